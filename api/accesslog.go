@@ -0,0 +1,93 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/urfave/negroni"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// HealthPaths are the paths of the health checks, removed from the access log if configured
+var HealthPaths = map[string]bool{"/health": true, "/healthz": true, "/ready": true, "/readyz": true, "/ping": true}
+
+// accessLogEntry is a request in the json access log
+type accessLogEntry struct {
+	Time      string  `json:"time"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	Bytes     int     `json:"bytes"`
+	LatencyMs float64 `json:"latency_ms"`
+	Remote    string  `json:"remote"`
+	User      string  `json:"user,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+	Referer   string  `json:"referer,omitempty"`
+	RequestId string  `json:"request_id,omitempty"`
+}
+
+// AccessLogger writes one line per request, with its status, size, latency and the identity
+// of its basic authentication user, the api key of the services
+type AccessLogger struct {
+	conf  config.AccessLog
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+// NewAccessLogger returns the access log of a server, written to the standard output
+//
+func NewAccessLogger(conf config.AccessLog) *AccessLogger {
+	return &AccessLogger{conf: conf, out: os.Stdout}
+}
+
+func (l *AccessLogger) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if l.conf.Format == "off" || (l.conf.ExcludeHealth && HealthPaths[r.URL.Path]) {
+		next(w, r)
+		return
+	}
+	start := time.Now()
+	next(w, r)
+	latency := time.Since(start)
+
+	status, size := http.StatusOK, 0
+	if rw, ok := w.(negroni.ResponseWriter); ok {
+		status, size = rw.Status(), rw.Size()
+	}
+	remote := ClientIP(r)
+	user, _, _ := r.BasicAuth()
+
+	var line []byte
+	if l.conf.Format == "json" {
+		line, _ = json.Marshal(accessLogEntry{
+			Time: start.UTC().Format(time.RFC3339Nano), Method: r.Method, Path: r.URL.RequestURI(),
+			Status: status, Bytes: size, LatencyMs: float64(latency.Microseconds()) / 1000,
+			Remote: remote, User: user, UserAgent: r.UserAgent(), Referer: r.Referer(), RequestId: RequestId(r),
+		})
+	} else {
+		line = []byte(remote + " - " + orDash(user) + " [" + start.Format("02/Jan/2006:15:04:05 -0700") + "] " +
+			strconv.Quote(r.Method+" "+r.URL.RequestURI()+" "+r.Proto) + " " + strconv.Itoa(status) + " " +
+			strconv.Itoa(size) + " " + strconv.Quote(r.Referer()) + " " + strconv.Quote(r.UserAgent()) + " " +
+			strconv.FormatFloat(latency.Seconds(), 'f', 3, 64) + " " + orDash(RequestId(r)))
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+// orDash returns a value of the combined format, "-" if empty
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// DefaultMaxBodySize is the default maximum size of the json and form bodies, in bytes
+const DefaultMaxBodySize = 1 << 20
+
+// ErrBodyTooLarge is returned while a request body is read, once it exceeds the maximum size
+var ErrBodyTooLarge = errors.New("The request body is too large")
+
+// limitedBody returns ErrBodyTooLarge once more than the maximum size is read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, ErrBodyTooLarge
+	}
+	return n, err
+}
+
+// isStructured checks that a request body is decoded in memory: json and form bodies,
+// as opposed to the uploaded files
+func isStructured(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "" {
+		// bodies without a known type are expected to be json
+		return true
+	}
+	return mediaType == ContentType_JSON || strings.HasSuffix(mediaType, "+json") ||
+		mediaType == ContentType_FORM_URL_ENCODED
+}
+
+// BodyLimit limits the size of the request bodies: maxBodySize for the json and form bodies
+// (DefaultMaxBodySize if 0), maxUploadSize for the other bodies (not limited if 0).
+// A request announcing a larger body is refused at once; otherwise reading past the limit
+// returns ErrBodyTooLarge.
+//
+func BodyLimit(maxBodySize int64, maxUploadSize int64) func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		limit := maxBodySize
+		if !isStructured(r.Header.Get("Content-Type")) {
+			limit = maxUploadSize
+		}
+		if limit > 0 && r.Body != nil {
+			if r.ContentLength > limit {
+				BodyError(w, r, ErrBodyTooLarge)
+				return
+			}
+			r.Body = &limitedBody{ReadCloser: r.Body, remaining: limit}
+		}
+		next(w, r)
+	}
+}
+
+// BodyError reports a request body which cannot be read or decoded: too large (413),
+// or malformed (400)
+//
+func BodyError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == ErrBodyTooLarge || strings.Contains(err.Error(), ErrBodyTooLarge.Error()) {
+		problem.Error(w, r, problem.Problem{Type: problem.BODY_TOO_LARGE, Title: "Request body too large", Detail: err.Error()}, http.StatusRequestEntityTooLarge)
+		return
+	}
+	problem.Error(w, r, problem.Problem{Type: problem.INVALID_BODY, Title: "Invalid request body", Detail: err.Error()}, http.StatusBadRequest)
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/urfave/negroni"
+
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+func TestBodyLimit(t *testing.T) {
+	n := negroni.New(negroni.HandlerFunc(BodyLimit(16, 32)))
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v interface{}
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			BodyError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	})
+	send := func(body string, contentType string, announced bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/contents/c1/license", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		if !announced {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		n.ServeHTTP(w, req)
+		return w
+	}
+
+	json20 := `{"id":"0123456789"}`
+	if w := send(`{"id":"1"}`, ContentType_LCP_JSON, true); w.Code != http.StatusOK {
+		t.Errorf("Expected a small body to be accepted, got %d", w.Code)
+	}
+	for _, announced := range []bool{true, false} {
+		w := send(json20, ContentType_LCP_JSON, announced)
+		var p problem.Problem
+		json.NewDecoder(w.Body).Decode(&p)
+		if w.Code != http.StatusRequestEntityTooLarge || w.Header().Get("Content-Type") != problem.ContentType_PROBLEM_JSON {
+			t.Errorf("Expected a large body to be refused (announced %t), got %d %+v", announced, w.Code, p)
+		}
+	}
+	// the uploads have their own limit
+	if w := send(json20, "application/epub+zip", true); w.Code != http.StatusOK {
+		t.Errorf("Expected an upload to be accepted, got %d", w.Code)
+	}
+	if w := send(json20+json20, "application/epub+zip", false); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a large upload to be refused, got %d", w.Code)
+	}
+}
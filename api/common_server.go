@@ -29,6 +29,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/abbot/go-http-auth"
 	"github.com/gorilla/mux"
@@ -37,7 +38,10 @@ import (
 	"github.com/technoweenie/grohl"
 	"github.com/urfave/negroni"
 
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/errorreport"
 	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/servicetoken"
 )
 
 const (
@@ -45,17 +49,53 @@ const (
 	ContentType_LSD_JSON  = "application/vnd.readium.license.status.v1.0+json"
 	ContentType_TEXT_HTML = "text/html"
 
-	ContentType_JSON = "application/json"
+	ContentType_JSON   = "application/json"
+	ContentType_NDJSON = "application/x-ndjson"
+	ContentType_CSV    = "text/csv"
+
+	ContentType_OPDS_JSON      = "application/opds+json"
+	ContentType_OPDS_AUTH_JSON = "application/opds-authentication+json"
 
 	ContentType_FORM_URL_ENCODED = "application/x-www-form-urlencoded"
+
+	ContentType_PKIX_CRL = "application/pkix-crl"
 )
 
+// HeaderTenant holds the tenant of a license in the notifications sent to the License Status Server
+const HeaderTenant = "X-Lcp-Tenant"
+
+// HeaderContentId holds the content of a license in the notifications sent to the License Status Server
+const HeaderContentId = "X-Lcp-Content-Id"
+
+// ConfigJs is the config.js script of the manage UI, generated by the server from its configuration. It is served
+// from memory rather than written to the static directory, which may be read-only, e.g. in a container.
+var ConfigJs string
+
+// serveConfigJs serves the config.js script of the manage UI, before the static files
+func serveConfigJs(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if ConfigJs == "" || r.URL.Path != "/config.js" || (r.Method != "GET" && r.Method != "HEAD") {
+		next(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == "GET" {
+		w.Write([]byte(ConfigJs))
+	}
+}
+
 type ServerRouter struct {
 	R *mux.Router
 	N *negroni.Negroni
+	// the logins seen by the rate limits and the replay of the idempotent requests,
+	// verified by the authenticators of the server
+	Logins *Logins
 }
 
-func CreateServerRouter(tplPath string) ServerRouter {
+// CreateServerRouter creates the router of a server and its middlewares; the static files of tplPath
+// are served if set, the cross-origin requests and the size of the request bodies are handled
+// as configured for the server
+func CreateServerRouter(tplPath string, info config.ServerInfo) ServerRouter {
 
 	r := mux.NewRouter()
 
@@ -69,6 +109,9 @@ func CreateServerRouter(tplPath string) ServerRouter {
 	//n := negroni.Classic() == negroni.New(negroni.NewRecovery(), negroni.NewLogger(), negroni.NewStatic(...))
 	n := negroni.New()
 
+	// the client address and the base url forwarded by the trusted proxies, first so that all the middlewares see them
+	n.Use(negroni.HandlerFunc(Forwarded(info.Proxy)))
+
 	// HTTP client can emit requests with custom header:
 	//X-Add-Delay: 300ms
 	//X-Add-Delay: 2.5s
@@ -77,19 +120,23 @@ func CreateServerRouter(tplPath string) ServerRouter {
 	// possibly useful middlewares:
 	// https://github.com/jeffbmartinez/delay
 
-	//https://github.com/urfave/negroni#recovery
-	recovery := negroni.NewRecovery()
-	recovery.PrintStack = true
-	recovery.ErrorHandlerFunc = problem.PanicReport
-	n.Use(recovery)
+	// one line per request, outside the recovery so that the panics are logged with their response
+	n.Use(NewAccessLogger(info.AccessLog))
 
-	//https://github.com/urfave/negroni#logger
-	n.Use(negroni.NewLogger())
+	// give an id to the requests, and answer the panics of the handlers with a problem+json 500
+	n.Use(negroni.HandlerFunc(Recovery))
+
+	// report the panics and the server errors to the error tracker, within the recovery
+	n.Use(negroni.HandlerFunc(errorreport.Middleware))
+
+	// deadline of the handlers, logging of the slow requests
+	n.Use(NewDeadline(info.Timeouts))
 
 	// debug: log request details
 	//n.Use(negroni.HandlerFunc(ExtraLogger))
 
 	if tplPath != "" {
+		n.Use(negroni.HandlerFunc(serveConfigJs))
 		//https://github.com/urfave/negroni#static
 		n.Use(negroni.NewStatic(http.Dir(tplPath)))
 	}
@@ -101,24 +148,51 @@ func CreateServerRouter(tplPath string) ServerRouter {
 	// IMPORT "github.com/rs/cors"
 	// //https://github.com/rs/cors#parameters
 	// [cors] logs depend on the Debug option (false/true)
-	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"PATCH", "HEAD", "POST", "GET", "OPTIONS", "PUT", "DELETE"},
-		AllowedHeaders: []string{"Range", "Content-Type", "Origin", "X-Requested-With", "Accept", "Accept-Language", "Content-Language", "Authorization"},
-		Debug:          false,
-	})
-	n.Use(c)
+	if !info.CORS.Disabled {
+		n.Use(cors.New(CORSOptions(info.CORS)))
+	}
+
+	n.Use(negroni.HandlerFunc(BodyLimit(info.MaxBodySize, info.MaxUploadSize)))
+
+	// rate limits of the clients, and replay of the requests sent again with the same idempotency key
+	logins := &Logins{}
+	n.Use(negroni.HandlerFunc(RateLimit(info.RateLimit, logins)))
+	n.Use(negroni.HandlerFunc(Idempotency(info.Idempotency, logins)))
 
 	n.UseHandler(r)
 
 	sr := ServerRouter{
-		R: r,
-		N: n,
+		R:      r,
+		N:      n,
+		Logins: logins,
 	}
 
 	return sr
 }
 
+// CORSOptions returns the options of the CORS middleware, the defaults completed by the configuration
+func CORSOptions(conf config.CORS) cors.Options {
+	opts := cors.Options{
+		AllowedOrigins:   []string{"*"},
+		AllowedMethods:   []string{"PATCH", "HEAD", "POST", "GET", "OPTIONS", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"Range", "Content-Type", "Origin", "X-Requested-With", "Accept", "Accept-Language", "Content-Language", "Authorization"},
+		ExposedHeaders:   conf.ExposedHeaders,
+		AllowCredentials: conf.AllowCredentials,
+		MaxAge:           conf.MaxAge,
+		Debug:            false,
+	}
+	if len(conf.AllowedOrigins) > 0 {
+		opts.AllowedOrigins = conf.AllowedOrigins
+	}
+	if len(conf.AllowedMethods) > 0 {
+		opts.AllowedMethods = conf.AllowedMethods
+	}
+	if len(conf.AllowedHeaders) > 0 {
+		opts.AllowedHeaders = conf.AllowedHeaders
+	}
+	return opts
+}
+
 func ExtraLogger(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
 	log.Print(" << -------------------")
@@ -169,3 +243,58 @@ func CheckAuth(authenticator *auth.BasicAuth, w http.ResponseWriter, r *http.Req
 	grohl.Log(grohl.Data{"user": username})
 	return true
 }
+
+// Logins verifies the credentials of the requests for the middlewares which run before the handlers
+// authenticate them; Verify is set by the server once its authenticators are created, before it serves
+type Logins struct {
+	Verify func(r *http.Request) string
+}
+
+// Login returns the login of a request whose credentials are valid, empty if they are missing or wrong
+func (l *Logins) Login(r *http.Request) string {
+	if l == nil || l.Verify == nil {
+		return ""
+	}
+	return l.Verify(r)
+}
+
+// ServiceLogin returns the login of a request accepted by CheckServiceAuth, without answering the request:
+// the issuer of a valid service token, or the user of valid basic authentication credentials
+func ServiceLogin(authenticator *auth.BasicAuth, audience string, r *http.Request) string {
+	conf := config.ServiceTokensConfig()
+	if token := servicetoken.FromRequest(r); token != "" {
+		claims, err := servicetoken.Verify(token, audience, time.Now(), conf)
+		if err != nil {
+			return ""
+		}
+		return "service:" + claims.Issuer
+	}
+	if conf.RejectBasicAuth {
+		return ""
+	}
+	return authenticator.CheckAuth(r)
+}
+
+// CheckServiceAuth checks the credentials of a request sent by another server: a service token issued
+// for this server (audience), or the basic authentication unless the configuration rejects it
+func CheckServiceAuth(authenticator *auth.BasicAuth, audience string, w http.ResponseWriter, r *http.Request) bool {
+	conf := config.ServiceTokensConfig()
+	if token := servicetoken.FromRequest(r); token != "" {
+		claims, err := servicetoken.Verify(token, audience, time.Now(), conf)
+		if err != nil {
+			grohl.Log(grohl.Data{"error": err.Error(), "method": r.Method, "path": r.URL.Path})
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+authenticator.Realm+`"`)
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusUnauthorized)
+			return false
+		}
+		grohl.Log(grohl.Data{"service": claims.Issuer})
+		return true
+	}
+	if conf.RejectBasicAuth {
+		grohl.Log(grohl.Data{"error": "Unauthorized", "method": r.Method, "path": r.URL.Path})
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+authenticator.Realm+`"`)
+		problem.Error(w, r, problem.Problem{Detail: "A service token is required"}, http.StatusUnauthorized)
+		return false
+	}
+	return CheckAuth(authenticator, w, r)
+}
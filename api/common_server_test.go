@@ -0,0 +1,121 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/urfave/negroni"
+)
+
+func preflight(sr ServerRouter, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("OPTIONS", "/contents", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	w := httptest.NewRecorder()
+	sr.N.ServeHTTP(w, req)
+	return w
+}
+
+func TestCORS(t *testing.T) {
+	sr := CreateServerRouter("", config.ServerInfo{})
+	if w := preflight(sr, "http://reader.example.com"); w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Expected any origin to be allowed by default, got %v", w.Header())
+	}
+
+	conf := config.CORS{
+		AllowedOrigins:   []string{"https://admin.example.com"},
+		AllowCredentials: true,
+		MaxAge:           600,
+	}
+	sr = CreateServerRouter("", config.ServerInfo{CORS: conf})
+	w := preflight(sr, "https://admin.example.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://admin.example.com" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" || w.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("Unexpected preflight response %v", w.Header())
+	}
+	if w = preflight(sr, "http://other.example.com"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected another origin to be refused, got %v", w.Header())
+	}
+
+	sr = CreateServerRouter("", config.ServerInfo{CORS: config.CORS{Disabled: true}})
+	sr.R.HandleFunc("/contents", func(w http.ResponseWriter, r *http.Request) {}).Methods("OPTIONS")
+	if w = preflight(sr, "http://reader.example.com"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected no CORS headers when disabled, got %v", w.Header())
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	sr := CreateServerRouter("", config.ServerInfo{})
+	panics := Panics.Value()
+
+	w := httptest.NewRecorder()
+	sr.N.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+	if w.Code != http.StatusInternalServerError || w.Header().Get("Content-Type") != problem.ContentType_PROBLEM_JSON {
+		t.Fatalf("Expected a problem+json 500, got %d %v", w.Code, w.Header())
+	}
+	id := w.Header().Get(HeaderRequestId)
+	if id == "" || !strings.Contains(w.Body.String(), id) {
+		t.Errorf("Expected the id of the request in the response, got %q %s", id, w.Body.String())
+	}
+	if Panics.Value() != panics+1 {
+		t.Errorf("Expected the panic to be counted")
+	}
+
+	req := httptest.NewRequest("GET", "/missing", nil)
+	req.Header.Set(HeaderRequestId, "proxy-42")
+	w = httptest.NewRecorder()
+	sr.N.ServeHTTP(w, req)
+	if w.Header().Get(HeaderRequestId) != "proxy-42" {
+		t.Errorf("Expected the id of the proxy to be kept, got %q", w.Header().Get(HeaderRequestId))
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	serve := func(conf config.AccessLog, path string) string {
+		var out bytes.Buffer
+		logger := NewAccessLogger(conf)
+		logger.out = &out
+		n := negroni.New(logger, negroni.HandlerFunc(Recovery))
+		n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("hello"))
+		})
+		req := httptest.NewRequest("PUT", path, nil)
+		req.SetBasicAuth("distributor", "secret")
+		req.Header.Set(HeaderRequestId, "req-1")
+		n.ServeHTTP(httptest.NewRecorder(), req)
+		return out.String()
+	}
+
+	line := serve(config.AccessLog{}, "/contents/c1?x=1")
+	if !strings.HasPrefix(line, "192.0.2.1 - distributor [") ||
+		!strings.Contains(line, `"PUT /contents/c1?x=1 HTTP/1.1" 201 5 "" ""`) || !strings.HasSuffix(line, " req-1\n") {
+		t.Errorf("Unexpected combined log %q", line)
+	}
+
+	var entry accessLogEntry
+	if err := json.Unmarshal([]byte(serve(config.AccessLog{Format: "json"}, "/contents/c1")), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Method != "PUT" || entry.Path != "/contents/c1" || entry.Status != 201 || entry.Bytes != 5 ||
+		entry.User != "distributor" || entry.RequestId != "req-1" || entry.Remote != "192.0.2.1" {
+		t.Errorf("Unexpected json log %+v", entry)
+	}
+
+	if line = serve(config.AccessLog{ExcludeHealth: true}, "/health"); line != "" {
+		t.Errorf("Expected the health checks to be excluded, got %q", line)
+	}
+	if line = serve(config.AccessLog{Format: "off"}, "/contents/c1"); line != "" {
+		t.Errorf("Expected no log, got %q", line)
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"strings"
+)
+
+// MatchETag checks an entity tag against the value of an If-Match header,
+// which is a list of entity tags or "*" (RFC 7232). Weak tags are compared as strong ones.
+//
+func MatchETag(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
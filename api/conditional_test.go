@@ -0,0 +1,23 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"testing"
+)
+
+func TestMatchETag(t *testing.T) {
+	etag := `"abc"`
+	for _, header := range []string{`"abc"`, `*`, `"def", "abc"`, `W/"abc"`} {
+		if !MatchETag(header, etag) {
+			t.Errorf("Expected %s to match %s", header, etag)
+		}
+	}
+	for _, header := range []string{`"def"`, `abc`, `"ab"`} {
+		if MatchETag(header, etag) {
+			t.Errorf("Did not expect %s to match %s", header, etag)
+		}
+	}
+}
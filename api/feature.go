@@ -0,0 +1,64 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/feature"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// FeatureRollout is the body of a request setting the rollout of a feature
+type FeatureRollout struct {
+	Rollout *string `json:"rollout"`
+}
+
+// FeaturesHandler returns the routes of the features stored in the database: GET /features returns the rollouts
+// applied by the server, PUT /features/{name} stores the rollout of a feature, e.g. {"rollout": "* 10%"},
+// and DELETE /features/{name} removes it, so that the configuration applies again.
+func FeaturesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		switch {
+		case r.Method == http.MethodPut && name != "":
+			var body FeatureRollout
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				BodyError(w, r, err)
+				return
+			}
+			if body.Rollout == nil {
+				problem.Error(w, r, problem.Problem{Detail: "Missing rollout"}, http.StatusBadRequest)
+				return
+			}
+			if err := feature.CheckRollout(*body.Rollout); err != nil {
+				problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+				return
+			}
+			if err := feature.Set(name, *body.Rollout); err != nil {
+				StoreError(w, r, err)
+				return
+			}
+			writeFeatures(w)
+		case r.Method == http.MethodDelete && name != "":
+			if err := feature.Delete(name); err != nil {
+				StoreError(w, r, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeFeatures(w)
+		}
+	}
+}
+
+func writeFeatures(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", ContentType_JSON)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(feature.Rollouts())
+}
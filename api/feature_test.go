@@ -0,0 +1,87 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/feature"
+)
+
+func TestFeatures(t *testing.T) {
+	config.Config.LcpServer.Database = "sqlite3://:memory:"
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	fs, err := feature.Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = feature.Use(fs); err != nil {
+		t.Fatal(err)
+	}
+	defer feature.Use(nil)
+	config.Config.Features = map[string]string{feature.Profile10: "https://a.example.com"}
+	defer func() { config.Config.Features = nil }()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/features", FeaturesHandler()).Methods("GET")
+	router.HandleFunc("/features/{name}", FeaturesHandler()).Methods("PUT", "DELETE")
+	send := func(method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	rollouts := func(w *httptest.ResponseRecorder) map[string]string {
+		var m map[string]string
+		if err := json.NewDecoder(w.Body).Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	if m := rollouts(send("GET", "/features", "")); len(m) != 1 || m[feature.Profile10] != "https://a.example.com" {
+		t.Errorf("Expected the rollouts of the configuration, got %v", m)
+	}
+	w := send("PUT", "/features/"+feature.StorageParts, `{"rollout":"tenant-a 10%"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the rollout to be stored, got %d %s", w.Code, w.Body.String())
+	}
+	if m := rollouts(w); len(m) != 2 || m[feature.StorageParts] != "tenant-a 10%" {
+		t.Errorf("Expected the stored rollout, got %v", m)
+	}
+	if !feature.Enabled(feature.StorageParts, "tenant-a") || feature.Enabled(feature.StorageParts, "") {
+		t.Error("Expected the stored rollout to apply")
+	}
+
+	if w = send("PUT", "/features/"+feature.StorageParts, `{"rollout":"200%"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid percentage to be refused, got %d", w.Code)
+	}
+	if w = send("PUT", "/features/"+feature.StorageParts, `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a missing rollout to be refused, got %d", w.Code)
+	}
+
+	if w = send("DELETE", "/features/"+feature.StorageParts, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the rollout to be removed, got %d", w.Code)
+	}
+	if w = send("DELETE", "/features/"+feature.StorageParts, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the feature not to be found, got %d", w.Code)
+	}
+	if !feature.Enabled(feature.StorageParts, "") {
+		t.Error("Expected the default to apply")
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// HeaderForwardedBase holds the base url forwarded by a trusted proxy, set by the Forwarded middleware
+const HeaderForwardedBase = "X-Lcp-Forwarded-Base"
+
+// the headers set by the reverse proxies
+const (
+	headerForwardedFor   = "X-Forwarded-For"
+	headerForwardedProto = "X-Forwarded-Proto"
+	headerForwardedHost  = "X-Forwarded-Host"
+)
+
+// trustedNetworks parses the trusted proxies of the configuration, IP addresses or CIDR ranges
+func trustedNetworks(proxies []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(p); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+func trusted(networks []*net.IPNet, host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client of a request, forwarded by the trusted proxies
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// firstValue returns the first value of a header which may be repeated or hold a list
+func firstValue(r *http.Request, name string) string {
+	return strings.TrimSpace(strings.SplitN(r.Header.Get(name), ",", 2)[0])
+}
+
+// validHost checks a forwarded host, e.g. "lcp.example.com" or "lcp.example.com:8443"
+func validHost(host string) bool {
+	if host == "" || strings.ContainsAny(host, "/\\?#@ ") {
+		return false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host != ""
+}
+
+// Forwarded honors the X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers of the requests
+// sent by the trusted proxies: the client address of the request becomes the address forwarded by the proxies,
+// the first one from the right which is not a trusted proxy, so that the logs and the rate limits see the client.
+// If ForwardedLinks is set, the forwarded scheme and host make the base url of the absolute links (see BaseURL).
+// The forwarded headers of the other requests are removed, so that a client cannot spoof them.
+//
+func Forwarded(conf config.Proxy) func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	networks := trustedNetworks(conf.TrustedProxies)
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		r.Header.Del(HeaderForwardedBase)
+		peer, port, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !trusted(networks, peer) {
+			r.Header.Del(headerForwardedFor)
+			r.Header.Del(headerForwardedProto)
+			r.Header.Del(headerForwardedHost)
+			next(w, r)
+			return
+		}
+		// the proxies append the address of their client: the client is the last untrusted address
+		client := peer
+		hops := strings.Split(strings.Join(r.Header.Values(headerForwardedFor), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			client = hop
+			if !trusted(networks, hop) {
+				break
+			}
+		}
+		r.RemoteAddr = net.JoinHostPort(client, port)
+
+		if conf.ForwardedLinks {
+			proto, host := firstValue(r, headerForwardedProto), firstValue(r, headerForwardedHost)
+			if proto == "" {
+				proto = "http"
+				if r.TLS != nil {
+					proto = "https"
+				}
+			}
+			if (proto == "http" || proto == "https") && validHost(host) {
+				r.Header.Set(HeaderForwardedBase, proto+"://"+host)
+			}
+		}
+		next(w, r)
+	}
+}
+
+// BaseURL returns the base url of the absolute links of a request: the base url forwarded by a trusted proxy,
+// or else the public base url of the server
+func BaseURL(r *http.Request, publicBaseURL string) string {
+	if r != nil {
+		if base := r.Header.Get(HeaderForwardedBase); base != "" {
+			return base
+		}
+	}
+	return publicBaseURL
+}
+
+// RebaseURL moves a link on the public base url of the server to the base url of a request
+func RebaseURL(r *http.Request, href string, publicBaseURL string) string {
+	base := BaseURL(r, publicBaseURL)
+	if base == publicBaseURL || publicBaseURL == "" || !strings.HasPrefix(href, publicBaseURL) {
+		return href
+	}
+	return base + strings.TrimPrefix(href, publicBaseURL)
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/urfave/negroni"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestForwarded(t *testing.T) {
+	conf := config.Proxy{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}, ForwardedLinks: true}
+	var seen *http.Request
+	n := negroni.New(negroni.HandlerFunc(Forwarded(conf)))
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = r })
+	send := func(remote string, headers map[string]string) *http.Request {
+		req := httptest.NewRequest("GET", "/licenses/1", nil)
+		req.RemoteAddr = remote + ":1234"
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		n.ServeHTTP(httptest.NewRecorder(), req)
+		return seen
+	}
+	forwarded := map[string]string{
+		"X-Forwarded-For":   "203.0.113.9, 198.51.100.7, 10.1.2.3",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "lcp.example.com",
+	}
+
+	// a trusted proxy: the client is the last address which is not a trusted proxy
+	r := send("192.168.1.1", forwarded)
+	if ClientIP(r) != "198.51.100.7" {
+		t.Errorf("Expected the forwarded client, got %s", ClientIP(r))
+	}
+	if base := BaseURL(r, "http://localhost:8989"); base != "https://lcp.example.com" {
+		t.Errorf("Expected the forwarded base url, got %s", base)
+	}
+	if href := RebaseURL(r, "http://localhost:8989/contents/1/download", "http://localhost:8989"); href != "https://lcp.example.com/contents/1/download" {
+		t.Errorf("Expected a link on the forwarded base url, got %s", href)
+	}
+	if href := RebaseURL(r, "https://cdn.example.com/1.epub", "http://localhost:8989"); href != "https://cdn.example.com/1.epub" {
+		t.Errorf("Expected a link elsewhere to be kept, got %s", href)
+	}
+
+	// a client spoofing the headers
+	headers := map[string]string{HeaderForwardedBase: "https://evil.example.com"}
+	for name, value := range forwarded {
+		headers[name] = value
+	}
+	r = send("203.0.113.9", headers)
+	if ClientIP(r) != "203.0.113.9" || r.Header.Get("X-Forwarded-For") != "" {
+		t.Errorf("Expected the forwarded headers to be ignored, got %s %v", ClientIP(r), r.Header)
+	}
+	if base := BaseURL(r, "http://localhost:8989"); base != "http://localhost:8989" {
+		t.Errorf("Expected the public base url, got %s", base)
+	}
+
+	// an invalid forwarded host or scheme is ignored
+	r = send("10.0.0.5", map[string]string{"X-Forwarded-Proto": "javascript", "X-Forwarded-Host": "lcp.example.com"})
+	if r.Header.Get(HeaderForwardedBase) != "" {
+		t.Errorf("Expected no forwarded base url, got %s", r.Header.Get(HeaderForwardedBase))
+	}
+	r = send("10.0.0.5", map[string]string{"X-Forwarded-Host": "evil.example.com/path"})
+	if r.Header.Get(HeaderForwardedBase) != "" {
+		t.Errorf("Expected no forwarded base url, got %s", r.Header.Get(HeaderForwardedBase))
+	}
+
+	// the links are not forwarded unless configured
+	n = negroni.New(negroni.HandlerFunc(Forwarded(config.Proxy{TrustedProxies: conf.TrustedProxies})))
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = r })
+	r = send("10.0.0.5", forwarded)
+	if ClientIP(r) != "198.51.100.7" || r.Header.Get(HeaderForwardedBase) != "" {
+		t.Errorf("Expected the forwarded client only, got %s %s", ClientIP(r), r.Header.Get(HeaderForwardedBase))
+	}
+}
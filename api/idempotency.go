@@ -0,0 +1,191 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/shared"
+)
+
+// HeaderIdempotencyKey identifies a request which the client may send again
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+// HeaderIdempotentReplayed is set on the responses replayed for an idempotency key
+const HeaderIdempotentReplayed = "Idempotent-Replayed"
+
+// DefaultIdempotencyTTL is the time the responses are kept, if the configuration does not set it
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// the responses larger than this size are not kept: the request is processed again if it is sent again
+const maxIdempotentResponse = 1 << 20
+
+// idempotentResponse is the response kept for an idempotency key; the fingerprint is the hash of the request body
+type idempotentResponse struct {
+	Pending     bool        `json:"pending,omitempty"`
+	Fingerprint string      `json:"fingerprint,omitempty"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// idempotencyKey returns the key of the response to a request of a verified user in the shared store:
+// the same key sent by another client, or for another route, is another request
+func idempotencyKey(r *http.Request, user string, key string) string {
+	sum := sha256.Sum256([]byte(user + "\n" + r.Method + " " + r.URL.Path + "\n" + key))
+	return "idempotency:" + hex.EncodeToString(sum[:])
+}
+
+// fingerprint reads the rest of a request body and returns the hash of the body
+func fingerprint(h hash.Hash, body io.Reader) string {
+	if body != nil {
+		io.Copy(h, body)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Idempotency replays the response to a POST, PUT or PATCH request sent again with the same Idempotency-Key header,
+// e.g. by a client which did not get the response: the request is processed once. A request sent again while it is
+// processed gets a 409 problem, and a key reused with another body gets a 422 problem. The responses are kept
+// in the shared store, across the instances of the server if it is Redis; the server errors are not kept.
+// Only the requests whose credentials are valid are replayed, the other ones are processed as usual.
+//
+func Idempotency(conf config.Idempotency, logins *Logins) func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	ttl := time.Duration(conf.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		key := r.Header.Get(HeaderIdempotencyKey)
+		if !conf.Enabled || key == "" || (r.Method != "POST" && r.Method != "PUT" && r.Method != "PATCH") {
+			next(w, r)
+			return
+		}
+		user := logins.Login(r)
+		if user == "" {
+			next(w, r)
+			return
+		}
+		store := shared.Default()
+		storeKey := idempotencyKey(r, user, key)
+		pending, _ := json.Marshal(idempotentResponse{Pending: true})
+		ok, err := store.SetNX(storeKey, pending, ttl)
+		if err != nil {
+			log.Println("Idempotency: " + err.Error())
+			next(w, r)
+			return
+		}
+		if !ok {
+			replayResponse(w, r, store, storeKey)
+			return
+		}
+
+		// the body is hashed while the handler reads it
+		h := sha256.New()
+		if r.Body != nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, h), r.Body}
+		}
+		// the headers set by the middlewares, e.g. the request id, are not replayed
+		before := w.Header().Clone()
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		kept := false
+		defer func() {
+			if !kept {
+				// the request can be sent again, also after a panic of the handler, which goes on to the recovery
+				store.DeleteIf(storeKey, pending)
+			}
+		}()
+		next(rec, r)
+
+		if rec.status >= 500 || rec.overflow {
+			return
+		}
+		resp := idempotentResponse{Fingerprint: fingerprint(h, r.Body), Status: rec.status, Header: make(http.Header), Body: rec.body.Bytes()}
+		for name, values := range w.Header() {
+			if _, ok := before[name]; !ok {
+				resp.Header[name] = values
+			}
+		}
+		doc, _ := json.Marshal(resp)
+		if err = store.Set(storeKey, doc, ttl); err != nil {
+			log.Println("Idempotency: " + err.Error())
+			return
+		}
+		kept = true
+	}
+}
+
+// replayResponse sends the response kept for an idempotency key
+func replayResponse(w http.ResponseWriter, r *http.Request, store shared.Store, storeKey string) {
+	doc, err := store.Get(storeKey)
+	var resp idempotentResponse
+	if err == nil && doc != nil {
+		err = json.Unmarshal(doc, &resp)
+	}
+	if err != nil || doc == nil || resp.Pending {
+		problem.Error(w, r, problem.Problem{Detail: "A request with the same idempotency key is being processed"}, http.StatusConflict)
+		return
+	}
+	if fingerprint(sha256.New(), r.Body) != resp.Fingerprint {
+		problem.Error(w, r, problem.Problem{Type: problem.IDEMPOTENCY_MISMATCH, Detail: "The idempotency key was used for a request with another body"}, http.StatusUnprocessableEntity)
+		return
+	}
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(HeaderIdempotentReplayed, "true")
+	w.WriteHeader(resp.Status)
+	io.Copy(w, bytes.NewReader(resp.Body))
+}
+
+// responseRecorder forwards a response and keeps a copy of it, up to maxIdempotentResponse bytes
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if !rec.overflow {
+		if rec.body.Len()+len(b) > maxIdempotentResponse {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush sends the response written so far, for the streamed responses
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives access to the response writer of the server, for http.NewResponseController
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
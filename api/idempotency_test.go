@@ -0,0 +1,127 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/urfave/negroni"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/shared"
+)
+
+func TestIdempotency(t *testing.T) {
+	shared.Use(shared.NewMemory())
+	var mutex sync.Mutex
+	calls := 0
+	count := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return calls
+	}
+	started, block := make(chan struct{}), make(chan struct{})
+	n := negroni.New(negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		// the recovery of the server
+		defer func() {
+			if recover() != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}()
+		next(w, r)
+	}), negroni.HandlerFunc(Idempotency(config.Idempotency{Enabled: true}, testLogins())))
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) == "block" {
+			// the key is taken: the duplicate request may be sent
+			close(started)
+			<-block
+		}
+		mutex.Lock()
+		calls++
+		call := calls
+		mutex.Unlock()
+		if string(body) == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if string(body) == "panic" {
+			panic("handler failure")
+		}
+		w.Header().Set("Content-Type", ContentType_JSON)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"call":` + strconv.Itoa(call) + `}`))
+	})
+	sendAs := func(password string, key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/contents/c1/license", strings.NewReader(body))
+		req.SetBasicAuth("distributor", password)
+		if key != "" {
+			req.Header.Set(HeaderIdempotencyKey, key)
+		}
+		w := httptest.NewRecorder()
+		n.ServeHTTP(w, req)
+		return w
+	}
+	send := func(key string, body string) *httptest.ResponseRecorder {
+		return sendAs("secret", key, body)
+	}
+
+	first := send("k1", "license")
+	replayed := send("k1", "license")
+	if count() != 1 || replayed.Code != http.StatusCreated || replayed.Body.String() != first.Body.String() ||
+		replayed.Header().Get(HeaderIdempotentReplayed) != "true" || replayed.Header().Get("Content-Type") != ContentType_JSON {
+		t.Errorf("Expected the response to be replayed, got %d calls, %d %s", count(), replayed.Code, replayed.Body.String())
+	}
+	if w := send("k1", "another license"); w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), problem.IDEMPOTENCY_MISMATCH) {
+		t.Errorf("Expected the key to be refused for another body, got %d %s", w.Code, w.Body.String())
+	}
+	// without key, or with another key, the request is processed again
+	send("", "license")
+	send("k2", "license")
+	if count() != 3 {
+		t.Errorf("Expected the requests to be processed, got %d calls", count())
+	}
+	// a server error is not kept
+	send("k3", "fail")
+	send("k3", "fail")
+	if count() != 5 {
+		t.Errorf("Expected the failed request to be processed again, got %d calls", count())
+	}
+
+	// the response is not replayed to a client whose credentials are wrong
+	if w := sendAs("wrong", "k1", "license"); count() != 6 || w.Header().Get(HeaderIdempotentReplayed) != "" {
+		t.Errorf("Expected the request to be processed, got %d calls", count())
+	}
+	// a request whose handler panics can be sent again
+	if w := send("k5", "panic"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected the panic to reach the recovery, got %d", w.Code)
+	}
+	if w := send("k5", "panic"); w.Code != http.StatusInternalServerError || count() != 8 {
+		t.Errorf("Expected the request to be processed again, got %d after %d calls", w.Code, count())
+	}
+
+	// a request sent again while it is processed
+	done := make(chan struct{})
+	go func() {
+		send("k4", "block")
+		close(done)
+	}()
+	<-started
+	if w := send("k4", "block"); w.Code != http.StatusConflict {
+		t.Errorf("Expected a conflict, got %d", w.Code)
+	}
+	close(block)
+	<-done
+	if count() != 9 {
+		t.Errorf("Expected the request to be processed once, got %d calls", count())
+	}
+}
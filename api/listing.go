@@ -0,0 +1,159 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/dbutils"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// the number of items of a page of a list: by default, at most
+const (
+	DefaultPerPage = 30
+	MaxPerPage     = 1000
+)
+
+// the errors of the listing parameters
+var (
+	ErrBadPage   = errors.New("page and per_page must be positive integers, per_page at most 1000")
+	ErrBadCursor = errors.New("A cursor cannot be combined with a page number or a sort")
+)
+
+// ListParams are the query parameters common to the listing endpoints:
+//	page: page number, starting at 1; 0 if not given
+//	per_page: number of items per page
+//	after: cursor of the page, given by the "next" link of the endpoints which support it
+//	sort: field of the sort, prefixed by "-" for a descending order, e.g. sort=-issued
+//	fields: comma separated names of the fields of the items to return, all of them if empty
+//
+type ListParams struct {
+	Page    int
+	PerPage int
+	After   string
+	Sort    string
+	Fields  []string
+}
+
+// ParseListParams returns the listing parameters of a request; the sort field is checked by the store.
+// With a defaultPerPage of 0, the list is not paginated unless a page or per_page is requested.
+//
+func ParseListParams(r *http.Request, defaultPerPage int) (ListParams, error) {
+	p := ListParams{PerPage: defaultPerPage, After: r.FormValue("after"), Sort: r.FormValue("sort")}
+	if page := r.FormValue("page"); page != "" {
+		n, err := strconv.Atoi(page)
+		if err != nil || n < 1 {
+			return p, ErrBadPage
+		}
+		p.Page = n
+	}
+	if perPage := r.FormValue("per_page"); perPage != "" {
+		n, err := strconv.Atoi(perPage)
+		if err != nil || n < 1 || n > MaxPerPage {
+			return p, ErrBadPage
+		}
+		p.PerPage = n
+	}
+	if p.Page != 0 && p.PerPage == 0 {
+		p.PerPage = DefaultPerPage
+	}
+	if p.After != "" && (p.Page != 0 || p.Sort != "") {
+		return p, ErrBadCursor
+	}
+	for _, field := range strings.Split(r.FormValue("fields"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			p.Fields = append(p.Fields, field)
+		}
+	}
+	return p, nil
+}
+
+// Listing returns the sort and the page of the store matching the parameters
+func (p ListParams) Listing() dbutils.Listing {
+	page := p.Page
+	if page < 1 {
+		page = 1
+	}
+	return dbutils.Listing{Sort: p.Sort, Limit: p.PerPage, Offset: (page - 1) * p.PerPage}
+}
+
+// PageLinks returns the "next" and "previous" links of a page of count items, for the Link header;
+// the other parameters of the request are kept
+//
+func (p ListParams) PageLinks(r *http.Request, count int) string {
+	page := p.Page
+	if page < 1 {
+		page = 1
+	}
+	var links []string
+	if p.PerPage > 0 && count == p.PerPage {
+		links = append(links, Link(r, "next", "page", strconv.Itoa(page+1)))
+	}
+	if page > 1 {
+		links = append(links, Link(r, "previous", "page", strconv.Itoa(page-1)))
+	}
+	return strings.Join(links, ", ")
+}
+
+// Link returns a link to the resource of a request with a query parameter changed, for the Link header
+//
+func Link(r *http.Request, rel string, name string, value string) string {
+	query := r.URL.Query()
+	query.Set(name, value)
+	if name == "after" {
+		query.Del("page")
+	}
+	return "<" + r.URL.Path + "?" + query.Encode() + ">; rel=\"" + rel + "\"; title=\"" + rel + "\""
+}
+
+// SelectFields returns the members of the json form of a list of items which are named in fields;
+// the items are returned unchanged if fields is empty
+//
+func SelectFields(items interface{}, fields []string) (interface{}, error) {
+	if len(fields) == 0 {
+		return items, nil
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	var all []map[string]json.RawMessage
+	if err = json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	selected := make([]map[string]json.RawMessage, len(all))
+	for i, item := range all {
+		selected[i] = make(map[string]json.RawMessage, len(fields))
+		for _, field := range fields {
+			if value, ok := item[field]; ok {
+				selected[i][field] = value
+			}
+		}
+	}
+	return selected, nil
+}
+
+// WriteList writes a page of a list in json, with its links and the selected fields of its items
+//
+func WriteList(w http.ResponseWriter, r *http.Request, items interface{}, links string, fields []string) {
+	list, err := SelectFields(items, fields)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if links != "" {
+		w.Header().Set("Link", links)
+	}
+	w.Header().Set("Content-Type", ContentType_JSON)
+	enc := json.NewEncoder(w)
+	// do not escape characters
+	enc.SetEscapeHTML(false)
+	enc.Encode(list)
+}
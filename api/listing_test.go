@@ -0,0 +1,62 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseListParams(t *testing.T) {
+	r := httptest.NewRequest("GET", "/licenses/?page=3&per_page=20&sort=-issued&fields=id,+issued,", nil)
+	p, err := ParseListParams(r, DefaultPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Page != 3 || p.PerPage != 20 || p.Sort != "-issued" || strings.Join(p.Fields, ",") != "id,issued" {
+		t.Errorf("Unexpected parameters %+v", p)
+	}
+	if l := p.Listing(); l.Limit != 20 || l.Offset != 40 || l.Sort != "-issued" {
+		t.Errorf("Unexpected listing %+v", l)
+	}
+	links := p.PageLinks(r, 20)
+	if !strings.Contains(links, "page=4") || !strings.Contains(links, "page=2") || !strings.Contains(links, "sort=-issued") {
+		t.Errorf("Unexpected links %s", links)
+	}
+
+	// the lists without a default page size are not paginated
+	p, err = ParseListParams(httptest.NewRequest("GET", "/contents", nil), 0)
+	if err != nil || p.Listing().Limit != 0 || p.PageLinks(r, 0) != "" {
+		t.Errorf("Unexpected parameters %+v, %v", p, err)
+	}
+	p, err = ParseListParams(httptest.NewRequest("GET", "/contents?page=2", nil), 0)
+	if err != nil || p.PerPage != DefaultPerPage {
+		t.Errorf("Expected the default page size, got %+v, %v", p, err)
+	}
+
+	for _, query := range []string{"page=0", "page=a", "per_page=0", "per_page=1001", "after=abc&page=2", "after=abc&sort=id"} {
+		if _, err = ParseListParams(httptest.NewRequest("GET", "/licenses/?"+query, nil), DefaultPerPage); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	type item struct {
+		Id    string `json:"id"`
+		Title string `json:"title"`
+		Size  int    `json:"size"`
+	}
+	list, err := SelectFields([]item{{"1", "one", 1}, {"2", "two", 2}}, []string{"id", "size", "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(list)
+	if string(data) != `[{"id":"1","size":1},{"id":"2","size":2}]` {
+		t.Errorf("Unexpected fields %s", data)
+	}
+}
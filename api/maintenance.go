@@ -0,0 +1,92 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/maintenance"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// CheckMaintenance refuses a request which writes to the database while the server is in maintenance,
+// with a 503 problem and a Retry-After header, and returns false; it returns true otherwise
+//
+func CheckMaintenance(w http.ResponseWriter, r *http.Request, server string) bool {
+	st, active := maintenance.Active(server)
+	if !active {
+		return true
+	}
+	detail := st.Message
+	if detail == "" {
+		detail = "The server is in maintenance, retry later"
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(st.RetryIn(clock.Now())/time.Second)))
+	problem.Error(w, r, problem.Problem{Detail: detail}, http.StatusServiceUnavailable)
+	return false
+}
+
+// MaintenanceHandler returns the maintenance route of a server: GET returns the maintenance state,
+// PUT starts a maintenance, with an optional state in the body (message, retry_after and until),
+// and DELETE ends the maintenance. The message and retry_after default to the configuration of the server.
+//
+func MaintenanceHandler(server string, conf config.Maintenance) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			var st maintenance.State
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+					BodyError(w, r, err)
+					return
+				}
+			}
+			if st.Message == "" {
+				st.Message = conf.Message
+			}
+			if st.RetryAfter == 0 {
+				st.RetryAfter = conf.RetryAfter
+			}
+			if st.RetryAfter < 0 {
+				problem.Error(w, r, problem.Problem{Detail: "Negative retry_after"}, http.StatusBadRequest)
+				return
+			}
+			var err error
+			if st, err = maintenance.Start(server, st); err != nil {
+				if err == maintenance.ErrEnded {
+					problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+					return
+				}
+				StoreError(w, r, err)
+				return
+			}
+			writeMaintenance(w, st)
+		case http.MethodDelete:
+			if err := maintenance.Stop(server); err != nil {
+				StoreError(w, r, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			st, err := maintenance.Get(server)
+			if err != nil {
+				StoreError(w, r, err)
+				return
+			}
+			writeMaintenance(w, st)
+		}
+	}
+}
+
+func writeMaintenance(w http.ResponseWriter, st maintenance.State) {
+	w.Header().Set("Content-Type", ContentType_JSON)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(st)
+}
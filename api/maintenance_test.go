@@ -0,0 +1,64 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/maintenance"
+	"github.com/readium/readium-lcp-server/shared"
+)
+
+func TestMaintenance(t *testing.T) {
+	shared.Use(shared.NewMemory())
+	handler := MaintenanceHandler("lcp", config.Maintenance{RetryAfter: 600})
+	send := func(method string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, "/maintenance", strings.NewReader(body)))
+		return w
+	}
+	check := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if CheckMaintenance(w, httptest.NewRequest("POST", "/contents/1/license", nil), "lcp") {
+			w.WriteHeader(http.StatusCreated)
+		}
+		return w
+	}
+
+	if w := check(); w.Code != http.StatusCreated {
+		t.Fatalf("Expected the request to be served, got %d", w.Code)
+	}
+	w := send("PUT", `{"message":"Database upgrade"}`)
+	var st maintenance.State
+	if err := json.NewDecoder(w.Body).Decode(&st); err != nil || !st.Enabled || st.RetryAfter != 600 || st.Until == nil {
+		t.Fatalf("Expected a maintenance with the configured retry_after, got %d %+v %v", w.Code, st, err)
+	}
+	w = check()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "600" || !strings.Contains(w.Body.String(), "Database upgrade") {
+		t.Errorf("Expected the request to be refused, got %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+	// the maintenance of a server does not apply to the others
+	if _, active := maintenance.Active("lsd"); active {
+		t.Error("Expected the lsd server not to be in maintenance")
+	}
+	if w = send("PUT", `{"until":"2000-01-01T00:00:00Z"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a past end to be refused, got %d", w.Code)
+	}
+
+	if w = send("DELETE", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the maintenance to end, got %d", w.Code)
+	}
+	if w = check(); w.Code != http.StatusCreated {
+		t.Errorf("Expected the request to be served, got %d", w.Code)
+	}
+	if w = send("GET", ""); !strings.Contains(w.Body.String(), `"enabled":false`) {
+		t.Errorf("Expected no maintenance, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/readium/readium-lcp-server/dbutils"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/servicetoken"
+	"github.com/readium/readium-lcp-server/shared"
+	"github.com/readium/readium-lcp-server/storage"
+)
+
+// the types of the problems reporting the errors of the common handlers and middlewares
+func init() {
+	problem.RegisterType(ErrBodyTooLarge, problem.BODY_TOO_LARGE)
+	problem.RegisterType(ErrRangeNotSatisfiable, problem.RANGE_NOT_SATISFIABLE)
+	problem.RegisterType(servicetoken.ErrInvalidToken, problem.INVALID_SERVICE_TOKEN)
+	problem.RegisterType(servicetoken.ErrExpiredToken, problem.EXPIRED_SERVICE_TOKEN)
+	problem.RegisterType(servicetoken.ErrWrongAudience, problem.SERVICE_TOKEN_AUDIENCE)
+}
+
+// StoreStatus returns the http status matching an error returned by a store:
+// 404 if an item was not found, 409 on a conflict, 400 if the listing parameters are invalid, 500 otherwise
+//
+func StoreStatus(err error) int {
+	switch {
+	case errors.Is(err, dbutils.ErrInvalidListing):
+		return http.StatusBadRequest
+	case errors.Is(err, dbutils.ErrNotFound), errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dbutils.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, shared.ErrLocked):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// StoreError reports an error returned by a store, with the status matching its kind
+//
+func StoreError(w http.ResponseWriter, r *http.Request, err error) {
+	problem.Error(w, r, problem.Problem{Detail: err.Error()}, StoreStatus(err))
+}
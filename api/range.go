@@ -0,0 +1,68 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrRangeNotSatisfiable is returned when a byte range is outside of the resource
+var ErrRangeNotSatisfiable = errors.New("The requested range is not satisfiable")
+
+// ParseRange parses the value of a Range header for a resource of the given size (RFC 7233).
+// Only a single byte range is supported: ok is false if the header is missing, malformed
+// or holds several ranges, in which case the full resource should be returned.
+// The returned range is start..start+length-1.
+//
+func ParseRange(header string, size int64) (start int64, length int64, ok bool, err error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false, nil
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return 0, 0, false, nil
+	}
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+	if first == "" {
+		// suffix range: the last n bytes
+		n, e := strconv.ParseInt(last, 10, 64)
+		if e != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, ErrRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, nil
+	}
+
+	start, e := strconv.ParseInt(first, 10, 64)
+	if e != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		end, e = strconv.ParseInt(last, 10, 64)
+		if e != nil || end < start {
+			return 0, 0, false, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, false, ErrRangeNotSatisfiable
+	}
+	return start, end - start + 1, true, nil
+}
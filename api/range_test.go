@@ -0,0 +1,36 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header        string
+		start, length int64
+		ok            bool
+		err           error
+	}{
+		{"", 0, 0, false, nil},
+		{"bytes=0-99", 0, 100, true, nil},
+		{"bytes=100-", 100, 900, true, nil},
+		{"bytes=900-2000", 900, 100, true, nil},
+		{"bytes=-100", 900, 100, true, nil},
+		{"bytes=-5000", 0, 1000, true, nil},
+		{"bytes=0-1,5-9", 0, 0, false, nil},
+		{"bytes=9-1", 0, 0, false, nil},
+		{"items=0-1", 0, 0, false, nil},
+		{"bytes=1000-", 0, 0, false, ErrRangeNotSatisfiable},
+		{"bytes=-0", 0, 0, false, ErrRangeNotSatisfiable},
+	}
+	for _, c := range cases {
+		start, length, ok, err := ParseRange(c.header, 1000)
+		if start != c.start || length != c.length || ok != c.ok || err != c.err {
+			t.Errorf("%q: got %d, %d, %v, %v", c.header, start, length, ok, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/shared"
+)
+
+// DefaultRateLimitWindow is the window of the rate limits, if the configuration does not set it
+const DefaultRateLimitWindow = 60 * time.Second
+
+// rateLimitClient identifies the client of a request: its login if its credentials are valid, else its address;
+// an unverified login is not trusted, it would let a client share the limit of another one or escape its own
+func rateLimitClient(r *http.Request, logins *Logins) string {
+	if user := logins.Login(r); user != "" {
+		return "user:" + user
+	}
+	return "addr:" + ClientIP(r)
+}
+
+// RateLimit limits the number of requests of a client, its verified login or else its address, in a window: the requests
+// beyond the limit are refused with a 429 problem and a Retry-After header. The counters are kept in the shared store,
+// across the instances of the server if it is Redis; the requests are served if the store fails.
+// The health checks are not limited.
+//
+func RateLimit(conf config.RateLimit, logins *Logins) func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	window := time.Duration(conf.Window) * time.Second
+	if window <= 0 {
+		window = DefaultRateLimitWindow
+	}
+	limit := int64(conf.Requests)
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if limit <= 0 || HealthPaths[r.URL.Path] {
+			next(w, r)
+			return
+		}
+		now := time.Now()
+		slot := now.UnixNano() / int64(window)
+		count, err := shared.Default().Incr("ratelimit:"+rateLimitClient(r, logins)+":"+strconv.FormatInt(slot, 10), window)
+		if err != nil {
+			log.Println("Rate limit: " + err.Error())
+			next(w, r)
+			return
+		}
+		remaining := limit - count
+		if remaining < 0 {
+			remaining = 0
+		}
+		w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(limit, 10))
+		w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		if count > limit {
+			reset := time.Unix(0, (slot+1)*int64(window))
+			w.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(now)/time.Second)+1))
+			problem.Error(w, r, problem.Problem{Detail: "Too many requests, retry later"}, http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/urfave/negroni"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/shared"
+)
+
+func TestRateLimit(t *testing.T) {
+	shared.Use(shared.NewMemory())
+	n := negroni.New(negroni.HandlerFunc(RateLimit(config.RateLimit{Requests: 2, Window: 3600}, testLogins())))
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	send := func(path string, remote string, user string, password ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remote + ":1234"
+		if user != "" {
+			req.SetBasicAuth(user, append(password, "secret")[0])
+		}
+		w := httptest.NewRecorder()
+		n.ServeHTTP(w, req)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := send("/licenses", "10.0.0.1", ""); w.Code != http.StatusOK {
+			t.Fatalf("Expected request %d to be served, got %d", i+1, w.Code)
+		}
+	}
+	w := send("/licenses", "10.0.0.1", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("Expected the request to be limited, got %d %v", w.Code, w.Header())
+	}
+	// the limits are per client, and the health checks are not limited
+	if w = send("/licenses", "10.0.0.2", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected another client to be served, got %d", w.Code)
+	}
+	if w = send("/health", "10.0.0.1", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the health check to be served, got %d", w.Code)
+	}
+	// an authenticated client is identified by its login, not by its address
+	for i := 0; i < 2; i++ {
+		if w = send("/licenses", "10.0.0.1", "distributor"); w.Code != http.StatusOK {
+			t.Errorf("Expected the login to have its own limit, got %d", w.Code)
+		}
+	}
+	// a login whose credentials are wrong is not trusted: the client is identified by its address
+	if w = send("/licenses", "10.0.0.2", "distributor", "wrong"); w.Code != http.StatusOK {
+		t.Errorf("Expected the address to be served, got %d", w.Code)
+	}
+	if w = send("/licenses", "10.0.0.1", "another", "wrong"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the address to stay limited, got %d", w.Code)
+	}
+}
+
+// testLogins accepts the basic authentication credentials whose password is "secret"
+func testLogins() *Logins {
+	return &Logins{Verify: func(r *http.Request) string {
+		if user, password, ok := r.BasicAuth(); ok && password == "secret" {
+			return user
+		}
+		return ""
+	}}
+}
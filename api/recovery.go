@@ -0,0 +1,66 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/urfave/negroni"
+
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// HeaderRequestId identifies a request in the logs, the error reports and the response;
+// the id sent by a proxy is kept
+const HeaderRequestId = "X-Request-Id"
+
+// maxRequestIdLength is the max length of a request id sent by a client; a longer id is replaced
+const maxRequestIdLength = 128
+
+// Panics is the number of panics recovered by the server, exposed on /debug/vars
+var Panics = expvar.NewInt("http_panics")
+
+// RequestId returns the id given to a request by the Recovery middleware
+func RequestId(r *http.Request) string {
+	return r.Header.Get(HeaderRequestId)
+}
+
+// Recovery gives an id to each request and recovers the panics of the handlers: the panic is logged
+// with its stack and the id of the request, counted, and answered by a problem+json 500,
+// unless the response had already started.
+//
+func Recovery(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	id := r.Header.Get(HeaderRequestId)
+	if id == "" || len(id) > maxRequestIdLength {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+		r.Header.Set(HeaderRequestId, id)
+	}
+	w.Header().Set(HeaderRequestId, id)
+
+	defer func() {
+		err := recover()
+		if err == nil {
+			return
+		}
+		if err == http.ErrAbortHandler {
+			// the handler aborted the response on purpose
+			panic(err)
+		}
+		Panics.Add(1)
+		log.Printf("Panic in %s %s (request %s): %v\n%s", r.Method, r.URL.Path, id, err, debug.Stack())
+		if rw, ok := w.(negroni.ResponseWriter); ok && rw.Written() {
+			return
+		}
+		problem.Error(w, r, problem.Problem{Detail: "Internal error, request " + id}, http.StatusInternalServerError)
+	}()
+	next(w, r)
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// Timeouts is the number of requests which reached the deadline of their handler, exposed on /debug/vars
+var Timeouts = expvar.NewInt("http_timeouts")
+
+// SetTimeouts sets the configured timeouts of the connections of a server, keeping its defaults otherwise
+//
+func SetTimeouts(s *http.Server, conf config.Timeouts) {
+	if conf.Read > 0 {
+		s.ReadTimeout = time.Duration(conf.Read) * time.Second
+	}
+	if conf.Write > 0 {
+		s.WriteTimeout = time.Duration(conf.Write) * time.Second
+	}
+	if conf.Idle > 0 {
+		s.IdleTimeout = time.Duration(conf.Idle) * time.Second
+	}
+}
+
+// Deadline enforces the deadline of the handlers and logs the slow requests.
+// The handler runs until it returns, but its context is canceled at the deadline and, if the response
+// has not started, the request is answered by a 503 and the connection released: a hung backend
+// does not hold all the connections. A response started in time, e.g. a download, is bounded by the write timeout.
+//
+type Deadline struct {
+	conf config.Timeouts
+}
+
+// NewDeadline returns the deadline middleware of a server
+func NewDeadline(conf config.Timeouts) *Deadline {
+	return &Deadline{conf: conf}
+}
+
+// timeoutOf returns the deadline of the handler of a path: the one of the longest route prefix, else the default
+func (d *Deadline) timeoutOf(path string) time.Duration {
+	seconds, length := d.conf.Handler, 0
+	for prefix, s := range d.conf.Routes {
+		if strings.HasPrefix(path, prefix) && len(prefix) > length {
+			seconds, length = s, len(prefix)
+		}
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (d *Deadline) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	start := time.Now()
+	if d.conf.SlowRequest > 0 {
+		defer func() {
+			if elapsed := time.Since(start); elapsed > time.Duration(d.conf.SlowRequest)*time.Millisecond {
+				log.Printf("Slow request: %s %s (request %s) lasted %v", r.Method, r.URL.Path, RequestId(r), elapsed)
+			}
+		}()
+	}
+	timeout := d.timeoutOf(r.URL.Path)
+	if timeout <= 0 {
+		next(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+	tw := &timeoutWriter{w: w, header: w.Header().Clone()}
+	// the panic of the handler, nil once it returned
+	result := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			err := recover()
+			if err != nil && tw.expired() {
+				// the request was answered, the outer middlewares are gone
+				log.Println(fmt.Sprint("Panic after the timeout of the request ", RequestId(r), ": ", err))
+				err = nil
+			}
+			result <- err
+		}()
+		next(tw, r)
+	}()
+
+	select {
+	case err := <-result:
+		tw.finish(err)
+		return
+	case <-ctx.Done():
+	}
+	tw.mutex.Lock()
+	// a response started in time goes on within the write timeout, and a canceled request ends the handler
+	wait := tw.started || ctx.Err() != context.DeadlineExceeded
+	tw.timedOut = !wait
+	tw.mutex.Unlock()
+	if wait {
+		tw.finish(<-result)
+		return
+	}
+	Timeouts.Add(1)
+	log.Printf("Timeout: %s %s (request %s) after %v", r.Method, r.URL.Path, RequestId(r), timeout)
+	problem.Error(w, r, problem.Problem{Detail: "The request could not be served in time"}, http.StatusServiceUnavailable)
+}
+
+// timeoutWriter forwards a response until the deadline of its request; the handler writes
+// its own headers, which are sent with the response, and its writes after the deadline fail
+type timeoutWriter struct {
+	w        http.ResponseWriter
+	header   http.Header
+	mutex    sync.Mutex
+	started  bool
+	timedOut bool
+}
+
+// expired returns true if the request was answered at the deadline
+func (tw *timeoutWriter) expired() bool {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	return tw.timedOut
+}
+
+// finish ends the response of a handler which returned in time, or panics again in the goroutine of the request
+func (tw *timeoutWriter) finish(err interface{}) {
+	if err != nil {
+		panic(err)
+	}
+	// the headers of a response without body
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	tw.start()
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+// start sends the headers of the handler, the mutex being held
+func (tw *timeoutWriter) start() {
+	if tw.started {
+		return
+	}
+	tw.started = true
+	dst := tw.w.Header()
+	for name := range dst {
+		if _, ok := tw.header[name]; !ok {
+			dst.Del(name)
+		}
+	}
+	for name, values := range tw.header {
+		dst[name] = values
+	}
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if tw.timedOut || tw.started {
+		return
+	}
+	tw.start()
+	tw.w.WriteHeader(status)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.start()
+	return tw.w.Write(b)
+}
+
+// Flush sends the response written so far, for the streamed responses
+func (tw *timeoutWriter) Flush() {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if f, ok := tw.w.(http.Flusher); ok && !tw.timedOut {
+		tw.start()
+		f.Flush()
+	}
+}
+
+// Unwrap gives access to the response writer of the server, for http.NewResponseController
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/urfave/negroni"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestDeadline(t *testing.T) {
+	conf := config.Timeouts{Handler: 30, Routes: map[string]int{"/licenses": 1, "/licenses/export": 0}}
+	d := NewDeadline(conf)
+	for path, expected := range map[string]time.Duration{"/contents": 30 * time.Second, "/licenses/l1": time.Second, "/licenses/export": 0} {
+		if timeout := d.timeoutOf(path); timeout != expected {
+			t.Errorf("Expected the deadline of %s to be %v, got %v", path, expected, timeout)
+		}
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	n := negroni.New(negroni.HandlerFunc(Recovery), d)
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/licenses/hung":
+			// a backend which ignores the cancellation
+			<-release
+			w.Write([]byte("too late"))
+		case "/licenses/started":
+			w.Header().Set("X-Started", "yes")
+			w.Write([]byte("a"))
+			time.Sleep(1500 * time.Millisecond)
+			w.Write([]byte("b"))
+		case "/licenses/panic":
+			panic("boom")
+		default:
+			w.Header().Set("X-Empty", "yes")
+		}
+	})
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		n.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	timeouts := Timeouts.Value()
+	start := time.Now()
+	w := serve("/licenses/hung")
+	if w.Code != http.StatusServiceUnavailable || time.Since(start) > 5*time.Second {
+		t.Errorf("Expected a 503 at the deadline, got %d after %v", w.Code, time.Since(start))
+	}
+	if Timeouts.Value() != timeouts+1 {
+		t.Error("Expected the timeout to be counted")
+	}
+	if w = serve("/licenses/started"); w.Code != http.StatusOK || w.Body.String() != "ab" || w.Header().Get("X-Started") != "yes" {
+		t.Errorf("Expected a response started in time to be complete, got %d %q", w.Code, w.Body.String())
+	}
+	if w = serve("/licenses/panic"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected the panic to be recovered, got %d", w.Code)
+	}
+	if w = serve("/licenses/empty"); w.Code != http.StatusOK || w.Header().Get("X-Empty") != "yes" {
+		t.Errorf("Expected the headers of a response without body, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestSetTimeouts(t *testing.T) {
+	s := http.Server{ReadTimeout: 5 * time.Second, WriteTimeout: 15 * time.Second}
+	SetTimeouts(&s, config.Timeouts{Write: 60, Idle: 120})
+	if s.ReadTimeout != 5*time.Second || s.WriteTimeout != time.Minute || s.IdleTimeout != 2*time.Minute {
+		t.Errorf("Unexpected timeouts %v %v %v", s.ReadTimeout, s.WriteTimeout, s.IdleTimeout)
+	}
+}
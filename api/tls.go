@@ -0,0 +1,119 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// cipherSuites are the TLS 1.2 cipher suites of the servers: forward secrecy and authenticated encryption only.
+// The cipher suites of TLS 1.3 are not configurable.
+var cipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// TLSConfig returns the TLS configuration of a server; the ACME manager is returned
+// if the certificates are obtained automatically
+//
+func TLSConfig(conf config.TLS) (*tls.Config, *autocert.Manager, error) {
+	tlsConf := &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CipherSuites:     cipherSuites,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		NextProtos:       []string{"h2", "http/1.1"},
+	}
+	if conf.MinVersion == "1.3" {
+		tlsConf.MinVersion = tls.VersionTLS13
+	}
+
+	if len(conf.ACME.Domains) == 0 {
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.PrivateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+		return tlsConf, nil, nil
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(conf.ACME.Domains...),
+		Cache:      autocert.DirCache(conf.ACME.CacheDir),
+		Email:      conf.ACME.Email,
+	}
+	if conf.ACME.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: conf.ACME.DirectoryURL}
+	}
+	tlsConf.GetCertificate = manager.GetCertificate
+	// the tls-alpn-01 challenges are answered on the https listener
+	tlsConf.NextProtos = append(tlsConf.NextProtos, acme.ALPNProto)
+	return tlsConf, manager, nil
+}
+
+// redirectHandler redirects the http requests to the https listener of a server
+func redirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// ListenAndServe starts a server on http, or on https if TLS is enabled for it;
+// the http listener which redirects to https is started if a redirect port is configured
+//
+func ListenAndServe(s *http.Server, conf config.TLS) error {
+	if !conf.Enabled {
+		return s.ListenAndServe()
+	}
+	tlsConf, manager, err := TLSConfig(conf)
+	if err != nil {
+		return err
+	}
+	s.TLSConfig = tlsConf
+
+	if conf.RedirectPort > 0 {
+		var handler http.Handler = redirectHandler(s.Addr)
+		if manager != nil {
+			// the http-01 challenges are answered on the http listener
+			handler = manager.HTTPHandler(handler)
+		}
+		host, _, _ := net.SplitHostPort(s.Addr)
+		redirect := &http.Server{
+			Addr:         net.JoinHostPort(host, strconv.Itoa(conf.RedirectPort)),
+			Handler:      handler,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+		}
+		go func() {
+			log.Println("Redirecting http to https on " + redirect.Addr)
+			if err := redirect.ListenAndServe(); err != nil {
+				log.Println("Error " + err.Error())
+			}
+		}()
+	}
+	return s.ListenAndServeTLS("", "")
+}
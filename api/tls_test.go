@@ -0,0 +1,81 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// selfSigned writes a self-signed certificate and its private key in a directory
+func selfSigned(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"lsd.example.com"},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := selfSigned(t, dir)
+
+	tlsConf, manager, err := TLSConfig(config.TLS{Enabled: true, Cert: certFile, PrivateKey: keyFile, MinVersion: "1.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manager != nil || len(tlsConf.Certificates) != 1 || tlsConf.MinVersion != tls.VersionTLS13 {
+		t.Errorf("Unexpected TLS configuration %+v", tlsConf)
+	}
+	if _, _, err = TLSConfig(config.TLS{Enabled: true, Cert: certFile, PrivateKey: certFile}); err == nil {
+		t.Error("Expected an error without a private key")
+	}
+
+	acmeConf := config.TLS{Enabled: true, ACME: config.ACME{Domains: []string{"lsd.example.com"}, CacheDir: dir}}
+	tlsConf, manager, err = TLSConfig(acmeConf)
+	if err != nil || manager == nil || tlsConf.GetCertificate == nil || tlsConf.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Unexpected ACME configuration %+v %v", tlsConf, err)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	for addr, location := range map[string]string{
+		":443":  "https://lsd.example.com/licenses/1/status?x=1",
+		":8443": "https://lsd.example.com:8443/licenses/1/status?x=1",
+	} {
+		w := httptest.NewRecorder()
+		redirectHandler(addr).ServeHTTP(w, httptest.NewRequest("GET", "http://lsd.example.com:8080/licenses/1/status?x=1", nil))
+		if w.Code != 301 || w.Header().Get("Location") != location {
+			t.Errorf("Expected a redirection to %s, got %d %s", location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
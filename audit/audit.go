@@ -0,0 +1,140 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package audit records the administrative operations of the License Server,
+// e.g. the erasure of the personal data of a user.
+package audit
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
+)
+
+// NotFound is returned at the end of a list of entries
+var NotFound = errors.New("Audit entry not found")
+
+// actions recorded in the audit log
+const (
+	ActionErasure      = "erasure"
+	ActionLoanDuration = "loan_duration"
+	ActionRefund       = "refund"
+)
+
+// Entry is an operation recorded in the audit log.
+// The subject must not contain personal data, which would survive its erasure.
+type Entry struct {
+	Id        int64     `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Subject   string    `json:"subject"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// Store is the audit log; entries are never updated nor deleted
+type Store interface {
+	Add(e Entry) error
+	List(action string, page int, pageNum int) func() (Entry, error)
+}
+
+type dbStore struct {
+	add  *dbutils.Stmt
+	list *dbutils.Stmt
+}
+
+// Add records an entry; the timestamp is set to now if it is missing
+func (s dbStore) Add(e Entry) error {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+	_, err := s.add.Exec(e.Timestamp.UTC(), e.Actor, e.Action, e.Subject, e.Detail)
+	return err
+}
+
+// List returns a page of entries, most recent first; all the actions are listed if action is empty
+func (s dbStore) List(action string, page int, pageNum int) func() (Entry, error) {
+	rows, err := s.list.Query(action, action, page, pageNum*page)
+	if err != nil {
+		return func() (Entry, error) { return Entry{}, err }
+	}
+	return func() (Entry, error) {
+		var e Entry
+		var err error
+		if rows.Next() {
+			err = rows.Scan(&e.Id, &e.Timestamp, &e.Actor, &e.Action, &e.Subject, &e.Detail)
+		} else {
+			rows.Close()
+			err = NotFound
+		}
+		return e, err
+	}
+}
+
+// Open opens the audit log and creates the audit_log table if it does not exist
+func Open(db *sql.DB) (s Store, err error) {
+	// the queries are written with '?' placeholders, bound to the dialect of the database
+	d := dbutils.DialectOf(config.Config.LcpServer.Database)
+	createTableQuery := tableDef
+	if d == dbutils.Postgres {
+		createTableQuery = tableDefPostgres
+	}
+	addQuery := "INSERT INTO audit_log (timestamp, actor, action, subject, detail) VALUES (?, ?, ?, ?, ?)"
+	listQuery := "SELECT id, timestamp, actor, action, subject, detail FROM audit_log WHERE (? = '' OR action = ?) ORDER BY id DESC LIMIT ? OFFSET ?"
+
+	// if sqlite/postgres, create the audit table if it does not exist
+	if d != dbutils.MySQL {
+		_, err = db.Exec(createTableQuery)
+		if err != nil {
+			log.Println("Error creating the audit_log table")
+			return
+		}
+	}
+	// if mysql, create the audit table if it does not exist
+	if d == dbutils.MySQL {
+		err = dbutils.CreateMySQLTables(db, tableDefMySQL)
+		if err != nil {
+			log.Println("Error creating the audit_log table")
+			return
+		}
+	}
+
+	s = dbStore{
+		dbutils.NewStmt(db, d.Bind(addQuery)),
+		dbutils.NewStmt(db, d.Bind(listQuery)),
+	}
+	return
+}
+
+const tableDef = "CREATE TABLE IF NOT EXISTS audit_log (" +
+	"id integer PRIMARY KEY AUTOINCREMENT," +
+	"timestamp datetime NOT NULL," +
+	"actor varchar(255) NOT NULL DEFAULT ''," +
+	"action varchar(64) NOT NULL," +
+	"subject varchar(255) NOT NULL DEFAULT ''," +
+	"detail text NOT NULL" +
+	");" +
+	"CREATE INDEX IF NOT EXISTS audit_log_action_index on audit_log (action);"
+
+const tableDefPostgres = "CREATE TABLE IF NOT EXISTS audit_log (" +
+	"id SERIAL PRIMARY KEY," +
+	"timestamp TIMESTAMPTZ NOT NULL," +
+	"actor VARCHAR(255) NOT NULL DEFAULT ''," +
+	"action VARCHAR(64) NOT NULL," +
+	"subject VARCHAR(255) NOT NULL DEFAULT ''," +
+	"detail TEXT NOT NULL" +
+	");" +
+	"CREATE INDEX IF NOT EXISTS audit_log_action_index on audit_log (action);"
+
+var tableDefMySQL = dbutils.MySQLTable{Name: "audit_log", Definition: "`id` int NOT NULL PRIMARY KEY AUTO_INCREMENT," +
+	"`timestamp` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+	"`actor` varchar(255) NOT NULL DEFAULT ''," +
+	"`action` varchar(64) NOT NULL," +
+	"`subject` varchar(255) NOT NULL DEFAULT ''," +
+	"`detail` text NOT NULL",
+	Indexes: []dbutils.MySQLIndex{{Name: "audit_log_action_index", Columns: "`action`"}}}
@@ -0,0 +1,53 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package audit
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestAuditLog(t *testing.T) {
+	config.Config.LcpServer.Database = "sqlite3://:memory:"
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	s, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Add(Entry{Actor: "admin", Action: ActionErasure, Subject: "anon-1", Detail: "3 licenses"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Add(Entry{Actor: "admin", Action: "other", Subject: "x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []Entry
+	fn := s.List(ActionErasure, 10, 0)
+	for e, err := fn(); err == nil; e, err = fn() {
+		entries = append(entries, e)
+	}
+	if len(entries) != 1 || entries[0].Subject != "anon-1" || entries[0].Actor != "admin" || entries[0].Timestamp.IsZero() {
+		t.Fatalf("Expected the erasure entry, got %v", entries)
+	}
+
+	// all the actions, most recent first
+	entries = nil
+	fn = s.List("", 10, 0)
+	for e, err := fn(); err == nil; e, err = fn() {
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 || entries[0].Action != "other" {
+		t.Fatalf("Expected 2 entries, most recent first, got %v", entries)
+	}
+}
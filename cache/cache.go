@@ -0,0 +1,88 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package cache provides an optional cache layer in front of the database reads
+// of the License Server: an in-process LRU cache or a Redis cache, shared by several instances.
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// cache types
+const (
+	TypeMemory = "memory"
+	TypeRedis  = "redis"
+)
+
+// default size of the memory cache, in entries
+const defaultSize = 10000
+
+// default time to live of the entries, in seconds
+const defaultTTL = 300
+
+// ErrUnknownType is returned when the type of cache is not supported
+var ErrUnknownType = errors.New("Unknown cache type")
+
+// Cache stores values by key, for a limited time
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+	Delete(key string)
+	// DeletePrefix removes the entries whose key starts with a prefix, e.g. after a bulk update
+	DeletePrefix(prefix string)
+}
+
+// New returns the cache defined in the configuration
+func New(conf config.Cache) (Cache, error) {
+	ttl := time.Duration(conf.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = defaultTTL * time.Second
+	}
+	switch conf.Type {
+	case TypeMemory:
+		size := conf.Size
+		if size <= 0 {
+			size = defaultSize
+		}
+		return NewLRU(size, ttl), nil
+	case TypeRedis:
+		return NewRedis(conf.RedisURL, ttl)
+	default:
+		return nil, ErrUnknownType
+	}
+}
+
+// GetObject gets a value from the cache and decodes it into v;
+// it returns false if the key is not in the cache or the value cannot be decoded
+func GetObject(c Cache, key string, v interface{}) bool {
+	b, ok := c.Get(key)
+	if !ok {
+		return false
+	}
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+	if err != nil {
+		log.Println("Cache: error decoding " + key + ": " + err.Error())
+		c.Delete(key)
+		return false
+	}
+	return true
+}
+
+// SetObject encodes a value and stores it in the cache
+func SetObject(c Cache, key string, v interface{}) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		log.Println("Cache: error encoding " + key + ": " + err.Error())
+		return
+	}
+	c.Set(key, buf.Bytes())
+}
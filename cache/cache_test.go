@@ -0,0 +1,88 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestLRUEviction(t *testing.T) {
+	c := NewLRU(2, time.Minute)
+	c.Set("a", []byte("1"))
+	c.Set("b", []byte("2"))
+	// "a" becomes the most recently used entry
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("Expected a in the cache")
+	}
+	c.Set("c", []byte("3"))
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("Expected b to be evicted")
+	}
+	if v, ok := c.Get("a"); !ok || string(v) != "1" {
+		t.Error("Expected a to stay in the cache")
+	}
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Error("Expected a to be deleted")
+	}
+}
+
+func TestLRUDeletePrefix(t *testing.T) {
+	c := NewLRU(10, time.Minute)
+	c.Set("lcp:license:1", []byte("1"))
+	c.Set("lcp:license-keys:1", []byte("2"))
+	c.Set("lcp:content:1", []byte("3"))
+	c.DeletePrefix("lcp:license")
+	if _, ok := c.Get("lcp:license:1"); ok {
+		t.Error("Expected the license to be deleted")
+	}
+	if _, ok := c.Get("lcp:license-keys:1"); ok {
+		t.Error("Expected the keys to be deleted")
+	}
+	if _, ok := c.Get("lcp:content:1"); !ok {
+		t.Error("Expected the content to stay in the cache")
+	}
+}
+
+func TestLRUExpiration(t *testing.T) {
+	c := NewLRU(10, 10*time.Millisecond)
+	c.Set("a", []byte("1"))
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Error("Expected a to be expired")
+	}
+}
+
+func TestObjects(t *testing.T) {
+	type item struct {
+		Id  string
+		Key []byte
+	}
+
+	c, err := New(config.Cache{Type: TypeMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetObject(c, "item", item{Id: "id", Key: []byte{1, 2, 3}})
+
+	var res item
+	if !GetObject(c, "item", &res) {
+		t.Fatal("Expected the item in the cache")
+	}
+	if res.Id != "id" || len(res.Key) != 3 {
+		t.Errorf("Unexpected item %+v", res)
+	}
+	if GetObject(c, "missing", &res) {
+		t.Error("Did not expect a missing item")
+	}
+
+	if _, err = New(config.Cache{Type: "unknown"}); err != ErrUnknownType {
+		t.Errorf("Expected ErrUnknownType, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package cache
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisCache is a cache shared by all instances of the server;
+// a Redis error is logged and handled as a cache miss, the database being the reference.
+type redisCache struct {
+	pool *redis.Pool
+	ttl  int
+}
+
+// NewRedis returns a cache stored in the Redis server at the given url (redis://host:port/db)
+func NewRedis(url string, ttl time.Duration) (Cache, error) {
+	if url == "" {
+		return nil, errors.New("The url of the Redis server is missing")
+	}
+	pool := &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url,
+				redis.DialConnectTimeout(time.Second),
+				redis.DialReadTimeout(time.Second),
+				redis.DialWriteTimeout(time.Second))
+		},
+	}
+	// check the connection at startup
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		return nil, err
+	}
+	return &redisCache{pool: pool, ttl: int(ttl / time.Second)}, nil
+}
+
+func (c *redisCache) Get(key string) ([]byte, bool) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	b, err := redis.Bytes(conn.Do("GET", key))
+	if err != nil {
+		if err != redis.ErrNil {
+			log.Println("Cache: Redis error on GET " + key + ": " + err.Error())
+		}
+		return nil, false
+	}
+	return b, true
+}
+
+func (c *redisCache) Set(key string, value []byte) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SET", key, value, "EX", c.ttl); err != nil {
+		log.Println("Cache: Redis error on SET " + key + ": " + err.Error())
+	}
+}
+
+func (c *redisCache) Delete(key string) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("DEL", key); err != nil {
+		log.Println("Cache: Redis error on DEL " + key + ": " + err.Error())
+	}
+}
+
+// DeletePrefix scans the keys with the prefix, as KEYS would block the server
+func (c *redisCache) DeletePrefix(prefix string) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", 1000))
+		if err == nil {
+			var keys []string
+			if _, err = redis.Scan(values, &cursor, &keys); err == nil && len(keys) > 0 {
+				_, err = conn.Do("DEL", redis.Args{}.AddFlat(keys)...)
+			}
+		}
+		if err != nil {
+			log.Println("Cache: Redis error on DEL " + prefix + "*: " + err.Error())
+			return
+		}
+		if cursor == 0 {
+			return
+		}
+	}
+}
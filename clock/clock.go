@@ -0,0 +1,116 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package clock gives the current time to the licensing code: the issue and the expiration of the licenses,
+// the potential rights and the renewals. The system clock is used by default; the tests set a fake clock
+// to run the timelines of the licenses, and a test server may shift its clock (see config.Clock).
+package clock
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// Clock returns the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// system is the clock of the system, shifted by an offset and in a timezone if set
+type system struct {
+	offset   time.Duration
+	location *time.Location
+}
+
+func (c system) Now() time.Time {
+	t := time.Now().Add(c.offset)
+	if c.location != nil {
+		t = t.In(c.location)
+	}
+	return t
+}
+
+var (
+	mu      sync.RWMutex
+	current Clock = system{}
+)
+
+// Now returns the current time of the clock
+func Now() time.Time {
+	mu.RLock()
+	c := current
+	mu.RUnlock()
+	return c.Now()
+}
+
+// Set sets the clock and returns a function which restores the previous one, e.g. at the end of a test
+//
+func Set(c Clock) (restore func()) {
+	mu.Lock()
+	previous := current
+	current = c
+	mu.Unlock()
+	return func() {
+		mu.Lock()
+		current = previous
+		mu.Unlock()
+	}
+}
+
+// Init sets the clock of a server from its configuration: the system clock, shifted if configured
+//
+func Init(conf config.Clock) error {
+	var c system
+	var err error
+	if conf.Offset != "" {
+		if c.offset, err = time.ParseDuration(conf.Offset); err != nil {
+			return err
+		}
+	}
+	if conf.Location != "" {
+		if c.location, err = time.LoadLocation(conf.Location); err != nil {
+			return err
+		}
+	}
+	if c.offset != 0 || c.location != nil {
+		log.Println("Warning: the clock is shifted, current time " + c.Now().Format(time.RFC3339))
+	}
+	Set(c)
+	return nil
+}
+
+// Fake is a clock which only moves when it is set or advanced
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFake returns a fake clock set at a time
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the time of the fake clock
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Set sets the time of the fake clock
+func (f *Fake) Set(now time.Time) {
+	f.mu.Lock()
+	f.now = now
+	f.mu.Unlock()
+}
+
+// Advance moves the fake clock forward, or backward if the duration is negative
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	f.now = f.now.Add(d)
+	f.mu.Unlock()
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	fake := NewFake(start)
+	restore := Set(fake)
+	if !Now().Equal(start) {
+		t.Errorf("Expected the fake time, got %v", Now())
+	}
+	fake.Advance(30 * 24 * time.Hour)
+	if !Now().Equal(start.AddDate(0, 0, 30)) {
+		t.Errorf("Expected the fake clock to move forward, got %v", Now())
+	}
+	restore()
+	if time.Since(Now()) > time.Minute {
+		t.Errorf("Expected the system clock to be restored, got %v", Now())
+	}
+}
+
+func TestInit(t *testing.T) {
+	defer Set(system{})
+	if err := Init(config.Clock{Offset: "720h", Location: "America/Montreal"}); err != nil {
+		t.Fatal(err)
+	}
+	now := Now()
+	if shift := now.Sub(time.Now()); shift < 719*time.Hour || shift > 721*time.Hour {
+		t.Errorf("Expected the clock to be shifted by 30 days, got %v", shift)
+	}
+	if now.Location().String() != "America/Montreal" {
+		t.Errorf("Expected the time in the configured timezone, got %v", now.Location())
+	}
+	if err := Init(config.Clock{Offset: "a month"}); err == nil {
+		t.Error("Expected an invalid offset to be rejected")
+	}
+}
@@ -26,10 +26,12 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -48,6 +50,24 @@ type Configuration struct {
 	ComplianceMode bool               `yaml:"compliance_mode"`
 	GoofyMode      bool               `yaml:"goofy_mode"`
 	Profile        string             `yaml:"profile,omitempty"`
+	Packaging      Packaging          `yaml:"packaging,omitempty"`
+	Streamer       Streamer           `yaml:"streamer,omitempty"`
+	Cache          Cache              `yaml:"cache,omitempty"`
+	SignedURLs     SignedURLs         `yaml:"signed_urls,omitempty"`
+	Tenants        []Tenant           `yaml:"tenants,omitempty"`
+	ProviderCerts  []ProviderCert     `yaml:"provider_certificates,omitempty"`
+	Retention      Retention          `yaml:"retention,omitempty"`
+	ServiceTokens  ServiceTokens      `yaml:"service_tokens,omitempty"`
+	Shadow         Shadow             `yaml:"shadow,omitempty"`
+	ErrorReporting ErrorReporting     `yaml:"error_reporting,omitempty"`
+	Clock          Clock              `yaml:"clock,omitempty"`
+	RightsPolicy   RightsPolicy       `yaml:"rights_policy,omitempty"`
+	Refunds        Refunds            `yaml:"refunds,omitempty"`
+	Transport      Transport          `yaml:"transport,omitempty"`
+	Shared         Shared             `yaml:"shared,omitempty"`
+	Staging        Storage            `yaml:"staging,omitempty"`
+	// rollout of the features by provider, e.g. "profile_1_0": "https://provider.example.com 10%"
+	Features map[string]string `yaml:"features,omitempty"`
 
 	// DISABLED, see https://github.com/readium/readium-lcp-server/issues/109
 	//AES256_CBC_OR_GCM string             `yaml:"aes256_cbc_or_gcm,omitempty"`
@@ -59,8 +79,131 @@ type ServerInfo struct {
 	AuthFile      string `yaml:"auth_file"`
 	ReadOnly      bool   `yaml:"readonly,omitempty"`
 	PublicBaseUrl string `yaml:"public_base_url,omitempty"`
+	// address the server listens on, e.g. ":8989" or "0.0.0.0:8989", independent of the public base url
+	ListenAddress string `yaml:"listen_address,omitempty"`
 	Database      string `yaml:"database,omitempty"`
 	Directory     string `yaml:"directory,omitempty"`
+	// optional read-only replica of the database, used by listings and statistics
+	ReplicaDatabase string `yaml:"replica_database,omitempty"`
+	// database connection pool; zero values keep the defaults
+	MaxOpenConns    int `yaml:"max_open_conns,omitempty"`
+	MaxIdleConns    int `yaml:"max_idle_conns,omitempty"`
+	ConnMaxLifetime int `yaml:"conn_max_lifetime,omitempty"` // in seconds
+	// sqlite: delay a connection waits for a lock held by another one, in milliseconds
+	BusyTimeout int `yaml:"busy_timeout,omitempty"`
+	// cross-origin requests, e.g. from a browser-based admin UI or web reader
+	CORS CORS `yaml:"cors,omitempty"`
+	// native https listener
+	TLS TLS `yaml:"tls,omitempty"`
+	// maximum size of the request bodies in bytes: json and form bodies (1 MiB by default),
+	// and uploaded files (not limited by default)
+	MaxBodySize   int64 `yaml:"max_body_size,omitempty"`
+	MaxUploadSize int64 `yaml:"max_upload_size,omitempty"`
+	// one line per request
+	AccessLog AccessLog `yaml:"access_log,omitempty"`
+	// timeouts of the connections and deadlines of the handlers
+	Timeouts Timeouts `yaml:"timeouts,omitempty"`
+	// number of requests of a client, rejected beyond the limit
+	RateLimit RateLimit `yaml:"rate_limit,omitempty"`
+	// replay of the responses to the requests sent again with the same Idempotency-Key header
+	Idempotency Idempotency `yaml:"idempotency,omitempty"`
+	// reverse proxies or load balancers in front of the server
+	Proxy Proxy `yaml:"proxy,omitempty"`
+	// read-only mode of a maintenance window, e.g. of the database
+	Maintenance Maintenance `yaml:"maintenance,omitempty"`
+}
+
+// Maintenance puts a server in maintenance when it starts, if Enabled: the requests which write to the database
+// are refused with a 503 response and a Retry-After header of RetryAfter seconds (300 by default), with the Message
+// if set, while the reads are served. The maintenance is also started and ended by the /maintenance route of the server.
+type Maintenance struct {
+	Enabled    bool   `yaml:"enabled,omitempty"`
+	RetryAfter int    `yaml:"retry_after,omitempty"`
+	Message    string `yaml:"message,omitempty"`
+}
+
+// Proxy configures the reverse proxies in front of a server: the X-Forwarded-For, X-Forwarded-Proto
+// and X-Forwarded-Host headers are honored only for the requests sent by the TrustedProxies, IP addresses
+// or CIDR ranges, and removed from the other requests. The client address of the logs, rate limits and events
+// is the forwarded one; if ForwardedLinks is set, the absolute links of the licenses and status documents
+// are built on the forwarded scheme and host instead of the public base url.
+type Proxy struct {
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+	ForwardedLinks bool     `yaml:"forwarded_links,omitempty"`
+}
+
+// RateLimit limits the number of requests of a client in a window of Window seconds (60 by default);
+// the client is identified by its login, else by its address. There is no limit if Requests is 0.
+type RateLimit struct {
+	Requests int `yaml:"requests,omitempty"`
+	Window   int `yaml:"window,omitempty"`
+}
+
+// Idempotency replays the response to a POST, PUT or PATCH request sent again by the same client with the same
+// Idempotency-Key header, e.g. after a timeout, instead of processing it twice. The responses are kept TTL seconds,
+// 24 hours by default.
+type Idempotency struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	TTL     int  `yaml:"ttl,omitempty"`
+}
+
+// Timeouts bounds the duration of the requests of a server, in seconds; the defaults of the server apply if 0.
+// Read, Write and Idle are the timeouts of the connections: reading a request, writing a response,
+// and waiting for the next request on a keep-alive connection.
+// Handler is the deadline of the handlers: the context of the request is canceled at the deadline,
+// and a 503 response is sent if the response has not started. Routes overrides it by path prefix,
+// the longest prefix first, e.g. "/licenses": 10. Requests lasting more than SlowRequest milliseconds are logged.
+type Timeouts struct {
+	Read        int            `yaml:"read,omitempty"`
+	Write       int            `yaml:"write,omitempty"`
+	Idle        int            `yaml:"idle,omitempty"`
+	Handler     int            `yaml:"handler,omitempty"`
+	Routes      map[string]int `yaml:"routes,omitempty"`
+	SlowRequest int            `yaml:"slow_request,omitempty"`
+}
+
+// AccessLog configures the log of the requests of a server, on the standard output.
+// Format is "combined" (default, the Apache combined format followed by the latency and the request id),
+// "json" (one json document per request) or "off". ExcludeHealth removes the health checks from the log.
+type AccessLog struct {
+	Format        string `yaml:"format,omitempty"`
+	ExcludeHealth bool   `yaml:"exclude_health,omitempty"`
+}
+
+// TLS configures the https listener of a server, with a certificate and its private key (PEM files),
+// or with certificates obtained automatically from an ACME CA (e.g. Let's Encrypt) if ACME domains are set.
+// MinVersion is "1.2" (default) or "1.3". If RedirectPort is set, a http listener on this port redirects
+// to https, and answers the http-01 challenges of the ACME CA.
+type TLS struct {
+	Enabled      bool   `yaml:"enabled,omitempty"`
+	Cert         string `yaml:"cert,omitempty"`
+	PrivateKey   string `yaml:"private_key,omitempty"`
+	ACME         ACME   `yaml:"acme,omitempty"`
+	MinVersion   string `yaml:"min_version,omitempty"`
+	RedirectPort int    `yaml:"redirect_port,omitempty"`
+}
+
+// ACME configures the automatic certificates of a server: the domains it serves, the contact email
+// of the account, and the directory where the certificates are kept between restarts.
+// DirectoryURL is the ACME directory, Let's Encrypt by default; e.g. its staging directory for tests.
+type ACME struct {
+	Domains      []string `yaml:"domains,omitempty"`
+	Email        string   `yaml:"email,omitempty"`
+	CacheDir     string   `yaml:"cache_dir,omitempty"`
+	DirectoryURL string   `yaml:"directory_url,omitempty"`
+}
+
+// CORS configures the cross-origin requests accepted by a server. By default, any origin is allowed
+// with the usual methods and headers, without credentials; the CORS headers are not sent if Disabled.
+// MaxAge is the time a browser may cache a preflight response, in seconds.
+type CORS struct {
+	Disabled         bool     `yaml:"disabled,omitempty"`
+	AllowedOrigins   []string `yaml:"allowed_origins,omitempty"`
+	AllowedMethods   []string `yaml:"allowed_methods,omitempty"`
+	AllowedHeaders   []string `yaml:"allowed_headers,omitempty"`
+	ExposedHeaders   []string `yaml:"exposed_headers,omitempty"`
+	AllowCredentials bool     `yaml:"allow_credentials,omitempty"`
+	MaxAge           int      `yaml:"max_age,omitempty"`
 }
 
 type LsdServerInfo struct {
@@ -71,11 +214,70 @@ type LsdServerInfo struct {
 
 type FrontendServerInfo struct {
 	ServerInfo          `yaml:",inline"`
-	ProviderUri         string `yaml:"provider_uri"`
-	RightPrint          int32  `yaml:"right_print"`
-	RightCopy           int32  `yaml:"right_copy"`
-	MasterRepository    string `yaml:"master_repository"`
-	EncryptedRepository string `yaml:"encrypted_repository"`
+	ProviderUri         string            `yaml:"provider_uri"`
+	RightPrint          int32             `yaml:"right_print"`
+	RightCopy           int32             `yaml:"right_copy"`
+	MasterRepository    string            `yaml:"master_repository"`
+	EncryptedRepository string            `yaml:"encrypted_repository"`
+	LoanDays            int               `yaml:"loan_days,omitempty"`
+	UploadWorkers       int               `yaml:"upload_workers,omitempty"`
+	Auth                FrontendAuth      `yaml:"auth,omitempty"`
+	Renewal             FrontendRenewal   `yaml:"renewal,omitempty"`
+	Mail                FrontendMail      `yaml:"mail,omitempty"`
+	Reminders           FrontendReminders `yaml:"reminders,omitempty"`
+}
+
+// FrontendReminders configures the reminders of the end of the loans: every channel sends a reminder
+// a number of days before the end of a loan, once per loan and number of days.
+type FrontendReminders struct {
+	Interval int               `yaml:"interval,omitempty"` // minutes between the searches of the loans, 60 by default
+	Channels []ReminderChannel `yaml:"channels,omitempty"`
+}
+
+// ReminderChannel is a way to remind the users of the end of their loans: "email" (through the mailer of the frontend),
+// "webhook" (the loan is posted in JSON) or "push" (a notification is posted to a push gateway).
+// The body of the webhooks and the push notifications is signed with the secret, if set.
+type ReminderChannel struct {
+	Type   string `yaml:"type"`
+	Days   []int  `yaml:"days"`
+	URL    string `yaml:"url,omitempty"`
+	Secret string `yaml:"secret,omitempty"`
+}
+
+// FrontendMail configures the emails sent to the users by the frontend server, through an SMTP server
+// or the HTTP API of a mail provider; no email is sent if the provider is not set.
+// The templates of the folder override or complete the default templates, in English.
+type FrontendMail struct {
+	Provider        string `yaml:"provider,omitempty"` // "smtp" or "api"
+	From            string `yaml:"from,omitempty"`
+	Host            string `yaml:"host,omitempty"`
+	Port            int    `yaml:"port,omitempty"`
+	Username        string `yaml:"username,omitempty"`
+	Password        string `yaml:"password,omitempty"`
+	APIURL          string `yaml:"api_url,omitempty"`
+	APIKey          string `yaml:"api_key,omitempty"`
+	Templates       string `yaml:"templates,omitempty"`
+	DefaultLanguage string `yaml:"default_language,omitempty"`
+	AttachLicense   bool   `yaml:"attach_license,omitempty"`
+}
+
+// FrontendRenewal is the policy of the loan extensions requested by the patrons:
+// the maximum number of renewals of a loan (unlimited if zero), the number of days before the end of a loan
+// from which it may be renewed (any time if zero), and the number of days added by a renewal
+// (if zero, the License Status Server chooses the renew period).
+type FrontendRenewal struct {
+	MaxRenewals int `yaml:"max_renewals,omitempty"`
+	WindowDays  int `yaml:"window_days,omitempty"`
+	Days        int `yaml:"days,omitempty"`
+}
+
+// FrontendAuth configures the user accounts of the frontend server; the authentication is enabled
+// when the secret of the session tokens is set. The admin account is created at startup if it does not exist.
+type FrontendAuth struct {
+	Secret        string `yaml:"secret,omitempty"`
+	TokenTTL      int    `yaml:"token_ttl,omitempty"` // in seconds
+	AdminEmail    string `yaml:"admin_email,omitempty"`
+	AdminPassword string `yaml:"admin_password,omitempty"`
 }
 
 type Auth struct {
@@ -83,9 +285,184 @@ type Auth struct {
 	Password string `yaml:"password"`
 }
 
+// Cache configures an optional cache of the content index and licenses, in front of the database.
+// Type is "memory" (in-process LRU cache) or "redis"; there is no cache by default.
+// SignedLicenses also caches the fresh licenses signed by the server.
+type Cache struct {
+	Type           string `yaml:"type,omitempty"`
+	Size           int    `yaml:"size,omitempty"`
+	TTL            int    `yaml:"ttl,omitempty"`
+	RedisURL       string `yaml:"redis_url,omitempty"`
+	SignedLicenses bool   `yaml:"signed_licenses,omitempty"`
+}
+
+// Streamer configures the access of trusted internal services to the decrypted resources of the publications;
+// it is disabled by default.
+type Streamer struct {
+	Enabled    bool     `yaml:"enabled"`
+	Auth       Auth     `yaml:"auth"`
+	AllowedIPs []string `yaml:"allowed_ips,omitempty"`
+}
+
+// SignedURLs configures the time-limited download urls of the encrypted publications;
+// if a secret is set, they are used in the publication link of the licenses.
+// TTL is in seconds.
+type SignedURLs struct {
+	Secret string `yaml:"secret"`
+	TTL    int    `yaml:"ttl,omitempty"`
+}
+
+// ServiceTokens replaces the basic authentication between the License Server, the License Status Server
+// and the frontend by short-lived signed tokens (JWT), bound to the server they are sent to.
+// The tokens are signed with the key SigningKey, a HMAC secret (HS256) or a private key (RS256 or ES256,
+// given as a PEM file); they are checked with the secrets and the public keys (PEM files), by key id.
+// A key is rotated by adding the new key to every server, then signing with it, then removing the old one.
+// TTL is in seconds. The basic authentication is still accepted, unless RejectBasicAuth is set.
+type ServiceTokens struct {
+	SigningKey      string            `yaml:"signing_key,omitempty"`
+	Secrets         map[string]string `yaml:"secrets,omitempty"`
+	PrivateKeys     map[string]string `yaml:"private_keys,omitempty"`
+	PublicKeys      map[string]string `yaml:"public_keys,omitempty"`
+	TTL             int               `yaml:"ttl,omitempty"`
+	RejectBasicAuth bool              `yaml:"reject_basic_auth,omitempty"`
+}
+
+// Shadow replays the license fetches against a secondary License Server, e.g. the legacy server
+// of a migration, and logs the differences between the responses, to validate the migration before the cutover.
+// The shadow mode is disabled if Url is empty. SampleRate is the share of the fetches replayed, all of them if 0;
+// Timeout is in seconds, 10 by default. Ignore lists the members of the licenses which are not compared
+// (dotted paths, e.g. links.hint), besides the signature and the values encrypted for the user.
+type Shadow struct {
+	Url        string   `yaml:"url"`
+	Auth       Auth     `yaml:"auth,omitempty"`
+	SampleRate float64  `yaml:"sample_rate,omitempty"`
+	Timeout    int      `yaml:"timeout,omitempty"`
+	Ignore     []string `yaml:"ignore,omitempty"`
+}
+
+// ErrorReporting sends the panics and the server errors (5xx) of the requests to an error tracker;
+// SentryDSN is the DSN of a Sentry project, the errors are only logged if empty.
+// Environment tags the errors, e.g. production or staging.
+type ErrorReporting struct {
+	SentryDSN   string `yaml:"sentry_dsn,omitempty"`
+	Environment string `yaml:"environment,omitempty"`
+}
+
+// Clock shifts the time seen by the licensing code (issue and expiration of the licenses, potential rights,
+// renewals), to investigate the timelines of the licenses and the timezone bugs on a test server, never in production.
+// Offset is a duration (e.g. "720h" or "-2h30m") added to the system time; Location is the timezone
+// of the time (e.g. "America/Montreal"), the local timezone of the server if empty.
+type Clock struct {
+	Offset   string `yaml:"offset,omitempty"`
+	Location string `yaml:"location,omitempty"`
+}
+
+// Refunds confirms the refunds of the purchases to the storefront: once a refunded license is revoked,
+// its confirmation is posted to WebhookURL, the body signed with WebhookSecret if set.
+type Refunds struct {
+	WebhookURL    string `yaml:"webhook_url,omitempty"`
+	WebhookSecret string `yaml:"webhook_secret,omitempty"`
+}
+
+// Transport configures the calls between the License Server and the License Status Server: Mode is "http"
+// (the default) to call the public base url of the other server, "inprocess" to call its handler directly when
+// both servers run in the same process, or "redis" to send the calls through queues of the Redis server
+// at RedisURL, consumed by the instances of the other server.
+type Transport struct {
+	Mode     string `yaml:"mode,omitempty"`
+	RedisURL string `yaml:"redis_url,omitempty"`
+}
+
+// Shared configures the store of the rate limits, the idempotency keys and the locks of the concurrent loan checks:
+// Type is "memory" (the default), the limits holding for each instance of a server, or "redis" to share them
+// between the instances behind a load balancer through the Redis server at RedisURL.
+type Shared struct {
+	Type     string `yaml:"type,omitempty"`
+	RedisURL string `yaml:"redis_url,omitempty"`
+}
+
+// RightsPolicy limits the rights of the licenses generated and updated by the License Server;
+// the rules of a provider replace the default rules for its licenses.
+type RightsPolicy struct {
+	RightsRules `yaml:",inline"`
+	Providers   map[string]RightsRules `yaml:"providers,omitempty"`
+}
+
+// RightsRules are the limits of the rights of a license: MinLoanDays and MaxLoanDays are the minimum
+// and maximum number of days between the start (the issue date by default) and the end of the rights,
+// unlimited if zero; a loan out of this range is rejected, or clamped into it if LoanEnforcement is "clamp".
+// AllowPastEnd accepts an end of the rights in the past, e.g. for the tests of the expired licenses.
+type RightsRules struct {
+	MinLoanDays     int    `yaml:"min_loan_days,omitempty"`
+	MaxLoanDays     int    `yaml:"max_loan_days,omitempty"`
+	LoanEnforcement string `yaml:"loan_enforcement,omitempty"` // reject (default) or clamp
+	AllowPastEnd    bool   `yaml:"allow_past_end,omitempty"`
+}
+
+// Tenant is a publisher served by a shared License Server: its contents and licenses
+// are only visible with its own credentials. The certificate and the storage prefix are optional;
+// the certificate of the server and the root of the storage are used by default.
+type Tenant struct {
+	Id            string      `yaml:"id"`
+	AuthFile      string      `yaml:"auth_file"`
+	Certificate   Certificate `yaml:"certificate,omitempty"`
+	StoragePrefix string      `yaml:"storage_prefix,omitempty"`
+}
+
+// ProviderCert is the certificate used to sign the licenses of a provider,
+// so that a License Server can sign for several imprints
+type ProviderCert struct {
+	Provider   string `yaml:"provider"`
+	Cert       string `yaml:"cert"`
+	PrivateKey string `yaml:"private_key"`
+	Chain      string `yaml:"chain,omitempty"`
+	// certificate replacing this one during a key rotation
+	Next NextCertificate `yaml:"next,omitempty"`
+}
+
+// Retention configures the periodic purge of old records; a rule is disabled if its number of days is 0.
+// The License Server purges the expired licenses, the License Status Server the events and the returned loans.
+// In dry-run mode, the records are counted but not purged.
+type Retention struct {
+	Interval      int    `yaml:"interval,omitempty"` // in hours, 24 by default
+	DryRun        bool   `yaml:"dry_run,omitempty"`
+	LicenseDays   int    `yaml:"license_days,omitempty"`   // licenses whose rights ended this number of days ago
+	LicenseAction string `yaml:"license_action,omitempty"` // "archive" (by default) or "delete"
+	EventDays     int    `yaml:"event_days,omitempty"`     // events older than this number of days
+	ReturnedDays  int    `yaml:"returned_days,omitempty"`  // returned loans, with their events, this number of days after the return
+}
+
 type Certificate struct {
 	Cert       string `yaml:"cert"`
 	PrivateKey string `yaml:"private_key"`
+	// PEM file of the intermediate certificates between the certificate and its root, embedded in the signatures
+	Chain string `yaml:"chain,omitempty"`
+	// number of concurrent signatures of licenses, one per processor by default
+	SignerWorkers int `yaml:"signer_workers,omitempty"`
+	// number of days before the expiry of the certificates when a warning is logged, 30 by default
+	ExpiryWarningDays int `yaml:"expiry_warning_days,omitempty"`
+	CRL               CRL `yaml:"crl,omitempty"`
+	// certificate replacing this one during a key rotation
+	Next NextCertificate `yaml:"next,omitempty"`
+}
+
+// NextCertificate is the certificate which replaces a certificate during a key rotation. The policy selects
+// the certificate signing the licenses: "staged" (by default) keeps the current one, "new" signs the new licenses,
+// and the licenses already signed with it, with the next one, "all" signs all the licenses with the next one.
+type NextCertificate struct {
+	Cert       string `yaml:"cert,omitempty"`
+	PrivateKey string `yaml:"private_key,omitempty"`
+	Chain      string `yaml:"chain,omitempty"`
+	Policy     string `yaml:"policy,omitempty"`
+}
+
+// CRL configures the certificate revocation lists of the certificates of the licenses: if enabled, the License Server
+// fetches them from the distribution points of the certificates, or from Url, serves them and refuses to start with
+// a revoked certificate. Refresh is the number of hours between two fetches of a list, at most 24 and until its next update.
+type CRL struct {
+	Enabled bool   `yaml:"enabled,omitempty"`
+	Url     string `yaml:"url,omitempty"`
+	Refresh int    `yaml:"refresh,omitempty"`
 }
 
 type FileSystem struct {
@@ -103,10 +480,49 @@ type Storage struct {
 	Bucket     string
 	Region     string
 	Token      string
+	GC         StorageGC `yaml:"gc,omitempty"`
+	// maximum size in bytes of a stored object: larger encrypted files are stored in parts
+	// (License Server); 0 for no limit
+	PartSize int64 `yaml:"part_size,omitempty"`
+	// hosts from which the License Server downloads the encrypted files given by an http(s) url,
+	// none by default, and maximum size in bytes of these files, 1 GiB by default (staging)
+	DownloadHosts   []string `yaml:"download_hosts,omitempty"`
+	MaxDownloadSize int64    `yaml:"max_download_size,omitempty"`
+}
+
+// StorageGC configures the periodic deletion of the encrypted files which have no content record
+// (License Server). In dry-run mode, the files are only reported.
+type StorageGC struct {
+	Enabled  bool `yaml:"enabled,omitempty"`
+	Interval int  `yaml:"interval,omitempty"` // in hours, 24 by default
+	DryRun   bool `yaml:"dry_run,omitempty"`
 }
 
 type License struct {
 	Links map[string]string `yaml:"links"`
+	// default values of the licenses, per content type or collection
+	Templates []LicenseTemplate `yaml:"templates,omitempty"`
+	// users asking for a loan of a content whose copies are all on loan are placed on hold
+	HoldQueue bool `yaml:"hold_queue,omitempty"`
+	// fields of the user info ("email", "name") encrypted with the user key, in addition to the fields listed by the caller
+	EncryptUserFields []string `yaml:"encrypt_user_fields,omitempty"`
+	// passphrase hash algorithms accepted per profile ("basic", "1.0"), the preferred first; sha256 by default
+	HashAlgorithms map[string][]string `yaml:"hash_algorithms,omitempty"`
+}
+
+// LicenseTemplate gives default values to the licenses of the contents it selects by media type or collection;
+// they apply to the fields omitted by the partial licenses. The first matching template is used,
+// a template without content types and collections matches every content.
+type LicenseTemplate struct {
+	Name         string            `yaml:"name"`
+	ContentTypes []string          `yaml:"content_types,omitempty"` // media types or ranges, e.g. "audio/*"
+	Collections  []string          `yaml:"collections,omitempty"`   // collections of the metadata of the contents
+	Print        *int32            `yaml:"print,omitempty"`
+	Copy         *int32            `yaml:"copy,omitempty"`
+	Days         int               `yaml:"days,omitempty"` // end of the rights, in days after their start
+	Hint         string            `yaml:"hint,omitempty"`
+	Profile      string            `yaml:"profile,omitempty"` // "basic" or "1.0"
+	Links        map[string]string `yaml:"links,omitempty"`   // replace or add to the links of the license section
 }
 
 type LicenseStatus struct {
@@ -116,6 +532,143 @@ type LicenseStatus struct {
 	RentingDays  int    `yaml:"renting_days" "default 0"`
 	RenewDays    int    `yaml:"renew_days" "default 0"`
 	RenewPageUrl string `yaml:"renew_page_url,omitempty"`
+	// max number of events kept per license status; older events are archived (0 = no limit)
+	EventsCap int `yaml:"events_cap,omitempty"`
+	// the reading systems report the consumption of the print and copy rights
+	RightsAccounting bool `yaml:"rights_accounting,omitempty"`
+	// policies computing the potential end of the loans; renting_days is used by default
+	PotentialRights PotentialRights `yaml:"potential_rights,omitempty"`
+	// the license link of the status documents returns a license signed again with its current rights
+	FreshLicense FreshLicense `yaml:"fresh_license,omitempty"`
+	// vendor fields and links added to the status documents
+	Extensions StatusExtensions `yaml:"extensions,omitempty"`
+}
+
+// StatusExtensions adds vendor fields and links to the status documents: the default extension
+// applies to all the licenses, the extension of a provider to its licenses, after the default one.
+type StatusExtensions struct {
+	Default   StatusExtension            `yaml:"default,omitempty"`
+	Providers map[string]StatusExtension `yaml:"providers,omitempty"`
+}
+
+// StatusExtension is a set of fields and links added to a status document. The names of the fields
+// are URIs (e.g. https://vendor.example.com/support), so that they never clash with the fields
+// of the specification; their values are any JSON value.
+type StatusExtension struct {
+	Fields map[string]interface{} `yaml:"fields,omitempty"`
+	Links  []ExtensionLink        `yaml:"links,omitempty"`
+}
+
+// ExtensionLink is a link added to a status document; "{license_id}" in its href is replaced
+// by the id of the license. A rel which is not defined by the specification must be a URI.
+type ExtensionLink struct {
+	Rel       string `yaml:"rel"`
+	Href      string `yaml:"href"`
+	Type      string `yaml:"type,omitempty"`
+	Title     string `yaml:"title,omitempty"`
+	Profile   string `yaml:"profile,omitempty"`
+	Templated bool   `yaml:"templated,omitempty"`
+}
+
+// JSONFields returns the fields of an extension as JSON values, or an error naming the first field
+// whose value cannot be expressed in JSON.
+func (e StatusExtension) JSONFields() (map[string]interface{}, error) {
+	fields := make(map[string]interface{}, len(e.Fields))
+	for name, value := range e.Fields {
+		v, err := jsonValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", name, err)
+		}
+		fields[name] = v
+	}
+	return fields, nil
+}
+
+// jsonValue converts a value decoded from yaml, whose maps have interface{} keys, to a JSON value
+func jsonValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, bool, string, int, int64, uint64, float64:
+		return v, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if list[i], err = jsonValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("the key %v is not a string", key)
+			}
+			var err error
+			if object[k], err = jsonValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return object, nil
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			var err error
+			if object[k], err = jsonValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return object, nil
+	}
+	return nil, fmt.Errorf("unsupported value %v", value)
+}
+
+// FreshLicense configures the license link of the status documents: when enabled, the link points
+// to the License Status Server, which requests the license signed again from the License Server,
+// instead of license_link_url.
+type FreshLicense struct {
+	Enabled  bool `yaml:"enabled"`
+	Attempts int  `yaml:"attempts,omitempty"` // attempts of a request to the License Server, 3 by default
+	Timeout  int  `yaml:"timeout,omitempty"`  // timeout of an attempt in seconds, 10 by default
+}
+
+// PotentialRights selects the policy which computes the potential end of a loan, i.e. the date until which
+// it can be renewed; a policy is resolved per license from its tenant, then its provider, then the default.
+type PotentialRights struct {
+	Policy      string            `yaml:"policy,omitempty"`       // renting_days (default), fixed, rolling or publisher
+	FixedEnd    string            `yaml:"fixed_end,omitempty"`    // max end date of the fixed policy, RFC 3339
+	RollingDays int               `yaml:"rolling_days,omitempty"` // number of days from now of the rolling policy
+	Tenants     map[string]string `yaml:"tenants,omitempty"`      // policy per tenant
+	Providers   map[string]string `yaml:"providers,omitempty"`    // policy per provider of the licenses
+}
+
+type Packaging struct {
+	// resources matching one of these rules are not encrypted
+	Exemptions []ExemptionRule `yaml:"exemptions,omitempty"`
+	// media types (or ranges, e.g. "text/*") of resources deflated before encryption
+	CompressTypes []string `yaml:"compress_types,omitempty"`
+	// media types (or ranges, e.g. "audio/*") of resources stored without compression;
+	// they take precedence over compress_types
+	NoCompressTypes []string `yaml:"no_compress_types,omitempty"`
+	// handling by the License Server of a publication already encrypted as another content,
+	// detected by the checksum of its source: "reject", "alias" (the new id stands for the existing
+	// content), or accepted as a new content if empty
+	Duplicates string `yaml:"duplicates,omitempty"`
+	// encryption of the EPUB files uploaded to the License Server (POST /contents/pack), by a pool of workers:
+	// number of workers (2 by default), attempts of an encryption (3 by default),
+	// and directory of the uploaded files waiting for their encryption (the temporary directory by default)
+	Workers         int    `yaml:"workers,omitempty"`
+	MaxAttempts     int    `yaml:"max_attempts,omitempty"`
+	UploadDirectory string `yaml:"upload_directory,omitempty"`
+}
+
+// ExemptionRule selects resources by path (glob pattern) or media type ("image/*" is accepted);
+// if MaxSize is set, only resources up to this size (in bytes) are selected
+type ExemptionRule struct {
+	Pattern   string `yaml:"pattern,omitempty"`
+	MediaType string `yaml:"media_type,omitempty"`
+	MaxSize   int64  `yaml:"max_size,omitempty"`
 }
 
 type Localization struct {
@@ -126,69 +679,120 @@ type Localization struct {
 
 var Config Configuration
 
+// ReadConfig reads the configuration file, then applies the overrides of the LCP_* environment variables.
+// The file may be missing if the configuration is entirely set by environment variables, e.g. in a container.
 func ReadConfig(configFileName string) {
 	filename, _ := filepath.Abs(configFileName)
 	yamlFile, err := ioutil.ReadFile(filename)
 
-	if err != nil {
+	if err != nil && !(os.IsNotExist(err) && hasEnvOverrides()) {
 		panic("Can't read config file: " + configFileName)
 	}
 
-	err = yaml.Unmarshal(yamlFile, &Config)
+	if err == nil {
+		err = yaml.Unmarshal(yamlFile, &Config)
+		if err != nil {
+			panic("Can't unmarshal config. " + configFileName + " -> " + err.Error())
+		}
+	}
 
+	err = ApplyEnv()
 	if err != nil {
-		panic("Can't unmarshal config. " + configFileName + " -> " + err.Error())
+		panic("Can't apply the environment to the config. " + err.Error())
 	}
 }
 
 func SetPublicUrls() error {
+	return setPublicUrls(&Config)
+}
+
+// Listen returns the address a server listens on: its listen address if set, else the given default address
+func (info ServerInfo) Listen(defaultAddr string) string {
+	if info.ListenAddress != "" {
+		return info.ListenAddress
+	}
+	return defaultAddr
+}
+
+// placeholders of the link templates, replaced by the public base urls of the servers, e.g.
+// "{lsd_base_url}/licenses/{license_id}/status"
+const (
+	LcpBaseUrlPlaceholder      = "{lcp_base_url}"
+	LsdBaseUrlPlaceholder      = "{lsd_base_url}"
+	FrontendBaseUrlPlaceholder = "{frontend_base_url}"
+)
+
+// expandBaseUrls replaces the base url placeholders of a link template by the public base urls of the servers
+func expandBaseUrls(c *Configuration, link string) string {
+	return strings.NewReplacer(
+		LcpBaseUrlPlaceholder, c.LcpServer.PublicBaseUrl,
+		LsdBaseUrlPlaceholder, c.LsdServer.PublicBaseUrl,
+		FrontendBaseUrlPlaceholder, c.FrontendServer.PublicBaseUrl,
+	).Replace(link)
+}
+
+// scheme returns the scheme of the default public base url of a server
+func scheme(info ServerInfo) string {
+	if info.TLS.Enabled {
+		return "https://"
+	}
+	return "http://"
+}
+
+func setPublicUrls(c *Configuration) error {
 	var lcpPublicBaseUrl, lsdPublicBaseUrl, frontendPublicBaseUrl, lcpHost, lsdHost, frontendHost string
 	var lcpPort, lsdPort, frontendPort int
 	var err error
 
-	if lcpHost = Config.LcpServer.Host; lcpHost == "" {
+	if lcpHost = c.LcpServer.Host; lcpHost == "" {
 		lcpHost, err = os.Hostname()
 		if err != nil {
 			return err
 		}
 	}
 
-	if lsdHost = Config.LsdServer.Host; lsdHost == "" {
+	if lsdHost = c.LsdServer.Host; lsdHost == "" {
 		lsdHost, err = os.Hostname()
 		if err != nil {
 			return err
 		}
 	}
 
-	if frontendHost = Config.FrontendServer.Host; frontendHost == "" {
+	if frontendHost = c.FrontendServer.Host; frontendHost == "" {
 		frontendHost, err = os.Hostname()
 		if err != nil {
 			return err
 		}
 	}
 
-	if lcpPort = Config.LcpServer.Port; lcpPort == 0 {
+	if lcpPort = c.LcpServer.Port; lcpPort == 0 {
 		lcpPort = 8989
 	}
-	if lsdPort = Config.LsdServer.Port; lsdPort == 0 {
+	if lsdPort = c.LsdServer.Port; lsdPort == 0 {
 		lsdPort = 8990
 	}
-	if frontendPort = Config.FrontendServer.Port; frontendPort == 0 {
+	if frontendPort = c.FrontendServer.Port; frontendPort == 0 {
 		frontendPort = 80
 	}
 
-	if lcpPublicBaseUrl = Config.LcpServer.PublicBaseUrl; lcpPublicBaseUrl == "" {
-		lcpPublicBaseUrl = "http://" + lcpHost + ":" + strconv.Itoa(lcpPort)
-		Config.LcpServer.PublicBaseUrl = lcpPublicBaseUrl
+	if lcpPublicBaseUrl = c.LcpServer.PublicBaseUrl; lcpPublicBaseUrl == "" {
+		lcpPublicBaseUrl = scheme(c.LcpServer) + lcpHost + ":" + strconv.Itoa(lcpPort)
+		c.LcpServer.PublicBaseUrl = lcpPublicBaseUrl
+	}
+	if lsdPublicBaseUrl = c.LsdServer.PublicBaseUrl; lsdPublicBaseUrl == "" {
+		lsdPublicBaseUrl = scheme(c.LsdServer.ServerInfo) + lsdHost + ":" + strconv.Itoa(lsdPort)
+		c.LsdServer.PublicBaseUrl = lsdPublicBaseUrl
 	}
-	if lsdPublicBaseUrl = Config.LsdServer.PublicBaseUrl; lsdPublicBaseUrl == "" {
-		lsdPublicBaseUrl = "http://" + lsdHost + ":" + strconv.Itoa(lsdPort)
-		Config.LsdServer.PublicBaseUrl = lsdPublicBaseUrl
+	if frontendPublicBaseUrl = c.FrontendServer.PublicBaseUrl; frontendPublicBaseUrl == "" {
+		frontendPublicBaseUrl = scheme(c.FrontendServer.ServerInfo) + frontendHost + ":" + strconv.Itoa(frontendPort)
+		c.FrontendServer.PublicBaseUrl = frontendPublicBaseUrl
 	}
-	if frontendPublicBaseUrl = Config.FrontendServer.PublicBaseUrl; frontendPublicBaseUrl == "" {
-		frontendPublicBaseUrl = "http://" + frontendHost + ":" + strconv.Itoa(frontendPort)
-		Config.FrontendServer.PublicBaseUrl = frontendPublicBaseUrl
+
+	// the links of the licenses, status documents and publications are built on the public base urls
+	for rel, link := range c.License.Links {
+		c.License.Links[rel] = expandBaseUrls(c, link)
 	}
+	c.LsdServer.LicenseLinkUrl = expandBaseUrls(c, c.LsdServer.LicenseLinkUrl)
 
 	return err
 }
@@ -0,0 +1,189 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding the configuration:
+// the key "lcp.port" is overridden by LCP_LCP_PORT, "storage.filesystem.directory" by LCP_STORAGE_FILESYSTEM_DIRECTORY.
+const EnvPrefix = "LCP_"
+
+// Keys returns the keys of the configuration which can be overridden, e.g. "lcp.port".
+// Lists of sections (tenants, provider certificates, packaging exemptions) can only be set in the configuration file.
+func Keys() []string {
+	var keys []string
+	walk(reflect.ValueOf(&Config).Elem(), "", func(key string, v reflect.Value) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// EnvName returns the environment variable which overrides a key
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// Set sets the value of a key of the configuration, from its text representation.
+// Lists are comma separated, maps (e.g. license.links) are comma separated name=value pairs.
+func Set(key, value string) error {
+	return set(&Config, key, value)
+}
+
+func set(c *Configuration, key, value string) error {
+	var field reflect.Value
+	walk(reflect.ValueOf(c).Elem(), "", func(k string, v reflect.Value) {
+		if k == key {
+			field = v
+		}
+	})
+	if !field.IsValid() {
+		return errors.New("unknown configuration key " + key)
+	}
+	if err := setValue(field, value); err != nil {
+		return errors.New(key + ": " + err.Error())
+	}
+	return nil
+}
+
+// ApplyEnv overrides the configuration with the LCP_* environment variables
+func ApplyEnv() error {
+	return applyEnv(&Config)
+}
+
+func applyEnv(c *Configuration) error {
+	for _, key := range Keys() {
+		if value, ok := os.LookupEnv(EnvName(key)); ok {
+			if err := set(c, key, value); err != nil {
+				return errors.New(EnvName(key) + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// hasEnvOverrides returns true if at least one key is set by an environment variable
+func hasEnvOverrides() bool {
+	for _, key := range Keys() {
+		if _, ok := os.LookupEnv(EnvName(key)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterFlags defines a command line flag for each key of the configuration, e.g. -lcp.port=8989.
+// ApplyFlags must be called after the configuration file is read.
+func RegisterFlags(fs *flag.FlagSet) {
+	for _, key := range Keys() {
+		fs.String(key, "", "overrides "+key+" of the configuration file")
+	}
+}
+
+// ApplyFlags overrides the configuration with the flags set on the command line;
+// they take precedence over the environment variables.
+func ApplyFlags(fs *flag.FlagSet) error {
+	return applyFlags(&Config, fs)
+}
+
+func applyFlags(c *Configuration, fs *flag.FlagSet) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		for _, key := range Keys() {
+			if key == f.Name {
+				err = set(c, key, f.Value.String())
+				return
+			}
+		}
+	})
+	return err
+}
+
+// walk calls fn for each scalar, list of scalars or map of the configuration, with its yaml key
+func walk(v reflect.Value, prefix string, fn func(key string, v reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		inline := len(tag) > 1 && tag[1] == "inline"
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		key := prefix + name
+		fv := v.Field(i)
+		switch f.Type.Kind() {
+		case reflect.Struct:
+			if inline {
+				walk(fv, prefix, fn)
+			} else {
+				walk(fv, key+".", fn)
+			}
+		case reflect.Slice:
+			if f.Type.Elem().Kind() == reflect.String {
+				fn(key, fv)
+			}
+		case reflect.Map:
+			if f.Type.Key().Kind() == reflect.String && f.Type.Elem().Kind() == reflect.String {
+				fn(key, fv)
+			}
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64:
+			fn(key, fv)
+		}
+	}
+}
+
+func setValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("invalid boolean " + value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return errors.New("invalid integer " + value)
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case reflect.Map:
+		m := make(map[string]string)
+		for _, pair := range strings.Split(value, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return errors.New("invalid name=value pair " + pair)
+			}
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		v.Set(reflect.ValueOf(m))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package config
+
+import (
+	"flag"
+	"os"
+	"testing"
+)
+
+func TestEnvOverrides(t *testing.T) {
+	Config = Configuration{}
+	os.Setenv("LCP_LCP_PORT", "9000")
+	os.Setenv("LCP_STORAGE_FILESYSTEM_DIRECTORY", "/data/storage")
+	os.Setenv("LCP_STORAGE_MODE", "s3")
+	os.Setenv("LCP_LSD_PUBLIC_BASE_URL", "https://lsd.example.com")
+	os.Setenv("LCP_LICENSE_LINKS", "status=https://lsd.example.com/licenses/{license_id}/status, hint=https://example.com/hint")
+	os.Setenv("LCP_PACKAGING_COMPRESS_TYPES", "text/*, application/xhtml+xml")
+	defer func() {
+		for _, name := range []string{"LCP_LCP_PORT", "LCP_STORAGE_FILESYSTEM_DIRECTORY", "LCP_STORAGE_MODE",
+			"LCP_LSD_PUBLIC_BASE_URL", "LCP_LICENSE_LINKS", "LCP_PACKAGING_COMPRESS_TYPES"} {
+			os.Unsetenv(name)
+		}
+		Config = Configuration{}
+	}()
+
+	if err := ApplyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if Config.LcpServer.Port != 9000 || Config.Storage.FileSystem.Directory != "/data/storage" || Config.Storage.Mode != "s3" {
+		t.Errorf("Unexpected configuration %+v", Config)
+	}
+	if Config.LsdServer.PublicBaseUrl != "https://lsd.example.com" {
+		t.Errorf("Expected the inline key lsd.public_base_url to be set, got %s", Config.LsdServer.PublicBaseUrl)
+	}
+	if Config.License.Links["hint"] != "https://example.com/hint" || len(Config.License.Links) != 2 {
+		t.Errorf("Unexpected links %v", Config.License.Links)
+	}
+	if len(Config.Packaging.CompressTypes) != 2 || Config.Packaging.CompressTypes[1] != "application/xhtml+xml" {
+		t.Errorf("Unexpected list %v", Config.Packaging.CompressTypes)
+	}
+
+	os.Setenv("LCP_LCP_PORT", "http")
+	if err := ApplyEnv(); err == nil {
+		t.Error("Expected an error for an invalid port")
+	}
+}
+
+func TestFlagOverrides(t *testing.T) {
+	Config = Configuration{}
+	defer func() { Config = Configuration{} }()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	if err := fs.Parse([]string{"-lcp.readonly=true", "-lsd.license_link_url", "https://example.com/{license_id}"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyFlags(fs); err != nil {
+		t.Fatal(err)
+	}
+	if !Config.LcpServer.ReadOnly || Config.LsdServer.LicenseLinkUrl != "https://example.com/{license_id}" {
+		t.Errorf("Unexpected configuration %+v", Config)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	Config = Configuration{}
+	defer func() { Config = Configuration{} }()
+
+	Config.LcpServer.Port = 70000
+	Config.Cache.Type = "memcached"
+	err := Validate(LcpServerName)
+	verr, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+	// port, auth file, certificate, private key and cache are all reported
+	if len(verr) != 5 {
+		t.Errorf("Expected 5 problems, got %d: %v", len(verr), verr)
+	}
+
+	Config = Configuration{}
+	Config.FrontendServer.ProviderUri = "https://provider.example.com"
+	if err = Validate(FrontendServerName); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPublicUrls(t *testing.T) {
+	c := &Configuration{}
+	c.LcpServer.ListenAddress = "0.0.0.0:8989"
+	c.LcpServer.PublicBaseUrl = "https://lcp.example.com"
+	c.LsdServer.PublicBaseUrl = "https://lsd.example.com"
+	c.FrontendServer.Host = "frontend.example.com"
+	c.License.Links = map[string]string{"status": "{lsd_base_url}/licenses/{license_id}/status", "hint": "{frontend_base_url}/hint"}
+	c.LsdServer.LicenseLinkUrl = "{lcp_base_url}/licenses/{license_id}"
+	if err := setPublicUrls(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.License.Links["status"] != "https://lsd.example.com/licenses/{license_id}/status" ||
+		c.License.Links["hint"] != "http://frontend.example.com:80/hint" ||
+		c.LsdServer.LicenseLinkUrl != "https://lcp.example.com/licenses/{license_id}" {
+		t.Errorf("Expected the links to use the public base urls, got %v and %s", c.License.Links, c.LsdServer.LicenseLinkUrl)
+	}
+	// the listen address does not change the public base url
+	if c.LcpServer.Listen(":8989") != "0.0.0.0:8989" || c.LsdServer.Listen(":8990") != ":8990" {
+		t.Errorf("Unexpected listen addresses %s, %s", c.LcpServer.Listen(":8989"), c.LsdServer.Listen(":8990"))
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Reloadable lists the keys of the License Server configuration which can be changed without a restart.
+// Their values must be read with the accessors below, which are safe while a reload is in progress.
+var Reloadable = []string{
+	"license.links",
+	"lsd_notify_auth.username",
+	"lsd_notify_auth.password",
+	"signed_urls.ttl",
+	"streamer.auth.username",
+	"streamer.auth.password",
+	"streamer.allowed_ips",
+	"service_tokens.signing_key",
+	"service_tokens.secrets",
+	"service_tokens.private_keys",
+	"service_tokens.public_keys",
+	"service_tokens.ttl",
+	"features",
+}
+
+var reloadMutex sync.RWMutex
+
+// NotifyAuth returns the credentials used to notify the License Status Server
+func NotifyAuth() Auth {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	return Config.LsdNotifyAuth
+}
+
+// LicenseLinks returns a copy of the link templates of the licenses
+func LicenseLinks() map[string]string {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	links := make(map[string]string, len(Config.License.Links))
+	for name, link := range Config.License.Links {
+		links[name] = link
+	}
+	return links
+}
+
+// SignedURLsTTL returns the validity of the signed download urls, in seconds
+func SignedURLsTTL() int {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	return Config.SignedURLs.TTL
+}
+
+// StreamerConfig returns the parameters of the streamer
+func StreamerConfig() Streamer {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	return Config.Streamer
+}
+
+// ServiceTokensConfig returns a copy of the keys and parameters of the service tokens
+func ServiceTokensConfig() ServiceTokens {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	st := Config.ServiceTokens
+	st.Secrets = copyMap(st.Secrets)
+	st.PrivateKeys = copyMap(st.PrivateKeys)
+	st.PublicKeys = copyMap(st.PublicKeys)
+	return st
+}
+
+// FeaturesConfig returns a copy of the rollouts of the features
+func FeaturesConfig() map[string]string {
+	reloadMutex.RLock()
+	defer reloadMutex.RUnlock()
+	return copyMap(Config.Features)
+}
+
+func copyMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// Reload reads the configuration file, the environment and the flags again, then applies the changes
+// of the reloadable settings. It returns the applied changes and the changed keys which need a restart;
+// the configuration is left untouched if the new one is not valid.
+//
+func Reload(configFileName, server string, fs *flag.FlagSet) (changes []string, ignored []string, err error) {
+	var next Configuration
+	filename, _ := filepath.Abs(configFileName)
+	yamlFile, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = yaml.Unmarshal(yamlFile, &next)
+	} else if hasEnvOverrides() {
+		err = nil
+	}
+	if err != nil {
+		return nil, nil, errors.New("Can't read config file " + configFileName + ": " + err.Error())
+	}
+	if err = applyEnv(&next); err != nil {
+		return nil, nil, err
+	}
+	if fs != nil {
+		if err = applyFlags(&next, fs); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err = validate(&next, server); err != nil {
+		return nil, nil, err
+	}
+	if err = setPublicUrls(&next); err != nil {
+		return nil, nil, err
+	}
+
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	current, updated := values(&Config), values(&next)
+	for _, key := range Keys() {
+		old, value := current[key], updated[key]
+		if reflect.DeepEqual(old.Interface(), value.Interface()) {
+			continue
+		}
+		if !isReloadable(key) {
+			ignored = append(ignored, key)
+			continue
+		}
+		changes = append(changes, key+": "+display(key, old)+" -> "+display(key, value))
+		old.Set(value)
+	}
+	return changes, ignored, nil
+}
+
+// values returns the settings of a configuration by key
+func values(c *Configuration) map[string]reflect.Value {
+	m := make(map[string]reflect.Value)
+	walk(reflect.ValueOf(c).Elem(), "", func(key string, v reflect.Value) {
+		m[key] = v
+	})
+	return m
+}
+
+func isReloadable(key string) bool {
+	for _, k := range Reloadable {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// display returns a value for the logs; secrets are masked
+func display(key string, v reflect.Value) string {
+	if strings.Contains(key, "password") || strings.Contains(key, "secret") || strings.Contains(key, "token") {
+		return "***"
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yaml")
+	writeConfig := func(content string) {
+		if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig("frontend:\n  provider_uri: https://provider.example.com\n  port: 8991\nlsd_notify_auth:\n  username: adm\n  password: old\n")
+	Config = Configuration{}
+	defer func() { Config = Configuration{} }()
+	ReadConfig(configFile)
+	SetPublicUrls()
+
+	// a reloadable and a non reloadable setting are changed
+	writeConfig("frontend:\n  provider_uri: https://provider.example.com\n  port: 8992\nlsd_notify_auth:\n  username: adm\n  password: new\n")
+	changes, ignored, err := Reload(configFile, FrontendServerName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0] != "lsd_notify_auth.password: *** -> ***" {
+		t.Errorf("Unexpected changes %v", changes)
+	}
+	// the default public url follows the port
+	if len(ignored) != 2 || ignored[0] != "frontend.port" || ignored[1] != "frontend.public_base_url" {
+		t.Errorf("Unexpected ignored changes %v", ignored)
+	}
+	if NotifyAuth().Password != "new" || Config.FrontendServer.Port != 8991 {
+		t.Errorf("Unexpected configuration %+v", Config)
+	}
+
+	// an invalid configuration is not applied
+	writeConfig("lsd_notify_auth:\n  username: adm\n  password: other\n")
+	if _, _, err = Reload(configFile, FrontendServerName, nil); err == nil {
+		t.Error("Expected a validation error")
+	}
+	if NotifyAuth().Password != "new" {
+		t.Error("Expected the configuration to be unchanged")
+	}
+}
@@ -0,0 +1,565 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the servers whose configuration can be validated
+const (
+	LcpServerName      = "lcp"
+	LsdServerName      = "lsd"
+	FrontendServerName = "frontend"
+)
+
+// ValidationError lists all the missing or invalid settings of a configuration
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n- " + strings.Join(e, "\n- ")
+}
+
+type validator struct {
+	errs ValidationError
+}
+
+func (v *validator) fail(key, msg string) {
+	v.errs = append(v.errs, key+": "+msg)
+}
+
+func (v *validator) required(key, value string) bool {
+	if value == "" {
+		v.fail(key, "missing value (or "+EnvName(key)+")")
+		return false
+	}
+	return true
+}
+
+// file checks that a mandatory file exists
+func (v *validator) file(key, path string) {
+	if !v.required(key, path) {
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		v.fail(key, "cannot access "+path)
+	}
+}
+
+// serviceKey checks that a key of the service tokens is a RSA or P-256 key, the keys of RS256 and ES256;
+// a private key is a PKCS #1, EC or PKCS #8 key, a public key a PKIX key or a certificate
+func (v *validator) serviceKey(key, path string, private bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		// reported by file
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		v.fail(key, "no PEM key in "+path)
+		return
+	}
+	var parsed interface{}
+	if private {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			if parsed, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			}
+		}
+	} else if parsed, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			parsed = cert.PublicKey
+		}
+	}
+	if err != nil {
+		v.fail(key, "invalid key in "+path)
+		return
+	}
+	switch k := parsed.(type) {
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			v.fail(key, "must be a RSA or P-256 key")
+		}
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			v.fail(key, "must be a RSA or P-256 key")
+		}
+	}
+}
+
+// rightsRules checks the limits of the rights of the licenses
+func (v *validator) rightsRules(key string, rules RightsRules) {
+	if rules.MinLoanDays < 0 {
+		v.fail(key+".min_loan_days", "negative number of days")
+	}
+	if rules.MaxLoanDays < 0 {
+		v.fail(key+".max_loan_days", "negative number of days")
+	}
+	if rules.MaxLoanDays > 0 && rules.MinLoanDays > rules.MaxLoanDays {
+		v.fail(key+".min_loan_days", "greater than max_loan_days")
+	}
+	switch rules.LoanEnforcement {
+	case "", "reject", "clamp":
+	default:
+		v.fail(key+".loan_enforcement", "must be reject or clamp")
+	}
+}
+
+// sampleLink replaces the base url placeholders of a link template, which may not be known yet, by a sample url
+func sampleLink(link string) string {
+	return strings.NewReplacer(
+		LcpBaseUrlPlaceholder, "http://lcp",
+		LsdBaseUrlPlaceholder, "http://lsd",
+		FrontendBaseUrlPlaceholder, "http://frontend",
+	).Replace(link)
+}
+
+func (v *validator) server(key string, info ServerInfo) {
+	if info.Port < 0 || info.Port > 65535 {
+		v.fail(key+".port", "invalid port "+strconv.Itoa(info.Port))
+	}
+	v.url(key+".public_base_url", info.PublicBaseUrl)
+	if info.ListenAddress != "" {
+		if _, port, err := net.SplitHostPort(info.ListenAddress); err != nil || port == "" {
+			v.fail(key+".listen_address", "invalid address "+info.ListenAddress+", host:port expected")
+		}
+	}
+	v.database(key+".database", info.Database)
+	v.database(key+".replica_database", info.ReplicaDatabase)
+	if info.MaxOpenConns < 0 || info.MaxIdleConns < 0 || info.ConnMaxLifetime < 0 {
+		v.fail(key, "negative database pool setting")
+	}
+	if info.TLS.Enabled {
+		if len(info.TLS.ACME.Domains) > 0 {
+			v.required(key+".tls.acme.cache_dir", info.TLS.ACME.CacheDir)
+			v.url(key+".tls.acme.directory_url", info.TLS.ACME.DirectoryURL)
+		} else {
+			v.file(key+".tls.cert", info.TLS.Cert)
+			v.file(key+".tls.private_key", info.TLS.PrivateKey)
+		}
+		if m := info.TLS.MinVersion; m != "" && m != "1.2" && m != "1.3" {
+			v.fail(key+".tls.min_version", "unknown version "+m+", 1.2 or 1.3 expected")
+		}
+		if info.TLS.RedirectPort < 0 || info.TLS.RedirectPort > 65535 {
+			v.fail(key+".tls.redirect_port", "invalid port "+strconv.Itoa(info.TLS.RedirectPort))
+		}
+	}
+	if info.MaxBodySize < 0 || info.MaxUploadSize < 0 {
+		v.fail(key, "negative max_body_size or max_upload_size")
+	}
+	if t := info.Timeouts; t.Read < 0 || t.Write < 0 || t.Idle < 0 || t.Handler < 0 || t.SlowRequest < 0 {
+		v.fail(key+".timeouts", "negative timeout")
+	}
+	if info.RateLimit.Requests < 0 || info.RateLimit.Window < 0 {
+		v.fail(key+".rate_limit", "negative requests or window")
+	}
+	if info.Maintenance.RetryAfter < 0 {
+		v.fail(key+".maintenance.retry_after", "negative retry_after")
+	}
+	if info.Idempotency.TTL < 0 {
+		v.fail(key+".idempotency.ttl", "negative ttl")
+	}
+	for _, proxy := range info.Proxy.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			v.fail(key+".proxy.trusted_proxies", "invalid address or range "+proxy)
+		}
+	}
+	for prefix, seconds := range info.Timeouts.Routes {
+		if !strings.HasPrefix(prefix, "/") || seconds < 0 {
+			v.fail(key+".timeouts.routes", "invalid route "+prefix+": "+strconv.Itoa(seconds))
+		}
+	}
+	switch info.AccessLog.Format {
+	case "", "combined", "json", "off":
+	default:
+		v.fail(key+".access_log.format", "unknown format "+info.AccessLog.Format)
+	}
+	if info.CORS.MaxAge < 0 {
+		v.fail(key+".cors.max_age", "negative max age")
+	}
+	if info.CORS.AllowCredentials {
+		// the credentials must not be sent to any origin
+		if len(info.CORS.AllowedOrigins) == 0 {
+			v.fail(key+".cors.allowed_origins", "credentials allowed without allowed origins")
+		}
+		for _, origin := range info.CORS.AllowedOrigins {
+			if origin == "*" {
+				v.fail(key+".cors.allowed_origins", "credentials allowed for any origin")
+			}
+		}
+	}
+}
+
+// url checks an optional absolute http(s) url
+func (v *validator) url(key, value string) {
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.fail(key, "invalid url "+value)
+	}
+}
+
+// isStatusLinkRel checks if a link relation is one of the links set by the License Status Server
+func isStatusLinkRel(rel string) bool {
+	switch rel {
+	case "license", "register", "return", "renew", "rights":
+		return true
+	}
+	return false
+}
+
+// nextCertificate checks the certificate of a key rotation, if set
+func (v *validator) nextCertificate(key string, next NextCertificate) {
+	if next.Cert == "" && next.PrivateKey == "" && next.Chain == "" && next.Policy == "" {
+		return
+	}
+	v.file(key+".cert", next.Cert)
+	v.file(key+".private_key", next.PrivateKey)
+	if next.Chain != "" {
+		v.file(key+".chain", next.Chain)
+	}
+	switch next.Policy {
+	case "", "staged", "new", "all":
+	default:
+		v.fail(key+".policy", "must be staged, new or all")
+	}
+}
+
+// extension checks the fields and links added to the status documents
+func (v *validator) extension(key string, e StatusExtension) {
+	for name := range e.Fields {
+		if u, err := url.Parse(name); err != nil || !u.IsAbs() {
+			v.fail(key+".fields", "the name "+name+" is not a URI")
+		}
+	}
+	if _, err := e.JSONFields(); err != nil {
+		v.fail(key+".fields", err.Error())
+	}
+	for i, l := range e.Links {
+		lkey := key + ".links[" + strconv.Itoa(i) + "]"
+		if isStatusLinkRel(l.Rel) {
+			v.fail(lkey+".rel", "the rel "+l.Rel+" is set by the server")
+		} else if u, err := url.Parse(l.Rel); err != nil || !u.IsAbs() {
+			v.fail(lkey+".rel", "the rel "+l.Rel+" is not a URI")
+		}
+		if v.required(lkey+".href", l.Href) {
+			v.url(lkey+".href", strings.Replace(l.Href, "{license_id}", "id", -1))
+		}
+	}
+}
+
+// database checks an optional database uri, e.g. sqlite3://file:lcp.sqlite
+func (v *validator) database(key, value string) {
+	if value != "" && !strings.Contains(value, "://") {
+		v.fail(key, "invalid database uri, driver://datasource expected")
+	}
+}
+
+// Validate checks the configuration of a server (LcpServerName, LsdServerName or FrontendServerName)
+// and returns a ValidationError listing all the problems found, or nil.
+func Validate(server string) error {
+	return validate(&Config, server)
+}
+
+func validate(c *Configuration, server string) error {
+	v := &validator{}
+
+	if c.Profile != "" && c.Profile != "basic" && c.Profile != "1.0" {
+		v.fail("profile", "unknown profile "+c.Profile)
+	}
+	for i, t := range c.License.Templates {
+		key := "license.templates[" + strconv.Itoa(i) + "]"
+		if t.Profile != "" && t.Profile != "basic" && t.Profile != "1.0" {
+			v.fail(key+".profile", "unknown profile "+t.Profile)
+		}
+		if t.Days < 0 || (t.Print != nil && *t.Print < 0) || (t.Copy != nil && *t.Copy < 0) {
+			v.fail(key, "negative days, print or copy")
+		}
+	}
+
+	for profile, algorithms := range c.License.HashAlgorithms {
+		if profile != "basic" && profile != "1.0" {
+			v.fail("license.hash_algorithms", "unknown profile "+profile)
+		}
+		if len(algorithms) == 0 {
+			v.fail("license.hash_algorithms."+profile, "no algorithm")
+		}
+	}
+	for _, field := range c.License.EncryptUserFields {
+		if field != "email" && field != "name" {
+			v.fail("license.encrypt_user_fields", "unknown user field "+field)
+		}
+	}
+
+	for name, rollout := range c.Features {
+		for _, target := range strings.Fields(rollout) {
+			if !strings.HasSuffix(target, "%") {
+				continue
+			}
+			if percent, err := strconv.Atoi(strings.TrimSuffix(target, "%")); err != nil || percent < 0 || percent > 100 {
+				v.fail("features."+name, "invalid percentage "+target)
+			}
+		}
+	}
+
+	if st := c.ServiceTokens; st.SigningKey != "" {
+		_, secret := st.Secrets[st.SigningKey]
+		_, private := st.PrivateKeys[st.SigningKey]
+		if !secret && !private {
+			v.fail("service_tokens.signing_key", "no secret or private key "+st.SigningKey)
+		}
+	}
+	for kid, file := range c.ServiceTokens.PrivateKeys {
+		v.file("service_tokens.private_keys."+kid, file)
+		v.serviceKey("service_tokens.private_keys."+kid, file, true)
+	}
+	for kid, file := range c.ServiceTokens.PublicKeys {
+		v.file("service_tokens.public_keys."+kid, file)
+		v.serviceKey("service_tokens.public_keys."+kid, file, false)
+	}
+	if c.ServiceTokens.TTL < 0 {
+		v.fail("service_tokens.ttl", "negative ttl")
+	}
+
+	if dsn := c.ErrorReporting.SentryDSN; dsn != "" {
+		if u, err := url.Parse(dsn); err != nil || u.User == nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			v.fail("error_reporting.sentry_dsn", "invalid dsn")
+		}
+	}
+
+	if c.Clock.Offset != "" {
+		if _, err := time.ParseDuration(c.Clock.Offset); err != nil {
+			v.fail("clock.offset", "invalid duration")
+		}
+	}
+	if c.Clock.Location != "" {
+		if _, err := time.LoadLocation(c.Clock.Location); err != nil {
+			v.fail("clock.location", "unknown timezone")
+		}
+	}
+
+	switch c.Transport.Mode {
+	case "", "http", "inprocess":
+	case "redis":
+		v.required("transport.redis_url", c.Transport.RedisURL)
+	default:
+		v.fail("transport.mode", "unknown transport "+c.Transport.Mode)
+	}
+
+	switch c.Shared.Type {
+	case "", "memory":
+	case "redis":
+		v.required("shared.redis_url", c.Shared.RedisURL)
+	default:
+		v.fail("shared.type", "unknown store "+c.Shared.Type)
+	}
+
+	if c.Staging.Mode == "s3" {
+		v.required("staging.bucket", c.Staging.Bucket)
+		v.required("staging.region", c.Staging.Region)
+	}
+	if c.Staging.MaxDownloadSize < 0 {
+		v.fail("staging.max_download_size", "negative size")
+	}
+
+	v.rightsRules("rights_policy", c.RightsPolicy.RightsRules)
+	for provider, rules := range c.RightsPolicy.Providers {
+		v.rightsRules("rights_policy.providers."+provider, rules)
+	}
+
+	switch server {
+	case LcpServerName:
+		v.server("lcp", c.LcpServer)
+		v.file("lcp.auth_file", c.LcpServer.AuthFile)
+		v.file("certificate.cert", c.Certificate.Cert)
+		v.file("certificate.private_key", c.Certificate.PrivateKey)
+		if c.Certificate.Chain != "" {
+			v.file("certificate.chain", c.Certificate.Chain)
+		}
+		v.nextCertificate("certificate.next", c.Certificate.Next)
+		v.url("lsd.public_base_url", c.LsdServer.PublicBaseUrl)
+		v.url("refunds.webhook_url", c.Refunds.WebhookURL)
+		v.url("certificate.crl.url", c.Certificate.CRL.Url)
+		if c.Certificate.ExpiryWarningDays < 0 || c.Certificate.CRL.Refresh < 0 {
+			v.fail("certificate", "negative expiry_warning_days or crl.refresh")
+		}
+		if c.Storage.Mode == "s3" {
+			v.required("storage.bucket", c.Storage.Bucket)
+			v.required("storage.region", c.Storage.Region)
+		}
+		switch c.Cache.Type {
+		case "", "memory":
+		case "redis":
+			v.required("cache.redis_url", c.Cache.RedisURL)
+		default:
+			v.fail("cache.type", "unknown cache "+c.Cache.Type)
+		}
+		if c.Cache.Size < 0 || c.Cache.TTL < 0 {
+			v.fail("cache", "negative size or ttl")
+		}
+		if c.Cache.SignedLicenses && c.Cache.Type == "" {
+			v.fail("cache.signed_licenses", "no cache type")
+		}
+		if c.Streamer.Enabled {
+			v.required("streamer.auth.username", c.Streamer.Auth.Username)
+			v.required("streamer.auth.password", c.Streamer.Auth.Password)
+		}
+		if c.SignedURLs.TTL < 0 {
+			v.fail("signed_urls.ttl", "negative ttl")
+		}
+		for i, t := range c.Tenants {
+			key := "tenants[" + strconv.Itoa(i) + "]"
+			v.required(key+".id", t.Id)
+			v.file(key+".auth_file", t.AuthFile)
+			if t.Certificate.Cert != "" || t.Certificate.PrivateKey != "" {
+				v.file(key+".certificate.cert", t.Certificate.Cert)
+				v.file(key+".certificate.private_key", t.Certificate.PrivateKey)
+			}
+			if t.Certificate.Chain != "" {
+				v.file(key+".certificate.chain", t.Certificate.Chain)
+			}
+			v.nextCertificate(key+".certificate.next", t.Certificate.Next)
+		}
+		for i, pc := range c.ProviderCerts {
+			key := "provider_certificates[" + strconv.Itoa(i) + "]"
+			v.required(key+".provider", pc.Provider)
+			v.file(key+".cert", pc.Cert)
+			v.file(key+".private_key", pc.PrivateKey)
+			if pc.Chain != "" {
+				v.file(key+".chain", pc.Chain)
+			}
+			v.nextCertificate(key+".next", pc.Next)
+		}
+		if c.Retention.LicenseDays < 0 {
+			v.fail("retention.license_days", "negative number of days")
+		}
+		if a := c.Retention.LicenseAction; a != "" && a != "archive" && a != "delete" {
+			v.fail("retention.license_action", "unknown action "+a)
+		}
+		if d := c.Packaging.Duplicates; d != "" && d != "reject" && d != "alias" {
+			v.fail("packaging.duplicates", "unknown policy "+d)
+		}
+		if c.Packaging.Workers < 0 || c.Packaging.MaxAttempts < 0 {
+			v.fail("packaging", "negative workers or max_attempts")
+		}
+		v.url("shadow.url", c.Shadow.Url)
+		if c.Shadow.SampleRate < 0 || c.Shadow.SampleRate > 1 {
+			v.fail("shadow.sample_rate", "not between 0 and 1")
+		}
+		if c.Shadow.Timeout < 0 {
+			v.fail("shadow.timeout", "negative timeout")
+		}
+	case LsdServerName:
+		v.server("lsd", c.LsdServer.ServerInfo)
+		v.file("lsd.auth_file", c.LsdServer.AuthFile)
+		if fresh := c.LicenseStatus.FreshLicense; fresh.Enabled {
+			if v.required("lcp.public_base_url", c.LcpServer.PublicBaseUrl) {
+				v.url("lcp.public_base_url", c.LcpServer.PublicBaseUrl)
+			}
+			if fresh.Attempts < 0 || fresh.Timeout < 0 {
+				v.fail("license_status.fresh_license", "negative attempts or timeout")
+			}
+		} else if v.required("lsd.license_link_url", c.LsdServer.LicenseLinkUrl) {
+			v.url("lsd.license_link_url", strings.Replace(sampleLink(c.LsdServer.LicenseLinkUrl), "{license_id}", "id", -1))
+		}
+		if c.LicenseStatus.RentingDays < 0 || c.LicenseStatus.RenewDays < 0 || c.LicenseStatus.EventsCap < 0 {
+			v.fail("license_status", "negative renting_days, renew_days or events_cap")
+		}
+		if pr := c.LicenseStatus.PotentialRights; pr.FixedEnd != "" {
+			if _, err := time.Parse(time.RFC3339, pr.FixedEnd); err != nil {
+				v.fail("license_status.potential_rights.fixed_end", "not a RFC 3339 date")
+			}
+		}
+		if c.LicenseStatus.PotentialRights.RollingDays < 0 {
+			v.fail("license_status.potential_rights.rolling_days", "negative number of days")
+		}
+		v.extension("license_status.extensions.default", c.LicenseStatus.Extensions.Default)
+		for provider, e := range c.LicenseStatus.Extensions.Providers {
+			v.extension("license_status.extensions.providers["+provider+"]", e)
+		}
+		if c.Retention.EventDays < 0 || c.Retention.ReturnedDays < 0 {
+			v.fail("retention", "negative event_days or returned_days")
+		}
+	case FrontendServerName:
+		v.server("frontend", c.FrontendServer.ServerInfo)
+		v.required("frontend.provider_uri", c.FrontendServer.ProviderUri)
+		v.url("lcp.public_base_url", c.LcpServer.PublicBaseUrl)
+		v.url("lsd.public_base_url", c.LsdServer.PublicBaseUrl)
+		if c.FrontendServer.LoanDays < 0 {
+			v.fail("frontend.loan_days", "negative number of days")
+		}
+		if c.FrontendServer.UploadWorkers < 0 {
+			v.fail("frontend.upload_workers", "negative number of workers")
+		}
+		switch m := c.FrontendServer.Mail; m.Provider {
+		case "":
+		case "smtp":
+			v.required("frontend.mail.from", m.From)
+			v.required("frontend.mail.host", m.Host)
+		case "api":
+			v.required("frontend.mail.from", m.From)
+			v.url("frontend.mail.api_url", m.APIURL)
+		default:
+			v.fail("frontend.mail.provider", "unknown provider "+m.Provider+", smtp or api expected")
+		}
+		if c.FrontendServer.Reminders.Interval < 0 {
+			v.fail("frontend.reminders.interval", "negative interval")
+		}
+		for i, ch := range c.FrontendServer.Reminders.Channels {
+			key := "frontend.reminders.channels[" + strconv.Itoa(i) + "]"
+			switch ch.Type {
+			case "email":
+				if c.FrontendServer.Mail.Provider == "" {
+					v.fail(key, "email reminders without mail provider")
+				}
+			case "webhook", "push":
+				v.url(key+".url", ch.URL)
+			default:
+				v.fail(key+".type", "unknown type "+ch.Type+", email, webhook or push expected")
+			}
+			if len(ch.Days) == 0 {
+				v.fail(key+".days", "no number of days")
+			}
+			for _, d := range ch.Days {
+				if d <= 0 {
+					v.fail(key+".days", "the number of days must be positive")
+				}
+			}
+		}
+		if r := c.FrontendServer.Renewal; r.MaxRenewals < 0 || r.WindowDays < 0 || r.Days < 0 {
+			v.fail("frontend.renewal", "negative max_renewals, window_days or days")
+		}
+	default:
+		v.fail("server", "unknown server "+server)
+	}
+
+	if c.Retention.Interval < 0 {
+		v.fail("retention.interval", "negative interval")
+	}
+	if c.Storage.GC.Interval < 0 {
+		v.fail("storage.gc.interval", "negative interval")
+	}
+	if c.Storage.PartSize < 0 {
+		v.fail("storage.part_size", "negative size")
+	}
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package crl
+
+import (
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// default number of days before the expiry of a certificate when a warning is logged
+const defaultExpiryWarningDays = 30
+
+// ExpiryDays is the number of days before the expiry of each certificate, negative once expired, exposed on /debug/vars
+var ExpiryDays = expvar.NewMap("certificate_expiry_days")
+
+// Revoked is 1 for each certificate revoked by its revocation list, exposed on /debug/vars
+var Revoked = expvar.NewMap("certificate_revoked")
+
+// Check is the state of a certificate
+type Check struct {
+	Name     string
+	NotAfter time.Time
+	Days     float64
+	Expiring bool
+	Revoked  bool
+	// CRLError is set when the revocation list of the certificate is not available
+	CRLError error
+}
+
+// expiryWarningDays returns the number of days before the expiry of a certificate when a warning is logged
+func expiryWarningDays() int {
+	if days := config.Config.Certificate.ExpiryWarningDays; days > 0 {
+		return days
+	}
+	return defaultExpiryWarningDays
+}
+
+// CheckCertificate checks the expiry of a certificate and, if the revocation lists are enabled, its revocation;
+// the metrics are updated with the result
+//
+func CheckCertificate(name string, chain *tls.Certificate) (Check, error) {
+	leaf, _, err := Leaf(chain)
+	if err != nil {
+		return Check{Name: name}, err
+	}
+	c := Check{Name: name, NotAfter: leaf.NotAfter}
+	c.Days = leaf.NotAfter.Sub(clock.Now()).Hours() / 24
+	c.Expiring = c.Days < float64(expiryWarningDays())
+	days := new(expvar.Float)
+	days.Set(c.Days)
+	ExpiryDays.Set(name, days)
+
+	if config.Config.Certificate.CRL.Enabled {
+		var list *List
+		if list, c.CRLError = Get(chain); c.CRLError == nil {
+			c.Revoked = list.IsRevoked(leaf)
+		}
+		revoked := new(expvar.Int)
+		if c.Revoked {
+			revoked.Set(1)
+		}
+		Revoked.Set(name, revoked)
+	}
+	return c, nil
+}
+
+// CheckCertificates checks the certificates of the licenses, by name, and logs the expired, expiring and revoked ones;
+// it returns an error if a certificate is revoked
+//
+func CheckCertificates(certs map[string]*tls.Certificate) error {
+	names := make([]string, 0, len(certs))
+	for name := range certs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var revoked []string
+	for _, name := range names {
+		c, err := CheckCertificate(name, certs[name])
+		if err != nil {
+			log.Println("Error checking the certificate " + name + ": " + err.Error())
+			continue
+		}
+		expiry := c.NotAfter.UTC().Format(time.RFC3339)
+		switch {
+		case c.Days < 0:
+			log.Println("Error: the certificate " + name + " expired on " + expiry + ", the reading systems reject the licenses it signs")
+		case c.Expiring:
+			log.Println("Warning: the certificate " + name + " expires on " + expiry + ", in " + strconv.Itoa(int(c.Days)) + " days")
+		}
+		if c.CRLError != nil {
+			log.Println("Warning: the revocation list of the certificate " + name + " is not available: " + c.CRLError.Error())
+		}
+		if c.Revoked {
+			log.Println("Error: the certificate " + name + " is revoked, the reading systems reject the licenses it signs")
+			revoked = append(revoked, name)
+		}
+	}
+	if len(revoked) > 0 {
+		return errors.New("Revoked certificates: " + strings.Join(revoked, ", "))
+	}
+	return nil
+}
+
+// Run checks the certificates periodically, which also fetches their revocation lists again when they are stale.
+// It never returns.
+//
+func Run(certs map[string]*tls.Certificate, interval time.Duration) {
+	for range time.Tick(interval) {
+		CheckCertificates(certs)
+	}
+}
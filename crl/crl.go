@@ -0,0 +1,197 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package crl fetches and caches the certificate revocation lists of the certificates which sign the licenses,
+// and checks that these certificates are neither revoked nor expiring.
+package crl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// a list is fetched again at least daily, even if its next update is later
+const maxRefresh = 24 * time.Hour
+
+// timeout of the download of a list
+const fetchTimeout = 30 * time.Second
+
+// maximum size of a list
+const maxSize = 10 << 20
+
+// delay before a new attempt to fetch a list, after a failure
+const retryDelay = 5 * time.Minute
+
+// ErrNoDistributionPoint is returned when a certificate has no revocation list
+var ErrNoDistributionPoint = errors.New("The certificate has no CRL distribution point")
+
+// List is a certificate revocation list, as fetched from its distribution point
+type List struct {
+	URL        string
+	DER        []byte
+	ThisUpdate time.Time
+	NextUpdate time.Time
+	Fetched    time.Time
+	revoked    map[string]bool
+}
+
+// IsRevoked returns true if the list revokes a certificate
+func (l *List) IsRevoked(cert *x509.Certificate) bool {
+	return l.revoked[cert.SerialNumber.String()]
+}
+
+// stale returns true if the list must be fetched again
+func (l *List) stale(now time.Time) bool {
+	refresh := time.Duration(config.Config.Certificate.CRL.Refresh) * time.Hour
+	if refresh <= 0 || refresh > maxRefresh {
+		refresh = maxRefresh
+	}
+	due := l.Fetched.Add(refresh)
+	if !l.NextUpdate.IsZero() && l.NextUpdate.Before(due) {
+		due = l.NextUpdate
+	}
+	return !now.Before(due)
+}
+
+// Parse parses a revocation list, in DER or PEM; its signature is checked if the issuer is given
+func Parse(data []byte, issuer *x509.Certificate) (*List, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	rl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+	if issuer != nil {
+		if err = rl.CheckSignatureFrom(issuer); err != nil {
+			return nil, errors.New("The revocation list is not signed by the issuer of the certificate: " + err.Error())
+		}
+	}
+	l := &List{DER: data, ThisUpdate: rl.ThisUpdate, NextUpdate: rl.NextUpdate, revoked: make(map[string]bool)}
+	for _, rc := range rl.RevokedCertificates {
+		l.revoked[rc.SerialNumber.String()] = true
+	}
+	return l, nil
+}
+
+// Fetch downloads the revocation list at a url; its signature is checked if the issuer is given
+func Fetch(url string, issuer *x509.Certificate) (*List, error) {
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("GET " + url + " returned " + strconv.Itoa(resp.StatusCode))
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize))
+	if err != nil {
+		return nil, err
+	}
+	l, err := Parse(data, issuer)
+	if err != nil {
+		return nil, err
+	}
+	l.URL = url
+	l.Fetched = time.Now()
+	return l, nil
+}
+
+// DistributionPoint returns the url of the revocation list of a certificate: the url of the configuration
+// if set, else the first http distribution point of the certificate
+func DistributionPoint(cert *x509.Certificate) string {
+	if url := config.Config.Certificate.CRL.Url; url != "" {
+		return url
+	}
+	for _, url := range cert.CRLDistributionPoints {
+		if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+			return url
+		}
+	}
+	return ""
+}
+
+// Leaf returns the certificate of a chain, and its issuer if it is part of the chain
+func Leaf(chain *tls.Certificate) (leaf *x509.Certificate, issuer *x509.Certificate, err error) {
+	if len(chain.Certificate) == 0 {
+		return nil, nil, errors.New("Empty certificate chain")
+	}
+	if leaf, err = x509.ParseCertificate(chain.Certificate[0]); err != nil {
+		return nil, nil, err
+	}
+	if len(chain.Certificate) > 1 {
+		if parent, err := x509.ParseCertificate(chain.Certificate[1]); err == nil && leaf.CheckSignatureFrom(parent) == nil {
+			issuer = parent
+		}
+	}
+	return leaf, issuer, nil
+}
+
+// the lists fetched by this process, and the last failures to fetch them, by url
+var (
+	listsMutex sync.Mutex
+	lists      = make(map[string]*List)
+	failures   = make(map[string]failure)
+)
+
+type failure struct {
+	at  time.Time
+	err error
+}
+
+// Get returns the revocation list of a certificate, cached until it is stale; if it cannot be fetched again,
+// the stale list is returned. After a failure, the list is not fetched again for a few minutes.
+//
+func Get(chain *tls.Certificate) (*List, error) {
+	leaf, issuer, err := Leaf(chain)
+	if err != nil {
+		return nil, err
+	}
+	url := DistributionPoint(leaf)
+	if url == "" {
+		return nil, ErrNoDistributionPoint
+	}
+	now := time.Now()
+	listsMutex.Lock()
+	cached := lists[url]
+	last, failed := failures[url]
+	listsMutex.Unlock()
+	if cached != nil && !cached.stale(now) {
+		return cached, nil
+	}
+	if failed && now.Sub(last.at) < retryDelay {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, last.err
+	}
+
+	l, err := Fetch(url, issuer)
+	listsMutex.Lock()
+	defer listsMutex.Unlock()
+	if err != nil {
+		failures[url] = failure{at: now, err: err}
+		if cached != nil {
+			log.Println("CRL: error fetching " + url + ", the list of " + cached.ThisUpdate.UTC().Format(time.RFC3339) + " is kept: " + err.Error())
+			return cached, nil
+		}
+		return nil, err
+	}
+	delete(failures, url)
+	lists[url] = l
+	return l, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package crl
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/testsupport"
+)
+
+func TestRevocationList(t *testing.T) {
+	var der []byte
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(der)
+	}))
+	defer server.Close()
+
+	ca, err := testsupport.NewCA(10 * 24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.CRLDistributionPoint = server.URL + "/root.crl"
+	good, err := ca.ProviderCertificate("https://good.example.com", testsupport.ECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := ca.ProviderCertificate("https://bad.example.com", testsupport.ECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if der, err = ca.RevocationList(time.Hour, bad); err != nil {
+		t.Fatal(err)
+	}
+	config.Config.Certificate = config.Certificate{CRL: config.CRL{Enabled: true}}
+	defer func() { config.Config.Certificate = config.Certificate{} }()
+
+	list, err := Get(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goodLeaf, _, _ := Leaf(good)
+	badLeaf, _, _ := Leaf(bad)
+	if list.IsRevoked(goodLeaf) || !list.IsRevoked(badLeaf) {
+		t.Error("Expected only the revoked certificate to be in the list")
+	}
+	if _, err = Get(bad); err != nil || fetches != 1 {
+		t.Errorf("Expected the list to be cached, got %d fetches, %v", fetches, err)
+	}
+
+	// the server refuses to start with a revoked certificate, and warns of the expiring ones
+	err = CheckCertificates(map[string]*tls.Certificate{"default": good, "https://bad.example.com": bad})
+	if err == nil || !strings.Contains(err.Error(), "https://bad.example.com") || strings.Contains(err.Error(), "default") {
+		t.Errorf("Expected the revoked certificate to be reported, got %v", err)
+	}
+	c, err := CheckCertificate("default", good)
+	if err != nil || c.Revoked || !c.Expiring || c.Days < 9 || c.Days > 10 {
+		t.Errorf("Expected a certificate expiring in 10 days, got %+v, %v", c, err)
+	}
+	if ExpiryDays.Get("default") == nil || Revoked.Get("https://bad.example.com").String() != "1" {
+		t.Error("Expected the expiry and the revocation of the certificates in the metrics")
+	}
+
+	// a list which is not signed by the issuer of the certificate is refused
+	other, err := testsupport.NewCA(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := other.RevocationList(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Parse(forged, ca.Certificate); err == nil {
+		t.Error("Expected a list signed by another authority to be refused")
+	}
+
+	// without distribution point, there is no list
+	ca.CRLDistributionPoint = ""
+	none, err := ca.ProviderCertificate("https://none.example.com", testsupport.RSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Get(none); err != ErrNoDistributionPoint {
+		t.Errorf("Expected no distribution point, got %v", err)
+	}
+}
@@ -30,9 +30,13 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"io"
 )
 
+// ErrInvalidCiphertext is returned when the data to decrypt is not a valid ciphertext
+var ErrInvalidCiphertext = errors.New("Invalid ciphertext")
+
 type cbcEncrypter struct{}
 
 const (
@@ -96,13 +100,20 @@ func (c cbcEncrypter) Decrypt(key ContentKey, r io.Reader, w io.Writer) error {
 	io.Copy(&buffer, r)
 
 	buf := buffer.Bytes()
+	// the IV and at least one block are expected
+	if len(buf) < 2*aes.BlockSize || len(buf)%aes.BlockSize != 0 {
+		return ErrInvalidCiphertext
+	}
 	iv := buf[:aes.BlockSize]
 
 	mode := cipher.NewCBCDecrypter(block, iv)
 	mode.CryptBlocks(buf[aes.BlockSize:], buf[aes.BlockSize:])
 
-	padding := buf[len(buf)-1] // padding length valid for both PKCS#7 and W3C schemes
-	w.Write(buf[aes.BlockSize : len(buf)-int(padding)])
+	padding := int(buf[len(buf)-1]) // padding length valid for both PKCS#7 and W3C schemes
+	if padding == 0 || padding > aes.BlockSize {
+		return ErrInvalidCiphertext
+	}
+	w.Write(buf[aes.BlockSize : len(buf)-padding])
 
 	return nil
 }
@@ -117,6 +117,21 @@ func TestDecrypt(t *testing.T) {
 	}
 }
 
+func TestDecryptInvalidCiphertext(t *testing.T) {
+	key := sha256.Sum256([]byte("password"))
+	cbc := &cbcEncrypter{}
+
+	var res bytes.Buffer
+	err := cbc.Decrypt(key[:], bytes.NewBufferString("short"), &res)
+	if err != ErrInvalidCiphertext {
+		t.Errorf("Expected ErrInvalidCiphertext on a short input, got %v", err)
+	}
+	err = cbc.Decrypt(key[:], bytes.NewReader(make([]byte, aes.BlockSize*2+1)), &res)
+	if err != ErrInvalidCiphertext {
+		t.Errorf("Expected ErrInvalidCiphertext on a truncated block, got %v", err)
+	}
+}
+
 func TestKeyWrap(t *testing.T) {
 	key := []byte{0x00, 0x01, 0x02, 0x03,
 		0x04, 0x05, 0x06, 0x07,
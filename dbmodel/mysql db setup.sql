@@ -5,8 +5,43 @@ CREATE TABLE `content` (
     `location` text NOT NULL,
     `length` bigint(20),
     `sha256` varchar(64),
-    `type` varchar(255) NOT NULL DEFAULT 'application/epub+zip'
-);
+    `type` varchar(255) NOT NULL DEFAULT 'application/epub+zip',
+    `tenant` varchar(255) NOT NULL DEFAULT '',
+    `max_concurrent_loans` int(11) NOT NULL DEFAULT 0
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `content_metadata` (
+    `content_id` varchar(255) PRIMARY KEY NOT NULL,
+    `title` varchar(255) NOT NULL DEFAULT '',
+    `author` varchar(255) NOT NULL DEFAULT '',
+    `isbn` varchar(32) NOT NULL DEFAULT '',
+    `cover_url` varchar(2048) NOT NULL DEFAULT '',
+    `collection` varchar(255) NOT NULL DEFAULT '',
+    FOREIGN KEY(content_id) REFERENCES content(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `lsd_outbox` (
+    `id` int(11) PRIMARY KEY AUTO_INCREMENT,
+    `license_id` varchar(255) NOT NULL,
+    `payload` text NOT NULL,
+    `attempts` int(11) NOT NULL DEFAULT 0,
+    `next_attempt` datetime NOT NULL,
+    `last_error` varchar(1024) NOT NULL DEFAULT '',
+    `created` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE INDEX `lsd_outbox_next_attempt_index` ON `lsd_outbox` (`next_attempt`) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `audit_log` (
+    `id` int(11) PRIMARY KEY AUTO_INCREMENT,
+    `timestamp` datetime NOT NULL,
+    `actor` varchar(255) NOT NULL DEFAULT '',
+    `action` varchar(64) NOT NULL,
+    `subject` varchar(255) NOT NULL DEFAULT '',
+    `detail` text NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE INDEX `audit_log_action_index` ON `audit_log` (`action`) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
 CREATE TABLE `license` (
     `id` varchar(255) PRIMARY KEY NOT NULL,
@@ -20,23 +55,64 @@ CREATE TABLE `license` (
     `rights_end` datetime DEFAULT NULL,
     `content_fk` varchar(255) NOT NULL,
     `lsd_status` int(11) default 0,
+    `tenant` varchar(255) NOT NULL DEFAULT '',
+    `print_used` int(11) NOT NULL DEFAULT 0,
+    `copy_used` int(11) NOT NULL DEFAULT 0,
+    `profile` varchar(255) NOT NULL DEFAULT '',
+    `user_key_algorithm` varchar(255) NOT NULL DEFAULT '',
     FOREIGN KEY(content_fk) REFERENCES content(id)
-);
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `license_archive` (
+    `id` varchar(255) PRIMARY KEY NOT NULL,
+    `user_id` varchar(255) NOT NULL,
+    `provider` varchar(255) NOT NULL,
+    `issued` datetime NOT NULL,
+    `updated` datetime DEFAULT NULL,
+    `rights_print` int(11) DEFAULT NULL,
+    `rights_copy` int(11) DEFAULT NULL,
+    `rights_start` datetime DEFAULT NULL,
+    `rights_end` datetime DEFAULT NULL,
+    `content_fk` varchar(255) NOT NULL,
+    `lsd_status` int(11) default 0,
+    `tenant` varchar(255) NOT NULL DEFAULT ''
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `license_hold` (
+    `content_fk` varchar(255) NOT NULL,
+    `user_id` varchar(255) NOT NULL,
+    `created` datetime NOT NULL,
+    PRIMARY KEY (`content_fk`, `user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
 CREATE TABLE `license_status` (
-    `id` int(11) PRIMARY KEY,
+    `id` int(11) PRIMARY KEY AUTO_INCREMENT,
     `status` int(11) NOT NULL,
     `license_updated` datetime NOT NULL,
     `status_updated` datetime NOT NULL,
     `device_count` int(11) DEFAULT NULL,
     `potential_rights_end` datetime DEFAULT NULL,
     `license_ref` varchar(255) NOT NULL,
-    `rights_end` datetime DEFAULT NULL 
-);
+    `rights_end` datetime DEFAULT NULL,
+    `tenant` varchar(255) NOT NULL DEFAULT '',
+    `potential_rights_policy` varchar(64) NOT NULL DEFAULT ''
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
-CREATE INDEX `license_ref_index` ON `license_status` (`license_ref`);
+CREATE INDEX `license_ref_index` ON `license_status` (`license_ref`) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
 CREATE TABLE `event` (
+    `id` int(11) PRIMARY KEY AUTO_INCREMENT,
+    `device_name` varchar(255) DEFAULT NULL,
+    `timestamp` datetime NOT NULL,
+    `type` int NOT NULL,
+    `device_id` varchar(255) DEFAULT NULL,
+    `license_status_fk` int NOT NULL,
+    FOREIGN KEY(`license_status_fk`) REFERENCES `license_status` (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE INDEX `license_status_fk_index` on `event` (`license_status_fk`) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `event_archive` (
     `id` int(11) PRIMARY KEY,
     `device_name` varchar(255) DEFAULT NULL,
     `timestamp` datetime NOT NULL,
@@ -44,18 +120,32 @@ CREATE TABLE `event` (
     `device_id` varchar(255) DEFAULT NULL,
     `license_status_fk` int NOT NULL,
     FOREIGN KEY(`license_status_fk`) REFERENCES `license_status` (`id`)
-);
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
-CREATE INDEX `license_status_fk_index` on `event` (`license_status_fk`);
+CREATE INDEX `event_archive_license_status_fk_index` on `event_archive` (`license_status_fk`) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
 CREATE TABLE `publication` (
     `id` int(11) NOT NULL PRIMARY KEY,
     `uuid` varchar(255) NOT NULL,	/* == content id */
     `title` varchar(255) NOT NULL,
     `status` varchar(255) NOT NULL
-);
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
-CREATE INDEX uuid_index ON publication (`uuid`);
+CREATE INDEX uuid_index ON publication (`uuid`) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `upload_job` (
+    `id` int(11) NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `title` varchar(255) NOT NULL,
+    `filename` varchar(255) NOT NULL DEFAULT '',
+    `url` varchar(1024) NOT NULL DEFAULT '',
+    `input_path` varchar(1024) NOT NULL DEFAULT '',
+    `status` varchar(32) NOT NULL,
+    `error` text NOT NULL,
+    `publication_uuid` varchar(255) NOT NULL DEFAULT '',
+    `created` datetime NOT NULL,
+    `updated` datetime NOT NULL,
+    INDEX `idx_upload_job_status` (`status`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
 CREATE TABLE `user` (
     `id` int(11) NOT NULL PRIMARY KEY,
@@ -63,8 +153,11 @@ CREATE TABLE `user` (
     `name` varchar(64) NOT NULL,
     `email` varchar(64) NOT NULL,
     `password` varchar(64) NOT NULL,
-    `hint` varchar(64) NOT NULL
-);
+    `hint` varchar(64) NOT NULL,
+    `role` varchar(16) NOT NULL DEFAULT 'patron',
+    `login_hash` varchar(255) NOT NULL DEFAULT '',
+    `language` varchar(16) NOT NULL DEFAULT ''
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
 CREATE TABLE `purchase` (
     `id` int(11) PRIMARY KEY NOT NULL,
@@ -77,11 +170,34 @@ CREATE TABLE `purchase` (
     `start_date` datetime,
     `end_date` datetime,
     `status` varchar(255) NOT NULL,
+    `state` varchar(32) NOT NULL DEFAULT 'created',
+    `state_updated` datetime NULL,
     FOREIGN KEY (`publication_id`) REFERENCES `publication` (`id`),
     FOREIGN KEY (`user_id`) REFERENCES `user` (`id`)
-);
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE INDEX `idx_purchase` ON `purchase` (`license_uuid`) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `purchase_event` (
+    `id` int(11) NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `purchase_id` int(11) NOT NULL,
+    `from_state` varchar(32) NOT NULL,
+    `to_state` varchar(32) NOT NULL,
+    `timestamp` datetime NOT NULL,
+    `detail` varchar(255) NOT NULL DEFAULT '',
+    FOREIGN KEY (`purchase_id`) REFERENCES `purchase` (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
-CREATE INDEX `idx_purchase` ON `purchase` (`license_uuid`);
+CREATE TABLE `purchase_reminder` (
+    `id` int(11) NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `purchase_id` int(11) NOT NULL,
+    `channel` varchar(255) NOT NULL,
+    `days` int(11) NOT NULL,
+    `end_date` datetime NOT NULL,
+    `sent` datetime NOT NULL,
+    FOREIGN KEY (`purchase_id`) REFERENCES `purchase` (`id`),
+    UNIQUE INDEX `idx_purchase_reminder` (`purchase_id`, `channel`, `days`, `end_date`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
 CREATE TABLE `license_view` (
     `id` int(11) NOT NULL PRIMARY KEY,
@@ -89,5 +205,5 @@ CREATE TABLE `license_view` (
     `device_count` int(11) NOT NULL,
     `status` varchar(255) NOT NULL,
     `message` varchar(255) NOT NULL
-);
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
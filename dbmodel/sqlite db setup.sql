@@ -5,9 +5,44 @@ CREATE TABLE content (
   location text NOT NULL, 
   length bigint,
   sha256 varchar(64),
-  "type" varchar(255) NOT NULL DEFAULT 'application/epub+zip'
+  "type" varchar(255) NOT NULL DEFAULT 'application/epub+zip',
+  tenant varchar(255) NOT NULL DEFAULT '',
+  max_concurrent_loans integer NOT NULL DEFAULT 0
 );
 
+CREATE TABLE content_metadata (
+  content_id varchar(255) PRIMARY KEY NOT NULL,
+  title varchar(255) NOT NULL DEFAULT '',
+  author varchar(255) NOT NULL DEFAULT '',
+  isbn varchar(32) NOT NULL DEFAULT '',
+  cover_url varchar(2048) NOT NULL DEFAULT '',
+  collection varchar(255) NOT NULL DEFAULT '',
+  FOREIGN KEY(content_id) REFERENCES content(id)
+);
+
+CREATE TABLE lsd_outbox (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  license_id varchar(255) NOT NULL,
+  payload text NOT NULL,
+  attempts int NOT NULL DEFAULT 0,
+  next_attempt datetime NOT NULL,
+  last_error varchar(1024) NOT NULL DEFAULT '',
+  created datetime NOT NULL
+);
+
+CREATE INDEX lsd_outbox_next_attempt_index ON lsd_outbox (next_attempt);
+
+CREATE TABLE audit_log (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  timestamp datetime NOT NULL,
+  actor varchar(255) NOT NULL DEFAULT '',
+  action varchar(64) NOT NULL,
+  subject varchar(255) NOT NULL DEFAULT '',
+  detail text NOT NULL
+);
+
+CREATE INDEX audit_log_action_index ON audit_log (action);
+
 CREATE TABLE license (
   id varchar(255) PRIMARY KEY NOT NULL,
   user_id varchar(255) NOT NULL,
@@ -20,9 +55,36 @@ CREATE TABLE license (
   rights_end datetime DEFAULT NULL,
   content_fk varchar(255) NOT NULL,
   lsd_status integer default 0,
+  tenant varchar(255) NOT NULL DEFAULT '',
+  print_used integer NOT NULL DEFAULT 0,
+  copy_used integer NOT NULL DEFAULT 0,
+  profile varchar(255) NOT NULL DEFAULT '',
+  user_key_algorithm varchar(255) NOT NULL DEFAULT '',
   FOREIGN KEY(content_fk) REFERENCES content(id)
 );
 
+CREATE TABLE license_archive (
+  id varchar(255) PRIMARY KEY NOT NULL,
+  user_id varchar(255) NOT NULL,
+  provider varchar(255) NOT NULL,
+  issued datetime NOT NULL,
+  updated datetime DEFAULT NULL,
+  rights_print int(11) DEFAULT NULL,
+  rights_copy int(11) DEFAULT NULL,
+  rights_start datetime DEFAULT NULL,
+  rights_end datetime DEFAULT NULL,
+  content_fk varchar(255) NOT NULL,
+  lsd_status integer default 0,
+  tenant varchar(255) NOT NULL DEFAULT ''
+);
+
+CREATE TABLE license_hold (
+  content_fk varchar(255) NOT NULL,
+  user_id varchar(255) NOT NULL,
+  created datetime NOT NULL,
+  PRIMARY KEY (content_fk, user_id)
+);
+
 CREATE TABLE license_status (
   id INTEGER PRIMARY KEY,
   status int(11) NOT NULL,
@@ -31,7 +93,9 @@ CREATE TABLE license_status (
   device_count int(11) DEFAULT NULL,
   potential_rights_end datetime DEFAULT NULL,
   license_ref varchar(255) NOT NULL,
-  rights_end datetime DEFAULT NULL 
+  rights_end datetime DEFAULT NULL,
+  tenant varchar(255) NOT NULL DEFAULT '',
+  potential_rights_policy varchar(64) NOT NULL DEFAULT ''
 );
 
 CREATE INDEX license_ref_index ON license_status (license_ref);
@@ -48,6 +112,18 @@ CREATE TABLE event (
 
 CREATE INDEX license_status_fk_index on event (license_status_fk);
 
+CREATE TABLE event_archive (
+	id integer PRIMARY KEY,
+	device_name varchar(255) DEFAULT NULL,
+	timestamp datetime NOT NULL,
+	type int NOT NULL,
+	device_id varchar(255) DEFAULT NULL,
+	license_status_fk int NOT NULL,
+  FOREIGN KEY(license_status_fk) REFERENCES license_status(id)
+);
+
+CREATE INDEX event_archive_license_status_fk_index on event_archive (license_status_fk);
+
 CREATE TABLE publication (
   id integer NOT NULL PRIMARY KEY,
   uuid varchar(255) NOT NULL,
@@ -57,6 +133,21 @@ CREATE TABLE publication (
 
 CREATE INDEX uuid_index ON publication (uuid);
 
+CREATE TABLE upload_job (
+  id integer NOT NULL PRIMARY KEY,
+  title varchar(255) NOT NULL,
+  filename varchar(255) NOT NULL DEFAULT '',
+  url varchar(1024) NOT NULL DEFAULT '',
+  input_path varchar(1024) NOT NULL DEFAULT '',
+  status varchar(32) NOT NULL,
+  error text NOT NULL DEFAULT '',
+  publication_uuid varchar(255) NOT NULL DEFAULT '',
+  created datetime NOT NULL,
+  updated datetime NOT NULL
+);
+
+CREATE INDEX idx_upload_job_status ON upload_job (status);
+
 CREATE TABLE purchase (
   id integer NOT NULL PRIMARY KEY,
   uuid varchar(255) NOT NULL,
@@ -68,19 +159,48 @@ CREATE TABLE purchase (
   start_date datetime,
   end_date datetime,
   status varchar(255) NOT NULL,
+  state varchar(32) NOT NULL DEFAULT 'created',
+  state_updated datetime NULL,
   FOREIGN KEY (publication_id) REFERENCES publication(id),
   FOREIGN KEY (user_id) REFERENCES "user"(id)
 );
   
 CREATE INDEX idx_purchase ON purchase (license_uuid);
 
+CREATE TABLE purchase_event (
+  id integer NOT NULL PRIMARY KEY,
+  purchase_id integer NOT NULL,
+  from_state varchar(32) NOT NULL,
+  to_state varchar(32) NOT NULL,
+  timestamp datetime NOT NULL,
+  detail varchar(255) NOT NULL DEFAULT '',
+  FOREIGN KEY (purchase_id) REFERENCES purchase(id)
+);
+
+CREATE INDEX idx_purchase_event ON purchase_event (purchase_id);
+
+CREATE TABLE purchase_reminder (
+  id integer NOT NULL PRIMARY KEY,
+  purchase_id integer NOT NULL,
+  channel varchar(255) NOT NULL,
+  days integer NOT NULL,
+  end_date datetime NOT NULL,
+  sent datetime NOT NULL,
+  FOREIGN KEY (purchase_id) REFERENCES purchase(id)
+);
+
+CREATE UNIQUE INDEX idx_purchase_reminder ON purchase_reminder (purchase_id, channel, days, end_date);
+
 CREATE TABLE "user" (
   id integer NOT NULL PRIMARY KEY,
   uuid varchar(255) NOT NULL,
   name varchar(64) NOT NULL,
   email varchar(64) NOT NULL,
   password varchar(64) NOT NULL,
-  hint varchar(64) NOT NULL
+  hint varchar(64) NOT NULL,
+  role varchar(16) NOT NULL DEFAULT 'patron',
+  login_hash varchar(255) NOT NULL DEFAULT '',
+  language varchar(16) NOT NULL DEFAULT ''
 );
 
 CREATE TABLE license_view (
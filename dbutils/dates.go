@@ -0,0 +1,191 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// The dates are stored in UTC, to the second, whatever the timezone of the server and the database engine:
+// the statements convert their date parameters, and the connections read the dates in UTC
+// (sqlite: _loc=UTC, mysql: loc=UTC and a UTC session, postgres: a UTC session).
+// Once encoded in json, the dates are RFC 3339 dates in UTC, e.g. "2020-03-01T12:00:00Z".
+
+// sqliteTimestampFormat is the format of the dates written by the sqlite driver
+const sqliteTimestampFormat = "2006-01-02 15:04:05.999999999-07:00"
+
+// sqliteParseFormats are the formats of the dates read by the sqlite driver
+var sqliteParseFormats = []string{
+	sqliteTimestampFormat,
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// UTC returns a date as it is stored: in UTC, truncated to the second
+func UTC(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// utcArgs converts the date parameters of a statement to their stored value;
+// the parameters of the caller are not modified
+func utcArgs(args []interface{}) []interface{} {
+	var converted []interface{}
+	for i, arg := range args {
+		var t time.Time
+		switch v := arg.(type) {
+		case time.Time:
+			t = v
+		case *time.Time:
+			if v == nil {
+				continue
+			}
+			t = *v
+		default:
+			continue
+		}
+		if converted == nil {
+			converted = append([]interface{}(nil), args...)
+		}
+		converted[i] = UTC(t)
+	}
+	if converted == nil {
+		return args
+	}
+	return converted
+}
+
+// PostgresDSN sets the timezone of the sessions of a postgres connection string to UTC, unless it is already set
+func PostgresDSN(cnxn string) string {
+	if strings.Contains(cnxn, "timezone=") {
+		return cnxn
+	}
+	// a connection string is either a url or a list of key=value parameters
+	if strings.Contains(cnxn, "=") && !strings.Contains(cnxn, "?") && !strings.Contains(cnxn, "/") {
+		return cnxn + " timezone=UTC"
+	}
+	return addParams(cnxn, []dsnParam{{"timezone", "UTC"}})
+}
+
+// MigrateDates rewrites the dates of a sqlite database in UTC, to the second: the dates written
+// with the offset of the timezone of the server, or with fractions of seconds, are compared as text
+// by sqlite. It returns the number of rewritten dates. The dates of mysql (written in UTC by the driver)
+// and postgres (timestamps with a timezone) do not need a migration.
+//
+func MigrateDates(db *sql.DB, d Dialect) (int64, error) {
+	if d != SQLite {
+		return 0, nil
+	}
+	tables, err := sqliteDateColumns(db)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for table, columns := range tables {
+		for _, column := range columns {
+			n, err := migrateColumn(db, table, column)
+			count += n
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
+
+// sqliteDateColumns returns the date columns of the tables of a sqlite database
+func sqliteDateColumns(db *sql.DB) (map[string][]string, error) {
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	columns := make(map[string][]string)
+	for _, table := range tables {
+		rows, err := db.Query("SELECT name, type FROM pragma_table_info(?)", table)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name, kind string
+			if err = rows.Scan(&name, &kind); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			kind = strings.ToLower(kind)
+			if strings.Contains(kind, "date") || strings.Contains(kind, "time") {
+				columns[table] = append(columns[table], name)
+			}
+		}
+		rows.Close()
+	}
+	return columns, nil
+}
+
+// migrateColumn rewrites the dates of a column which are not stored in UTC, to the second
+func migrateColumn(db *sql.DB, table, column string) (int64, error) {
+	// the dates are read as text, as the driver would convert them
+	rows, err := db.Query(`SELECT rowid, CAST("` + column + `" AS TEXT) FROM "` + table + `" WHERE "` + column + `" IS NOT NULL`)
+	if err != nil {
+		return 0, err
+	}
+	updates := make(map[int64]string)
+	for rows.Next() {
+		var rowid int64
+		var value string
+		if err = rows.Scan(&rowid, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		t, ok := parseSqliteDate(value)
+		if !ok {
+			continue
+		}
+		if normalized := UTC(t).Format(sqliteTimestampFormat); normalized != value {
+			updates[rowid] = normalized
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for rowid, value := range updates {
+		if _, err = db.Exec(`UPDATE "`+table+`" SET "`+column+`" = ? WHERE rowid = ?`, value, rowid); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// parseSqliteDate parses a date stored by sqlite; a date without offset is in UTC
+func parseSqliteDate(value string) (time.Time, bool) {
+	value = strings.TrimSuffix(value, "Z")
+	for _, format := range sqliteParseFormats {
+		if t, err := time.ParseInLocation(format, value, time.UTC); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
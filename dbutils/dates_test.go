@@ -0,0 +1,79 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestUTCDates(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:?_loc=UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	if _, err = db.Exec("CREATE TABLE event (id integer PRIMARY KEY, timestamp datetime, note varchar(32))"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the dates of the statements are stored in UTC, to the second, whatever their timezone
+	montreal := time.FixedZone("EST", -5*3600)
+	local := time.Date(2021, 12, 31, 21, 30, 15, 500, montreal)
+	add := NewStmt(db, "INSERT INTO event (id, timestamp, note) VALUES (?, ?, ?)")
+	if _, err = add.Exec(1, local, "event"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = add.Exec(2, &local, "pointer"); err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	var timestamp time.Time
+	for _, id := range []int{1, 2} {
+		if err = db.QueryRow("SELECT CAST(timestamp AS TEXT), timestamp FROM event WHERE id = ?", id).Scan(&stored, &timestamp); err != nil {
+			t.Fatal(err)
+		}
+		if stored != "2022-01-01 02:30:15+00:00" || timestamp.Location() != time.UTC {
+			t.Errorf("Expected a date in UTC, got %s, %v", stored, timestamp)
+		}
+	}
+
+	// the dates written before in the timezone of the server are migrated, the other values are kept
+	_, err = db.Exec("INSERT INTO event (id, timestamp, note) VALUES (3, '2021-12-31 21:30:15.123-05:00', '2021-12-31 21:30:15-05:00'), (4, NULL, ''), (5, '2022-01-01 02:30:15+00:00', '')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := MigrateDates(db, SQLite)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 date to be migrated, got %d, %v", n, err)
+	}
+	var note string
+	if err = db.QueryRow("SELECT CAST(timestamp AS TEXT), note FROM event WHERE id = 3").Scan(&stored, &note); err != nil {
+		t.Fatal(err)
+	}
+	if stored != "2022-01-01 02:30:15+00:00" || note != "2021-12-31 21:30:15-05:00" {
+		t.Errorf("Unexpected migrated row %s, %s", stored, note)
+	}
+	if n, err = MigrateDates(db, SQLite); err != nil || n != 0 {
+		t.Errorf("Expected the migration to be done once, got %d, %v", n, err)
+	}
+}
+
+func TestPostgresDSN(t *testing.T) {
+	for cnxn, expected := range map[string]string{
+		"postgres://lcp@localhost/lcp":               "postgres://lcp@localhost/lcp?timezone=UTC",
+		"lcp@localhost/lcp?sslmode=disable":          "lcp@localhost/lcp?sslmode=disable&timezone=UTC",
+		"host=localhost dbname=lcp":                  "host=localhost dbname=lcp timezone=UTC",
+		"host=localhost dbname=lcp timezone=Etc/GMT": "host=localhost dbname=lcp timezone=Etc/GMT",
+	} {
+		if dsn := PostgresDSN(cnxn); dsn != expected {
+			t.Errorf("Expected %s, got %s", expected, dsn)
+		}
+	}
+}
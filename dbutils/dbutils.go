@@ -0,0 +1,43 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package dbutils contains helpers shared by the database stores of the servers:
+// connection pool configuration, sqlite settings and lazily prepared statements.
+package dbutils
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// OpenReplica opens the read-only replica database of a server,
+// or returns the primary database if no replica is configured.
+func OpenReplica(info config.ServerInfo, primary *sql.DB) (*sql.DB, error) {
+	if info.ReplicaDatabase == "" {
+		return primary, nil
+	}
+	parts := strings.SplitN(info.ReplicaDatabase, "://", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("Invalid replica database uri")
+	}
+	return Open(parts[0], parts[1], info)
+}
+
+// ConfigurePool applies the connection pool settings of a server to a database handle;
+// zero values keep the defaults of database/sql.
+func ConfigurePool(db *sql.DB, info config.ServerInfo) {
+	if info.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(info.MaxOpenConns)
+	}
+	if info.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(info.MaxIdleConns)
+	}
+	if info.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(time.Duration(info.ConnMaxLifetime) * time.Second)
+	}
+}
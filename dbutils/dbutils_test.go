@@ -0,0 +1,63 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestOpenReplica(t *testing.T) {
+	primary, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenReplica(config.ServerInfo{}, primary)
+	if err != nil || db != primary {
+		t.Error("Expected the primary database without a replica")
+	}
+
+	db, err = OpenReplica(config.ServerInfo{ReplicaDatabase: "sqlite3://file::memory:", MaxOpenConns: 1}, primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db == primary {
+		t.Error("Expected a distinct replica database")
+	}
+	if db.Stats().MaxOpenConnections != 1 {
+		t.Error("Expected the pool settings to apply to the replica")
+	}
+
+	if _, err = OpenReplica(config.ServerInfo{ReplicaDatabase: "invalid"}, primary); err == nil {
+		t.Error("Expected an error on an invalid uri")
+	}
+}
+
+func TestSqliteDSN(t *testing.T) {
+	dsn := SqliteDSN("file:lcp.sqlite?cache=shared&mode=rwc", config.ServerInfo{})
+	if dsn != "file:lcp.sqlite?cache=shared&mode=rwc&_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate&_loc=UTC" {
+		t.Errorf("Unexpected connection string %s", dsn)
+	}
+	dsn = SqliteDSN("lcp.sqlite?_timeout=100&_journal=DELETE", config.ServerInfo{BusyTimeout: 2000})
+	if dsn != "lcp.sqlite?_timeout=100&_journal=DELETE&_txlock=immediate&_loc=UTC" {
+		t.Errorf("The parameters of the connection string must be kept, got %s", dsn)
+	}
+	dsn = SqliteDSN("lcp.sqlite", config.ServerInfo{BusyTimeout: 2000})
+	if dsn != "lcp.sqlite?_journal_mode=WAL&_busy_timeout=2000&_txlock=immediate&_loc=UTC" {
+		t.Errorf("Unexpected connection string %s", dsn)
+	}
+}
+
+func TestMySQLDSN(t *testing.T) {
+	if dsn := MySQLDSN("user:pwd@tcp(localhost:3306)/lcp"); dsn != "user:pwd@tcp(localhost:3306)/lcp?parseTime=true&loc=UTC&time_zone=%27%2B00%3A00%27" {
+		t.Errorf("Unexpected connection string %s", dsn)
+	}
+	if dsn := MySQLDSN("user:pwd@tcp(localhost:3306)/lcp?parseTime=false&loc=Local&time_zone=%27SYSTEM%27"); dsn != "user:pwd@tcp(localhost:3306)/lcp?parseTime=false&loc=Local&time_zone=%27SYSTEM%27" {
+		t.Errorf("The parameters of the connection string must be kept, got %s", dsn)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect is the SQL dialect of a database: the stores write their queries once,
+// with '?' placeholders, and the dialect adapts the placeholders, the column types
+// and the statements which differ between the databases.
+type Dialect string
+
+// the dialects of the supported databases, named after their drivers
+const (
+	SQLite   Dialect = "sqlite3"
+	Postgres Dialect = "postgres"
+	MySQL    Dialect = "mysql"
+)
+
+// DialectOf returns the dialect of a database uri, e.g. "postgres://user@host/lcp";
+// sqlite is the default database of the servers.
+func DialectOf(uri string) Dialect {
+	switch {
+	case strings.HasPrefix(uri, "postgres"):
+		return Postgres
+	case strings.HasPrefix(uri, "mysql"):
+		return MySQL
+	}
+	return SQLite
+}
+
+// Bind replaces the '?' placeholders of a query by the placeholders of the dialect,
+// '$1', '$2'... for postgres. The question marks of the quoted strings are kept.
+func (d Dialect) Bind(query string) string {
+	if d != Postgres || !strings.ContainsRune(query, '?') {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// column types which are named differently by the databases
+const (
+	TypeDatetime = "datetime"
+	TypeBlob     = "blob"
+)
+
+// Type returns the name of a column type in the dialect
+func (d Dialect) Type(t string) string {
+	if d == Postgres {
+		switch t {
+		case TypeDatetime:
+			return "TIMESTAMPTZ"
+		case TypeBlob:
+			return "bytea"
+		}
+	}
+	return t
+}
+
+// ForUpdate returns the clause which locks the rows read in a transaction;
+// sqlite locks the whole database when a transaction begins.
+func (d Dialect) ForUpdate() string {
+	if d == SQLite {
+		return ""
+	}
+	return " FOR UPDATE"
+}
+
+// Upsert returns the statement which inserts a row, or updates the other columns of the row
+// with the same keys, in a single statement. Its parameters are the values of the columns, in order.
+func (d Dialect) Upsert(table string, columns []string, keys []string) string {
+	query := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (" +
+		strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+	var set []string
+	for _, c := range columns {
+		if contains(keys, c) {
+			continue
+		}
+		if d == MySQL {
+			set = append(set, c+" = VALUES("+c+")")
+		} else {
+			set = append(set, c+" = excluded."+c)
+		}
+	}
+	switch {
+	case d == MySQL && len(set) == 0:
+		// a row with the same keys is kept as is
+		query = strings.Replace(query, "INSERT INTO", "INSERT IGNORE INTO", 1)
+	case d == MySQL:
+		query += " ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+	case len(set) == 0:
+		query += " ON CONFLICT (" + strings.Join(keys, ", ") + ") DO NOTHING"
+	default:
+		query += " ON CONFLICT (" + strings.Join(keys, ", ") + ") DO UPDATE SET " + strings.Join(set, ", ")
+	}
+	return d.Bind(query)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestDialectOf(t *testing.T) {
+	uris := map[string]Dialect{
+		"sqlite3://file:lcp.sqlite?cache=shared": SQLite,
+		"postgres://lcp@localhost/lcp":           Postgres,
+		"mysql://lcp@tcp(localhost)/lcp":         MySQL,
+		"":                                       SQLite,
+	}
+	for uri, expected := range uris {
+		if d := DialectOf(uri); d != expected {
+			t.Errorf("Expected %s for %q, got %s", expected, uri, d)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	query := "SELECT id FROM item WHERE name = ? AND note <> '?' AND id > ?"
+	if q := SQLite.Bind(query); q != query {
+		t.Errorf("Expected the sqlite query to be kept, got %s", q)
+	}
+	if q := MySQL.Bind(query); q != query {
+		t.Errorf("Expected the mysql query to be kept, got %s", q)
+	}
+	expected := "SELECT id FROM item WHERE name = $1 AND note <> '?' AND id > $2"
+	if q := Postgres.Bind(query); q != expected {
+		t.Errorf("Expected %s, got %s", expected, q)
+	}
+}
+
+func TestForUpdate(t *testing.T) {
+	if SQLite.ForUpdate() != "" || Postgres.ForUpdate() != " FOR UPDATE" || MySQL.ForUpdate() != " FOR UPDATE" {
+		t.Error("Unexpected FOR UPDATE clauses")
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	columns := []string{"id", "name"}
+	keys := []string{"id"}
+	upserts := map[Dialect]string{
+		SQLite:   "INSERT INTO item (id, name) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET name = excluded.name",
+		Postgres: "INSERT INTO item (id, name) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET name = excluded.name",
+		MySQL:    "INSERT INTO item (id, name) VALUES (?, ?) ON DUPLICATE KEY UPDATE name = VALUES(name)",
+	}
+	for d, expected := range upserts {
+		if q := d.Upsert("item", columns, keys); q != expected {
+			t.Errorf("Expected %s, got %s", expected, q)
+		}
+	}
+	if q := MySQL.Upsert("item", keys, keys); q != "INSERT IGNORE INTO item (id) VALUES (?)" {
+		t.Errorf("Unexpected mysql insert of the keys only, %s", q)
+	}
+	if q := SQLite.Upsert("item", keys, keys); q != "INSERT INTO item (id) VALUES (?) ON CONFLICT (id) DO NOTHING" {
+		t.Errorf("Unexpected sqlite insert of the keys only, %s", q)
+	}
+
+	// the statement is run twice on the same key
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("CREATE TABLE item (id integer PRIMARY KEY, name varchar(64))"); err != nil {
+		t.Fatal(err)
+	}
+	upsert := SQLite.Upsert("item", columns, keys)
+	for _, name := range []string{"first", "second"} {
+		if _, err = db.Exec(upsert, 1, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var count int
+	var name string
+	db.QueryRow("SELECT COUNT(*), MAX(name) FROM item").Scan(&count, &name)
+	if count != 1 || name != "second" {
+		t.Errorf("Expected a single updated row, got %d rows, %s", count, name)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// the kinds of the errors returned by the stores; the handlers map them to http status codes
+// with errors.Is, whatever the store which returned them
+var (
+	ErrNotFound = errors.New("Not found")
+	ErrConflict = errors.New("Conflict")
+	ErrStorage  = errors.New("Storage error")
+)
+
+// Error is an error of a store: its kind, the operation which failed and the underlying error,
+// e.g. the error of the database driver, which errors.As reaches.
+// A kind may itself be an Error, so that the errors of a store are also of a more general kind.
+type Error struct {
+	Kind error
+	Op   string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Op == "" {
+		return e.Err.Error()
+	}
+	return e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is checks if the error is of a kind
+func (e *Error) Is(target error) bool {
+	return target == e.Kind || errors.Is(e.Kind, target)
+}
+
+// NewError returns an error of a kind, e.g. the ErrNotFound of a store, which is a ErrNotFound
+//
+func NewError(kind error, message string) error {
+	return &Error{Kind: kind, Err: errors.New(message)}
+}
+
+// Wrap returns the error of an operation of a store, given the kinds of its errors:
+// notFound if no row was found, an error of kind conflict if a unique constraint was violated,
+// else an error of kind storage. The errors already returned by a store are not wrapped again.
+//
+func Wrap(op string, err error, notFound error, conflict error, storage error) error {
+	var storeErr *Error
+	switch {
+	case err == nil:
+		return nil
+	case err == sql.ErrNoRows:
+		return notFound
+	case errors.As(err, &storeErr):
+		return err
+	case isDuplicate(err):
+		return &Error{Kind: conflict, Op: op, Err: err}
+	}
+	return &Error{Kind: storage, Op: op, Err: err}
+}
+
+// isDuplicate checks if an error is the violation of a unique constraint
+// (sqlite, mysql: 1062, postgres: 23505, mssql: 2627)
+func isDuplicate(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unique constraint") || strings.Contains(msg, "duplicate entry") ||
+		strings.Contains(msg, "duplicate key") || strings.Contains(msg, "violation of primary key")
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+func TestWrap(t *testing.T) {
+	errNotFound := NewError(ErrNotFound, "Item not found")
+	errConflict := NewError(ErrConflict, "Item conflict")
+	errStorage := NewError(ErrStorage, "Item storage error")
+	wrap := func(op string, err error) error {
+		return Wrap(op, err, errNotFound, errConflict, errStorage)
+	}
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec("CREATE TABLE item (id integer PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+
+	if wrap("add item", nil) != nil {
+		t.Error("Expected no error")
+	}
+	var id int
+	err = wrap("get item", db.QueryRow("SELECT id FROM item WHERE id = 1").Scan(&id))
+	if err != errNotFound || !errors.Is(err, ErrNotFound) || err.Error() != "Item not found" {
+		t.Errorf("Expected the not found error of the store, got %v", err)
+	}
+
+	db.Exec("INSERT INTO item (id) VALUES (1)")
+	_, err = db.Exec("INSERT INTO item (id) VALUES (1)")
+	err = wrap("add item", err)
+	var driverErr sqlite3.Error
+	if !errors.Is(err, errConflict) || !errors.Is(err, ErrConflict) || errors.Is(err, ErrStorage) || !errors.As(err, &driverErr) {
+		t.Errorf("Expected a conflict wrapping the error of the driver, got %v", err)
+	}
+	// the errors of a store are not wrapped again
+	if wrap("update item", err) != err {
+		t.Error("Expected the error to be returned as is")
+	}
+
+	_, err = db.Exec("INSERT INTO thing (id) VALUES (1)")
+	err = wrap("add thing", err)
+	if !errors.Is(err, errStorage) || !errors.Is(err, ErrStorage) || errors.Is(err, ErrNotFound) || err.Error() != "add thing: no such table: thing" {
+		t.Errorf("Expected a storage error, got %v", err)
+	}
+}
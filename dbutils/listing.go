@@ -0,0 +1,63 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidListing is the kind of the errors of the listing parameters, e.g. an unknown sort field;
+// the handlers report them as bad requests
+var ErrInvalidListing = errors.New("Invalid listing")
+
+// Listing is the order and the page of a list.
+// Sort is the name of a field, prefixed by "-" for a descending order, the default order of the list if empty.
+// A Limit of 0 does not limit the list.
+type Listing struct {
+	Sort   string
+	Limit  int
+	Offset int
+}
+
+// SortField returns the field of the sort of a listing, and whether the order is descending
+func (l Listing) SortField() (string, bool) {
+	if strings.HasPrefix(l.Sort, "-") {
+		return l.Sort[1:], true
+	}
+	return l.Sort, false
+}
+
+// Clauses returns the ORDER BY, LIMIT and OFFSET clauses of a listing.
+// columns maps the fields which can be sorted to their columns, so that no parameter of a request
+// is written in the query; the key column, unique, breaks the ties so that the pages do not overlap.
+// defaultSort is used if the listing has no sort.
+//
+func (l Listing) Clauses(columns map[string]string, defaultSort string, key string) (string, error) {
+	if l.Sort == "" {
+		l.Sort = defaultSort
+	}
+	field, desc := l.SortField()
+	column, ok := columns[field]
+	if !ok {
+		return "", &Error{Kind: ErrInvalidListing, Err: errors.New("Unknown sort field " + field)}
+	}
+	if l.Limit < 0 || l.Offset < 0 {
+		return "", &Error{Kind: ErrInvalidListing, Err: errors.New("The limit and the offset of a list must be positive")}
+	}
+	direction := " ASC"
+	if desc {
+		direction = " DESC"
+	}
+	clauses := " ORDER BY " + column + direction
+	if column != key {
+		clauses += ", " + key + direction
+	}
+	if l.Limit > 0 {
+		clauses += " LIMIT " + strconv.Itoa(l.Limit) + " OFFSET " + strconv.Itoa(l.Offset)
+	}
+	return clauses, nil
+}
@@ -0,0 +1,31 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestListingClauses(t *testing.T) {
+	columns := map[string]string{"id": "id", "issued": "issued"}
+	clauses := map[Listing]string{
+		{}:                                   " ORDER BY issued DESC, id DESC",
+		{Sort: "issued", Limit: 10}:          " ORDER BY issued ASC, id ASC LIMIT 10 OFFSET 0",
+		{Sort: "-id", Limit: 10, Offset: 20}: " ORDER BY id DESC LIMIT 10 OFFSET 20",
+	}
+	for l, expected := range clauses {
+		c, err := l.Clauses(columns, "-issued", "id")
+		if err != nil || c != expected {
+			t.Errorf("Expected %q for %+v, got %q, %v", expected, l, c, err)
+		}
+	}
+	// the sort field must be known, the request parameters are never written in the queries
+	for _, l := range []Listing{{Sort: "issued; DROP TABLE license"}, {Sort: "user_id"}, {Limit: -1}} {
+		if _, err := l.Clauses(columns, "-issued", "id"); !errors.Is(err, ErrInvalidListing) {
+			t.Errorf("Expected an invalid listing for %+v, got %v", l, err)
+		}
+	}
+}
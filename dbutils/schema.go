@@ -0,0 +1,94 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+)
+
+// MySQLTableOptions are the options of the tables created in MySQL and MariaDB:
+// utf8mb4 stores all unicode characters, unlike the legacy 3-byte utf8 charset.
+const MySQLTableOptions = "ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci"
+
+// MySQLIndex is a secondary index of a MySQL table
+type MySQLIndex struct {
+	Name    string
+	Columns string
+}
+
+// MySQLTable is the definition of a MySQL table: the columns and constraints, without parentheses,
+// and the secondary indexes. Dates are stored as datetime, as timestamp ends in 2038.
+type MySQLTable struct {
+	Name       string
+	Definition string
+	Indexes    []MySQLIndex
+}
+
+// CreateMySQLTables creates the tables which do not exist yet and their missing indexes,
+// as MySQL has no "CREATE INDEX IF NOT EXISTS". The tables created before with another charset,
+// e.g. by the former setup script, are converted to utf8mb4.
+//
+func CreateMySQLTables(db *sql.DB, tables ...MySQLTable) error {
+	for _, t := range tables {
+		_, err := db.Exec("CREATE TABLE IF NOT EXISTS `" + t.Name + "` (" + t.Definition + ") " + MySQLTableOptions)
+		if err != nil {
+			return err
+		}
+		var collation sql.NullString
+		err = db.QueryRow("SELECT table_collation FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?",
+			t.Name).Scan(&collation)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(collation.String, "utf8mb4") {
+			if err = convertToUtf8mb4(db, t.Name); err != nil {
+				return err
+			}
+		}
+		for _, idx := range t.Indexes {
+			var count int
+			err = db.QueryRow("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?",
+				t.Name, idx.Name).Scan(&count)
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
+			log.Println("Creating the index " + idx.Name + " of the table " + t.Name)
+			if _, err = db.Exec("CREATE INDEX `" + idx.Name + "` ON `" + t.Name + "` (" + idx.Columns + ")"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// convertToUtf8mb4 converts the charset of a table; the foreign key checks are disabled
+// on the connection, as the referenced tables may not be converted yet
+func convertToUtf8mb4(db *sql.DB, table string) error {
+	log.Println("Converting the table " + table + " to utf8mb4")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS = 0"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS = 1")
+	_, err = conn.ExecContext(ctx, "ALTER TABLE `"+table+"` CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci")
+	return err
+}
+
+// MySQLDSN makes the MySQL driver scan the dates as time.Time, as the stores expect,
+// unless the connection string already sets it
+func MySQLDSN(cnxn string) string {
+	return addParams(cnxn, []dsnParam{{"parseTime", "true"}, {"loc", "UTC"}, {"time_zone", "%27%2B00%3A00%27"}})
+}
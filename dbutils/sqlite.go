@@ -0,0 +1,112 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// DefaultBusyTimeout is the delay a sqlite connection waits for a lock held by another one, in milliseconds
+const DefaultBusyTimeout = 5000
+
+// writeLocks serialize the writes on the sqlite databases of the process, by database handle
+var writeLocks sync.Map
+
+// Open opens the database of a server and configures its connection pool.
+// A sqlite database is opened in WAL mode, so that reads do not block on writes,
+// with a busy timeout and with immediate transactions, which take the write lock when they begin;
+// the writes of the process are also serialized, as sqlite accepts a single writer.
+// MySQL dates are scanned as time.Time; the dates are read in UTC with all the engines.
+//
+func Open(driver, cnxn string, info config.ServerInfo) (*sql.DB, error) {
+	switch driver {
+	case "sqlite3":
+		cnxn = SqliteDSN(cnxn, info)
+	case "mysql":
+		cnxn = MySQLDSN(cnxn)
+	case "postgres":
+		cnxn = PostgresDSN(cnxn)
+	}
+	db, err := sql.Open(driver, cnxn)
+	if err != nil {
+		return nil, err
+	}
+	ConfigurePool(db, info)
+	if driver == "sqlite3" {
+		SerializeWrites(db)
+	}
+	return db, nil
+}
+
+// SqliteDSN adds the WAL mode, the busy timeout and the immediate transactions
+// to the parameters of a sqlite connection string, unless they are already set
+func SqliteDSN(cnxn string, info config.ServerInfo) string {
+	busyTimeout := info.BusyTimeout
+	if busyTimeout <= 0 {
+		busyTimeout = DefaultBusyTimeout
+	}
+	return addParams(cnxn, []dsnParam{
+		{"_journal_mode _journal", "WAL"},
+		{"_busy_timeout _timeout", strconv.Itoa(busyTimeout)},
+		{"_txlock", "immediate"},
+		{"_loc", "UTC"},
+	})
+}
+
+// dsnParam is a parameter of a connection string; names lists its aliases, the first one is added
+type dsnParam struct {
+	names, value string
+}
+
+// addParams adds parameters to a connection string, unless they are already set
+func addParams(cnxn string, params []dsnParam) string {
+	query := ""
+	if pos := strings.IndexRune(cnxn, '?'); pos >= 0 {
+		query = cnxn[pos+1:]
+	}
+	for _, p := range params {
+		names := strings.Fields(p.names)
+		set := false
+		for _, kv := range strings.Split(query, "&") {
+			for _, name := range names {
+				if strings.HasPrefix(kv, name+"=") {
+					set = true
+				}
+			}
+		}
+		if set {
+			continue
+		}
+		if strings.ContainsRune(cnxn, '?') {
+			cnxn += "&"
+		} else {
+			cnxn += "?"
+		}
+		cnxn += names[0] + "=" + p.value
+	}
+	return cnxn
+}
+
+// SerializeWrites makes the statements of a database execute their writes one at a time
+func SerializeWrites(db *sql.DB) {
+	writeLocks.LoadOrStore(db, new(sync.Mutex))
+}
+
+// lockWrites waits for the other writes on a database to end, if its writes are serialized,
+// and returns the function which releases the lock
+func lockWrites(db *sql.DB) func() {
+	lock, ok := writeLocks.Load(db)
+	if !ok {
+		return func() {}
+	}
+	mutex := lock.(*sync.Mutex)
+	mutex.Lock()
+	return mutex.Unlock
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+)
+
+// Stmt is a statement prepared on its first use rather than at startup.
+// Some drivers and connection proxies drop the prepared statements when a connection
+// is reset: the statement is then prepared again and the call is retried once.
+type Stmt struct {
+	db    *sql.DB
+	query string
+	mutex sync.Mutex
+	stmt  *sql.Stmt
+}
+
+// NewStmt returns a statement which will be prepared on its first use
+func NewStmt(db *sql.DB, query string) *Stmt {
+	return &Stmt{db: db, query: query}
+}
+
+// prepared returns the prepared statement, preparing it if needed
+func (s *Stmt) prepared() (*sql.Stmt, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stmt == nil {
+		stmt, err := s.db.Prepare(s.query)
+		if err != nil {
+			return nil, err
+		}
+		s.stmt = stmt
+	}
+	return s.stmt, nil
+}
+
+// reset closes a statement the driver has lost, so that it is prepared again
+func (s *Stmt) reset(stmt *sql.Stmt) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stmt == stmt {
+		s.stmt.Close()
+		s.stmt = nil
+	}
+}
+
+// Query executes a prepared query statement
+func (s *Stmt) Query(args ...interface{}) (*sql.Rows, error) {
+	stmt, err := s.prepared()
+	if err != nil {
+		return nil, err
+	}
+	args = utcArgs(args)
+	rows, err := stmt.Query(args...)
+	if isStatementLost(err) {
+		s.reset(stmt)
+		if stmt, err = s.prepared(); err != nil {
+			return nil, err
+		}
+		rows, err = stmt.Query(args...)
+	}
+	return rows, err
+}
+
+// Row is the result of QueryRow
+type Row struct {
+	s    *Stmt
+	stmt *sql.Stmt
+	args []interface{}
+	row  *sql.Row
+}
+
+// Scan copies the columns of the row; if the prepared statement was lost,
+// it is prepared again and the query is retried once
+func (r *Row) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	if r.stmt != nil && isStatementLost(err) {
+		r.s.reset(r.stmt)
+		stmt, err := r.s.prepared()
+		if err != nil {
+			return err
+		}
+		return stmt.QueryRow(r.args...).Scan(dest...)
+	}
+	return err
+}
+
+// QueryRow executes a prepared query statement returning at most one row;
+// if the statement cannot be prepared, the query is executed directly, which reports the error.
+func (s *Stmt) QueryRow(args ...interface{}) *Row {
+	args = utcArgs(args)
+	stmt, err := s.prepared()
+	if err != nil {
+		return &Row{row: s.db.QueryRow(s.query, args...)}
+	}
+	return &Row{s: s, stmt: stmt, args: args, row: stmt.QueryRow(args...)}
+}
+
+// Exec executes a prepared statement; the writes on a sqlite database are serialized
+func (s *Stmt) Exec(args ...interface{}) (sql.Result, error) {
+	defer lockWrites(s.db)()
+
+	stmt, err := s.prepared()
+	if err != nil {
+		return nil, err
+	}
+	args = utcArgs(args)
+	res, err := stmt.Exec(args...)
+	if isStatementLost(err) {
+		s.reset(stmt)
+		if stmt, err = s.prepared(); err != nil {
+			return nil, err
+		}
+		res, err = stmt.Exec(args...)
+	}
+	return res, err
+}
+
+// ExecTx executes the statement in a transaction
+func (s *Stmt) ExecTx(tx *sql.Tx, args ...interface{}) (sql.Result, error) {
+	return tx.Exec(s.query, utcArgs(args)...)
+}
+
+// QueryTx executes the query in a transaction
+func (s *Stmt) QueryTx(tx *sql.Tx, args ...interface{}) (*sql.Rows, error) {
+	return tx.Query(s.query, utcArgs(args)...)
+}
+
+// QueryRowTx executes the query in a transaction, returning at most one row
+func (s *Stmt) QueryRowTx(tx *sql.Tx, args ...interface{}) *sql.Row {
+	return tx.QueryRow(s.query, utcArgs(args)...)
+}
+
+// isStatementLost checks if an error means that the prepared statement is unknown
+// on the server side (postgres: 26000, mysql: 1243)
+func isStatementLost(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return (strings.Contains(msg, "prepared statement") && strings.Contains(msg, "does not exist")) ||
+		strings.Contains(msg, "Unknown prepared statement handler")
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestLazyStatement(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	// the table does not exist yet: nothing is prepared at this point
+	add := NewStmt(db, "INSERT INTO item (id) VALUES (?)")
+	get := NewStmt(db, "SELECT id FROM item WHERE id = ?")
+	if _, err = add.Exec(1); err == nil {
+		t.Error("Expected an error on a missing table")
+	}
+
+	_, err = db.Exec("CREATE TABLE item (id integer PRIMARY KEY)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = add.Exec(1); err != nil {
+		t.Fatal(err)
+	}
+	var id int
+	if err = get.QueryRow(1).Scan(&id); err != nil || id != 1 {
+		t.Errorf("Expected the item 1, got %d, %v", id, err)
+	}
+	rows, err := get.Query(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() {
+		t.Error("Expected a row")
+	}
+	rows.Close()
+}
+
+func TestStatementLost(t *testing.T) {
+	if !isStatementLost(errors.New(`pq: prepared statement "1" does not exist`)) {
+		t.Error("Expected a lost postgres statement")
+	}
+	if !isStatementLost(errors.New("Error 1243: Unknown prepared statement handler (1) given to mysqld_stmt_execute")) {
+		t.Error("Expected a lost mysql statement")
+	}
+	if isStatementLost(errors.New("no such table: item")) || isStatementLost(nil) {
+		t.Error("Did not expect a lost statement")
+	}
+}
+
+// lostDriver loses the first statement it prepares, as a connection proxy resetting the connection
+type lostDriver struct{}
+
+var lostPrepared int
+
+func init() {
+	sql.Register("lost", lostDriver{})
+}
+
+func (lostDriver) Open(name string) (driver.Conn, error) { return lostConn{}, nil }
+
+type lostConn struct{}
+
+func (lostConn) Prepare(query string) (driver.Stmt, error) {
+	lostPrepared++
+	return &lostStmt{n: lostPrepared}, nil
+}
+func (lostConn) Close() error              { return nil }
+func (lostConn) Begin() (driver.Tx, error) { return nil, errors.New("no transaction") }
+
+type lostStmt struct{ n int }
+
+func (s *lostStmt) Close() error  { return nil }
+func (s *lostStmt) NumInput() int { return -1 }
+func (s *lostStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("no exec")
+}
+func (s *lostStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.n == 1 {
+		return nil, errors.New(`pq: prepared statement "1" does not exist`)
+	}
+	return &lostRows{}, nil
+}
+
+type lostRows struct{ done bool }
+
+func (r *lostRows) Columns() []string { return []string{"id"} }
+func (r *lostRows) Close() error      { return nil }
+func (r *lostRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(1)
+	return nil
+}
+
+func TestQueryRowStatementLost(t *testing.T) {
+	lostPrepared = 0
+	db, err := sql.Open("lost", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	get := NewStmt(db, "SELECT id FROM item WHERE id = ?")
+	var id int
+	if err = get.QueryRow(1).Scan(&id); err != nil || id != 1 {
+		t.Errorf("Expected the query to be retried, got %d, %v", id, err)
+	}
+	if lostPrepared != 2 {
+		t.Errorf("Expected the statement to be prepared again, got %d preparations", lostPrepared)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"database/sql"
+)
+
+// Beginner starts the transactions of a unit of work; *sql.DB and the stores
+// which share their database with other stores implement it
+type Beginner interface {
+	Begin() (*sql.Tx, error)
+}
+
+// committedError is an error returned by a unit of work whose changes are committed anyway
+type committedError struct {
+	err error
+}
+
+func (e committedError) Error() string {
+	return e.err.Error()
+}
+
+func (e committedError) Unwrap() error {
+	return e.err
+}
+
+// KeepChanges marks the error returned by a unit of work whose changes must be committed anyway,
+// e.g. a request rejected after recording a reservation. Transact returns the error itself.
+func KeepChanges(err error) error {
+	return committedError{err: err}
+}
+
+// Transact runs a unit of work: the writes of fn, made through the Tx methods of the stores
+// sharing the database, are committed together if fn succeeds, and rolled back together
+// if it returns an error or panics.
+//
+func Transact(b Beginner, fn func(tx *sql.Tx) error) error {
+	tx, err := b.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	err = fn(tx)
+	if kept, ok := err.(committedError); ok {
+		if cerr := tx.Commit(); cerr != nil {
+			return cerr
+		}
+		return kept.err
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package dbutils
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestTransact(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec("CREATE TABLE item (id integer PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+	add := NewStmt(db, "INSERT INTO item (id) VALUES (?)")
+	count := func() (n int) {
+		db.QueryRow("SELECT COUNT(*) FROM item").Scan(&n)
+		return n
+	}
+	addTwo := func(tx *sql.Tx, first int) error {
+		if _, err := add.ExecTx(tx, first); err != nil {
+			return err
+		}
+		_, err := add.ExecTx(tx, first+1)
+		return err
+	}
+
+	if err = Transact(db, func(tx *sql.Tx) error { return addTwo(tx, 1) }); err != nil || count() != 2 {
+		t.Errorf("Expected the writes to be committed, got %d items, %v", count(), err)
+	}
+	// the second insert fails: the first one is rolled back
+	if err = Transact(db, func(tx *sql.Tx) error { return addTwo(tx, 0) }); err == nil || count() != 2 {
+		t.Errorf("Expected the writes to be rolled back, got %d items, %v", count(), err)
+	}
+	rejected := errors.New("rejected")
+	if err = Transact(db, func(tx *sql.Tx) error {
+		addTwo(tx, 10)
+		return KeepChanges(rejected)
+	}); err != rejected || count() != 4 {
+		t.Errorf("Expected the writes to be kept with the error, got %d items, %v", count(), err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected the panic to be propagated")
+			}
+		}()
+		Transact(db, func(tx *sql.Tx) error {
+			addTwo(tx, 20)
+			panic("unexpected")
+		})
+	}()
+	if count() != 4 {
+		t.Errorf("Expected the writes to be rolled back on a panic, got %d items", count())
+	}
+}
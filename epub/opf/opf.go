@@ -17,15 +17,18 @@ type Package struct {
 	BasePath string   `xml:"-"`
 	Metadata Metadata `xml:"http://www.idpf.org/2007/opf metadata"`
 	Manifest Manifest `xml:"http://www.idpf.org/2007/opf manifest"`
+	Spine    Spine    `xml:"http://www.idpf.org/2007/opf spine"`
 }
 
 // Metadata is the package metadata structure
 type Metadata struct {
-	Author string `json:"author" xml:"http://purl.org/dc/elements/1.1/ creator"`
-	Title  string `json:"title" xml:"http://purl.org/dc/elements/1.1/ title"`
-	Isbn   string `json:"isbn" xml:"http://purl.org/dc/elements/1.1/ identifier"`
-	Metas  []Meta `xml:"http://www.idpf.org/2007/opf meta"`
-	Cover  string `json:"cover"`
+	Author   string `json:"author" xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Title    string `json:"title" xml:"http://purl.org/dc/elements/1.1/ title"`
+	Isbn     string `json:"isbn" xml:"http://purl.org/dc/elements/1.1/ identifier"`
+	Language string `json:"language" xml:"http://purl.org/dc/elements/1.1/ language"`
+	Date     string `json:"date" xml:"http://purl.org/dc/elements/1.1/ date"`
+	Metas    []Meta `xml:"http://www.idpf.org/2007/opf meta"`
+	Cover    string `json:"cover"`
 }
 
 // Meta is the metadata item structure
@@ -48,6 +51,16 @@ type Item struct {
 	Properties string `xml:"properties,attr"`
 }
 
+// Spine is the package spine structure
+type Spine struct {
+	ItemRefs []ItemRef `xml:"http://www.idpf.org/2007/opf itemref"`
+}
+
+// ItemRef is the spine itemref structure
+type ItemRef struct {
+	IdRef string `xml:"idref,attr"`
+}
+
 // ItemWithPath looks for the manifest item corresponding to a given path
 func (m Manifest) ItemWithPath(path string) (Item, bool) {
 	for _, i := range m.Items {
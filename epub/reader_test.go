@@ -27,6 +27,7 @@ package epub
 
 import (
 	"archive/zip"
+	"bytes"
 	"fmt"
 	"sort"
 	"testing"
@@ -67,3 +68,61 @@ func TestEpubLoading(t *testing.T) {
 		t.Errorf("Content Type matching, expected %v, got %v", expected, ep.Resource[2].ContentType)
 	}
 }
+
+func TestEpubValidation(t *testing.T) {
+	zr, err := zip.OpenReader("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	report := Validate(&zr.Reader)
+	if !report.Valid {
+		t.Errorf("Expected a valid epub, got %v", report.Errors)
+	}
+
+	// build an epub with a missing resource and an unknown spine item
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := []struct{ name, body string }{
+		{"mimetype", ContentType_EPUB},
+		{ContainerFile, `<?xml version="1.0"?><container xmlns="urn:oasis:names:tc:opendocument:xmlns:container"><rootfiles>` +
+			`<rootfile full-path="OPS/package.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`},
+		{"OPS/package.opf", `<?xml version="1.0"?><package xmlns="http://www.idpf.org/2007/opf"><manifest>` +
+			`<item id="c1" href="chapter%201.xhtml" media-type="application/xhtml+xml"/>` +
+			`<item id="c2" href="chapter2.xhtml" media-type="application/xhtml+xml"/></manifest>` +
+			`<spine><itemref idref="c1"/><itemref idref="c3"/></spine></package>`},
+		{"OPS/chapter 1.xhtml", "<html/>"},
+	}
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.body))
+	}
+	zw.Close()
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = Validate(r)
+	if report.Valid {
+		t.Fatal("Expected an invalid epub")
+	}
+	codes := make(map[string]string)
+	for _, issue := range report.Errors {
+		codes[issue.Code] = issue.Path
+	}
+	if codes[IssueResourceMissing] != "OPS/chapter2.xhtml" {
+		t.Errorf("Expected a missing resource error for OPS/chapter2.xhtml, got %v", report.Errors)
+	}
+	if _, ok := codes[IssueSpineItemMissing]; !ok {
+		t.Errorf("Expected a spine item error, got %v", report.Errors)
+	}
+	// the mimetype file is compressed
+	if len(report.Warnings) != 1 || report.Warnings[0].Code != IssueMimetypeInvalid {
+		t.Errorf("Expected a mimetype warning, got %v", report.Warnings)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 European Digital Reading Lab. All rights reserved.
+// Licensed to the Readium Foundation under one or more contributor license agreements.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package epub
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/epub/opf"
+)
+
+// validation issue codes
+const (
+	IssueMimetypeMissing    = "mimetype-missing"
+	IssueMimetypeInvalid    = "mimetype-invalid"
+	IssueContainerMissing   = "container-missing"
+	IssueContainerInvalid   = "container-invalid"
+	IssueRootFileMissing    = "rootfile-missing"
+	IssuePackageInvalid     = "package-invalid"
+	IssueResourceMissing    = "resource-missing"
+	IssueSpineItemMissing   = "spine-item-missing"
+	IssueResourceUndeclared = "resource-undeclared"
+)
+
+// Issue is a problem detected during the validation of an EPUB
+type Issue struct {
+	Code    string `json:"code"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidationReport is the machine-readable result of the validation of an EPUB
+// errors make the publication unusable; warnings do not prevent its protection
+type ValidationReport struct {
+	Valid    bool    `json:"valid"`
+	Errors   []Issue `json:"errors,omitempty"`
+	Warnings []Issue `json:"warnings,omitempty"`
+}
+
+func (report *ValidationReport) addError(code string, path string, message string) {
+	report.Errors = append(report.Errors, Issue{Code: code, Path: path, Message: message})
+	report.Valid = false
+}
+
+func (report *ValidationReport) addWarning(code string, path string, message string) {
+	report.Warnings = append(report.Warnings, Issue{Code: code, Path: path, Message: message})
+}
+
+// Validate checks the structure of an EPUB: the mimetype file, the container file,
+// the package documents and the presence of the resources they declare
+func Validate(r *zip.Reader) ValidationReport {
+	report := ValidationReport{Valid: true}
+
+	files := make(map[string]*zip.File)
+	for _, file := range r.File {
+		files[file.Name] = file
+	}
+
+	// the mimetype file should be the first entry of the zip, stored without compression
+	if mimetype, ok := files["mimetype"]; !ok {
+		report.addWarning(IssueMimetypeMissing, "mimetype", "The mimetype file is missing")
+	} else {
+		content, err := readZipFile(mimetype)
+		if err != nil || strings.TrimSpace(string(content)) != ContentType_EPUB {
+			report.addWarning(IssueMimetypeInvalid, "mimetype", "The mimetype file must contain "+ContentType_EPUB)
+		} else if r.File[0] != mimetype || mimetype.Method != zip.Store {
+			report.addWarning(IssueMimetypeInvalid, "mimetype", "The mimetype file must be the first entry, stored without compression")
+		}
+	}
+
+	container, ok := files[ContainerFile]
+	if !ok {
+		report.addError(IssueContainerMissing, ContainerFile, "The container file is missing")
+		return report
+	}
+	fd, err := container.Open()
+	if err != nil {
+		report.addError(IssueContainerInvalid, ContainerFile, err.Error())
+		return report
+	}
+	rootFiles, err := findRootFiles(fd)
+	fd.Close()
+	if err != nil {
+		report.addError(IssueContainerInvalid, ContainerFile, err.Error())
+		return report
+	}
+	if len(rootFiles) == 0 {
+		report.addError(IssueContainerInvalid, ContainerFile, "The container file does not reference any package document")
+		return report
+	}
+
+	// resources declared in a package document
+	declared := map[string]bool{"mimetype": true}
+
+	for _, rootFile := range rootFiles {
+		file, ok := files[rootFile.FullPath]
+		if !ok {
+			report.addError(IssueRootFileMissing, rootFile.FullPath, "The package document is missing")
+			continue
+		}
+		declared[rootFile.FullPath] = true
+		packageFile, err := file.Open()
+		if err != nil {
+			report.addError(IssuePackageInvalid, rootFile.FullPath, err.Error())
+			continue
+		}
+		p, err := opf.Parse(packageFile)
+		packageFile.Close()
+		if err != nil {
+			report.addError(IssuePackageInvalid, rootFile.FullPath, err.Error())
+			continue
+		}
+
+		basePath := path.Dir(rootFile.FullPath)
+		ids := make(map[string]bool)
+		for _, item := range p.Manifest.Items {
+			ids[item.Id] = true
+			// remote resources are not part of the package
+			if u, err := url.Parse(item.Href); err != nil || u.IsAbs() {
+				continue
+			}
+			itemPath, err := resolveHref(basePath, item.Href)
+			if err != nil {
+				report.addError(IssuePackageInvalid, rootFile.FullPath, "Invalid href "+item.Href)
+				continue
+			}
+			declared[itemPath] = true
+			if _, ok := files[itemPath]; !ok {
+				report.addError(IssueResourceMissing, itemPath, "The resource declared in the manifest is missing")
+			}
+		}
+		for _, itemRef := range p.Spine.ItemRefs {
+			if !ids[itemRef.IdRef] {
+				report.addError(IssueSpineItemMissing, rootFile.FullPath, "The spine references an unknown item "+itemRef.IdRef)
+			}
+		}
+	}
+
+	// resources which are not declared in any package document
+	for _, file := range r.File {
+		if file.FileInfo().IsDir() || strings.HasPrefix(file.Name, "META-INF/") || declared[file.Name] {
+			continue
+		}
+		report.addWarning(IssueResourceUndeclared, file.Name, "The resource is not declared in the manifest")
+	}
+
+	return report
+}
+
+// resolveHref returns the path in the zip of a resource referenced by a package document
+func resolveHref(basePath string, href string) (string, error) {
+	if i := strings.Index(href, "#"); i >= 0 {
+		href = href[:i]
+	}
+	unescaped, err := url.PathUnescape(href)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(basePath, unescaped), nil
+}
+
+func readZipFile(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package errorreport reports the panics and the server errors (5xx) of the requests to an error tracker,
+// with the context of the request. The tracker is a Reporter; Sentry is supported.
+package errorreport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// maxCapturedBody is the max size of the body of an error response kept for its report, in bytes
+const maxCapturedBody = 4096
+
+// Event is an error reported to the error tracker
+type Event struct {
+	Time    time.Time
+	Server  string // lcp, lsd or frontend
+	Message string
+	Panic   bool
+	Stack   string // the stack of a panic
+	Status  int    // the http status of the response
+	// the context of the request
+	Method    string
+	Path      string
+	RequestId string
+	UserAgent string
+	User      string // the basic authentication user, if any
+}
+
+// Reporter sends the errors to an error tracker; Report must not block the request
+type Reporter interface {
+	Report(e Event)
+}
+
+var (
+	mutex    sync.RWMutex
+	reporter Reporter
+	server   string
+)
+
+// SetReporter sets the reporter of the errors of a server; a nil reporter disables the reports
+//
+func SetReporter(name string, r Reporter) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	server, reporter = name, r
+}
+
+// Init sets the reporter configured for a server, if any
+//
+func Init(name string, conf config.ErrorReporting) error {
+	if conf.SentryDSN == "" {
+		SetReporter(name, nil)
+		return nil
+	}
+	sentry, err := NewSentry(conf.SentryDSN, conf.Environment)
+	if err != nil {
+		return err
+	}
+	SetReporter(name, sentry)
+	return nil
+}
+
+// Capture reports an error with the context of a request, if a reporter is set
+//
+func Capture(r *http.Request, e Event) {
+	mutex.RLock()
+	rep, name := reporter, server
+	mutex.RUnlock()
+	if rep == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	e.Server = name
+	if r != nil {
+		e.Method = r.Method
+		e.Path = r.URL.Path
+		// set by the recovery of the servers, or by a proxy
+		e.RequestId = r.Header.Get("X-Request-Id")
+		e.UserAgent = r.UserAgent()
+		e.User, _, _ = r.BasicAuth()
+	}
+	rep.Report(e)
+}
+
+// Middleware reports the panics of the handlers, which are then recovered by the outer middlewares,
+// and the responses with a server error status
+//
+func Middleware(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	rec := &recorder{ResponseWriter: w}
+	defer func() {
+		if err := recover(); err != nil {
+			Capture(r, Event{Message: fmt.Sprint(err), Panic: true, Stack: string(debug.Stack()),
+				Status: http.StatusInternalServerError})
+			panic(err)
+		}
+	}()
+	next(rec, r)
+	if rec.status >= 500 {
+		Capture(r, Event{Message: rec.message(), Status: rec.status})
+	}
+}
+
+// recorder keeps the status of a response, and the beginning of the body of a server error
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status >= 500 && rec.body.Len() < maxCapturedBody {
+		n := len(b)
+		if n > maxCapturedBody-rec.body.Len() {
+			n = maxCapturedBody - rec.body.Len()
+		}
+		rec.body.Write(b[:n])
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush sends the response written so far, for the streamed responses
+func (rec *recorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives access to the response writer of the server, for http.NewResponseController
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// message returns the detail of the problem of a server error, else its status
+func (rec *recorder) message() string {
+	var p struct {
+		Detail string `json:"detail"`
+	}
+	if json.Unmarshal(rec.body.Bytes(), &p) == nil && p.Detail != "" {
+		return p.Detail
+	}
+	return strconv.Itoa(rec.status) + " " + http.StatusText(rec.status)
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package errorreport
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type events []Event
+
+func (e *events) Report(event Event) {
+	*e = append(*e, event)
+}
+
+func TestMiddleware(t *testing.T) {
+	var reported events
+	SetReporter("lcp", &reported)
+	defer SetReporter("", nil)
+
+	serve := func(handler http.HandlerFunc) (panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		r := httptest.NewRequest("GET", "/licenses/l1?x=1", nil)
+		r.SetBasicAuth("admin", "secret")
+		r.Header.Set("X-Request-Id", "req-1")
+		Middleware(httptest.NewRecorder(), r, handler)
+		return false
+	}
+
+	serve(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+	if len(reported) != 0 {
+		t.Fatalf("Expected no report of a client error, got %v", reported)
+	}
+
+	serve(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":503,"detail":"The database is unreachable"}`))
+	})
+	if len(reported) != 1 {
+		t.Fatalf("Expected the server error to be reported, got %v", reported)
+	}
+	e := reported[0]
+	if e.Server != "lcp" || e.Status != 503 || e.Message != "The database is unreachable" || e.Panic {
+		t.Errorf("Unexpected report %+v", e)
+	}
+	if e.Method != "GET" || e.Path != "/licenses/l1" || e.User != "admin" || e.RequestId != "req-1" {
+		t.Errorf("Expected the context of the request, got %+v", e)
+	}
+
+	if !serve(func(w http.ResponseWriter, r *http.Request) { panic("boom") }) {
+		t.Fatal("Expected the panic to reach the recovery")
+	}
+	if len(reported) != 2 || !reported[1].Panic || reported[1].Message != "boom" || reported[1].Stack == "" {
+		t.Errorf("Expected the panic to be reported with its stack, got %+v", reported)
+	}
+}
+
+func TestSentry(t *testing.T) {
+	if _, err := NewSentry("https://sentry.example.com/42", ""); err != ErrInvalidDSN {
+		t.Errorf("Expected a DSN without key to be invalid, got %v", err)
+	}
+
+	received := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/prefix/api/42/envelope/" || !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key=key") {
+			t.Errorf("Unexpected request %s %s", r.URL.Path, r.Header.Get("X-Sentry-Auth"))
+		}
+		scanner := bufio.NewScanner(r.Body)
+		var lines []string
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		var event map[string]interface{}
+		if len(lines) != 3 || json.Unmarshal([]byte(lines[2]), &event) != nil {
+			t.Errorf("Expected an envelope of an event, got %v", lines)
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	sentry, err := NewSentry(strings.Replace(server.URL, "://", "://key@", 1)+"/prefix/42", "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sentry.Report(Event{Time: time.Now(), Server: "lsd", Message: "boom", Panic: true, Status: 500, Path: "/licenses"})
+	select {
+	case event := <-received:
+		if event["message"] != "boom" || event["level"] != "fatal" || event["environment"] != "staging" {
+			t.Errorf("Unexpected event %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the event to be sent to Sentry")
+	}
+}
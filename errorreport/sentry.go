@@ -0,0 +1,145 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package errorreport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sentryQueueSize is the max number of events waiting to be sent; the events beyond are dropped
+const sentryQueueSize = 100
+
+// ErrInvalidDSN is returned when a Sentry DSN is not https://<key>@<host>/<project>
+var ErrInvalidDSN = errors.New("Invalid Sentry DSN")
+
+// Sentry sends the errors to a Sentry project, with its envelope api, from a background goroutine
+type Sentry struct {
+	endpoint    string
+	auth        string
+	dsn         string
+	environment string
+	hostname    string
+	client      *http.Client
+	queue       chan Event
+}
+
+// NewSentry returns a reporter sending the errors to the Sentry project of a DSN
+//
+func NewSentry(dsn string, environment string) (*Sentry, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.User.Username() == "" || u.Host == "" {
+		return nil, ErrInvalidDSN
+	}
+	path := strings.Trim(u.Path, "/")
+	if path == "" {
+		return nil, ErrInvalidDSN
+	}
+	prefix, project := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		prefix, project = "/"+path[:i], path[i+1:]
+	}
+	hostname, _ := os.Hostname()
+	s := &Sentry{
+		endpoint:    u.Scheme + "://" + u.Host + prefix + "/api/" + project + "/envelope/",
+		auth:        "Sentry sentry_version=7, sentry_client=readium-lcp-server/1.0, sentry_key=" + u.User.Username(),
+		dsn:         dsn,
+		environment: environment,
+		hostname:    hostname,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan Event, sentryQueueSize),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Report queues an error; it is dropped if the queue is full, e.g. while Sentry is unreachable
+func (s *Sentry) Report(e Event) {
+	select {
+	case s.queue <- e:
+	default:
+		log.Println("Sentry: error report dropped: " + e.Message)
+	}
+}
+
+func (s *Sentry) run() {
+	for e := range s.queue {
+		if err := s.send(e); err != nil {
+			log.Println("Sentry: " + err.Error())
+		}
+	}
+}
+
+// send posts an event in an envelope: a header, the header of the item and the event, one per line
+func (s *Sentry) send(e Event) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+	eventId := hex.EncodeToString(id)
+
+	level := "error"
+	if e.Panic {
+		level = "fatal"
+	}
+	event := map[string]interface{}{
+		"event_id":    eventId,
+		"timestamp":   e.Time.Format(time.RFC3339),
+		"platform":    "go",
+		"level":       level,
+		"logger":      e.Server,
+		"server_name": s.hostname,
+		"message":     e.Message,
+		"tags":        map[string]string{"server": e.Server, "status": strconv.Itoa(e.Status)},
+		"request": map[string]interface{}{
+			"method":  e.Method,
+			"url":     e.Path,
+			"headers": map[string]string{"User-Agent": e.UserAgent, "X-Request-Id": e.RequestId},
+		},
+	}
+	if s.environment != "" {
+		event["environment"] = s.environment
+	}
+	if e.User != "" {
+		event["user"] = map[string]string{"username": e.User}
+	}
+	if e.Stack != "" {
+		event["extra"] = map[string]string{"stack": e.Stack}
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	header, _ := json.Marshal(map[string]string{"event_id": eventId, "dsn": s.dsn})
+	var body bytes.Buffer
+	body.Write(header)
+	body.WriteString("\n{\"type\":\"event\",\"length\":" + strconv.Itoa(len(payload)) + "}\n")
+	body.Write(payload)
+	body.WriteString("\n")
+
+	req, err := http.NewRequest("POST", s.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+	response, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return errors.New("Sentry returned " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
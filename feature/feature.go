@@ -0,0 +1,73 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package feature evaluates the feature flags of the configuration by provider, so that a new behavior
+// is rolled out to some providers first. The rollout of a feature is a list of targets separated by spaces:
+// provider URIs, "*" for all the providers, or a percentage such as "10%", which selects a stable share
+// of the providers. A feature absent from the configuration keeps its default.
+// The rollouts stored in the database of the License Server override the configuration.
+package feature
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// the features rolled out by provider
+const (
+	// the new licenses get the 1.0 profile, unless the template of their content sets a profile
+	Profile10 = "profile_1_0"
+	// the reminders of the end of the loans are sent to the push channels
+	PushReminders = "push_reminders"
+	// the large encrypted files are stored in parts, evaluated for the tenant of the file
+	StorageParts = "storage_parts"
+)
+
+// Defaults are the states of the features absent from the configuration
+var Defaults = map[string]bool{
+	Profile10:     false,
+	PushReminders: true,
+	StorageParts:  true,
+}
+
+// Enabled returns true if a feature is enabled for a provider
+func Enabled(name string, provider string) bool {
+	rollout, ok := storedRollout(name)
+	if !ok {
+		rollout, ok = config.FeaturesConfig()[name]
+	}
+	if !ok {
+		return Defaults[name]
+	}
+	return Selects(rollout, name, provider)
+}
+
+// Selects returns true if the rollout of a feature selects a provider
+func Selects(rollout string, name string, provider string) bool {
+	for _, target := range strings.Fields(rollout) {
+		switch {
+		case target == "*":
+			return true
+		case strings.HasSuffix(target, "%"):
+			percent, err := strconv.Atoi(strings.TrimSuffix(target, "%"))
+			if err == nil && provider != "" && bucket(name, provider) < percent {
+				return true
+			}
+		case target == provider:
+			return true
+		}
+	}
+	return false
+}
+
+// bucket places a provider between 0 and 99 for a feature, the same on every instance of the servers;
+// a percentage selects the providers of the first buckets, and keeps them selected when it grows
+func bucket(name string, provider string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name + "|" + provider))
+	return int(h.Sum32() % 100)
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package feature
+
+import (
+	"database/sql"
+	"strconv"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestEnabled(t *testing.T) {
+	defer func() { config.Config.Features = nil }()
+
+	// the features absent from the configuration keep their default
+	if Enabled(Profile10, "https://a.example.com") || !Enabled(PushReminders, "https://a.example.com") {
+		t.Error("Expected the default states of the features")
+	}
+	config.Config.Features = map[string]string{
+		Profile10:     "https://a.example.com https://b.example.com",
+		PushReminders: "",
+		"new_storage": "*",
+	}
+	if !Enabled(Profile10, "https://a.example.com") || Enabled(Profile10, "https://c.example.com") {
+		t.Error("Expected the feature to be enabled for the listed providers only")
+	}
+	if Enabled(PushReminders, "https://a.example.com") {
+		t.Error("Expected the feature to be disabled for all the providers")
+	}
+	if !Enabled("new_storage", "https://c.example.com") {
+		t.Error("Expected the feature to be enabled for all the providers")
+	}
+}
+
+func TestSelectsPercentage(t *testing.T) {
+	selected := 0
+	for i := 0; i < 1000; i++ {
+		provider := "https://provider" + strconv.Itoa(i) + ".example.com"
+		in := Selects("20%", Profile10, provider)
+		if in {
+			selected++
+		}
+		// a provider stays selected when the percentage grows
+		if in && !Selects("50%", Profile10, provider) {
+			t.Fatalf("Expected %s to stay selected", provider)
+		}
+	}
+	if selected < 150 || selected > 250 {
+		t.Errorf("Expected about 20%% of the providers, got %d out of 1000", selected)
+	}
+	if Selects("0%", Profile10, "https://a.example.com") || !Selects("100%", Profile10, "https://a.example.com") {
+		t.Error("Expected 0% to select none and 100% to select all the providers")
+	}
+}
+
+func TestStore(t *testing.T) {
+	config.Config.LcpServer.Database = "sqlite3://:memory:"
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	config.Config.Features = map[string]string{Profile10: "https://a.example.com", PushReminders: ""}
+	defer func() { config.Config.Features = nil }()
+
+	s, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Use(s); err != nil {
+		t.Fatal(err)
+	}
+	defer Use(nil)
+
+	// the rollouts of the database override the configuration
+	if err = Set(Profile10, "https://b.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Set(StorageParts, ""); err != nil {
+		t.Fatal(err)
+	}
+	if Enabled(Profile10, "https://a.example.com") || !Enabled(Profile10, "https://b.example.com") {
+		t.Error("Expected the rollout of the database to apply")
+	}
+	if Enabled(StorageParts, "") || Enabled(PushReminders, "https://a.example.com") {
+		t.Error("Expected the features to be disabled")
+	}
+	rollouts := Rollouts()
+	if len(rollouts) != 3 || rollouts[Profile10] != "https://b.example.com" || rollouts[PushReminders] != "" {
+		t.Errorf("Unexpected rollouts %v", rollouts)
+	}
+
+	// another instance of the server reads the rollouts at its refresh
+	if err = s.Set(Profile10, "*"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if !Enabled(Profile10, "https://c.example.com") {
+		t.Error("Expected the refreshed rollout to apply")
+	}
+
+	// a deleted rollout falls back to the configuration, then to the default
+	if err = Delete(Profile10); err != nil {
+		t.Fatal(err)
+	}
+	if err = Delete(StorageParts); err != nil {
+		t.Fatal(err)
+	}
+	if !Enabled(Profile10, "https://a.example.com") || Enabled(Profile10, "https://b.example.com") || !Enabled(StorageParts, "") {
+		t.Error("Expected the configuration and the defaults to apply")
+	}
+	if err = Delete(StorageParts); err != ErrNotFound {
+		t.Errorf("Expected the feature not to be found, got %v", err)
+	}
+}
+
+func TestCheckRollout(t *testing.T) {
+	for rollout, valid := range map[string]bool{
+		"":                           true,
+		"* 10%":                      true,
+		"https://a.example.com 0%":   true,
+		"100%":                       true,
+		"101%":                       false,
+		"-1%":                        false,
+		"https://a.example.com ten%": false,
+	} {
+		if err := CheckRollout(rollout); (err == nil) != valid {
+			t.Errorf("Unexpected check of %q: %v", rollout, err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package feature
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
+)
+
+// ErrNotFound is returned when a feature is not in the database
+var ErrNotFound = dbutils.NewError(dbutils.ErrNotFound, "Feature not found")
+
+// Store keeps the rollouts of the features in the database, which override the configuration,
+// so that a feature is rolled out on all the instances of a server without a change of their configuration
+type Store interface {
+	List() (map[string]string, error)
+	Set(name string, rollout string) error
+	Delete(name string) error
+}
+
+type dbStore struct {
+	list   *dbutils.Stmt
+	set    *dbutils.Stmt
+	delete *dbutils.Stmt
+}
+
+// List returns the rollouts stored in the database, by feature
+func (s dbStore) List() (map[string]string, error) {
+	rows, err := s.list.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rollouts := make(map[string]string)
+	for rows.Next() {
+		var name, rollout string
+		if err = rows.Scan(&name, &rollout); err != nil {
+			return nil, err
+		}
+		rollouts[name] = rollout
+	}
+	return rollouts, rows.Err()
+}
+
+// Set stores the rollout of a feature
+func (s dbStore) Set(name string, rollout string) error {
+	_, err := s.set.Exec(name, rollout, time.Now().UTC())
+	return err
+}
+
+// Delete removes the rollout of a feature, which falls back to the configuration
+func (s dbStore) Delete(name string) error {
+	res, err := s.delete.Exec(name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Open opens the store of the features and creates the feature_flag table if it does not exist
+func Open(db *sql.DB) (s Store, err error) {
+	// the queries are written with '?' placeholders, bound to the dialect of the database
+	d := dbutils.DialectOf(config.Config.LcpServer.Database)
+	createTableQuery := tableDef
+	if d == dbutils.Postgres {
+		createTableQuery = tableDefPostgres
+	}
+	listQuery := "SELECT name, rollout FROM feature_flag"
+	deleteQuery := "DELETE FROM feature_flag WHERE name = ?"
+
+	// if sqlite/postgres, create the feature table if it does not exist
+	if d != dbutils.MySQL {
+		_, err = db.Exec(createTableQuery)
+		if err != nil {
+			log.Println("Error creating the feature_flag table")
+			return
+		}
+	}
+	// if mysql, create the feature table if it does not exist
+	if d == dbutils.MySQL {
+		err = dbutils.CreateMySQLTables(db, tableDefMySQL)
+		if err != nil {
+			log.Println("Error creating the feature_flag table")
+			return
+		}
+	}
+
+	s = dbStore{
+		dbutils.NewStmt(db, d.Bind(listQuery)),
+		dbutils.NewStmt(db, d.Upsert("feature_flag", []string{"name", "rollout", "updated"}, []string{"name"})),
+		dbutils.NewStmt(db, d.Bind(deleteQuery)),
+	}
+	return
+}
+
+const tableDef = "CREATE TABLE IF NOT EXISTS feature_flag (" +
+	"name varchar(64) PRIMARY KEY," +
+	"rollout text NOT NULL," +
+	"updated datetime NOT NULL" +
+	");"
+
+const tableDefPostgres = "CREATE TABLE IF NOT EXISTS feature_flag (" +
+	"name VARCHAR(64) PRIMARY KEY," +
+	"rollout TEXT NOT NULL," +
+	"updated TIMESTAMPTZ NOT NULL" +
+	");"
+
+var tableDefMySQL = dbutils.MySQLTable{Name: "feature_flag", Definition: "`name` varchar(64) NOT NULL PRIMARY KEY," +
+	"`rollout` text NOT NULL," +
+	"`updated` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP"}
+
+// the store used by the server, and the rollouts it held at the last refresh
+var (
+	storeMutex sync.RWMutex
+	store      Store
+	stored     map[string]string
+)
+
+// Use makes the rollouts of a store override the configuration, and loads them
+func Use(s Store) error {
+	storeMutex.Lock()
+	store, stored = s, nil
+	storeMutex.Unlock()
+	return Refresh()
+}
+
+// Refresh loads the rollouts of the store, e.g. after a change by another instance of the server;
+// the rollouts loaded before are kept if the store cannot be read
+func Refresh() error {
+	storeMutex.RLock()
+	s := store
+	storeMutex.RUnlock()
+	if s == nil {
+		return nil
+	}
+	rollouts, err := s.List()
+	if err != nil {
+		return err
+	}
+	storeMutex.Lock()
+	stored = rollouts
+	storeMutex.Unlock()
+	return nil
+}
+
+// Run refreshes the rollouts of the store periodically; it never returns
+func Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := Refresh(); err != nil {
+			log.Println("Features: " + err.Error())
+		}
+	}
+}
+
+// Rollouts returns the rollouts applied by the server: the rollouts of the configuration,
+// overridden by the rollouts of the store
+func Rollouts() map[string]string {
+	rollouts := config.FeaturesConfig()
+	if rollouts == nil {
+		rollouts = make(map[string]string)
+	}
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	for name, rollout := range stored {
+		rollouts[name] = rollout
+	}
+	return rollouts
+}
+
+// Set stores the rollout of a feature and applies it at once on this instance of the server,
+// the other instances apply it at their next refresh
+func Set(name string, rollout string) error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	if store == nil {
+		return errors.New("No store of the features")
+	}
+	if err := store.Set(name, rollout); err != nil {
+		return err
+	}
+	if stored == nil {
+		stored = make(map[string]string)
+	}
+	stored[name] = rollout
+	return nil
+}
+
+// Delete removes the rollout of a feature from the store, the configuration applies again
+func Delete(name string) error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	if store == nil {
+		return errors.New("No store of the features")
+	}
+	if err := store.Delete(name); err != nil {
+		return err
+	}
+	delete(stored, name)
+	return nil
+}
+
+// storedRollout returns the rollout of a feature held by the store
+func storedRollout(name string) (string, bool) {
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	rollout, ok := stored[name]
+	return rollout, ok
+}
+
+// CheckRollout checks the percentages of a rollout, between 0 and 100
+func CheckRollout(rollout string) error {
+	for _, target := range strings.Fields(rollout) {
+		if !strings.HasSuffix(target, "%") {
+			continue
+		}
+		if percent, err := strconv.Atoi(strings.TrimSuffix(target, "%")); err != nil || percent < 0 || percent > 100 {
+			return errors.New("Invalid percentage " + target)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package staticapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/frontend/webauth"
+	"github.com/readium/readium-lcp-server/frontend/webuser"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// loginRequest is the body of a login
+type loginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// loginResponse is the session returned by a login
+type loginResponse struct {
+	Token   string       `json:"token"`
+	Expires time.Time    `json:"expires"`
+	User    webuser.User `json:"user"`
+}
+
+// tokenTTL returns the lifetime of the session tokens
+func tokenTTL() time.Duration {
+	if ttl := config.Config.FrontendServer.Auth.TokenTTL; ttl > 0 {
+		return time.Duration(ttl) * time.Second
+	}
+	return webauth.DefaultTokenTTL
+}
+
+// Login checks the email and login password of a user and opens a session:
+// the session token is returned, and set in a cookie for the browsers
+//
+func Login(w http.ResponseWriter, r *http.Request, s IServer) {
+	secret := config.Config.FrontendServer.Auth.Secret
+	if secret == "" {
+		problem.Error(w, r, problem.Problem{Detail: "The authentication is disabled"}, http.StatusNotFound)
+		return
+	}
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: "incorrect JSON login " + err.Error()}, http.StatusBadRequest)
+		return
+	}
+	user, err := s.UserAPI().GetByEmail(req.Email)
+	if err != nil && err != webuser.ErrNotFound {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	// the same answer for an unknown email and a wrong password
+	if err == webuser.ErrNotFound || !webauth.CheckPassword(user.LoginHash, req.Password) {
+		problem.Error(w, r, problem.Problem{Detail: "Invalid email or password"}, http.StatusUnauthorized)
+		return
+	}
+
+	token, claims := webauth.NewToken(user.ID, user.Role, time.Now(), tokenTTL(), secret)
+	expires := time.Unix(claims.Expires, 0).UTC()
+	http.SetCookie(w, &http.Cookie{
+		Name:     webauth.SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(loginResponse{Token: token, Expires: expires, User: user}); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+	}
+}
+
+// Logout clears the session cookie; the session tokens are not revoked, they expire
+//
+func Logout(w http.ResponseWriter, r *http.Request, s IServer) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     webauth.SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetMe returns the user of the session
+//
+func GetMe(w http.ResponseWriter, r *http.Request, s IServer) {
+	claims, ok := webauth.FromRequest(r)
+	if !ok {
+		problem.Error(w, r, problem.Problem{Detail: "The authentication is disabled"}, http.StatusNotFound)
+		return
+	}
+	user, err := s.UserAPI().Get(claims.UserID)
+	if err != nil {
+		if err == webuser.ErrNotFound {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(user); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+	}
+}
+
+// forbidUser answers that the session does not give access to the data of a user, if it is the case
+func forbidUser(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	if webauth.CanAccessUser(r, userID) {
+		return false
+	}
+	problem.Error(w, r, problem.Problem{Detail: "Access to this user is forbidden"}, http.StatusForbidden)
+	return true
+}
@@ -28,8 +28,11 @@ package staticapi
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/clock"
 	"github.com/readium/readium-lcp-server/frontend/webpublication"
 	"github.com/readium/readium-lcp-server/problem"
 )
@@ -86,3 +89,85 @@ func GetDashboardBestSellers(w http.ResponseWriter, r *http.Request, s IServer)
 		}
 	}
 }
+
+// GetDashboardTopLoans gets the titles with the highest number of loans
+// parameters:
+//	limit: optional number of titles, default to 10
+//
+func GetDashboardTopLoans(w http.ResponseWriter, r *http.Request, s IServer) {
+	limit := 10
+	if rLimit := r.FormValue("limit"); rLimit != "" {
+		l, err := strconv.Atoi(rLimit)
+		if err != nil || l < 1 {
+			problem.Error(w, r, problem.Problem{Detail: "limit must be a positive number"}, http.StatusBadRequest)
+			return
+		}
+		limit = l
+	}
+
+	topLoans, err := s.DashboardAPI().GetTopLoans(limit)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(topLoans); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+	}
+}
+
+// GetDashboardActiveLoans gets the number of active loans per day
+// parameters:
+//	from, to: optional time window, RFC 3339 timestamps; defaults to the last 30 days
+//
+func GetDashboardActiveLoans(w http.ResponseWriter, r *http.Request, s IServer) {
+	var err error
+	to := clock.Now().UTC()
+	if rTo := r.FormValue("to"); rTo != "" {
+		if to, err = time.Parse(time.RFC3339, rTo); err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.AddDate(0, 0, -30)
+	if rFrom := r.FormValue("from"); rFrom != "" {
+		if from, err = time.Parse(time.RFC3339, rFrom); err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+			return
+		}
+	}
+	if to.Before(from) {
+		problem.Error(w, r, problem.Problem{Detail: "from must be before to"}, http.StatusBadRequest)
+		return
+	}
+
+	activeLoans, err := s.DashboardAPI().GetActiveLoans(from, to)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(activeLoans); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+	}
+}
+
+// GetDashboardReturnsRate gets the proportion of loans returned before their end
+//
+func GetDashboardReturnsRate(w http.ResponseWriter, r *http.Request, s IServer) {
+	rate, err := s.DashboardAPI().GetReturnsRate()
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(rate); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package staticapi
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/frontend/webauth"
+	"github.com/readium/readium-lcp-server/frontend/webpublication"
+	"github.com/readium/readium-lcp-server/frontend/webpurchase"
+	"github.com/readium/readium-lcp-server/frontend/webuser"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// OPDS 2.0 link relations
+const (
+	opdsRelBorrow  = "http://opds-spec.org/acquisition/borrow"
+	opdsRelAuthDoc = "http://opds-spec.org/auth/document"
+	opdsRelSelf    = "self"
+	opdsRelNext    = "next"
+	opdsRelPrev    = "previous"
+)
+
+// default duration of a loan made from the OPDS feed, in days
+const opdsDefaultLoanDays = 30
+
+// number of purchases read at once when looking for the current loan of a user
+const opdsLoansPerPage = 100
+
+// opdsBorrowLock serializes the loans made from the OPDS feed
+var opdsBorrowLock sync.Mutex
+
+// OpdsFeed is an OPDS 2.0 feed
+type OpdsFeed struct {
+	Metadata     OpdsFeedMetadata  `json:"metadata"`
+	Links        []OpdsLink        `json:"links"`
+	Publications []OpdsPublication `json:"publications"`
+}
+
+// OpdsFeedMetadata is the metadata of an OPDS 2.0 feed
+type OpdsFeedMetadata struct {
+	Title         string `json:"title"`
+	ItemsPerPage  int    `json:"itemsPerPage,omitempty"`
+	CurrentPage   int    `json:"currentPage,omitempty"`
+	NumberOfItems int    `json:"numberOfItems"`
+}
+
+// OpdsPublication is a publication in an OPDS 2.0 feed
+type OpdsPublication struct {
+	Metadata OpdsPublicationMetadata `json:"metadata"`
+	Links    []OpdsLink              `json:"links"`
+}
+
+// OpdsPublicationMetadata is the metadata of a publication in an OPDS 2.0 feed
+type OpdsPublicationMetadata struct {
+	Type       string `json:"@type"`
+	Identifier string `json:"identifier"`
+	Title      string `json:"title"`
+}
+
+// OpdsLink is a link in an OPDS 2.0 feed
+type OpdsLink struct {
+	Rel        string              `json:"rel"`
+	Href       string              `json:"href"`
+	Type       string              `json:"type"`
+	Properties *OpdsLinkProperties `json:"properties,omitempty"`
+}
+
+// OpdsLinkProperties are the properties of a link in an OPDS 2.0 feed: the authentication document
+// of an acquisition link which requires an authentication
+type OpdsLinkProperties struct {
+	Authenticate *OpdsLink `json:"authenticate,omitempty"`
+}
+
+// GetOpdsFeed returns the catalog of publications as an OPDS 2.0 feed;
+// each publication holds an acquisition link to borrow it.
+// parameters:
+//	page, per_page: pagination, as in the publications api
+//
+func GetOpdsFeed(w http.ResponseWriter, r *http.Request, s IServer) {
+	pagination, err := ExtractPaginationFromRequest(r)
+	if err != nil || pagination.PerPage <= 0 {
+		problem.Error(w, r, problem.Problem{Detail: "Invalid pagination parameters"}, http.StatusBadRequest)
+		return
+	}
+
+	baseURL := config.Config.FrontendServer.PublicBaseUrl
+	feedURL := baseURL + "/opds2/publications.json"
+	authLink := opdsAuthLink()
+
+	feed := OpdsFeed{
+		Metadata: OpdsFeedMetadata{
+			Title:        "Readium LCP test catalog",
+			ItemsPerPage: pagination.PerPage,
+			CurrentPage:  pagination.Page + 1,
+		},
+		Links:        make([]OpdsLink, 0),
+		Publications: make([]OpdsPublication, 0),
+	}
+
+	fn := s.PublicationAPI().List(pagination.PerPage, pagination.Page)
+	for pub, err := fn(); err == nil; pub, err = fn() {
+		// only the publications available on the license server can be borrowed
+		if pub.Status != webpublication.StatusOk {
+			continue
+		}
+		feed.Publications = append(feed.Publications, OpdsPublication{
+			Metadata: OpdsPublicationMetadata{
+				Type:       "http://schema.org/Book",
+				Identifier: "urn:uuid:" + pub.UUID,
+				Title:      pub.Title,
+			},
+			Links: []OpdsLink{{
+				Rel:  opdsRelBorrow,
+				Href: baseURL + "/opds2/publications/" + strconv.FormatInt(pub.ID, 10) + "/loan",
+				Type: api.ContentType_LCP_JSON,
+				// the reading apps authenticate the user before following the link
+				Properties: &OpdsLinkProperties{Authenticate: &authLink},
+			}},
+		})
+	}
+	feed.Metadata.NumberOfItems = len(feed.Publications)
+
+	feed.Links = append(feed.Links, OpdsLink{Rel: opdsRelSelf, Href: feedURL + "?page=" + strconv.Itoa(pagination.Page+1), Type: api.ContentType_OPDS_JSON})
+	feed.Links = append(feed.Links, authLink)
+	if pagination.Page > 0 {
+		feed.Links = append(feed.Links, OpdsLink{Rel: opdsRelPrev, Href: feedURL + "?page=" + strconv.Itoa(pagination.Page), Type: api.ContentType_OPDS_JSON})
+	}
+	if hasNextOpdsPage(s, pagination) {
+		feed.Links = append(feed.Links, OpdsLink{Rel: opdsRelNext, Href: feedURL + "?page=" + strconv.Itoa(pagination.Page+2), Type: api.ContentType_OPDS_JSON})
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_OPDS_JSON)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(feed)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+}
+
+// hasNextOpdsPage tells if the catalog holds publications after the current page of the feed
+//
+func hasNextOpdsPage(s IServer, pagination Pagination) bool {
+	hasNext := false
+	// the first publication of the next page, if any
+	fn := s.PublicationAPI().List(1, (pagination.Page+1)*pagination.PerPage)
+	for _, err := fn(); err == nil; _, err = fn() {
+		hasNext = true
+	}
+	return hasNext
+}
+
+// BorrowOpdsPublication is the target of the acquisition links of the OPDS feed.
+// The user authenticates with his email and password (basic authentication, see the authentication document);
+// a loan is created and the corresponding license is returned. As the reading apps and feed readers may follow
+// the link several times, the license of the current loan of the publication is returned if the user has one.
+//
+func BorrowOpdsPublication(w http.ResponseWriter, r *http.Request, s IServer) {
+	user, ok := authenticateOpdsUser(r, s)
+	if !ok {
+		writeOpdsAuthRequired(w)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: "The publication id must be an integer"}, http.StatusBadRequest)
+		return
+	}
+	pub, err := s.PublicationAPI().Get(id)
+	if err != nil {
+		if err == webpublication.ErrNotFound {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// the check of the current loans and the creation of a new one are not interleaved
+	opdsBorrowLock.Lock()
+	defer opdsBorrowLock.Unlock()
+	purchase, found, err := currentOpdsLoan(s, user.ID, pub.ID)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		if purchase, err = addOpdsLoan(s, user, pub); err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		log.Println("user " + strconv.FormatInt(user.ID, 10) + " borrowed publication " + strconv.FormatInt(pub.ID, 10) + " from the OPDS feed until " + purchase.EndDate.String())
+	}
+
+	fullLicense, err := s.PurchaseAPI().GenerateOrGetLicense(purchase)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_LCP_JSON)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+pub.UUID+".lcpl\"")
+	enc := json.NewEncoder(w)
+	// does not escape characters
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(fullLicense)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+}
+
+// currentOpdsLoan returns the loan of a publication by a user which has not ended yet, if any
+//
+func currentOpdsLoan(s IServer, userID int64, publicationID int64) (webpurchase.Purchase, bool, error) {
+	now := clock.Now()
+	for page := 0; ; page++ {
+		fn := s.PurchaseAPI().ListByUser(userID, opdsLoansPerPage, page)
+		count := 0
+		var current webpurchase.Purchase
+		found := false
+		p, err := fn()
+		for ; err == nil; p, err = fn() {
+			count++
+			if found || p.Type != webpurchase.LOAN || p.Publication.ID != publicationID {
+				continue
+			}
+			if p.State != webpurchase.StateCreated && p.State != webpurchase.StateLicensed {
+				continue
+			}
+			if p.EndDate != nil && !p.EndDate.After(now) {
+				continue
+			}
+			current, found = p, true
+		}
+		if err != webpurchase.ErrNotFound {
+			return webpurchase.Purchase{}, false, err
+		}
+		if found || count < opdsLoansPerPage {
+			return current, found, nil
+		}
+	}
+}
+
+// addOpdsLoan creates a loan of a publication by a user, for the loan duration of the frontend
+//
+func addOpdsLoan(s IServer, user webuser.User, pub webpublication.Publication) (webpurchase.Purchase, error) {
+	loanDays := config.Config.FrontendServer.LoanDays
+	if loanDays <= 0 {
+		loanDays = opdsDefaultLoanDays
+	}
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return webpurchase.Purchase{}, err
+	}
+	start := clock.Now().UTC().Truncate(time.Second)
+	end := start.AddDate(0, 0, loanDays)
+	purchase := webpurchase.Purchase{
+		UUID:            uid.String(),
+		Publication:     pub,
+		User:            user,
+		Type:            webpurchase.LOAN,
+		TransactionDate: start,
+		StartDate:       &start,
+		EndDate:         &end,
+	}
+	if err = s.PurchaseAPI().Add(purchase); err != nil {
+		return webpurchase.Purchase{}, err
+	}
+	// get the purchase back, with its id
+	return s.PurchaseAPI().GetByUUID(purchase.UUID)
+}
+
+// authenticateOpdsUser checks the basic authentication credentials of a user:
+// the username is his email, the password is his login password if he has one,
+// else his passphrase, which is stored as its hex encoded sha256 hash.
+//
+func authenticateOpdsUser(r *http.Request, s IServer) (webuser.User, bool) {
+	email, passphrase, ok := r.BasicAuth()
+	if !ok || email == "" {
+		return webuser.User{}, false
+	}
+	user, err := s.UserAPI().GetByEmail(email)
+	if err != nil {
+		return webuser.User{}, false
+	}
+	if user.LoginHash != "" {
+		return user, webauth.CheckPassword(user.LoginHash, passphrase)
+	}
+	hash := sha256.Sum256([]byte(passphrase))
+	given := []byte(hex.EncodeToString(hash[:]))
+	stored := []byte(strings.ToLower(user.Password))
+	if subtle.ConstantTimeCompare(given, stored) != 1 {
+		return webuser.User{}, false
+	}
+	return user, true
+}
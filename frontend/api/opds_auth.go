@@ -0,0 +1,85 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package staticapi
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// OPDS authentication types
+const opdsAuthBasic = "http://opds-spec.org/auth/basic"
+
+// path of the authentication document of the OPDS feed
+const opdsAuthPath = "/opds2/auth.json"
+
+// OpdsAuthDocument is an OPDS Authentication Document: it tells the reading apps
+// how to authenticate the users before following the acquisition links
+type OpdsAuthDocument struct {
+	Id             string               `json:"id"`
+	Title          string               `json:"title"`
+	Description    string               `json:"description,omitempty"`
+	Links          []OpdsLink           `json:"links,omitempty"`
+	Authentication []OpdsAuthentication `json:"authentication"`
+}
+
+// OpdsAuthentication is an authentication flow of an OPDS Authentication Document
+type OpdsAuthentication struct {
+	Type   string          `json:"type"`
+	Labels *OpdsAuthLabels `json:"labels,omitempty"`
+}
+
+// OpdsAuthLabels are the labels of the fields of a basic authentication, shown by the reading apps
+type OpdsAuthLabels struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+// opdsAuthLink returns the link to the authentication document of the OPDS feed
+func opdsAuthLink() OpdsLink {
+	return OpdsLink{Rel: opdsRelAuthDoc, Href: config.Config.FrontendServer.PublicBaseUrl + opdsAuthPath, Type: api.ContentType_OPDS_AUTH_JSON}
+}
+
+// opdsAuthDocument returns the authentication document of the OPDS feed: a basic authentication
+// with the email and the password of the user (his passphrase if he has no login password)
+func opdsAuthDocument() OpdsAuthDocument {
+	baseURL := config.Config.FrontendServer.PublicBaseUrl
+	return OpdsAuthDocument{
+		Id:          baseURL + opdsAuthPath,
+		Title:       "Readium LCP test catalog",
+		Description: "Sign in with the email and the password of your account to borrow the publications",
+		Links: []OpdsLink{
+			{Rel: "start", Href: baseURL + "/opds2/publications.json", Type: api.ContentType_OPDS_JSON},
+		},
+		Authentication: []OpdsAuthentication{
+			{Type: opdsAuthBasic, Labels: &OpdsAuthLabels{Login: "Email", Password: "Password"}},
+		},
+	}
+}
+
+// GetOpdsAuthDocument returns the authentication document of the OPDS feed
+//
+func GetOpdsAuthDocument(w http.ResponseWriter, r *http.Request, s IServer) {
+	writeOpdsAuthDocument(w, http.StatusOK)
+}
+
+// writeOpdsAuthRequired answers a request which requires an authentication: as required by the OPDS
+// authentication, the response is a 401 carrying the authentication document
+func writeOpdsAuthRequired(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Readium LCP test catalog"`)
+	writeOpdsAuthDocument(w, http.StatusUnauthorized)
+}
+
+// writeOpdsAuthDocument writes the authentication document of the OPDS feed with a status code
+func writeOpdsAuthDocument(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", api.ContentType_OPDS_AUTH_JSON)
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(opdsAuthDocument())
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package staticapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestOpdsAuthDocument(t *testing.T) {
+	s, previous := newOpdsServer()
+	defer func() { config.Config.FrontendServer = previous }()
+
+	document := func(w *httptest.ResponseRecorder) OpdsAuthDocument {
+		if ct := w.Header().Get("Content-Type"); ct != api.ContentType_OPDS_AUTH_JSON {
+			t.Errorf("Expected an authentication document, got %s", ct)
+		}
+		var doc OpdsAuthDocument
+		if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+			t.Fatal(err)
+		}
+		return doc
+	}
+
+	w := httptest.NewRecorder()
+	GetOpdsAuthDocument(w, httptest.NewRequest("GET", opdsAuthPath, nil), s)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	doc := document(w)
+	if doc.Id != "http://frontend.example.com/opds2/auth.json" {
+		t.Errorf("Unexpected document id %s", doc.Id)
+	}
+	if len(doc.Authentication) != 1 || doc.Authentication[0].Type != opdsAuthBasic || doc.Authentication[0].Labels == nil {
+		t.Errorf("Expected a basic authentication with labels, got %+v", doc.Authentication)
+	}
+	if len(doc.Links) != 1 || doc.Links[0].Rel != "start" || doc.Links[0].Href != "http://frontend.example.com/opds2/publications.json" {
+		t.Errorf("Expected a link to the feed, got %+v", doc.Links)
+	}
+
+	// a loan without credentials is answered with the document
+	r := mux.SetURLVars(httptest.NewRequest("GET", "/opds2/publications/1/loan", nil), map[string]string{"id": "1"})
+	w = httptest.NewRecorder()
+	BorrowOpdsPublication(w, r, s)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Basic realm="Readium LCP test catalog"` {
+		t.Fatalf("Expected a basic authentication challenge, got %d %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	if challenge := document(w); challenge.Id != doc.Id {
+		t.Errorf("Expected the authentication document, got %+v", challenge)
+	}
+
+	// the feed and its acquisition links point to the document
+	w = httptest.NewRecorder()
+	GetOpdsFeed(w, httptest.NewRequest("GET", "/opds2/publications.json", nil), s)
+	var feed OpdsFeed
+	if err := json.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, l := range feed.Links {
+		if l.Rel == opdsRelAuthDoc && l.Href == doc.Id && l.Type == api.ContentType_OPDS_AUTH_JSON {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected a link to the authentication document in %+v", feed.Links)
+	}
+	for _, p := range feed.Publications {
+		props := p.Links[0].Properties
+		if props == nil || props.Authenticate == nil || props.Authenticate.Href != doc.Id {
+			t.Errorf("Expected the acquisition link of %s to require the authentication", p.Metadata.Identifier)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package staticapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/frontend/webdashboard"
+	"github.com/readium/readium-lcp-server/frontend/weblicense"
+	"github.com/readium/readium-lcp-server/frontend/webpublication"
+	"github.com/readium/readium-lcp-server/frontend/webpurchase"
+	"github.com/readium/readium-lcp-server/frontend/webrepository"
+	"github.com/readium/readium-lcp-server/frontend/webuser"
+	"github.com/readium/readium-lcp-server/license"
+)
+
+// fakePublications is a catalog of publications held in memory
+type fakePublications struct {
+	webpublication.WebPublication
+	pubs []webpublication.Publication
+}
+
+func (f *fakePublications) Get(id int64) (webpublication.Publication, error) {
+	for _, p := range f.pubs {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return webpublication.Publication{}, webpublication.ErrNotFound
+}
+
+func (f *fakePublications) List(page int, pageNum int) func() (webpublication.Publication, error) {
+	i := page * pageNum
+	end := i + page
+	return func() (webpublication.Publication, error) {
+		if i >= end || i >= len(f.pubs) {
+			return webpublication.Publication{}, webpublication.ErrNotFound
+		}
+		i++
+		return f.pubs[i-1], nil
+	}
+}
+
+// fakeUsers are the users of the frontend, held in memory
+type fakeUsers struct {
+	webuser.WebUser
+	users []webuser.User
+}
+
+func (f *fakeUsers) GetByEmail(email string) (webuser.User, error) {
+	for _, u := range f.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return webuser.User{}, webuser.ErrNotFound
+}
+
+// fakePurchases are the purchases of the frontend, held in memory
+type fakePurchases struct {
+	webpurchase.WebPurchase
+	purchases []webpurchase.Purchase
+}
+
+func (f *fakePurchases) Add(p webpurchase.Purchase) error {
+	p.ID = int64(len(f.purchases) + 1)
+	p.State = webpurchase.StateCreated
+	f.purchases = append(f.purchases, p)
+	return nil
+}
+
+func (f *fakePurchases) GetByUUID(uuid string) (webpurchase.Purchase, error) {
+	for _, p := range f.purchases {
+		if p.UUID == uuid {
+			return p, nil
+		}
+	}
+	return webpurchase.Purchase{}, webpurchase.ErrNotFound
+}
+
+func (f *fakePurchases) ListByUser(userID int64, page int, pageNum int) func() (webpurchase.Purchase, error) {
+	var list []webpurchase.Purchase
+	for _, p := range f.purchases {
+		if p.User.ID == userID {
+			list = append(list, p)
+		}
+	}
+	i := page * pageNum
+	end := i + page
+	return func() (webpurchase.Purchase, error) {
+		if i >= end || i >= len(list) {
+			return webpurchase.Purchase{}, webpurchase.ErrNotFound
+		}
+		i++
+		return list[i-1], nil
+	}
+}
+
+func (f *fakePurchases) GenerateOrGetLicense(p webpurchase.Purchase) (license.License, error) {
+	return license.License{Id: "license-" + strconv.FormatInt(p.ID, 10)}, nil
+}
+
+// fakeServer gives the handlers access to the fake stores
+type fakeServer struct {
+	pubs      *fakePublications
+	users     *fakeUsers
+	purchases *fakePurchases
+}
+
+func (s fakeServer) RepositoryAPI() webrepository.WebRepository    { return nil }
+func (s fakeServer) PublicationAPI() webpublication.WebPublication { return s.pubs }
+func (s fakeServer) UserAPI() webuser.WebUser                      { return s.users }
+func (s fakeServer) PurchaseAPI() webpurchase.WebPurchase          { return s.purchases }
+func (s fakeServer) DashboardAPI() webdashboard.WebDashboard       { return nil }
+func (s fakeServer) LicenseAPI() weblicense.WebLicense             { return nil }
+
+// newOpdsServer returns a server holding three publications and a user, and the configuration to restore
+func newOpdsServer() (fakeServer, config.FrontendServerInfo) {
+	previous := config.Config.FrontendServer
+	config.Config.FrontendServer.PublicBaseUrl = "http://frontend.example.com"
+	config.Config.FrontendServer.LoanDays = 0
+
+	hash := sha256.Sum256([]byte("secret"))
+	return fakeServer{
+		pubs: &fakePublications{pubs: []webpublication.Publication{
+			{ID: 1, UUID: "p1", Title: "C", Status: webpublication.StatusOk},
+			{ID: 2, UUID: "p2", Title: "B", Status: webpublication.StatusOk},
+			{ID: 3, UUID: "p3", Title: "A", Status: webpublication.StatusOk},
+		}},
+		users: &fakeUsers{users: []webuser.User{
+			{ID: 7, Email: "reader@example.com", Password: hex.EncodeToString(hash[:])},
+		}},
+		purchases: &fakePurchases{},
+	}, previous
+}
+
+func TestOpdsFeedPages(t *testing.T) {
+	s, previous := newOpdsServer()
+	defer func() { config.Config.FrontendServer = previous }()
+
+	feedOf := func(query string) OpdsFeed {
+		w := httptest.NewRecorder()
+		GetOpdsFeed(w, httptest.NewRequest("GET", "/opds2/publications.json?"+query, nil), s)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var feed OpdsFeed
+		if err := json.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+			t.Fatal(err)
+		}
+		return feed
+	}
+	rels := func(feed OpdsFeed) map[string]string {
+		m := make(map[string]string)
+		for _, l := range feed.Links {
+			m[l.Rel] = l.Href
+		}
+		return m
+	}
+
+	// a first page followed by another one
+	feed := feedOf("page=1&per_page=2")
+	if len(feed.Publications) != 2 {
+		t.Fatalf("Expected 2 publications, got %d", len(feed.Publications))
+	}
+	links := rels(feed)
+	if links[opdsRelNext] != "http://frontend.example.com/opds2/publications.json?page=2" {
+		t.Errorf("Expected a link to the second page, got %q", links[opdsRelNext])
+	}
+	if _, ok := links[opdsRelPrev]; ok {
+		t.Error("Expected no previous link on the first page")
+	}
+	if href := feed.Publications[0].Links[0].Href; href != "http://frontend.example.com/opds2/publications/1/loan" {
+		t.Errorf("Unexpected borrow link %s", href)
+	}
+
+	// the last page has no next link
+	feed = feedOf("page=2&per_page=2")
+	links = rels(feed)
+	if len(feed.Publications) != 1 {
+		t.Fatalf("Expected 1 publication, got %d", len(feed.Publications))
+	}
+	if _, ok := links[opdsRelNext]; ok {
+		t.Error("Expected no next link on the last page")
+	}
+	if links[opdsRelPrev] != "http://frontend.example.com/opds2/publications.json?page=1" {
+		t.Errorf("Expected a link to the first page, got %q", links[opdsRelPrev])
+	}
+
+	// a last page which is full
+	if _, ok := rels(feedOf("page=1&per_page=3"))[opdsRelNext]; ok {
+		t.Error("Expected no next link when the catalog fits on the page")
+	}
+}
+
+func TestBorrowOpdsPublication(t *testing.T) {
+	s, previous := newOpdsServer()
+	defer func() { config.Config.FrontendServer = previous }()
+
+	borrow := func(id string, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/opds2/publications/"+id+"/loan", nil)
+		if password != "" {
+			r.SetBasicAuth("reader@example.com", password)
+		}
+		r = mux.SetURLVars(r, map[string]string{"id": id})
+		w := httptest.NewRecorder()
+		BorrowOpdsPublication(w, r, s)
+		return w
+	}
+
+	if w := borrow("1", ""); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected an authentication to be required, got %d", w.Code)
+	}
+	if w := borrow("1", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected wrong credentials to be refused, got %d", w.Code)
+	}
+	if w := borrow("9", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown publication, got %d", w.Code)
+	}
+
+	// a loan is created, then its license is returned again
+	for i := 0; i < 2; i++ {
+		w := borrow("1", "secret")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var l license.License
+		if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+			t.Fatal(err)
+		}
+		if l.Id != "license-1" {
+			t.Errorf("Expected the license of the first loan, got %s", l.Id)
+		}
+	}
+	if n := len(s.purchases.purchases); n != 1 {
+		t.Fatalf("Expected a single loan, got %d", n)
+	}
+	p := s.purchases.purchases[0]
+	if p.Type != webpurchase.LOAN || p.User.ID != 7 || p.EndDate.Sub(*p.StartDate) != opdsDefaultLoanDays*24*time.Hour {
+		t.Errorf("Unexpected loan %+v", p)
+	}
+
+	// another publication, or the same one after the loan was returned, is a new loan
+	if w := borrow("2", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	s.purchases.purchases[0].State = webpurchase.StateReturned
+	if w := borrow("1", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	if n := len(s.purchases.purchases); n != 3 {
+		t.Errorf("Expected 3 loans, got %d", n)
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package staticapi
+
+import (
+	"github.com/readium/readium-lcp-server/frontend/webauth"
+	"github.com/readium/readium-lcp-server/frontend/weblicense"
+	"github.com/readium/readium-lcp-server/frontend/webpublication"
+	"github.com/readium/readium-lcp-server/frontend/webpurchase"
+	"github.com/readium/readium-lcp-server/frontend/webuser"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// the types of the problems reporting the errors of the frontend server
+func init() {
+	problem.RegisterType(webauth.ErrInvalidToken, problem.INVALID_SESSION)
+	problem.RegisterType(webauth.ErrExpiredToken, problem.EXPIRED_SESSION)
+	problem.RegisterType(weblicense.ErrNotFound, problem.LICENSE_NOT_FOUND)
+	problem.RegisterType(webpublication.ErrNotFound, problem.PUBLICATION_NOT_FOUND)
+	problem.RegisterType(webpublication.ErrMetadataNotFound, problem.PUBLICATION_NOT_FOUND)
+	problem.RegisterType(webpublication.ErrUnsupportedFile, problem.UNSUPPORTED_UPLOAD)
+	problem.RegisterType(webpurchase.ErrNotFound, problem.PURCHASE_NOT_FOUND)
+	problem.RegisterType(webpurchase.ErrInvalidTransition, problem.INVALID_PURCHASE_STATE)
+	problem.RegisterType(webpurchase.ErrNotALoan, problem.RENEWAL_REFUSED)
+	problem.RegisterType(webpurchase.ErrMaxRenewals, problem.RENEWAL_REFUSED)
+	problem.RegisterType(webpurchase.ErrRenewalWindow, problem.RENEWAL_REFUSED)
+	problem.RegisterType(webuser.ErrNotFound, problem.USER_NOT_FOUND)
+}
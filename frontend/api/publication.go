@@ -114,6 +114,45 @@ func GetPublication(w http.ResponseWriter, r *http.Request, s IServer) {
 	}
 }
 
+// GetPublicationMetadata returns the metadata of a publication, as ingested by the license server
+//
+func GetPublicationMetadata(w http.ResponseWriter, r *http.Request, s IServer) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		// id is not a number
+		problem.Error(w, r, problem.Problem{Detail: "The publication id must be an integer"}, http.StatusBadRequest)
+		return
+	}
+
+	pub, err := s.PublicationAPI().Get(int64(id))
+	if err != nil {
+		if err == webpublication.ErrNotFound {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	metadata, err := s.PublicationAPI().GetMetadata(pub)
+	if err != nil {
+		if err == webpublication.ErrMetadataNotFound {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadGateway)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(metadata)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+	}
+}
+
 // CheckPublicationByTitle check if a publication with this title exist
 func CheckPublicationByTitle(w http.ResponseWriter, r *http.Request, s IServer) {
 	var title string
@@ -8,8 +8,12 @@ package staticapi
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"path"
 	"strconv"
 
 	"github.com/gorilla/mux"
@@ -34,33 +38,32 @@ func DecodeJSONPurchase(r *http.Request) (webpurchase.Purchase, error) {
 }
 
 // GetPurchases searches all purchases for a client
+// parameters: page, per_page, sort (id, transactionDate, startDate, endDate, status or state,
+// prefixed by "-" for a descending order; default -transactionDate) and fields
 //
 func GetPurchases(w http.ResponseWriter, r *http.Request, s IServer) {
-	var err error
-
-	pagination, err := ExtractPaginationFromRequest(r)
+	params, err := api.ParseListParams(r, api.DefaultPerPage)
+	if err == nil && params.After != "" {
+		err = errors.New("The purchases are listed by page")
+	}
 	if err != nil {
-		// user id is not a number
-		problem.Error(w, r, problem.Problem{Detail: "Pagination error"}, http.StatusBadRequest)
+		problem.Error(w, r, problem.Problem{Detail: "Pagination error: " + err.Error()}, http.StatusBadRequest)
 		return
 	}
 
 	purchases := make([]webpurchase.Purchase, 0)
-	fn := s.PurchaseAPI().List(pagination.PerPage, pagination.Page)
+	fn := s.PurchaseAPI().ListSorted(params.Listing())
 
-	for it, err := fn(); err == nil; it, err = fn() {
+	it, err := fn()
+	for ; err == nil; it, err = fn() {
 		purchases = append(purchases, it)
 	}
-
-	PrepareListHeaderResponse(len(purchases), "/api/v1/purchases", pagination, w)
-	w.Header().Set("Content-Type", api.ContentType_JSON)
-
-	enc := json.NewEncoder(w)
-	err = enc.Encode(purchases)
-	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+	if err != webpurchase.ErrNotFound {
+		api.StoreError(w, r, err)
 		return
 	}
+
+	api.WriteList(w, r, purchases, params.PageLinks(r, len(purchases)), params.Fields)
 }
 
 // GetUserPurchases searches all purchases for a client
@@ -75,6 +78,9 @@ func GetUserPurchases(w http.ResponseWriter, r *http.Request, s IServer) {
 		problem.Error(w, r, problem.Problem{Detail: "User ID must be an integer"}, http.StatusBadRequest)
 		return
 	}
+	if forbidUser(w, r, userId) {
+		return
+	}
 
 	pagination, err := ExtractPaginationFromRequest(r)
 	if err != nil {
@@ -109,6 +115,10 @@ func CreatePurchase(w http.ResponseWriter, r *http.Request, s IServer) {
 		problem.Error(w, r, problem.Problem{Detail: "incorrect JSON Purchase " + err.Error()}, http.StatusBadRequest)
 		return
 	}
+	// a patron only buys or borrows for himself
+	if forbidUser(w, r, purchase.User.ID) {
+		return
+	}
 
 	// purchase ok
 	if err = s.PurchaseAPI().Add(purchase); err != nil {
@@ -146,6 +156,9 @@ func GetPurchasedLicense(w http.ResponseWriter, r *http.Request, s IServer) {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
 		return
 	}
+	if forbidUser(w, r, purchase.User.ID) {
+		return
+	}
 
 	fullLicense, err := s.PurchaseAPI().GenerateOrGetLicense(purchase)
 	if err != nil {
@@ -171,6 +184,59 @@ func GetPurchasedLicense(w http.ResponseWriter, r *http.Request, s IServer) {
 
 }
 
+// GetPurchasedPublication returns the publication of a purchase with its license embedded,
+// a single file for the reading apps which do not fetch the publication from the license.
+// The license is generated first if the purchase has none.
+//
+func GetPurchasedPublication(w http.ResponseWriter, r *http.Request, s IServer) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		// id is not an integer (int64)
+		problem.Error(w, r, problem.Problem{Detail: "Purchase ID must be an integer"}, http.StatusBadRequest)
+		return
+	}
+
+	purchase, err := s.PurchaseAPI().Get(id)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		return
+	}
+	if forbidUser(w, r, purchase.User.ID) {
+		return
+	}
+	if purchase.LicenseUUID == nil {
+		fullLicense, err := s.PurchaseAPI().GenerateOrGetLicense(purchase)
+		if err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		purchase.LicenseUUID = &fullLicense.Id
+	}
+
+	resp, err := s.PurchaseAPI().GetLicensedPublication(purchase)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	// the file keeps the extension given by the License Server
+	extension := ".epub"
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && path.Ext(params["filename"]) != "" {
+		extension = path.Ext(params["filename"])
+	}
+	attachmentName := slugify.Slugify(purchase.Publication.Title)
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+attachmentName+extension+"\"")
+	w.WriteHeader(http.StatusOK)
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		log.Println("Error returning the publication of purchase", id, ":", err)
+		return
+	}
+	log.Println("Return publication / id " + vars["id"] + " / " + purchase.Publication.Title + " / license " + *purchase.LicenseUUID)
+}
+
 // GetPurchase gets a purchase by its id in the database
 //
 func GetPurchase(w http.ResponseWriter, r *http.Request, s IServer) {
@@ -193,6 +259,9 @@ func GetPurchase(w http.ResponseWriter, r *http.Request, s IServer) {
 		}
 		return
 	}
+	if forbidUser(w, r, purchase.User.ID) {
+		return
+	}
 
 	w.Header().Set("Content-Type", api.ContentType_JSON)
 	// json encode the purchase info into the output stream
@@ -274,6 +343,8 @@ func UpdatePurchase(w http.ResponseWriter, r *http.Request, s IServer) {
 		switch err {
 		case webpurchase.ErrNotFound:
 			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		case webpurchase.ErrInvalidTransition:
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusConflict)
 		default:
 			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		}
@@ -282,3 +353,117 @@ func UpdatePurchase(w http.ResponseWriter, r *http.Request, s IServer) {
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// getPurchaseFromRequest gets the purchase of the id of the url, or writes the error
+func getPurchaseFromRequest(w http.ResponseWriter, r *http.Request, s IServer) (webpurchase.Purchase, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: "Purchase ID must be an integer"}, http.StatusBadRequest)
+		return webpurchase.Purchase{}, false
+	}
+	purchase, err := s.PurchaseAPI().Get(id)
+	if err != nil {
+		switch err {
+		case webpurchase.ErrNotFound:
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		default:
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return webpurchase.Purchase{}, false
+	}
+	return purchase, true
+}
+
+// GetPurchaseEvents lists the transitions of a purchase, in chronological order
+//
+func GetPurchaseEvents(w http.ResponseWriter, r *http.Request, s IServer) {
+	purchase, ok := getPurchaseFromRequest(w, r, s)
+	if !ok {
+		return
+	}
+	if forbidUser(w, r, purchase.User.ID) {
+		return
+	}
+	events, err := s.PurchaseAPI().ListEvents(purchase.ID)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(events); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+	}
+}
+
+// stateChange is the body of a change of the state of a purchase
+type stateChange struct {
+	State  string `json:"state"`
+	Detail string `json:"detail"`
+}
+
+// ChangePurchaseState moves a purchase to a final state: returned, expired or revoked.
+// The license is returned or revoked on the License Status Server.
+//
+func ChangePurchaseState(w http.ResponseWriter, r *http.Request, s IServer) {
+	purchase, ok := getPurchaseFromRequest(w, r, s)
+	if !ok {
+		return
+	}
+	var change stateChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: "incorrect JSON state " + err.Error()}, http.StatusBadRequest)
+		return
+	}
+	if err := s.PurchaseAPI().ChangeState(purchase, change.State, change.Detail); err != nil {
+		if err == webpurchase.ErrInvalidTransition {
+			problem.Error(w, r, problem.Problem{Detail: "The purchase cannot go from " + purchase.State + " to " + change.State}, http.StatusConflict)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+	log.Println("purchase " + strconv.FormatInt(purchase.ID, 10) + " " + change.State)
+
+	// the purchase is returned with its new state
+	if purchase, ok = getPurchaseFromRequest(w, r, s); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	json.NewEncoder(w).Encode(purchase)
+}
+
+// RenewPurchase extends a loan on the request of its patron, according to the renewal policy of the frontend,
+// and returns the refreshed license, so that the reading apps can offer a "renew" button.
+//
+func RenewPurchase(w http.ResponseWriter, r *http.Request, s IServer) {
+	purchase, ok := getPurchaseFromRequest(w, r, s)
+	if !ok {
+		return
+	}
+	if forbidUser(w, r, purchase.User.ID) {
+		return
+	}
+	fullLicense, err := s.PurchaseAPI().Renew(purchase)
+	if err != nil {
+		switch err {
+		case webpurchase.ErrNotALoan, webpurchase.ErrMaxRenewals, webpurchase.ErrRenewalWindow:
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusForbidden)
+		case webpurchase.ErrInvalidTransition:
+			problem.Error(w, r, problem.Problem{Detail: "The purchase cannot be renewed in the state " + purchase.State}, http.StatusConflict)
+		default:
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+	log.Println("purchase " + strconv.FormatInt(purchase.ID, 10) + " renewed by its user")
+
+	attachmentName := slugify.Slugify(purchase.Publication.Title)
+	w.Header().Set("Content-Type", api.ContentType_LCP_JSON)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+attachmentName+".lcpl\"")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err = enc.Encode(fullLicense); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+	}
+}
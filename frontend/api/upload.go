@@ -0,0 +1,153 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package staticapi
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/frontend/webpublication"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// maxUploadMemory is the part of a multipart upload kept in memory, the rest is stored in temp files
+const maxUploadMemory = 32 << 20
+
+// uploadURL is a publication to download and encrypt
+type uploadURL struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// UploadPublications queues the encryption of a set of publications and returns the upload jobs.
+// The publications are either the "file" parts of a multipart form (with optional "title" parts, in the same order),
+// or given by their URL in a JSON array: [{"title": ..., "url": ...}].
+// The jobs are polled until they are done or failed.
+//
+func UploadPublications(w http.ResponseWriter, r *http.Request, s IServer) {
+	jobs := make([]webpublication.UploadJob, 0)
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+			problem.Error(w, r, problem.Problem{Detail: "incorrect multipart upload " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+		files := r.MultipartForm.File["file"]
+		if len(files) == 0 {
+			problem.Error(w, r, problem.Problem{Detail: "No file to upload"}, http.StatusBadRequest)
+			return
+		}
+		titles := r.MultipartForm.Value["title"]
+		for i, header := range files {
+			var title string
+			if i < len(titles) {
+				title = titles[i]
+			}
+			file, err := header.Open()
+			if err != nil {
+				problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+				return
+			}
+			inputPath, err := webpublication.SaveUpload(file, header.Filename)
+			file.Close()
+			if err != nil {
+				problem.Error(w, r, problem.Problem{Detail: header.Filename + ": " + err.Error()}, http.StatusBadRequest)
+				return
+			}
+			job, err := s.PublicationAPI().EnqueueFile(title, header.Filename, inputPath)
+			if err != nil {
+				os.Remove(inputPath)
+				problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+				return
+			}
+			jobs = append(jobs, job)
+		}
+	} else {
+		var urls []uploadURL
+		if err := json.NewDecoder(r.Body).Decode(&urls); err != nil {
+			problem.Error(w, r, problem.Problem{Detail: "incorrect JSON upload " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if len(urls) == 0 {
+			problem.Error(w, r, problem.Problem{Detail: "No publication to upload"}, http.StatusBadRequest)
+			return
+		}
+		for _, u := range urls {
+			job, err := s.PublicationAPI().EnqueueURL(u.Title, u.URL)
+			if err != nil {
+				problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+				return
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	log.Println(strconv.Itoa(len(jobs)) + " publications queued for encryption")
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// GetUploadJobs lists the upload jobs, the most recent first
+//
+func GetUploadJobs(w http.ResponseWriter, r *http.Request, s IServer) {
+	page, perPage := 0, 30
+	var err error
+	if v := r.FormValue("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			problem.Error(w, r, problem.Problem{Detail: "page must be a positive integer"}, http.StatusBadRequest)
+			return
+		}
+		page-- // pagenum starting at 0 in code, but user interface starting at 1
+	}
+	if v := r.FormValue("per_page"); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage < 1 {
+			problem.Error(w, r, problem.Problem{Detail: "per_page must be a positive integer"}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	jobs := make([]webpublication.UploadJob, 0)
+	fn := s.PublicationAPI().ListUploadJobs(perPage, page)
+	var job webpublication.UploadJob
+	for job, err = fn(); err == nil; job, err = fn() {
+		jobs = append(jobs, job)
+	}
+	if err != webpublication.ErrJobNotFound {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// GetUploadJob returns an upload job, with its status
+//
+func GetUploadJob(w http.ResponseWriter, r *http.Request, s IServer) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: "The job id must be an integer"}, http.StatusBadRequest)
+		return
+	}
+	job, err := s.PublicationAPI().GetUploadJob(id)
+	if err != nil {
+		switch err {
+		case webpublication.ErrJobNotFound:
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		default:
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	json.NewEncoder(w).Encode(job)
+}
@@ -27,13 +27,20 @@ package staticapi
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/frontend/webauth"
 	"github.com/readium/readium-lcp-server/frontend/webuser"
 	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/servicetoken"
 )
 
 //GetUsers returns a list of users
@@ -97,6 +104,10 @@ func GetUser(w http.ResponseWriter, r *http.Request, s IServer) {
 	if err != nil {
 		// id is not a number
 		problem.Error(w, r, problem.Problem{Detail: "User ID must be an integer"}, http.StatusBadRequest)
+		return
+	}
+	if forbidUser(w, r, int64(id)) {
+		return
 	}
 	if user, err := s.UserAPI().Get(int64(id)); err == nil {
 		enc := json.NewEncoder(w)
@@ -141,6 +152,15 @@ func CreateUser(w http.ResponseWriter, r *http.Request, s IServer) {
 		problem.Error(w, r, problem.Problem{Detail: "incorrect JSON User " + err.Error()}, http.StatusBadRequest)
 		return
 	}
+	if user.Role != "" && !webauth.ValidRole(user.Role) {
+		problem.Error(w, r, problem.Problem{Detail: "unknown role " + user.Role}, http.StatusBadRequest)
+		return
+	}
+	// only an administrator creates staff accounts
+	if user.Role != "" && user.Role != webauth.RolePatron && !webauth.IsAdmin(r) {
+		problem.Error(w, r, problem.Problem{Detail: "Only an administrator can set the role of a user"}, http.StatusForbidden)
+		return
+	}
 	//user ok
 	if err := s.UserAPI().Add(user); err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
@@ -161,13 +181,20 @@ func UpdateUser(w http.ResponseWriter, r *http.Request, s IServer) {
 		problem.Error(w, r, problem.Problem{Detail: "User ID must be an integer"}, http.StatusBadRequest)
 		return
 	}
+	if forbidUser(w, r, int64(id)) {
+		return
+	}
 	//ID is a number, check user (json)
 	if user, err = DecodeJSONUser(r); err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
+	if user.Role != "" && !webauth.ValidRole(user.Role) {
+		problem.Error(w, r, problem.Problem{Detail: "unknown role " + user.Role}, http.StatusBadRequest)
+		return
+	}
 	// user ok, id is a number, search user to update
-	if _, err := s.UserAPI().Get(int64(id)); err != nil {
+	if current, err := s.UserAPI().Get(int64(id)); err != nil {
 		switch err {
 		case webuser.ErrNotFound:
 			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
@@ -176,11 +203,30 @@ func UpdateUser(w http.ResponseWriter, r *http.Request, s IServer) {
 		}
 	} else {
 		// client is found!
+		// only an administrator changes a role; a user changes his own login password
+		if user.Role != "" && user.Role != current.Role && !webauth.IsAdmin(r) {
+			problem.Error(w, r, problem.Problem{Detail: "Only an administrator can set the role of a user"}, http.StatusForbidden)
+			return
+		}
+		if claims, ok := webauth.FromRequest(r); ok && user.LoginPassword != "" && claims.UserID != current.ID && claims.Role != webauth.RoleAdmin {
+			problem.Error(w, r, problem.Problem{Detail: "Only an administrator can set the login password of another user"}, http.StatusForbidden)
+			return
+		}
 		if err := s.UserAPI().Update(webuser.User{ID: int64(id), Name: user.Name, Email: user.Email, Password: user.Password, Hint: user.Hint}); err != nil {
 			//update failed!
 			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 			return
 		}
+		if user.Role != "" || user.LoginPassword != "" {
+			role := current.Role
+			if user.Role != "" {
+				role = user.Role
+			}
+			if err := s.UserAPI().SetLogin(int64(id), role, user.LoginPassword); err != nil {
+				problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+				return
+			}
+		}
 		//database update ok
 		w.WriteHeader(http.StatusOK)
 		//return
@@ -203,3 +249,71 @@ func DeleteUser(w http.ResponseWriter, r *http.Request, s IServer) {
 	// user added to db
 	w.WriteHeader(http.StatusOK)
 }
+
+// erasureResult is the response of the License Server to an erasure
+type erasureResult struct {
+	Pseudonym string `json:"pseudonym"`
+	Licenses  int    `json:"licenses"`
+}
+
+//EraseUser erases the personal data of a user: the License Server replaces the user id of its licenses
+//by a pseudonym, then the user is anonymized; the purchases are kept for the statistics
+func EraseUser(w http.ResponseWriter, r *http.Request, s IServer) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: "User ID must be an integer"}, http.StatusBadRequest)
+		return
+	}
+	user, err := s.UserAPI().Get(id)
+	if err != nil {
+		switch err {
+		case webuser.ErrNotFound:
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		default:
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	result, err := eraseLicenseUser(user.UUID)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadGateway)
+		return
+	}
+	if err = s.UserAPI().Anonymize(id, result.Pseudonym); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	log.Println("User " + vars["id"] + " erased, " + strconv.Itoa(result.Licenses) + " licenses pseudonymized")
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	json.NewEncoder(w).Encode(result)
+}
+
+// eraseLicenseUser asks the License Server to erase a user from its licenses
+func eraseLicenseUser(userUUID string) (erasureResult, error) {
+	var result erasureResult
+	lcpURL := config.Config.LcpServer.PublicBaseUrl + "/users/" + url.PathEscape(userUUID) + "/erasure"
+	req, err := http.NewRequest("POST", lcpURL, nil)
+	if err != nil {
+		return result, err
+	}
+	if err = servicetoken.Authorize(req, config.LcpServerName, config.Config.LcpUpdateAuth); err != nil {
+		return result, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return result, errors.New("The License Server returned " + resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err == nil && result.Pseudonym == "" {
+		err = errors.New("The License Server returned no pseudonym")
+	}
+	return result, err
+}
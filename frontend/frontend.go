@@ -26,7 +26,8 @@
 package main
 
 import (
-	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -41,14 +42,22 @@ import (
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/clock"
 	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
+	"github.com/readium/readium-lcp-server/errorreport"
 	"github.com/readium/readium-lcp-server/frontend/server"
+	"github.com/readium/readium-lcp-server/frontend/webauth"
 	"github.com/readium/readium-lcp-server/frontend/webdashboard"
 	"github.com/readium/readium-lcp-server/frontend/weblicense"
 	"github.com/readium/readium-lcp-server/frontend/webpublication"
 	"github.com/readium/readium-lcp-server/frontend/webpurchase"
 	"github.com/readium/readium-lcp-server/frontend/webrepository"
 	"github.com/readium/readium-lcp-server/frontend/webuser"
+	"github.com/readium/readium-lcp-server/servicetoken"
+	"github.com/readium/readium-lcp-server/shared"
+	"github.com/readium/readium-lcp-server/staging"
 )
 
 func dbFromURI(uri string) (string, string) {
@@ -60,11 +69,31 @@ func main() {
 	var dbURI, static, configFile string
 	var err error
 
+	config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
 	if configFile = os.Getenv("READIUM_FRONTEND_CONFIG"); configFile == "" {
 		configFile = "config.yaml"
 	}
 	config.ReadConfig(configFile)
 	log.Println("Read config from " + configFile)
+	if err = config.ApplyFlags(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	if err = config.Validate(config.FrontendServerName); err != nil {
+		log.Fatal(err)
+	}
+	servicetoken.Issuer = config.FrontendServerName
+	if err = errorreport.Init(config.FrontendServerName, config.Config.ErrorReporting); err != nil {
+		log.Fatal(err)
+	}
+	if err = clock.Init(config.Config.Clock); err != nil {
+		log.Fatal(err)
+	}
+	// store of the rate limits, idempotency keys and locks, shared by the instances of the server
+	if err = shared.Open(config.Config.Shared); err != nil {
+		log.Fatal(err)
+	}
 
 	err = config.SetPublicUrls()
 	if err != nil {
@@ -79,11 +108,7 @@ func main() {
 		dbURI = "sqlite3://file:frontend.sqlite?cache=shared&mode=rwc"
 	}
 	driver, cnxn := dbFromURI(dbURI)
-	db, err := sql.Open(driver, cnxn)
-	if err != nil {
-		panic(err)
-	}
-	_, err = db.Exec("PRAGMA journal_mode = WAL")
+	db, err := dbutils.Open(driver, cnxn, config.Config.FrontendServer.ServerInfo)
 	if err != nil {
 		panic(err)
 	}
@@ -97,11 +122,17 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if err = publicationDB.StartUploadWorkers(config.Config.FrontendServer.UploadWorkers); err != nil {
+		panic(err)
+	}
 
 	userDB, err := webuser.Open(db)
 	if err != nil {
 		panic(err)
 	}
+	if err = ensureAdmin(userDB, config.Config.FrontendServer.Auth); err != nil {
+		panic(err)
+	}
 
 	purchaseDB, err := webpurchase.Init(config.Config, db)
 	if err != nil {
@@ -125,18 +156,6 @@ func main() {
 		static = filepath.Join(here, "../frontend/manage")
 	}
 
-	filepathConfigJs := filepath.Join(static, "config.js")
-	fileConfigJs, err := os.Create(filepathConfigJs)
-	if err != nil {
-		panic(err)
-	}
-
-	defer func() {
-		if err := fileConfigJs.Close(); err != nil {
-			panic(err)
-		}
-	}()
-
 	configJs := `
 	// This file is automatically generated, and git-ignored.
 	// To ignore your local changes, use:
@@ -149,17 +168,49 @@ func main() {
 	log.Println("manage/index.html config.js:")
 	log.Println(configJs)
 
-	fileConfigJs.WriteString(configJs)
+	// served from memory, the static directory may be read-only
+	api.ConfigJs = configJs
+
+	// files in transit between the instances of the frontend and the License Server, e.g. the uploads waiting for their encryption
+	if err = staging.Init(config.Config.Staging); err != nil {
+		panic(err)
+	}
 	HandleSignals()
-	s := frontend.New(config.Config.FrontendServer.Host+":"+strconv.Itoa(config.Config.FrontendServer.Port), static, repoManager, publicationDB, userDB, dashboardDB, licenseDB, purchaseDB)
-	log.Println("Frontend webserver for LCP running on " + config.Config.FrontendServer.Host + ":" + strconv.Itoa(config.Config.FrontendServer.Port))
+	// the listen address is independent of the public base url, e.g. behind a load balancer
+	listenAddr := config.Config.FrontendServer.Listen(config.Config.FrontendServer.Host + ":" + strconv.Itoa(config.Config.FrontendServer.Port))
+	s := frontend.New(listenAddr, static, repoManager, publicationDB, userDB, dashboardDB, licenseDB, purchaseDB)
+	log.Println("Frontend webserver for LCP running on " + listenAddr)
 	log.Println("using database " + dbURI)
 
-	if err := s.ListenAndServe(); err != nil {
+	if err := api.ListenAndServe(&s.Server, config.Config.FrontendServer.TLS); err != nil {
 		log.Println("Error " + err.Error())
 	}
 }
 
+// ensureAdmin creates the admin account of the configuration if it does not exist,
+// and warns if the authentication is disabled
+func ensureAdmin(users webuser.WebUser, auth config.FrontendAuth) error {
+	if auth.Secret == "" {
+		log.Println("Warning: the authentication of the frontend is disabled, set frontend.auth.secret to enable it")
+		return nil
+	}
+	if auth.AdminEmail == "" {
+		return nil
+	}
+	_, err := users.GetByEmail(auth.AdminEmail)
+	if err != webuser.ErrNotFound {
+		return err
+	}
+	if auth.AdminPassword == "" {
+		return errors.New("the password of the admin account is missing, set frontend.auth.admin_password")
+	}
+	err = users.Add(webuser.User{Name: "admin", Email: auth.AdminEmail, Role: webauth.RoleAdmin, LoginPassword: auth.AdminPassword})
+	if err == nil {
+		log.Println("Admin account " + auth.AdminEmail + " created")
+	}
+	return err
+}
+
 // HandleSignals handles system signals and adds a log before quitting
 func HandleSignals() {
 	sigChan := make(chan os.Signal)
@@ -32,19 +32,23 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/claudiu/gocron"
 	"github.com/gorilla/mux"
 	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/clock"
 	"github.com/readium/readium-lcp-server/config"
 	"github.com/readium/readium-lcp-server/frontend/api"
+	"github.com/readium/readium-lcp-server/frontend/webauth"
 	"github.com/readium/readium-lcp-server/frontend/webdashboard"
 	"github.com/readium/readium-lcp-server/frontend/weblicense"
 	"github.com/readium/readium-lcp-server/frontend/webpublication"
 	"github.com/readium/readium-lcp-server/frontend/webpurchase"
 	"github.com/readium/readium-lcp-server/frontend/webrepository"
 	"github.com/readium/readium-lcp-server/frontend/webuser"
+	"github.com/readium/readium-lcp-server/problem"
 )
 
 //Server struct contains server info and  db interfaces
@@ -76,7 +80,7 @@ func New(
 	licenseAPI weblicense.WebLicense,
 	purchaseAPI webpurchase.WebPurchase) *Server {
 
-	sr := api.CreateServerRouter(tplPath)
+	sr := api.CreateServerRouter(tplPath, config.Config.FrontendServer.ServerInfo)
 	s := &Server{
 		Server: http.Server{
 			Handler:        sr.N,
@@ -91,57 +95,106 @@ func New(
 		dashboard:    dashboardAPI,
 		license:      licenseAPI,
 		purchases:    purchaseAPI}
+	api.SetTimeouts(&s.Server, config.Config.FrontendServer.Timeouts)
+
+	// the logins of the rate limits and of the idempotent requests: the users of valid session tokens
+	sr.Logins.Verify = func(r *http.Request) string {
+		secret := config.Config.FrontendServer.Auth.Secret
+		token := webauth.TokenFromRequest(r)
+		if secret == "" || token == "" {
+			return ""
+		}
+		claims, err := webauth.ParseToken(token, secret, time.Now())
+		if err != nil {
+			return ""
+		}
+		return "session:" + strconv.FormatInt(claims.UserID, 10)
+	}
 
 	// Cron, get license status information
 	gocron.Start()
 	gocron.Every(10).Minutes().Do(fetchLicenseStatusesTask, s)
+	// remind the users of the end of their loans
+	if reminders := config.Config.FrontendServer.Reminders; len(reminders.Channels) > 0 {
+		interval := reminders.Interval
+		if interval <= 0 {
+			interval = webpurchase.DefaultReminderInterval
+		}
+		gocron.Every(uint64(interval)).Minutes().Do(sendRemindersTask, s)
+	}
 
 	apiURLPrefix := "/api/v1"
 
+	//
+	// sessions: the authentication is enabled when the secret of the session tokens is set
+	//
+	s.handleFunc(sr.R, apiURLPrefix+"/login", staticapi.Login).Methods("POST")
+	s.handleFunc(sr.R, apiURLPrefix+"/logout", staticapi.Logout).Methods("POST")
+	s.handleAuthFunc(sr.R, apiURLPrefix+"/me", webauth.RolePatron, staticapi.GetMe).Methods("GET")
+
 	//
 	//  repositories of master files
 	//
 	repositoriesRoutesPathPrefix := apiURLPrefix + "/repositories"
 	repositoriesRoutes := sr.R.PathPrefix(repositoriesRoutesPathPrefix).Subrouter().StrictSlash(false)
 	//
-	s.handleFunc(repositoriesRoutes, "/master-files", staticapi.GetRepositoryMasterFiles).Methods("GET")
+	s.handleAuthFunc(repositoriesRoutes, "/master-files", webauth.RoleStaff, staticapi.GetRepositoryMasterFiles).Methods("GET")
 	//
 	// dashboard
 	//
-	s.handleFunc(sr.R, "/dashboardInfos", staticapi.GetDashboardInfos).Methods("GET")
-	s.handleFunc(sr.R, "/dashboardBestSellers", staticapi.GetDashboardBestSellers).Methods("GET")
+	s.handleAuthFunc(sr.R, "/dashboardInfos", webauth.RoleStaff, staticapi.GetDashboardInfos).Methods("GET")
+	s.handleAuthFunc(sr.R, "/dashboardBestSellers", webauth.RoleStaff, staticapi.GetDashboardBestSellers).Methods("GET")
+	s.handleAuthFunc(sr.R, "/dashboardTopLoans", webauth.RoleStaff, staticapi.GetDashboardTopLoans).Methods("GET")
+	s.handleAuthFunc(sr.R, "/dashboardActiveLoans", webauth.RoleStaff, staticapi.GetDashboardActiveLoans).Methods("GET")
+	s.handleAuthFunc(sr.R, "/dashboardReturnsRate", webauth.RoleStaff, staticapi.GetDashboardReturnsRate).Methods("GET")
 	//
 	// publications
 	//
 	publicationsRoutesPathPrefix := apiURLPrefix + "/publications"
 	publicationsRoutes := sr.R.PathPrefix(publicationsRoutesPathPrefix).Subrouter().StrictSlash(false)
 	//
-	s.handleFunc(sr.R, publicationsRoutesPathPrefix, staticapi.GetPublications).Methods("GET")
+	s.handleAuthFunc(sr.R, publicationsRoutesPathPrefix, webauth.RolePatron, staticapi.GetPublications).Methods("GET")
+	//
+	s.handleAuthFunc(sr.R, publicationsRoutesPathPrefix, webauth.RoleStaff, staticapi.CreatePublication).Methods("POST")
 	//
-	s.handleFunc(sr.R, publicationsRoutesPathPrefix, staticapi.CreatePublication).Methods("POST")
+	s.handleAuthFunc(sr.R, "/PublicationUpload", webauth.RoleStaff, staticapi.UploadEPUB).Methods("POST")
 	//
-	s.handleFunc(sr.R, "/PublicationUpload", staticapi.UploadEPUB).Methods("POST")
+	s.handleAuthFunc(publicationsRoutes, "/check-by-title", webauth.RoleStaff, staticapi.CheckPublicationByTitle).Methods("GET")
+	// bulk uploads, encrypted in the background
+	s.handleAuthFunc(publicationsRoutes, "/uploads", webauth.RoleStaff, staticapi.UploadPublications).Methods("POST")
+	s.handleAuthFunc(publicationsRoutes, "/uploads", webauth.RoleStaff, staticapi.GetUploadJobs).Methods("GET")
+	s.handleAuthFunc(publicationsRoutes, "/uploads/{id}", webauth.RoleStaff, staticapi.GetUploadJob).Methods("GET")
 	//
-	s.handleFunc(publicationsRoutes, "/check-by-title", staticapi.CheckPublicationByTitle).Methods("GET")
+	s.handleAuthFunc(publicationsRoutes, "/{id}", webauth.RolePatron, staticapi.GetPublication).Methods("GET")
+	// get the metadata (title, author, isbn, cover) ingested by the license server
+	s.handleAuthFunc(publicationsRoutes, "/{id}/metadata", webauth.RolePatron, staticapi.GetPublicationMetadata).Methods("GET")
+	s.handleAuthFunc(publicationsRoutes, "/{id}", webauth.RoleStaff, staticapi.UpdatePublication).Methods("PUT")
+	s.handleAuthFunc(publicationsRoutes, "/{id}", webauth.RoleStaff, staticapi.DeletePublication).Methods("DELETE")
 	//
-	s.handleFunc(publicationsRoutes, "/{id}", staticapi.GetPublication).Methods("GET")
-	s.handleFunc(publicationsRoutes, "/{id}", staticapi.UpdatePublication).Methods("PUT")
-	s.handleFunc(publicationsRoutes, "/{id}", staticapi.DeletePublication).Methods("DELETE")
+	// OPDS 2.0 catalog, for reading apps
+	//
+	s.handleFunc(sr.R, "/opds2/publications.json", staticapi.GetOpdsFeed).Methods("GET")
+	// the OPDS authentication document, which tells the reading apps how to authenticate the users
+	s.handleFunc(sr.R, "/opds2/auth.json", staticapi.GetOpdsAuthDocument).Methods("GET")
+	// borrow a publication, get its license
+	s.handleFunc(sr.R, "/opds2/publications/{id}/loan", staticapi.BorrowOpdsPublication).Methods("GET")
 	//
 	// user functions
 	//
 	usersRoutesPathPrefix := apiURLPrefix + "/users"
 	usersRoutes := sr.R.PathPrefix(usersRoutesPathPrefix).Subrouter().StrictSlash(false)
 	//
-	s.handleFunc(sr.R, usersRoutesPathPrefix, staticapi.GetUsers).Methods("GET")
-	//
-	s.handleFunc(sr.R, usersRoutesPathPrefix, staticapi.CreateUser).Methods("POST")
+	s.handleAuthFunc(sr.R, usersRoutesPathPrefix, webauth.RoleStaff, staticapi.GetUsers).Methods("GET")
 	//
-	s.handleFunc(usersRoutes, "/{id}", staticapi.GetUser).Methods("GET")
-	s.handleFunc(usersRoutes, "/{id}", staticapi.UpdateUser).Methods("PUT")
-	s.handleFunc(usersRoutes, "/{id}", staticapi.DeleteUser).Methods("DELETE")
+	s.handleAuthFunc(sr.R, usersRoutesPathPrefix, webauth.RoleStaff, staticapi.CreateUser).Methods("POST")
+	// a patron only accesses his own account and purchases
+	s.handleAuthFunc(usersRoutes, "/{id}", webauth.RolePatron, staticapi.GetUser).Methods("GET")
+	s.handleAuthFunc(usersRoutes, "/{id}", webauth.RolePatron, staticapi.UpdateUser).Methods("PUT")
+	s.handleAuthFunc(usersRoutes, "/{id}", webauth.RoleAdmin, staticapi.DeleteUser).Methods("DELETE")
+	// erasure of the personal data of a user
+	s.handleAuthFunc(usersRoutes, "/{id}/erasure", webauth.RoleAdmin, staticapi.EraseUser).Methods("POST")
 	// get all purchases for a given user
-	s.handleFunc(usersRoutes, "/{user_id}/purchases", staticapi.GetUserPurchases).Methods("GET")
+	s.handleAuthFunc(usersRoutes, "/{user_id}/purchases", webauth.RolePatron, staticapi.GetUserPurchases).Methods("GET")
 
 	//
 	// purchases
@@ -149,15 +202,22 @@ func New(
 	purchasesRoutesPathPrefix := apiURLPrefix + "/purchases"
 	purchasesRoutes := sr.R.PathPrefix(purchasesRoutesPathPrefix).Subrouter().StrictSlash(false)
 	// get all purchases
-	s.handleFunc(sr.R, purchasesRoutesPathPrefix, staticapi.GetPurchases).Methods("GET")
+	s.handleAuthFunc(sr.R, purchasesRoutesPathPrefix, webauth.RoleStaff, staticapi.GetPurchases).Methods("GET")
 	// create a purchase
-	s.handleFunc(sr.R, purchasesRoutesPathPrefix, staticapi.CreatePurchase).Methods("POST")
+	s.handleAuthFunc(sr.R, purchasesRoutesPathPrefix, webauth.RolePatron, staticapi.CreatePurchase).Methods("POST")
 	// update a purchase
-	s.handleFunc(purchasesRoutes, "/{id}", staticapi.UpdatePurchase).Methods("PUT")
+	s.handleAuthFunc(purchasesRoutes, "/{id}", webauth.RoleStaff, staticapi.UpdatePurchase).Methods("PUT")
 	// get a purchase by purchase id
-	s.handleFunc(purchasesRoutes, "/{id}", staticapi.GetPurchase).Methods("GET")
+	s.handleAuthFunc(purchasesRoutes, "/{id}", webauth.RolePatron, staticapi.GetPurchase).Methods("GET")
 	// get a license from the associated purchase id
-	s.handleFunc(purchasesRoutes, "/{id}/license", staticapi.GetPurchasedLicense).Methods("GET")
+	s.handleAuthFunc(purchasesRoutes, "/{id}/license", webauth.RolePatron, staticapi.GetPurchasedLicense).Methods("GET")
+	// get the publication of a purchase, with its license embedded
+	s.handleAuthFunc(purchasesRoutes, "/{id}/publication", webauth.RolePatron, staticapi.GetPurchasedPublication).Methods("GET")
+	// the lifecycle of a purchase: its transitions, and the change of its state by the staff
+	s.handleAuthFunc(purchasesRoutes, "/{id}/events", webauth.RolePatron, staticapi.GetPurchaseEvents).Methods("GET")
+	s.handleAuthFunc(purchasesRoutes, "/{id}/state", webauth.RoleStaff, staticapi.ChangePurchaseState).Methods("POST")
+	// extend a loan (patron self-service)
+	s.handleAuthFunc(purchasesRoutes, "/{id}/renew", webauth.RolePatron, staticapi.RenewPurchase).Methods("POST")
 	//
 	// licences
 	//
@@ -165,9 +225,9 @@ func New(
 	licenseRoutes := sr.R.PathPrefix(licenseRoutesPathPrefix).Subrouter().StrictSlash(false)
 	//
 	// get a list of licenses
-	s.handleFunc(sr.R, licenseRoutesPathPrefix, staticapi.GetFilteredLicenses).Methods("GET")
+	s.handleAuthFunc(sr.R, licenseRoutesPathPrefix, webauth.RoleStaff, staticapi.GetFilteredLicenses).Methods("GET")
 	// get a license by id
-	s.handleFunc(licenseRoutes, "/{license_id}", staticapi.GetLicense).Methods("GET")
+	s.handleAuthFunc(licenseRoutes, "/{license_id}", webauth.RoleStaff, staticapi.GetLicense).Methods("GET")
 
 	return s
 }
@@ -205,6 +265,17 @@ func fetchLicenseStatusesTask(s *Server) {
 	if err != nil {
 		panic(err)
 	}
+
+	// end the purchases whose license has ended
+	if _, err = s.purchases.SyncStates(); err != nil {
+		log.Println("Error updating the purchase states: " + err.Error())
+	}
+}
+
+func sendRemindersTask(s *Server) {
+	if _, err := s.purchases.SendReminders(clock.Now()); err != nil {
+		log.Println("Error sending the reminders: " + err.Error())
+	}
 }
 
 // RepositoryAPI ( staticapi.IServer ) returns interface for repositories
@@ -243,6 +314,35 @@ func (server *Server) handleFunc(router *mux.Router, route string, fn HandlerFun
 	})
 }
 
+// handleAuthFunc registers a route reserved to the users who have a role, or a more privileged one.
+// The session token is checked unless the authentication is disabled.
+func (server *Server) handleAuthFunc(router *mux.Router, route string, role string, fn HandlerFunc) *mux.Route {
+	return router.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
+		secret := config.Config.FrontendServer.Auth.Secret
+		if secret == "" {
+			fn(w, r, server)
+			return
+		}
+		token := webauth.TokenFromRequest(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Readium LCP frontend"`)
+			problem.Error(w, r, problem.Problem{Detail: "Authentication required"}, http.StatusUnauthorized)
+			return
+		}
+		claims, err := webauth.ParseToken(token, secret, time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Readium LCP frontend", error="invalid_token"`)
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusUnauthorized)
+			return
+		}
+		if !webauth.Allows(claims.Role, role) {
+			problem.Error(w, r, problem.Problem{Detail: "This operation requires the " + role + " role"}, http.StatusForbidden)
+			return
+		}
+		fn(w, webauth.WithClaims(r, claims), server)
+	})
+}
+
 /*no private functions used
 func (server *Server) handlePrivateFunc(router *mux.Router, route string, fn HandlerFunc, authenticator *auth.BasicAuth) *mux.Route {
 	return router.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,169 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package webauth authenticates the users of the frontend server: their login passwords are hashed with bcrypt,
+// and a successful login returns a session token, a JWT signed with a secret of the server (HS256),
+// which carries the id and the role of the user.
+package webauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the roles of the users, from the most to the least privileged
+const (
+	RoleAdmin  = "admin"
+	RoleStaff  = "staff"
+	RolePatron = "patron"
+)
+
+// roleRanks orders the roles: a role has the rights of the roles of lower rank
+var roleRanks = map[string]int{RolePatron: 1, RoleStaff: 2, RoleAdmin: 3}
+
+// ValidRole checks if a role is known
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// Allows checks if a role has the rights of a required role
+func Allows(role, required string) bool {
+	return roleRanks[role] >= roleRanks[required] && roleRanks[role] > 0
+}
+
+// ErrInvalidToken is returned when a session token is malformed or badly signed
+var ErrInvalidToken = errors.New("Invalid session token")
+
+// ErrExpiredToken is returned when a session token has expired
+var ErrExpiredToken = errors.New("The session has expired")
+
+// SessionCookie is the name of the cookie which carries the session token of the browsers
+const SessionCookie = "frontend_session"
+
+// DefaultTokenTTL is the default lifetime of a session token
+const DefaultTokenTTL = 8 * time.Hour
+
+// HashPassword hashes a login password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword checks a login password against its hash; an empty hash matches no password
+func CheckPassword(hash, password string) bool {
+	if hash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Claims are the claims of a session token
+type Claims struct {
+	UserID   int64  `json:"sub"`
+	Role     string `json:"role"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+// tokenHeader is the encoded header of the session tokens
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// NewToken returns the session token of a user, valid for a lifetime
+func NewToken(userID int64, role string, now time.Time, ttl time.Duration, secret string) (string, Claims) {
+	claims := Claims{UserID: userID, Role: role, IssuedAt: now.Unix(), Expires: now.Add(ttl).Unix()}
+	payload, _ := json.Marshal(claims)
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + tokenSignature(unsigned, secret), claims
+}
+
+// ParseToken checks the signature and the expiration time of a session token and returns its claims
+func ParseToken(token string, secret string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return Claims{}, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(tokenSignature(parts[0]+"."+parts[1], secret))
+	if !hmac.Equal(sig, expected) {
+		return Claims{}, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	var claims Claims
+	if err = json.Unmarshal(payload, &claims); err != nil || !ValidRole(claims.Role) {
+		return Claims{}, ErrInvalidToken
+	}
+	if now.Unix() >= claims.Expires {
+		return Claims{}, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+func tokenSignature(unsigned string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// TokenFromRequest returns the session token of a request,
+// given as a bearer token or in the session cookie
+func TokenFromRequest(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+type claimsKey struct{}
+
+// WithClaims returns a copy of a request which carries the claims of its session
+func WithClaims(r *http.Request, claims Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims))
+}
+
+// FromRequest returns the claims of the session of a request;
+// there are none if the authentication is disabled or if the route is public
+func FromRequest(r *http.Request) (Claims, bool) {
+	claims, ok := r.Context().Value(claimsKey{}).(Claims)
+	return claims, ok
+}
+
+// CanAccessUser checks if the session of a request gives access to the data of a user:
+// the staff accesses all the users, a patron only himself.
+// The access is granted when the authentication is disabled.
+func CanAccessUser(r *http.Request, userID int64) bool {
+	claims, ok := FromRequest(r)
+	if !ok {
+		return true
+	}
+	return Allows(claims.Role, RoleStaff) || claims.UserID == userID
+}
+
+// IsAdmin checks if the session of a request is the one of an administrator,
+// which is always the case when the authentication is disabled
+func IsAdmin(r *http.Request) bool {
+	claims, ok := FromRequest(r)
+	return !ok || claims.Role == RoleAdmin
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package webauth
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckPassword(hash, "secret") {
+		t.Error("Expected the password to match its hash")
+	}
+	if CheckPassword(hash, "wrong") {
+		t.Error("Expected a wrong password to be rejected")
+	}
+	if CheckPassword("", "") {
+		t.Error("Expected an account without password to be rejected")
+	}
+}
+
+func TestToken(t *testing.T) {
+	now := time.Now()
+	token, _ := NewToken(42, RoleStaff, now, time.Hour, "secret")
+
+	claims, err := ParseToken(token, "secret", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != 42 || claims.Role != RoleStaff {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+	if _, err = ParseToken(token, "other", now); err != ErrInvalidToken {
+		t.Errorf("Expected an invalid token with another secret, got %v", err)
+	}
+	if _, err = ParseToken(token, "secret", now.Add(2*time.Hour)); err != ErrExpiredToken {
+		t.Errorf("Expected an expired token, got %v", err)
+	}
+
+	// the role cannot be changed
+	admin, _ := NewToken(42, RoleAdmin, now, time.Hour, "secret")
+	parts, adminParts := strings.Split(token, "."), strings.Split(admin, ".")
+	forged := parts[0] + "." + adminParts[1] + "." + parts[2]
+	if _, err = ParseToken(forged, "secret", now); err != ErrInvalidToken {
+		t.Errorf("Expected an invalid forged token, got %v", err)
+	}
+	if _, err = ParseToken("garbage", "secret", now); err != ErrInvalidToken {
+		t.Errorf("Expected an invalid token, got %v", err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	if !Allows(RoleAdmin, RoleStaff) || !Allows(RoleStaff, RolePatron) || !Allows(RolePatron, RolePatron) {
+		t.Error("Expected a role to have the rights of the less privileged roles")
+	}
+	if Allows(RolePatron, RoleStaff) || Allows(RoleStaff, RoleAdmin) || Allows("", RolePatron) {
+		t.Error("Expected a role not to have the rights of the more privileged roles")
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/users/7", nil)
+	if !CanAccessUser(r, 7) || !IsAdmin(r) {
+		t.Error("Expected all the accesses to be granted without authentication")
+	}
+	patron := WithClaims(r, Claims{UserID: 7, Role: RolePatron})
+	if !CanAccessUser(patron, 7) || CanAccessUser(patron, 8) || IsAdmin(patron) {
+		t.Error("Expected a patron to access only his own data")
+	}
+	staff := WithClaims(r, Claims{UserID: 1, Role: RoleStaff})
+	if !CanAccessUser(staff, 8) || IsAdmin(staff) {
+		t.Error("Expected the staff to access all the users")
+	}
+
+	r.Header.Set("Authorization", "Bearer abc")
+	if TokenFromRequest(r) != "abc" {
+		t.Error("Expected the bearer token to be read")
+	}
+}
@@ -28,6 +28,7 @@ package webdashboard
 import (
 	"database/sql"
 	"errors"
+	"time"
 
 	"github.com/readium/readium-lcp-server/config"
 )
@@ -47,6 +48,9 @@ var ErrNotFound = errors.New("Informations not found")
 type WebDashboard interface {
 	GetDashboardInfos() (Dashboard, error)
 	GetDashboardBestSellers() ([5]BestSeller, error)
+	GetTopLoans(limit int) ([]BestSeller, error)
+	GetActiveLoans(from time.Time, to time.Time) ([]DailyLoans, error)
+	GetReturnsRate() (ReturnsRate, error)
 }
 
 // Dashboard struct defines a publication
@@ -175,3 +179,128 @@ func Init(config config.Configuration, db *sql.DB) (i WebDashboard, err error) {
 	i = DashboardManager{config, db}
 	return
 }
+
+// DailyLoans is the number of loans active on a given day
+type DailyLoans struct {
+	Day   string `json:"day"`
+	Count int64  `json:"count"`
+}
+
+// ReturnsRate is the proportion of delivered loans returned before their end
+type ReturnsRate struct {
+	LoanCount     int64   `json:"loanCount"`
+	ReturnedCount int64   `json:"returnedCount"`
+	Rate          float64 `json:"rate"`
+}
+
+// GetTopLoans returns the titles with the highest number of loans
+//
+func (dashManager DashboardManager) GetTopLoans(limit int) ([]BestSeller, error) {
+	dbList, err := dashManager.db.Prepare(
+		`SELECT pub.title, COUNT(pur.id) AS loans
+		FROM purchase pur JOIN publication pub
+		ON pur.publication_id = pub.id
+		WHERE pur.type = 'LOAN'
+		GROUP BY pub.id, pub.title
+		ORDER BY loans DESC LIMIT ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer dbList.Close()
+	records, err := dbList.Query(limit)
+	if err != nil {
+		return nil, err
+	}
+	defer records.Close()
+
+	topLoans := make([]BestSeller, 0)
+	for records.Next() {
+		var bestSeller BestSeller
+		err = records.Scan(&bestSeller.Title, &bestSeller.Count)
+		if err != nil {
+			return topLoans, err
+		}
+		topLoans = append(topLoans, bestSeller)
+	}
+	return topLoans, records.Err()
+}
+
+// GetActiveLoans returns the number of active loans per day, in the [from, to] interval
+//
+func (dashManager DashboardManager) GetActiveLoans(from time.Time, to time.Time) ([]DailyLoans, error) {
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	to = time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+
+	// select the loans which overlap the interval
+	dbList, err := dashManager.db.Prepare(
+		`SELECT start_date, end_date FROM purchase
+		WHERE type = 'LOAN' AND start_date IS NOT NULL AND start_date < ?
+		AND (end_date IS NULL OR end_date >= ?)`)
+	if err != nil {
+		return nil, err
+	}
+	defer dbList.Close()
+	records, err := dbList.Query(to.AddDate(0, 0, 1), from)
+	if err != nil {
+		return nil, err
+	}
+	defer records.Close()
+
+	// one counter per day of the interval
+	days := int(to.Sub(from).Hours()/24) + 1
+	if days < 1 {
+		return make([]DailyLoans, 0), nil
+	}
+	counts := make([]int64, days)
+	for records.Next() {
+		var start time.Time
+		var end *time.Time
+		err = records.Scan(&start, &end)
+		if err != nil {
+			return nil, err
+		}
+		for i := range counts {
+			dayStart := from.AddDate(0, 0, i)
+			dayEnd := dayStart.AddDate(0, 0, 1)
+			if start.Before(dayEnd) && (end == nil || !end.Before(dayStart)) {
+				counts[i]++
+			}
+		}
+	}
+	if err = records.Err(); err != nil {
+		return nil, err
+	}
+
+	activeLoans := make([]DailyLoans, days)
+	for i, count := range counts {
+		activeLoans[i] = DailyLoans{Day: from.AddDate(0, 0, i).Format("2006-01-02"), Count: count}
+	}
+	return activeLoans, nil
+}
+
+// GetReturnsRate returns the proportion of delivered loans which have been returned,
+// according to the license statuses fetched from the license status server
+//
+func (dashManager DashboardManager) GetReturnsRate() (ReturnsRate, error) {
+	var rate ReturnsRate
+
+	row := dashManager.db.QueryRow(`SELECT COUNT(*) FROM purchase WHERE type = 'LOAN' AND license_uuid IS NOT NULL`)
+	err := row.Scan(&rate.LoanCount)
+	if err != nil {
+		return ReturnsRate{}, err
+	}
+
+	row = dashManager.db.QueryRow(
+		`SELECT COUNT(*) FROM purchase pur JOIN license_view lic
+		ON pur.license_uuid = lic.uuid
+		WHERE pur.type = 'LOAN' AND lic.status = 'returned'`)
+	err = row.Scan(&rate.ReturnedCount)
+	if err != nil {
+		return ReturnsRate{}, err
+	}
+
+	if rate.LoanCount > 0 {
+		rate.Rate = float64(rate.ReturnedCount) / float64(rate.LoanCount)
+	}
+	return rate, nil
+}
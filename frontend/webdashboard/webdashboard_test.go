@@ -0,0 +1,110 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package webdashboard
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// openDashboard returns a dashboard on a database holding two publications, their loans and a purchase
+func openDashboard(t *testing.T) (WebDashboard, *sql.DB) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE TABLE publication (id integer PRIMARY KEY, title varchar(255));
+	CREATE TABLE purchase (id integer PRIMARY KEY, publication_id integer, type varchar(32),
+		start_date datetime, end_date datetime, license_uuid varchar(255));
+	CREATE TABLE license_view (uuid varchar(255), status varchar(255));
+	INSERT INTO publication (id, title) VALUES (1, 'first'), (2, 'second');
+	INSERT INTO purchase (publication_id, type, start_date, end_date, license_uuid) VALUES
+		(1, 'LOAN', '2020-01-01 10:00:00', '2020-01-03 10:00:00', 'l1'),
+		(1, 'LOAN', '2020-01-02 10:00:00', '2020-01-10 10:00:00', 'l2'),
+		(2, 'LOAN', '2020-01-05 10:00:00', '2020-01-06 10:00:00', 'l3'),
+		(2, 'LOAN', NULL, NULL, NULL),
+		(2, 'BUY', '2020-01-01 10:00:00', NULL, 'l4');
+	INSERT INTO license_view (uuid, status) VALUES ('l1', 'returned'), ('l2', 'active'), ('l4', 'returned');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := Init(config.Configuration{}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i, db
+}
+
+func TestTopLoans(t *testing.T) {
+	dash, db := openDashboard(t)
+	defer db.Close()
+
+	top, err := dash.GetTopLoans(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the purchases are not counted
+	if len(top) != 2 || top[0] != (BestSeller{Title: "first", Count: 2}) && top[0] != (BestSeller{Title: "second", Count: 2}) {
+		t.Errorf("Expected the loans of the 2 titles, got %+v", top)
+	}
+	if top, err = dash.GetTopLoans(1); err != nil || len(top) != 1 {
+		t.Errorf("Expected a single title, got %+v (%v)", top, err)
+	}
+}
+
+func TestActiveLoans(t *testing.T) {
+	dash, db := openDashboard(t)
+	defer db.Close()
+
+	from := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	days, err := dash.GetActiveLoans(from, from.AddDate(0, 0, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DailyLoans{
+		{"2020-01-01", 1}, {"2020-01-02", 2}, {"2020-01-03", 2},
+		{"2020-01-04", 1}, {"2020-01-05", 2}, {"2020-01-06", 2},
+	}
+	if len(days) != len(expected) {
+		t.Fatalf("Expected %d days, got %+v", len(expected), days)
+	}
+	for i := range expected {
+		if days[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], days[i])
+		}
+	}
+
+	// an empty interval
+	if days, err = dash.GetActiveLoans(from, from.AddDate(0, 0, -1)); err != nil || len(days) != 0 {
+		t.Errorf("Expected no day, got %+v (%v)", days, err)
+	}
+}
+
+func TestReturnsRate(t *testing.T) {
+	dash, db := openDashboard(t)
+	defer db.Close()
+
+	// the loans without license are not delivered, the returned purchases are not counted
+	rate, err := dash.GetReturnsRate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate.LoanCount != 3 || rate.ReturnedCount != 1 || rate.Rate < 0.33 || rate.Rate > 0.34 {
+		t.Errorf("Unexpected returns rate %+v", rate)
+	}
+
+	if _, err = db.Exec("DELETE FROM purchase"); err != nil {
+		t.Fatal(err)
+	}
+	if rate, err = dash.GetReturnsRate(); err != nil || rate != (ReturnsRate{}) {
+		t.Errorf("Expected no loan, got %+v (%v)", rate, err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package webmail
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// The kinds of emails
+const (
+	LoanCreated  = "loan_created"
+	LoanExpiring = "loan_expiring"
+	LoanReturned = "loan_returned"
+)
+
+// fallbackLanguage is the language of the default templates
+const fallbackLanguage = "en-US"
+
+// Data are the values given to the templates
+type Data struct {
+	Name        string // the name of the user
+	Title       string // the title of the publication
+	EndDate     string // the end of the loan, formatted as a date
+	Days        int    // the number of days before the end of the loan
+	LicenseID   string
+	DownloadURL string // the link to the license, if it is not attached
+}
+
+// defaultTemplates are the templates in English. A template starts with the subject line,
+// then the body after an empty line.
+var defaultTemplates = map[string]string{
+	LoanCreated: `Your loan of "{{.Title}}"
+
+Hello {{.Name}},
+
+You have borrowed "{{.Title}}"{{if .EndDate}} until {{.EndDate}}{{end}}.
+{{if .DownloadURL}}Download the license of the publication and open it in your reading app:
+{{.DownloadURL}}{{else}}Open the attached license in your reading app.{{end}}
+`,
+	LoanExpiring: `Your loan of "{{.Title}}" ends soon
+
+Hello {{.Name}},
+
+Your loan of "{{.Title}}" ends {{if eq .Days 1}}tomorrow{{else}}in {{.Days}} days{{end}}, on {{.EndDate}}.
+You may renew it from your reading app if you have not finished the publication.
+`,
+	LoanReturned: `"{{.Title}}" has been returned
+
+Hello {{.Name}},
+
+Your loan of "{{.Title}}" has been returned. Thank you!
+`,
+}
+
+// Templates are the templates of the emails, per kind and language
+type Templates struct {
+	templates       map[string]*template.Template // by kind + "." + language
+	defaultLanguage string
+}
+
+// LoadTemplates loads the default templates, then the templates of a folder, which override them;
+// the templates of a folder are named after their kind and language, e.g. "loan_created.fr-FR.txt"
+func LoadTemplates(folder string, defaultLanguage string) (*Templates, error) {
+	if defaultLanguage == "" {
+		defaultLanguage = fallbackLanguage
+	}
+	t := &Templates{templates: make(map[string]*template.Template), defaultLanguage: defaultLanguage}
+	for kind, text := range defaultTemplates {
+		if err := t.add(kind+"."+fallbackLanguage, text); err != nil {
+			return nil, err
+		}
+	}
+	if folder == "" {
+		return t, nil
+	}
+	files, err := filepath.Glob(filepath.Join(folder, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err = t.add(strings.TrimSuffix(filepath.Base(file), ".txt"), string(text)); err != nil {
+			return nil, errors.New(filepath.Base(file) + ": " + err.Error())
+		}
+	}
+	return t, nil
+}
+
+func (t *Templates) add(name string, text string) error {
+	tpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return err
+	}
+	t.templates[name] = tpl
+	return nil
+}
+
+// lookup finds the template of a kind in a language, or its base language ("fr" for "fr-FR"),
+// else in the default language, else in English
+func (t *Templates) lookup(kind string, language string) *template.Template {
+	candidates := []string{language}
+	if i := strings.IndexAny(language, "-_"); i > 0 {
+		candidates = append(candidates, language[:i])
+	}
+	candidates = append(candidates, t.defaultLanguage, fallbackLanguage)
+	for _, lang := range candidates {
+		if lang == "" {
+			continue
+		}
+		if tpl, ok := t.templates[kind+"."+lang]; ok {
+			return tpl
+		}
+	}
+	return nil
+}
+
+// Render writes the subject and the body of an email of a kind, in a language
+func (t *Templates) Render(kind string, language string, data Data) (string, string, error) {
+	tpl := t.lookup(kind, language)
+	if tpl == nil {
+		return "", "", errors.New("no template for the emails " + kind)
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	text := strings.Replace(buf.String(), "\r\n", "\n", -1)
+	parts := strings.SplitN(text, "\n\n", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("the template " + tpl.Name() + " has no subject line")
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimLeft(parts[1], "\n"), nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package webmail sends the emails of the frontend server to its users: the license of a new loan,
+// the reminder of the end of a loan and the confirmation of a return. The emails are written from templates,
+// localized in the language of the user, and sent through an SMTP server or the HTTP API of a mail provider.
+package webmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// Attachment is a file attached to an email
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"content"` // base64 in json
+}
+
+// Message is an email
+type Message struct {
+	From        string
+	To          string
+	Subject     string
+	Body        string
+	Attachments []Attachment
+}
+
+// Mailer sends the emails
+type Mailer interface {
+	Send(m Message) error
+}
+
+// NewMailer returns the mailer of a configuration, nil if no provider is set
+func NewMailer(c config.FrontendMail) (Mailer, error) {
+	switch c.Provider {
+	case "":
+		return nil, nil
+	case "smtp":
+		if c.Host == "" {
+			return nil, errors.New("the SMTP host of the mailer is missing")
+		}
+		port := c.Port
+		if port == 0 {
+			port = 25
+		}
+		return smtpMailer{addr: net.JoinHostPort(c.Host, strconv.Itoa(port)), host: c.Host, username: c.Username, password: c.Password}, nil
+	case "api":
+		if c.APIURL == "" {
+			return nil, errors.New("the API url of the mailer is missing")
+		}
+		return apiMailer{url: c.APIURL, key: c.APIKey, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	return nil, errors.New("unknown mail provider " + c.Provider)
+}
+
+// smtpMailer sends the emails through an SMTP server; STARTTLS is used if the server supports it
+type smtpMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+}
+
+func (m smtpMailer) Send(msg Message) error {
+	data, err := buildMessage(msg, time.Now())
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	return smtp.SendMail(m.addr, auth, msg.From, []string{msg.To}, data)
+}
+
+// apiMessage is the json body sent to the API of a mail provider
+type apiMessage struct {
+	From        string       `json:"from"`
+	To          []string     `json:"to"`
+	Subject     string       `json:"subject"`
+	Text        string       `json:"text"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// apiMailer posts the emails to the HTTP API of a mail provider, authenticated by a bearer key
+type apiMailer struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+func (m apiMailer) Send(msg Message) error {
+	body, err := json.Marshal(apiMessage{From: msg.From, To: []string{msg.To}, Subject: msg.Subject, Text: msg.Body, Attachments: msg.Attachments})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", m.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.key != "" {
+		req.Header.Set("Authorization", "Bearer "+m.key)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("the mail provider returned the status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+// buildMessage writes an email in the MIME format: a text in quoted-printable,
+// in a multipart message if there are attachments
+func buildMessage(msg Message, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", msg.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if len(msg.Attachments) == 0 {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+		return buf.Bytes(), writeText(&buf, msg.Body)
+	}
+
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = writeText(part, msg.Body); err != nil {
+		return nil, err
+	}
+	for _, a := range msg.Attachments {
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		part, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(a.Data)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeText(w interface{ Write([]byte) (int, error) }, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(strings.Replace(text, "\n", "\r\n", -1))); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// Notifier writes the emails of the frontend from their templates and sends them
+type Notifier struct {
+	mailer    Mailer
+	templates *Templates
+	from      string
+}
+
+// New returns the notifier of a configuration; it is nil, and sends nothing, if no mail provider is set
+func New(c config.FrontendMail) (*Notifier, error) {
+	mailer, err := NewMailer(c)
+	if err != nil || mailer == nil {
+		return nil, err
+	}
+	templates, err := LoadTemplates(c.Templates, c.DefaultLanguage)
+	if err != nil {
+		return nil, err
+	}
+	return NewNotifier(mailer, templates, c.From), nil
+}
+
+// NewNotifier returns a notifier which sends its emails through a mailer
+func NewNotifier(mailer Mailer, templates *Templates, from string) *Notifier {
+	return &Notifier{mailer: mailer, templates: templates, from: from}
+}
+
+// Notify sends an email of a kind to a user, in his language
+func (n *Notifier) Notify(kind string, language string, to string, data Data, attachments ...Attachment) error {
+	if n == nil {
+		return nil
+	}
+	if to == "" {
+		return errors.New("the user has no email address")
+	}
+	subject, body, err := n.templates.Render(kind, language, data)
+	if err != nil {
+		return err
+	}
+	err = n.mailer.Send(Message{From: n.from, To: to, Subject: subject, Body: body, Attachments: attachments})
+	if err == nil {
+		log.Println("Email " + kind + " sent to " + to)
+	}
+	return err
+}
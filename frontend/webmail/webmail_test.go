@@ -0,0 +1,104 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package webmail
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestTemplates(t *testing.T) {
+	dir := t.TempDir()
+	fr := "Votre prêt de « {{.Title}} »\n\nBonjour {{.Name}},\n\nVous avez emprunté « {{.Title}} » jusqu'au {{.EndDate}}.\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "loan_created.fr.txt"), []byte(fr), 0644); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := LoadTemplates(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := Data{Name: "Ann", Title: "Moby Dick", EndDate: "2020-03-08", DownloadURL: "https://example.com/license"}
+
+	// the base language is used for a regional language
+	subject, body, err := templates.Render(LoanCreated, "fr-FR", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Votre prêt de « Moby Dick »" || !strings.Contains(body, "jusqu'au 2020-03-08") {
+		t.Errorf("Unexpected french email %q, %q", subject, body)
+	}
+	// the default templates are used for the other languages and kinds
+	subject, body, err = templates.Render(LoanCreated, "de-DE", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != `Your loan of "Moby Dick"` || !strings.Contains(body, "https://example.com/license") {
+		t.Errorf("Unexpected default email %q, %q", subject, body)
+	}
+	if _, body, err = templates.Render(LoanExpiring, "fr-FR", Data{Title: "Moby Dick", Days: 1}); err != nil || !strings.Contains(body, "tomorrow") {
+		t.Errorf("Unexpected reminder %q, %v", body, err)
+	}
+	if _, _, err = templates.Render("unknown", "en-US", data); err == nil {
+		t.Error("Expected an unknown kind of email to fail")
+	}
+}
+
+func TestBuildMessage(t *testing.T) {
+	msg := Message{From: "library@example.com", To: "ann@example.com", Subject: "Votre prêt", Body: "Bonjour,\nvoici la licence.",
+		Attachments: []Attachment{{Filename: "moby-dick.lcpl", ContentType: "application/vnd.readium.lcp.license.v1.0+json", Data: bytes.Repeat([]byte("{}"), 100)}}}
+	data, err := buildMessage(msg, time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	for _, expected := range []string{"To: ann@example.com\r\n", "Subject: =?utf-8?q?Votre_pr=C3=AAt?=\r\n", "multipart/mixed", "attachment; filename=moby-dick.lcpl", "voici la licence."} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("Expected %q in the message:\n%s", expected, text)
+		}
+	}
+}
+
+func TestAPIMailer(t *testing.T) {
+	var received apiMessage
+	var authorization string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer provider.Close()
+
+	n, err := New(config.FrontendMail{Provider: "api", APIURL: provider.URL, APIKey: "key", From: "library@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Notify(LoanReturned, "", "ann@example.com", Data{Name: "Ann", Title: "Moby Dick"}, Attachment{Filename: "a.txt", Data: []byte("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "Bearer key" || received.From != "library@example.com" || len(received.To) != 1 || received.To[0] != "ann@example.com" {
+		t.Errorf("Unexpected request %s %+v", authorization, received)
+	}
+	if received.Subject != `"Moby Dick" has been returned` || len(received.Attachments) != 1 || string(received.Attachments[0].Data) != "a" {
+		t.Errorf("Unexpected message %+v", received)
+	}
+
+	// no email is sent without a provider
+	if n, err = New(config.FrontendMail{}); n != nil || err != nil {
+		t.Errorf("Expected no notifier, got %v, %v", n, err)
+	}
+	if err = n.Notify(LoanReturned, "", "ann@example.com", Data{}); err != nil {
+		t.Errorf("Expected a nil notifier to send nothing, got %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package webpublication
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readium/readium-lcp-server/staging"
+)
+
+// Upload job status: a job is queued, then encrypted by a worker, and done or failed
+const (
+	JobQueued     string = "queued"
+	JobEncrypting string = "encrypting"
+	JobDone       string = "done"
+	JobFailed     string = "failed"
+)
+
+// DefaultUploadWorkers is the default number of workers which encrypt the uploaded publications
+const DefaultUploadWorkers = 2
+
+// ErrJobNotFound is returned when an upload job is not found
+var ErrJobNotFound = errors.New("Upload job not found")
+
+// ErrUnsupportedFile is returned when an uploaded file is neither an EPUB nor a PDF file
+var ErrUnsupportedFile = errors.New("Only EPUB and PDF files can be uploaded")
+
+// UploadJob is the encryption of an uploaded publication, or of a publication downloaded from a URL
+type UploadJob struct {
+	ID              int64     `json:"id"`
+	Title           string    `json:"title"`
+	Filename        string    `json:"filename,omitempty"`
+	URL             string    `json:"url,omitempty"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+	PublicationUUID string    `json:"publicationUuid,omitempty"`
+	Created         time.Time `json:"created"`
+	Updated         time.Time `json:"updated"`
+	// the local file to encrypt; it is removed once the job has ended
+	inputPath string
+}
+
+// uploadQueue wakes up the workers when a job is queued
+type uploadQueue struct {
+	wake chan struct{}
+}
+
+// uploadPollInterval is the interval at which idle workers look for queued jobs
+const uploadPollInterval = time.Minute
+
+// uploadClient downloads the publications given by their URL
+var uploadClient = &http.Client{
+	Timeout: 10 * time.Minute,
+}
+
+// uploadExtension returns the extension of a publication file, if it is supported
+func uploadExtension(name string) (string, error) {
+	ext := strings.ToLower(path.Ext(name))
+	if ext != ".epub" && ext != ".pdf" {
+		return "", ErrUnsupportedFile
+	}
+	return ext, nil
+}
+
+// SaveUpload stores an uploaded file in a temporary file, until it is encrypted by a job;
+// the extension of the file name selects the format of the publication. With a staging store,
+// the file is moved to the staging store, so that the job may be run by another instance of the frontend.
+func SaveUpload(r io.Reader, filename string) (string, error) {
+	inputPath, err := saveTempFile(r, filename)
+	if err != nil || !staging.Enabled() {
+		return inputPath, err
+	}
+	return staging.PutFile(inputPath)
+}
+
+// saveTempFile stores a publication in a local temporary file
+func saveTempFile(r io.Reader, filename string) (string, error) {
+	ext, err := uploadExtension(filename)
+	if err != nil {
+		return "", err
+	}
+	tmpfile, err := ioutil.TempFile("", "upload.*"+ext)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(tmpfile, r); err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return "", err
+	}
+	if err = tmpfile.Close(); err != nil {
+		os.Remove(tmpfile.Name())
+		return "", err
+	}
+	return tmpfile.Name(), nil
+}
+
+// EnqueueFile queues the encryption of an uploaded file, stored by SaveUpload
+//
+func (pubManager PublicationManager) EnqueueFile(title string, filename string, inputPath string) (UploadJob, error) {
+	return pubManager.enqueue(UploadJob{Title: title, Filename: filename, inputPath: inputPath})
+}
+
+// EnqueueURL queues the download and the encryption of a publication
+//
+func (pubManager PublicationManager) EnqueueURL(title string, publicationURL string) (UploadJob, error) {
+	u, err := url.Parse(publicationURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return UploadJob{}, errors.New("Invalid publication URL " + publicationURL)
+	}
+	if _, err = uploadExtension(u.Path); err != nil {
+		return UploadJob{}, err
+	}
+	if title == "" {
+		title = strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path))
+	}
+	return pubManager.enqueue(UploadJob{Title: title, Filename: path.Base(u.Path), URL: publicationURL})
+}
+
+func (pubManager PublicationManager) enqueue(job UploadJob) (UploadJob, error) {
+	if job.Title == "" {
+		job.Title = strings.TrimSuffix(job.Filename, path.Ext(job.Filename))
+	}
+	job.Status = JobQueued
+	job.Created = time.Now().UTC().Truncate(time.Second)
+	job.Updated = job.Created
+	result, err := pubManager.db.Exec(`INSERT INTO upload_job (title, filename, url, input_path, status, error, publication_uuid, created, updated)
+	VALUES (?, ?, ?, ?, ?, '', '', ?, ?)`, job.Title, job.Filename, job.URL, job.inputPath, job.Status, job.Created, job.Updated)
+	if err != nil {
+		return UploadJob{}, err
+	}
+	if job.ID, err = result.LastInsertId(); err != nil {
+		return UploadJob{}, err
+	}
+	if pubManager.uploads != nil {
+		select {
+		case pubManager.uploads.wake <- struct{}{}:
+		default:
+			// the workers are already awake
+		}
+	}
+	return job, nil
+}
+
+const uploadJobQuery = `SELECT id, title, filename, url, input_path, status, error, publication_uuid, created, updated FROM upload_job`
+
+func scanUploadJob(row interface{ Scan(...interface{}) error }) (UploadJob, error) {
+	var job UploadJob
+	err := row.Scan(&job.ID, &job.Title, &job.Filename, &job.URL, &job.inputPath, &job.Status, &job.Error, &job.PublicationUUID, &job.Created, &job.Updated)
+	return job, err
+}
+
+// GetUploadJob returns an upload job, for the polling of its status
+//
+func (pubManager PublicationManager) GetUploadJob(id int64) (UploadJob, error) {
+	job, err := scanUploadJob(pubManager.db.QueryRow(uploadJobQuery+" WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return UploadJob{}, ErrJobNotFound
+	}
+	return job, err
+}
+
+// ListUploadJobs lists the upload jobs, the most recent first
+// Parameters: page = number of items per page; pageNum = page offset (0 for the first page)
+//
+func (pubManager PublicationManager) ListUploadJobs(page int, pageNum int) func() (UploadJob, error) {
+	records, err := pubManager.db.Query(uploadJobQuery+" ORDER BY id DESC LIMIT ? OFFSET ?", page, pageNum*page)
+	if err != nil {
+		return func() (UploadJob, error) { return UploadJob{}, err }
+	}
+	return func() (UploadJob, error) {
+		if !records.Next() {
+			records.Close()
+			return UploadJob{}, ErrJobNotFound
+		}
+		return scanUploadJob(records)
+	}
+}
+
+// StartUploadWorkers starts the workers which encrypt the queued publications.
+// The jobs interrupted by a stop of the server are queued again.
+//
+func (pubManager PublicationManager) StartUploadWorkers(workers int) error {
+	if workers <= 0 {
+		workers = DefaultUploadWorkers
+	}
+	if _, err := pubManager.db.Exec("UPDATE upload_job SET status = ? WHERE status = ?", JobQueued, JobEncrypting); err != nil {
+		return err
+	}
+	for i := 0; i < workers; i++ {
+		go pubManager.uploadWorker()
+	}
+	return nil
+}
+
+func (pubManager PublicationManager) uploadWorker() {
+	ticker := time.NewTicker(uploadPollInterval)
+	defer ticker.Stop()
+	for {
+		// process the queued jobs, then wait for new ones
+		for pubManager.runNextUploadJob() {
+		}
+		select {
+		case <-pubManager.uploads.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// runNextUploadJob claims the oldest queued job and runs it; it returns false if there was no job to run
+func (pubManager PublicationManager) runNextUploadJob() bool {
+	for {
+		var id int64
+		err := pubManager.db.QueryRow("SELECT id FROM upload_job WHERE status = ? ORDER BY id LIMIT 1", JobQueued).Scan(&id)
+		if err == sql.ErrNoRows {
+			return false
+		}
+		if err != nil {
+			log.Println("Error reading the upload jobs: " + err.Error())
+			return false
+		}
+		// another worker may claim the same job
+		result, err := pubManager.db.Exec("UPDATE upload_job SET status = ?, updated = ? WHERE id = ? AND status = ?",
+			JobEncrypting, time.Now().UTC().Truncate(time.Second), id, JobQueued)
+		if err != nil {
+			log.Println("Error claiming an upload job: " + err.Error())
+			return false
+		}
+		if claimed, err := result.RowsAffected(); err == nil && claimed != 1 {
+			continue
+		}
+		job, err := pubManager.GetUploadJob(id)
+		if err != nil {
+			log.Println("Error reading an upload job: " + err.Error())
+			return false
+		}
+		pubManager.runUploadJob(job)
+		return true
+	}
+}
+
+// runUploadJob downloads the publication of a job if needed, encrypts it and records the result
+func (pubManager PublicationManager) runUploadJob(job UploadJob) {
+	var err error
+	if job.URL != "" && job.inputPath == "" {
+		job.inputPath, err = downloadPublication(job.URL)
+	}
+	if err == nil {
+		// the uploaded file may be in the staging store
+		var f *os.File
+		if f, err = staging.Open(job.inputPath); err == nil {
+			job.PublicationUUID, err = encryptPublication(f.Name(), Publication{Title: job.Title}, pubManager)
+			staging.Close(job.inputPath, f)
+		}
+	}
+	if job.inputPath != "" {
+		staging.Remove(job.inputPath)
+	}
+
+	job.Status = JobDone
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+		log.Println("Upload job " + strconv.FormatInt(job.ID, 10) + " (" + job.Title + ") failed: " + job.Error)
+	} else {
+		log.Println("Upload job " + strconv.FormatInt(job.ID, 10) + " (" + job.Title + ") encrypted as " + job.PublicationUUID)
+	}
+	_, err = pubManager.db.Exec("UPDATE upload_job SET status = ?, error = ?, publication_uuid = ?, input_path = '', updated = ? WHERE id = ?",
+		job.Status, job.Error, job.PublicationUUID, time.Now().UTC().Truncate(time.Second), job.ID)
+	if err != nil {
+		log.Println("Error updating an upload job: " + err.Error())
+	}
+}
+
+// downloadPublication downloads a publication in a temporary file
+func downloadPublication(publicationURL string) (string, error) {
+	u, err := url.Parse(publicationURL)
+	if err != nil {
+		return "", err
+	}
+	log.Println("GET " + publicationURL)
+	resp, err := uploadClient.Get(publicationURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("The download of the publication failed, status " + strconv.Itoa(resp.StatusCode))
+	}
+	return saveTempFile(resp.Body, path.Base(u.Path))
+}
+
+// uploadJobTableDef creates the table of the upload jobs
+const uploadJobTableDef = "CREATE TABLE IF NOT EXISTS upload_job (" +
+	"id integer NOT NULL PRIMARY KEY," +
+	"title varchar(255) NOT NULL," +
+	"filename varchar(255) NOT NULL DEFAULT ''," +
+	"url varchar(1024) NOT NULL DEFAULT ''," +
+	"input_path varchar(1024) NOT NULL DEFAULT ''," +
+	"status varchar(32) NOT NULL," +
+	"error text NOT NULL DEFAULT ''," +
+	"publication_uuid varchar(255) NOT NULL DEFAULT ''," +
+	"created datetime NOT NULL," +
+	"updated datetime NOT NULL" +
+	");" +
+	"CREATE INDEX IF NOT EXISTS idx_upload_job_status ON upload_job (status)"
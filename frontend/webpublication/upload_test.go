@@ -0,0 +1,115 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package webpublication
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/testsupport"
+)
+
+func TestUploadQueue(t *testing.T) {
+	// a License Server which accepts the contents
+	var stored []string
+	lcp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/contents/") {
+			stored = append(stored, strings.TrimPrefix(r.URL.Path, "/contents/"))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer lcp.Close()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	var cfg config.Configuration
+	cfg.FrontendServer.Database = "sqlite3://:memory:"
+	cfg.FrontendServer.EncryptedRepository = t.TempDir()
+	cfg.LcpServer.PublicBaseUrl = lcp.URL
+	i, err := Init(cfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := i.(PublicationManager)
+
+	epub, err := testsupport.SampleEPUB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputPath, err := SaveUpload(bytes.NewReader(epub), "Moby Dick.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SaveUpload(bytes.NewReader(epub), "notes.txt"); err != ErrUnsupportedFile {
+		t.Errorf("Expected a text file to be refused, got %v", err)
+	}
+	uploaded, err := pm.EnqueueFile("", "Moby Dick.epub", inputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded.Status != JobQueued || uploaded.Title != "Moby Dick" {
+		t.Errorf("Unexpected job %+v", uploaded)
+	}
+	downloaded, err := pm.EnqueueURL("Missing", lcp.URL+"/files/missing.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pm.EnqueueURL("", "ftp://example.com/book.epub"); err == nil {
+		t.Error("Expected an ftp URL to be refused")
+	}
+
+	// the jobs are run in order, then the queue is empty
+	if !pm.runNextUploadJob() || !pm.runNextUploadJob() || pm.runNextUploadJob() {
+		t.Fatal("Expected two jobs to be run")
+	}
+
+	job, err := pm.GetUploadJob(uploaded.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != JobDone || len(stored) != 1 || job.PublicationUUID != stored[0] {
+		t.Errorf("Expected the upload to be encrypted, got %+v", job)
+	}
+	if _, err = os.Stat(inputPath); !os.IsNotExist(err) {
+		t.Error("Expected the uploaded file to be removed")
+	}
+	if pub, err := pm.GetByUUID(job.PublicationUUID); err != nil || pub.Title != "Moby Dick" || pub.Status != StatusOk {
+		t.Errorf("Expected the publication to be stored, got %+v, %v", pub, err)
+	}
+
+	job, err = pm.GetUploadJob(downloaded.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != JobFailed || !strings.Contains(job.Error, "404") {
+		t.Errorf("Expected the download to fail, got %+v", job)
+	}
+
+	fn := pm.ListUploadJobs(10, 0)
+	var ids []int64
+	for job, err = fn(); err == nil; job, err = fn() {
+		ids = append(ids, job.ID)
+	}
+	if err != ErrJobNotFound || len(ids) != 2 || ids[0] != downloaded.ID {
+		t.Errorf("Expected the jobs, the most recent first, got %v, %v", ids, err)
+	}
+	if _, err = pm.GetUploadJob(42); err != ErrJobNotFound {
+		t.Errorf("Expected an unknown job, got %v", err)
+	}
+}
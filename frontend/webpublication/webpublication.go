@@ -10,13 +10,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,9 +23,13 @@ import (
 	"github.com/readium/readium-lcp-server/api"
 	"github.com/readium/readium-lcp-server/config"
 	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/index"
 	"github.com/readium/readium-lcp-server/lcpencrypt/encrypt"
 	"github.com/readium/readium-lcp-server/lcpserver/api"
 	"github.com/readium/readium-lcp-server/pack"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/servicetoken"
+	"github.com/readium/readium-lcp-server/staging"
 	"github.com/satori/go.uuid"
 
 	"github.com/Machiel/slugify"
@@ -44,6 +46,9 @@ const (
 // ErrNotFound error trown when publication is not found
 var ErrNotFound = errors.New("Publication not found")
 
+// ErrMetadataNotFound error thrown when the license server has no metadata for a publication
+var ErrMetadataNotFound = errors.New("Publication metadata not found")
+
 // WebPublication interface for publication db interaction
 type WebPublication interface {
 	Get(id int64) (Publication, error)
@@ -54,6 +59,12 @@ type WebPublication interface {
 	List(page int, pageNum int) func() (Publication, error)
 	UploadEPUB(*http.Request, http.ResponseWriter, Publication)
 	CheckByTitle(title string) (int64, error)
+	GetMetadata(pub Publication) (index.Metadata, error)
+	EnqueueFile(title string, filename string, inputPath string) (UploadJob, error)
+	EnqueueURL(title string, publicationURL string) (UploadJob, error)
+	GetUploadJob(id int64) (UploadJob, error)
+	ListUploadJobs(page int, pageNum int) func() (UploadJob, error)
+	StartUploadWorkers(workers int) error
 }
 
 // Publication struct defines a publication
@@ -67,8 +78,9 @@ type Publication struct {
 
 // PublicationManager helper
 type PublicationManager struct {
-	config config.Configuration
-	db     *sql.DB
+	config  config.Configuration
+	db      *sql.DB
+	uploads *uploadQueue
 }
 
 // Get gets a publication by its ID
@@ -149,10 +161,17 @@ func BuildWebPubPackage(pub Publication, inputPath string, outputPath string) er
 // EncryptPublication encrypts a Publication File and sends the content to the LCP server
 //
 func EncryptPublication(inputPath string, pub Publication, pubManager PublicationManager) error {
+	_, err := encryptPublication(inputPath, pub, pubManager)
+	return err
+}
+
+// encryptPublication encrypts a publication file, sends the content to the LCP server
+// and stores the publication; it returns the content id of the publication
+func encryptPublication(inputPath string, pub Publication, pubManager PublicationManager) (string, error) {
 	// generate a new uuid; this will be the content id in the lcp server
 	uid, err_u := uuid.NewV4()
 	if err_u != nil {
-		return err_u
+		return "", err_u
 	}
 	contentUUID := uid.String()
 
@@ -173,13 +192,13 @@ func EncryptPublication(inputPath string, pub Publication, pubManager Publicatio
 		err = BuildWebPubPackage(pub, inputPath, clearWebPubPath)
 		if err != nil {
 			log.Printf("Error building webpub package: %s", err)
-			return err
+			return "", err
 		}
 		encryptedPub, err = encrypt.EncryptWebPubPackage(pack.EncryptionProfile(pubManager.config.Profile), clearWebPubPath, outputPath)
 		// Remove the intermediate file
 		os.Remove(clearWebPubPath)
 	} else {
-		return errors.New("Could not match the filename")
+		return "", errors.New("Could not match the filename")
 	}
 
 	if err != nil {
@@ -187,7 +206,7 @@ func EncryptPublication(inputPath string, pub Publication, pubManager Publicatio
 		if _, statErr := os.Stat(inputPath); statErr == nil {
 			os.Remove(inputPath)
 		}
-		return err
+		return "", err
 	}
 
 	// prepare the import request to the lcp server
@@ -195,17 +214,24 @@ func EncryptPublication(inputPath string, pub Publication, pubManager Publicatio
 	lcpPublication := apilcp.LcpPublication{}
 	lcpPublication.ContentId = contentUUID
 	lcpPublication.ContentKey = encryptedPub.EncryptionKey
-	// both frontend and lcp server must understand this path (warning if using Docker containers)
+	// both frontend and lcp server must understand this path (warning if using Docker containers),
+	// unless the encrypted file is moved to the staging store shared by the servers
 	lcpPublication.Output = outputPath
+	if staging.Enabled() {
+		if lcpPublication.Output, err = staging.PutFile(outputPath); err != nil {
+			return "", err
+		}
+	}
 	lcpPublication.ContentDisposition = &contentDisposition
 	lcpPublication.Checksum = &encryptedPub.Checksum
 	lcpPublication.Size = &encryptedPub.Size
 	lcpPublication.ContentType = contentType
+	lcpPublication.Title = pub.Title
 
 	// json encode the payload
 	jsonBody, err := json.Marshal(lcpPublication)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// send the content to the LCP server
 	lcpServerConfig := pubManager.config.LcpServer
@@ -213,12 +239,11 @@ func EncryptPublication(inputPath string, pub Publication, pubManager Publicatio
 	log.Println("PUT " + lcpURL)
 	req, err := http.NewRequest("PUT", lcpURL, bytes.NewReader(jsonBody))
 	if err != nil {
-		return err
+		return "", err
 	}
 	// authenticate
-	lcpUpdateAuth := pubManager.config.LcpUpdateAuth
-	if pubManager.config.LcpUpdateAuth.Username != "" {
-		req.SetBasicAuth(lcpUpdateAuth.Username, lcpUpdateAuth.Password)
+	if err = servicetoken.Authorize(req, config.LcpServerName, pubManager.config.LcpUpdateAuth); err != nil {
+		return "", err
 	}
 	// set the payload type
 	req.Header.Add("Content-Type", api.ContentType_LCP_JSON)
@@ -229,12 +254,13 @@ func EncryptPublication(inputPath string, pub Publication, pubManager Publicatio
 	// sends the import request to the lcp server
 	resp, err := lcpClient.Do(req)
 	if err != nil {
-		return err
+		return "", err
 	}
 
+	resp.Body.Close()
 	if resp.StatusCode != 201 {
 		// error on creation
-		return err
+		return "", errors.New("The License Server refused the content, status " + strconv.Itoa(resp.StatusCode))
 	}
 
 	// store the new publication in the db
@@ -243,7 +269,7 @@ func EncryptPublication(inputPath string, pub Publication, pubManager Publicatio
 	pub.Status = StatusOk
 	dbAdd, err := pubManager.db.Prepare("INSERT INTO publication (uuid, title, status) VALUES ( ?, ?, ?)")
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer dbAdd.Close()
 
@@ -251,7 +277,48 @@ func EncryptPublication(inputPath string, pub Publication, pubManager Publicatio
 		pub.UUID,
 		pub.Title,
 		pub.Status)
-	return err
+	return contentUUID, err
+}
+
+// GetMetadata gets the metadata of a publication (title, author, isbn, cover)
+// from the LCP server, where it has been ingested from the catalog of the publisher
+//
+func (pubManager PublicationManager) GetMetadata(pub Publication) (index.Metadata, error) {
+	lcpServerConfig := pubManager.config.LcpServer
+	lcpURL := lcpServerConfig.PublicBaseUrl + "/contents/" + pub.UUID + "/metadata"
+	req, err := http.NewRequest("GET", lcpURL, nil)
+	if err != nil {
+		return index.Metadata{}, err
+	}
+	// authenticate
+	if err = servicetoken.Authorize(req, config.LcpServerName, pubManager.config.LcpUpdateAuth); err != nil {
+		return index.Metadata{}, err
+	}
+
+	var lcpClient = &http.Client{
+		Timeout: time.Second * 5,
+	}
+	resp, err := lcpClient.Do(req)
+	if err != nil {
+		return index.Metadata{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return index.Metadata{}, ErrMetadataNotFound
+	default:
+		return index.Metadata{}, errors.New("The License Server returned an error")
+	}
+
+	var metadata index.Metadata
+	dec := json.NewDecoder(resp.Body)
+	err = dec.Decode(&metadata)
+	if err != nil {
+		return index.Metadata{}, errors.New("Unable to decode the metadata")
+	}
+	return metadata, nil
 }
 
 // Add adds a new publication
@@ -270,36 +337,33 @@ func (pubManager PublicationManager) Add(pub Publication) error {
 	return EncryptPublication(inputPath, pub, pubManager)
 }
 
-// UploadEPUB creates a new EPUB file, namd after a file form parameter.
-// a temp file is created then deleted.
+// UploadEPUB stores a file, named after a file form parameter, in a temp file,
+// and queues its encryption; the temp file is deleted once encrypted.
 //
 func (pubManager PublicationManager) UploadEPUB(r *http.Request, w http.ResponseWriter, pub Publication) {
 
 	file, header, err := r.FormFile("file")
-
-	ext := filepath.Ext(header.Filename)
-
-	tmpfile, err := ioutil.TempFile("", "inputpub.*"+ext)
-
 	if err != nil {
-		fmt.Fprintln(w, err)
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
+	defer file.Close()
 
-	defer os.Remove(tmpfile.Name())
-
-	_, err = io.Copy(tmpfile, file)
-
-	if err := tmpfile.Close(); err != nil {
-		log.Fatal(err)
+	inputPath, err := SaveUpload(file, header.Filename)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
 	}
-	// encrypt the EPUB File and send the content to the LCP server
-	if err := EncryptPublication(tmpfile.Name(), pub, pubManager); err != nil {
-		log.Fatal(err)
+	// encrypt the EPUB File and send the content to the LCP server, in the background
+	if _, err := pubManager.EnqueueFile(pub.Title, header.Filename, inputPath); err != nil {
+		os.Remove(inputPath)
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
 	}
 
+	w.WriteHeader(http.StatusAccepted)
 	fmt.Fprintf(w, "File uploaded successfully : ")
-	fmt.Fprintf(w, header.Filename)
+	fmt.Fprint(w, header.Filename)
 }
 
 // Update updates a publication
@@ -361,7 +425,13 @@ func (pubManager PublicationManager) Delete(id int64) error {
 	}
 	result.Close()
 
-	// delete all purchases relative to this publication
+	// delete all purchases relative to this publication, their events and reminders
+	if _, err := pubManager.db.Exec(`DELETE FROM purchase_event WHERE purchase_id IN (SELECT id FROM purchase WHERE publication_id=?)`, id); err != nil {
+		return err
+	}
+	if _, err := pubManager.db.Exec(`DELETE FROM purchase_reminder WHERE purchase_id IN (SELECT id FROM purchase WHERE publication_id=?)`, id); err != nil {
+		return err
+	}
 	delPurchases, err := pubManager.db.Prepare(`DELETE FROM purchase WHERE publication_id=?`)
 	if err != nil {
 		return err
@@ -425,9 +495,14 @@ func Init(config config.Configuration, db *sql.DB) (i WebPublication, err error)
 			log.Println("Error creating publication table")
 			return
 		}
+		_, err = db.Exec(uploadJobTableDef)
+		if err != nil {
+			log.Println("Error creating upload_job table")
+			return
+		}
 	}
 
-	i = PublicationManager{config, db}
+	i = PublicationManager{config, db, &uploadQueue{wake: make(chan struct{}, 1)}}
 	return
 }
 
@@ -0,0 +1,87 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package webpurchase
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/Machiel/slugify"
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/frontend/webmail"
+	"github.com/readium/readium-lcp-server/license"
+)
+
+// mailData returns the values of the email templates for a purchase
+func (pManager PurchaseManager) mailData(p Purchase) webmail.Data {
+	data := webmail.Data{Name: p.User.Name, Title: p.Publication.Title}
+	if p.EndDate != nil {
+		data.EndDate = p.EndDate.UTC().Format("2006-01-02")
+	}
+	if p.LicenseUUID != nil {
+		data.LicenseID = *p.LicenseUUID
+		data.DownloadURL = pManager.licenseURL(p)
+	}
+	return data
+}
+
+// licenseURL returns the link to the license of a purchase: the public license link of the License Status Server if set,
+// else the license of the purchase on the frontend, which requires a session of the user
+func (pManager PurchaseManager) licenseURL(p Purchase) string {
+	if link := pManager.config.LsdServer.LicenseLinkUrl; link != "" {
+		return strings.Replace(link, "{license_id}", *p.LicenseUUID, -1)
+	}
+	return pManager.config.FrontendServer.PublicBaseUrl + "/api/v1/purchases/" + strconv.FormatInt(p.ID, 10) + "/license"
+}
+
+// sendMail sends an email to the user of a purchase, in the background
+func (pManager PurchaseManager) sendMail(kind string, p Purchase, data webmail.Data, attachments ...webmail.Attachment) {
+	go func() {
+		if err := pManager.notifier.Notify(kind, p.User.Language, p.User.Email, data, attachments...); err != nil {
+			log.Println("Error sending the email " + kind + " of the purchase " + strconv.FormatInt(p.ID, 10) + ": " + err.Error())
+		}
+	}()
+}
+
+// notifyLoan sends the license of a new loan to its user, attached or as a link
+func (pManager PurchaseManager) notifyLoan(p Purchase, lic license.License) {
+	if pManager.notifier == nil {
+		return
+	}
+	p.LicenseUUID = &lic.Id
+	data := pManager.mailData(p)
+	if !pManager.config.FrontendServer.Mail.AttachLicense {
+		pManager.sendMail(webmail.LoanCreated, p, data)
+		return
+	}
+	content, err := json.Marshal(lic)
+	if err != nil {
+		log.Println("Error encoding the license " + lic.Id + ": " + err.Error())
+		return
+	}
+	data.DownloadURL = ""
+	pManager.sendMail(webmail.LoanCreated, p, data, webmail.Attachment{
+		Filename:    slugify.Slugify(p.Publication.Title) + ".lcpl",
+		ContentType: api.ContentType_LCP_JSON,
+		Data:        content,
+	})
+}
+
+// notifyReturn confirms the return of a loan to its user
+func (pManager PurchaseManager) notifyReturn(purchaseID int64) {
+	if pManager.notifier == nil {
+		return
+	}
+	p, err := pManager.Get(purchaseID)
+	if err != nil {
+		log.Println("Error reading the purchase " + strconv.FormatInt(purchaseID, 10) + ": " + err.Error())
+		return
+	}
+	if p.Type == LOAN {
+		pManager.sendMail(webmail.LoanReturned, p, pManager.mailData(p))
+	}
+}
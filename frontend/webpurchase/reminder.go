@@ -0,0 +1,224 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package webpurchase
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/feature"
+	"github.com/readium/readium-lcp-server/frontend/webmail"
+)
+
+// DefaultReminderInterval is the default interval between the searches of the loans to remind, in minutes
+const DefaultReminderInterval = 60
+
+// ReminderEvent is the event of the webhooks and push notifications which remind the end of a loan
+const ReminderEvent = "loan_expiring"
+
+// SignatureHeader carries the HMAC-SHA256 of the body of the webhooks and push notifications, in hex
+const SignatureHeader = "X-LCP-Signature"
+
+// Reminder is the body of a webhook which reminds the end of a loan
+type Reminder struct {
+	Event           string    `json:"event"`
+	Days            int       `json:"days"`
+	End             time.Time `json:"end"`
+	PurchaseID      int64     `json:"purchaseId"`
+	PurchaseUUID    string    `json:"purchaseUuid"`
+	LicenseID       string    `json:"licenseId"`
+	UserUUID        string    `json:"userUuid"`
+	UserEmail       string    `json:"userEmail"`
+	PublicationUUID string    `json:"publicationUuid"`
+	Title           string    `json:"title"`
+}
+
+// pushNotification is the body of a push notification, posted to a push gateway
+type pushNotification struct {
+	User  string   `json:"user"`
+	Title string   `json:"title"`
+	Body  string   `json:"body"`
+	Data  Reminder `json:"data"`
+}
+
+var reminderClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// reminderThreshold returns the smallest number of days of a channel which covers the time left, 0 if none does
+func reminderThreshold(days []int, left time.Duration) int {
+	sorted := append([]int(nil), days...)
+	sort.Ints(sorted)
+	for _, d := range sorted {
+		if left <= time.Duration(d)*24*time.Hour {
+			return d
+		}
+	}
+	return 0
+}
+
+// channelKey identifies a reminder channel in the deduplication of the reminders
+func channelKey(ch config.ReminderChannel) string {
+	return ch.Type + ":" + ch.URL
+}
+
+// SendReminders reminds the users of the end of their loans, through the channels of the configuration.
+// A channel sends one reminder per loan and number of days, the smallest which covers the time left;
+// a renewed loan is reminded again before its new end. It returns the number of reminders sent.
+//
+func (pManager PurchaseManager) SendReminders(now time.Time) (int, error) {
+	var channels []config.ReminderChannel
+	for _, ch := range pManager.config.FrontendServer.Reminders.Channels {
+		// the push notifications are rolled out by provider
+		if ch.Type == "push" && !feature.Enabled(feature.PushReminders, pManager.config.FrontendServer.ProviderUri) {
+			continue
+		}
+		channels = append(channels, ch)
+	}
+	maxDays := 0
+	for _, ch := range channels {
+		for _, d := range ch.Days {
+			if d > maxDays {
+				maxDays = d
+			}
+		}
+	}
+	if maxDays == 0 {
+		return 0, nil
+	}
+
+	records, err := pManager.db.Query(purchaseManagerQuery+` WHERE p.type = ? AND p.state = ? AND p.end_date > ? AND p.end_date <= ?`,
+		LOAN, StateLicensed, now.UTC(), now.UTC().Add(time.Duration(maxDays)*24*time.Hour))
+	if err != nil {
+		return 0, err
+	}
+	var loans []Purchase
+	fn := convertRecordsToPurchases(records)
+	for p, err := fn(); err != ErrNotFound; p, err = fn() {
+		if err != nil {
+			records.Close()
+			return 0, err
+		}
+		loans = append(loans, p)
+	}
+
+	sent := 0
+	for _, p := range loans {
+		left := p.EndDate.Sub(now)
+		for _, ch := range channels {
+			days := reminderThreshold(ch.Days, left)
+			if days == 0 {
+				continue
+			}
+			// the reminder is recorded before it is sent, so that concurrent searches do not send it twice
+			end := p.EndDate.UTC().Truncate(time.Second)
+			_, err := pManager.db.Exec("INSERT INTO purchase_reminder (purchase_id, channel, days, end_date, sent) VALUES (?, ?, ?, ?, ?)",
+				p.ID, channelKey(ch), days, end, now.UTC().Truncate(time.Second))
+			if err != nil {
+				// already sent
+				continue
+			}
+			// the number of days announced is the number of days left, rounded up
+			reminderDays := int((left + 24*time.Hour - 1) / (24 * time.Hour))
+			if err = pManager.sendReminder(ch, p, reminderDays); err != nil {
+				log.Println("Error reminding the end of the purchase " + strconv.FormatInt(p.ID, 10) + " by " + ch.Type + ": " + err.Error())
+				// it will be sent again at the next search
+				pManager.db.Exec("DELETE FROM purchase_reminder WHERE purchase_id = ? AND channel = ? AND days = ? AND end_date = ?",
+					p.ID, channelKey(ch), days, end)
+				continue
+			}
+			sent++
+		}
+	}
+	if sent > 0 {
+		log.Println(strconv.Itoa(sent) + " reminders of the end of the loans sent")
+	}
+	return sent, nil
+}
+
+// sendReminder reminds the end of a loan through a channel
+func (pManager PurchaseManager) sendReminder(ch config.ReminderChannel, p Purchase, days int) error {
+	data := pManager.mailData(p)
+	data.Days = days
+	if ch.Type == "email" {
+		return pManager.notifier.Notify(webmail.LoanExpiring, p.User.Language, p.User.Email, data)
+	}
+
+	reminder := Reminder{
+		Event:           ReminderEvent,
+		Days:            days,
+		End:             p.EndDate.UTC(),
+		PurchaseID:      p.ID,
+		PurchaseUUID:    p.UUID,
+		UserUUID:        p.User.UUID,
+		UserEmail:       p.User.Email,
+		PublicationUUID: p.Publication.UUID,
+		Title:           p.Publication.Title,
+	}
+	if p.LicenseUUID != nil {
+		reminder.LicenseID = *p.LicenseUUID
+	}
+	var body interface{} = reminder
+	if ch.Type == "push" {
+		if pManager.templates == nil {
+			return errors.New("the templates of the notifications are not loaded")
+		}
+		title, text, err := pManager.templates.Render(webmail.LoanExpiring, p.User.Language, data)
+		if err != nil {
+			return err
+		}
+		body = pushNotification{User: p.User.UUID, Title: title, Body: text, Data: reminder}
+	}
+	return postSigned(ch.URL, ch.Secret, body)
+}
+
+// postSigned posts a json body, signed with a secret if it is set
+func postSigned(url string, secret string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(payload)
+		req.Header.Set(SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := reminderClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("the receiver returned the status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+// purchaseReminderTableDef creates the table of the reminders sent, which deduplicates them
+const purchaseReminderTableDef = "CREATE TABLE IF NOT EXISTS purchase_reminder (" +
+	"id integer NOT NULL PRIMARY KEY," +
+	"purchase_id integer NOT NULL," +
+	"channel varchar(255) NOT NULL," +
+	"days integer NOT NULL," +
+	"end_date datetime NOT NULL," +
+	"sent datetime NOT NULL," +
+	"FOREIGN KEY (purchase_id) REFERENCES purchase(id)" +
+	");" +
+	"CREATE UNIQUE INDEX IF NOT EXISTS idx_purchase_reminder ON purchase_reminder (purchase_id, channel, days, end_date)"
@@ -0,0 +1,98 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package webpurchase
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestReminderThreshold(t *testing.T) {
+	day := 24 * time.Hour
+	if d := reminderThreshold([]int{7, 1, 3}, 2*day); d != 3 {
+		t.Errorf("Expected the 3 days reminder, got %d", d)
+	}
+	if d := reminderThreshold([]int{7, 1, 3}, 12*time.Hour); d != 1 {
+		t.Errorf("Expected the 1 day reminder, got %d", d)
+	}
+	if d := reminderThreshold([]int{7}, 8*day); d != 0 {
+		t.Errorf("Expected no reminder, got %d", d)
+	}
+}
+
+func TestSendReminders(t *testing.T) {
+	var reminders []Reminder
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		if r.Header.Get(SignatureHeader) != hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var reminder Reminder
+		json.Unmarshal(body, &reminder)
+		reminders = append(reminders, reminder)
+	}))
+	defer receiver.Close()
+
+	pm, db := openManager(t)
+	defer db.Close()
+	pm.config.FrontendServer.Reminders.Channels = []config.ReminderChannel{{Type: "webhook", Days: []int{7, 3}, URL: receiver.URL, Secret: "secret"}}
+
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	end := now.Add(50 * time.Hour)
+	p := Purchase{UUID: "purchase-1", Type: LOAN, EndDate: &end}
+	p.User.ID, p.Publication.ID = 1, 1
+	if err := pm.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	p, _ = pm.GetByUUID("purchase-1")
+	if err := pm.Transition(p.ID, StateLicensed, "license l1"); err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("UPDATE purchase SET license_uuid = 'l1', end_date = ? WHERE id = ?", end, p.ID)
+
+	sent, err := pm.SendReminders(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || len(reminders) != 1 {
+		t.Fatalf("Expected a reminder, got %d", sent)
+	}
+	if r := reminders[0]; r.Event != ReminderEvent || r.Days != 3 || r.LicenseID != "l1" || r.UserEmail != "user@example.com" || !r.End.Equal(end) {
+		t.Errorf("Unexpected reminder %+v", r)
+	}
+	// the user is not reminded twice
+	if sent, _ = pm.SendReminders(now.Add(time.Hour)); sent != 0 {
+		t.Errorf("Expected no reminder, got %d", sent)
+	}
+
+	// a renewed loan is reminded again
+	end = end.Add(4 * 24 * time.Hour)
+	db.Exec("UPDATE purchase SET end_date = ? WHERE id = ?", end, p.ID)
+	if sent, _ = pm.SendReminders(now.Add(2 * time.Hour)); sent != 1 || reminders[1].Days != 6 {
+		t.Errorf("Expected a reminder of the renewed loan, got %d", sent)
+	}
+
+	// a failed reminder is sent again
+	pm.config.FrontendServer.Reminders.Channels[0].Secret = "wrong"
+	if sent, _ = pm.SendReminders(now.Add(4 * 24 * time.Hour)); sent != 0 {
+		t.Errorf("Expected the reminder to fail, got %d", sent)
+	}
+	pm.config.FrontendServer.Reminders.Channels[0].Secret = "secret"
+	if sent, _ = pm.SendReminders(now.Add(4 * 24 * time.Hour)); sent != 1 || reminders[2].Days != 3 {
+		t.Errorf("Expected the failed reminder to be sent again, got %d", sent)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package webpurchase
+
+import (
+	"errors"
+	"time"
+
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license"
+)
+
+// ErrNotALoan is returned when the extension of a purchase which is not a loan is requested
+var ErrNotALoan = errors.New("Only a loan can be extended")
+
+// ErrMaxRenewals is returned when a loan has already been renewed the maximum number of times
+var ErrMaxRenewals = errors.New("The loan has reached the maximum number of renewals")
+
+// ErrRenewalWindow is returned when a loan is renewed too long before its end
+var ErrRenewalWindow = errors.New("The loan cannot be renewed yet")
+
+// RenewalPolicy is the policy of the loan extensions
+type RenewalPolicy struct {
+	MaxRenewals int           // unlimited if zero
+	Window      time.Duration // the loan may be renewed any time if zero
+	Extension   time.Duration // the License Status Server chooses the renew period if zero
+}
+
+// NewRenewalPolicy returns the renewal policy of a configuration
+func NewRenewalPolicy(c config.FrontendRenewal) RenewalPolicy {
+	day := 24 * time.Hour
+	return RenewalPolicy{
+		MaxRenewals: c.MaxRenewals,
+		Window:      time.Duration(c.WindowDays) * day,
+		Extension:   time.Duration(c.Days) * day,
+	}
+}
+
+// Check checks if a loan renewed a number of times may be renewed now,
+// and returns the requested end of the loan, nil if the License Status Server chooses it
+func (policy RenewalPolicy) Check(p Purchase, renewals int, now time.Time) (*time.Time, error) {
+	if p.Type != LOAN {
+		return nil, ErrNotALoan
+	}
+	if p.State != StateLicensed || p.LicenseUUID == nil {
+		return nil, ErrInvalidTransition
+	}
+	if policy.MaxRenewals > 0 && renewals >= policy.MaxRenewals {
+		return nil, ErrMaxRenewals
+	}
+	if p.EndDate == nil {
+		if policy.Extension > 0 {
+			end := now.Add(policy.Extension).UTC().Truncate(time.Second)
+			return &end, nil
+		}
+		return nil, nil
+	}
+	if policy.Window > 0 && now.Before(p.EndDate.Add(-policy.Window)) {
+		return nil, ErrRenewalWindow
+	}
+	if policy.Extension > 0 {
+		// an expired loan is extended from now
+		from := *p.EndDate
+		if from.Before(now) {
+			from = now
+		}
+		end := from.Add(policy.Extension).UTC().Truncate(time.Second)
+		return &end, nil
+	}
+	return nil, nil
+}
+
+// countRenewals counts the renewals of a purchase, recorded as events which keep it licensed
+func (pManager PurchaseManager) countRenewals(purchaseID int64) (int, error) {
+	var count int
+	err := pManager.db.QueryRow(`SELECT COUNT(*) FROM purchase_event
+	WHERE purchase_id = ? AND from_state = ? AND to_state = ? AND detail LIKE 'renewed%'`,
+		purchaseID, StateLicensed, StateLicensed).Scan(&count)
+	return count, err
+}
+
+// Renew extends a loan on the request of its patron, according to the renewal policy of the configuration:
+// the loan is renewed on the License Status Server, then the refreshed license is fetched from the License Server.
+//
+func (pManager PurchaseManager) Renew(p Purchase) (license.License, error) {
+	renewals, err := pManager.countRenewals(p.ID)
+	if err != nil {
+		return license.License{}, err
+	}
+	end, err := NewRenewalPolicy(pManager.config.FrontendServer.Renewal).Check(p, renewals, clock.Now())
+	if err != nil {
+		return license.License{}, err
+	}
+	p.Status = StatusToBeRenewed
+	p.EndDate = end
+	if err = pManager.Update(p); err != nil {
+		return license.License{}, err
+	}
+	return pManager.GenerateOrGetLicense(p)
+}
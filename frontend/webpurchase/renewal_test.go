@@ -0,0 +1,78 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package webpurchase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestRenewalPolicy(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	licenseID := "l1"
+	end := now.Add(48 * time.Hour)
+	loan := Purchase{Type: LOAN, State: StateLicensed, LicenseUUID: &licenseID, EndDate: &end}
+
+	policy := NewRenewalPolicy(config.FrontendRenewal{MaxRenewals: 2, WindowDays: 3, Days: 7})
+	newEnd, err := policy.Check(loan, 1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newEnd == nil || !newEnd.Equal(end.Add(7*24*time.Hour)) {
+		t.Errorf("Expected the loan to be extended by 7 days, got %v", newEnd)
+	}
+	if _, err = policy.Check(loan, 2, now); err != ErrMaxRenewals {
+		t.Errorf("Expected the maximum number of renewals to be reached, got %v", err)
+	}
+	if _, err = policy.Check(loan, 0, now.Add(-48*time.Hour)); err != ErrRenewalWindow {
+		t.Errorf("Expected the renewal to be refused before the window, got %v", err)
+	}
+	// an expired loan is extended from now
+	if newEnd, _ = policy.Check(loan, 0, end.Add(time.Hour)); newEnd == nil || !newEnd.Equal(end.Add(time.Hour+7*24*time.Hour)) {
+		t.Errorf("Expected the expired loan to be extended from now, got %v", newEnd)
+	}
+
+	buy := loan
+	buy.Type = BUY
+	if _, err = policy.Check(buy, 0, now); err != ErrNotALoan {
+		t.Errorf("Expected a purchase not to be renewed, got %v", err)
+	}
+	returned := loan
+	returned.State = StateReturned
+	if _, err = policy.Check(returned, 0, now); err != ErrInvalidTransition {
+		t.Errorf("Expected a returned loan not to be renewed, got %v", err)
+	}
+
+	// without policy, the License Status Server chooses the end of the loan
+	if newEnd, err = NewRenewalPolicy(config.FrontendRenewal{}).Check(loan, 10, now.Add(-30*24*time.Hour)); err != nil || newEnd != nil {
+		t.Errorf("Expected an unrestricted renewal, got %v, %v", newEnd, err)
+	}
+}
+
+func TestCountRenewals(t *testing.T) {
+	pm, db := openManager(t)
+	defer db.Close()
+	p := Purchase{UUID: "purchase-1", Type: LOAN}
+	p.User.ID, p.Publication.ID = 1, 1
+	if err := pm.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	p, _ = pm.GetByUUID("purchase-1")
+	if err := pm.Transition(p.ID, StateLicensed, "license l1"); err != nil {
+		t.Fatal(err)
+	}
+	pm.recordEvent(p.ID, StateLicensed, "renewed until 2020-03-08T12:00:00Z")
+	pm.recordEvent(p.ID, StateLicensed, "renewed")
+
+	count, err := pm.countRenewals(p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 renewals, got %d", count)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package webpurchase
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/readium/readium-lcp-server/clock"
+)
+
+// The states of a purchase: a purchase is created, then licensed when its license is generated;
+// a licensed purchase ends when it is returned, expired or revoked.
+const (
+	StateCreated  string = "created"
+	StateLicensed string = "licensed"
+	StateReturned string = "returned"
+	StateExpired  string = "expired"
+	StateRevoked  string = "revoked"
+)
+
+// transitions lists the states which follow each state
+var transitions = map[string][]string{
+	StateCreated:  {StateLicensed, StateRevoked},
+	StateLicensed: {StateReturned, StateExpired, StateRevoked},
+}
+
+// ErrInvalidTransition is returned when a purchase cannot go from its state to another one
+var ErrInvalidTransition = errors.New("Invalid transition of the purchase state")
+
+// CanTransition checks if a purchase can go from a state to another one
+func CanTransition(from, to string) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Event records a transition of a purchase, or a renewal of a loan, which keeps it licensed
+type Event struct {
+	ID         int64     `json:"id"`
+	PurchaseID int64     `json:"purchaseId"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Timestamp  time.Time `json:"timestamp"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// Transition moves a purchase to a new state and records the event.
+// The state is checked and changed in a transaction, so that concurrent transitions cannot both succeed.
+//
+func (pManager PurchaseManager) Transition(purchaseID int64, to string, detail string) error {
+	tx, err := pManager.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var from string
+	err = tx.QueryRow("SELECT state FROM purchase WHERE id = ?", purchaseID).Scan(&from)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !CanTransition(from, to) {
+		return ErrInvalidTransition
+	}
+	now := clock.Now().UTC().Truncate(time.Second)
+	result, err := tx.Exec("UPDATE purchase SET state = ?, state_updated = ? WHERE id = ? AND state = ?", to, now, purchaseID, from)
+	if err != nil {
+		return err
+	}
+	if changed, err := result.RowsAffected(); err == nil && changed != 1 {
+		return ErrInvalidTransition
+	}
+	if err = insertEvent(tx, Event{PurchaseID: purchaseID, From: from, To: to, Timestamp: now, Detail: detail}); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	if to == StateReturned {
+		pManager.notifyReturn(purchaseID)
+	}
+	return nil
+}
+
+// recordEvent records an event which does not change the state of a purchase
+func (pManager PurchaseManager) recordEvent(purchaseID int64, state string, detail string) error {
+	return insertEvent(pManager.db, Event{PurchaseID: purchaseID, From: state, To: state, Timestamp: clock.Now().UTC().Truncate(time.Second), Detail: detail})
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertEvent(db execer, e Event) error {
+	_, err := db.Exec("INSERT INTO purchase_event (purchase_id, from_state, to_state, timestamp, detail) VALUES (?, ?, ?, ?, ?)",
+		e.PurchaseID, e.From, e.To, e.Timestamp, e.Detail)
+	return err
+}
+
+// ListEvents lists the events of a purchase, in chronological order
+//
+func (pManager PurchaseManager) ListEvents(purchaseID int64) ([]Event, error) {
+	rows, err := pManager.db.Query(`SELECT id, purchase_id, from_state, to_state, timestamp, detail
+	FROM purchase_event WHERE purchase_id = ? ORDER BY timestamp, id`, purchaseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := make([]Event, 0)
+	for rows.Next() {
+		var e Event
+		if err = rows.Scan(&e.ID, &e.PurchaseID, &e.From, &e.To, &e.Timestamp, &e.Detail); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// lsdStates maps the final statuses of the licenses to the states of the purchases
+var lsdStates = map[string]string{
+	"returned":  StateReturned,
+	"expired":   StateExpired,
+	"revoked":   StateRevoked,
+	"cancelled": StateRevoked,
+}
+
+// SyncStates ends the licensed purchases whose license has ended on the License Status Server,
+// as reported by the statuses fetched in the license view. It returns the number of purchases which changed.
+//
+func (pManager PurchaseManager) SyncStates() (int, error) {
+	rows, err := pManager.db.Query(`SELECT p.id, lv.status FROM purchase p
+	INNER JOIN license_view lv ON lv.uuid = p.license_uuid
+	WHERE p.state = ? AND lv.status IN ('returned', 'expired', 'revoked', 'cancelled')`, StateLicensed)
+	if err != nil {
+		return 0, err
+	}
+	type ended struct {
+		id     int64
+		status string
+	}
+	var list []ended
+	for rows.Next() {
+		var e ended
+		if err = rows.Scan(&e.id, &e.status); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		list = append(list, e)
+	}
+	rows.Close()
+
+	changed := 0
+	for _, e := range list {
+		err = pManager.Transition(e.id, lsdStates[e.status], "license "+e.status+" on the License Status Server")
+		if err == ErrInvalidTransition {
+			// changed meanwhile
+			continue
+		}
+		if err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	if changed > 0 {
+		log.Println(strconv.Itoa(changed) + " purchases ended by the License Status Server")
+	}
+	return changed, nil
+}
+
+// ChangeState moves a purchase to a final state on the request of the staff, with its effect on the license:
+// a returned loan is returned to the License Status Server, a revoked license is revoked there;
+// an expired purchase only changes its state.
+//
+func (pManager PurchaseManager) ChangeState(p Purchase, to string, detail string) error {
+	switch to {
+	case StateReturned:
+		if p.State != StateLicensed {
+			return ErrInvalidTransition
+		}
+		p.Status = StatusToBeReturned
+		return pManager.Update(p)
+	case StateRevoked:
+		if !CanTransition(p.State, StateRevoked) {
+			return ErrInvalidTransition
+		}
+		if p.LicenseUUID != nil {
+			if err := pManager.revokeLicense(*p.LicenseUUID, detail); err != nil {
+				return err
+			}
+		}
+		return pManager.Transition(p.ID, StateRevoked, detail)
+	case StateExpired:
+		return pManager.Transition(p.ID, StateExpired, detail)
+	}
+	return ErrInvalidTransition
+}
+
+// purchaseEventTableDef creates the table of the purchase events
+const purchaseEventTableDef = "CREATE TABLE IF NOT EXISTS purchase_event (" +
+	"id integer NOT NULL PRIMARY KEY," +
+	"purchase_id integer NOT NULL," +
+	"from_state varchar(32) NOT NULL," +
+	"to_state varchar(32) NOT NULL," +
+	"timestamp datetime NOT NULL," +
+	"detail varchar(255) NOT NULL DEFAULT ''," +
+	"FOREIGN KEY (purchase_id) REFERENCES purchase(id)" +
+	");" +
+	"CREATE INDEX IF NOT EXISTS idx_purchase_event ON purchase_event (purchase_id)"
@@ -0,0 +1,109 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package webpurchase
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/frontend/weblicense"
+	"github.com/readium/readium-lcp-server/frontend/webpublication"
+	"github.com/readium/readium-lcp-server/frontend/webuser"
+)
+
+func openManager(t *testing.T) (PurchaseManager, *sql.DB) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	var cfg config.Configuration
+	cfg.FrontendServer.Database = "sqlite3://:memory:"
+	config.Config.FrontendServer.Database = cfg.FrontendServer.Database
+	if _, err = webuser.Open(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = webpublication.Init(cfg, db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = weblicense.Init(cfg, db); err != nil {
+		t.Fatal(err)
+	}
+	i, err := Init(cfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("INSERT INTO user (uuid, name, email, password, hint) VALUES ('u1', 'user', 'user@example.com', '', '')")
+	db.Exec("INSERT INTO publication (uuid, title, status) VALUES ('p1', 'title', 'ok')")
+	return i.(PurchaseManager), db
+}
+
+func TestTransitions(t *testing.T) {
+	if !CanTransition(StateCreated, StateLicensed) || !CanTransition(StateLicensed, StateReturned) {
+		t.Error("Expected the lifecycle transitions to be allowed")
+	}
+	if CanTransition(StateReturned, StateLicensed) || CanTransition(StateCreated, StateReturned) || CanTransition(StateRevoked, StateRevoked) {
+		t.Error("Expected the transitions out of the lifecycle to be refused")
+	}
+
+	pm, db := openManager(t)
+	defer db.Close()
+	p := Purchase{UUID: "purchase-1", Type: LOAN}
+	p.User.ID, p.Publication.ID = 1, 1
+	if err := pm.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	p, err := pm.GetByUUID("purchase-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.State != StateCreated {
+		t.Errorf("Expected a new purchase to be created, got %s", p.State)
+	}
+
+	if err = pm.Transition(p.ID, StateReturned, ""); err != ErrInvalidTransition {
+		t.Errorf("Expected a created purchase not to be returned, got %v", err)
+	}
+	if err = pm.Transition(p.ID, StateLicensed, "license l1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = pm.Transition(p.ID, StateLicensed, "license l2"); err != ErrInvalidTransition {
+		t.Errorf("Expected a purchase not to be licensed twice, got %v", err)
+	}
+	db.Exec("UPDATE purchase SET license_uuid = 'l1' WHERE id = ?", p.ID)
+
+	// the license is returned on the License Status Server
+	db.Exec("INSERT INTO license_view (uuid, device_count, status, message) VALUES ('l1', 1, 'returned', '')")
+	changed, err := pm.SyncStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 1 {
+		t.Errorf("Expected a purchase to be ended, got %d", changed)
+	}
+	if changed, _ = pm.SyncStates(); changed != 0 {
+		t.Errorf("Expected the synchronization to be idempotent, got %d", changed)
+	}
+
+	events, err := pm.ListEvents(p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{StateCreated, StateLicensed, StateReturned}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %+v", len(expected), events)
+	}
+	for i, e := range events {
+		if e.To != expected[i] || (i > 0 && e.From != expected[i-1]) {
+			t.Errorf("Unexpected event %d: %+v", i, e)
+		}
+	}
+	if p, _ = pm.GetByUUID("purchase-1"); p.State != StateReturned || p.StateUpdated == nil {
+		t.Errorf("Expected the purchase to be returned, got %s", p.State)
+	}
+}
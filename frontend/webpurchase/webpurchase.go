@@ -13,15 +13,20 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/clock"
 	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
+	"github.com/readium/readium-lcp-server/frontend/webmail"
 	"github.com/readium/readium-lcp-server/frontend/webpublication"
 	"github.com/readium/readium-lcp-server/frontend/webuser"
 	"github.com/readium/readium-lcp-server/license"
 	"github.com/readium/readium-lcp-server/license_statuses"
+	"github.com/readium/readium-lcp-server/servicetoken"
 	"github.com/satori/go.uuid"
 )
 
@@ -36,7 +41,8 @@ p.id, p.uuid,
 p.type, p.transaction_date,
 p.license_uuid,
 p.start_date, p.end_date, p.status,
-u.id, u.uuid, u.name, u.email, u.password, u.hint,
+p.state, p.state_updated,
+u.id, u.uuid, u.name, u.email, u.password, u.hint, u.language,
 pu.id, pu.uuid, pu.title, pu.status
 FROM purchase p
 left join user u on (p.user_id=u.id)
@@ -47,15 +53,25 @@ type WebPurchase interface {
 	Get(id int64) (Purchase, error)
 	GenerateOrGetLicense(purchase Purchase) (license.License, error)
 	GetPartialLicense(purchase Purchase) (license.License, error)
+	GetLicensedPublication(purchase Purchase) (*http.Response, error)
 	GetLicenseStatusDocument(purchase Purchase) (licensestatuses.LicenseStatus, error)
 	GetByLicenseID(licenseID string) (Purchase, error)
+	GetByUUID(uuid string) (Purchase, error)
 	List(page int, pageNum int) func() (Purchase, error)
+	ListSorted(listing dbutils.Listing) func() (Purchase, error)
 	ListByUser(userID int64, page int, pageNum int) func() (Purchase, error)
 	Add(p Purchase) error
 	Update(p Purchase) error
+	Transition(purchaseID int64, to string, detail string) error
+	ChangeState(p Purchase, to string, detail string) error
+	ListEvents(purchaseID int64) ([]Event, error)
+	SyncStates() (int, error)
+	Renew(p Purchase) (license.License, error)
+	SendReminders(now time.Time) (int, error)
 }
 
-// Purchase status
+// Purchase status: the status of the last request on the purchase; "to-be-renewed" and "to-be-returned"
+// are requests sent to the License Status Server on an update. The lifecycle of the purchase is its state.
 const (
 	StatusToBeRenewed  string = "to-be-renewed"
 	StatusToBeReturned string = "to-be-returned"
@@ -72,22 +88,26 @@ const (
 //Purchase struct defines a user in json and database
 //PurchaseType: BUY or LOAN
 type Purchase struct {
-	ID              int64                      `json:"id, omitempty"`
+	ID              int64                      `json:"id"`
 	UUID            string                     `json:"uuid"`
 	Publication     webpublication.Publication `json:"publication"`
 	User            webuser.User               `json:"user"`
 	LicenseUUID     *string                    `json:"licenseUuid,omitempty"`
 	Type            string                     `json:"type"`
-	TransactionDate time.Time                  `json:"transactionDate, omitempty"`
-	StartDate       *time.Time                 `json:"startDate, omitempty"`
-	EndDate         *time.Time                 `json:"endDate, omitempty"`
+	TransactionDate time.Time                  `json:"transactionDate"`
+	StartDate       *time.Time                 `json:"startDate"`
+	EndDate         *time.Time                 `json:"endDate"`
 	Status          string                     `json:"status"`
-	MaxEndDate      *time.Time                 `json:"maxEndDate, omitempty"`
+	MaxEndDate      *time.Time                 `json:"maxEndDate"`
+	State           string                     `json:"state"`
+	StateUpdated    *time.Time                 `json:"stateUpdated,omitempty"`
 }
 
 type PurchaseManager struct {
-	config config.Configuration
-	db     *sql.DB
+	config    config.Configuration
+	db        *sql.DB
+	notifier  *webmail.Notifier
+	templates *webmail.Templates // the templates of the push notifications
 }
 
 func convertRecordsToPurchases(records *sql.Rows) func() (Purchase, error) {
@@ -122,12 +142,15 @@ func convertRecordToPurchase(records *sql.Rows) (Purchase, error) {
 		&purchase.StartDate,
 		&purchase.EndDate,
 		&purchase.Status,
+		&purchase.State,
+		&purchase.StateUpdated,
 		&user.ID,
 		&user.UUID,
 		&user.Name,
 		&user.Email,
 		&user.Password,
 		&user.Hint,
+		&user.Language,
 		&pub.ID,
 		&pub.UUID,
 		&pub.Title,
@@ -183,12 +206,9 @@ func (pManager PurchaseManager) Get(id int64) (Purchase, error) {
 	return Purchase{}, ErrNotFound
 }
 
-// GenerateOrGetLicense generates a new license associated with a purchase,
-// or gets an existing license,
-// depending on the value of the license id in the purchase.
-//
-func (pManager PurchaseManager) GenerateOrGetLicense(purchase Purchase) (license.License, error) {
-	// create a partial license
+// newPartialLicense returns the partial license sent to the License Server for a purchase:
+// the provider, the user and its passphrase hash
+func newPartialLicense(purchase Purchase) (license.License, error) {
 	partialLicense := license.License{}
 
 	// set the mandatory provider URI
@@ -216,6 +236,22 @@ func (pManager PurchaseManager) GenerateOrGetLicense(purchase Purchase) (license
 	userKey.Hint = purchase.User.Hint
 	userKey.Value = userKeyValue
 	partialLicense.Encryption.UserKey = userKey
+	return partialLicense, nil
+}
+
+// GenerateOrGetLicense generates a new license associated with a purchase,
+// or gets an existing license,
+// depending on the value of the license id in the purchase.
+//
+func (pManager PurchaseManager) GenerateOrGetLicense(purchase Purchase) (license.License, error) {
+	// a license is only generated for a new purchase
+	if purchase.LicenseUUID == nil && purchase.State != StateCreated {
+		return license.License{}, ErrInvalidTransition
+	}
+	partialLicense, err := newPartialLicense(purchase)
+	if err != nil {
+		return license.License{}, err
+	}
 
 	// In case of a creation of license, add the user rights
 	var copy, print int32
@@ -248,7 +284,8 @@ func (pManager PurchaseManager) GenerateOrGetLicense(purchase Purchase) (license
 
 	if purchase.LicenseUUID == nil {
 		// if the purchase contains no license id, generate a new license
-		lcpURL = lcpServerConfig.PublicBaseUrl + "/contents/" + purchase.Publication.UUID + "/license"
+		// the purchase is the external reference of the license
+		lcpURL = lcpServerConfig.PublicBaseUrl + "/contents/" + purchase.Publication.UUID + "/license?reference=" + url.QueryEscape(purchase.UUID)
 	} else {
 		// if the purchase contains a license id, fetch an existing license
 		// note: this will not update the license rights
@@ -262,9 +299,8 @@ func (pManager PurchaseManager) GenerateOrGetLicense(purchase Purchase) (license
 	if err != nil {
 		return license.License{}, err
 	}
-	lcpUpdateAuth := pManager.config.LcpUpdateAuth
-	if pManager.config.LcpUpdateAuth.Username != "" {
-		req.SetBasicAuth(lcpUpdateAuth.Username, lcpUpdateAuth.Password)
+	if err = servicetoken.Authorize(req, config.LcpServerName, pManager.config.LcpUpdateAuth); err != nil {
+		return license.License{}, err
 	}
 	// the body is a partial license in json format
 	req.Header.Add("Content-Type", api.ContentType_LCP_JSON)
@@ -300,10 +336,17 @@ func (pManager PurchaseManager) GenerateOrGetLicense(purchase Purchase) (license
 	// store the license id if it was not already set
 	if purchase.LicenseUUID == nil {
 		purchase.LicenseUUID = &fullLicense.Id
-		pManager.Update(purchase)
+		err = pManager.Update(purchase)
 		if err != nil {
 			return license.License{}, errors.New("Unable to update the license id")
 		}
+		err = pManager.Transition(purchase.ID, StateLicensed, "license "+fullLicense.Id)
+		if err != nil {
+			return license.License{}, err
+		}
+		if purchase.Type == LOAN {
+			pManager.notifyLoan(purchase, fullLicense)
+		}
 	}
 
 	return fullLicense, nil
@@ -327,9 +370,8 @@ func (pManager PurchaseManager) GetPartialLicense(purchase Purchase) (license.Li
 		return license.License{}, err
 	}
 	// set credentials
-	lcpUpdateAuth := pManager.config.LcpUpdateAuth
-	if pManager.config.LcpUpdateAuth.Username != "" {
-		req.SetBasicAuth(lcpUpdateAuth.Username, lcpUpdateAuth.Password)
+	if err = servicetoken.Authorize(req, config.LcpServerName, pManager.config.LcpUpdateAuth); err != nil {
+		return license.License{}, err
 	}
 	// send the request
 	var lcpClient = &http.Client{
@@ -360,6 +402,49 @@ func (pManager PurchaseManager) GetPartialLicense(purchase Purchase) (license.Li
 	return partialLicense, nil
 }
 
+// GetLicensedPublication requests the publication of a purchase with its license embedded
+// from the License Server; the license must have been generated. The caller reads the publication
+// from the body of the response, and closes it.
+//
+func (pManager PurchaseManager) GetLicensedPublication(purchase Purchase) (*http.Response, error) {
+	if purchase.LicenseUUID == nil {
+		return nil, errors.New("No license has been yet delivered")
+	}
+	partialLicense, err := newPartialLicense(purchase)
+	if err != nil {
+		return nil, err
+	}
+	jsonBody, err := json.Marshal(partialLicense)
+	if err != nil {
+		return nil, err
+	}
+
+	lcpURL := pManager.config.LcpServer.PublicBaseUrl + "/licenses/" + *purchase.LicenseUUID + "/publication"
+	log.Println("POST " + lcpURL)
+	req, err := http.NewRequest("POST", lcpURL, bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	if err = servicetoken.Authorize(req, config.LcpServerName, pManager.config.LcpUpdateAuth); err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", api.ContentType_LCP_JSON)
+
+	// the publication may be large: only the wait for the response is limited
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Second * 30
+	lcpClient := &http.Client{Transport: transport}
+	resp, err := lcpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		resp.Body.Close()
+		return nil, errors.New("The License Server returned an error")
+	}
+	return resp, nil
+}
+
 // GetLicenseStatusDocument gets a license status document associated with a purchase
 //
 func (pManager PurchaseManager) GetLicenseStatusDocument(purchase Purchase) (licensestatuses.LicenseStatus, error) {
@@ -424,6 +509,28 @@ func (pManager PurchaseManager) GetByLicenseID(licenseID string) (Purchase, erro
 	return Purchase{}, ErrNotFound
 }
 
+// GetByUUID gets a purchase by its uuid
+//
+func (pManager PurchaseManager) GetByUUID(uuid string) (Purchase, error) {
+	dbGetByUUIDQuery := purchaseManagerQuery + ` WHERE p.uuid = ? LIMIT 1`
+	dbGetByUUID, err := pManager.db.Prepare(dbGetByUUIDQuery)
+	if err != nil {
+		return Purchase{}, err
+	}
+	defer dbGetByUUID.Close()
+
+	records, err := dbGetByUUID.Query(uuid)
+	if err != nil {
+		return Purchase{}, err
+	}
+	defer records.Close()
+	if records.Next() {
+		return convertRecordToPurchase(records)
+	}
+	// no purchase found
+	return Purchase{}, ErrNotFound
+}
+
 // List purchases, with pagination
 //
 func (pManager PurchaseManager) List(page int, pageNum int) func() (Purchase, error) {
@@ -439,6 +546,31 @@ func (pManager PurchaseManager) List(page int, pageNum int) func() (Purchase, er
 	return convertRecordsToPurchases(records)
 }
 
+// purchaseSortColumns are the columns of the fields the purchases are sorted by
+var purchaseSortColumns = map[string]string{
+	"id":              "p.id",
+	"transactionDate": "p.transaction_date",
+	"startDate":       "p.start_date",
+	"endDate":         "p.end_date",
+	"status":          "p.status",
+	"state":           "p.state",
+}
+
+// ListSorted lists the purchases sorted by id, transactionDate, startDate, endDate, status or state,
+// the last transactions first by default
+//
+func (pManager PurchaseManager) ListSorted(listing dbutils.Listing) func() (Purchase, error) {
+	clauses, err := listing.Clauses(purchaseSortColumns, "-transactionDate", "p.id")
+	if err != nil {
+		return func() (Purchase, error) { return Purchase{}, err }
+	}
+	records, err := pManager.db.Query(purchaseManagerQuery + clauses)
+	if err != nil {
+		return func() (Purchase, error) { return Purchase{}, err }
+	}
+	return convertRecordsToPurchases(records)
+}
+
 // ListByUser: list the purchases of a given user, with pagination
 //
 func (pManager PurchaseManager) ListByUser(userID int64, page int, pageNum int) func() (Purchase, error) {
@@ -460,8 +592,8 @@ func (pManager PurchaseManager) Add(p Purchase) error {
 	add, err := pManager.db.Prepare(`INSERT INTO purchase
 	(uuid, publication_id, user_id,
 	type, transaction_date,
-	start_date, end_date, status)
-	VALUES (?, ?, ?, ?, ?, ?, ?, 'ok')`)
+	start_date, end_date, status, state, state_updated)
+	VALUES (?, ?, ?, ?, ?, ?, ?, 'ok', ?, ?)`)
 	if err != nil {
 		return err
 	}
@@ -469,27 +601,36 @@ func (pManager PurchaseManager) Add(p Purchase) error {
 
 	// Fill default values
 	if p.TransactionDate.IsZero() {
-		p.TransactionDate = time.Now().UTC().Truncate(time.Second)
+		p.TransactionDate = clock.Now().UTC().Truncate(time.Second)
 	}
 
 	if p.Type == LOAN && p.StartDate == nil {
 		p.StartDate = &p.TransactionDate
 	}
 
-	// Create uuid
-	uid, err_u := uuid.NewV4()
-	if err_u != nil {
-		return err_u
+	// Create uuid, unless the caller provided one
+	if p.UUID == "" {
+		uid, err_u := uuid.NewV4()
+		if err_u != nil {
+			return err_u
+		}
+		p.UUID = uid.String()
 	}
-	p.UUID = uid.String()
 
-	_, err = add.Exec(
+	result, err := add.Exec(
 		p.UUID,
 		p.Publication.ID, p.User.ID,
 		string(p.Type), p.TransactionDate,
-		p.StartDate, p.EndDate)
-
-	return err
+		p.StartDate, p.EndDate,
+		StateCreated, p.TransactionDate)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	return insertEvent(pManager.db, Event{PurchaseID: id, To: StateCreated, Timestamp: p.TransactionDate, Detail: string(p.Type)})
 }
 
 // Update modifies a purchase on a renew or return request
@@ -506,9 +647,15 @@ func (pManager PurchaseManager) Update(p Purchase) error {
 	if origPurchase.Status != StatusOk {
 		return errors.New("Cannot update an invalid purchase")
 	}
+	// the event recorded once the License Status Server has accepted the request
+	var event string
 	if p.Status == StatusToBeRenewed ||
 		p.Status == StatusToBeReturned {
 
+		// only a licensed purchase is renewed or returned
+		if origPurchase.State != StateLicensed {
+			return ErrInvalidTransition
+		}
 		if p.LicenseUUID == nil {
 			return errors.New("Cannot return or renew a purchase when no license has been delivered")
 		}
@@ -525,11 +672,13 @@ func (pManager PurchaseManager) Update(p Purchase) error {
 
 			// Next status if LSD raises no error
 			p.Status = StatusOk
+			event = StatusToBeRenewed
 		} else if p.Status == StatusToBeReturned {
 			lsdURL += "/return"
 
 			// Next status if LSD raises no error
 			p.Status = StatusOk
+			event = StatusToBeReturned
 		}
 		// message to the console
 		log.Println("PUT " + lsdURL)
@@ -539,9 +688,8 @@ func (pManager PurchaseManager) Update(p Purchase) error {
 			return err
 		}
 		// set credentials
-		lsdAuth := pManager.config.LsdNotifyAuth
-		if lsdAuth.Username != "" {
-			req.SetBasicAuth(lsdAuth.Username, lsdAuth.Password)
+		if err = servicetoken.Authorize(req, config.LsdServerName, pManager.config.LsdNotifyAuth); err != nil {
+			return err
 		}
 		// call the lsd server
 		var lsdClient = &http.Client{
@@ -553,6 +701,9 @@ func (pManager PurchaseManager) Update(p Purchase) error {
 		}
 		// FIXME: what is the use of the resp.Body.Close?
 		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.New("The License Status Server returned an error")
+		}
 
 		// get the new end date from the license server
 
@@ -574,12 +725,56 @@ func (pManager PurchaseManager) Update(p Purchase) error {
 	}
 	defer update.Close()
 	result, err := update.Exec(p.LicenseUUID, p.StartDate, p.EndDate, p.Status, p.ID)
+	if err != nil {
+		return err
+	}
 	if changed, err := result.RowsAffected(); err == nil {
 		if changed != 1 {
 			return ErrNoChange
 		}
 	}
-	return err
+	switch event {
+	case StatusToBeReturned:
+		return pManager.Transition(p.ID, StateReturned, "returned")
+	case StatusToBeRenewed:
+		detail := "renewed"
+		if p.EndDate != nil {
+			detail += " until " + p.EndDate.UTC().Format(time.RFC3339)
+		}
+		return pManager.recordEvent(p.ID, StateLicensed, detail)
+	}
+	return nil
+}
+
+// revokeLicense revokes a license on the License Status Server
+//
+func (pManager PurchaseManager) revokeLicense(licenseID string, message string) error {
+	body, err := json.Marshal(map[string]string{"status": "revoked", "message": message})
+	if err != nil {
+		return err
+	}
+	lsdURL := pManager.config.LsdServer.PublicBaseUrl + "/licenses/" + licenseID + "/status"
+	log.Println("PATCH " + lsdURL)
+	req, err := http.NewRequest("PATCH", lsdURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", api.ContentType_JSON)
+	if err = servicetoken.Authorize(req, config.LsdServerName, pManager.config.LsdNotifyAuth); err != nil {
+		return err
+	}
+	var lsdClient = &http.Client{
+		Timeout: time.Second * 5,
+	}
+	resp, err := lsdClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("The License Status Server refused the revocation")
+	}
+	return nil
 }
 
 // Init initializes the PurchaseManager
@@ -592,8 +787,39 @@ func Init(config config.Configuration, db *sql.DB) (i WebPurchase, err error) {
 			log.Println("Error creating purchase table")
 			return
 		}
+		_, err = db.Exec(purchaseEventTableDef)
+		if err != nil {
+			log.Println("Error creating purchase_event table")
+			return
+		}
+		_, err = db.Exec(purchaseReminderTableDef)
+		if err != nil {
+			log.Println("Error creating purchase_reminder table")
+			return
+		}
+	}
+	// add the state columns to a table created by a former version; the error is ignored if they exist
+	db.Exec("ALTER TABLE purchase ADD COLUMN state varchar(32) NOT NULL DEFAULT 'created'")
+	db.Exec("ALTER TABLE purchase ADD COLUMN state_updated datetime NULL")
+	// the purchases which got their license before the states existed are licensed
+	_, err = db.Exec("UPDATE purchase SET state = ? WHERE state = ? AND license_uuid IS NOT NULL", StateLicensed, StateCreated)
+	if err != nil {
+		return
+	}
+	notifier, err := webmail.New(config.FrontendServer.Mail)
+	if err != nil {
+		return
+	}
+	var templates *webmail.Templates
+	for _, ch := range config.FrontendServer.Reminders.Channels {
+		if ch.Type == "push" {
+			if templates, err = webmail.LoadTemplates(config.FrontendServer.Mail.Templates, config.FrontendServer.Mail.DefaultLanguage); err != nil {
+				return
+			}
+			break
+		}
 	}
-	i = PurchaseManager{config, db}
+	i = PurchaseManager{config, db, notifier, templates}
 	return
 }
 
@@ -608,6 +834,8 @@ const tableDef = "CREATE TABLE IF NOT EXISTS purchase (" +
 	"start_date datetime," +
 	"end_date datetime," +
 	"status varchar(255) NOT NULL," +
+	"state varchar(32) NOT NULL DEFAULT 'created'," +
+	"state_updated datetime NULL," +
 	"FOREIGN KEY (publication_id) REFERENCES publication(id)," +
 	"FOREIGN KEY (user_id) REFERENCES user(id)" +
 	");" +
@@ -32,6 +32,8 @@ import (
 	"strings"
 
 	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
+	"github.com/readium/readium-lcp-server/frontend/webauth"
 	"github.com/satori/go.uuid"
 )
 
@@ -44,7 +46,9 @@ type WebUser interface {
 	GetByEmail(email string) (User, error)
 	Add(c User) error
 	Update(c User) error
+	SetLogin(userID int64, role string, loginPassword string) error
 	DeleteUser(UserID int64) error
+	Anonymize(userID int64, pseudonym string) error
 	ListUsers(page int, pageNum int) func() (User, error)
 }
 
@@ -56,20 +60,31 @@ type User struct {
 	Email    string `json:"email,omitempty"`
 	Password string `json:"password,omitempty"`
 	Hint     string `json:"hint"`
+	// Role is the role of the user on the frontend: admin, staff or patron
+	Role string `json:"role,omitempty"`
+	// LoginPassword is the password of the user on the frontend, only given to set it
+	LoginPassword string `json:"login_password,omitempty"`
+	// LoginHash is the bcrypt hash of the login password, never sent
+	LoginHash string `json:"-"`
+	// Language is the language of the emails sent to the user, e.g. "fr-FR"
+	Language string `json:"language,omitempty"`
 }
 
 type dbUser struct {
 	db         *sql.DB
-	getUser    *sql.Stmt
-	getByEmail *sql.Stmt
+	getUser    *dbutils.Stmt
+	getByEmail *dbutils.Stmt
 }
 
 func (user dbUser) Get(id int64) (User, error) {
 	records, err := user.getUser.Query(id)
+	if err != nil {
+		return User{}, err
+	}
 	defer records.Close()
 	if records.Next() {
 		var c User
-		err = records.Scan(&c.ID, &c.UUID, &c.Name, &c.Email, &c.Password, &c.Hint)
+		err = records.Scan(&c.ID, &c.UUID, &c.Name, &c.Email, &c.Password, &c.Hint, &c.Role, &c.LoginHash, &c.Language)
 		return c, err
 	}
 
@@ -78,10 +93,13 @@ func (user dbUser) Get(id int64) (User, error) {
 
 func (user dbUser) GetByEmail(email string) (User, error) {
 	records, err := user.getByEmail.Query(email)
+	if err != nil {
+		return User{}, err
+	}
 	defer records.Close()
 	if records.Next() {
 		var c User
-		err = records.Scan(&c.ID, &c.UUID, &c.Name, &c.Email, &c.Password, &c.Hint)
+		err = records.Scan(&c.ID, &c.UUID, &c.Name, &c.Email, &c.Password, &c.Hint, &c.Role, &c.LoginHash, &c.Language)
 		return c, err
 	}
 
@@ -89,7 +107,7 @@ func (user dbUser) GetByEmail(email string) (User, error) {
 }
 
 func (user dbUser) Add(newUser User) error {
-	add, err := user.db.Prepare("INSERT INTO user (uuid, name, email, password, hint) VALUES (?, ?, ?, ?, ?)")
+	add, err := user.db.Prepare("INSERT INTO user (uuid, name, email, password, hint, role, login_hash, language) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
@@ -102,22 +120,52 @@ func (user dbUser) Add(newUser User) error {
 	}
 	newUser.UUID = uid.String()
 
-	_, err = add.Exec(newUser.UUID, newUser.Name, newUser.Email, newUser.Password, newUser.Hint)
+	if newUser.Role == "" {
+		newUser.Role = webauth.RolePatron
+	}
+	if newUser.LoginPassword != "" {
+		if newUser.LoginHash, err = webauth.HashPassword(newUser.LoginPassword); err != nil {
+			return err
+		}
+	}
+
+	_, err = add.Exec(newUser.UUID, newUser.Name, newUser.Email, newUser.Password, newUser.Hint, newUser.Role, newUser.LoginHash, newUser.Language)
 	return err
 }
 
 func (user dbUser) Update(changedUser User) error {
-	add, err := user.db.Prepare("UPDATE user SET name=? , email=?, password=?, hint=? WHERE id=?")
+	// the language is kept if it is not given
+	add, err := user.db.Prepare("UPDATE user SET name=? , email=?, password=?, hint=?, language=COALESCE(NULLIF(?, ''), language) WHERE id=?")
 	if err != nil {
 		return err
 	}
 	defer add.Close()
-	_, err = add.Exec(changedUser.Name, changedUser.Email, changedUser.Password, changedUser.Hint, changedUser.ID)
+	_, err = add.Exec(changedUser.Name, changedUser.Email, changedUser.Password, changedUser.Hint, changedUser.Language, changedUser.ID)
+	return err
+}
+
+// SetLogin sets the role of a user, and his login password if it is not empty
+func (user dbUser) SetLogin(userID int64, role string, loginPassword string) error {
+	if loginPassword == "" {
+		_, err := user.db.Exec("UPDATE user SET role=? WHERE id=?", role, userID)
+		return err
+	}
+	hash, err := webauth.HashPassword(loginPassword)
+	if err != nil {
+		return err
+	}
+	_, err = user.db.Exec("UPDATE user SET role=?, login_hash=? WHERE id=?", role, hash, userID)
 	return err
 }
 
 func (user dbUser) DeleteUser(userID int64) error {
-	// delete purchases from user
+	// delete purchases from user, their events and reminders
+	if _, err := user.db.Exec(`DELETE FROM purchase_event WHERE purchase_id IN (SELECT id FROM purchase WHERE user_id=?)`, userID); err != nil {
+		return err
+	}
+	if _, err := user.db.Exec(`DELETE FROM purchase_reminder WHERE purchase_id IN (SELECT id FROM purchase WHERE user_id=?)`, userID); err != nil {
+		return err
+	}
 	delPurchases, err := user.db.Prepare(`DELETE FROM purchase WHERE user_id=?`)
 	if err != nil {
 		return err
@@ -136,8 +184,22 @@ func (user dbUser) DeleteUser(userID int64) error {
 	return err
 }
 
+// Anonymize erases the personal data of a user: the name, email, password and hint are erased
+// and the uuid, which identifies the user in the licenses, is replaced by a pseudonym; the user cannot log in anymore.
+// The purchases of the user are kept for the statistics.
+func (user dbUser) Anonymize(userID int64, pseudonym string) error {
+	query, err := user.db.Prepare("UPDATE user SET uuid=?, name='', email=?, password='', hint='', role='patron', login_hash='' WHERE id=?")
+	if err != nil {
+		return err
+	}
+	defer query.Close()
+	// the email is the login of the user, it is replaced by a pseudonymous address
+	_, err = query.Exec(pseudonym, pseudonym+"@anonymized.invalid", userID)
+	return err
+}
+
 func (user dbUser) ListUsers(page int, pageNum int) func() (User, error) {
-	listUsers, err := user.db.Query(`SELECT id, uuid, name, email, password, hint
+	listUsers, err := user.db.Query(`SELECT id, uuid, name, email, password, hint, role, login_hash, language
 	FROM user
 	ORDER BY email desc LIMIT ? OFFSET ? `, page, pageNum*page)
 	if err != nil {
@@ -146,7 +208,7 @@ func (user dbUser) ListUsers(page int, pageNum int) func() (User, error) {
 	return func() (User, error) {
 		var u User
 		if listUsers.Next() {
-			err := listUsers.Scan(&u.ID, &u.UUID, &u.Name, &u.Email, &u.Password, &u.Hint)
+			err := listUsers.Scan(&u.ID, &u.UUID, &u.Name, &u.Email, &u.Password, &u.Hint, &u.Role, &u.LoginHash, &u.Language)
 
 			if err != nil {
 				return u, err
@@ -170,14 +232,13 @@ func Open(db *sql.DB) (i WebUser, err error) {
 			return
 		}
 	}
-	get, err := db.Prepare("SELECT id, uuid, name, email, password, hint FROM user WHERE id = ? LIMIT 1")
-	if err != nil {
-		return
-	}
-	getByEmail, err := db.Prepare("SELECT id, uuid, name, email, password, hint FROM user WHERE email = ? LIMIT 1")
-	if err != nil {
-		return
-	}
+	// add the login columns to a table created by a former version; the error is ignored if they exist
+	db.Exec("ALTER TABLE user ADD COLUMN role varchar(16) NOT NULL DEFAULT 'patron'")
+	db.Exec("ALTER TABLE user ADD COLUMN login_hash varchar(255) NOT NULL DEFAULT ''")
+	db.Exec("ALTER TABLE user ADD COLUMN language varchar(16) NOT NULL DEFAULT ''")
+
+	get := dbutils.NewStmt(db, "SELECT id, uuid, name, email, password, hint, role, login_hash, language FROM user WHERE id = ? LIMIT 1")
+	getByEmail := dbutils.NewStmt(db, "SELECT id, uuid, name, email, password, hint, role, login_hash, language FROM user WHERE email = ? LIMIT 1")
 	i = dbUser{db, get, getByEmail}
 	return
 }
@@ -188,4 +249,7 @@ const tableDef = "CREATE TABLE IF NOT EXISTS user (" +
 	"name varchar(64) NOT NULL," +
 	"email varchar(64) NOT NULL," +
 	"password varchar(64) NOT NULL," +
-	"hint varchar(64) NOT NULL)"
+	"hint varchar(64) NOT NULL," +
+	"role varchar(16) NOT NULL DEFAULT 'patron'," +
+	"login_hash varchar(255) NOT NULL DEFAULT ''," +
+	"language varchar(16) NOT NULL DEFAULT '')"
@@ -0,0 +1,81 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package index
+
+import (
+	"github.com/readium/readium-lcp-server/cache"
+)
+
+// cachedIndex reads the contents through a cache; updates invalidate the cached entries
+type cachedIndex struct {
+	Index
+	cache cache.Cache
+}
+
+// NewCachedIndex returns an index which caches the reads of the index given as a parameter
+func NewCachedIndex(idx Index, c cache.Cache) Index {
+	return cachedIndex{Index: idx, cache: c}
+}
+
+func contentKey(id string) string {
+	return "lcp:content:" + id
+}
+
+func metadataKey(id string) string {
+	return "lcp:metadata:" + id
+}
+
+func (i cachedIndex) Get(id string) (Content, error) {
+	var c Content
+	if cache.GetObject(i.cache, contentKey(id), &c) {
+		return c, nil
+	}
+	c, err := i.Index.Get(id)
+	if err == nil {
+		cache.SetObject(i.cache, contentKey(id), c)
+	}
+	return c, err
+}
+
+func (i cachedIndex) Add(c Content) error {
+	i.cache.Delete(contentKey(c.Id))
+	return i.Index.Add(c)
+}
+
+func (i cachedIndex) Update(c Content) error {
+	err := i.Index.Update(c)
+	i.cache.Delete(contentKey(c.Id))
+	return err
+}
+
+func (i cachedIndex) Upsert(c Content) (bool, error) {
+	created, err := i.Index.Upsert(c)
+	i.cache.Delete(contentKey(c.Id))
+	return created, err
+}
+
+func (i cachedIndex) UpdateIfMatch(c Content, etag string) error {
+	err := i.Index.UpdateIfMatch(c, etag)
+	i.cache.Delete(contentKey(c.Id))
+	return err
+}
+
+func (i cachedIndex) GetMetadata(id string) (Metadata, error) {
+	var m Metadata
+	if cache.GetObject(i.cache, metadataKey(id), &m) {
+		return m, nil
+	}
+	m, err := i.Index.GetMetadata(id)
+	if err == nil {
+		cache.SetObject(i.cache, metadataKey(id), m)
+	}
+	return m, err
+}
+
+func (i cachedIndex) SetMetadata(m Metadata) error {
+	err := i.Index.SetMetadata(m)
+	i.cache.Delete(metadataKey(m.ContentId))
+	return err
+}
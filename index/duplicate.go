@@ -0,0 +1,53 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package index
+
+import (
+	"github.com/readium/readium-lcp-server/dbutils"
+)
+
+// ListBySourceHash returns the contents encrypted from the source publication with this checksum
+func (i dbIndex) ListBySourceHash(hash string) ([]Content, error) {
+	rows, err := i.listBySourceHash.Query(hash)
+	if err != nil {
+		return nil, wrap("list contents by source", err)
+	}
+	defer rows.Close()
+	var contents []Content
+	for rows.Next() {
+		var c Content
+		err = rows.Scan(&c.Id, &c.EncryptionKey, &c.Location, &c.Length, &c.Sha256, &c.Type, &c.Tenant, &c.MaxConcurrentLoans,
+			&c.Title, &c.Author, &c.Language, &c.PublicationDate, &c.CoverUrl, &c.Version, &c.SourceSha256)
+		if err != nil {
+			return nil, wrap("list contents by source", err)
+		}
+		contents = append(contents, c)
+	}
+	return contents, wrap("list contents by source", rows.Err())
+}
+
+// AddAlias records an alias of a content: a duplicate content, identified by the alias,
+// is not stored but stands for the existing content
+func (i dbIndex) AddAlias(alias string, id string) error {
+	_, err := i.addAlias.Exec(alias, id)
+	return wrap("add content alias", err)
+}
+
+// getAliased returns the content an alias stands for
+func (i dbIndex) getAliased(alias string) (Content, error) {
+	var id string
+	err := i.getAlias.QueryRow(alias).Scan(&id)
+	if err != nil {
+		return Content{}, wrap("get content alias", err)
+	}
+	return i.get1(id)
+}
+
+const aliasTableDef = "CREATE TABLE IF NOT EXISTS content_alias (" +
+	"alias varchar(255) PRIMARY KEY," +
+	"content_id varchar(255) NOT NULL)"
+
+var aliasTableDefMySQL = dbutils.MySQLTable{Name: "content_alias", Definition: "`alias` varchar(255) NOT NULL PRIMARY KEY," +
+	"`content_id` varchar(255) NOT NULL"}
@@ -0,0 +1,24 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package index
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// ETag returns the entity tag of a content as stored in the index.
+// It changes each time the content is encrypted again or moved.
+//
+func ETag(c Content) string {
+	fields := []string{
+		c.Id, hex.EncodeToString(c.EncryptionKey), c.Location,
+		strconv.FormatInt(c.Length, 10), c.Sha256, c.Type,
+	}
+	hash := sha256.Sum256([]byte(strings.Join(fields, "\n")))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
@@ -27,19 +27,42 @@ package index
 
 import (
 	"database/sql"
-	"errors"
-	"strings"
 
 	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
 )
 
-var NotFound = errors.New("Content not found")
+// the errors of the index; the errors of the database are wrapped in errors of kind ErrStorage,
+// the violations of a unique constraint in errors of kind ErrConflict
+var (
+	ErrNotFound = dbutils.NewError(dbutils.ErrNotFound, "Content not found")
+	ErrConflict = dbutils.NewError(dbutils.ErrConflict, "Content conflict")
+	ErrStorage  = dbutils.NewError(dbutils.ErrStorage, "Content storage error")
+)
+
+// ErrModified is returned when a content was modified since it was read
+var ErrModified = dbutils.NewError(ErrConflict, "The content has been modified since it was read")
+
+// wrap returns the error of an operation of the index
+func wrap(op string, err error) error {
+	return dbutils.Wrap(op, err, ErrNotFound, ErrConflict, ErrStorage)
+}
 
 type Index interface {
 	Get(id string) (Content, error)
 	Add(c Content) error
 	Update(c Content) error
+	Upsert(c Content) (created bool, err error)
+	UpdateIfMatch(c Content, etag string) error
+	LockTx(tx *sql.Tx, id string) (Content, error)
+	GetVersion(id string, version int) (Content, error)
+	ListVersions(id string) ([]Content, error)
+	ListBySourceHash(hash string) ([]Content, error)
+	AddAlias(alias string, id string) error
 	List() func() (Content, error)
+	ListContents(tenant string, listing dbutils.Listing) func() (Content, error)
+	GetMetadata(id string) (Metadata, error)
+	SetMetadata(m Metadata) error
 }
 
 type Content struct {
@@ -49,112 +72,381 @@ type Content struct {
 	Length        int64  `json:"length"` //not exported in license spec?
 	Sha256        string `json:"sha256"` //not exported in license spec?
 	Type          string `json:"type"`
+	Tenant        string `json:"-"`
+	// number of simultaneous loans of the content, 0 if not limited
+	MaxConcurrentLoans int `json:"max_concurrent_loans,omitempty"`
+	// optional descriptive fields, provided by the packager, displayed in license hints and listings
+	Title           string `json:"title,omitempty"`
+	Author          string `json:"author,omitempty"`
+	Language        string `json:"language,omitempty"`
+	PublicationDate string `json:"publication_date,omitempty"`
+	CoverUrl        string `json:"cover_url,omitempty"`
+	// the version of the content, incremented each time a new file replaces the content
+	Version int `json:"version"`
+	// true for a previous version of the content, whose file is kept for the licenses issued for it
+	Archived bool `json:"archived,omitempty"`
+	// the SHA-256 checksum of the source publication, which identifies the duplicate contents
+	SourceSha256 string `json:"source_sha256,omitempty"`
+}
+
+// Metadata is the descriptive metadata associated with a content,
+// usually ingested from the catalog of the publisher (e.g. ONIX)
+type Metadata struct {
+	ContentId string `json:"content_id"`
+	Title     string `json:"title,omitempty"`
+	Author    string `json:"author,omitempty"`
+	Isbn      string `json:"isbn,omitempty"`
+	CoverUrl  string `json:"cover_url,omitempty"`
+	// the collection (series, imprint...) of the content, which may select a license template
+	Collection string `json:"collection,omitempty"`
 }
 
 type dbIndex struct {
-	db   *sql.DB
-	get  *sql.Stmt
-	add  *sql.Stmt
-	update *sql.Stmt
-	list *sql.Stmt
+	db               *sql.DB
+	get              *dbutils.Stmt
+	add              *dbutils.Stmt
+	update           *dbutils.Stmt
+	upsert           *dbutils.Stmt
+	getForUpdate     *dbutils.Stmt
+	list             *dbutils.Stmt
+	getMetadata      *dbutils.Stmt
+	addMetadata      *dbutils.Stmt
+	updateMetadata   *dbutils.Stmt
+	getVersion       *dbutils.Stmt
+	listVersions     *dbutils.Stmt
+	addVersion       *dbutils.Stmt
+	listBySourceHash *dbutils.Stmt
+	getAlias         *dbutils.Stmt
+	addAlias         *dbutils.Stmt
+	replica          *sql.DB
+	dialect          dbutils.Dialect
+}
+
+// contentSortColumns are the columns of the fields the contents are sorted by
+var contentSortColumns = map[string]string{
+	"id":               "id",
+	"title":            "title",
+	"author":           "author",
+	"language":         "language",
+	"publication_date": "publication_date",
+	"length":           "length",
+	"version":          "version",
 }
 
+// Get returns a content; an alias returns the content it stands for
 func (i dbIndex) Get(id string) (Content, error) {
+	c, err := i.get1(id)
+	if err != ErrNotFound {
+		return c, err
+	}
+	return i.getAliased(id)
+}
+
+func (i dbIndex) get1(id string) (Content, error) {
 	records, err := i.get.Query(id)
 	if err != nil {
-		return Content{}, err
+		return Content{}, wrap("get content", err)
 	}
 	defer records.Close()
 	if records.Next() {
 		var c Content
-		err = records.Scan(&c.Id, &c.EncryptionKey, &c.Location, &c.Length, &c.Sha256, &c.Type)
-		return c, err
+		err = records.Scan(&c.Id, &c.EncryptionKey, &c.Location, &c.Length, &c.Sha256, &c.Type, &c.Tenant, &c.MaxConcurrentLoans,
+			&c.Title, &c.Author, &c.Language, &c.PublicationDate, &c.CoverUrl, &c.Version, &c.SourceSha256)
+		return c, wrap("get content", err)
 	}
 
-	return Content{}, NotFound
+	return Content{}, ErrNotFound
 }
 
-func (i dbIndex) Add(c Content) error {	
-	_, err := i.add.Exec(c.Id, c.EncryptionKey, c.Location, c.Length, c.Sha256, c.Type)
-	return err
+func (i dbIndex) Add(c Content) error {
+	if c.Version == 0 {
+		c.Version = 1
+	}
+	_, err := i.add.Exec(c.Id, c.EncryptionKey, c.Location, c.Length, c.Sha256, c.Type, c.Tenant, c.MaxConcurrentLoans,
+		c.Title, c.Author, c.Language, c.PublicationDate, c.CoverUrl, c.Version, c.SourceSha256)
+	return wrap("add content", err)
 }
 
+// Update updates a content; if its file is replaced, the previous version is archived
 func (i dbIndex) Update(c Content) error {
-	_, err := i.update.Exec(c.EncryptionKey, c.Location, c.Length, c.Sha256, c.Type, c.Id)
-	return err
+	return i.updateVersion(c, "", false)
+}
+
+// Upsert adds a content, or updates it if it already exists, and tells if the content was created.
+// A notification repeated by the packager, or sent twice at the same time, does not fail:
+// the row inserted meanwhile by another request is updated in the same statement.
+func (i dbIndex) Upsert(c Content) (created bool, err error) {
+	tx, err := i.db.Begin()
+	if err != nil {
+		return false, wrap("upsert content", err)
+	}
+	var cur Content
+	err = i.getForUpdate.QueryRowTx(tx, c.Id).Scan(&cur.Id, &cur.EncryptionKey, &cur.Location, &cur.Length, &cur.Sha256, &cur.Type, &cur.Tenant, &cur.MaxConcurrentLoans,
+		&cur.Title, &cur.Author, &cur.Language, &cur.PublicationDate, &cur.CoverUrl, &cur.Version, &cur.SourceSha256)
+	switch {
+	case err == sql.ErrNoRows:
+		created = true
+		if c.Version == 0 {
+			c.Version = 1
+		}
+		_, err = i.upsert.ExecTx(tx, c.Id, c.EncryptionKey, c.Location, c.Length, c.Sha256, c.Type, c.Tenant, c.MaxConcurrentLoans,
+			c.Title, c.Author, c.Language, c.PublicationDate, c.CoverUrl, c.Version, c.SourceSha256)
+	case err == nil:
+		c.Version, err = i.archiveTx(tx, cur, c)
+		if err == nil {
+			_, err = i.update.ExecTx(tx, c.EncryptionKey, c.Location, c.Length, c.Sha256, c.Type, c.MaxConcurrentLoans,
+				c.Title, c.Author, c.Language, c.PublicationDate, c.CoverUrl, c.Version, c.SourceSha256, c.Id)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, wrap("upsert content", err)
+	}
+	return created, wrap("upsert content", tx.Commit())
+}
+
+// UpdateIfMatch updates a content if the stored content still has the given entity tag.
+// The stored content is locked during the check (except in sqlite, where the write
+// transaction fails if another one modified the content meanwhile).
+func (i dbIndex) UpdateIfMatch(c Content, etag string) error {
+	return i.updateVersion(c, etag, true)
+}
+
+// updateVersion updates a content, after checking its entity tag if required
+func (i dbIndex) updateVersion(c Content, etag string, check bool) error {
+	tx, err := i.db.Begin()
+	if err != nil {
+		return wrap("update content", err)
+	}
+	var cur Content
+	err = i.getForUpdate.QueryRowTx(tx, c.Id).Scan(&cur.Id, &cur.EncryptionKey, &cur.Location, &cur.Length, &cur.Sha256, &cur.Type, &cur.Tenant, &cur.MaxConcurrentLoans,
+		&cur.Title, &cur.Author, &cur.Language, &cur.PublicationDate, &cur.CoverUrl, &cur.Version, &cur.SourceSha256)
+	if err == nil && check && ETag(cur) != etag {
+		err = ErrModified
+	}
+	if err == nil {
+		c.Version, err = i.archiveTx(tx, cur, c)
+	}
+	if err == nil {
+		_, err = i.update.ExecTx(tx, c.EncryptionKey, c.Location, c.Length, c.Sha256, c.Type, c.MaxConcurrentLoans,
+			c.Title, c.Author, c.Language, c.PublicationDate, c.CoverUrl, c.Version, c.SourceSha256, c.Id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return wrap("update content", err)
+	}
+	return wrap("update content", tx.Commit())
+}
+
+// LockTx reads a content and locks it until the end of the transaction
+// (in sqlite, the whole database is locked by the first write of the transaction).
+func (i dbIndex) LockTx(tx *sql.Tx, id string) (Content, error) {
+	var c Content
+	err := i.getForUpdate.QueryRowTx(tx, id).Scan(&c.Id, &c.EncryptionKey, &c.Location, &c.Length, &c.Sha256, &c.Type, &c.Tenant, &c.MaxConcurrentLoans,
+		&c.Title, &c.Author, &c.Language, &c.PublicationDate, &c.CoverUrl, &c.Version, &c.SourceSha256)
+	if err != nil {
+		return Content{}, wrap("lock content", err)
+	}
+	return c, nil
 }
 
 func (i dbIndex) List() func() (Content, error) {
-	rows, err := i.list.Query()
+	return listContents(i.list.Query())
+}
+
+// ListContents lists the contents of a tenant, of all the tenants if empty,
+// sorted by id, title, author, language, publication_date, length or version; by id by default
+func (i dbIndex) ListContents(tenant string, listing dbutils.Listing) func() (Content, error) {
+	clauses, err := listing.Clauses(contentSortColumns, "id", "id")
 	if err != nil {
+		return listContents(nil, err)
+	}
+	query := contentListQuery
+	var args []interface{}
+	if tenant != "" {
+		query += " WHERE tenant = ?"
+		args = append(args, tenant)
+	}
+	// the sort and the page are not parameters of the query: the query is not prepared
+	return listContents(i.replica.Query(i.dialect.Bind(query+clauses), args...))
+}
+
+// listContents iterates on the rows of a list of contents
+func listContents(rows *sql.Rows, err error) func() (Content, error) {
+	if err != nil {
+		err = wrap("list contents", err)
 		return func() (Content, error) { return Content{}, err }
 	}
 	return func() (Content, error) {
 		var c Content
 		var err error
 		if rows.Next() {
-			err = rows.Scan(&c.Id, &c.EncryptionKey, &c.Location, &c.Length, &c.Sha256, &c.Type)
+			err = wrap("list contents", rows.Scan(&c.Id, &c.EncryptionKey, &c.Location, &c.Length, &c.Sha256, &c.Type, &c.Tenant, &c.MaxConcurrentLoans,
+				&c.Title, &c.Author, &c.Language, &c.PublicationDate, &c.CoverUrl, &c.Version, &c.SourceSha256))
 		} else {
 			rows.Close()
-			err = NotFound
+			err = ErrNotFound
 		}
 		return c, err
 	}
 }
 
+func (i dbIndex) GetMetadata(id string) (Metadata, error) {
+	records, err := i.getMetadata.Query(id)
+	if err != nil {
+		return Metadata{}, wrap("get metadata", err)
+	}
+	defer records.Close()
+	if records.Next() {
+		var m Metadata
+		err = records.Scan(&m.ContentId, &m.Title, &m.Author, &m.Isbn, &m.CoverUrl, &m.Collection)
+		return m, wrap("get metadata", err)
+	}
+
+	return Metadata{}, ErrNotFound
+}
+
+// SetMetadata creates or replaces the metadata of a content
+func (i dbIndex) SetMetadata(m Metadata) error {
+	res, err := i.updateMetadata.Exec(m.Title, m.Author, m.Isbn, m.CoverUrl, m.Collection, m.ContentId)
+	if err != nil {
+		return wrap("set metadata", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+	_, err = i.addMetadata.Exec(m.ContentId, m.Title, m.Author, m.Isbn, m.CoverUrl, m.Collection)
+	return wrap("set metadata", err)
+}
+
 func Open(db *sql.DB) (i Index, err error) {
+	return OpenWithReplica(db, db)
+}
+
+// OpenWithReplica opens the index; listings are read from the replica database.
+func OpenWithReplica(db *sql.DB, replica *sql.DB) (i Index, err error) {
 	var createTableQuery, getQuery, addQuery, updateQuery, listQuery string
-	// if postgres use '$n' instead of '?'
-	if strings.HasPrefix(config.Config.LcpServer.Database, "postgres") {
+	var getMetadataQuery, addMetadataQuery, updateMetadataQuery string
+	var versionTableQuery, getVersionQuery, listVersionsQuery, addVersionQuery string
+	var aliasTableQuery, listBySourceHashQuery, getAliasQuery, addAliasQuery string
+	// the queries are written with '?' placeholders, bound to the dialect of the database
+	d := dbutils.DialectOf(config.Config.LcpServer.Database)
+	createTableQuery = tableDef
+	versionTableQuery = versionTableDef
+	if d == dbutils.Postgres {
 		createTableQuery = tableDefPostgres
-		getQuery = "SELECT id,encryption_key,location,length,sha256,type FROM content WHERE id = $1 LIMIT 1"
-		addQuery = "INSERT INTO content (id,encryption_key,location,length,sha256,type) VALUES ($1, $2, $3, $4, $5, $6)"
-		updateQuery = "UPDATE content SET encryption_key=$1, location=$2, length=$3, sha256=$4, type=$5 WHERE id=$6"
-		listQuery = "SELECT id,encryption_key,location,length,sha256,type FROM content"
-	} else {
-		// sqlite/mysql
-		createTableQuery = tableDef
-		getQuery = "SELECT id,encryption_key,location,length,sha256,type FROM content WHERE id = ? LIMIT 1"
-		addQuery = "INSERT INTO content (id,encryption_key,location,length,sha256,type) VALUES (?, ?, ?, ?, ?, ?)"
-		updateQuery = "UPDATE content SET encryption_key=?, location=?, length=?, sha256=?, type=? WHERE id=?"
-		listQuery = "SELECT id,encryption_key,location,length,sha256,type FROM content"
+		versionTableQuery = versionTableDefPostgres
 	}
+	getQuery = "SELECT id,encryption_key,location,length,sha256,type,tenant,max_concurrent_loans,title,author,language,publication_date,cover_url,version,source_sha256 FROM content WHERE id = ? LIMIT 1"
+	addQuery = "INSERT INTO content (id,encryption_key,location,length,sha256,type,tenant,max_concurrent_loans,title,author,language,publication_date,cover_url,version,source_sha256) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	updateQuery = "UPDATE content SET encryption_key=?, location=?, length=?, sha256=?, type=?, max_concurrent_loans=?, title=?, author=?, language=?, publication_date=?, cover_url=?, version=?, source_sha256=? WHERE id=?"
+	listQuery = contentListQuery
+	getMetadataQuery = "SELECT content_id,title,author,isbn,cover_url,collection FROM content_metadata WHERE content_id = ? LIMIT 1"
+	addMetadataQuery = "INSERT INTO content_metadata (content_id,title,author,isbn,cover_url,collection) VALUES (?, ?, ?, ?, ?, ?)"
+	updateMetadataQuery = "UPDATE content_metadata SET title=?, author=?, isbn=?, cover_url=?, collection=? WHERE content_id=?"
+	getVersionQuery = "SELECT content_id,version,encryption_key,location,length,sha256,type FROM content_version WHERE content_id = ? AND version = ?"
+	listVersionsQuery = "SELECT content_id,version,encryption_key,location,length,sha256,type FROM content_version WHERE content_id = ? ORDER BY version"
+	addVersionQuery = "INSERT INTO content_version (content_id,version,encryption_key,location,length,sha256,type) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	aliasTableQuery = aliasTableDef
+	listBySourceHashQuery = "SELECT id,encryption_key,location,length,sha256,type,tenant,max_concurrent_loans,title,author,language,publication_date,cover_url,version,source_sha256 FROM content WHERE source_sha256 = ? ORDER BY id"
+	getAliasQuery = "SELECT content_id FROM content_alias WHERE alias = ?"
+	addAliasQuery = "INSERT INTO content_alias (alias,content_id) VALUES (?, ?)"
+	// lock the row read before a conditional update
+	getForUpdateQuery := getQuery + d.ForUpdate()
 	// create the content table in the lcp db if it does not exist
-	_, err = db.Exec(createTableQuery)
-	if err != nil {
-		return
+	if d == dbutils.MySQL {
+		err = dbutils.CreateMySQLTables(db, tableDefMySQL, metadataTableDefMySQL, versionTableDefMySQL, aliasTableDefMySQL)
+		if err != nil {
+			return
+		}
+	} else {
+		_, err = db.Exec(createTableQuery)
+		if err != nil {
+			return
+		}
+		// create the content metadata table
+		_, err = db.Exec(metadataTableDef)
+		if err != nil {
+			return
+		}
+		// create the table of the previous versions of the contents
+		_, err = db.Exec(versionTableQuery)
+		if err != nil {
+			return
+		}
+		// create the table of the aliases of the duplicate contents
+		_, err = db.Exec(aliasTableQuery)
+		if err != nil {
+			return
+		}
 	}
 	// if sqlite, add "type" column, ignore an error
-	if strings.HasPrefix(config.Config.LcpServer.Database, "sqlite") {
+	if d == dbutils.SQLite {
 		db.Exec("ALTER TABLE content ADD COLUMN \"type\" varchar(255) NOT NULL DEFAULT 'application/epub+zip'")
-	}	
-	get, err := db.Prepare(getQuery)
-	if err != nil {
-		return
 	}
-	add, err := db.Prepare(addQuery)
-	if err != nil {
-		return
+	// add the "tenant" column to the databases created before multi-tenancy, ignore an error
+	db.Exec("ALTER TABLE content ADD COLUMN tenant varchar(255) NOT NULL DEFAULT ''")
+	// add the "max_concurrent_loans" column to the databases created before the limit of the loans, ignore an error
+	db.Exec("ALTER TABLE content ADD COLUMN max_concurrent_loans int NOT NULL DEFAULT 0")
+	// add the descriptive columns to the databases created before them, ignore the errors
+	for _, column := range []string{"title varchar(255)", "author varchar(255)", "language varchar(64)", "publication_date varchar(32)", "cover_url varchar(2048)"} {
+		db.Exec("ALTER TABLE content ADD COLUMN " + column + " NOT NULL DEFAULT ''")
 	}
-	update, err := db.Prepare(updateQuery)
-	if err != nil {
-		return
-	}
-	list, err := db.Prepare(listQuery)
-	if err != nil {
-		return
+	// add the "version" column to the databases created before the versioning of the contents, ignore an error
+	db.Exec("ALTER TABLE content ADD COLUMN version int NOT NULL DEFAULT 1")
+	// add the "source_sha256" column to the databases created before the detection of the duplicates, ignore an error
+	db.Exec("ALTER TABLE content ADD COLUMN source_sha256 varchar(64) NOT NULL DEFAULT ''")
+	// index the source checksums; mysql has no "IF NOT EXISTS" and the error of an existing index is ignored
+	if d == dbutils.MySQL {
+		db.Exec("CREATE INDEX content_source_sha256_index ON content (source_sha256)")
+	} else {
+		db.Exec("CREATE INDEX IF NOT EXISTS content_source_sha256_index ON content (source_sha256)")
 	}
-	i = dbIndex{db, get, add, update, list}
+	// add the "collection" column to the metadata created before the license templates, ignore an error
+	db.Exec("ALTER TABLE content_metadata ADD COLUMN collection varchar(255) NOT NULL DEFAULT ''")
+	get := dbutils.NewStmt(db, d.Bind(getQuery))
+	add := dbutils.NewStmt(db, d.Bind(addQuery))
+	update := dbutils.NewStmt(db, d.Bind(updateQuery))
+	upsert := dbutils.NewStmt(db, d.Upsert("content", contentColumns, []string{"id"}))
+	getForUpdate := dbutils.NewStmt(db, d.Bind(getForUpdateQuery))
+	list := dbutils.NewStmt(replica, d.Bind(listQuery))
+	getMetadata := dbutils.NewStmt(db, d.Bind(getMetadataQuery))
+	addMetadata := dbutils.NewStmt(db, d.Bind(addMetadataQuery))
+	updateMetadata := dbutils.NewStmt(db, d.Bind(updateMetadataQuery))
+	getVersion := dbutils.NewStmt(db, d.Bind(getVersionQuery))
+	listVersions := dbutils.NewStmt(db, d.Bind(listVersionsQuery))
+	addVersion := dbutils.NewStmt(db, d.Bind(addVersionQuery))
+	listBySourceHash := dbutils.NewStmt(db, d.Bind(listBySourceHashQuery))
+	getAlias := dbutils.NewStmt(db, d.Bind(getAliasQuery))
+	addAlias := dbutils.NewStmt(db, d.Bind(addAliasQuery))
+	i = dbIndex{db, get, add, update, upsert, getForUpdate, list, getMetadata, addMetadata, updateMetadata,
+		getVersion, listVersions, addVersion, listBySourceHash, getAlias, addAlias, replica, d}
 	return
 }
 
+// contentListQuery selects the contents of the lists
+const contentListQuery = "SELECT id,encryption_key,location,length,sha256,type,tenant,max_concurrent_loans,title,author,language,publication_date,cover_url,version,source_sha256 FROM content"
+
+// the columns of the content table, in the order of the insert statements
+var contentColumns = []string{"id", "encryption_key", "location", "length", "sha256", "type", "tenant", "max_concurrent_loans",
+	"title", "author", "language", "publication_date", "cover_url", "version", "source_sha256"}
+
 const tableDef = "CREATE TABLE IF NOT EXISTS content (" +
 	"id varchar(255) PRIMARY KEY," +
 	"encryption_key varchar(64) NOT NULL," +
 	"location text NOT NULL," +
 	"length bigint," +
 	"sha256 varchar(64)," +
-	"\"type\" varchar(256) NOT NULL default 'application/epub+zip')"
+	"\"type\" varchar(256) NOT NULL default 'application/epub+zip'," +
+	"tenant varchar(255) NOT NULL default ''," +
+	"max_concurrent_loans integer NOT NULL default 0," +
+	"title varchar(255) NOT NULL default ''," +
+	"author varchar(255) NOT NULL default ''," +
+	"language varchar(64) NOT NULL default ''," +
+	"publication_date varchar(32) NOT NULL default ''," +
+	"cover_url varchar(2048) NOT NULL default ''," +
+	"version integer NOT NULL default 1," +
+	"source_sha256 varchar(64) NOT NULL default '')"
 
 const tableDefPostgres = "CREATE TABLE IF NOT EXISTS content (" +
 	"id varchar(255) PRIMARY KEY," +
@@ -162,4 +454,44 @@ const tableDefPostgres = "CREATE TABLE IF NOT EXISTS content (" +
 	"location text NOT NULL," +
 	"length bigint," +
 	"sha256 varchar(64)," +
-	"\"type\" varchar(256) NOT NULL default 'application/epub+zip')" 
\ No newline at end of file
+	"\"type\" varchar(256) NOT NULL default 'application/epub+zip'," +
+	"tenant varchar(255) NOT NULL default ''," +
+	"max_concurrent_loans INT NOT NULL default 0," +
+	"title varchar(255) NOT NULL default ''," +
+	"author varchar(255) NOT NULL default ''," +
+	"language varchar(64) NOT NULL default ''," +
+	"publication_date varchar(32) NOT NULL default ''," +
+	"cover_url varchar(2048) NOT NULL default ''," +
+	"version integer NOT NULL default 1," +
+	"source_sha256 varchar(64) NOT NULL default '')"
+
+const metadataTableDef = "CREATE TABLE IF NOT EXISTS content_metadata (" +
+	"content_id varchar(255) PRIMARY KEY," +
+	"title varchar(255) NOT NULL default ''," +
+	"author varchar(255) NOT NULL default ''," +
+	"isbn varchar(32) NOT NULL default ''," +
+	"cover_url varchar(2048) NOT NULL default ''," +
+	"collection varchar(255) NOT NULL default '')"
+
+var tableDefMySQL = dbutils.MySQLTable{Name: "content", Definition: "`id` varchar(255) NOT NULL PRIMARY KEY," +
+	"`encryption_key` varbinary(64) NOT NULL," +
+	"`location` text NOT NULL," +
+	"`length` bigint DEFAULT NULL," +
+	"`sha256` varchar(64) DEFAULT NULL," +
+	"`type` varchar(255) NOT NULL DEFAULT 'application/epub+zip'," +
+	"`tenant` varchar(255) NOT NULL DEFAULT ''," +
+	"`max_concurrent_loans` int NOT NULL DEFAULT 0," +
+	"`title` varchar(255) NOT NULL DEFAULT ''," +
+	"`author` varchar(255) NOT NULL DEFAULT ''," +
+	"`language` varchar(64) NOT NULL DEFAULT ''," +
+	"`publication_date` varchar(32) NOT NULL DEFAULT ''," +
+	"`cover_url` varchar(2048) NOT NULL DEFAULT ''," +
+	"`version` int NOT NULL DEFAULT 1," +
+	"`source_sha256` varchar(64) NOT NULL DEFAULT ''"}
+
+var metadataTableDefMySQL = dbutils.MySQLTable{Name: "content_metadata", Definition: "`content_id` varchar(255) NOT NULL PRIMARY KEY," +
+	"`title` varchar(255) NOT NULL DEFAULT ''," +
+	"`author` varchar(255) NOT NULL DEFAULT ''," +
+	"`isbn` varchar(32) NOT NULL DEFAULT ''," +
+	"`cover_url` varchar(2048) NOT NULL DEFAULT ''," +
+	"`collection` varchar(255) NOT NULL DEFAULT ''"}
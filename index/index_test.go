@@ -41,7 +41,7 @@ func TestIndexCreation(t *testing.T) {
 		t.FailNow()
 	}
 
-	c := Content{"test", []byte("1234"), "test.epub"}
+	c := Content{Id: "test", EncryptionKey: []byte("1234"), Location: "test.epub"}
 	err = idx.Add(c)
 	if err != nil {
 		t.Error(err)
@@ -0,0 +1,143 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package index
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/readium/readium-lcp-server/dbutils"
+)
+
+// tenantIndex restricts an index to the contents of a tenant:
+// the contents of other tenants are reported as not found
+type tenantIndex struct {
+	Index
+	tenant string
+}
+
+// ForTenant returns a view of the index restricted to the contents of a tenant;
+// the contents added through this view belong to the tenant.
+func ForTenant(idx Index, tenant string) Index {
+	return tenantIndex{Index: idx, tenant: tenant}
+}
+
+// owned checks that a content belongs to the tenant
+func (i tenantIndex) owned(id string) error {
+	_, err := i.Get(id)
+	return err
+}
+
+func (i tenantIndex) Get(id string) (Content, error) {
+	c, err := i.Index.Get(id)
+	if err == nil && c.Tenant != i.tenant {
+		return Content{}, ErrNotFound
+	}
+	return c, err
+}
+
+func (i tenantIndex) Add(c Content) error {
+	c.Tenant = i.tenant
+	return i.Index.Add(c)
+}
+
+func (i tenantIndex) Update(c Content) error {
+	if err := i.owned(c.Id); err != nil {
+		return err
+	}
+	c.Tenant = i.tenant
+	return i.Index.Update(c)
+}
+
+// Upsert adds a content to the tenant, or updates it if the tenant owns it
+func (i tenantIndex) Upsert(c Content) (bool, error) {
+	cur, err := i.Index.Get(c.Id)
+	if err == nil && cur.Tenant != i.tenant {
+		return false, ErrConflict
+	} else if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	c.Tenant = i.tenant
+	return i.Index.Upsert(c)
+}
+
+func (i tenantIndex) UpdateIfMatch(c Content, etag string) error {
+	if err := i.owned(c.Id); err != nil {
+		return err
+	}
+	c.Tenant = i.tenant
+	return i.Index.UpdateIfMatch(c, etag)
+}
+
+func (i tenantIndex) LockTx(tx *sql.Tx, id string) (Content, error) {
+	c, err := i.Index.LockTx(tx, id)
+	if err == nil && c.Tenant != i.tenant {
+		return Content{}, ErrNotFound
+	}
+	return c, err
+}
+
+func (i tenantIndex) List() func() (Content, error) {
+	fn := i.Index.List()
+	return func() (Content, error) {
+		for {
+			c, err := fn()
+			if err != nil || c.Tenant == i.tenant {
+				return c, err
+			}
+		}
+	}
+}
+
+// ListContents lists the contents of the tenant
+func (i tenantIndex) ListContents(tenant string, listing dbutils.Listing) func() (Content, error) {
+	return i.Index.ListContents(i.tenant, listing)
+}
+
+func (i tenantIndex) GetMetadata(id string) (Metadata, error) {
+	if err := i.owned(id); err != nil {
+		return Metadata{}, err
+	}
+	return i.Index.GetMetadata(id)
+}
+
+func (i tenantIndex) SetMetadata(m Metadata) error {
+	if err := i.owned(m.ContentId); err != nil {
+		return err
+	}
+	return i.Index.SetMetadata(m)
+}
+
+func (i tenantIndex) GetVersion(id string, version int) (Content, error) {
+	if err := i.owned(id); err != nil {
+		return Content{}, err
+	}
+	return i.Index.GetVersion(id, version)
+}
+
+func (i tenantIndex) ListVersions(id string) ([]Content, error) {
+	if err := i.owned(id); err != nil {
+		return nil, err
+	}
+	return i.Index.ListVersions(id)
+}
+
+func (i tenantIndex) ListBySourceHash(hash string) ([]Content, error) {
+	contents, err := i.Index.ListBySourceHash(hash)
+	var owned []Content
+	for _, c := range contents {
+		if c.Tenant == i.tenant {
+			owned = append(owned, c)
+		}
+	}
+	return owned, err
+}
+
+func (i tenantIndex) AddAlias(alias string, id string) error {
+	if err := i.owned(id); err != nil {
+		return err
+	}
+	return i.Index.AddAlias(alias, id)
+}
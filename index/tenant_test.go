@@ -0,0 +1,93 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package index
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/dbutils"
+)
+
+func TestTenantIndex(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	idx, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1, t2 := ForTenant(idx, "t1"), ForTenant(idx, "t2")
+	if err = t1.Add(Content{Id: "c1", EncryptionKey: []byte("key1"), Location: "c1.epub"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = t2.Add(Content{Id: "c2", EncryptionKey: []byte("key2"), Location: "c2.epub"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// read
+	if c, err := t1.Get("c1"); err != nil || c.Tenant != "t1" {
+		t.Errorf("Expected the content of the tenant, got %+v (%v)", c, err)
+	}
+	if _, err = t1.Get("c2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the content of another tenant not to be found, got %v", err)
+	}
+	if _, err = t1.GetVersion("c2", 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the version of another tenant not to be found, got %v", err)
+	}
+	if _, err = t1.ListVersions("c2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the versions of another tenant not to be found, got %v", err)
+	}
+	if _, err = t1.GetMetadata("c2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the metadata of another tenant not to be found, got %v", err)
+	}
+
+	// list
+	// each listing is opened once the previous one is drained, the database has a single connection
+	for name, list := range map[string]func() func() (Content, error){
+		"List":         func() func() (Content, error) { return t1.List() },
+		"ListContents": func() func() (Content, error) { return t1.ListContents("t2", dbutils.Listing{}) },
+	} {
+		fn := list()
+		var ids []string
+		for c, err := fn(); err == nil; c, err = fn() {
+			ids = append(ids, c.Id)
+		}
+		if len(ids) != 1 || ids[0] != "c1" {
+			t.Errorf("%s: expected the content of the tenant only, got %v", name, ids)
+		}
+	}
+
+	// update
+	c2, err := idx.Get("c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.Location = "stolen.epub"
+	if err = t1.Update(c2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the update to be refused, got %v", err)
+	}
+	if err = t1.UpdateIfMatch(c2, ETag(c2)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the conditional update to be refused, got %v", err)
+	}
+	if _, err = t1.Upsert(c2); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected the upsert to be refused, got %v", err)
+	}
+	if err = t1.SetMetadata(Metadata{ContentId: "c2"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the metadata update to be refused, got %v", err)
+	}
+	if err = t1.AddAlias("c3", "c2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the alias to be refused, got %v", err)
+	}
+	if c, err := idx.Get("c2"); err != nil || c.Location != "c2.epub" || c.Tenant != "t2" {
+		t.Errorf("Expected the content to be unchanged, got %+v (%v)", c, err)
+	}
+}
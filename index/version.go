@@ -0,0 +1,128 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package index
+
+import (
+	"bytes"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/dbutils"
+)
+
+// IsNewVersion checks if an update of a content replaces its file:
+// a new encryption key, location or checksum makes a new version of the content.
+func IsNewVersion(cur Content, c Content) bool {
+	return !bytes.Equal(cur.EncryptionKey, c.EncryptionKey) || cur.Location != c.Location || cur.Sha256 != c.Sha256
+}
+
+// VersionKey returns the key in the storage of the file of a previous version of a content
+func VersionKey(id string, version int) string {
+	return id + ".v" + strconv.Itoa(version)
+}
+
+// ParseVersionKey returns the content id and version of the key of a previous version
+func ParseVersionKey(key string) (string, int, bool) {
+	pos := strings.LastIndex(key, ".v")
+	if pos <= 0 {
+		return "", 0, false
+	}
+	version, err := strconv.Atoi(key[pos+2:])
+	if err != nil || version <= 0 {
+		return "", 0, false
+	}
+	return key[:pos], version, true
+}
+
+// StorageKey returns the key of the file of a content in the storage:
+// its id for the current version, a version key for a previous one
+func StorageKey(c Content) string {
+	if c.Archived {
+		return VersionKey(c.Id, c.Version)
+	}
+	return c.Id
+}
+
+// archiveTx stores the current version of a content in the content_version table
+// if the update replaces its file, and returns the version of the updated content
+func (i dbIndex) archiveTx(tx *sql.Tx, cur Content, c Content) (int, error) {
+	if !IsNewVersion(cur, c) {
+		return cur.Version, nil
+	}
+	_, err := i.addVersion.ExecTx(tx, cur.Id, cur.Version, cur.EncryptionKey, cur.Location, cur.Length, cur.Sha256, cur.Type)
+	return cur.Version + 1, err
+}
+
+// GetVersion returns a version of a content, the current version if version is 0.
+// A previous version has the descriptive fields of the current one.
+func (i dbIndex) GetVersion(id string, version int) (Content, error) {
+	c, err := i.Get(id)
+	if err != nil || version == 0 || version == c.Version {
+		return c, err
+	}
+	err = i.getVersion.QueryRow(c.Id, version).Scan(&c.Id, &c.Version, &c.EncryptionKey, &c.Location, &c.Length, &c.Sha256, &c.Type)
+	if err != nil {
+		return Content{}, wrap("get content version", err)
+	}
+	c.Archived = true
+	return c, nil
+}
+
+// ListVersions returns the versions of a content, the previous ones first
+func (i dbIndex) ListVersions(id string) ([]Content, error) {
+	cur, err := i.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := i.listVersions.Query(cur.Id)
+	if err != nil {
+		return nil, wrap("list content versions", err)
+	}
+	defer rows.Close()
+	var versions []Content
+	for rows.Next() {
+		c := cur
+		err = rows.Scan(&c.Id, &c.Version, &c.EncryptionKey, &c.Location, &c.Length, &c.Sha256, &c.Type)
+		if err != nil {
+			return nil, wrap("list content versions", err)
+		}
+		c.Archived = true
+		versions = append(versions, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, wrap("list content versions", err)
+	}
+	return append(versions, cur), nil
+}
+
+const versionTableDef = "CREATE TABLE IF NOT EXISTS content_version (" +
+	"content_id varchar(255) NOT NULL," +
+	"version integer NOT NULL," +
+	"encryption_key varchar(64) NOT NULL," +
+	"location text NOT NULL," +
+	"length bigint," +
+	"sha256 varchar(64)," +
+	"\"type\" varchar(256) NOT NULL default 'application/epub+zip'," +
+	"PRIMARY KEY (content_id, version))"
+
+const versionTableDefPostgres = "CREATE TABLE IF NOT EXISTS content_version (" +
+	"content_id varchar(255) NOT NULL," +
+	"version INT NOT NULL," +
+	"encryption_key bytea NOT NULL," +
+	"location text NOT NULL," +
+	"length bigint," +
+	"sha256 varchar(64)," +
+	"\"type\" varchar(256) NOT NULL default 'application/epub+zip'," +
+	"PRIMARY KEY (content_id, version))"
+
+var versionTableDefMySQL = dbutils.MySQLTable{Name: "content_version", Definition: "`content_id` varchar(255) NOT NULL," +
+	"`version` int NOT NULL," +
+	"`encryption_key` varbinary(64) NOT NULL," +
+	"`location` text NOT NULL," +
+	"`length` bigint DEFAULT NULL," +
+	"`sha256` varchar(64) DEFAULT NULL," +
+	"`type` varchar(255) NOT NULL DEFAULT 'application/epub+zip'," +
+	"PRIMARY KEY (`content_id`, `version`)"}
@@ -0,0 +1,285 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package integrity verifies the records of a License Server, e.g. after a migration:
+// it signs each stored license again and verifies the signature, checks that the content keys
+// can be encrypted and decrypted and reports corrupted or orphaned records.
+package integrity
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/sign"
+	"github.com/readium/readium-lcp-server/storage"
+	"github.com/readium/readium-lcp-server/streamer"
+)
+
+// kinds of problems
+const (
+	InvalidKey       = "invalid_key"       // the content key is not an AES-256 key
+	MissingFile      = "missing_file"      // the encrypted publication is not in the storage
+	KeyMismatch      = "key_mismatch"      // the content key does not decrypt the publication
+	OrphanedFile     = "orphaned_file"     // a file of the storage has no content record
+	OrphanedLicense  = "orphaned_license"  // the content of the license does not exist
+	InvalidRights    = "invalid_rights"    // the rights of the license are inconsistent
+	InvalidSignature = "invalid_signature" // the license cannot be signed and verified
+	InvalidCert      = "invalid_certificate"
+)
+
+// licensePageSize is the number of licenses read at once
+const licensePageSize = 100
+
+// Source gives access to the records of a License Server, or of one of its tenants
+type Source interface {
+	Index() index.Index
+	Licenses() license.Store
+	Store() storage.Store
+	CertificateFor(provider string) *tls.Certificate
+}
+
+// Problem is a corrupted or orphaned record
+type Problem struct {
+	Kind   string `json:"kind"`
+	Id     string `json:"id"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report is the result of a verification
+type Report struct {
+	Contents int       `json:"contents"`
+	Licenses int       `json:"licenses"`
+	Problems []Problem `json:"problems"`
+}
+
+func (r *Report) add(kind, id, detail string) {
+	r.Problems = append(r.Problems, Problem{Kind: kind, Id: id, Detail: detail})
+}
+
+// Check verifies all the records of a source. forTenant returns the view of a tenant,
+// used for the storage and certificate of its records. If deep is true, a resource of each
+// publication is decrypted with the content key, which reads all the encrypted files.
+//
+func Check(src Source, forTenant func(tenant string) Source, deep bool) (Report, error) {
+	report := Report{Problems: []Problem{}}
+
+	contents := make(map[string]index.Content)
+	fn := src.Index().List()
+	c, err := fn()
+	for ; err == nil; c, err = fn() {
+		contents[c.Id] = c
+	}
+	if !errors.Is(err, index.ErrNotFound) {
+		return report, err
+	}
+	report.Contents = len(contents)
+	for _, c := range contents {
+		checkContent(&report, c, forTenant(c.Tenant).Store(), deep)
+	}
+
+	// files of the storage without content record
+	items, err := src.Store().List()
+	if err == nil {
+		for _, item := range items {
+			if !knownFile(src.Index(), path.Base(item.Key()), contents) {
+				report.add(OrphanedFile, item.Key(), "")
+			}
+		}
+	}
+
+	checkedCerts := make(map[*tls.Certificate]bool)
+	var after license.Cursor
+	for {
+		var reports []license.LicenseReport
+		fn := src.Licenses().ListAllAfter(after, licensePageSize)
+		lr, err := fn()
+		for ; err == nil; lr, err = fn() {
+			reports = append(reports, lr)
+		}
+		if !errors.Is(err, license.ErrNotFound) {
+			return report, err
+		}
+		for _, lr := range reports {
+			report.Licenses++
+			l, err := src.Licenses().Get(lr.Id)
+			if err != nil {
+				report.add(InvalidSignature, lr.Id, err.Error())
+				continue
+			}
+			c, ok := contents[l.ContentId]
+			if !ok {
+				report.add(OrphanedLicense, l.Id, "content "+l.ContentId+" not found")
+				continue
+			}
+			cert := forTenant(l.Tenant).CertificateFor(l.Provider)
+			if !checkedCerts[cert] {
+				checkedCerts[cert] = true
+				checkCertificate(&report, cert, l.Provider)
+			}
+			checkLicense(&report, l, c, cert)
+		}
+		if len(reports) < licensePageSize {
+			break
+		}
+		after = license.CursorOf(reports[len(reports)-1])
+	}
+	return report, nil
+}
+
+// checkContent checks the key of a content and the presence of its file
+// knownFile checks if a file is the file of a content, or of a previous version of a content
+func knownFile(idx index.Index, key string, contents map[string]index.Content) bool {
+	if _, ok := contents[key]; ok {
+		return true
+	}
+	id, version, ok := index.ParseVersionKey(key)
+	if _, found := contents[id]; !ok || !found {
+		return false
+	}
+	c, err := idx.GetVersion(id, version)
+	return err == nil && c.Archived
+}
+
+func checkContent(report *Report, c index.Content, store storage.Store, deep bool) {
+	if len(c.EncryptionKey) != 32 {
+		report.add(InvalidKey, c.Id, "the key is not 32 bytes long")
+		return
+	}
+	item, err := store.Get(c.Id)
+	if err != nil {
+		report.add(MissingFile, c.Id, err.Error())
+		return
+	}
+	if !deep {
+		return
+	}
+	if err = decryptResource(item, c.EncryptionKey); err != nil {
+		report.add(KeyMismatch, c.Id, err.Error())
+	}
+}
+
+// decryptResource decrypts the first encrypted resource of a publication
+func decryptResource(item storage.Item, key []byte) error {
+	rc, err := item.Contents()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		// not a package, e.g. an encrypted PDF is stored inside a package; nothing to check
+		return nil
+	}
+	pub, err := streamer.Open(zr, key)
+	if err != nil {
+		return err
+	}
+	for _, res := range pub.Resources() {
+		if !res.Encrypted {
+			continue
+		}
+		_, clear, err := pub.Open(res.Path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ioutil.Discard, clear)
+		clear.Close()
+		return err
+	}
+	return nil
+}
+
+// checkCertificate checks the validity period of a signing certificate and its chain
+func checkCertificate(report *Report, cert *tls.Certificate, provider string) {
+	if cert == nil || len(cert.Certificate) == 0 {
+		report.add(InvalidCert, provider, "no certificate")
+		return
+	}
+	var chain []*x509.Certificate
+	for _, der := range cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			report.add(InvalidCert, provider, err.Error())
+			return
+		}
+		chain = append(chain, c)
+	}
+	now := time.Now()
+	for i, c := range chain {
+		if now.Before(c.NotBefore) || now.After(c.NotAfter) {
+			report.add(InvalidCert, provider, c.Subject.CommonName+" is not valid at this date")
+		}
+		if i+1 < len(chain) {
+			if err := c.CheckSignatureFrom(chain[i+1]); err != nil {
+				report.add(InvalidCert, provider, c.Subject.CommonName+" is not signed by "+chain[i+1].Subject.CommonName)
+			}
+		}
+	}
+}
+
+// checkLicense builds the license as the License Server does, with a throw-away user key,
+// then checks that the content key decrypts and that the signature is valid
+func checkLicense(report *Report, l license.License, c index.Content, cert *tls.Certificate) {
+	if l.Rights != nil && l.Rights.Start != nil && l.Rights.End != nil && l.Rights.End.Before(*l.Rights.Start) {
+		report.add(InvalidRights, l.Id, "the end of the rights is before their start")
+	}
+	if cert == nil {
+		return
+	}
+
+	passphraseHash := make([]byte, 32)
+	for i := range passphraseHash {
+		passphraseHash[i] = byte(i)
+	}
+	license.SetLicenseProfile(&l)
+	l.Encryption.UserKey.Value = passphraseHash
+	l.Encryption.UserKey.Hint = "integrity check"
+	// the content key is encrypted with the user key derived from the passphrase hash by the profile
+	userKey, err := license.GenerateUserKey(l.Encryption.Profile, l.Encryption.UserKey)
+	if err != nil {
+		report.add(InvalidSignature, l.Id, err.Error())
+		return
+	}
+	if err := license.SetLicenseLinks(&l, c); err != nil {
+		report.add(InvalidSignature, l.Id, err.Error())
+		return
+	}
+	if err := license.EncryptLicenseFields(&l, c); err != nil {
+		report.add(InvalidSignature, l.Id, err.Error())
+		return
+	}
+
+	decrypter, ok := crypto.NewAESEncrypter_CONTENT_KEY().(crypto.Decrypter)
+	if ok {
+		var out bytes.Buffer
+		err := decrypter.Decrypt(userKey, bytes.NewReader(l.Encryption.ContentKey.Value), &out)
+		if err != nil || !bytes.Equal(out.Bytes(), c.EncryptionKey) {
+			report.add(KeyMismatch, l.Id, "the content key does not decrypt")
+		}
+	}
+
+	if err := license.SignLicense(&l, cert); err != nil {
+		report.add(InvalidSignature, l.Id, err.Error())
+		return
+	}
+	sig := *l.Signature
+	l.Signature = nil
+	if err := sign.Verify(l, sig); err != nil {
+		report.add(InvalidSignature, l.Id, err.Error())
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package integrity
+
+import (
+	"bytes"
+	"crypto/tls"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/storage"
+)
+
+type source struct {
+	idx   index.Index
+	lst   license.Store
+	store storage.Store
+	cert  *tls.Certificate
+}
+
+func (s source) Index() index.Index                     { return s.idx }
+func (s source) Licenses() license.Store                { return s.lst }
+func (s source) Store() storage.Store                   { return s.store }
+func (s source) CertificateFor(string) *tls.Certificate { return s.cert }
+
+func TestCheck(t *testing.T) {
+	config.Config.LcpServer.Database = "sqlite3://:memory:"
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	idx, err := index.Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lst, err := license.NewSqlStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "integrity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, err := tls.LoadX509KeyPair("../sign/cert/sample_rsa.crt", "../sign/cert/sample_rsa.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := source{idx: idx, lst: lst, store: storage.NewFileSystem(dir, "http://localhost/files"), cert: &cert}
+
+	key := bytes.Repeat([]byte{1}, 32)
+	idx.Add(index.Content{Id: "good", EncryptionKey: key, Location: "good.epub", Type: "application/epub+zip"})
+	idx.Add(index.Content{Id: "nofile", EncryptionKey: key, Location: "nofile.epub"})
+	idx.Add(index.Content{Id: "badkey", EncryptionKey: []byte{1, 2, 3}, Location: "badkey.epub"})
+	src.store.Add("good", bytes.NewReader([]byte("not a package")))
+	src.store.Add("orphan", bytes.NewReader([]byte("orphan")))
+
+	now := time.Now().UTC().Truncate(time.Second)
+	before := now.Add(-time.Hour)
+	lst.Add(license.License{Id: "l1", Provider: "http://example.com", Issued: now, ContentId: "good",
+		User: license.UserInfo{Id: "u1"}, Rights: &license.UserRights{}})
+	lst.Add(license.License{Id: "l2", Provider: "http://example.com", Issued: now, ContentId: "good",
+		User: license.UserInfo{Id: "u2"}, Rights: &license.UserRights{Start: &now, End: &before}})
+	lst.Add(license.License{Id: "l3", Provider: "http://example.com", Issued: now, ContentId: "deleted",
+		User: license.UserInfo{Id: "u3"}, Rights: &license.UserRights{}})
+
+	report, err := Check(src, func(string) Source { return src }, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Contents != 3 || report.Licenses != 3 {
+		t.Errorf("Expected 3 contents and 3 licenses, got %d and %d", report.Contents, report.Licenses)
+	}
+	expected := map[string]string{
+		"nofile": MissingFile,
+		"badkey": InvalidKey,
+		"orphan": OrphanedFile,
+		"l2":     InvalidRights,
+		"l3":     OrphanedLicense,
+	}
+	for _, p := range report.Problems {
+		if p.Kind == InvalidCert {
+			// the sample certificate may be expired
+			continue
+		}
+		if expected[p.Id] != p.Kind {
+			t.Errorf("Unexpected problem %v", p)
+		}
+		delete(expected, p.Id)
+	}
+	if len(expected) != 0 {
+		t.Errorf("Missing problems %v", expected)
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package jobs stores the background work of the License Server, e.g. the encryption of the uploaded
+// publications, in the database: the jobs are run by a pool of workers, retried after a failure,
+// and their state is polled by the clients.
+package jobs
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
+)
+
+// the errors of the job store
+var (
+	ErrNotFound = dbutils.NewError(dbutils.ErrNotFound, "Job not found")
+	ErrConflict = dbutils.NewError(dbutils.ErrConflict, "Job conflict")
+	ErrStorage  = dbutils.NewError(dbutils.ErrStorage, "Job storage error")
+)
+
+func wrap(op string, err error) error {
+	return dbutils.Wrap(op, err, ErrNotFound, ErrConflict, ErrStorage)
+}
+
+// the states of a job: queued until a worker runs it, then done, queued again for a retry, or failed.
+// A job left running by a server which stopped is queued again once its lease has expired.
+const (
+	StateQueued  = "queued"
+	StateRunning = "running"
+	StateDone    = "done"
+	StateFailed  = "failed"
+)
+
+// Job is a unit of background work; its payload and result are json documents given by its kind
+type Job struct {
+	Id          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	State       string          `json:"state"`
+	Payload     json.RawMessage `json:"-"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	RunAt       time.Time       `json:"run_at"`
+	Created     time.Time       `json:"created"`
+	Updated     time.Time       `json:"updated"`
+}
+
+// LastAttempt returns true if a running job will not be retried after a failure
+func (j Job) LastAttempt() bool {
+	return j.Attempts >= j.MaxAttempts
+}
+
+// Store is the table of the jobs
+type Store interface {
+	Add(j Job) (Job, error)
+	Get(id int64) (Job, error)
+	// Claim marks the oldest due job as running for a worker; ErrNotFound if there is none
+	Claim(now time.Time) (Job, error)
+	Finish(id int64, result json.RawMessage) error
+	Retry(id int64, next time.Time, lastError string) error
+	Fail(id int64, lastError string) error
+	// Touch extends the lease of a running job
+	Touch(id int64) error
+	// Recover queues again the running jobs whose lease has expired before a time,
+	// or fails them if they were at their last attempt; it returns the number of recovered jobs
+	Recover(before time.Time) (int64, error)
+	// Requeue queues again a failed job, for a new series of attempts; ErrConflict if the job has not failed
+	Requeue(id int64) error
+	// List lists the jobs in a state, of all the states if empty,
+	// sorted by id, kind, state, run_at or updated; by id by default
+	List(state string, listing dbutils.Listing) func() (Job, error)
+}
+
+type sqlStore struct {
+	dialect dbutils.Dialect
+	add     *dbutils.Stmt
+	get     *dbutils.Stmt
+	due     *dbutils.Stmt
+	claim   *dbutils.Stmt
+	finish  *dbutils.Stmt
+	retry   *dbutils.Stmt
+	fail    *dbutils.Stmt
+	touch   *dbutils.Stmt
+	expire  *dbutils.Stmt
+	recover *dbutils.Stmt
+	requeue *dbutils.Stmt
+	db      *sql.DB
+}
+
+const jobColumns = "id, kind, state, payload, result, attempts, max_attempts, last_error, run_at, created, updated"
+
+func scanJob(row interface{ Scan(...interface{}) error }) (Job, error) {
+	var j Job
+	var payload, result string
+	err := row.Scan(&j.Id, &j.Kind, &j.State, &payload, &result, &j.Attempts, &j.MaxAttempts, &j.LastError, &j.RunAt, &j.Created, &j.Updated)
+	j.Payload = json.RawMessage(payload)
+	if result != "" {
+		j.Result = json.RawMessage(result)
+	}
+	return j, err
+}
+
+// Add queues a job, due immediately unless its RunAt is set
+func (s sqlStore) Add(j Job) (Job, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	j.State, j.Attempts, j.Created, j.Updated = StateQueued, 0, now, now
+	if j.RunAt.IsZero() {
+		j.RunAt = now
+	}
+	if j.MaxAttempts < 1 {
+		j.MaxAttempts = 1
+	}
+	args := []interface{}{j.Kind, j.State, string(j.Payload), j.MaxAttempts, j.RunAt.UTC(), j.Created, j.Updated}
+	var err error
+	if s.dialect == dbutils.Postgres {
+		// no LastInsertId with postgres
+		err = s.add.QueryRow(args...).Scan(&j.Id)
+	} else {
+		var result sql.Result
+		if result, err = s.add.Exec(args...); err == nil {
+			j.Id, err = result.LastInsertId()
+		}
+	}
+	return j, wrap("add job", err)
+}
+
+// Get returns a job
+func (s sqlStore) Get(id int64) (Job, error) {
+	j, err := scanJob(s.get.QueryRow(id))
+	return j, wrap("get job", err)
+}
+
+// Claim marks the oldest due job as running; another worker, of this server or of another instance,
+// may claim the same job, which is then skipped
+func (s sqlStore) Claim(now time.Time) (Job, error) {
+	for {
+		var id int64
+		if err := s.due.QueryRow(StateQueued, now.UTC()).Scan(&id); err != nil {
+			return Job{}, wrap("claim job", err)
+		}
+		result, err := s.claim.Exec(StateRunning, time.Now().UTC().Truncate(time.Second), id, StateQueued)
+		if err != nil {
+			return Job{}, wrap("claim job", err)
+		}
+		if claimed, err := result.RowsAffected(); err == nil && claimed != 1 {
+			continue
+		}
+		return s.Get(id)
+	}
+}
+
+// Finish records the result of a job
+func (s sqlStore) Finish(id int64, result json.RawMessage) error {
+	_, err := s.finish.Exec(StateDone, string(result), time.Now().UTC().Truncate(time.Second), id)
+	return wrap("finish job", err)
+}
+
+// Retry queues a failed job again, for its next attempt
+func (s sqlStore) Retry(id int64, next time.Time, lastError string) error {
+	_, err := s.retry.Exec(StateQueued, next.UTC(), truncate(lastError), time.Now().UTC().Truncate(time.Second), id)
+	return wrap("retry job", err)
+}
+
+// Fail records the failure of the last attempt of a job
+func (s sqlStore) Fail(id int64, lastError string) error {
+	_, err := s.fail.Exec(StateFailed, truncate(lastError), time.Now().UTC().Truncate(time.Second), id)
+	return wrap("fail job", err)
+}
+
+// Touch extends the lease of a running job: a job is running as long as its update is recent
+func (s sqlStore) Touch(id int64) error {
+	_, err := s.touch.Exec(time.Now().UTC().Truncate(time.Second), id, StateRunning)
+	return wrap("touch job", err)
+}
+
+// Recover fails the expired jobs which were at their last attempt, then queues again the others
+func (s sqlStore) Recover(before time.Time) (int64, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	result, err := s.expire.Exec(StateFailed, "Interrupted during its last attempt", now, StateRunning, before.UTC())
+	if err != nil {
+		return 0, wrap("recover jobs", err)
+	}
+	failed, _ := result.RowsAffected()
+	result, err = s.recover.Exec(StateQueued, now, "Interrupted", now, StateRunning, before.UTC())
+	if err != nil {
+		return failed, wrap("recover jobs", err)
+	}
+	queued, _ := result.RowsAffected()
+	return failed + queued, nil
+}
+
+// Requeue queues again a failed job, with its attempts reset
+func (s sqlStore) Requeue(id int64) error {
+	now := time.Now().UTC().Truncate(time.Second)
+	result, err := s.requeue.Exec(StateQueued, now, now, id, StateFailed)
+	if err != nil {
+		return wrap("requeue job", err)
+	}
+	if requeued, err := result.RowsAffected(); err == nil && requeued == 1 {
+		return nil
+	}
+	// either the job does not exist or it has not failed
+	if _, err = s.Get(id); err != nil {
+		return err
+	}
+	return &dbutils.Error{Kind: ErrConflict, Op: "requeue job", Err: errors.New("Only a failed job can be queued again")}
+}
+
+var jobSortColumns = map[string]string{
+	"id":      "id",
+	"kind":    "kind",
+	"state":   "state",
+	"run_at":  "run_at",
+	"updated": "updated",
+}
+
+// List lists the jobs in a state
+func (s sqlStore) List(state string, listing dbutils.Listing) func() (Job, error) {
+	clauses, err := listing.Clauses(jobSortColumns, "id", "id")
+	if err != nil {
+		return listJobs(nil, err)
+	}
+	query := "SELECT " + jobColumns + " FROM job"
+	var args []interface{}
+	if state != "" {
+		query += " WHERE state = ?"
+		args = append(args, state)
+	}
+	// the sort and the page are not parameters of the query: the query is not prepared
+	return listJobs(s.db.Query(s.dialect.Bind(query+clauses), args...))
+}
+
+// listJobs iterates on the rows of a list of jobs
+func listJobs(rows *sql.Rows, err error) func() (Job, error) {
+	if err != nil {
+		err = wrap("list jobs", err)
+		return func() (Job, error) { return Job{}, err }
+	}
+	return func() (Job, error) {
+		if !rows.Next() {
+			rows.Close()
+			return Job{}, ErrNotFound
+		}
+		j, err := scanJob(rows)
+		return j, wrap("list jobs", err)
+	}
+}
+
+// truncate returns an error message which fits in its column
+func truncate(msg string) string {
+	if len(msg) > 1024 {
+		return msg[:1024]
+	}
+	return msg
+}
+
+// Open opens the job store and creates the job table if it does not exist
+func Open(db *sql.DB) (Store, error) {
+	d := dbutils.DialectOf(config.Config.LcpServer.Database)
+	var err error
+	switch d {
+	case dbutils.Postgres:
+		_, err = db.Exec(tableDefPostgres)
+	case dbutils.MySQL:
+		err = dbutils.CreateMySQLTables(db, tableDefMySQL)
+	default:
+		_, err = db.Exec(tableDef)
+	}
+	if err != nil {
+		log.Println("Error creating the job table")
+		return nil, err
+	}
+
+	addQuery := "INSERT INTO job (kind, state, payload, result, attempts, max_attempts, last_error, run_at, created, updated) VALUES (?, ?, ?, '', 0, ?, '', ?, ?, ?)"
+	if d == dbutils.Postgres {
+		addQuery += " RETURNING id"
+	}
+	return sqlStore{
+		dialect: d,
+		add:     dbutils.NewStmt(db, d.Bind(addQuery)),
+		get:     dbutils.NewStmt(db, d.Bind("SELECT "+jobColumns+" FROM job WHERE id = ?")),
+		due:     dbutils.NewStmt(db, d.Bind("SELECT id FROM job WHERE state = ? AND run_at <= ? ORDER BY run_at, id LIMIT 1")),
+		claim:   dbutils.NewStmt(db, d.Bind("UPDATE job SET state = ?, attempts = attempts + 1, updated = ? WHERE id = ? AND state = ?")),
+		finish:  dbutils.NewStmt(db, d.Bind("UPDATE job SET state = ?, result = ?, last_error = '', updated = ? WHERE id = ?")),
+		retry:   dbutils.NewStmt(db, d.Bind("UPDATE job SET state = ?, run_at = ?, last_error = ?, updated = ? WHERE id = ?")),
+		fail:    dbutils.NewStmt(db, d.Bind("UPDATE job SET state = ?, last_error = ?, updated = ? WHERE id = ?")),
+		touch:   dbutils.NewStmt(db, d.Bind("UPDATE job SET updated = ? WHERE id = ? AND state = ?")),
+		expire:  dbutils.NewStmt(db, d.Bind("UPDATE job SET state = ?, last_error = ?, updated = ? WHERE state = ? AND updated < ? AND attempts >= max_attempts")),
+		recover: dbutils.NewStmt(db, d.Bind("UPDATE job SET state = ?, run_at = ?, last_error = ?, updated = ? WHERE state = ? AND updated < ?")),
+		requeue: dbutils.NewStmt(db, d.Bind("UPDATE job SET state = ?, attempts = 0, run_at = ?, last_error = '', updated = ? WHERE id = ? AND state = ?")),
+		db:      db,
+	}, nil
+}
+
+const tableDef = "CREATE TABLE IF NOT EXISTS job (" +
+	"id integer PRIMARY KEY AUTOINCREMENT," +
+	"kind varchar(64) NOT NULL," +
+	"state varchar(16) NOT NULL," +
+	"payload text NOT NULL," +
+	"result text NOT NULL," +
+	"attempts int NOT NULL DEFAULT 0," +
+	"max_attempts int NOT NULL DEFAULT 1," +
+	"last_error varchar(1024) NOT NULL DEFAULT ''," +
+	"run_at datetime NOT NULL," +
+	"created datetime NOT NULL," +
+	"updated datetime NOT NULL" +
+	");" +
+	"CREATE INDEX IF NOT EXISTS job_state_index on job (state, run_at);"
+
+const tableDefPostgres = "CREATE TABLE IF NOT EXISTS job (" +
+	"id SERIAL PRIMARY KEY," +
+	"kind VARCHAR(64) NOT NULL," +
+	"state VARCHAR(16) NOT NULL," +
+	"payload TEXT NOT NULL," +
+	"result TEXT NOT NULL," +
+	"attempts INT NOT NULL DEFAULT 0," +
+	"max_attempts INT NOT NULL DEFAULT 1," +
+	"last_error VARCHAR(1024) NOT NULL DEFAULT ''," +
+	"run_at TIMESTAMPTZ NOT NULL," +
+	"created TIMESTAMPTZ NOT NULL," +
+	"updated TIMESTAMPTZ NOT NULL" +
+	");" +
+	"CREATE INDEX IF NOT EXISTS job_state_index on job (state, run_at);"
+
+var tableDefMySQL = dbutils.MySQLTable{Name: "job", Definition: "`id` int NOT NULL PRIMARY KEY AUTO_INCREMENT," +
+	"`kind` varchar(64) NOT NULL," +
+	"`state` varchar(16) NOT NULL," +
+	"`payload` text NOT NULL," +
+	"`result` text NOT NULL," +
+	"`attempts` int NOT NULL DEFAULT 0," +
+	"`max_attempts` int NOT NULL DEFAULT 1," +
+	"`last_error` varchar(1024) NOT NULL DEFAULT ''," +
+	"`run_at` datetime NOT NULL," +
+	"`created` datetime NOT NULL," +
+	"`updated` datetime NOT NULL",
+	Indexes: []dbutils.MySQLIndex{{Name: "job_state_index", Columns: "`state`, `run_at`"}}}
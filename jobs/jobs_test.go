@@ -0,0 +1,149 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package jobs
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
+)
+
+func openStore(t *testing.T) (Store, func()) {
+	config.Config.LcpServer.Database = "sqlite3://:memory:"
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	st, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st, func() { db.Close() }
+}
+
+func TestQueue(t *testing.T) {
+	st, closeDB := openStore(t)
+	defer closeDB()
+
+	q := NewQueue(st, 2)
+	q.Handle("square", func(j Job) (interface{}, error) {
+		var n int
+		if err := json.Unmarshal(j.Payload, &n); err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errors.New("negative")
+		}
+		return n * n, nil
+	})
+
+	now := time.Now()
+	if q.RunNext(now) {
+		t.Fatal("Expected no job to run")
+	}
+	ok, err := q.Enqueue("square", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok.State != StateQueued || ok.Id == 0 || ok.MaxAttempts != 2 {
+		t.Errorf("Unexpected job %+v", ok)
+	}
+	failed, _ := q.Enqueue("square", -1)
+	unknown, _ := q.Enqueue("cube", 2)
+
+	for q.RunNext(now) {
+	}
+	if j, _ := st.Get(ok.Id); j.State != StateDone || string(j.Result) != "9" || j.Attempts != 1 {
+		t.Errorf("Expected the job to be done, got %+v", j)
+	}
+	if j, _ := st.Get(unknown.Id); j.State != StateQueued || j.LastError != ErrUnknownKind.Error() {
+		t.Errorf("Expected the job without handler to be retried, got %+v", j)
+	}
+	j, _ := st.Get(failed.Id)
+	if j.State != StateQueued || j.Attempts != 1 || j.LastError != "negative" || !j.RunAt.After(now) {
+		t.Fatalf("Expected the failed job to be retried later, got %+v", j)
+	}
+
+	// the retries are due later
+	later := now.Add(time.Hour)
+	for q.RunNext(later) {
+	}
+	if j, _ = st.Get(failed.Id); j.State != StateFailed || j.Attempts != 2 {
+		t.Errorf("Expected the job to fail after its last attempt, got %+v", j)
+	}
+	if j, _ = st.Get(unknown.Id); j.State != StateFailed || j.LastError != ErrUnknownKind.Error() {
+		t.Errorf("Expected the job without handler to fail, got %+v", j)
+	}
+	if _, err = st.Get(42); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	st, closeDB := openStore(t)
+	defer closeDB()
+
+	// two jobs left running by a server which stopped, one of them at its last attempt
+	now := time.Now()
+	once, _ := st.Add(Job{Kind: "square", Payload: json.RawMessage("2"), MaxAttempts: 2})
+	last, _ := st.Add(Job{Kind: "square", Payload: json.RawMessage("3"), MaxAttempts: 1})
+	for i := 0; i < 2; i++ {
+		if _, err := st.Claim(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := st.Recover(now.Add(-time.Minute)); n != 0 || err != nil {
+		t.Fatalf("Expected the leases to be valid, got %d %v", n, err)
+	}
+	if n, err := st.Recover(now.Add(time.Minute)); n != 2 || err != nil {
+		t.Fatalf("Expected 2 jobs to be recovered, got %d %v", n, err)
+	}
+	if j, _ := st.Get(once.Id); j.State != StateQueued || j.Attempts != 1 || j.LastError == "" {
+		t.Errorf("Expected the interrupted job to be queued again, got %+v", j)
+	}
+	if j, _ := st.Get(last.Id); j.State != StateFailed || j.Attempts != 1 {
+		t.Errorf("Expected the job interrupted at its last attempt to fail, got %+v", j)
+	}
+
+	var failed []Job
+	fn := st.List(StateFailed, dbutils.Listing{})
+	j, err := fn()
+	for ; err == nil; j, err = fn() {
+		failed = append(failed, j)
+	}
+	if !errors.Is(err, ErrNotFound) || len(failed) != 1 || failed[0].Id != last.Id {
+		t.Fatalf("Expected the failed job to be listed, got %v %+v", err, failed)
+	}
+	if _, err = st.List("", dbutils.Listing{Sort: "payload"})(); !errors.Is(err, dbutils.ErrInvalidListing) {
+		t.Errorf("Expected an invalid listing, got %v", err)
+	}
+
+	if err = st.Requeue(last.Id); err != nil {
+		t.Fatal(err)
+	}
+	if j, _ = st.Get(last.Id); j.State != StateQueued || j.Attempts != 0 || j.LastError != "" {
+		t.Errorf("Expected the failed job to be queued again, got %+v", j)
+	}
+	if err = st.Requeue(last.Id); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected a queued job not to be queued again, got %v", err)
+	}
+	if err = st.Requeue(42); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	if retryDelay(1) != retryInitialDelay || retryDelay(3) != 4*retryInitialDelay || retryDelay(30) != retryMaxDelay {
+		t.Errorf("Unexpected delays %v %v %v", retryDelay(1), retryDelay(3), retryDelay(30))
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// pollInterval is the interval at which idle workers look for due jobs, e.g. the retries
+const pollInterval = 10 * time.Second
+
+// a running job holds a lease, extended by its worker while it runs; the jobs whose lease has expired,
+// left running by a server which stopped, are recovered at the start of the workers and then periodically
+const (
+	leaseDuration   = 5 * time.Minute
+	leaseHeartbeat  = time.Minute
+	recoverInterval = time.Minute
+)
+
+// delay between the attempts of a job, doubled at each failure
+const (
+	retryInitialDelay = 10 * time.Second
+	retryMaxDelay     = time.Hour
+)
+
+// ErrUnknownKind is the failure of a job which has no handler
+var ErrUnknownKind = errors.New("No handler for this kind of job")
+
+// Handler runs a job and returns its result, marshaled as json
+type Handler func(j Job) (interface{}, error)
+
+// Queue runs the jobs of a store with a pool of workers
+type Queue struct {
+	store       Store
+	handlers    map[string]Handler
+	maxAttempts int
+	wake        chan struct{}
+}
+
+// NewQueue returns the queue of the jobs of a store; a job is attempted at most maxAttempts times
+//
+func NewQueue(store Store, maxAttempts int) *Queue {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &Queue{store: store, handlers: make(map[string]Handler), maxAttempts: maxAttempts, wake: make(chan struct{}, 1)}
+}
+
+// Handle sets the handler of a kind of job; the handlers are set before the workers are started
+func (q *Queue) Handle(kind string, h Handler) {
+	q.handlers[kind] = h
+}
+
+// Store returns the store of the jobs of the queue
+func (q *Queue) Store() Store {
+	return q.store
+}
+
+// Enqueue adds a job, run as soon as a worker is free
+//
+func (q *Queue) Enqueue(kind string, payload interface{}) (Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+	j, err := q.store.Add(Job{Kind: kind, Payload: data, MaxAttempts: q.maxAttempts})
+	if err != nil {
+		return j, err
+	}
+	q.wakeUp()
+	return j, nil
+}
+
+// Requeue queues again a failed job, for a new series of attempts
+//
+func (q *Queue) Requeue(id int64) error {
+	if err := q.store.Requeue(id); err != nil {
+		return err
+	}
+	q.wakeUp()
+	return nil
+}
+
+// Recover queues again the jobs whose lease has expired at a time, left running by a server which stopped
+//
+func (q *Queue) Recover(now time.Time) {
+	n, err := q.store.Recover(now.Add(-leaseDuration))
+	if err != nil {
+		log.Println("Error recovering the interrupted jobs: " + err.Error())
+		return
+	}
+	if n > 0 {
+		log.Println("Recovered " + strconv.FormatInt(n, 10) + " interrupted jobs")
+		q.wakeUp()
+	}
+}
+
+func (q *Queue) wakeUp() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+		// the workers are already awake
+	}
+}
+
+// Start starts the workers of the queue, which limit the number of jobs running at the same time
+//
+func (q *Queue) Start(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	go q.recoverJobs()
+}
+
+func (q *Queue) recoverJobs() {
+	ticker := time.NewTicker(recoverInterval)
+	defer ticker.Stop()
+	for {
+		q.Recover(time.Now())
+		<-ticker.C
+	}
+}
+
+func (q *Queue) work() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		// run the due jobs, then wait for new ones
+		for q.RunNext(time.Now()) {
+		}
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunNext claims the oldest due job and runs it; it returns false if there was no job to run
+//
+func (q *Queue) RunNext(now time.Time) bool {
+	j, err := q.store.Claim(now)
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		log.Println("Error claiming a job: " + err.Error())
+		return false
+	}
+	result, err := q.runLeased(j)
+	switch {
+	case err == nil:
+		err = q.store.Finish(j.Id, result)
+	case j.LastAttempt():
+		log.Println("Job " + strconv.FormatInt(j.Id, 10) + " (" + j.Kind + ") failed: " + err.Error())
+		err = q.store.Fail(j.Id, err.Error())
+	default:
+		log.Println("Job " + strconv.FormatInt(j.Id, 10) + " (" + j.Kind + ") failed, retried: " + err.Error())
+		err = q.store.Retry(j.Id, time.Now().Add(retryDelay(j.Attempts)), err.Error())
+	}
+	if err != nil {
+		log.Println("Error updating the job " + strconv.FormatInt(j.Id, 10) + ": " + err.Error())
+	}
+	return true
+}
+
+// runLeased runs a job and extends its lease until it has ended
+func (q *Queue) runLeased(j Job) (json.RawMessage, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(leaseHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := q.store.Touch(j.Id); err != nil {
+					log.Println("Error extending the lease of the job " + strconv.FormatInt(j.Id, 10) + ": " + err.Error())
+				}
+			}
+		}
+	}()
+	return q.run(j)
+}
+
+// run runs the handler of a job and marshals its result
+func (q *Queue) run(j Job) (json.RawMessage, error) {
+	h, ok := q.handlers[j.Kind]
+	if !ok {
+		return nil, ErrUnknownKind
+	}
+	result, err := h(j)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+// retryDelay returns the delay before the next attempt of a job
+func retryDelay(attempts int) time.Duration {
+	delay := retryInitialDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/integrity"
+	"github.com/readium/readium-lcp-server/lcpserver/api"
+	"github.com/readium/readium-lcp-server/license"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// apiBackend talks to the REST APIs of the License Server
+type apiBackend struct {
+	lcpURL     string
+	lsdURL     string
+	username   string
+	password   string
+	notifyAuth config.Auth
+}
+
+// call sends a request and decodes the json response in out
+func call(method, url string, auth config.Auth, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	if auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return errors.New(method + " " + url + ": " + resp.Status + " " + string(detail))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (b *apiBackend) auth() config.Auth {
+	return config.Auth{Username: b.username, Password: b.password}
+}
+
+func (b *apiBackend) ListLicenses(contentID string, page, perPage int) ([]license.LicenseReport, error) {
+	u := b.lcpURL + "/licenses"
+	if contentID != "" {
+		u = b.lcpURL + "/contents/" + url.PathEscape(contentID) + "/licenses"
+	}
+	u += "?page=" + strconv.Itoa(page) + "&per_page=" + strconv.Itoa(perPage)
+	var licenses []license.LicenseReport
+	err := call("GET", u, b.auth(), "", nil, &licenses)
+	return licenses, err
+}
+
+// GetLicense returns the partial license stored by the License Server, without user key nor signature
+func (b *apiBackend) GetLicense(id string) (license.License, error) {
+	var l license.License
+	err := call("GET", b.lcpURL+"/licenses/"+url.PathEscape(id), b.auth(), "", nil, &l)
+	return l, err
+}
+
+func (b *apiBackend) ListContents() ([]index.Content, error) {
+	var contents []index.Content
+	err := call("GET", b.lcpURL+"/contents", b.auth(), "", nil, &contents)
+	return contents, err
+}
+
+// GetContent searches the content in the list, the content route returns the encrypted file
+func (b *apiBackend) GetContent(id string) (index.Content, error) {
+	contents, err := b.ListContents()
+	if err != nil {
+		return index.Content{}, err
+	}
+	for _, c := range contents {
+		if c.Id == id {
+			return c, nil
+		}
+	}
+	return index.Content{}, index.ErrNotFound
+}
+
+// Notify sends the license to the License Status Server, as the License Server does after its creation
+func (b *apiBackend) Notify(l license.License) error {
+	if b.lsdURL == "" {
+		return errors.New("the url of the License Status Server is missing, use -lsd or -config")
+	}
+	payload, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return call("PUT", b.lsdURL+"/licenses", b.notifyAuth, api.ContentType_LCP_JSON, bytes.NewReader(payload), nil)
+}
+
+// Verify asks the License Server to verify its records
+func (b *apiBackend) Verify(deep bool) (integrity.Report, error) {
+	var report integrity.Report
+	err := call("GET", b.lcpURL+"/integrity?deep="+strconv.FormatBool(deep), b.auth(), "", nil, &report)
+	return report, err
+}
+
+// Certificates returns the certificates signing the licenses and the number of licenses they signed last
+func (b *apiBackend) Certificates() ([]license.CertificateReport, error) {
+	var certs []license.CertificateReport
+	err := call("GET", b.lcpURL+"/certificates", b.auth(), "", nil, &certs)
+	return certs, err
+}
+
+// KeyCheck asks the License Server for the key check of a license, and to validate the key check and passphrase given
+func (b *apiBackend) KeyCheck(req apilcp.KeyCheckRequest) (apilcp.KeyCheckResult, error) {
+	var result apilcp.KeyCheckResult
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return result, err
+	}
+	err = call("POST", b.lcpURL+"/licenses/key_check", b.auth(), api.ContentType_JSON, bytes.NewReader(payload), &result)
+	return result, err
+}
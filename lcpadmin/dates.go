@@ -0,0 +1,47 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
+)
+
+// migrateDates rewrites in UTC the dates stored by the former versions of the servers
+// in the timezone of the server, in the databases of the configuration
+func migrateDates() error {
+	databases := []struct {
+		name string
+		info config.ServerInfo
+	}{
+		{config.LcpServerName, config.Config.LcpServer},
+		{config.LsdServerName, config.Config.LsdServer.ServerInfo},
+		{config.FrontendServerName, config.Config.FrontendServer.ServerInfo},
+	}
+	migrated := false
+	for _, d := range databases {
+		if d.info.Database == "" {
+			continue
+		}
+		db, err := openDB(d.info.Database, d.info)
+		if err != nil {
+			return err
+		}
+		n, err := dbutils.MigrateDates(db, dbutils.DialectOf(d.info.Database))
+		db.Close()
+		if err != nil {
+			return errors.New(d.name + ": " + err.Error())
+		}
+		fmt.Printf("%s: %d dates rewritten in UTC\n", d.name, n)
+		migrated = true
+	}
+	if !migrated {
+		return errors.New("no database in the configuration, use -config")
+	}
+	return nil
+}
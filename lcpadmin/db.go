@@ -0,0 +1,108 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/outbox"
+)
+
+// dbBackend reads the database of the License Server
+type dbBackend struct {
+	idx index.Index
+	lst license.Store
+	ob  outbox.Store
+}
+
+// openDB opens the database of a server from its uri, e.g. "sqlite3://file:lcp.sqlite"
+func openDB(uri string, info config.ServerInfo) (*sql.DB, error) {
+	parts := strings.SplitN(uri, "://", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("invalid database uri " + uri)
+	}
+	return dbutils.Open(parts[0], parts[1], info)
+}
+
+func openDatabase() (backend, error) {
+	uri := config.Config.LcpServer.Database
+	if uri == "" {
+		return nil, errors.New("the database of the License Server is missing, use -config")
+	}
+	db, err := openDB(uri, config.Config.LcpServer)
+	if err != nil {
+		return nil, err
+	}
+	b := &dbBackend{}
+	if b.idx, err = index.Open(db); err != nil {
+		return nil, err
+	}
+	if b.lst, err = license.NewSqlStore(db); err != nil {
+		return nil, err
+	}
+	if b.ob, err = outbox.Open(db); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *dbBackend) ListLicenses(contentID string, page, perPage int) ([]license.LicenseReport, error) {
+	var fn func() (license.LicenseReport, error)
+	if contentID != "" {
+		fn = b.lst.List(contentID, perPage, page-1)
+	} else {
+		fn = b.lst.ListAll(perPage, page-1)
+	}
+	var licenses []license.LicenseReport
+	l, err := fn()
+	for ; err == nil; l, err = fn() {
+		licenses = append(licenses, l)
+	}
+	if !errors.Is(err, license.ErrNotFound) {
+		return nil, err
+	}
+	return licenses, nil
+}
+
+func (b *dbBackend) GetLicense(id string) (license.License, error) {
+	return b.lst.Get(id)
+}
+
+func (b *dbBackend) ListContents() ([]index.Content, error) {
+	var contents []index.Content
+	fn := b.idx.List()
+	c, err := fn()
+	for ; err == nil; c, err = fn() {
+		contents = append(contents, c)
+	}
+	if !errors.Is(err, index.ErrNotFound) {
+		return nil, err
+	}
+	return contents, nil
+}
+
+func (b *dbBackend) GetContent(id string) (index.Content, error) {
+	return b.idx.Get(id)
+}
+
+// Notify stores the notification in the outbox, it is delivered by the running License Server
+func (b *dbBackend) Notify(l license.License) error {
+	payload, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return b.ob.Add(outbox.Notification{LicenseId: l.Id, Payload: payload})
+}
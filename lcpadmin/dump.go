@@ -0,0 +1,131 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/sign"
+	"github.com/readium/readium-lcp-server/status"
+)
+
+// dumpLicense prints the canonical JSON of a license, i.e. the signed data, and checks its signature.
+// The license is read from a file, or from the standard input with "-".
+//
+func dumpLicense(args []string) error {
+	name, err := oneArg(args, "license file")
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if name == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(name)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the license is decoded as a generic document, so that the fields unknown to this server are signed too
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err = dec.Decode(&doc); err != nil {
+		return err
+	}
+	rawSig, ok := doc["signature"]
+	if !ok {
+		return errors.New("the license is not signed")
+	}
+	delete(doc, "signature")
+	sigJSON, err := json.Marshal(rawSig)
+	if err != nil {
+		return err
+	}
+	var sig sign.Signature
+	if err = json.Unmarshal(sigJSON, &sig); err != nil {
+		return err
+	}
+
+	canon, err := sign.Canon(doc)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256(canon)
+	fmt.Println("Canonical JSON:")
+	fmt.Print(string(canon))
+	fmt.Println("SHA-256: " + hex.EncodeToString(hashed[:]))
+	fmt.Println("Signature algorithm: " + sig.Algorithm)
+	fmt.Println("Signature value: " + base64.StdEncoding.EncodeToString(sig.Value))
+
+	cert, err := x509.ParseCertificate(sig.Certificate)
+	if err != nil {
+		return errors.New("invalid certificate in the signature: " + err.Error())
+	}
+	fmt.Println("Certificate subject: " + cert.Subject.String())
+	fmt.Println("Certificate issuer: " + cert.Issuer.String())
+	fmt.Println("Certificate validity: " + cert.NotBefore.UTC().Format(time.RFC3339) + " - " + cert.NotAfter.UTC().Format(time.RFC3339))
+
+	if err = sign.Verify(doc, sig); err != nil {
+		fmt.Println("Signature: INVALID")
+		return err
+	}
+	fmt.Println("Signature: valid")
+	return nil
+}
+
+// revokeLicense asks the License Status Server to revoke or cancel a license;
+// the License Status Server updates the license on the License Server.
+//
+func revokeLicense(args []string, lsdURL string, auth config.Auth) error {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	message := fs.String("message", "", "message displayed to the user")
+	cancel := fs.Bool("cancel", false, "cancel the license instead of revoking it; only possible before its first use")
+	var id string
+	// the license id may come before or after the options
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		id, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if id == "" {
+		var err error
+		if id, err = oneArg(fs.Args(), "license id"); err != nil {
+			return err
+		}
+	}
+	if lsdURL == "" {
+		return errors.New("the url of the License Status Server is missing, use -lsd or -config")
+	}
+
+	newStatus := status.STATUS_REVOKED
+	if *cancel {
+		newStatus = status.STATUS_CANCELLED
+	}
+	body, err := json.Marshal(map[string]string{"status": newStatus, "message": *message})
+	if err != nil {
+		return err
+	}
+	err = call("PATCH", lsdURL+"/licenses/"+url.PathEscape(id)+"/status", auth, api.ContentType_JSON, bytes.NewReader(body), nil)
+	if err != nil {
+		return err
+	}
+	fmt.Println("License " + id + " " + newStatus)
+	return nil
+}
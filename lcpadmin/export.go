@@ -0,0 +1,442 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/license_statuses"
+	"github.com/readium/readium-lcp-server/status"
+	"github.com/readium/readium-lcp-server/transactions"
+)
+
+// A dump is a JSON document per line: a header, then the contents, the licenses and their status documents.
+// It does not depend on a database engine, e.g. it is used to migrate from sqlite to postgres.
+const (
+	dumpFormat  = "readium-lcp-dump"
+	dumpVersion = 1
+)
+
+// types of the lines of a dump
+const (
+	dumpHeaderType  = "header"
+	dumpContentType = "content"
+	dumpLicenseType = "license"
+	dumpStatusType  = "license_status"
+)
+
+// licenses read at once
+const exportPageSize = 100
+
+type dumpLine struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type dumpHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+type contentRecord struct {
+	Id              string          `json:"id"`
+	EncryptionKey   []byte          `json:"encryption_key"`
+	Location        string          `json:"location"`
+	Length          int64           `json:"length"`
+	Sha256          string          `json:"sha256"`
+	Type            string          `json:"type"`
+	Tenant          string          `json:"tenant,omitempty"`
+	Title           string          `json:"title,omitempty"`
+	Author          string          `json:"author,omitempty"`
+	Language        string          `json:"language,omitempty"`
+	PublicationDate string          `json:"publication_date,omitempty"`
+	CoverUrl        string          `json:"cover_url,omitempty"`
+	Metadata        *index.Metadata `json:"metadata,omitempty"`
+}
+
+type licenseRecord struct {
+	Id        string              `json:"id"`
+	UserId    string              `json:"user_id"`
+	Provider  string              `json:"provider"`
+	Issued    time.Time           `json:"issued"`
+	Updated   *time.Time          `json:"updated,omitempty"`
+	Rights    *license.UserRights `json:"rights,omitempty"`
+	ContentId string              `json:"content_id"`
+	Tenant    string              `json:"tenant,omitempty"`
+}
+
+type statusRecord struct {
+	LicenseId             string        `json:"license_id"`
+	Status                string        `json:"status"`
+	LicenseUpdated        *time.Time    `json:"license_updated,omitempty"`
+	StatusUpdated         *time.Time    `json:"status_updated,omitempty"`
+	DeviceCount           *int          `json:"device_count,omitempty"`
+	PotentialRightsEnd    *time.Time    `json:"potential_rights_end,omitempty"`
+	PotentialRightsPolicy string        `json:"potential_rights_policy,omitempty"`
+	RightsEnd             *time.Time    `json:"rights_end,omitempty"`
+	Tenant                string        `json:"tenant,omitempty"`
+	Provider              string        `json:"provider,omitempty"`
+	Events                []eventRecord `json:"events,omitempty"`
+}
+
+type eventRecord struct {
+	Type       string    `json:"type"`
+	Timestamp  time.Time `json:"timestamp"`
+	DeviceId   string    `json:"device_id,omitempty"`
+	DeviceName string    `json:"device_name,omitempty"`
+	Archived   bool      `json:"archived,omitempty"`
+}
+
+// dumpStores are the stores of the License Server and, if its database is configured,
+// of the License Status Server
+type dumpStores struct {
+	idx  index.Index
+	lst  license.Store
+	hist licensestatuses.LicenseStatuses
+	trns transactions.Transactions
+}
+
+// openDumpStores opens the databases of the configuration
+func openDumpStores() (*dumpStores, error) {
+	if config.Config.LcpServer.Database == "" {
+		return nil, errors.New("the database of the License Server is missing, use -config")
+	}
+	db, err := openDB(config.Config.LcpServer.Database, config.Config.LcpServer)
+	if err != nil {
+		return nil, err
+	}
+	s := &dumpStores{}
+	if s.idx, err = index.Open(db); err != nil {
+		return nil, err
+	}
+	if s.lst, err = license.NewSqlStore(db); err != nil {
+		return nil, err
+	}
+	if config.Config.LsdServer.Database == "" {
+		return s, nil
+	}
+	lsdDB, err := openDB(config.Config.LsdServer.Database, config.Config.LsdServer.ServerInfo)
+	if err != nil {
+		return nil, err
+	}
+	if s.hist, err = licensestatuses.Open(lsdDB); err != nil {
+		return nil, err
+	}
+	if s.trns, err = transactions.Open(lsdDB); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// exportDump writes the contents, licenses and status documents of the configured databases
+func exportDump(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("o", "-", "output file, - for the standard output")
+	fs.Parse(args)
+
+	s, err := openDumpStores()
+	if err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	write := func(kind string, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return enc.Encode(dumpLine{Type: kind, Data: data})
+	}
+
+	if err = write(dumpHeaderType, dumpHeader{Format: dumpFormat, Version: dumpVersion, Created: time.Now().UTC()}); err != nil {
+		return err
+	}
+
+	// contents are read first, the result set must be closed before reading their metadata
+	var contents []index.Content
+	fn := s.idx.List()
+	c, err := fn()
+	for ; err == nil; c, err = fn() {
+		contents = append(contents, c)
+	}
+	if !errors.Is(err, index.ErrNotFound) {
+		return err
+	}
+	for _, c := range contents {
+		rec := contentRecord{Id: c.Id, EncryptionKey: c.EncryptionKey, Location: c.Location, Length: c.Length,
+			Sha256: c.Sha256, Type: c.Type, Tenant: c.Tenant, Title: c.Title, Author: c.Author, Language: c.Language,
+			PublicationDate: c.PublicationDate, CoverUrl: c.CoverUrl}
+		if m, err := s.idx.GetMetadata(c.Id); err == nil {
+			rec.Metadata = &m
+		}
+		if err = write(dumpContentType, rec); err != nil {
+			return err
+		}
+	}
+
+	licenses, statuses := 0, 0
+	var after license.Cursor
+	for {
+		var ids []string
+		fn := s.lst.ListAllAfter(after, exportPageSize)
+		lr, err := fn()
+		for ; err == nil; lr, err = fn() {
+			ids = append(ids, lr.Id)
+			after = license.CursorOf(lr)
+		}
+		if !errors.Is(err, license.ErrNotFound) {
+			return err
+		}
+		for _, id := range ids {
+			l, err := s.lst.Get(id)
+			if err != nil {
+				return err
+			}
+			rec := licenseRecord{Id: l.Id, UserId: l.User.Id, Provider: l.Provider, Issued: l.Issued, Updated: l.Updated,
+				Rights: l.Rights, ContentId: l.ContentId, Tenant: l.Tenant}
+			if err = write(dumpLicenseType, rec); err != nil {
+				return err
+			}
+			licenses++
+			if s.hist == nil {
+				continue
+			}
+			ls, err := s.hist.GetByLicenseId(id)
+			if err != nil && ls == nil {
+				// no status document
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			srec, err := exportStatus(s.trns, ls)
+			if err != nil {
+				return err
+			}
+			if err = write(dumpStatusType, srec); err != nil {
+				return err
+			}
+			statuses++
+		}
+		if len(ids) < exportPageSize {
+			break
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d contents, %d licenses, %d license statuses exported\n", len(contents), licenses, statuses)
+	return nil
+}
+
+// exportStatus converts a status document and its events, archived events first
+func exportStatus(trns transactions.Transactions, ls *licensestatuses.LicenseStatus) (statusRecord, error) {
+	rec := statusRecord{LicenseId: ls.LicenseRef, Status: ls.Status, DeviceCount: ls.DeviceCount,
+		RightsEnd: ls.CurrentEndLicense, Tenant: ls.Tenant, PotentialRightsPolicy: ls.PotentialRightsPolicy,
+		Provider: ls.Provider}
+	if ls.Updated != nil {
+		rec.LicenseUpdated, rec.StatusUpdated = ls.Updated.License, ls.Updated.Status
+	}
+	if ls.PotentialRights != nil {
+		rec.PotentialRightsEnd = ls.PotentialRights.End
+	}
+	for _, archived := range []bool{true, false} {
+		var fn func() (transactions.Event, error)
+		if archived {
+			fn = trns.GetArchivedByLicenseStatusId(ls.Id)
+		} else {
+			fn = trns.GetByLicenseStatusId(ls.Id)
+		}
+		e, err := fn()
+		for ; err == nil; e, err = fn() {
+			rec.Events = append(rec.Events, eventRecord{Type: e.Type, Timestamp: e.Timestamp, DeviceId: e.DeviceId,
+				DeviceName: e.DeviceName, Archived: archived})
+		}
+		if !errors.Is(err, transactions.ErrNotFound) {
+			return rec, err
+		}
+	}
+	return rec, nil
+}
+
+// importDump reads a dump and adds its records to the configured databases.
+// The records which already exist are skipped, so that an interrupted import can be run again.
+func importDump(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Parse(args)
+	name, err := oneArg(fs.Args(), "dump file")
+	if err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	s, err := openDumpStores()
+	if err != nil {
+		return err
+	}
+
+	added := make(map[string]int)
+	skipped := make(map[string]int)
+	dec := json.NewDecoder(bufio.NewReader(in))
+	for n := 1; ; n++ {
+		var line dumpLine
+		err = dec.Decode(&line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.New("line " + strconv.Itoa(n) + ": " + err.Error())
+		}
+		if n == 1 {
+			var h dumpHeader
+			if line.Type != dumpHeaderType || json.Unmarshal(line.Data, &h) != nil || h.Format != dumpFormat {
+				return errors.New("not a dump of lcpadmin export")
+			}
+			if h.Version > dumpVersion {
+				return errors.New("unsupported dump version " + strconv.Itoa(h.Version))
+			}
+			continue
+		}
+		var exists bool
+		switch line.Type {
+		case dumpContentType:
+			exists, err = importContent(s, line.Data)
+		case dumpLicenseType:
+			exists, err = importLicense(s, line.Data)
+		case dumpStatusType:
+			if s.hist == nil {
+				return errors.New("the dump contains license statuses, the database of the License Status Server is missing in the configuration")
+			}
+			exists, err = importStatus(s, line.Data)
+		default:
+			err = errors.New("unknown type " + line.Type)
+		}
+		if err != nil {
+			return errors.New("line " + strconv.Itoa(n) + ": " + err.Error())
+		}
+		if exists {
+			skipped[line.Type]++
+		} else {
+			added[line.Type]++
+		}
+	}
+	for _, kind := range []string{dumpContentType, dumpLicenseType, dumpStatusType} {
+		fmt.Printf("%s: %d imported, %d already present\n", kind, added[kind], skipped[kind])
+	}
+	return nil
+}
+
+func importContent(s *dumpStores, data []byte) (bool, error) {
+	var rec contentRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return false, err
+	}
+	if _, err := s.idx.Get(rec.Id); err == nil {
+		return true, nil
+	}
+	c := index.Content{Id: rec.Id, EncryptionKey: rec.EncryptionKey, Location: rec.Location, Length: rec.Length,
+		Sha256: rec.Sha256, Type: rec.Type, Tenant: rec.Tenant, Title: rec.Title, Author: rec.Author, Language: rec.Language,
+		PublicationDate: rec.PublicationDate, CoverUrl: rec.CoverUrl}
+	if err := s.idx.Add(c); err != nil {
+		return false, err
+	}
+	if rec.Metadata != nil {
+		rec.Metadata.ContentId = rec.Id
+		return false, s.idx.SetMetadata(*rec.Metadata)
+	}
+	return false, nil
+}
+
+func importLicense(s *dumpStores, data []byte) (bool, error) {
+	var rec licenseRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return false, err
+	}
+	if _, err := s.lst.Get(rec.Id); err == nil {
+		return true, nil
+	}
+	l := license.License{Id: rec.Id, Provider: rec.Provider, Issued: rec.Issued, Updated: rec.Updated,
+		Rights: rec.Rights, ContentId: rec.ContentId, Tenant: rec.Tenant}
+	l.User.Id = rec.UserId
+	if l.Rights == nil {
+		l.Rights = new(license.UserRights)
+	}
+	return false, s.lst.Add(l)
+}
+
+// importStatus adds a status document, then its events: archived events are added as live events,
+// and archived again if events_cap is set in the configuration
+func importStatus(s *dumpStores, data []byte) (bool, error) {
+	var rec statusRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return false, err
+	}
+	if ls, err := s.hist.GetByLicenseId(rec.LicenseId); ls != nil {
+		return err == nil, err
+	}
+	ls := licensestatuses.LicenseStatus{LicenseRef: rec.LicenseId, Status: rec.Status, DeviceCount: rec.DeviceCount,
+		CurrentEndLicense: rec.RightsEnd, Tenant: rec.Tenant, PotentialRightsPolicy: rec.PotentialRightsPolicy, Provider: rec.Provider,
+		Updated: &licensestatuses.Updated{License: rec.LicenseUpdated, Status: rec.StatusUpdated}}
+	if rec.PotentialRightsEnd != nil {
+		ls.PotentialRights = &licensestatuses.PotentialRights{End: rec.PotentialRightsEnd}
+	}
+	if err := s.hist.Add(ls); err != nil {
+		return false, err
+	}
+	stored, err := s.hist.GetByLicenseId(rec.LicenseId)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range rec.Events {
+		typeInt, ok := eventTypeInt(e.Type)
+		if !ok {
+			return false, errors.New("unknown event type " + e.Type)
+		}
+		event := transactions.Event{DeviceName: e.DeviceName, Timestamp: e.Timestamp, DeviceId: e.DeviceId, LicenseStatusFk: stored.Id}
+		if err = s.trns.Add(event, typeInt); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// eventTypeInt returns the value stored in the database for a type of event
+func eventTypeInt(eventType string) (int, bool) {
+	for i, t := range status.EventTypes {
+		if t == eventType {
+			return i, true
+		}
+	}
+	return 0, false
+}
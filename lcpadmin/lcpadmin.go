@@ -0,0 +1,397 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// lcpadmin is a command line tool for the operators of a License Server:
+// it lists and inspects licenses and contents, revokes licenses, re-sends the notifications
+// to the License Status Server, dumps the signature of a license for debugging and reports the certificates
+// signing the licenses during a key rotation, and validates the key checks built from the passphrase hashes of the distributors.
+// It also exports and imports the contents, licenses and status documents, e.g. to change of database engine.
+// It talks to the server APIs, or directly to the database with -db.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/lcpserver/api"
+	"github.com/readium/readium-lcp-server/license"
+)
+
+// backend gives access to the licenses and contents of a License Server
+type backend interface {
+	ListLicenses(contentID string, page, perPage int) ([]license.LicenseReport, error)
+	GetLicense(id string) (license.License, error)
+	ListContents() ([]index.Content, error)
+	GetContent(id string) (index.Content, error)
+	// Notify sends the license to the License Status Server again
+	Notify(l license.License) error
+}
+
+const usage = `Usage: lcpadmin [options] <command> [arguments]
+
+Commands:
+  licenses [-content id] [-user id] [-page n] [-per-page n]   list or search licenses
+  license <license_id>                                         show a license record
+  revoke <license_id> [-message text] [-cancel]                revoke (or cancel) a license, through the License Status Server
+  contents                                                     list the contents
+  content <content_id>                                         show a content record
+  notify <license_id>                                          re-send the license to the License Status Server
+  dump <license file|->                                        print the canonical JSON and check the signature of a license
+  verify [-deep]                                               verify the stored licenses and contents, through the License Server
+  certificates [-retire fingerprint]                           list the certificates signing the licenses and their key rotations,
+                                                               or check that a certificate can be retired
+  keycheck <license_id> [-hash hex] [-passphrase text]         build the key check of a license from a passphrase hash, through the License Server,
+           [-check base64] [-profile uri]                      and validate the key check and the passphrase given
+  export [-o file]                                             export the contents, licenses and status documents of the databases of the configuration
+  import <dump file|->                                         import a dump of export into the databases of the configuration
+  migrate-dates                                                rewrite in UTC the dates stored in the timezone of the server (sqlite)
+
+Options:
+`
+
+func main() {
+	configFile := flag.String("config", os.Getenv("READIUM_LCPSERVER_CONFIG"), "configuration file of the License Server")
+	useDB := flag.Bool("db", false, "use the database of the configuration instead of the server APIs")
+	lcpURL := flag.String("lcp", "", "base url of the License Server, public_base_url of the configuration by default")
+	lsdURL := flag.String("lsd", "", "base url of the License Status Server, public_base_url of the configuration by default")
+	username := flag.String("username", "", "login of the License Server, lcp_update_auth of the configuration by default")
+	password := flag.String("password", "", "password of the License Server, lcp_update_auth of the configuration by default")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *configFile != "" {
+		config.ReadConfig(*configFile)
+	}
+	if *lcpURL == "" {
+		*lcpURL = config.Config.LcpServer.PublicBaseUrl
+	}
+	if *lsdURL == "" {
+		*lsdURL = config.Config.LsdServer.PublicBaseUrl
+	}
+	if *username == "" {
+		*username, *password = config.Config.LcpUpdateAuth.Username, config.Config.LcpUpdateAuth.Password
+	}
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+
+	// dump, revoke, export, import and migrate-dates do not need a backend
+	var err error
+	switch cmd {
+	case "dump":
+		err = dumpLicense(args)
+		exit(err)
+		return
+	case "revoke":
+		err = revokeLicense(args, *lsdURL, config.Config.LsdNotifyAuth)
+		exit(err)
+		return
+	case "export":
+		err = exportDump(args)
+		exit(err)
+		return
+	case "import":
+		err = importDump(args)
+		exit(err)
+		return
+	case "migrate-dates":
+		err = migrateDates()
+		exit(err)
+		return
+	}
+
+	var b backend
+	if *useDB {
+		b, err = openDatabase()
+	} else {
+		if *lcpURL == "" {
+			err = errors.New("the url of the License Server is missing, use -lcp or -config")
+		}
+		b = &apiBackend{lcpURL: strings.TrimRight(*lcpURL, "/"), lsdURL: strings.TrimRight(*lsdURL, "/"),
+			username: *username, password: *password, notifyAuth: config.Config.LsdNotifyAuth}
+	}
+	exit(err)
+
+	switch cmd {
+	case "licenses":
+		err = listLicenses(b, args)
+	case "license":
+		err = showLicense(b, args)
+	case "contents":
+		err = listContents(b)
+	case "content":
+		err = showContent(b, args)
+	case "notify":
+		err = notify(b, args)
+	case "verify":
+		if ab, ok := b.(*apiBackend); ok {
+			err = verify(ab, args)
+		} else {
+			err = errors.New("verify needs the License Server API, it is not available with -db")
+		}
+	case "certificates":
+		if ab, ok := b.(*apiBackend); ok {
+			err = listCertificates(ab, args)
+		} else {
+			err = errors.New("certificates needs the License Server API, it is not available with -db")
+		}
+	case "keycheck":
+		if ab, ok := b.(*apiBackend); ok {
+			err = keyCheck(ab, args)
+		} else {
+			err = errors.New("keycheck needs the License Server API, it is not available with -db")
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	exit(err)
+}
+
+// exit stops the program if there is an error
+func exit(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lcpadmin: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// oneArg returns the single identifier expected by a command
+func oneArg(args []string, name string) (string, error) {
+	if len(args) != 1 || args[0] == "" {
+		return "", errors.New("a " + name + " is expected")
+	}
+	return args[0], nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func listLicenses(b backend, args []string) error {
+	fs := flag.NewFlagSet("licenses", flag.ExitOnError)
+	contentID := fs.String("content", "", "licenses of a content")
+	userID := fs.String("user", "", "licenses of a user; all the pages are searched")
+	page := fs.Int("page", 1, "page number, starting at 1")
+	perPage := fs.Int("per-page", 30, "licenses per page")
+	fs.Parse(args)
+	if *page < 1 || *perPage < 1 {
+		return errors.New("page and per-page must be positive")
+	}
+
+	var licenses []license.LicenseReport
+	if *userID == "" {
+		list, err := b.ListLicenses(*contentID, *page, *perPage)
+		if err != nil {
+			return err
+		}
+		licenses = list
+	} else {
+		// the user is not indexed: scan the pages
+		for p := 1; ; p++ {
+			list, err := b.ListLicenses(*contentID, p, 100)
+			if err != nil {
+				return err
+			}
+			for _, l := range list {
+				if l.User.Id == *userID {
+					licenses = append(licenses, l)
+				}
+			}
+			if len(list) < 100 {
+				break
+			}
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tPROVIDER\tISSUED\tUPDATED\tEND")
+	for _, l := range licenses {
+		var end *time.Time
+		if l.Rights != nil {
+			end = l.Rights.End
+		}
+		fmt.Fprintln(w, l.Id+"\t"+l.User.Id+"\t"+l.Provider+"\t"+formatTime(&l.Issued)+"\t"+formatTime(l.Updated)+"\t"+formatTime(end))
+	}
+	return w.Flush()
+}
+
+func showLicense(b backend, args []string) error {
+	id, err := oneArg(args, "license id")
+	if err != nil {
+		return err
+	}
+	l, err := b.GetLicense(id)
+	if err != nil {
+		return err
+	}
+	return printJSON(l)
+}
+
+func listContents(b backend) error {
+	contents, err := b.ListContents()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tLENGTH\tLOCATION")
+	for _, c := range contents {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", c.Id, c.Type, c.Length, c.Location)
+	}
+	return w.Flush()
+}
+
+func showContent(b backend, args []string) error {
+	id, err := oneArg(args, "content id")
+	if err != nil {
+		return err
+	}
+	c, err := b.GetContent(id)
+	if err != nil {
+		return err
+	}
+	return printJSON(c)
+}
+
+func notify(b backend, args []string) error {
+	id, err := oneArg(args, "license id")
+	if err != nil {
+		return err
+	}
+	l, err := b.GetLicense(id)
+	if err != nil {
+		return err
+	}
+	if err = b.Notify(l); err != nil {
+		return err
+	}
+	fmt.Println("Notification of license " + id + " sent")
+	return nil
+}
+
+func verify(b *apiBackend, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	deep := fs.Bool("deep", false, "decrypt a resource of each publication; all the encrypted files are read")
+	fs.Parse(args)
+	report, err := b.Verify(*deep)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tID\tDETAIL")
+	for _, p := range report.Problems {
+		fmt.Fprintln(w, p.Kind+"\t"+p.Id+"\t"+p.Detail)
+	}
+	w.Flush()
+	fmt.Printf("%d contents, %d licenses, %d problems\n", report.Contents, report.Licenses, len(report.Problems))
+	if len(report.Problems) > 0 {
+		return errors.New("integrity problems found")
+	}
+	return nil
+}
+
+// listCertificates lists the certificates signing the licenses; with -retire, it checks that a certificate,
+// identified by its fingerprint, neither signs licenses nor was the last to sign an active license
+func listCertificates(b *apiBackend, args []string) error {
+	fs := flag.NewFlagSet("certificates", flag.ExitOnError)
+	retire := fs.String("retire", "", "fingerprint of a certificate to retire")
+	fs.Parse(args)
+	certs, err := b.Certificates()
+	if err != nil {
+		return err
+	}
+	if *retire != "" {
+		for _, c := range certs {
+			if c.Fingerprint != *retire {
+				continue
+			}
+			if c.Signing {
+				return errors.New("the certificate " + c.Fingerprint + " still signs licenses, its key rotation must use the policy all")
+			}
+			if !c.Retirable {
+				return fmt.Errorf("%d active licenses were last signed with the certificate %s", c.Active, c.Fingerprint)
+			}
+		}
+		// a certificate which never signed a license can be retired too
+		fmt.Println("The certificate " + *retire + " can be retired")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tROLE\tPOLICY\tFINGERPRINT\tNOT AFTER\tSIGNING\tLICENSES\tACTIVE\tRETIRABLE")
+	for _, c := range certs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\t%d\t%d\t%t\n", c.Name, c.Role, c.Policy, c.Fingerprint, formatTime(c.NotAfter),
+			c.Signing, c.Licenses, c.Active, c.Retirable)
+	}
+	return w.Flush()
+}
+
+func keyCheck(b *apiBackend, args []string) error {
+	fs := flag.NewFlagSet("keycheck", flag.ExitOnError)
+	hash := fs.String("hash", "", "hex encoded passphrase hash, as sent by the distributor")
+	passphrase := fs.String("passphrase", "", "passphrase of the user, hashed with sha256 if no hash is given")
+	check := fs.String("check", "", "base64 encoded key check to validate")
+	profile := fs.String("profile", "", "profile of the license, the profile of the server by default")
+	fs.Parse(args)
+	id, err := oneArg(fs.Args(), "license id")
+	if err != nil {
+		return err
+	}
+	req := apilcp.KeyCheckRequest{LicenseId: id, Profile: *profile, Passphrase: *passphrase}
+	req.UserKey.HexValue = *hash
+	if *hash == "" {
+		if *passphrase == "" {
+			return errors.New("the passphrase hash or the passphrase is missing")
+		}
+		sum := sha256.Sum256([]byte(*passphrase))
+		req.UserKey.HexValue = hex.EncodeToString(sum[:])
+	}
+	if *check != "" {
+		if req.UserKey.Check, err = base64.StdEncoding.DecodeString(*check); err != nil {
+			return errors.New("invalid key check: " + err.Error())
+		}
+	}
+	result, err := b.KeyCheck(req)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Profile:   " + result.Profile)
+	fmt.Println("Key check: " + base64.StdEncoding.EncodeToString(result.KeyCheck))
+	if result.PassphraseValid != nil && !*result.PassphraseValid {
+		return errors.New("the passphrase hash is not the sha256 hash of the passphrase")
+	}
+	if result.Valid != nil {
+		if !*result.Valid {
+			return errors.New("the key check does not match the passphrase hash")
+		}
+		fmt.Println("The key check matches the passphrase hash")
+	}
+	return nil
+}
@@ -35,6 +35,7 @@ import (
 	"io/ioutil"
 	"os"
 
+	"github.com/readium/readium-lcp-server/config"
 	"github.com/readium/readium-lcp-server/crypto"
 	"github.com/readium/readium-lcp-server/epub"
 	"github.com/readium/readium-lcp-server/pack"
@@ -58,7 +59,8 @@ func EncryptWebPubPackage(profile pack.EncryptionProfile, inputPath string, outp
 
 	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
 
-	encryptionKey, err := pack.Process(profile, encrypter, reader, writer)
+	options := pack.NewOptions(config.Config.Packaging)
+	encryptionKey, err := pack.ProcessWithOptions(profile, encrypter, reader, writer, options)
 	if err != nil {
 		return encryptionError("Unable to encrypt file")
 	}
@@ -129,7 +131,8 @@ func EncryptEpub(inputPath string, outputPath string) (EncryptionArtifact, error
 
 	// Pack / encrypt the epub content, fill the output file
 	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
-	_, encryptionKey, err := pack.Do(encrypter, epubContent, output)
+	options := pack.NewOptions(config.Config.Packaging)
+	_, encryptionKey, err := pack.DoWithOptions(encrypter, epubContent, output, options)
 	if err != nil {
 		return encryptionError("Unable to encrypt file")
 	}
@@ -43,6 +43,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/readium/readium-lcp-server/config"
 	"github.com/readium/readium-lcp-server/crypto"
 	"github.com/readium/readium-lcp-server/epub"
 	"github.com/readium/readium-lcp-server/lcpserver/api"
@@ -62,6 +63,7 @@ func notifyLcpServer(lcpService, contentid string, lcpPublication apilcp.LcpPubl
 	//  protected-content-sha256: content sha
 	//  protected-content-disposition: encrypted file name
 	//  protected-content-type: encrypted file content type
+	//  source-sha256: source publication sha, which identifies a publication encrypted twice
 	//fmt.Printf("lcpsv = %s\n", *lcpsv)
 	var urlBuffer bytes.Buffer
 	urlBuffer.WriteString(lcpService)
@@ -121,16 +123,28 @@ func showHelpAndExit() {
 	log.Println("[-lcpsv]      optional http endpoint for the License server")
 	log.Println("[-login]      login ( needed for License server) ")
 	log.Println("[-password]   password ( needed for License server)")
+	log.Println("[-exempt]     optional comma separated glob patterns of resources which must not be encrypted")
+	log.Println("[-exempt-types] optional comma separated media types of resources which must not be encrypted")
+	log.Println("[-exempt-max-size] optional max size in bytes of the resources exempted by -exempt and -exempt-types")
+	log.Println("[-compress-types] optional comma separated media types of resources deflated before encryption")
+	log.Println("[-no-compress-types] optional comma separated media types of resources stored without compression")
+	log.Println("[-config]     optional configuration file, defining packaging options")
+	log.Println("[-title] [-author] [-language] [-publication-date] optional metadata of the publication, found in the epub file by default")
+	log.Println("[-cover-url]  optional url of the cover image of the publication")
+	log.Println("[-strict]     refuse to protect an epub file which fails the structural validation; a json report is written to stdout, the error message to stderr")
 	log.Println("[-help] :     help information")
 	os.Exit(0)
 	return
 }
 
+// errorOutput receives the error messages: stdout, unless stdout holds a json report
+var errorOutput = os.Stdout
+
 func exitWithError(lcpPublication apilcp.LcpPublication, err error, errorlevel int) {
-	os.Stdout.WriteString(lcpPublication.ErrorMessage + "; level " + strconv.Itoa(errorlevel))
-	os.Stdout.WriteString("\n")
+	errorOutput.WriteString(lcpPublication.ErrorMessage + "; level " + strconv.Itoa(errorlevel))
+	errorOutput.WriteString("\n")
 	if err != nil {
-		os.Stdout.WriteString(err.Error())
+		errorOutput.WriteString(err.Error())
 	}
 	/* kept for future debug
 	jsonBody, err := json.MarshalIndent(lcpPublication, " ", "  ")
@@ -172,6 +186,18 @@ func main() {
 	var username = flag.String("login", "", "login (License server)")
 	var password = flag.String("password", "", "password (License server)")
 	var profile = flag.String("profile", "basic", "LCP Profile to use for encryption")
+	var exempt = flag.String("exempt", "", "optional comma separated glob patterns of resources which must not be encrypted")
+	var exemptTypes = flag.String("exempt-types", "", "optional comma separated media types of resources which must not be encrypted, e.g. image/*")
+	var exemptMaxSize = flag.Int64("exempt-max-size", 0, "optional max size in bytes of the resources exempted by -exempt and -exempt-types")
+	var compressTypes = flag.String("compress-types", "", "optional comma separated media types of resources deflated before encryption, e.g. text/*")
+	var noCompressTypes = flag.String("no-compress-types", "", "optional comma separated media types of resources stored without compression, e.g. audio/*")
+	var configFile = flag.String("config", "", "optional configuration file, defining packaging options")
+	var strict = flag.Bool("strict", false, "refuse to protect an epub file which fails the structural validation")
+	var title = flag.String("title", "", "optional title of the publication; by default the title found in the epub file")
+	var author = flag.String("author", "", "optional author of the publication; by default the author found in the epub file")
+	var language = flag.String("language", "", "optional language of the publication; by default the language found in the epub file")
+	var publicationDate = flag.String("publication-date", "", "optional publication date; by default the date found in the epub file")
+	var coverURL = flag.String("cover-url", "", "optional url of the cover image of the publication")
 
 	var help = flag.Bool("help", false, "shows information")
 
@@ -211,6 +237,16 @@ func main() {
 	// the output path must be accessible from the license server
 	addedPublication.Output = *outputFilename
 
+	// packaging options: from the configuration file, completed by the command line
+	var options pack.Options
+	if *configFile != "" {
+		config.ReadConfig(*configFile)
+		options = pack.NewOptions(config.Config.Packaging)
+	}
+	options.Exemptions = append(options.Exemptions, pack.ParseExemptionRules(*exempt, *exemptTypes, *exemptMaxSize)...)
+	options.CompressTypes = append(options.CompressTypes, pack.ParseMediaTypes(*compressTypes)...)
+	options.NoCompressTypes = append(options.NoCompressTypes, pack.ParseMediaTypes(*noCompressTypes)...)
+
 	var lcpProfile pack.EncryptionProfile
 	if *profile == "v1" {
 		lcpProfile = pack.EncryptionProfile(license.V1_PROFILE)
@@ -229,17 +265,45 @@ func main() {
 			addedPublication.ErrorMessage = "Error opening input file, for more information type 'lcpencrypt -help' "
 			exitWithError(addedPublication, err, 70)
 		}
+		// the checksum of the source lets the license server detect a publication encrypted twice
+		sourceHash := sha256.Sum256(buf)
+		addedPublication.SourceSha256 = hex.EncodeToString(sourceHash[:])
 		// read the epub content from the zipped buffer
 		zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
 		if err != nil {
 			addedPublication.ErrorMessage = "Error opening the epub file"
 			exitWithError(addedPublication, err, 60)
 		}
+		// check the structure of the epub
+		report := epub.Validate(zr)
+		for _, issue := range report.Errors {
+			log.Println("Validation error (" + issue.Code + ") " + issue.Path + ": " + issue.Message)
+		}
+		for _, issue := range report.Warnings {
+			log.Println("Validation warning (" + issue.Code + ") " + issue.Path + ": " + issue.Message)
+		}
+		if !report.Valid && *strict {
+			jsonReport, _ := json.MarshalIndent(report, " ", "  ")
+			os.Stdout.Write(jsonReport)
+			os.Stdout.WriteString("\n")
+			// stdout only holds the report, which can be parsed as json
+			errorOutput = os.Stderr
+			addedPublication.ErrorMessage = "The epub file is not valid"
+			exitWithError(addedPublication, nil, 55)
+		}
 		ep, err := epub.Read(zr)
 		if err != nil {
 			addedPublication.ErrorMessage = "Error reading the epub content"
 			exitWithError(addedPublication, err, 50)
 		}
+		// the descriptive metadata of the publication, sent to the license server
+		if len(ep.Package) > 0 {
+			metadata := ep.Package[0].Metadata
+			addedPublication.Title = strings.TrimSpace(metadata.Title)
+			addedPublication.Author = strings.TrimSpace(metadata.Author)
+			addedPublication.Language = strings.TrimSpace(metadata.Language)
+			addedPublication.PublicationDate = strings.TrimSpace(metadata.Date)
+		}
 
 		// create an output file
 		output, err = os.Create(*outputFilename)
@@ -249,9 +313,10 @@ func main() {
 		}
 
 		// pack / encrypt the epub content, fill the output file
-		_, encryptionKey, err = pack.Do(encrypter, ep, output)
+		_, encryptionKey, err = pack.DoWithOptions(encrypter, ep, output, options)
 	} else if strings.HasSuffix(*inputFilename, ".pdf") {
 		addedPublication.ContentType = "application/pdf+lcp"
+		addedPublication.SourceSha256 = getChecksum(*inputFilename)
 		packagePath := *outputFilename + ".webpub"
 		err := pack.BuildWebPubPackageFromPDF(filepath.Base(*inputFilename), *inputFilename, packagePath)
 		if err != nil {
@@ -278,7 +343,7 @@ func main() {
 			exitWithError(addedPublication, err, 40)
 		}
 
-		encryptionKey, err = pack.Process(lcpProfile, encrypter, reader, writer)
+		encryptionKey, err = pack.ProcessWithOptions(lcpProfile, encrypter, reader, writer, options)
 		if err != nil {
 			addedPublication.ErrorMessage = "Error encrypting"
 			exitWithError(addedPublication, err, 40)
@@ -301,6 +366,20 @@ func main() {
 		exitWithError(addedPublication, err, 30)
 	}
 	addedPublication.ContentKey = encryptionKey
+	// the metadata given on the command line override the metadata of the epub file
+	if *title != "" {
+		addedPublication.Title = *title
+	}
+	if *author != "" {
+		addedPublication.Author = *author
+	}
+	if *language != "" {
+		addedPublication.Language = *language
+	}
+	if *publicationDate != "" {
+		addedPublication.PublicationDate = *publicationDate
+	}
+	addedPublication.CoverUrl = *coverURL
 
 	// notify the LCP Server
 	if *lcpsv != "" {
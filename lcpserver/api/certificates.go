@@ -0,0 +1,40 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/sign"
+)
+
+// ListCertificates reports the certificates which sign the licenses, their key rotations,
+// and the number of licenses last signed with each of them, so that a certificate is retired
+// once no active license depends on it
+//
+func ListCertificates(w http.ResponseWriter, r *http.Request, s Server) {
+	counts, err := s.Licenses().CountSignatures(clock.Now())
+	if err == license.ErrOperatorOnly {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	certs := license.ReportCertificates(sign.Rotations(), counts)
+	if certs == nil {
+		certs = []license.CertificateReport{}
+	}
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(certs)
+}
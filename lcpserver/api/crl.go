@@ -0,0 +1,56 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/crl"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// maximum lifetime of a revocation list in the caches of the clients, in seconds
+const crlMaxAge = 24 * 60 * 60
+
+// GetCRL returns the certificate revocation list of the certificate which signs the licenses,
+// or of the certificate of a provider, as fetched from its distribution point and cached by the server
+//
+func GetCRL(w http.ResponseWriter, r *http.Request, s Server) {
+	cert := s.CertificateFor(r.FormValue("provider"))
+	if cert == nil {
+		problem.NotFoundHandler(w, r)
+		return
+	}
+	list, err := crl.Get(cert)
+	if err == crl.ErrNoDistributionPoint {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error getting the revocation list: " + err.Error())
+		problem.Error(w, r, problem.Problem{Detail: "The revocation list is not available"}, http.StatusBadGateway)
+		return
+	}
+
+	// the list is cached by the clients until its next update
+	maxAge := crlMaxAge
+	if !list.NextUpdate.IsZero() {
+		if untilNext := int(time.Until(list.NextUpdate) / time.Second); untilNext < maxAge {
+			maxAge = untilNext
+		}
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	w.Header().Set("Content-Type", api.ContentType_PKIX_CRL)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	w.Header().Set("Last-Modified", list.ThisUpdate.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(len(list.DER)))
+	w.Write(list.DER)
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/signedurl"
+	"github.com/readium/readium-lcp-server/storage"
+)
+
+// default validity of a download url
+const defaultDownloadTTL = 72 * time.Hour
+
+// maximum validity of a presigned url of a cloud storage (S3 signature v4)
+const maxPresignTTL = 7 * 24 * time.Hour
+
+// DownloadURL is a time-limited url of an encrypted publication
+type DownloadURL struct {
+	Href    string    `json:"href"`
+	Expires time.Time `json:"expires"`
+}
+
+// mintDownloadURL returns a time-limited url of an encrypted publication:
+// a presigned url if the storage supports it (S3), or a url of the License Server
+// signed with the secret of the configuration.
+//
+func mintDownloadURL(contentID string, s Server) (DownloadURL, error) {
+	ttl := defaultDownloadTTL
+	if signedTTL := config.SignedURLsTTL(); signedTTL > 0 {
+		ttl = time.Duration(signedTTL) * time.Second
+	}
+
+	item, err := s.Store().Get(contentID)
+	if err != nil {
+		return DownloadURL{}, err
+	}
+	if presigner, ok := item.(storage.Presigner); ok {
+		if ttl > maxPresignTTL {
+			ttl = maxPresignTTL
+		}
+		href, err := presigner.PresignedURL(ttl)
+		if err != nil {
+			return DownloadURL{}, err
+		}
+		return DownloadURL{Href: href, Expires: clock.Now().UTC().Add(ttl).Truncate(time.Second)}, nil
+	}
+
+	expires := clock.Now().UTC().Add(ttl).Truncate(time.Second)
+	href := config.Config.LcpServer.PublicBaseUrl + "/contents/" + contentID + "/download"
+	return DownloadURL{Href: signedurl.Sign(href, contentID, expires, config.Config.SignedURLs.Secret), Expires: expires}, nil
+}
+
+// setSignedPublicationLink replaces the publication link of a license by a time-limited url
+// of the file stored under a key
+//
+func setSignedPublicationLink(lic *license.License, key string, s Server) error {
+	for i := range lic.Links {
+		if lic.Links[i].Rel != "publication" {
+			continue
+		}
+		download, err := mintDownloadURL(key, s)
+		if err != nil {
+			return err
+		}
+		lic.Links[i].Href = download.Href
+	}
+	return nil
+}
+
+// MintDownloadURL returns a time-limited url of an encrypted publication
+//
+func MintDownloadURL(w http.ResponseWriter, r *http.Request, s Server) {
+	vars := mux.Vars(r)
+	contentID := vars["content_id"]
+
+	download, err := mintDownloadURL(contentID, s)
+	if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(download)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+}
+
+// DownloadContent returns an encrypted publication, if the url is signed and not expired
+//
+func DownloadContent(w http.ResponseWriter, r *http.Request, s Server) {
+	vars := mux.Vars(r)
+	contentID := vars["content_id"]
+
+	err := signedurl.Verify(r.URL.Query(), contentID, config.Config.SignedURLs.Secret, clock.Now())
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusForbidden)
+		return
+	}
+	serveContent(w, r, s, contentID)
+}
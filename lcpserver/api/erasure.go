@@ -0,0 +1,129 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/audit"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/servicetoken"
+	"github.com/readium/readium-lcp-server/transport"
+)
+
+// ErasureResult is the result of the erasure of the personal data of a user
+type ErasureResult struct {
+	Pseudonym string `json:"pseudonym"`
+	Licenses  int    `json:"licenses"`
+}
+
+// erasureDetail is the detail of an erasure recorded in the audit log; the user is identified
+// by a hash of its identifier, which allows to prove the erasure without keeping the identifier
+type erasureDetail struct {
+	UserHash string   `json:"user_hash"`
+	Licenses []string `json:"licenses"`
+	LsdError string   `json:"lsd_error,omitempty"`
+}
+
+// EraseUser replaces the identifier of a user by a pseudonym in its licenses, asks the License
+// Status Server to anonymize the events of these licenses and records the erasure in the audit log.
+// The licenses stay valid and the statistics are preserved, as all the licenses of the user
+// get the same pseudonym. The personal fields of the licenses (name, email, hint) are never stored.
+//
+func EraseUser(w http.ResponseWriter, r *http.Request, s Server) {
+	userID := mux.Vars(r)["user_id"]
+	if userID == "" {
+		problem.Error(w, r, problem.Problem{Detail: "The user id is missing"}, http.StatusBadRequest)
+		return
+	}
+	uid, err := uuid.NewV4()
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	pseudonym := "anon-" + uid.String()
+
+	ids, err := s.Licenses().EraseUser(userID, pseudonym)
+	if err == license.ErrOperatorOnly {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	hashed := sha256.Sum256([]byte(userID))
+	detail := erasureDetail{UserHash: hex.EncodeToString(hashed[:]), Licenses: ids}
+	if detail.Licenses == nil {
+		detail.Licenses = []string{}
+	}
+	lsdErr := notifyErasure(ids)
+	if lsdErr != nil {
+		detail.LsdError = lsdErr.Error()
+	}
+
+	actor, _, _ := r.BasicAuth()
+	payload, _ := json.Marshal(detail)
+	err = s.Audit().Add(audit.Entry{Actor: actor, Action: audit.ActionErasure, Subject: pseudonym, Detail: string(payload)})
+	if err != nil {
+		// the erasure is done, it must still be recorded
+		log.Println("Erasure " + pseudonym + ": error recording the audit entry: " + err.Error())
+		problem.Error(w, r, problem.Problem{Detail: "Erasure done but not recorded: " + err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	log.Println("Erasure " + pseudonym + ": " + strconv.Itoa(len(ids)) + " licenses")
+
+	if lsdErr != nil {
+		problem.Error(w, r, problem.Problem{Detail: "The licenses have been pseudonymized as " + pseudonym +
+			" but the events of the License Status Server have not been anonymized: " + lsdErr.Error()}, http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	json.NewEncoder(w).Encode(ErasureResult{Pseudonym: pseudonym, Licenses: len(ids)})
+}
+
+// notifyErasure asks the License Status Server to anonymize the events of the licenses
+func notifyErasure(ids []string) error {
+	if len(ids) == 0 || config.Config.LsdServer.PublicBaseUrl == "" {
+		return nil
+	}
+	payload, err := json.Marshal(map[string][]string{"licenses": ids})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", config.Config.LsdServer.PublicBaseUrl+"/erasures", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if err = servicetoken.Authorize(req, config.LsdServerName, config.NotifyAuth()); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", api.ContentType_JSON)
+
+	response, err := transport.To(config.LsdServerName).Do(req, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.New("The License Status Server returned " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// exportFlushRows is the number of licenses written between two flushes of an export
+const exportFlushRows = 1000
+
+// exportColumns are the columns of the csv exports
+var exportColumns = []string{"id", "user_id", "provider", "issued", "updated", "rights_print", "rights_copy",
+	"rights_start", "rights_end", "content_id", "reference"}
+
+// exportRecord is a license in an export, with its content
+type exportRecord struct {
+	license.LicenseReport
+	ContentId string `json:"content_id"`
+}
+
+// ExportLicenses streams the licenses, for the reconciliation with the systems of the distributors
+// parameters:
+//	format: ndjson (one json license per line, the default) or csv; else given by the Accept header
+//	content_id, user_id: content and user of the licenses
+//	since, until: bounds of the issue date of the licenses (RFC 3339)
+//
+// The licenses are written as they are read from the database, in chronological order.
+// Once the export has started, an error can only be reported by interrupting it.
+//
+func ExportLicenses(w http.ResponseWriter, r *http.Request, s Server) {
+	filter := license.ReportFilter{ContentId: r.FormValue("content_id"), UserId: r.FormValue("user_id")}
+	var err error
+	for name, bound := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := r.FormValue(name); value != "" {
+			if *bound, err = time.Parse(time.RFC3339, value); err != nil {
+				problem.Error(w, r, problem.Problem{Detail: name + " must be a RFC 3339 date"}, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	format := r.FormValue("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), api.ContentType_CSV) {
+		format = "csv"
+	}
+
+	var write func(license.LicenseReport) error
+	var flush func()
+	switch format {
+	case "", "ndjson":
+		w.Header().Set("Content-Type", api.ContentType_NDJSON)
+		w.Header().Set("Content-Disposition", "attachment; filename=licenses.ndjson")
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		write = func(l license.LicenseReport) error {
+			return enc.Encode(exportRecord{l, l.ContentId})
+		}
+		flush = func() {}
+	case "csv":
+		w.Header().Set("Content-Type", api.ContentType_CSV)
+		w.Header().Set("Content-Disposition", "attachment; filename=licenses.csv")
+		cw := csv.NewWriter(w)
+		cw.Write(exportColumns)
+		write = func(l license.LicenseReport) error {
+			return cw.Write(csvRecord(l))
+		}
+		flush = cw.Flush
+	default:
+		problem.Error(w, r, problem.Problem{Detail: "The format must be ndjson or csv"}, http.StatusBadRequest)
+		return
+	}
+
+	// a large export lasts longer than the write timeout of the server
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	err = s.Licenses().ExportReports(filter, func(l license.LicenseReport) error {
+		if err := write(l); err != nil {
+			return err
+		}
+		// the rows are sent as they are read, a slow client slows down the reading of the database
+		if count++; count%exportFlushRows == 0 {
+			flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil && count == 0 {
+		// nothing was sent yet
+		api.StoreError(w, r, err)
+		return
+	}
+	flush()
+	if err != nil {
+		log.Println("Export of the licenses interrupted after", count, "licenses:", err)
+	}
+}
+
+// csvRecord returns the columns of a license in a csv export
+func csvRecord(l license.LicenseReport) []string {
+	record := []string{l.Id, l.User.Id, l.Provider, l.Issued.UTC().Format(time.RFC3339), "", "", "", "", "", l.ContentId, l.Reference}
+	if l.Updated != nil {
+		record[4] = l.Updated.UTC().Format(time.RFC3339)
+	}
+	if l.Rights != nil {
+		if l.Rights.Print != nil {
+			record[5] = strconv.Itoa(int(*l.Rights.Print))
+		}
+		if l.Rights.Copy != nil {
+			record[6] = strconv.Itoa(int(*l.Rights.Copy))
+		}
+		if l.Rights.Start != nil {
+			record[7] = l.Rights.Start.UTC().Format(time.RFC3339)
+		}
+		if l.Rights.End != nil {
+			record[8] = l.Rights.End.UTC().Format(time.RFC3339)
+		}
+	}
+	return record
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/license"
+)
+
+func TestExportLicenses(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+
+	issued := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		l := license.License{Id: "l" + strconv.Itoa(i), Provider: "http://example.com", Issued: issued.AddDate(0, 0, i),
+			ContentId: "c1", Rights: &license.UserRights{}, Reference: "order-" + strconv.Itoa(i)}
+		l.User.Id = "u1"
+		if err := s.lst.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one license per line, in chronological order
+	w := httptest.NewRecorder()
+	ExportLicenses(w, httptest.NewRequest("GET", "/licenses/export?since=2020-03-02T00:00:00Z", nil), s)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Unexpected response %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var ids []string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["content_id"] != "c1" || record["reference"] == nil {
+			t.Errorf("Expected the content and the reference of the license, got %s", scanner.Bytes())
+		}
+		ids = append(ids, record["id"].(string))
+	}
+	if len(ids) != 2 || ids[0] != "l1" || ids[1] != "l2" {
+		t.Errorf("Expected the licenses issued since the 2nd, got %v", ids)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/licenses/export?until=2020-03-02T00:00:00Z", nil)
+	r.Header.Set("Accept", "text/csv")
+	ExportLicenses(w, r, s)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0][0] != "id" || records[1][0] != "l0" || records[1][3] != "2020-03-01T00:00:00Z" || records[1][10] != "order-0" {
+		t.Errorf("Unexpected csv export %v", records)
+	}
+
+	for _, query := range []string{"format=xml", "since=yesterday"} {
+		w = httptest.NewRecorder()
+		ExportLicenses(w, httptest.NewRequest("GET", "/licenses/export?"+query, nil), s)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected a bad request for %s, got %d", query, w.Code)
+		}
+	}
+}
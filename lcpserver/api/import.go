@@ -0,0 +1,195 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/license_statuses"
+)
+
+// MaxImportRecordSize is the max size of a record of an import, in bytes
+const MaxImportRecordSize = 1 << 20
+
+// the errors of the imported licenses
+var (
+	ErrImportLicense = errors.New("The license must have an id (at most 255 characters), a provider and an issue date")
+	ErrImportContent = errors.New("The content of the license is unknown: the contents are imported first")
+	ErrImportKeys    = errors.New("The keys of the license do not match its content and the passphrase hash of the user")
+)
+
+// ImportRecord is a license issued by another License Server, one json document per line of an import.
+// The License Status Server imports the same records: their status documents, or a new status document.
+//
+type ImportRecord struct {
+	// the license as it was delivered to the user, with its keys
+	License license.License `json:"license"`
+	// the content of the license, imported with its content key
+	ContentId string `json:"content_id"`
+	// the passphrase hash of the user, in hex: it checks the keys of the license and is not stored
+	UserKey string `json:"user_key,omitempty"`
+	// the status document of the license, if any
+	Status *licensestatuses.LicenseStatus `json:"status,omitempty"`
+}
+
+// ImportReport is the result of an import: the records imported, the records already present
+// and the invalid records, which are not imported
+//
+type ImportReport struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"`
+	Errors   []ImportError `json:"errors,omitempty"`
+}
+
+// ImportError is an invalid record of an import
+type ImportError struct {
+	Line  int    `json:"line"`
+	Id    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+// ReadImport calls fn on each record of an import; fn returns true if the record is already present.
+// An invalid record is reported and the import goes on, so that an import can be run again once fixed.
+// The import stops on an error of the body only.
+//
+func ReadImport(body io.Reader, fn func(ImportRecord) (bool, error)) (ImportReport, error) {
+	var report ImportReport
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), MaxImportRecordSize)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec ImportRecord
+		err := json.Unmarshal(line, &rec)
+		exists := false
+		if err == nil {
+			exists, err = fn(rec)
+		}
+		switch {
+		case err != nil:
+			report.Errors = append(report.Errors, ImportError{Line: n, Id: rec.License.Id, Error: err.Error()})
+		case exists:
+			report.Skipped++
+		default:
+			report.Imported++
+		}
+	}
+	return report, scanner.Err()
+}
+
+// WriteImportReport writes the report of an import, or the error which stopped it
+//
+func WriteImportReport(w http.ResponseWriter, r *http.Request, report ImportReport, err error) {
+	if err != nil {
+		api.BodyError(w, r, err)
+		return
+	}
+	log.Println("Import: " + strconv.Itoa(report.Imported) + " imported, " + strconv.Itoa(report.Skipped) +
+		" already present, " + strconv.Itoa(len(report.Errors)) + " invalid")
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(report)
+}
+
+// ImportLicenses imports the licenses issued by another License Server, e.g. while migrating to this server,
+// so that the publications already delivered stay readable: their fresh licenses are then built by this server.
+// The body is a sequence of ImportRecord, one per line; the contents of the licenses are imported first.
+// The keys of each license are checked with the passphrase hash of its user, which is not kept.
+// The License Status Server imports the same records, with POST /licenses/import.
+//
+func ImportLicenses(w http.ResponseWriter, r *http.Request, s Server) {
+	report, err := ReadImport(r.Body, func(rec ImportRecord) (bool, error) {
+		return importLicense(rec, s)
+	})
+	WriteImportReport(w, r, report, err)
+}
+
+// importLicense adds an imported license and keeps its keys; a license already present is skipped
+func importLicense(rec ImportRecord, s Server) (bool, error) {
+	l := rec.License
+	if l.Id == "" || len(l.Id) > 255 || l.Provider == "" || l.Issued.IsZero() {
+		return false, ErrImportLicense
+	}
+	_, err := s.Licenses().Get(l.Id)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, license.ErrNotFound) {
+		return false, err
+	}
+	c, err := s.Index().Get(rec.ContentId)
+	if errors.Is(err, index.ErrNotFound) {
+		return false, ErrImportContent
+	}
+	if err != nil {
+		return false, err
+	}
+	if l.Rights == nil {
+		l.Rights = new(license.UserRights)
+	}
+	// the imported licenses may have expired
+	if err = checkRights(l.Rights, config.RightsRules{AllowPastEnd: true}); err != nil {
+		return false, err
+	}
+	if err = checkImportedKeys(l, c, rec.UserKey); err != nil {
+		return false, err
+	}
+
+	stored := license.License{Id: l.Id, Provider: l.Provider, Issued: l.Issued.UTC(), Rights: l.Rights,
+		ContentId: c.Id, ContentVersion: c.Version}
+	stored.User.Id = l.User.Id
+	stored.Encryption.Profile = l.Encryption.Profile
+	stored.Encryption.UserKey.Algorithm = l.Encryption.UserKey.Algorithm
+	if err = s.Licenses().Add(stored); err != nil {
+		return false, err
+	}
+	// the encrypted content key, the key check and the encrypted user fields of the license
+	// are delivered again in its fresh licenses
+	return false, s.Licenses().SaveKeys(l.Id, license.KeysOf(l))
+}
+
+// checkImportedKeys checks that the content key and the key check of a license decrypt
+// with the user key derived from the passphrase hash of the user
+func checkImportedKeys(l license.License, c index.Content, userKeyHex string) error {
+	hash, err := hex.DecodeString(userKeyHex)
+	if err != nil || len(hash) == 0 {
+		return ErrImportKeys
+	}
+	key := l.Encryption.UserKey
+	key.Value = hash
+	userKey, err := license.GenerateUserKey(l.Encryption.Profile, key)
+	if err != nil {
+		return err
+	}
+	decrypter, ok := crypto.NewAESEncrypter_CONTENT_KEY().(crypto.Decrypter)
+	if !ok {
+		return ErrImportKeys
+	}
+	var contentKey bytes.Buffer
+	if err = decrypter.Decrypt(userKey, bytes.NewReader(l.Encryption.ContentKey.Value), &contentKey); err != nil ||
+		!bytes.Equal(contentKey.Bytes(), c.EncryptionKey) {
+		return ErrImportKeys
+	}
+	if license.CheckKeyCheck(l.Id, l.Encryption.Profile, key, l.Encryption.UserKey.Check) != nil {
+		return ErrImportKeys
+	}
+	return nil
+}
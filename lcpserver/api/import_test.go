@@ -0,0 +1,87 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/license"
+)
+
+// foreignRecord returns the import record of a license issued by another server for a content
+func foreignRecord(t *testing.T, id string, c index.Content, hash []byte) string {
+	l := license.License{Id: id, Provider: "http://other.example.com", Issued: time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)}
+	l.User.Id = "u1"
+	l.Encryption.Profile = license.BASIC_PROFILE
+	l.Encryption.UserKey.Algorithm = license.SHA256_URI
+	l.Encryption.UserKey.Hint = "hint"
+	l.Encryption.UserKey.Value = hash
+	if err := license.EncryptLicenseFields(&l, c); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(ImportRecord{License: l, ContentId: c.Id, UserKey: hex.EncodeToString(hash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestImportLicenses(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+
+	c := index.Content{Id: "c1", EncryptionKey: bytes.Repeat([]byte{7}, 32), Location: "c1.epub"}
+	if err := s.idx.Add(c); err != nil {
+		t.Fatal(err)
+	}
+	hash := bytes.Repeat([]byte{1}, 32)
+	other := c
+	other.EncryptionKey = bytes.Repeat([]byte{8}, 32)
+	unknown := c
+	unknown.Id = "c2"
+	body := strings.Join([]string{
+		foreignRecord(t, "l1", c, hash),
+		"",
+		foreignRecord(t, "l2", other, hash),
+		foreignRecord(t, "l3", unknown, hash),
+		`{"license":{"id":"l4"}}`,
+		`not json`,
+		foreignRecord(t, "l1", c, hash),
+	}, "\n")
+
+	w := httptest.NewRecorder()
+	ImportLicenses(w, httptest.NewRequest("POST", "/licenses/import", strings.NewReader(body)), s)
+	var report ImportReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 1 || report.Skipped != 1 || len(report.Errors) != 4 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	expected := map[int]string{3: ErrImportKeys.Error(), 4: ErrImportContent.Error(), 5: ErrImportLicense.Error()}
+	for _, e := range report.Errors {
+		if msg, ok := expected[e.Line]; ok && msg != e.Error {
+			t.Errorf("Expected %q on line %d, got %q", msg, e.Line, e.Error)
+		}
+	}
+
+	// the license is delivered again from its keys, the passphrase hash is not kept
+	l, err := s.lst.Get("l1")
+	if err != nil || l.Provider != "http://other.example.com" || l.User.Id != "u1" || !l.Issued.Equal(time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected imported license %+v (%v)", l, err)
+	}
+	keys, err := s.lst.GetKeys("l1")
+	if err != nil || len(keys.Encryption.ContentKey.Value) == 0 || len(keys.Encryption.UserKey.Check) == 0 ||
+		keys.Encryption.UserKey.Value != nil || keys.Encryption.UserKey.Hint != "hint" {
+		t.Errorf("Unexpected keys %+v (%v)", keys, err)
+	}
+}
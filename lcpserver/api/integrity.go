@@ -0,0 +1,32 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/integrity"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// CheckIntegrity verifies the stored licenses and contents and returns the report.
+// With ?deep=true, a resource of each publication is decrypted, which reads all the encrypted files.
+//
+func CheckIntegrity(w http.ResponseWriter, r *http.Request, s Server) {
+	deep := r.FormValue("deep") == "true"
+	report, err := integrity.Check(s, func(tenant string) integrity.Source { return s.ForTenant(tenant) }, deep)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err = enc.Encode(report); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+	}
+}
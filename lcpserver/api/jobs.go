@@ -0,0 +1,108 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/jobs"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// GetJob returns the state of a job, e.g. the encryption of an uploaded file, and its result once done
+//
+func GetJob(w http.ResponseWriter, r *http.Request, s Server) {
+	id, ok := jobId(w, r)
+	if !ok {
+		return
+	}
+	j, err := s.Jobs().Store().Get(id)
+	if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	writeJob(w, j, http.StatusOK)
+}
+
+// ListJobs lists the background jobs, e.g. the failed ones to queue them again
+// parameters:
+//	state: queued, running, done or failed (all the jobs by default)
+// 	page: page number
+//	per_page: number of items par page
+//	sort: id, kind, state, run_at or updated, prefixed by "-" for a descending order (default id)
+//
+func ListJobs(w http.ResponseWriter, r *http.Request, s Server) {
+	params, err := api.ParseListParams(r, api.DefaultPerPage)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	if params.After != "" {
+		problem.Error(w, r, problem.Problem{Detail: "The jobs are listed by page"}, http.StatusBadRequest)
+		return
+	}
+	state := r.FormValue("state")
+	switch state {
+	case "", jobs.StateQueued, jobs.StateRunning, jobs.StateDone, jobs.StateFailed:
+	default:
+		problem.Error(w, r, problem.Problem{Detail: "Unknown job state " + state}, http.StatusBadRequest)
+		return
+	}
+	fn := s.Jobs().Store().List(state, params.Listing())
+	list := make([]jobs.Job, 0)
+
+	j, err := fn()
+	for ; err == nil; j, err = fn() {
+		list = append(list, j)
+	}
+	if !errors.Is(err, jobs.ErrNotFound) {
+		api.StoreError(w, r, err)
+		return
+	}
+	api.WriteList(w, r, list, params.PageLinks(r, len(list)), params.Fields)
+}
+
+// RequeueJob queues again a failed job, for a new series of attempts; a job which has not failed is a conflict
+//
+func RequeueJob(w http.ResponseWriter, r *http.Request, s Server) {
+	id, ok := jobId(w, r)
+	if !ok {
+		return
+	}
+	if err := s.Jobs().Requeue(id); err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	j, err := s.Jobs().Store().Get(id)
+	if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	writeJob(w, j, http.StatusOK)
+}
+
+// jobId returns the id of the job of the url; an id which is not a number is not found
+func jobId(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["job_id"], 10, 64)
+	if err != nil {
+		api.StoreError(w, r, jobs.ErrNotFound)
+		return 0, false
+	}
+	return id, true
+}
+
+func writeJob(w http.ResponseWriter, j jobs.Job, status int) {
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(j)
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// KeyCheckRequest asks for the key check of a license, built from a passphrase hash, and validates
+// the key check and the passphrase if they are given. The profile is the profile of the server by default.
+type KeyCheckRequest struct {
+	LicenseId  string          `json:"license_id"`
+	Profile    string          `json:"profile,omitempty"`
+	Passphrase string          `json:"passphrase,omitempty"`
+	UserKey    license.UserKey `json:"user_key"`
+}
+
+// KeyCheckResult is the key check of a license for a passphrase hash;
+// Valid and PassphraseValid are only set if a key check or a passphrase was given
+type KeyCheckResult struct {
+	LicenseId       string `json:"license_id"`
+	Profile         string `json:"profile"`
+	Algorithm       string `json:"algorithm"`
+	KeyCheck        []byte `json:"key_check"`
+	Valid           *bool  `json:"valid,omitempty"`
+	PassphraseValid *bool  `json:"passphrase_valid,omitempty"`
+}
+
+// UserKeyRotation replaces the user key of a license: the passphrase hash of the previous user key
+// must match the key check of the license delivered last
+type UserKeyRotation struct {
+	Previous license.UserKey `json:"previous"`
+	UserKey  license.UserKey `json:"user_key"`
+}
+
+// decodePassphraseHash sets the passphrase hash of a user key from its hex value, if given,
+// and checks its size; sha256 is the default hash algorithm
+func decodePassphraseHash(key *license.UserKey) error {
+	if key.HexValue != "" {
+		value, err := hex.DecodeString(key.HexValue)
+		if err != nil {
+			return ErrBadHexValue
+		}
+		key.Value, key.HexValue = value, ""
+	}
+	if key.Value == nil {
+		return ErrMandatoryInfoMissing
+	}
+	if key.Algorithm == "" {
+		key.Algorithm = license.SHA256_URI
+	}
+	size := license.HashSize(key.Algorithm)
+	if size == 0 {
+		return license.ErrUnsupportedHashAlgorithm
+	}
+	if len(key.Value) != size {
+		return ErrBadValue
+	}
+	return nil
+}
+
+// CheckKeyCheck builds the key check of a license from a passphrase hash, so that a distributor can check
+// the hashes it sends before going live: the key check given is validated against the passphrase hash,
+// and the passphrase given is hashed and compared to it.
+//
+func CheckKeyCheck(w http.ResponseWriter, r *http.Request, s Server) {
+	var req KeyCheckRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		api.BodyError(w, r, err)
+		return
+	}
+	if req.LicenseId == "" {
+		problem.Error(w, r, problem.Problem{Detail: ErrMandatoryInfoMissing.Error()}, http.StatusBadRequest)
+		return
+	}
+	if req.Profile == "" {
+		req.Profile = license.ProfileURI(config.Config.Profile)
+	}
+	check := req.UserKey.Check
+	if err := decodePassphraseHash(&req.UserKey); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	keyCheck, err := license.BuildKeyCheck(req.LicenseId, req.Profile, req.UserKey)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	result := KeyCheckResult{LicenseId: req.LicenseId, Profile: req.Profile, Algorithm: req.UserKey.Algorithm, KeyCheck: keyCheck}
+	// the key check is encrypted with a random iv, it is validated by decryption
+	if check != nil {
+		valid := license.CheckKeyCheck(req.LicenseId, req.Profile, req.UserKey, check) == nil
+		result.Valid = &valid
+	}
+	if req.Passphrase != "" && req.UserKey.Algorithm == license.SHA256_URI {
+		hash := sha256.Sum256([]byte(req.Passphrase))
+		valid := bytes.Equal(hash[:], req.UserKey.Value)
+		result.PassphraseValid = &valid
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	json.NewEncoder(w).Encode(result)
+}
+
+// RotateUserKey encrypts the keys of the license delivered last with a new user key, after a change
+// of the passphrase of the user: the fresh licenses are then delivered with the new passphrase and hint.
+//
+func RotateUserKey(w http.ResponseWriter, r *http.Request, s Server) {
+	licenseID := mux.Vars(r)["license_id"]
+
+	var rotation UserKeyRotation
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rotation); err != nil {
+		api.BodyError(w, r, err)
+		return
+	}
+	for _, key := range []*license.UserKey{&rotation.Previous, &rotation.UserKey} {
+		if err := decodePassphraseHash(key); err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	keys, err := s.Licenses().GetKeys(licenseID)
+	if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	algorithm := keys.Encryption.UserKey.Algorithm
+	if algorithm == "" {
+		algorithm = license.SHA256_URI
+	}
+	if rotation.Previous.Algorithm != algorithm || rotation.UserKey.Algorithm != algorithm {
+		problem.Error(w, r, problem.Problem{Detail: ErrHashAlgorithmChanged.Error()}, http.StatusBadRequest)
+		return
+	}
+	rotated, err := keys.RotateUserKey(licenseID, rotation.Previous, rotation.UserKey)
+	if err == license.ErrKeyCheckMismatch {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	if err = s.Licenses().SaveKeys(licenseID, rotated); err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	log.Println("User key of the license " + licenseID + " rotated")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/license"
+)
+
+func passphraseHash(passphrase string) []byte {
+	hash := sha256.Sum256([]byte(passphrase))
+	return hash[:]
+}
+
+func TestCheckKeyCheck(t *testing.T) {
+	post := func(req KeyCheckRequest) (KeyCheckResult, int) {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		CheckKeyCheck(w, httptest.NewRequest("POST", "/licenses/key_check", bytes.NewReader(body)), nil)
+		var result KeyCheckResult
+		json.NewDecoder(w.Body).Decode(&result)
+		return result, w.Code
+	}
+
+	req := KeyCheckRequest{LicenseId: "l1", Passphrase: "secret"}
+	req.UserKey.HexValue = hex.EncodeToString(passphraseHash("secret"))
+	result, code := post(req)
+	if code != http.StatusOK || result.Profile != license.BASIC_PROFILE || result.KeyCheck == nil ||
+		result.PassphraseValid == nil || !*result.PassphraseValid || result.Valid != nil {
+		t.Fatalf("Unexpected key check %d %+v", code, result)
+	}
+	// the key check built is validated against the passphrase hash
+	req.UserKey.Check = result.KeyCheck
+	if result, _ = post(req); result.Valid == nil || !*result.Valid {
+		t.Errorf("Expected the key check to be valid, got %+v", result)
+	}
+	// the key check of another license, and another passphrase
+	req.LicenseId, req.Passphrase = "l2", "other"
+	if result, _ = post(req); result.Valid == nil || *result.Valid || *result.PassphraseValid {
+		t.Errorf("Expected the key check and the passphrase to be invalid, got %+v", result)
+	}
+	req.UserKey.HexValue = "not hex"
+	if _, code = post(req); code != http.StatusBadRequest {
+		t.Errorf("Expected a bad passphrase hash, got %d", code)
+	}
+}
+
+func TestRotateUserKey(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+	if err := borrow(s, "l1", "u1", nil); err != nil {
+		t.Fatal(err)
+	}
+	contentKey := bytes.Repeat([]byte{1}, 32)
+	l := license.License{Id: "l1", User: license.UserInfo{Id: "u1", Email: "user@example.com", Encrypted: []string{"email"}}}
+	l.Encryption.Profile = license.BASIC_PROFILE
+	l.Encryption.UserKey = license.UserKey{Key: license.Key{Algorithm: license.SHA256_URI}, Hint: "old hint", Value: passphraseHash("old")}
+	if err := license.EncryptLicenseFields(&l, index.Content{Id: "c1", EncryptionKey: contentKey}); err != nil {
+		t.Fatal(err)
+	}
+	saveLicenseKeys(l, s)
+
+	rotate := func(previous, next string) int {
+		var rotation UserKeyRotation
+		rotation.Previous.HexValue = hex.EncodeToString(passphraseHash(previous))
+		rotation.UserKey.HexValue = hex.EncodeToString(passphraseHash(next))
+		rotation.UserKey.Hint = "new hint"
+		body, _ := json.Marshal(rotation)
+		r := httptest.NewRequest("POST", "/licenses/l1/user_key", bytes.NewReader(body))
+		r = mux.SetURLVars(r, map[string]string{"license_id": "l1"})
+		w := httptest.NewRecorder()
+		RotateUserKey(w, r, s)
+		return w.Code
+	}
+	if code := rotate("wrong", "new"); code != http.StatusForbidden {
+		t.Errorf("Expected the previous passphrase to be checked, got %d", code)
+	}
+	if code := rotate("old", "new"); code != http.StatusNoContent {
+		t.Fatalf("Expected the user key to be rotated, got %d", code)
+	}
+
+	keys, err := s.Licenses().GetKeys("l1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey := license.UserKey{Value: passphraseHash("new")}
+	if err = license.CheckKeyCheck("l1", license.BASIC_PROFILE, newKey, keys.Encryption.UserKey.Check); err != nil {
+		t.Errorf("Expected the key check of the new passphrase, got %v", err)
+	}
+	if keys.Encryption.UserKey.Hint != "new hint" || keys.Encryption.UserKey.Value != nil {
+		t.Errorf("Unexpected user key %+v", keys.Encryption.UserKey)
+	}
+	var decrypted bytes.Buffer
+	decrypter := crypto.NewAESEncrypter_CONTENT_KEY().(crypto.Decrypter)
+	if err = decrypter.Decrypt(passphraseHash("new"), bytes.NewReader(keys.Encryption.ContentKey.Value), &decrypted); err != nil ||
+		!bytes.Equal(decrypted.Bytes(), contentKey) {
+		t.Errorf("Expected the content key to be encrypted with the new user key, got %v", err)
+	}
+	if email, err := license.DecryptUserField(passphraseHash("new"), keys.User.Email); err != nil || email != "user@example.com" {
+		t.Errorf("Expected the email to be encrypted with the new user key, got %s, %v", email, err)
+	}
+	// the previous passphrase no longer matches
+	if code := rotate("old", "other"); code != http.StatusForbidden {
+		t.Errorf("Expected the previous passphrase to be refused, got %d", code)
+	}
+}
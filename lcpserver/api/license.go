@@ -8,6 +8,7 @@ package apilcp
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -16,17 +17,19 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/audit"
+	"github.com/readium/readium-lcp-server/clock"
 	"github.com/readium/readium-lcp-server/config"
 	"github.com/readium/readium-lcp-server/epub"
 	"github.com/readium/readium-lcp-server/index"
 	"github.com/readium/readium-lcp-server/license"
 	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/sign"
 	"github.com/readium/readium-lcp-server/storage"
 )
 
@@ -39,6 +42,21 @@ var ErrBadHexValue = errors.New("Erroneous user_key.hex_value can't be decoded")
 // ErrBadValue sets an error message returned to the caller
 var ErrBadValue = errors.New("Erroneous user_key.value, can't be decoded")
 
+// ErrHashAlgorithmChanged sets an error message returned to the caller
+var ErrHashAlgorithmChanged = errors.New("The passphrase hash algorithm differs from the algorithm the license was issued with")
+
+// ErrNotUpdatable sets an error message returned to the caller
+var ErrNotUpdatable = errors.New("The partial license contains properties which cannot be updated")
+
+// ErrLicenseIdMismatch sets an error message returned to the caller
+var ErrLicenseIdMismatch = errors.New("The license id in the partial license does not match the url")
+
+// ErrBadRights sets an error message returned to the caller; the broken rules are detailed by a license.RightsError
+var ErrBadRights = license.ErrBadRights
+
+// ErrBadReference sets an error message returned to the caller
+var ErrBadReference = errors.New("Erroneous reference: at most 255 characters are allowed")
+
 // checkGetLicenseInput: if we generate or get a license, check mandatory information in the input body
 // and compute request parameters.
 //
@@ -62,15 +80,23 @@ func checkGetLicenseInput(l *license.License) error {
 		log.Println("User hashed passphrase is missing")
 		return ErrMandatoryInfoMissing
 	}
-	// check the size of Value (32 bytes), to avoid weird errors in the crypto code
-	if len(l.Encryption.UserKey.Value) != 32 {
-		return ErrBadValue
-	}
 	// the hash algorithm is given a default value -> sha256
 	if l.Encryption.UserKey.Algorithm == "" {
 		log.Println("User passphrase hash algorithm is missing, set default value")
-		// the only valid value (used in LCP basic and 1.0 profiles) is sha256
-		l.Encryption.UserKey.Algorithm = "http://www.w3.org/2001/04/xmlenc#sha256"
+		// the baseline value (used in LCP basic and 1.0 profiles) is sha256
+		l.Encryption.UserKey.Algorithm = license.SHA256_URI
+	}
+	// check the size of Value (32 bytes for sha256), to avoid weird errors in the crypto code
+	size := license.HashSize(l.Encryption.UserKey.Algorithm)
+	if size == 0 {
+		return license.ErrUnsupportedHashAlgorithm
+	}
+	if len(l.Encryption.UserKey.Value) != size {
+		return ErrBadValue
+	}
+	// only the email and name of the user can be encrypted
+	if err := license.CheckEncryptedFields(l.User); err != nil {
+		return err
 	}
 
 	return nil
@@ -87,6 +113,18 @@ func checkGenerateLicenseInput(l *license.License) error {
 		log.Println("User identification is missing")
 		return ErrMandatoryInfoMissing
 	}
+	if err := checkRights(l.Rights, license.RightsRulesOf(l.Provider)); err != nil {
+		return err
+	}
+	// the extensions are signed with the license
+	if err := license.CheckExtensions(l.Extensions); err != nil {
+		return err
+	}
+	if len(l.Reference) > 255 {
+		return ErrBadReference
+	}
+	// the profile of a new license is set by the server
+	l.Encryption.Profile = ""
 	// check user hint, passphrase hash and hash algorithm
 	err := checkGetLicenseInput(l)
 	return err
@@ -94,13 +132,19 @@ func checkGenerateLicenseInput(l *license.License) error {
 
 // get license, copy useful data from licIn to LicOut
 //
-func copyInputToLicense(licIn *license.License, licOut *license.License) {
+func copyInputToLicense(licIn *license.License, licOut *license.License) error {
+	// an issued license keeps its passphrase hash algorithm
+	algorithm := licOut.Encryption.UserKey.Algorithm
+	if algorithm != "" && algorithm != licIn.Encryption.UserKey.Algorithm {
+		return ErrHashAlgorithmChanged
+	}
 	// copy the hashed passphrase, user hint and algorithm
 	licOut.Encryption.UserKey = licIn.Encryption.UserKey
 	// copy optional user information
 	licOut.User.Email = licIn.User.Email
 	licOut.User.Name = licIn.User.Name
 	licOut.User.Encrypted = licIn.User.Encrypted
+	return nil
 }
 
 // normalize the start and end date, UTC, no milliseconds
@@ -120,40 +164,155 @@ func setRights(lic *license.License) {
 	}
 }
 
-// build a license, common to get and generate license, get and generate licensed publication
+// buildLicenseError reports an error of buildLicense; a passphrase hash algorithm not accepted
+// by the profile of the license is a bad request
 //
-func buildLicense(lic *license.License, s Server) error {
-
-	// set the LCP profile
-	license.SetLicenseProfile(lic)
-
-	// get content info from the db
-	content, err := s.Index().Get(lic.ContentId)
-	if err != nil {
-		log.Println("No content with id", lic.ContentId)
-		return err
+func buildLicenseError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == license.ErrUnsupportedHashAlgorithm {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
 	}
+	// e.g. an unknown content, a license id already used
+	api.StoreError(w, r, err)
+}
 
-	// set links
-	err = license.SetLicenseLinks(lic, content)
+// build a license, common to get and generate license, get and generate licensed publication
+//
+func buildLicense(lic *license.License, r *http.Request, s Server) error {
+	content, err := prepareLicense(lic, r, s)
 	if err != nil {
 		return err
 	}
+	// the server encrypts the user fields of the configuration, in addition to the fields listed by the caller
+	license.AddEncryptedFields(&lic.User, config.Config.License.EncryptUserFields)
 	// encrypt the content key, user fieds, set the key check
 	err = license.EncryptLicenseFields(lic, content)
 	if err != nil {
 		return err
 	}
-	// sign the license
-	err = license.SignLicense(lic, s.Certificate())
+	// sign the license with the certificate of its provider
+	return license.SignLicense(lic, signingCertificate(lic, s))
+}
+
+// refreshLicense builds a stored license again with the keys of the last license delivered
+// to the user: the rights and links are up to date, and the license is signed again with a certificate,
+// without the passphrase of the user
+//
+func refreshLicense(lic *license.License, keys license.Keys, cert *tls.Certificate, r *http.Request, s Server) error {
+	_, err := prepareLicense(lic, r, s)
 	if err != nil {
 		return err
 	}
-	return nil
+	keys.Apply(lic)
+	return license.SignLicense(lic, cert)
+}
+
+// signingCertificate returns the certificate signing a license: the certificate of its provider or,
+// during a key rotation, the certificate selected by the policy of the rotation
+//
+func signingCertificate(lic *license.License, s Server) *tls.Certificate {
+	rotation := sign.RotationOf(s.CertificateFor(lic.Provider))
+	if !rotation.Rotating() {
+		return rotation.Select("")
+	}
+	// the policy depends on the certificate which signed the license last, none for a new license
+	previous, err := s.Licenses().GetSignature(lic.Id)
+	if err != nil && !errors.Is(err, license.ErrSignatureNotFound) {
+		log.Println("Error getting the signature of the license", lic.Id, ":", err)
+		return rotation.Current
+	}
+	return rotation.Select(previous)
+}
+
+// saveLicenseKeys keeps the keys of a license delivered to a user, so that it can be refreshed,
+// and the certificate which signed it; an error is only logged, the license being delivered anyway
+func saveLicenseKeys(lic license.License, s Server) {
+	if err := s.Licenses().SaveKeys(lic.Id, license.KeysOf(lic)); err != nil {
+		log.Println("Error saving the keys of the license", lic.Id, ":", err)
+	}
+	saveLicenseSignature(lic, s)
 }
 
-func copyZipFile(out *zip.Writer, in *zip.Reader) error {
+// saveLicenseSignature records the certificate which signed a license, reported during a key rotation;
+// an error is only logged
+func saveLicenseSignature(lic license.License, s Server) {
+	if lic.Signature == nil {
+		return
+	}
+	if err := s.Licenses().SaveSignature(lic.Id, sign.FingerprintOf(lic.Signature.Certificate)); err != nil {
+		log.Println("Error saving the signature of the license", lic.Id, ":", err)
+	}
+}
+
+// prepareLicense sets the profile, the content and the links of a license,
+// and returns the version of the content it is issued for; the links on the server
+// are built on the base url forwarded by a trusted proxy, if any
+//
+func prepareLicense(lic *license.License, r *http.Request, s Server) (index.Content, error) {
+
+	// set the LCP profile of a new license; an issued license keeps the profile
+	// and the passphrase hash algorithm it was issued with
+	issued := lic.Encryption.Profile != ""
+	if !issued {
+		license.SetLicenseProfile(lic)
+	}
+
+	// get content info from the db: a license is issued for the current version of the content,
+	// and keeps the encryption key and file of this version when the content is replaced
+	content, err := s.Index().GetVersion(lic.ContentId, lic.ContentVersion)
+	if err != nil {
+		log.Println("No content with id", lic.ContentId, "version", lic.ContentVersion)
+		return content, err
+	}
+	lic.ContentVersion = content.Version
+	// a license requested for an alias is issued for the content the alias stands for
+	lic.ContentId = content.Id
+
+	// the license belongs to the tenant of the content
+	lic.Tenant = content.Tenant
+
+	// the template of the content may set the profile and links
+	var templateLinks map[string]string
+	if t := findLicenseTemplate(content, s); t != nil {
+		if t.Profile != "" && !issued {
+			lic.Encryption.Profile = license.ProfileURI(t.Profile)
+		}
+		templateLinks = t.Links
+	}
+	// the passphrase hash algorithm must be accepted by the profile
+	if !issued {
+		if err = license.NegotiateHashAlgorithm(lic); err != nil {
+			return content, err
+		}
+	}
+
+	// set links; the links set by the provider on an issued license replace the default and template links
+	var providerLinks []license.Link
+	if issued {
+		providerLinks = lic.Links
+	}
+	err = license.SetLicenseLinksWith(lic, content, templateLinks)
+	if err != nil {
+		return content, err
+	}
+	lic.Links = license.MergeLinks(lic.Links, providerLinks)
+	// replace the publication link by a time-limited url
+	if config.Config.SignedURLs.Secret != "" {
+		err = setSignedPublicationLink(lic, index.StorageKey(content), s)
+	}
+	for i := range lic.Links {
+		lic.Links[i].Href = api.RebaseURL(r, lic.Links[i].Href, config.Config.LcpServer.PublicBaseUrl)
+	}
+	return content, err
+}
+
+// copyZipFile copies the files of a zip archive, except the file with the given name;
+// the CRC-32 of each file is checked as it is read
+func copyZipFile(out *zip.Writer, in *zip.Reader, skip string) error {
 	for _, file := range in.File {
+		if file.Name == skip {
+			continue
+		}
 		newFile, err := out.CreateHeader(&file.FileHeader)
 		if err != nil {
 			return err
@@ -184,64 +343,122 @@ func isWebPub(in *zip.Reader) bool {
 	return false
 }
 
-// build a licensed publication, common to get and generate licensed publication
+// openLicensedPublication opens the stored file of the version of the content of a license,
+// read from the storage as the zip file is read
 //
-func buildLicensedPublication(lic *license.License, s Server) (buf bytes.Buffer, err error) {
-	// get the epub content info from the bd
-	epubFile, err := s.Store().Get(lic.ContentId)
+func openLicensedPublication(lic *license.License, s Server) (*zip.Reader, index.Content, error) {
+	content, err := s.Index().GetVersion(lic.ContentId, lic.ContentVersion)
 	if err != nil {
-		return
-	}
-	// get the epub content
-	contents, err1 := epubFile.Contents()
-	if err1 != nil {
-		return buf, err1
+		return nil, content, err
 	}
+	zr, err := openStoredPublication(content, s, "download")
+	return zr, content, err
+}
 
-	b, err := ioutil.ReadAll(contents)
+// openStoredPublication opens the stored file of a content, read from the storage as the zip file is read;
+// op names the operation counted by storage.Corrupted on a checksum mismatch
+//
+func openStoredPublication(content index.Content, s Server, op string) (*zip.Reader, error) {
+	item, err := s.Store().Get(index.StorageKey(content))
 	if err != nil {
-		return buf, err
+		return nil, err
 	}
-	// create a zip reader
-	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
-	if err != nil {
-		return buf, err
+	if content.Length <= 0 {
+		// the size of the file is unknown, it is read in memory
+		contents, err := item.Contents()
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(storage.NewVerifyingReader(contents, content.Sha256))
+		contents.Close()
+		if err == storage.ErrChecksumMismatch {
+			storage.Corrupted.Add(op, 1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	}
+	// the zip file is read at random positions: its checksum is verified first
+	if err = storage.Verify(item, content.Sha256, op); err != nil {
+		return nil, err
+	}
+	return zip.NewReader(storage.NewReaderAt(item, content.Length), content.Length)
+}
+
+// writeLicensedPublication writes a publication with its license, as it is read from the storage:
+// the license replaces the license already embedded in the publication, if any
+//
+func writeLicensedPublication(w io.Writer, zr *zip.Reader, lic *license.License) error {
+	location := epub.LicenseFile
+	if isWebPub(zr) {
+		location = "license.lcpl"
 	}
 
-	zipWriter := zip.NewWriter(&buf)
-	err = copyZipFile(zipWriter, zr)
+	zipWriter := zip.NewWriter(w)
+	err := copyZipFile(zipWriter, zr, location)
+	if err != nil {
+		return err
+	}
 
 	// Encode the license to JSON, removing the trailing newline
 	// write the buffer in the zip, and suppress the trailing newline
 	licenseBytes, err := json.Marshal(lic)
 	if err != nil {
-		return buf, err
+		return err
 	}
 
 	licenseBytes = bytes.TrimRight(licenseBytes, "\n")
 
-	location := epub.LicenseFile
-	if isWebPub(zr) {
-		location = "license.lcpl"
-	}
-
 	licenseWriter, err := zipWriter.Create(location)
 	if err != nil {
-		return buf, err
+		return err
 	}
 
 	_, err = licenseWriter.Write(licenseBytes)
 	if err != nil {
+		return err
+	}
+
+	return zipWriter.Close()
+}
+
+// serveLicensedPublication returns a licensed publication to the caller, streamed
+// from the storage
+//
+func serveLicensedPublication(w http.ResponseWriter, r *http.Request, lic *license.License, s Server) {
+	zr, content, err := openLicensedPublication(lic, s)
+	if errors.Is(err, storage.ErrNotFound) {
+		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: lic.ContentId}, http.StatusNotFound)
+		return
+	} else if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: lic.ContentId}, http.StatusInternalServerError)
 		return
 	}
+	contentType := content.Type
+	if contentType == "" {
+		contentType = epub.ContentType_EPUB
+	}
 
-	return buf, zipWriter.Close()
+	// set HTTP headers
+	w.Header().Add("Content-Type", contentType)
+	w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, content.Location))
+	// FIXME: check the use of X-Lcp-License by the caller (frontend?)
+	w.Header().Add("X-Lcp-License", lic.Id)
+	// must come *after* w.Header().Add()/Set(), but before w.Write()
+	w.WriteHeader(http.StatusCreated)
+	// the publication is written as it is read: an error interrupts the response
+	if err = writeLicensedPublication(w, zr, lic); err != nil {
+		log.Println("Error writing the licensed publication", lic.Id, ":", err)
+	}
 }
 
 // GetLicense returns an existing license,
 // selected by a license id and a partial license both given as input.
 // The input partial license is optional: if absent, a partial license
 // is returned to the caller, with the info stored in the db.
+// With the "fresh=true" query parameter and no input, a license already delivered
+// is returned signed again, with its current rights and links.
 //
 func GetLicense(w http.ResponseWriter, r *http.Request, s Server) {
 
@@ -255,28 +472,42 @@ func GetLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	var licOut license.License
 	licOut, e := s.Licenses().Get(licenseID)
 	// process license not found etc.
-	if e == license.NotFound {
-		problem.Error(w, r, problem.Problem{Detail: e.Error()}, http.StatusNotFound)
-		return
-	} else if e != nil {
-		problem.Error(w, r, problem.Problem{Detail: e.Error()}, http.StatusBadRequest)
+	if e != nil {
+		api.StoreError(w, r, e)
 		return
 	}
+	// the entity tag of the stored license, used for conditional updates
+	etag := license.ETag(licOut)
 	// get the input body.
 	// It contains the hashed passphrase, user hint
 	// and other optional user data the provider wants to see embedded in thel license
 	var err error
 	var licIn license.License
-	err = DecodeJSONLicense(r, &licIn)
+	err = decodePartialLicense(r, &licIn)
 	// error parsing the input body
 	if err != nil {
 		// if there was no partial license given as payload, return a partial license.
 		// The use case is a frontend that needs to get license up to date rights.
 		if err.Error() == "EOF" {
+			// a fresh license is built again with the current rights and links,
+			// from the keys of the last license delivered to the user
+			if r.FormValue("fresh") == "true" {
+				keys, err := s.Licenses().GetKeys(licenseID)
+				if err == nil {
+					log.Println("No payload, get a fresh license")
+					serveFreshLicense(w, r, &licOut, keys, etag, s)
+					return
+				}
+				if !errors.Is(err, license.ErrKeysNotFound) {
+					api.StoreError(w, r, err)
+					return
+				}
+			}
 			log.Println("No payload, get a partial license")
 
 			// add useful http headers
 			w.Header().Add("Content-Type", api.ContentType_LCP_JSON)
+			w.Header().Set("ETag", etag)
 			w.WriteHeader(http.StatusPartialContent)
 			// send back the partial license
 			// do not escape characters
@@ -285,8 +516,8 @@ func GetLicense(w http.ResponseWriter, r *http.Request, s Server) {
 			enc.Encode(licOut)
 			return
 		}
-		// unknown error
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		// malformed or too large partial license
+		api.BodyError(w, r, err)
 		return
 	}
 
@@ -298,17 +529,23 @@ func GetLicense(w http.ResponseWriter, r *http.Request, s Server) {
 		return
 	}
 	// copy useful data from licIn to LicOut
-	copyInputToLicense(&licIn, &licOut)
+	err = copyInputToLicense(&licIn, &licOut)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
 	// build the license
-	err = buildLicense(&licOut, s)
+	err = buildLicense(&licOut, r, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		buildLicenseError(w, r, err)
 		return
 	}
+	saveLicenseKeys(licOut, s)
 
 	// set the http headers
 	w.Header().Add("Content-Type", api.ContentType_LCP_JSON)
 	w.Header().Add("Content-Disposition", `attachment; filename="license.lcpl"`)
+	w.Header().Set("ETag", etag)
 	w.WriteHeader(http.StatusOK)
 	// send back the license
 	// do not escape characters in the json payload
@@ -317,6 +554,44 @@ func GetLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	enc.Encode(licOut)
 }
 
+// serveFreshLicense sends a stored license signed again, with the keys of the last license
+// delivered to the user, so that a reading system gets the current rights and status link
+// without the provider sending the user info and passphrase again
+//
+func serveFreshLicense(w http.ResponseWriter, r *http.Request, lic *license.License, keys license.Keys, etag string, s Server) {
+	// the signed license is cached until the license is updated or signed with another certificate;
+	// not with signed urls, which expire, nor with the links of a forwarded base url
+	cacheable := config.Config.SignedURLs.Secret == "" && r.Header.Get(api.HeaderForwardedBase) == ""
+	cert := signingCertificate(lic, s)
+	certificate := sign.Fingerprint(cert)
+	doc, ok := []byte(nil), false
+	if cacheable {
+		doc, ok = s.Licenses().GetSigned(*lic, certificate)
+	}
+	if !ok {
+		err := refreshLicense(lic, keys, cert, r, s)
+		if err != nil {
+			buildLicenseError(w, r, err)
+			return
+		}
+		saveLicenseSignature(*lic, s)
+		// do not escape characters in the json payload
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(lic)
+		doc = buf.Bytes()
+		if cacheable {
+			s.Licenses().SetSigned(*lic, certificate, doc)
+		}
+	}
+	w.Header().Add("Content-Type", api.ContentType_LCP_JSON)
+	w.Header().Add("Content-Disposition", `attachment; filename="license.lcpl"`)
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+	w.Write(doc)
+}
+
 // GenerateLicense generates and returns a new license,
 // for a given content identified by its id
 // plus a partial license given as input
@@ -332,37 +607,46 @@ func GenerateLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	// note: no need to create licIn / licOut here, as the input body contains
 	// info that we want to keep in the full license.
 	var lic license.License
-	err := DecodeJSONLicense(r, &lic)
+	err := decodePartialLicense(r, &lic)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		api.BodyError(w, r, err)
 		return
 	}
+	// the template of the content sets the fields omitted by the partial license
+	applyLicenseTemplate(&lic, contentID, s)
+	// the external reference of the license, e.g. an order number, used to find it again
+	lic.Reference = r.FormValue("reference")
+	// a loan out of the duration range of the provider is clamped into it or rejected
+	decision := license.EnforceLoan(lic.Rights, license.RightsRulesOf(lic.Provider), clock.Now())
 	// check mandatory information in the input body
 	err = checkGenerateLicenseInput(&lic)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		recordLoanDecision(s, r, contentID, decision)
+		inputError(w, r, err)
 		return
 	}
 	// init the license with an id and issue date
 	license.Initialize(contentID, &lic)
+	recordLoanDecision(s, r, lic.Id, decision)
 
 	// normalize the start and end date, UTC, no milliseconds
 	setRights(&lic)
 
 	// build the license
-	err = buildLicense(&lic, s)
+	err = buildLicense(&lic, r, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		buildLicenseError(w, r, err)
 		return
 	}
 
-	// store the license in the db
-	err = s.Licenses().Add(lic)
+	// store the license in the db, with its notification to the lsd server,
+	// which is delivered asynchronously
+	err = addLicenseWithNotification(lic, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
-		//problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusInternalServerError)
+		licenseError(w, r, err, contentID)
 		return
 	}
+	saveLicenseKeys(lic, s)
 	// set http headers
 	w.Header().Add("Content-Type", api.ContentType_LCP_JSON)
 	w.Header().Add("Content-Disposition", `attachment; filename="license.lcpl"`)
@@ -372,10 +656,6 @@ func GenerateLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	enc := json.NewEncoder(w)
 	enc.SetEscapeHTML(false)
 	enc.Encode(lic)
-
-	// notify the lsd server of the creation of the license.
-	// this is an asynchronous call.
-	go notifyLsdServer(lic, s)
 }
 
 // GetLicensedPublication returns a licensed publication
@@ -390,9 +670,9 @@ func GetLicensedPublication(w http.ResponseWriter, r *http.Request, s Server) {
 
 	// get the input body
 	var licIn license.License
-	err := DecodeJSONLicense(r, &licIn)
+	err := decodePartialLicense(r, &licIn)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		api.BodyError(w, r, err)
 		return
 	}
 	// check mandatory information in the input body
@@ -404,48 +684,25 @@ func GetLicensedPublication(w http.ResponseWriter, r *http.Request, s Server) {
 	// initialize the license from the info stored in the db.
 	licOut, e := s.Licenses().Get(licenseID)
 	// process license not found etc.
-	if e == license.NotFound {
-		problem.Error(w, r, problem.Problem{Detail: e.Error()}, http.StatusNotFound)
-		return
-	} else if e != nil {
-		problem.Error(w, r, problem.Problem{Detail: e.Error()}, http.StatusBadRequest)
+	if e != nil {
+		api.StoreError(w, r, e)
 		return
 	}
 	// copy useful data from licIn to LicOut
-	copyInputToLicense(&licIn, &licOut)
-	// build the license
-	err = buildLicense(&licOut, s)
+	err = copyInputToLicense(&licIn, &licOut)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
-		return
-	}
-	// build a licensed publication
-	buf, err := buildLicensedPublication(&licOut, s)
-	if err == storage.ErrNotFound {
-		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: licOut.ContentId}, http.StatusNotFound)
-		return
-	} else if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: licOut.ContentId}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
-	// get the content location to fill an http header
-	// FIXME: redundant as the content location has been set in a link (publication)
-	content, err1 := s.Index().Get(licOut.ContentId)
-	if err1 != nil {
-		problem.Error(w, r, problem.Problem{Detail: err1.Error(), Instance: licOut.ContentId}, http.StatusInternalServerError)
+	// build the license
+	err = buildLicense(&licOut, r, s)
+	if err != nil {
+		buildLicenseError(w, r, err)
 		return
 	}
-	location := content.Location
-
-	// set HTTP headers
-	w.Header().Add("Content-Type", epub.ContentType_EPUB)
-	w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, location))
-	// FIXME: check the use of X-Lcp-License by the caller (frontend?)
-	w.Header().Add("X-Lcp-License", licOut.Id)
-	// must come *after* w.Header().Add()/Set(), but before w.Write()
-	w.WriteHeader(http.StatusCreated)
+	saveLicenseKeys(licOut, s)
 	// return the full licensed publication to the caller
-	io.Copy(w, &buf)
+	serveLicensedPublication(w, r, &licOut, s)
 }
 
 // GenerateLicensedPublication generates and returns a licensed publication
@@ -460,74 +717,55 @@ func GenerateLicensedPublication(w http.ResponseWriter, r *http.Request, s Serve
 
 	// get the input body
 	var lic license.License
-	err := DecodeJSONLicense(r, &lic)
+	err := decodePartialLicense(r, &lic)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		api.BodyError(w, r, err)
 		return
 	}
+	// the template of the content sets the fields omitted by the partial license
+	applyLicenseTemplate(&lic, contentID, s)
+	// the external reference of the license, e.g. an order number, used to find it again
+	lic.Reference = r.FormValue("reference")
+	// a loan out of the duration range of the provider is clamped into it or rejected
+	decision := license.EnforceLoan(lic.Rights, license.RightsRulesOf(lic.Provider), clock.Now())
 	// check mandatory information in the input body
 	err = checkGenerateLicenseInput(&lic)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		recordLoanDecision(s, r, contentID, decision)
+		inputError(w, r, err)
 		return
 	}
 	// init the license with an id and issue date
 	license.Initialize(contentID, &lic)
+	recordLoanDecision(s, r, lic.Id, decision)
 	// normalize the start and end date, UTC, no milliseconds
 	setRights(&lic)
 	// build the license
-	err = buildLicense(&lic, s)
+	err = buildLicense(&lic, r, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		buildLicenseError(w, r, err)
 		return
 	}
-	// store the license in the db
-	err = s.Licenses().Add(lic)
+	// store the license in the db, with its notification to the lsd server
+	err = addLicenseWithNotification(lic, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusInternalServerError)
+		licenseError(w, r, err, contentID)
 		return
 	}
+	saveLicenseKeys(lic, s)
 
-	// notify the lsd server of the creation of the license
-	go notifyLsdServer(lic, s)
-
-	// build a licenced publication
-	buf, err := buildLicensedPublication(&lic, s)
-	if err == storage.ErrNotFound {
-		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: lic.ContentId}, http.StatusNotFound)
-		return
-	} else if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: lic.ContentId}, http.StatusInternalServerError)
-		return
-	}
-
-	// get the content location to fill an http header
-	// FIXME: redundant as the content location has been set in a link (publication)
-	content, err1 := s.Index().Get(lic.ContentId)
-	if err1 != nil {
-		problem.Error(w, r, problem.Problem{Detail: err1.Error(), Instance: lic.ContentId}, http.StatusInternalServerError)
-		return
-	}
-	location := content.Location
-
-	// set HTTP headers
-	w.Header().Add("Content-Type", epub.ContentType_EPUB)
-	w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, location))
-	// FIXME: check the use of X-Lcp-License by the caller (frontend?)
-	w.Header().Add("X-Lcp-License", lic.Id)
-	// must come *after* w.Header().Add()/Set(), but before w.Write()
-	w.WriteHeader(http.StatusCreated)
 	// return the full licensed publication to the caller
-	io.Copy(w, &buf)
+	serveLicensedPublication(w, r, &lic, s)
 }
 
 // UpdateLicense updates an existing license.
 // parameters:
 // 		{license_id} in the calling URL
 // 		partial license containing properties which should be updated (and only these)
-// return: an http status code (200, 400 or 404)
-// Usually called from the License Status Server after a renew, return or cancel/revoke action
-// -> updates the end date.
+//		updatable properties are the provider, the user id, the rights and the links
+//		other than the publication, status and self links; a link without href is removed;
+//		unknown properties are rejected, as well as properties which cannot be updated
+// the license is signed again the next time it is fetched, with a new 'updated' date
 //
 func UpdateLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	vars := mux.Vars(r)
@@ -537,22 +775,35 @@ func UpdateLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	log.Println("Update License with id", licenseID)
 
 	var licIn license.License
-	err := DecodeJSONLicense(r, &licIn)
+	err := decodePartialLicense(r, &licIn)
 	if err != nil { // no or incorrect (json) partial license found in the body
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		api.BodyError(w, r, err)
+		return
+	}
+	err = checkLicensePatch(licenseID, &licIn)
+	if err != nil {
+		inputError(w, r, err)
 		return
 	}
 	// initialize the license from the info stored in the db.
 	var licOut license.License
 	licOut, e := s.Licenses().Get(licenseID)
 	// process license not found etc.
-	if e == license.NotFound {
-		problem.Error(w, r, problem.Problem{Detail: e.Error()}, http.StatusNotFound)
+	if e != nil {
+		api.StoreError(w, r, e)
 		return
-	} else if e != nil {
-		problem.Error(w, r, problem.Problem{Detail: e.Error()}, http.StatusBadRequest)
+	}
+	// optimistic concurrency: the license must not have been modified since the caller read it
+	ifMatch := r.Header.Get("If-Match")
+	etag := license.ETag(licOut)
+	if ifMatch != "" && !api.MatchETag(ifMatch, etag) {
+		problem.Error(w, r, problem.Problem{Detail: license.ErrModified.Error()}, http.StatusPreconditionFailed)
 		return
 	}
+	if licOut.Rights == nil {
+		licOut.Rights = new(license.UserRights)
+	}
+	previous := *licOut.Rights
 	// update licOut using information found in licIn
 	if licIn.User.Id != "" {
 		log.Println("new user id: ", licIn.User.Id)
@@ -566,88 +817,265 @@ func UpdateLicense(w http.ResponseWriter, r *http.Request, s Server) {
 		log.Println("new content id: ", licIn.ContentId)
 		licOut.ContentId = licIn.ContentId
 	}
-	if licIn.Rights.Print != nil {
-		log.Println("new right, print: ", *licIn.Rights.Print)
-		licOut.Rights.Print = licIn.Rights.Print
+	if licIn.Links != nil {
+		log.Println("new links: ", len(licIn.Links))
+		licOut.Links = license.MergeLinks(licOut.Links, licIn.Links)
 	}
-	if licIn.Rights.Copy != nil {
-		log.Println("new right, copy: ", *licIn.Rights.Copy)
-		licOut.Rights.Copy = licIn.Rights.Copy
-	}
-	if licIn.Rights.Start != nil {
-		log.Println("new right, start: ", *licIn.Rights.Start)
-		licOut.Rights.Start = licIn.Rights.Start
+	if licIn.Rights != nil {
+		if licIn.Rights.Print != nil {
+			log.Println("new right, print: ", *licIn.Rights.Print)
+			licOut.Rights.Print = licIn.Rights.Print
+		}
+		if licIn.Rights.Copy != nil {
+			log.Println("new right, copy: ", *licIn.Rights.Copy)
+			licOut.Rights.Copy = licIn.Rights.Copy
+		}
+		if licIn.Rights.Start != nil {
+			log.Println("new right, start: ", *licIn.Rights.Start)
+			licOut.Rights.Start = licIn.Rights.Start
+		}
+		if licIn.Rights.End != nil {
+			log.Println("new right, end: ", *licIn.Rights.End)
+			licOut.Rights.End = licIn.Rights.End
+		}
 	}
-	if licIn.Rights.End != nil {
-		log.Println("new right, end: ", *licIn.Rights.End)
-		licOut.Rights.End = licIn.Rights.End
+	// the updated rights must follow the rules of the provider, e.g. a renewal is clamped into the duration range of the loans
+	rules := updateRules(licOut.Provider, previous, licIn.Rights)
+	decision := license.EnforceLoan(licOut.Rights, rules, clock.Now())
+	recordLoanDecision(s, r, licenseID, decision)
+	if err = checkRights(licOut.Rights, rules); err != nil {
+		inputError(w, r, err)
+		return
 	}
 	// update the license in the database
-	err = s.Licenses().Update(licOut)
-	if err != nil {
+	if ifMatch != "" {
+		err = s.Licenses().UpdateIfMatch(licOut, etag)
+	} else {
+		err = s.Licenses().Update(licOut)
+	}
+	if errors.Is(err, license.ErrModified) {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusPreconditionFailed)
+		return
+	} else if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		return
 	}
+	// return the new entity tag of the license, and its rights, which may have been clamped
+	if licOut, err = s.Licenses().Get(licenseID); err == nil {
+		w.Header().Set("ETag", license.ETag(licOut))
+	}
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	json.NewEncoder(w).Encode(license.License{Id: licenseID, Rights: licOut.Rights})
+}
+
+// decodePartialLicense decodes a partial license sent by a provider, rejecting unknown properties;
+// the properties named by URIs are the extensions of the license
+//
+func decodePartialLicense(r *http.Request, lic *license.License) error {
+	var dec *json.Decoder
+
+	if ctype := r.Header["Content-Type"]; len(ctype) > 0 && ctype[0] == api.ContentType_FORM_URL_ENCODED {
+		buf := bytes.NewBufferString(r.PostFormValue("data"))
+		dec = json.NewDecoder(buf)
+	} else {
+		dec = json.NewDecoder(r.Body)
+	}
+
+	var members map[string]json.RawMessage
+	err := dec.Decode(&members)
+	if err == nil {
+		for name, value := range members {
+			if license.IsExtensionName(name) {
+				if lic.Extensions == nil {
+					lic.Extensions = make(license.Extensions)
+				}
+				lic.Extensions[name] = value
+				delete(members, name)
+			}
+		}
+		err = decodeLicenseMembers(members, lic)
+	}
+	if err != nil && err != io.EOF {
+		log.Print("Decode partial license: " + err.Error())
+	}
+	return err
+}
+
+// decodeLicenseMembers decodes the members of a partial license, rejecting unknown properties
+func decodeLicenseMembers(members map[string]json.RawMessage, lic *license.License) error {
+	data, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(lic)
+}
+
+// checkLicensePatch checks that a partial license only contains updatable properties
+// the license id, if present, must be the one of the license to update.
+// Properties which cannot be updated are accepted if empty,
+// as the license status server sends a full license structure.
+//
+func checkLicensePatch(licenseID string, l *license.License) error {
+	if l.Id != "" && l.Id != licenseID {
+		return ErrLicenseIdMismatch
+	}
+	if !l.Issued.IsZero() || l.Updated != nil || l.Signature != nil ||
+		l.Encryption.Profile != "" || l.Encryption.ContentKey.Value != nil || l.Encryption.UserKey.Hint != "" ||
+		l.Encryption.UserKey.Value != nil || l.Encryption.UserKey.HexValue != "" || l.Encryption.UserKey.Check != nil ||
+		l.User.Email != "" || l.User.Name != "" || l.User.Encrypted != nil {
+		return ErrNotUpdatable
+	}
+	// the links set by the server cannot be updated
+	for _, link := range l.Links {
+		if link.Rel == "" || license.IsServerLink(link.Rel) {
+			return ErrNotUpdatable
+		}
+	}
+	// the rules of the provider apply to the updated license
+	return checkRights(l.Rights, config.RightsRules{AllowPastEnd: true})
+}
+
+// checkRights checks the rights of a license against the rules of its provider: the counts must not be negative,
+// the start must be before the end, the end must not be in the past and the loan must not be too long
+//
+func checkRights(rights *license.UserRights, rules config.RightsRules) error {
+	return license.ValidateRights(rights, rules, clock.Now())
+}
+
+// updateRules returns the rules of the updated rights of a license: a license which ends earlier,
+// e.g. returned or revoked, may end in the past and last longer or shorter than the loans of its provider,
+// which only applies when the start of the rights is changed or their end is postponed
+//
+func updateRules(provider string, previous license.UserRights, patch *license.UserRights) config.RightsRules {
+	rules := license.RightsRulesOf(provider)
+	if patch == nil || (patch.Start == nil && patch.End == nil) {
+		return config.RightsRules{AllowPastEnd: true}
+	}
+	postponed := patch.End != nil && (previous.End == nil || patch.End.After(*previous.End))
+	if !postponed {
+		rules.AllowPastEnd = true
+	}
+	if !postponed && patch.Start == nil {
+		rules.MinLoanDays, rules.MaxLoanDays = 0, 0
+	}
+	return rules
+}
+
+// recordLoanDecision records in the audit log a loan out of the duration range of its provider,
+// clamped or rejected; the subject is the license, or the content of a rejected new license
+//
+func recordLoanDecision(s Server, r *http.Request, subject string, d *license.LoanDecision) {
+	if d == nil {
+		return
+	}
+	actor, _, _ := r.BasicAuth()
+	detail, _ := json.Marshal(d)
+	log.Println("Loan duration of " + subject + ": " + string(detail))
+	if err := s.Audit().Add(audit.Entry{Actor: actor, Action: audit.ActionLoanDuration, Subject: subject, Detail: string(detail)}); err != nil {
+		log.Println("Error recording the loan duration decision of " + subject + ": " + err.Error())
+	}
+}
+
+// inputError reports an invalid partial license; the broken rules of the rights are listed
+//
+func inputError(w http.ResponseWriter, r *http.Request, err error) {
+	var rightsErr *license.RightsError
+	if !errors.As(err, &rightsErr) {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	params := make([]problem.InvalidParam, len(rightsErr.Violations))
+	for i, v := range rightsErr.Violations {
+		params[i] = problem.InvalidParam{Name: v.Field, Reason: v.Reason}
+	}
+	problem.Error(w, r, problem.Problem{Type: problem.BAD_RIGHTS, Detail: err.Error(), InvalidParams: params}, http.StatusBadRequest)
 }
 
 // ListLicenses returns a JSON struct with information about the existing licenses
 // parameters:
 // 	page: page number
 //	per_page: number of items par page
+//	after: cursor of the page, given by the "next" link; used if there is no page number and no sort
+//	sort: id, issued, updated, user, provider or end, prefixed by "-" for a descending order (default -issued)
+//	fields: comma separated fields of the licenses to return
+//	reference: external reference of the licenses, e.g. an order number; the licenses are not paginated
 //
 func ListLicenses(w http.ResponseWriter, r *http.Request, s Server) {
-	var page int64
-	var per_page int64
-	var err error
-	if r.FormValue("page") != "" {
-		page, err = strconv.ParseInt((r).FormValue("page"), 10, 32)
-		if err != nil {
-			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
-			return
-		}
-	} else {
-		page = 1
+	if reference := r.FormValue("reference"); reference != "" {
+		listLicensesByReference(w, r, reference, s)
+		return
 	}
-	if r.FormValue("per_page") != "" {
-		per_page, err = strconv.ParseInt((r).FormValue("per_page"), 10, 32)
-		if err != nil {
-			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
-			return
-		}
-	} else {
-		per_page = 30
+	params, err := api.ParseListParams(r, api.DefaultPerPage)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	if params.Page == 0 && params.Sort == "" {
+		listLicensesAfter(w, r, params, s)
+		return
 	}
-	if page > 0 { //pagenum starting at 0 in code, but user interface starting at 1
-		page--
+	listLicenseReports(w, r, license.ReportFilter{}, params, s)
+}
+
+// listLicenseReports lists a page of the licenses selected by a filter
+func listLicenseReports(w http.ResponseWriter, r *http.Request, filter license.ReportFilter, params api.ListParams, s Server) {
+	licenses := make([]license.LicenseReport, 0)
+	fn := s.Licenses().ListReports(filter, params.Listing())
+	it, err := fn()
+	for ; err == nil; it, err = fn() {
+		licenses = append(licenses, it)
 	}
-	if page < 0 {
-		problem.Error(w, r, problem.Problem{Detail: "page must be positive integer"}, http.StatusBadRequest)
+	if !errors.Is(err, license.ErrNotFound) {
+		api.StoreError(w, r, err)
+		return
+	}
+	api.WriteList(w, r, licenses, params.PageLinks(r, len(licenses)), params.Fields)
+}
+
+// listLicensesAfter lists the licenses which come after a cursor (keyset pagination),
+// the "next" link gives the cursor of the next page
+func listLicensesAfter(w http.ResponseWriter, r *http.Request, params api.ListParams, s Server) {
+	after, err := license.ParseCursor(params.After)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
 	licenses := make([]license.LicenseReport, 0)
-	//log.Println("ListAll(" + strconv.Itoa(int(per_page)) + "," + strconv.Itoa(int(page)) + ")")
-	fn := s.Licenses().ListAll(int(per_page), int(page))
-	for it, err := fn(); err == nil; it, err = fn() {
+	fn := s.Licenses().ListAllAfter(after, params.PerPage)
+	it, err := fn()
+	for ; err == nil; it, err = fn() {
 		licenses = append(licenses, it)
 	}
-	if len(licenses) > 0 {
-		nextPage := strconv.Itoa(int(page) + 1)
-		w.Header().Set("Link", "</licenses/?page="+nextPage+">; rel=\"next\"; title=\"next\"")
+	if !errors.Is(err, license.ErrNotFound) {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
 	}
-	if page > 1 {
-		previousPage := strconv.Itoa(int(page) - 1)
-		w.Header().Set("Link", "</licenses/?page="+previousPage+">; rel=\"previous\"; title=\"previous\"")
+	var links string
+	if len(licenses) == params.PerPage {
+		links = api.Link(r, "next", "after", license.CursorOf(licenses[len(licenses)-1]).String())
+	}
+	api.WriteList(w, r, licenses, links, params.Fields)
+}
+
+// listLicensesByReference lists the licenses generated with an external reference, e.g. for the customer support
+//
+func listLicensesByReference(w http.ResponseWriter, r *http.Request, reference string, s Server) {
+	licenses, err := s.Licenses().ListByReference(reference)
+	if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	if licenses == nil {
+		licenses = make([]license.LicenseReport, 0)
 	}
 	w.Header().Set("Content-Type", api.ContentType_JSON)
 
 	enc := json.NewEncoder(w)
 	// do not escape characters
 	enc.SetEscapeHTML(false)
-	err = enc.Encode(licenses)
-	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
-		return
-	}
+	enc.Encode(licenses)
 }
 
 // ListLicensesForContent lists all licenses associated with a given content
@@ -655,70 +1083,24 @@ func ListLicenses(w http.ResponseWriter, r *http.Request, s Server) {
 //	content_id: content identifier
 // 	page: page number (default 1)
 //	per_page: number of items par page (default 30)
+//	sort, fields: as for the list of all the licenses
 //
 func ListLicensesForContent(w http.ResponseWriter, r *http.Request, s Server) {
 	vars := mux.Vars(r)
-	var page int64
-	var per_page int64
-	var err error
 	contentID := vars["content_id"]
 
 	//check if the license exists
-	_, err = s.Index().Get(contentID)
-	if err == index.NotFound {
+	_, err := s.Index().Get(contentID)
+	if errors.Is(err, index.ErrNotFound) {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
 		return
 	} //other errors pass, but will probably reoccur
-	if r.FormValue("page") != "" {
-		page, err = strconv.ParseInt(r.FormValue("page"), 10, 32)
-		if err != nil {
-			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
-			return
-		}
-	} else {
-		page = 1
-	}
-
-	if r.FormValue("per_page") != "" {
-		per_page, err = strconv.ParseInt((r).FormValue("per_page"), 10, 32)
-		if err != nil {
-			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
-			return
-		}
-	} else {
-		per_page = 30
-	}
-	if page > 0 {
-		page-- //pagenum starting at 0 in code, but user interface starting at 1
-	}
-	if page < 0 {
-		problem.Error(w, r, problem.Problem{Detail: "page must be positive integer"}, http.StatusBadRequest)
-		return
-	}
-	licenses := make([]license.LicenseReport, 0)
-	//log.Println("List(" + contentId + "," + strconv.Itoa(int(per_page)) + "," + strconv.Itoa(int(page)) + ")")
-	fn := s.Licenses().List(contentID, int(per_page), int(page))
-	for it, err := fn(); err == nil; it, err = fn() {
-		licenses = append(licenses, it)
-	}
-	if len(licenses) > 0 {
-		nextPage := strconv.Itoa(int(page) + 1)
-		w.Header().Set("Link", "</licenses/?page="+nextPage+">; rel=\"next\"; title=\"next\"")
-	}
-	if page > 1 {
-		previousPage := strconv.Itoa(int(page) - 1)
-		w.Header().Set("Link", "</licenses/?page="+previousPage+">; rel=\"previous\"; title=\"previous\"")
-	}
-	w.Header().Set("Content-Type", api.ContentType_JSON)
-	enc := json.NewEncoder(w)
-	// do not escape characters
-	enc.SetEscapeHTML(false)
-	err = enc.Encode(licenses)
+	params, err := api.ParseListParams(r, api.DefaultPerPage)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
-
+	listLicenseReports(w, r, license.ReportFilter{ContentId: contentID}, params, s)
 }
 
 // DecodeJSONLicense decodes a license formatted in json and returns a license object
@@ -741,45 +1123,6 @@ func DecodeJSONLicense(r *http.Request, lic *license.License) error {
 	return err
 }
 
-// notifyLsdServer informs the License Status Server of the creation of a new license
-// and saves the result of the http request in the DB (using *Store)
-//
-func notifyLsdServer(l license.License, s Server) {
-	if config.Config.LsdServer.PublicBaseUrl != "" {
-		var lsdClient = &http.Client{
-			Timeout: time.Second * 10,
-		}
-		pr, pw := io.Pipe()
-		defer pr.Close()
-		go func() {
-			_ = json.NewEncoder(pw).Encode(l)
-			pw.Close() // signal end writing
-		}()
-		req, err := http.NewRequest("PUT", config.Config.LsdServer.PublicBaseUrl+"/licenses", pr)
-		if err != nil {
-			return
-		}
-		// set credentials on lsd request
-		notifyAuth := config.Config.LsdNotifyAuth
-		if notifyAuth.Username != "" {
-			req.SetBasicAuth(notifyAuth.Username, notifyAuth.Password)
-		}
-
-		req.Header.Add("Content-Type", api.ContentType_LCP_JSON)
-
-		response, err := lsdClient.Do(req)
-		if err != nil {
-			log.Println("Error Notify LsdServer of new License (" + l.Id + "):" + err.Error())
-			_ = s.Licenses().UpdateLsdStatus(l.Id, -1)
-		} else {
-			defer req.Body.Close()
-			_ = s.Licenses().UpdateLsdStatus(l.Id, int32(response.StatusCode))
-			// message to the console
-			log.Println("Notify Lsd Server of a new License with id " + l.Id + " = " + strconv.Itoa(response.StatusCode))
-		}
-	}
-}
-
 // utility: log a license for debug purposes
 // ex: logLicense("build licence:", licOut)
 
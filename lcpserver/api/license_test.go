@@ -0,0 +1,506 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/cache"
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/sign"
+	"github.com/readium/readium-lcp-server/storage"
+)
+
+func TestHashAlgorithms(t *testing.T) {
+	const sha512 = "http://www.w3.org/2001/04/xmlenc#sha512"
+	// a profile deriving the user key from a longer hash
+	license.RegisterUserKeyDerivation(license.V1_PROFILE, sha512, 64, func(hash []byte) ([]byte, error) {
+		return hash[:32], nil
+	})
+	config.Config.License.HashAlgorithms = map[string][]string{"1.0": {sha512, license.SHA256_URI}}
+	defer func() { config.Config.License.HashAlgorithms = nil }()
+
+	var l license.License
+	l.Encryption.Profile = license.V1_PROFILE
+	if err := license.NegotiateHashAlgorithm(&l); err != nil || l.Encryption.UserKey.Algorithm != sha512 {
+		t.Errorf("Expected the preferred algorithm of the profile, got %q %v", l.Encryption.UserKey.Algorithm, err)
+	}
+	l.Encryption.Profile = license.BASIC_PROFILE
+	if err := license.NegotiateHashAlgorithm(&l); err != license.ErrUnsupportedHashAlgorithm {
+		t.Errorf("Expected the algorithm to be rejected by the basic profile, got %v", err)
+	}
+
+	hash := bytes.Repeat([]byte{1}, 64)
+	l.Encryption.UserKey = license.UserKey{Key: license.Key{Algorithm: sha512}, Hint: "hint", Value: hash}
+	if err := checkGetLicenseInput(&l); err != nil {
+		t.Errorf("Expected a sha512 hash to be accepted, got %v", err)
+	}
+	l.Encryption.UserKey.Value = hash[:32]
+	if err := checkGetLicenseInput(&l); err != ErrBadValue {
+		t.Errorf("Expected a hash of the wrong size to be rejected, got %v", err)
+	}
+	l.Encryption.UserKey.Algorithm = "http://example.com/unknown"
+	if err := checkGetLicenseInput(&l); err != license.ErrUnsupportedHashAlgorithm {
+		t.Errorf("Expected an unknown algorithm to be rejected, got %v", err)
+	}
+
+	userKey, err := license.GenerateUserKey(license.V1_PROFILE, license.UserKey{Key: license.Key{Algorithm: sha512}, Value: hash})
+	if err != nil || len(userKey) != 32 {
+		t.Errorf("Expected a user key derived by the profile, got %v", err)
+	}
+
+	// an issued license keeps its algorithm
+	issued := license.License{}
+	issued.Encryption.UserKey.Algorithm = sha512
+	input := license.License{}
+	input.Encryption.UserKey.Algorithm = license.SHA256_URI
+	if err := copyInputToLicense(&input, &issued); err != ErrHashAlgorithmChanged {
+		t.Errorf("Expected a change of algorithm to be rejected, got %v", err)
+	}
+}
+
+func TestPartialLicenseValidation(t *testing.T) {
+	// the rights of the partial licenses must not end in the past
+	defer clock.Set(clock.NewFake(time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC)))()
+	decode := func(body string) (license.License, error) {
+		var l license.License
+		r := httptest.NewRequest("POST", "/contents/c1/license", strings.NewReader(body))
+		err := decodePartialLicense(r, &l)
+		return l, err
+	}
+	hash := strings.Repeat("ab", 32)
+	valid := `{"provider":"http://example.com","user":{"id":"u1"},
+		"encryption":{"user_key":{"text_hint":"hint","hex_value":"` + hash + `"}},
+		"rights":{"print":10,"start":"2020-01-01T00:00:00Z","end":"2020-02-01T00:00:00Z"}}`
+	l, err := decode(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkGenerateLicenseInput(&l); err != nil {
+		t.Errorf("Expected a valid partial license, got %v", err)
+	}
+
+	if _, err = decode(`{"provider":"http://example.com","unknown":true}`); err == nil {
+		t.Error("Expected an unknown property to be rejected")
+	}
+	if _, err = decode(`{"rights":{"end":"next week"}}`); err == nil {
+		t.Error("Expected an invalid date to be rejected")
+	}
+	for _, rights := range []string{`{"copy":-1}`, `{"start":"2020-02-01T00:00:00Z","end":"2020-01-01T00:00:00Z"}`} {
+		l, err = decode(strings.Replace(valid, `{"print":10,"start":"2020-01-01T00:00:00Z","end":"2020-02-01T00:00:00Z"}`, rights, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = checkGenerateLicenseInput(&l); !errors.Is(err, ErrBadRights) {
+			t.Errorf("Expected the rights %s to be rejected, got %v", rights, err)
+		}
+	}
+}
+
+func TestLicensePatch(t *testing.T) {
+	check := func(body string) error {
+		var l license.License
+		r := httptest.NewRequest("PATCH", "/licenses/l1", strings.NewReader(body))
+		if err := decodePartialLicense(r, &l); err != nil {
+			return err
+		}
+		return checkLicensePatch("l1", &l)
+	}
+	for _, body := range []string{
+		`{"id":"l1","provider":"http://example.com/other","user":{"id":"u2"}}`,
+		`{"rights":{"end":"2999-01-01T00:00:00Z"}}`,
+		`{"links":[{"rel":"hint","href":"https://example.com/hint","type":"text/html"}]}`,
+		`{"links":[{"rel":"support","href":""}]}`,
+	} {
+		if err := check(body); err != nil {
+			t.Errorf("Expected the patch %s to be accepted, got %v", body, err)
+		}
+	}
+	for _, body := range []string{
+		`{"issued":"2020-01-01T00:00:00Z"}`,
+		`{"user":{"email":"user@example.com"}}`,
+		`{"encryption":{"profile":"http://readium.org/lcp/profile-1.0"}}`,
+		`{"links":[{"rel":"publication","href":"https://example.com/book.epub"}]}`,
+		`{"links":[{"rel":"status","href":"https://example.com/status"}]}`,
+		`{"links":[{"rel":"self","href":"https://example.com/license"}]}`,
+		`{"links":[{"href":"https://example.com/hint"}]}`,
+	} {
+		if err := check(body); err != ErrNotUpdatable {
+			t.Errorf("Expected the patch %s to be rejected, got %v", body, err)
+		}
+	}
+	if err := check(`{"id":"l2"}`); err != ErrLicenseIdMismatch {
+		t.Errorf("Expected another license id to be rejected, got %v", err)
+	}
+
+	// a link replaces the link of its relation, or is added; a link without href is removed
+	links := license.MergeLinks([]license.Link{{Rel: "hint", Href: "https://a"}, {Rel: "support", Href: "https://b"}},
+		[]license.Link{{Rel: "hint", Href: "https://c"}, {Rel: "support"}, {Rel: "privacy", Href: "https://d"}})
+	if len(links) != 2 || links[0].Href != "https://c" || links[1].Rel != "privacy" {
+		t.Errorf("Unexpected merged links %+v", links)
+	}
+}
+
+func TestUpdateRules(t *testing.T) {
+	config.Config.RightsPolicy = config.RightsPolicy{RightsRules: config.RightsRules{MaxLoanDays: 30}}
+	defer func() { config.Config.RightsPolicy = config.RightsPolicy{} }()
+
+	now := time.Now()
+	start, end := now.AddDate(0, 0, -45), now.AddDate(0, 0, 15)
+	previous := license.UserRights{Start: &start, End: &end}
+	later, earlier := now.AddDate(0, 0, 20), now.Add(-time.Minute)
+
+	// a license returned now ends in the past and lasted longer than the maximum loan
+	if rules := updateRules("p", previous, &license.UserRights{End: &earlier}); !rules.AllowPastEnd || rules.MaxLoanDays != 0 {
+		t.Errorf("Expected an earlier end to be accepted, got %+v", rules)
+	}
+	if rules := updateRules("p", previous, &license.UserRights{End: &later}); rules.AllowPastEnd || rules.MaxLoanDays != 30 {
+		t.Errorf("Expected the rules of the provider for a postponed end, got %+v", rules)
+	}
+	if rules := updateRules("p", previous, nil); !rules.AllowPastEnd || rules.MaxLoanDays != 0 {
+		t.Errorf("Expected no rule on the dates of an update without dates, got %+v", rules)
+	}
+
+	w := httptest.NewRecorder()
+	rights := license.UserRights{Start: &start, End: &later}
+	inputError(w, httptest.NewRequest("PATCH", "/licenses/l1", nil), checkRights(&rights, updateRules("p", previous, &rights)))
+	var body struct {
+		Type          string `json:"type"`
+		InvalidParams []struct {
+			Name   string `json:"name"`
+			Reason string `json:"reason"`
+		} `json:"invalid-params"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || !strings.HasSuffix(body.Type, "bad-rights") || len(body.InvalidParams) != 1 || body.InvalidParams[0].Name != "rights.end" {
+		t.Errorf("Expected the too long loan to be detailed, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLicenseExtensions(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+
+	hash := strings.Repeat("ab", 32)
+	body := `{"provider":"http://example.com","user":{"id":"u1"},
+		"encryption":{"user_key":{"text_hint":"hint","hex_value":"` + hash + `"}},
+		"https://vendor.example.com/order":{"id":"o-42","total":12.50}}`
+	var l license.License
+	if err := decodePartialLicense(httptest.NewRequest("POST", "/contents/c1/license", strings.NewReader(body)), &l); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkGenerateLicenseInput(&l); err != nil {
+		t.Fatal(err)
+	}
+	if string(l.Extensions["https://vendor.example.com/order"]) != `{"id":"o-42","total":12.50}` {
+		t.Errorf("Unexpected extensions %s", l.Extensions)
+	}
+
+	// the extensions are part of the canonical form, which is signed, with their numbers as sent
+	canon, err := sign.Canon(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(canon), `"https://vendor.example.com/order":{"id":"o-42","total":12.50}`) {
+		t.Errorf("Expected the extension in the canonical form, got %s", canon)
+	}
+
+	// the extensions are stored with the license
+	license.Initialize("c1", &l)
+	setRights(&l)
+	if err = s.lst.Add(l); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.lst.Get(l.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Extensions) != 1 {
+		t.Errorf("Expected the extension to be stored, got %s", stored.Extensions)
+	}
+
+	if err = license.CheckExtensions(license.Extensions{"order": []byte(`"o-42"`)}); err != license.ErrInvalidExtensions {
+		t.Errorf("Expected an extension not named by a URI to be rejected, got %v", err)
+	}
+	large := license.Extensions{"https://vendor.example.com/note": []byte(`"` + strings.Repeat("a", license.MaxExtensionsSize) + `"`)}
+	if err = license.CheckExtensions(large); err != license.ErrInvalidExtensions {
+		t.Errorf("Expected too large extensions to be rejected, got %v", err)
+	}
+}
+
+func TestLicenseReference(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+
+	for i, ref := range []string{"order-1", "order-1", "order-2"} {
+		l := license.License{Id: "l" + strconv.Itoa(i), Provider: "http://example.com", Issued: time.Now().UTC(), ContentId: "c1",
+			Rights: &license.UserRights{}, Reference: ref, Tenant: "t" + strconv.Itoa(i)}
+		if err := s.lst.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := httptest.NewRecorder()
+	ListLicenses(w, httptest.NewRequest("GET", "/licenses?reference=order-1", nil), s)
+	var licenses []license.LicenseReport
+	if err := json.NewDecoder(w.Body).Decode(&licenses); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(licenses) != 2 {
+		t.Errorf("Expected the 2 licenses of the order, got %d %+v", w.Code, licenses)
+	}
+	if l, err := s.lst.Get("l2"); err != nil || l.Reference != "order-2" {
+		t.Errorf("Expected the reference to be stored, got %+v (%v)", l, err)
+	}
+	// a tenant only finds its own licenses
+	if licenses, err := license.ForTenant(s.lst, "t1").ListByReference("order-1"); err != nil || len(licenses) != 1 || licenses[0].Id != "l1" {
+		t.Errorf("Expected the license of the tenant, got %+v (%v)", licenses, err)
+	}
+}
+
+func TestListLicensesSorted(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+
+	issued := time.Now().UTC().Truncate(time.Second)
+	for i, user := range []string{"u2", "u3", "u1"} {
+		l := license.License{Id: "l" + strconv.Itoa(i), Provider: "http://example.com", Issued: issued.Add(time.Duration(i) * time.Minute),
+			ContentId: "c1", Rights: &license.UserRights{}}
+		l.User.Id = user
+		if err := s.lst.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := httptest.NewRecorder()
+	ListLicenses(w, httptest.NewRequest("GET", "/licenses/?sort=user&per_page=2&fields=id", nil), s)
+	var licenses []map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&licenses); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(licenses) != 2 || licenses[0]["id"] != "l2" || licenses[1]["id"] != "l0" || len(licenses[0]) != 1 {
+		t.Errorf("Expected the ids of the first licenses by user, got %d %+v", w.Code, licenses)
+	}
+	if link := w.Header().Get("Link"); !strings.Contains(link, "page=2") || !strings.Contains(link, "sort=user") {
+		t.Errorf("Expected a link to the next page, got %s", link)
+	}
+
+	if err := s.idx.Add(index.Content{Id: "c1", EncryptionKey: []byte("key"), Location: "c1.epub"}); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	ListLicensesForContent(w, mux.SetURLVars(httptest.NewRequest("GET", "/contents/c1/licenses?sort=user_id", nil),
+		map[string]string{"content_id": "c1"}), s)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown sort field to be refused, got %d", w.Code)
+	}
+}
+
+func TestLicensedPublication(t *testing.T) {
+	var src bytes.Buffer
+	zw := zip.NewWriter(&src)
+	for _, f := range []struct{ name, data string }{{"mimetype", "application/epub+zip"},
+		{"META-INF/license.lcpl", `{"id":"old"}`}, {"OEBPS/chapter1.xhtml", strings.Repeat("<p>text</p>", 100)}} {
+		w, _ := zw.Create(f.name)
+		w.Write([]byte(f.data))
+	}
+	zw.Close()
+
+	dir, err := ioutil.TempDir("", "lcp_publication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := storage.NewFileSystem(dir, "")
+	item, err := store.Add("c1", bytes.NewReader(src.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stored file is read as the zip is read
+	zr, err := zip.NewReader(storage.NewReaderAt(item, int64(src.Len())), int64(src.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = writeLicensedPublication(&out, zr, &license.License{Id: "new"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range res.File {
+		names = append(names, f.Name)
+		if f.Name == epub.LicenseFile {
+			rc, _ := f.Open()
+			data, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			if !strings.Contains(string(data), `"id":"new"`) {
+				t.Errorf("Expected the new license, got %s", data)
+			}
+		}
+	}
+	// the license replaces the license of the publication
+	if strings.Join(names, ",") != "mimetype,OEBPS/chapter1.xhtml,"+epub.LicenseFile {
+		t.Errorf("Unexpected files %v", names)
+	}
+}
+
+func TestFreshLicense(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+	if err := borrow(s, "l1", "u1", nil); err != nil {
+		t.Fatal(err)
+	}
+	get := func() int {
+		r := httptest.NewRequest("GET", "/licenses/l1?fresh=true", nil)
+		r = mux.SetURLVars(r, map[string]string{"license_id": "l1"})
+		w := httptest.NewRecorder()
+		GetLicense(w, r, s)
+		return w.Code
+	}
+	// no license delivered yet, a partial license is returned
+	if code := get(); code != http.StatusPartialContent {
+		t.Errorf("Expected a partial license, got %d", code)
+	}
+
+	var l license.License
+	l.Id = "l1"
+	l.Encryption.UserKey = license.UserKey{Hint: "hint", Value: []byte("passphrase hash")}
+	l.Encryption.UserKey.Check = []byte("check")
+	saveLicenseKeys(l, s)
+	keys, err := s.Licenses().GetKeys("l1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the passphrase hash is not kept
+	if keys.Encryption.UserKey.Value != nil || string(keys.Encryption.UserKey.Check) != "check" {
+		t.Errorf("Unexpected keys %+v", keys.Encryption.UserKey)
+	}
+	if _, err = s.Licenses().GetKeys("l2"); !errors.Is(err, license.ErrKeysNotFound) {
+		t.Errorf("Expected no keys, got %v", err)
+	}
+}
+
+func TestSignedLicenseCache(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+	config.Config.Cache.SignedLicenses = true
+	defer func() { config.Config.Cache.SignedLicenses = false }()
+	s.lst = license.NewCachedStore(s.lst, cache.NewLRU(10, time.Minute))
+	if err := borrow(s, "l1", "u1", nil); err != nil {
+		t.Fatal(err)
+	}
+	l, err := s.lst.Get("l1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lst.SetSigned(l, "c1", []byte(`{"id":"l1"}`))
+	if doc, ok := s.lst.GetSigned(l, "c1"); !ok || string(doc) != `{"id":"l1"}` {
+		t.Errorf("Expected the signed license to be cached, got %s", doc)
+	}
+	// after a key rotation, the license signed with the previous certificate is not served
+	if _, ok := s.lst.GetSigned(l, "c2"); ok {
+		t.Error("Expected the license signed with another certificate to be ignored")
+	}
+	// a change of the status invalidates the signed license
+	if err = s.lst.UpdateLsdStatus("l1", 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.lst.GetSigned(l, "c1"); ok {
+		t.Error("Expected the signed license to be invalidated")
+	}
+	// a license updated by another instance is not served from the cache
+	s.lst.SetSigned(l, "c1", []byte(`{"id":"l1"}`))
+	updated := time.Now().UTC().Truncate(time.Second)
+	l.Updated = &updated
+	if _, ok := s.lst.GetSigned(l, "c1"); ok {
+		t.Error("Expected the signed license of a previous update to be ignored")
+	}
+}
+
+func TestLicenseSignatures(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+	ended := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	for i, end := range []*time.Time{nil, &ended, nil} {
+		id := "l" + strconv.Itoa(i)
+		if err := borrow(s, id, "u1", end); err != nil {
+			t.Fatal(err)
+		}
+		certificate := "old"
+		if i == 2 {
+			certificate = "new"
+		}
+		if err := s.lst.SaveSignature(id, "new"); err != nil {
+			t.Fatal(err)
+		}
+		// the last signature is kept
+		if err := s.lst.SaveSignature(id, certificate); err != nil {
+			t.Fatal(err)
+		}
+		if previous, err := s.lst.GetSignature(id); err != nil || previous != certificate {
+			t.Errorf("Expected the last signature, got %s, %v", previous, err)
+		}
+	}
+	if _, err := s.lst.GetSignature("unknown"); !errors.Is(err, license.ErrSignatureNotFound) {
+		t.Errorf("Expected no signature, got %v", err)
+	}
+	counts, err := s.lst.CountSignatures(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []license.SignatureCount{{Certificate: "new", Licenses: 1, Active: 1}, {Certificate: "old", Licenses: 2, Active: 1}}
+	if len(counts) != 2 || counts[0] != expected[0] || counts[1] != expected[1] {
+		t.Errorf("Expected %+v, got %+v", expected, counts)
+	}
+	if _, err = license.ForTenant(s.lst, "t1").CountSignatures(time.Now()); err != license.ErrOperatorOnly {
+		t.Errorf("Expected the count to be reserved to the operator, got %v", err)
+	}
+}
+
+func TestCertificateReport(t *testing.T) {
+	current := &tls.Certificate{Certificate: [][]byte{[]byte("current")}}
+	next := &tls.Certificate{Certificate: [][]byte{[]byte("next")}}
+	rotations := []sign.Rotation{{Name: "default", Current: current, Next: next, Policy: sign.PolicyAll}}
+	counts := []license.SignatureCount{{Certificate: sign.Fingerprint(current), Licenses: 2, Active: 1}, {Certificate: "retired", Licenses: 1}}
+
+	// the current certificate does not sign any more, but an active license was last signed with it
+	report := license.ReportCertificates(rotations, counts)
+	if len(report) != 3 || report[0].Role != license.RoleCurrent || report[0].Signing || report[0].Retirable || report[0].Active != 1 ||
+		report[1].Role != license.RoleNext || !report[1].Signing || report[2].Role != license.RoleRetired || !report[2].Retirable {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	// once the active license is signed again with the next certificate, the current one can be retired
+	counts[0].Active = 0
+	if report = license.ReportCertificates(rotations, counts); !report[0].Retirable {
+		t.Errorf("Expected the current certificate to be retirable, got %+v", report[0])
+	}
+	// while staged, the current certificate still signs the licenses
+	rotations[0].Policy = sign.PolicyStaged
+	if report = license.ReportCertificates(rotations, counts); !report[0].Signing || report[0].Retirable || report[1].Signing {
+		t.Errorf("Expected only the current certificate to sign, got %+v", report)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// ErrorNoCopiesAvailable is the type of the problem returned when all the copies of a content are on loan
+const ErrorNoCopiesAvailable = problem.SERVER_ERROR_BASE_URL + "no-copies-available"
+
+// NoCopiesError is returned when a loan exceeds the number of concurrent loans of its content
+type NoCopiesError struct {
+	problem.Availability
+}
+
+func (e *NoCopiesError) Error() string {
+	return "No copies of the publication are available for a new loan"
+}
+
+// ConcurrentLoans is the number of simultaneous loans of a content
+type ConcurrentLoans struct {
+	MaxConcurrentLoans int `json:"max_concurrent_loans"`
+}
+
+// isLoan checks that a license ends: the licenses without end (e.g. purchases) are not limited
+func isLoan(l license.License) bool {
+	return l.Rights != nil && l.Rights.End != nil
+}
+
+// loansLimited checks that a license is a loan of a content limited to concurrent loans
+func loansLimited(l license.License, s Server) bool {
+	if !isLoan(l) {
+		return false
+	}
+	content, err := s.Index().Get(l.ContentId)
+	return err == nil && content.MaxConcurrentLoans > 0
+}
+
+// checkCopiesAvailable checks, in the transaction which stores a loan, that a copy of its content is available.
+// The content is locked until the end of the transaction, so that the concurrent loans are counted.
+// If the hold queue is enabled, the first users on hold borrow the copies first and a user without copy
+// is placed on hold; the returned error then gives the position of the user in the queue.
+//
+func checkCopiesAvailable(tx *sql.Tx, l license.License, s Server, now time.Time) error {
+	// read the limit again, under lock
+	content, err := s.Index().LockTx(tx, l.ContentId)
+	if err != nil || content.MaxConcurrentLoans <= 0 {
+		return err
+	}
+	loans, err := s.Licenses().CountLoansTx(tx, l.ContentId, now)
+	if err != nil {
+		return err
+	}
+	available := content.MaxConcurrentLoans - loans.Active
+	noCopies := &NoCopiesError{problem.Availability{
+		MaxConcurrentLoans: content.MaxConcurrentLoans,
+		ActiveLoans:        loans.Active,
+		NextAvailable:      loans.NextEnd,
+	}}
+	if !config.Config.License.HoldQueue || l.User.Id == "" {
+		if available > 0 {
+			return nil
+		}
+		return noCopies
+	}
+
+	holds, err := s.Licenses().HoldsTx(tx, l.ContentId)
+	if err != nil {
+		return err
+	}
+	position := 0
+	for _, h := range holds {
+		if h.UserId == l.User.Id {
+			position = h.Position
+			break
+		}
+	}
+	if position > 0 && position <= available {
+		return s.Licenses().RemoveHoldTx(tx, l.ContentId, l.User.Id)
+	}
+	if position == 0 && len(holds) < available {
+		return nil
+	}
+	if position == 0 {
+		if err = s.Licenses().AddHoldTx(tx, l.ContentId, l.User.Id, now); err != nil {
+			return err
+		}
+		position = len(holds) + 1
+	}
+	noCopies.HoldPosition = position
+	return noCopies
+}
+
+// licenseError reports an error of the storage of a new license; a loan refused because no copy
+// of its content is available is forbidden
+//
+func licenseError(w http.ResponseWriter, r *http.Request, err error, contentID string) {
+	if noCopies, ok := err.(*NoCopiesError); ok {
+		problem.Error(w, r, problem.Problem{Type: ErrorNoCopiesAvailable, Title: "No copies available",
+			Detail: noCopies.Error(), Instance: contentID, Availability: &noCopies.Availability}, http.StatusForbidden)
+		return
+	}
+	problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, api.StoreStatus(err))
+}
+
+// SetMaxConcurrentLoans sets the number of simultaneous loans of a content, 0 if not limited
+//
+func SetMaxConcurrentLoans(w http.ResponseWriter, r *http.Request, s Server) {
+	contentID := mux.Vars(r)["content_id"]
+
+	var loans ConcurrentLoans
+	if err := json.NewDecoder(r.Body).Decode(&loans); err != nil {
+		api.BodyError(w, r, err)
+		return
+	}
+	if loans.MaxConcurrentLoans < 0 {
+		problem.Error(w, r, problem.Problem{Detail: "The number of concurrent loans must not be negative"}, http.StatusBadRequest)
+		return
+	}
+	content, err := s.Index().Get(contentID)
+	if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	content.MaxConcurrentLoans = loans.MaxConcurrentLoans
+	if err = s.Index().Update(content); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListHolds lists the users waiting for a copy of a content, the first to borrow it first
+//
+func ListHolds(w http.ResponseWriter, r *http.Request, s Server) {
+	contentID := mux.Vars(r)["content_id"]
+
+	if _, err := s.Index().Get(contentID); err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	holds, err := s.Licenses().ListHolds(contentID)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	enc.Encode(holds)
+}
+
+// CancelHold removes a user from the users waiting for a copy of a content
+//
+func CancelHold(w http.ResponseWriter, r *http.Request, s Server) {
+	vars := mux.Vars(r)
+	contentID := vars["content_id"]
+
+	if _, err := s.Index().Get(contentID); err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	err := s.Licenses().RemoveHold(contentID, vars["user_id"])
+	if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
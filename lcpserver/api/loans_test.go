@@ -0,0 +1,127 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/outbox"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/storage"
+)
+
+// loanServer only implements the contents, licenses, outbox and storage of the server
+type loanServer struct {
+	Server
+	idx index.Index
+	lst license.Store
+	ob  outbox.Store
+	st  storage.Store
+}
+
+func (s loanServer) Index() index.Index      { return s.idx }
+func (s loanServer) Licenses() license.Store { return s.lst }
+func (s loanServer) Outbox() outbox.Store    { return s.ob }
+func (s loanServer) Store() storage.Store    { return s.st }
+
+func newLoanServer(t *testing.T) (loanServer, func()) {
+	config.Config.LcpServer.Database = "sqlite3://:memory:"
+	config.Config.LsdServer.PublicBaseUrl = ""
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	var s loanServer
+	if s.idx, err = index.Open(db); err != nil {
+		t.Fatal(err)
+	}
+	if s.lst, err = license.NewSqlStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if s.ob, err = outbox.Open(db); err != nil {
+		t.Fatal(err)
+	}
+	return s, func() { db.Close() }
+}
+
+func borrow(s Server, id string, userID string, end *time.Time) error {
+	l := license.License{Id: id, Provider: "http://example.com", Issued: time.Now().UTC(), ContentId: "c1",
+		Rights: &license.UserRights{End: end}}
+	l.User.Id = userID
+	return addLicenseWithNotification(l, s)
+}
+
+func TestMaxConcurrentLoans(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+	defer func() { config.Config.License.HoldQueue = false }()
+	if err := s.idx.Add(index.Content{Id: "c1", EncryptionKey: []byte("key"), Location: "c1.epub", MaxConcurrentLoans: 2}); err != nil {
+		t.Fatal(err)
+	}
+	end := time.Now().Add(14 * 24 * time.Hour).UTC().Truncate(time.Second)
+	for i, user := range []string{"u1", "u2"} {
+		if err := borrow(s, "l"+user, user, &end); err != nil {
+			t.Fatalf("Expected loan %d to be stored, got %v", i+1, err)
+		}
+	}
+
+	err := borrow(s, "lu3", "u3", &end)
+	noCopies, ok := err.(*NoCopiesError)
+	if !ok {
+		t.Fatalf("Expected no copies available, got %v", err)
+	}
+	if noCopies.ActiveLoans != 2 || noCopies.NextAvailable == nil || noCopies.HoldPosition != 0 {
+		t.Errorf("Unexpected availability %+v", noCopies.Availability)
+	}
+	// a license without end is not a loan
+	if err = borrow(s, "pu3", "u3", nil); err != nil {
+		t.Errorf("Expected a purchase to be stored, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	licenseError(w, httptest.NewRequest("POST", "/contents/c1/license", nil), noCopies, "c1")
+	var p problem.Problem
+	json.NewDecoder(w.Body).Decode(&p)
+	if w.Code != http.StatusForbidden || p.Type != ErrorNoCopiesAvailable || p.Availability == nil || p.Availability.MaxConcurrentLoans != 2 {
+		t.Errorf("Unexpected problem %d %+v", w.Code, p)
+	}
+
+	// the users are placed on hold, and borrow the copies in the order of their holds
+	config.Config.License.HoldQueue = true
+	for i, user := range []string{"u3", "u4"} {
+		err = borrow(s, "l"+user, user, &end)
+		if noCopies, ok = err.(*NoCopiesError); !ok || noCopies.HoldPosition != i+1 {
+			t.Fatalf("Expected %s to be on hold at position %d, got %v", user, i+1, err)
+		}
+	}
+	// u1 returns its loan
+	returned := time.Now().Add(-time.Minute).UTC()
+	l := license.License{Id: "lu1", Provider: "http://example.com", ContentId: "c1", Rights: &license.UserRights{End: &returned}}
+	l.User.Id = "u1"
+	if err = s.lst.Update(l); err != nil {
+		t.Fatal(err)
+	}
+	if err = borrow(s, "lu4", "u4", &end); err == nil {
+		t.Error("Expected the copy to be kept for the first user on hold")
+	}
+	if err = borrow(s, "lu3", "u3", &end); err != nil {
+		t.Errorf("Expected the first user on hold to borrow the copy, got %v", err)
+	}
+	holds, err := s.lst.ListHolds("c1")
+	if err != nil || len(holds) != 1 || holds[0].UserId != "u4" || holds[0].Position != 1 {
+		t.Errorf("Unexpected holds %+v %v", holds, err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/onix"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// OnixReport is the result of the ingestion of an ONIX message
+type OnixReport struct {
+	Matched   []string `json:"matched"`
+	Unmatched []string `json:"unmatched"`
+}
+
+// IngestOnix parses an ONIX 3.0 message and associates the metadata of each product
+// with the content it describes. A product matches a content if its record reference
+// or one of its product identifiers is the content id.
+//
+func IngestOnix(w http.ResponseWriter, r *http.Request, s Server) {
+	products, err := onix.Parse(r.Body)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	report := OnixReport{Matched: make([]string, 0), Unmatched: make([]string, 0)}
+	for _, product := range products {
+		content, err := findOnixContent(product, s.Index())
+		if errors.Is(err, index.ErrNotFound) {
+			report.Unmatched = append(report.Unmatched, product.RecordReference)
+			continue
+		}
+		if err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		metadata := index.Metadata{
+			ContentId:  content.Id,
+			Title:      product.Title,
+			Author:     product.Author(),
+			Isbn:       product.ISBN,
+			CoverUrl:   product.CoverURL,
+			Collection: product.Collection,
+		}
+		err = s.Index().SetMetadata(metadata)
+		if err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		report.Matched = append(report.Matched, content.Id)
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(report)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetContentMetadata returns the metadata associated with a content
+//
+func GetContentMetadata(w http.ResponseWriter, r *http.Request, s Server) {
+	vars := mux.Vars(r)
+	contentID := vars["content_id"]
+
+	metadata, err := s.Index().GetMetadata(contentID)
+	if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(metadata)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+}
+
+// findOnixContent looks for the content described by an ONIX product
+//
+func findOnixContent(product onix.Product, idx index.Index) (index.Content, error) {
+	candidates := append([]string{product.RecordReference}, product.Identifiers...)
+	for _, id := range candidates {
+		if id == "" {
+			continue
+		}
+		content, err := idx.Get(id)
+		if !errors.Is(err, index.ErrNotFound) {
+			return content, err
+		}
+	}
+	return index.Content{}, index.ErrNotFound
+}
@@ -0,0 +1,290 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/outbox"
+	"github.com/readium/readium-lcp-server/servicetoken"
+	"github.com/readium/readium-lcp-server/shared"
+	"github.com/readium/readium-lcp-server/transport"
+)
+
+// delay between the attempts to deliver a notification, doubled at each failure
+const (
+	outboxInitialDelay = 5 * time.Second
+	outboxMaxDelay     = time.Hour
+	outboxBatchSize    = 100
+)
+
+// circuit breaker: after consecutive failures, the lsd server is considered down
+// and the delivery of the notifications is suspended for a while
+const (
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+// OutboxDepth is the number of notifications waiting in the outbox, exposed on /debug/vars
+var OutboxDepth = expvar.NewInt("lsd_outbox_depth")
+
+// errNotifyRejected is returned when the lsd server rejects a notification;
+// it will not be accepted later, so it is not retried
+var errNotifyRejected = errors.New("The notification was rejected by the License Status Server")
+
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+var lsdBreaker circuitBreaker
+
+// allow returns false while the circuit is open
+func (b *circuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return clock.Now().After(b.openUntil)
+}
+
+func (b *circuitBreaker) success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+func (b *circuitBreaker) failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if b.failures >= breakerThreshold {
+		b.openUntil = clock.Now().Add(breakerCooldown)
+		log.Println("Lsd notifications: circuit open for " + breakerCooldown.String())
+	}
+}
+
+// sendLsdNotification sends a license to the lsd server and returns the http status code
+//
+func sendLsdNotification(payload []byte, tenant string, contentID string) (int, error) {
+	req, err := http.NewRequest("PUT", config.Config.LsdServer.PublicBaseUrl+"/licenses", bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	// set credentials on lsd request
+	if err = servicetoken.Authorize(req, config.LsdServerName, config.NotifyAuth()); err != nil {
+		return 0, err
+	}
+	req.Header.Add("Content-Type", api.ContentType_LCP_JSON)
+	if tenant != "" {
+		req.Header.Set(api.HeaderTenant, tenant)
+	}
+	if contentID != "" {
+		req.Header.Set(api.HeaderContentId, contentID)
+	}
+
+	response, err := transport.To(config.LsdServerName).Do(req, 10*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return response.StatusCode, nil
+	case isRejected(response.StatusCode):
+		return response.StatusCode, errNotifyRejected
+	default:
+		return response.StatusCode, errors.New("The License Status Server returned " + strconv.Itoa(response.StatusCode))
+	}
+}
+
+// isRejected tells if the lsd server rejected a notification for good; an authentication error
+// (e.g. credentials being rotated), a missing route (e.g. a deployment in progress), a timeout
+// or a rate limit are temporary, the notification is retried
+func isRejected(code int) bool {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return code >= 400 && code < 500
+}
+
+// the lock of the loans of a content is held at most loanLockTTL, and a new loan waits at most loanLockWait for it
+const (
+	loanLockTTL  = 30 * time.Second
+	loanLockWait = 10 * time.Second
+)
+
+// addLicenseWithNotification stores a license and its notification to the License Status Server
+// in the same transaction: a license is never stored without the notification which creates
+// its status document, even after a crash. The notification is then delivered asynchronously.
+// A loan is stored only if a copy of its content is available, checked in the same transaction.
+//
+func addLicenseWithNotification(l license.License, s Server) error {
+	notify := config.Config.LsdServer.PublicBaseUrl != ""
+	limited := loansLimited(l, s)
+	if !notify && !limited {
+		return s.Licenses().Add(l)
+	}
+	var payload []byte
+	var err error
+	if notify {
+		if payload, err = json.Marshal(l); err != nil {
+			return err
+		}
+	}
+	if limited {
+		// the loans of the content are also counted one at a time across the instances of the server,
+		// whatever the locking of the database
+		unlock, err := shared.Lock(shared.Default(), "loans:"+l.ContentId, loanLockTTL, loanLockWait)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	err = dbutils.Transact(s.Outbox(), func(tx *sql.Tx) error {
+		if limited {
+			err := checkCopiesAvailable(tx, l, s, clock.Now())
+			if noCopies, ok := err.(*NoCopiesError); ok && noCopies.HoldPosition > 0 {
+				// keep the hold of the user
+				return dbutils.KeepChanges(err)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := s.Licenses().AddTx(tx, l); err != nil {
+			return err
+		}
+		if notify {
+			return s.Outbox().AddTx(tx, outbox.Notification{LicenseId: l.Id, Payload: payload})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if notify {
+		OutboxDepth.Add(1)
+		WakeOutbox()
+	}
+	return nil
+}
+
+// outboxWakeup asks the re-driver to run without waiting for the next tick
+var outboxWakeup = make(chan struct{}, 1)
+
+// WakeOutbox asks the re-driver to deliver the pending notifications now
+func WakeOutbox() {
+	select {
+	case outboxWakeup <- struct{}{}:
+	default:
+		// a run is already requested
+	}
+}
+
+// RunOutbox delivers the notifications of the outbox, periodically
+// and each time a new notification is stored. It never returns.
+//
+func RunOutbox(s Server, interval time.Duration) {
+	updateOutboxDepth(s)
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+		case <-outboxWakeup:
+		}
+		RedriveOutbox(s)
+	}
+}
+
+// RedriveOutbox sends the notifications of the outbox which are due.
+// It must not be called concurrently: RunOutbox is the only caller in the License Server.
+//
+func RedriveOutbox(s Server) {
+	if config.Config.LsdServer.PublicBaseUrl == "" {
+		return
+	}
+	defer updateOutboxDepth(s)
+
+	// get the due notifications first, the result set must be closed before updates
+	var due []outbox.Notification
+	fn := s.Outbox().ListDue(clock.Now().UTC(), outboxBatchSize)
+	n, err := fn()
+	for ; err == nil; n, err = fn() {
+		due = append(due, n)
+	}
+	if err != outbox.NotFound {
+		log.Println("Outbox: error listing the notifications: " + err.Error())
+		return
+	}
+
+	for _, n := range due {
+		if !lsdBreaker.allow() {
+			return
+		}
+		// the tenant and the content are not part of the license document
+		var tenant, contentID string
+		if l, err := s.Licenses().Get(n.LicenseId); err == nil {
+			tenant, contentID = l.Tenant, l.ContentId
+		}
+		code, err := sendLsdNotification(n.Payload, tenant, contentID)
+		if err == nil || err == errNotifyRejected {
+			lsdBreaker.success()
+			_ = s.Licenses().UpdateLsdStatus(n.LicenseId, int32(code))
+			if err = s.Outbox().Delete(n.Id); err != nil {
+				log.Println("Outbox: error deleting notification " + strconv.FormatInt(n.Id, 10) + ": " + err.Error())
+			}
+			// message to the console
+			log.Println("Notify Lsd Server of a new License with id " + n.LicenseId + " = " + strconv.Itoa(code))
+			continue
+		}
+		lsdBreaker.failure()
+		log.Println("Error Notify LsdServer of new License (" + n.LicenseId + "):" + err.Error())
+		if n.Attempts == 0 {
+			_ = s.Licenses().UpdateLsdStatus(n.LicenseId, -1)
+		}
+		attempts := n.Attempts + 1
+		err = s.Outbox().Retry(n.Id, attempts, clock.Now().UTC().Add(outboxDelay(attempts)), err.Error())
+		if err != nil {
+			log.Println("Outbox: error rescheduling notification " + strconv.FormatInt(n.Id, 10) + ": " + err.Error())
+		}
+	}
+}
+
+// outboxDelay returns the delay before the next attempt, doubled at each failure
+func outboxDelay(attempts int) time.Duration {
+	delay := outboxInitialDelay
+	for i := 1; i < attempts && delay < outboxMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > outboxMaxDelay {
+		delay = outboxMaxDelay
+	}
+	return delay
+}
+
+func updateOutboxDepth(s Server) {
+	if count, err := s.Outbox().Count(); err == nil {
+		OutboxDepth.Set(count)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/clock"
+)
+
+func TestNotificationRejected(t *testing.T) {
+	for code, rejected := range map[int]bool{
+		http.StatusBadRequest:          true,
+		http.StatusConflict:            true,
+		http.StatusUnauthorized:        false,
+		http.StatusForbidden:           false,
+		http.StatusNotFound:            false,
+		http.StatusRequestTimeout:      false,
+		http.StatusTooManyRequests:     false,
+		http.StatusInternalServerError: false,
+	} {
+		if isRejected(code) != rejected {
+			t.Errorf("Expected the status %d to be rejected: %v", code, rejected)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC))
+	defer clock.Set(fake)()
+
+	var b circuitBreaker
+	for i := 0; i < breakerThreshold-1; i++ {
+		b.failure()
+	}
+	if !b.allow() {
+		t.Fatal("Expected the circuit to stay closed below the threshold")
+	}
+	b.failure()
+	if b.allow() {
+		t.Fatal("Expected the circuit to open at the threshold")
+	}
+	fake.Advance(breakerCooldown - time.Second)
+	if b.allow() {
+		t.Error("Expected the circuit to stay open during the cooldown")
+	}
+	fake.Advance(2 * time.Second)
+	if !b.allow() {
+		t.Error("Expected the circuit to close after the cooldown")
+	}
+	b.success()
+	b.failure()
+	if !b.allow() {
+		t.Error("Expected the failures to be counted again after a success")
+	}
+}
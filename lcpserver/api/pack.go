@@ -0,0 +1,124 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/jobs"
+	"github.com/readium/readium-lcp-server/pack"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/staging"
+)
+
+// JobEncrypt is the kind of the jobs which encrypt an uploaded EPUB file
+const JobEncrypt = "encrypt"
+
+// the defaults of the encryption of the uploaded files
+const (
+	DefaultPackWorkers     = 2
+	DefaultPackMaxAttempts = 3
+)
+
+// encryptPayload is the payload of an encryption job: the location of the uploaded file, a local path
+// or a file of the staging store, kept until the job has ended
+type encryptPayload struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// encryptResult is the result of an encryption job
+type encryptResult struct {
+	ContentId string `json:"content_id"`
+}
+
+// StoreContent queues the encryption of an EPUB file, sent as the body of the request;
+// the content name is given in the url (name). The file is encrypted by the workers of the job queue,
+// so that a large file does not hold the request: the response is a 202 with the url of the job,
+// polled until the job is done, with the id of the new content as its result, or failed.
+//
+func StoreContent(w http.ResponseWriter, r *http.Request, s Server) {
+	name := r.FormValue("name")
+	if name == "" {
+		problem.Error(w, r, problem.Problem{Detail: "The name of the content is missing"}, http.StatusBadRequest)
+		return
+	}
+	path, err := saveUpload(r.Body)
+	if err != nil {
+		api.BodyError(w, r, err)
+		return
+	}
+	j, err := s.Jobs().Enqueue(JobEncrypt, encryptPayload{Name: name, Path: path})
+	if err != nil {
+		staging.Remove(path)
+		api.StoreError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+strconv.FormatInt(j.Id, 10))
+	writeJob(w, j, http.StatusAccepted)
+}
+
+// saveUpload stores an uploaded file in the upload directory, until it is encrypted; with a staging store,
+// the file is moved to the staging store, so that the job may be run by another instance of the server
+func saveUpload(body io.Reader) (string, error) {
+	f, err := ioutil.TempFile(config.Config.Packaging.UploadDirectory, "readium-lcp-upload")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if staging.Enabled() {
+		return staging.PutFile(f.Name())
+	}
+	return f.Name(), nil
+}
+
+// EncryptUpload returns the handler of the encryption jobs: the uploaded file is encrypted by the packager,
+// and removed once encrypted or after the last attempt
+//
+func EncryptUpload(s Server) jobs.Handler {
+	return func(j jobs.Job) (interface{}, error) {
+		var p encryptPayload
+		if err := json.Unmarshal(j.Payload, &p); err != nil {
+			return nil, err
+		}
+		result := encryptFile(s, p)
+		if result.Error != nil && !j.LastAttempt() {
+			return nil, result.Error
+		}
+		staging.Remove(p.Path)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		return encryptResult{ContentId: result.Id}, nil
+	}
+}
+
+// encryptFile encrypts an uploaded file, stores it and adds it to the index
+func encryptFile(s Server, p encryptPayload) pack.Result {
+	f, err := staging.Open(p.Path)
+	if err != nil {
+		return pack.Result{Error: err}
+	}
+	defer staging.Close(p.Path, f)
+	info, err := f.Stat()
+	if err != nil {
+		return pack.Result{Error: err}
+	}
+	return s.Source().Post(pack.NewTask(p.Name, f, info.Size()))
+}
@@ -0,0 +1,39 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/storage"
+)
+
+// the types of the problems reporting the errors of the License Server
+func init() {
+	problem.RegisterType(license.ErrNotFound, problem.LICENSE_NOT_FOUND)
+	problem.RegisterType(license.ErrModified, problem.LICENSE_MODIFIED)
+	problem.RegisterType(license.ErrHoldNotFound, problem.HOLD_NOT_FOUND)
+	problem.RegisterType(license.ErrRightsExceeded, problem.RIGHTS_EXCEEDED)
+	problem.RegisterType(license.ErrInvalidCursor, problem.INVALID_CURSOR)
+	problem.RegisterType(license.ErrOperatorOnly, problem.OPERATOR_ONLY)
+	problem.RegisterType(license.ErrUnsupportedHashAlgorithm, problem.UNSUPPORTED_HASH)
+	problem.RegisterType(license.ErrBadHashSize, problem.BAD_PASSPHRASE_HASH)
+	problem.RegisterType(license.ErrUnknownUserField, problem.UNKNOWN_USER_FIELD)
+	problem.RegisterType(license.ErrKeyCheckMismatch, problem.KEY_CHECK_MISMATCH)
+	problem.RegisterType(index.ErrNotFound, problem.CONTENT_NOT_FOUND)
+	problem.RegisterType(index.ErrModified, problem.CONTENT_MODIFIED)
+	problem.RegisterType(storage.ErrNotFound, problem.FILE_NOT_FOUND)
+	problem.RegisterType(storage.ErrChecksumMismatch, problem.CHECKSUM_MISMATCH)
+
+	problem.RegisterType(ErrMandatoryInfoMissing, problem.MANDATORY_INFO_MISSING)
+	problem.RegisterType(ErrBadHexValue, problem.BAD_PASSPHRASE_HASH)
+	problem.RegisterType(ErrBadValue, problem.BAD_PASSPHRASE_HASH)
+	problem.RegisterType(ErrHashAlgorithmChanged, problem.HASH_ALGORITHM_CHANGED)
+	problem.RegisterType(ErrNotUpdatable, problem.NOT_UPDATABLE)
+	problem.RegisterType(ErrLicenseIdMismatch, problem.LICENSE_ID_MISMATCH)
+	problem.RegisterType(ErrBadRights, problem.BAD_RIGHTS)
+	problem.RegisterType(ErrBadConsumption, problem.BAD_CONSUMPTION)
+}
@@ -0,0 +1,249 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/audit"
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/servicetoken"
+	"github.com/readium/readium-lcp-server/status"
+	"github.com/readium/readium-lcp-server/transport"
+)
+
+// RefundEvent is the event of the webhooks which confirm the refund of a license
+const RefundEvent = "license_refunded"
+
+// RefundSignatureHeader carries the HMAC-SHA256 of the body of the refund webhooks, in hex
+const RefundSignatureHeader = "X-LCP-Signature"
+
+// RefundRequest is the optional body of a refund, sent by the storefront
+type RefundRequest struct {
+	OrderId string `json:"order_id,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// RefundConfirmation is the result of a refund, also posted to the webhook of the refunds
+type RefundConfirmation struct {
+	Event     string     `json:"event"`
+	LicenseId string     `json:"license_id"`
+	ContentId string     `json:"content_id"`
+	Provider  string     `json:"provider"`
+	OrderId   string     `json:"order_id,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Status    string     `json:"status,omitempty"`
+	End       *time.Time `json:"end,omitempty"`
+	Refunded  time.Time  `json:"refunded"`
+}
+
+// refundDetail is the detail of a refund recorded in the audit log
+type refundDetail struct {
+	OrderId      string     `json:"order_id,omitempty"`
+	Reason       string     `json:"reason,omitempty"`
+	PreviousEnd  *time.Time `json:"previous_end,omitempty"`
+	End          *time.Time `json:"end,omitempty"`
+	Status       string     `json:"status,omitempty"`
+	LsdError     string     `json:"lsd_error,omitempty"`
+	WebhookError string     `json:"webhook_error,omitempty"`
+}
+
+// timeout of the calls to the License Status Server and to the webhook of the refunds
+const refundTimeout = 30 * time.Second
+
+var refundClient = &http.Client{
+	Timeout: refundTimeout,
+}
+
+// RefundLicense invalidates the license of a refunded purchase: the License Status Server revokes it
+// (or cancels it if it has never been used), which ends its rights now; the rights are ended directly
+// if there is no License Status Server. The refund is recorded in the audit log and confirmed
+// to the webhook of the refunds. Refunding a license already returned, revoked or expired confirms it again.
+//
+func RefundLicense(w http.ResponseWriter, r *http.Request, s Server) {
+	licenseID := mux.Vars(r)["license_id"]
+
+	var refund RefundRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&refund); err != nil && err != io.EOF {
+		api.BodyError(w, r, err)
+		return
+	}
+
+	lic, err := s.Licenses().Get(licenseID)
+	if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	detail := refundDetail{OrderId: refund.OrderId, Reason: refund.Reason}
+	if lic.Rights != nil {
+		detail.PreviousEnd = lic.Rights.End
+	}
+
+	lsdErr := revokeRefunded(&lic, s)
+	if lsdErr != nil {
+		detail.LsdError = lsdErr.Error()
+	} else {
+		if lic, err = s.Licenses().Get(licenseID); err != nil {
+			api.StoreError(w, r, err)
+			return
+		}
+		detail.Status, lsdErr = refundedStatus(licenseID)
+		if lsdErr != nil {
+			detail.LsdError = lsdErr.Error()
+		}
+	}
+	if lic.Rights != nil {
+		detail.End = lic.Rights.End
+	}
+
+	confirmation := RefundConfirmation{Event: RefundEvent, LicenseId: licenseID, ContentId: lic.ContentId, Provider: lic.Provider,
+		OrderId: refund.OrderId, Reason: refund.Reason, Status: detail.Status, End: detail.End, Refunded: clock.Now().UTC().Truncate(time.Second)}
+	// the invalidation is only confirmed once the status document is revoked
+	if lsdErr == nil {
+		if err = postRefundWebhook(confirmation); err != nil {
+			log.Println("Refund " + licenseID + ": error posting the webhook: " + err.Error())
+			detail.WebhookError = err.Error()
+		}
+	}
+
+	actor, _, _ := r.BasicAuth()
+	payload, _ := json.Marshal(detail)
+	err = s.Audit().Add(audit.Entry{Actor: actor, Action: audit.ActionRefund, Subject: licenseID, Detail: string(payload)})
+	if err != nil {
+		log.Println("Refund " + licenseID + ": error recording the audit entry: " + err.Error())
+		problem.Error(w, r, problem.Problem{Detail: "Refund processed but not recorded: " + err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	log.Println("Refund " + licenseID + ", status " + detail.Status)
+
+	if lsdErr != nil {
+		problem.Error(w, r, problem.Problem{Detail: "The status of the license " + licenseID +
+			" has not been revoked by the License Status Server: " + lsdErr.Error()}, http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	json.NewEncoder(w).Encode(confirmation)
+}
+
+// revokeRefunded asks the License Status Server to revoke a license, which ends its rights through
+// an update of the license; a license which is not ready nor active has already been invalidated.
+// Without License Status Server, the rights of the license end now.
+//
+func revokeRefunded(lic *license.License, s Server) error {
+	if config.Config.LsdServer.PublicBaseUrl == "" {
+		now := clock.Now().UTC().Truncate(time.Second)
+		if lic.Rights == nil {
+			lic.Rights = new(license.UserRights)
+		}
+		if lic.Rights.End != nil && !lic.Rights.End.After(now) {
+			return nil
+		}
+		lic.Rights.End = &now
+		return s.Licenses().Update(*lic)
+	}
+
+	payload, err := json.Marshal(map[string]string{"status": status.STATUS_REVOKED})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PATCH", config.Config.LsdServer.PublicBaseUrl+"/licenses/"+lic.Id+"/status", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if err = servicetoken.Authorize(req, config.LsdServerName, config.NotifyAuth()); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", api.ContentType_JSON)
+	response, err := transport.To(config.LsdServerName).Do(req, refundTimeout)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	// 400: the license is not ready nor active, i.e. already returned, revoked, cancelled or expired
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusBadRequest {
+		return errors.New("The License Status Server returned " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
+
+// refundedStatus returns the status of a refunded license, from its status document;
+// it is empty without License Status Server
+func refundedStatus(licenseID string) (string, error) {
+	if config.Config.LsdServer.PublicBaseUrl == "" {
+		return "", nil
+	}
+	req, err := http.NewRequest("GET", config.Config.LsdServer.PublicBaseUrl+"/licenses/"+licenseID+"/status", nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := transport.To(config.LsdServerName).Do(req, refundTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New("The License Status Server returned " + strconv.Itoa(response.StatusCode))
+	}
+	var doc struct {
+		Status string `json:"status"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&doc); err != nil {
+		return "", err
+	}
+	switch doc.Status {
+	case status.STATUS_READY, status.STATUS_ACTIVE:
+		return "", errors.New("The license is still " + doc.Status)
+	}
+	return doc.Status, nil
+}
+
+// postRefundWebhook posts the confirmation of a refund, signed with the secret of the webhook if it is set
+func postRefundWebhook(confirmation RefundConfirmation) error {
+	conf := config.Config.Refunds
+	if conf.WebhookURL == "" {
+		return nil
+	}
+	payload, err := json.Marshal(confirmation)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", conf.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", api.ContentType_JSON)
+	if conf.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(conf.WebhookSecret))
+		mac.Write(payload)
+		req.Header.Set(RefundSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+	response, err := refundClient.Do(req)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.New("The webhook returned " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
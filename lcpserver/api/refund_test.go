@@ -0,0 +1,129 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/audit"
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license"
+)
+
+// refundServer adds the audit log to the loanServer
+type refundServer struct {
+	loanServer
+	aud audit.Store
+}
+
+func (s refundServer) Audit() audit.Store { return s.aud }
+
+func refund(s Server, id string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/licenses/"+id+"/refund", strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"license_id": id})
+	r.SetBasicAuth("storefront", "secret")
+	w := httptest.NewRecorder()
+	RefundLicense(w, r, s)
+	return w
+}
+
+func TestRefundLicense(t *testing.T) {
+	ls, closeDB := newLoanServer(t)
+	defer closeDB()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	aud, err := audit.Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := refundServer{loanServer: ls, aud: aud}
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	defer clock.Set(clock.NewFake(now))()
+
+	var confirmations []RefundConfirmation
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("hook-secret"))
+		mac.Write(body)
+		if r.Header.Get(RefundSignatureHeader) != hex.EncodeToString(mac.Sum(nil)) {
+			t.Error("Expected a signed webhook")
+		}
+		var c RefundConfirmation
+		json.Unmarshal(body, &c)
+		confirmations = append(confirmations, c)
+	}))
+	defer webhook.Close()
+	config.Config.Refunds = config.Refunds{WebhookURL: webhook.URL, WebhookSecret: "hook-secret"}
+	defer func() { config.Config.Refunds = config.Refunds{} }()
+
+	// without License Status Server, the rights of the refunded purchase end now
+	if err = s.lst.Add(license.License{Id: "p1", Provider: "http://example.com", Issued: now.AddDate(0, 0, -2), ContentId: "c1", Rights: &license.UserRights{}}); err != nil {
+		t.Fatal(err)
+	}
+	w := refund(s, "p1", `{"order_id": "o-42", "reason": "duplicate order"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the refund to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	lic, err := s.lst.Get("p1")
+	if err != nil || lic.Rights == nil || lic.Rights.End == nil || !lic.Rights.End.Equal(now) {
+		t.Fatalf("Expected the license to end now, got %+v, %v", lic.Rights, err)
+	}
+	if len(confirmations) != 1 || confirmations[0].Event != RefundEvent || confirmations[0].OrderId != "o-42" || confirmations[0].LicenseId != "p1" {
+		t.Errorf("Expected the refund to be confirmed to the webhook, got %+v", confirmations)
+	}
+	var entries []audit.Entry
+	fn := s.aud.List(audit.ActionRefund, 10, 0)
+	for e, err := fn(); err == nil; e, err = fn() {
+		entries = append(entries, e)
+	}
+	if len(entries) != 1 || entries[0].Subject != "p1" || entries[0].Actor != "storefront" || !strings.Contains(entries[0].Detail, `"order_id":"o-42"`) {
+		t.Errorf("Expected the refund to be audited, got %+v", entries)
+	}
+
+	// the License Status Server revokes the license; it is not confirmed while the status is not revoked
+	lsdStatus := http.StatusBadGateway
+	lsd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PATCH" {
+			w.WriteHeader(lsdStatus)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+	}))
+	defer lsd.Close()
+	config.Config.LsdServer.PublicBaseUrl = lsd.URL
+	defer func() { config.Config.LsdServer.PublicBaseUrl = "" }()
+
+	confirmations = nil
+	if w = refund(s, "p1", ""); w.Code != http.StatusBadGateway || len(confirmations) != 0 {
+		t.Errorf("Expected the refund to fail with the License Status Server, got %d, %d confirmations", w.Code, len(confirmations))
+	}
+	lsdStatus = http.StatusOK
+	if w = refund(s, "p1", ""); w.Code != http.StatusOK || len(confirmations) != 1 || confirmations[0].Status != "revoked" {
+		t.Errorf("Expected the revocation to be confirmed, got %d, %+v", w.Code, confirmations)
+	}
+	if w = refund(s, "unknown", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown license to be not found, got %d", w.Code)
+	}
+	if w = refund(s, "p1", `{"amount": 10}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown property to be refused, got %d", w.Code)
+	}
+}
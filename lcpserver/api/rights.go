@@ -0,0 +1,73 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// Consumption is the amount of pages printed and characters copied reported by a reading system
+type Consumption struct {
+	Print int32 `json:"print"`
+	Copy  int32 `json:"copy"`
+}
+
+// ErrBadConsumption is returned when a reported consumption is not a positive amount
+var ErrBadConsumption = errors.New("The print and copy amounts consumed must be positive, at least one of them not null")
+
+// GetLicenseRights returns the print and copy rights granted by a license, their consumption
+// and the remaining allowances
+//
+func GetLicenseRights(w http.ResponseWriter, r *http.Request, s Server) {
+	licenseID := mux.Vars(r)["license_id"]
+
+	allowance, err := s.Licenses().GetAllowance(licenseID)
+	if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	writeAllowance(w, allowance)
+}
+
+// ConsumeLicenseRights adds the print and copy amounts reported by a reading system to the consumption
+// of a license; a consumption exceeding the granted rights is rejected and nothing is recorded.
+//
+func ConsumeLicenseRights(w http.ResponseWriter, r *http.Request, s Server) {
+	licenseID := mux.Vars(r)["license_id"]
+
+	var consumption Consumption
+	if err := json.NewDecoder(r.Body).Decode(&consumption); err != nil {
+		api.BodyError(w, r, err)
+		return
+	}
+	if consumption.Print < 0 || consumption.Copy < 0 || (consumption.Print == 0 && consumption.Copy == 0) {
+		problem.Error(w, r, problem.Problem{Detail: ErrBadConsumption.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	allowance, err := s.Licenses().Consume(licenseID, consumption.Print, consumption.Copy)
+	if err == license.ErrRightsExceeded {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusForbidden)
+		return
+	} else if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	writeAllowance(w, allowance)
+}
+
+func writeAllowance(w http.ResponseWriter, allowance license.Allowance) {
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	enc.Encode(allowance)
+}
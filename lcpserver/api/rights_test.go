@@ -0,0 +1,87 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license"
+)
+
+// licenseServer only implements the licenses of the server
+type licenseServer struct {
+	Server
+	lst license.Store
+}
+
+func (s licenseServer) Licenses() license.Store { return s.lst }
+
+func consume(s Server, licenseID string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/licenses/"+licenseID+"/rights", strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"license_id": licenseID})
+	w := httptest.NewRecorder()
+	ConsumeLicenseRights(w, r, s)
+	return w
+}
+
+func TestConsumeLicenseRights(t *testing.T) {
+	config.Config.LcpServer.Database = "sqlite3://:memory:"
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	lst, err := license.NewSqlStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	printRight, copyRight := int32(10), int32(1000)
+	l := license.License{Id: "l1", Provider: "http://example.com", Issued: time.Now().UTC(), ContentId: "c1",
+		Rights: &license.UserRights{Print: &printRight, Copy: &copyRight}}
+	l.User.Id = "u1"
+	if err = lst.Add(l); err != nil {
+		t.Fatal(err)
+	}
+	s := licenseServer{lst: lst}
+
+	w := consume(s, "l1", `{"print": 4, "copy": 600}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the consumption to be recorded, got %d %s", w.Code, w.Body.String())
+	}
+	var a license.Allowance
+	json.NewDecoder(w.Body).Decode(&a)
+	if a.Print.Used != 4 || *a.Print.Remaining != 6 || a.Copy.Used != 600 || *a.Copy.Remaining != 400 {
+		t.Errorf("Unexpected allowance %+v", a)
+	}
+
+	// a consumption exceeding one of the rights is rejected as a whole
+	if w = consume(s, "l1", `{"print": 1, "copy": 401}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the consumption to be rejected, got %d", w.Code)
+	}
+	if a, _ = lst.GetAllowance("l1"); a.Print.Used != 4 || a.Copy.Used != 600 {
+		t.Errorf("Expected the consumption to be unchanged, got %+v", a)
+	}
+	if w = consume(s, "l1", `{"print": 6, "copy": 400}`); w.Code != http.StatusOK {
+		t.Errorf("Expected the remaining rights to be consumed, got %d", w.Code)
+	}
+
+	if w = consume(s, "l1", `{"print": -1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a negative amount to be rejected, got %d", w.Code)
+	}
+	if w = consume(s, "unknown", `{"print": 1}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown license, got %d", w.Code)
+	}
+}
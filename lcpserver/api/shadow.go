@@ -0,0 +1,247 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// ShadowStats counts the replays of the shadow mode, exposed on /debug/vars:
+// replayed, mismatches, errors (the secondary server did not answer) and dropped (too many replays in flight)
+var ShadowStats = expvar.NewMap("shadow")
+
+// shadowMaxReplays is the max number of replays in flight; the fetches beyond are not replayed
+const shadowMaxReplays = 16
+
+// shadowMaxBody is the max size of the responses compared, in bytes
+const shadowMaxBody = 1 << 20
+
+var shadowReplays = make(chan struct{}, shadowMaxReplays)
+
+// the members of the licenses which always differ between two servers: the signature,
+// and the values encrypted with a random initialization vector
+var shadowIgnored = []string{"signature", "encryption.content_key.encrypted_value", "encryption.user_key.key_check"}
+
+// shadowRecorder keeps the status and the body of a response while it is written
+type shadowRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (rec *shadowRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *shadowRecorder) Write(b []byte) (int, error) {
+	if rec.body.Len()+len(b) > shadowMaxBody {
+		rec.truncated = true
+	} else {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap gives access to the response writer of the server, for http.NewResponseController
+func (rec *shadowRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Shadowed returns a license fetch handler which also replays the fetch against the secondary
+// License Server of the shadow mode, once served; the responses are compared asynchronously
+// and their differences logged. The handler is unchanged while the shadow mode is disabled.
+//
+func Shadowed(handler func(http.ResponseWriter, *http.Request, Server)) func(http.ResponseWriter, *http.Request, Server) {
+	return func(w http.ResponseWriter, r *http.Request, s Server) {
+		shadow := config.Config.Shadow
+		if shadow.Url == "" || (shadow.SampleRate > 0 && rand.Float64() >= shadow.SampleRate) {
+			handler(w, r, s)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			api.BodyError(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		rec := &shadowRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, r, s)
+
+		select {
+		case shadowReplays <- struct{}{}:
+		default:
+			ShadowStats.Add("dropped", 1)
+			return
+		}
+		method, uri, contentType := r.Method, r.URL.RequestURI(), r.Header.Get("Content-Type")
+		go func() {
+			defer func() { <-shadowReplays }()
+			replayShadow(shadow, method, uri, contentType, body, rec)
+		}()
+	}
+}
+
+// replayShadow sends a license fetch to the secondary server and logs the differences of its response
+func replayShadow(shadow config.Shadow, method, uri, contentType string, body []byte, primary *shadowRecorder) {
+	ShadowStats.Add("replayed", 1)
+	status, secondary, err := sendShadowRequest(shadow, method, uri, contentType, body)
+	if err != nil {
+		ShadowStats.Add("errors", 1)
+		log.Println("Shadow: " + method + " " + uri + ": " + err.Error())
+		return
+	}
+	var diffs []string
+	switch {
+	case status != primary.status:
+		diffs = []string{"status " + strconv.Itoa(primary.status) + " vs " + strconv.Itoa(status)}
+	case status >= 300 || primary.truncated:
+		// only the status of the errors is compared
+	default:
+		diffs = compareLicenses(primary.body.Bytes(), secondary, append(shadowIgnored, shadow.Ignore...))
+	}
+	if len(diffs) > 0 {
+		ShadowStats.Add("mismatches", 1)
+		log.Println("Shadow: " + method + " " + uri + ": the responses differ: " + strings.Join(diffs, ", "))
+	}
+}
+
+// sendShadowRequest sends a request to the secondary server and returns the status and the body of its response
+func sendShadowRequest(shadow config.Shadow, method, uri, contentType string, body []byte) (int, []byte, error) {
+	timeout := time.Duration(shadow.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	req, err := http.NewRequest(method, strings.TrimSuffix(shadow.Url, "/")+uri, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if shadow.Auth.Username != "" {
+		req.SetBasicAuth(shadow.Auth.Username, shadow.Auth.Password)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	response, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+	secondary, err := io.ReadAll(io.LimitReader(response.Body, shadowMaxBody+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(secondary) > shadowMaxBody {
+		return 0, nil, errors.New("The response of the secondary server is too large")
+	}
+	return response.StatusCode, secondary, nil
+}
+
+// compareLicenses returns the paths of the members which differ between two licenses;
+// the ignored members (dotted paths, through the arrays) and the encrypted user fields are not compared
+func compareLicenses(primary, secondary []byte, ignore []string) []string {
+	var a, b interface{}
+	if json.Unmarshal(primary, &a) != nil || json.Unmarshal(secondary, &b) != nil {
+		if bytes.Equal(primary, secondary) {
+			return nil
+		}
+		return []string{"body"}
+	}
+	for _, doc := range []interface{}{a, b} {
+		for _, path := range append(ignore, encryptedUserFields(doc)...) {
+			removeMember(doc, strings.Split(path, "."))
+		}
+	}
+	var diffs []string
+	diffMembers("", a, b, &diffs)
+	return diffs
+}
+
+// encryptedUserFields returns the paths of the user fields of a license which are encrypted
+func encryptedUserFields(doc interface{}) []string {
+	var paths []string
+	if m, ok := doc.(map[string]interface{}); ok {
+		if user, ok := m["user"].(map[string]interface{}); ok {
+			if names, ok := user["encrypted"].([]interface{}); ok {
+				for _, name := range names {
+					if s, ok := name.(string); ok {
+						paths = append(paths, "user."+s)
+					}
+				}
+			}
+		}
+	}
+	return paths
+}
+
+// removeMember removes a member from a json document, in every item of the arrays on its path
+func removeMember(doc interface{}, path []string) {
+	switch v := doc.(type) {
+	case []interface{}:
+		for _, item := range v {
+			removeMember(item, path)
+		}
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+		} else if child, ok := v[path[0]]; ok {
+			removeMember(child, path[1:])
+		}
+	}
+}
+
+// diffMembers appends the paths of the members which differ between two json values
+func diffMembers(path string, a, b interface{}, diffs *[]string) {
+	ma, okA := a.(map[string]interface{})
+	mb, okB := b.(map[string]interface{})
+	if okA && okB {
+		names := make([]string, 0, len(ma)+len(mb))
+		for name := range ma {
+			names = append(names, name)
+		}
+		for name := range mb {
+			if _, ok := ma[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := name
+			if path != "" {
+				child = path + "." + name
+			}
+			diffMembers(child, ma[name], mb[name], diffs)
+		}
+		return
+	}
+	la, okA := a.([]interface{})
+	lb, okB := b.([]interface{})
+	if okA && okB && len(la) == len(lb) {
+		for i := range la {
+			diffMembers(path+"["+strconv.Itoa(i)+"]", la[i], lb[i], diffs)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		*diffs = append(*diffs, path)
+	}
+}
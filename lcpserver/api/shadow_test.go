@@ -0,0 +1,91 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestCompareLicenses(t *testing.T) {
+	primary := `{"id":"l1","provider":"p","user":{"id":"u","email":"AAA","encrypted":["email"]},
+		"encryption":{"content_key":{"encrypted_value":"AAA","algorithm":"aes"}},
+		"links":[{"rel":"hint","href":"https://new/hint"},{"rel":"publication","href":"https://p"}],
+		"rights":{"print":10},"signature":{"value":"AAA"}}`
+	secondary := `{"id":"l1","provider":"p","user":{"id":"u","email":"BBB","encrypted":["email"]},
+		"encryption":{"content_key":{"encrypted_value":"BBB","algorithm":"aes"}},
+		"links":[{"rel":"hint","href":"https://old/hint"},{"rel":"publication","href":"https://p"}],
+		"rights":{"print":20,"copy":5},"signature":{"value":"BBB"}}`
+
+	diffs := compareLicenses([]byte(primary), []byte(secondary), shadowIgnored)
+	expected := []string{"links[0].href", "rights.copy", "rights.print"}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("Expected the differences %v, got %v", expected, diffs)
+	}
+	diffs = compareLicenses([]byte(primary), []byte(secondary), append(shadowIgnored, "links.href", "rights"))
+	if len(diffs) != 0 {
+		t.Errorf("Expected the ignored members not to be compared, got %v", diffs)
+	}
+	if diffs = compareLicenses([]byte("not found"), []byte("{}"), nil); len(diffs) != 1 {
+		t.Errorf("Expected a difference of the bodies, got %v", diffs)
+	}
+}
+
+func TestShadowed(t *testing.T) {
+	type replay struct {
+		method, uri, body, user string
+	}
+	replays := make(chan replay, 1)
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		user, _, _ := r.BasicAuth()
+		replays <- replay{r.Method, r.URL.RequestURI(), string(body), user}
+		w.Write([]byte(`{"id":"l1"}`))
+	}))
+	defer legacy.Close()
+
+	served := false
+	handler := Shadowed(func(w http.ResponseWriter, r *http.Request, s Server) {
+		body, _ := io.ReadAll(r.Body)
+		served = string(body) == `{"user_key":{}}`
+		w.Write([]byte(`{"id":"l1"}`))
+	})
+
+	// disabled
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/licenses/l1", strings.NewReader(`{"user_key":{}}`)), nil)
+	if !served {
+		t.Fatal("Expected the fetch to be served")
+	}
+	select {
+	case <-replays:
+		t.Fatal("Expected no replay while the shadow mode is disabled")
+	default:
+	}
+
+	config.Config.Shadow = config.Shadow{Url: legacy.URL + "/", Auth: config.Auth{Username: "legacy"}}
+	defer func() { config.Config.Shadow = config.Shadow{} }()
+	served = false
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/licenses/l1?x=1", strings.NewReader(`{"user_key":{}}`)), nil)
+	if !served || w.Body.String() != `{"id":"l1"}` {
+		t.Fatal("Expected the fetch to be served with the body of the request")
+	}
+	select {
+	case rep := <-replays:
+		expected := replay{"POST", "/licenses/l1?x=1", `{"user_key":{}}`, "legacy"}
+		if rep != expected {
+			t.Errorf("Expected the replay %v, got %v", expected, rep)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the fetch to be replayed against the secondary server")
+	}
+}
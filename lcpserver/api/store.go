@@ -28,19 +28,27 @@ package apilcp
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
 
 	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
 
 	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/audit"
+	"github.com/readium/readium-lcp-server/config"
 	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/jobs"
 	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/outbox"
 	"github.com/readium/readium-lcp-server/pack"
 	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/staging"
 	"github.com/readium/readium-lcp-server/storage"
 )
 
@@ -48,8 +56,13 @@ type Server interface {
 	Store() storage.Store
 	Index() index.Index
 	Licenses() license.Store
+	Outbox() outbox.Store
+	Audit() audit.Store
 	Certificate() *tls.Certificate
+	CertificateFor(provider string) *tls.Certificate
+	ForTenant(tenant string) Server
 	Source() *pack.ManualSource
+	Jobs() *jobs.Queue
 }
 
 // LcpPublication is a struct for communication with lcp-server
@@ -62,6 +75,35 @@ type LcpPublication struct {
 	ContentDisposition *string `json:"protected-content-disposition"`
 	ContentType        string  `json:"protected-content-type,omitempty"`
 	ErrorMessage       string  `json:"error,omitempty"`
+	// number of simultaneous loans of the content, unchanged if omitted
+	MaxConcurrentLoans *int `json:"max-concurrent-loans,omitempty"`
+	// descriptive fields of the content, unchanged if omitted
+	Title           string `json:"title,omitempty"`
+	Author          string `json:"author,omitempty"`
+	Language        string `json:"language,omitempty"`
+	PublicationDate string `json:"publication-date,omitempty"`
+	CoverUrl        string `json:"cover-url,omitempty"`
+	// checksum of the source publication, which identifies the duplicate contents
+	SourceSha256 string `json:"source-sha256,omitempty"`
+}
+
+// setContentMetadata sets the descriptive fields of a content which are given in a publication
+func setContentMetadata(c *index.Content, publication LcpPublication) {
+	if publication.Title != "" {
+		c.Title = publication.Title
+	}
+	if publication.Author != "" {
+		c.Author = publication.Author
+	}
+	if publication.Language != "" {
+		c.Language = publication.Language
+	}
+	if publication.PublicationDate != "" {
+		c.PublicationDate = publication.PublicationDate
+	}
+	if publication.CoverUrl != "" {
+		c.CoverUrl = publication.CoverUrl
+	}
 }
 
 func writeRequestFileToTemp(r io.Reader) (int64, *os.File, error) {
@@ -87,33 +129,27 @@ func cleanupTempFile(f *os.File) {
 	os.Remove(f.Name())
 }
 
-// StoreContent stores content in the storage
-// the content name is given in the url (name)
-// a temporary file is created, then deleted after the content has been stored
-//
-func StoreContent(w http.ResponseWriter, r *http.Request, s Server) {
-	vars := mux.Vars(r)
-
-	size, f, err := writeRequestFileToTemp(r.Body)
+// archiveContentFile copies the stored file of a content under the key of its version
+func archiveContentFile(c index.Content, s Server) error {
+	item, err := s.Store().Get(c.Id)
+	if errors.Is(err, storage.ErrNotFound) {
+		// no file to keep
+		return nil
+	} else if err != nil {
+		return err
+	}
+	contents, err := item.Contents()
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
-		return
+		return err
 	}
-
-	defer cleanupTempFile(f)
-
-	t := pack.NewTask(vars["name"], f, size)
-	result := s.Source().Post(t)
-
-	if result.Error != nil {
-		problem.Error(w, r, problem.Problem{Detail: result.Error.Error()}, http.StatusBadRequest)
-		return
+	_, file, err := writeRequestFileToTemp(contents)
+	contents.Close()
+	defer cleanupTempFile(file)
+	if err != nil {
+		return err
 	}
-
-	// must come *after* w.Header().Add()/Set(), but before w.Write()
-	w.WriteHeader(http.StatusCreated)
-
-	json.NewEncoder(w).Encode(result.Id)
+	_, err = storage.AddVerified(s.Store(), index.VersionKey(c.Id, c.Version), file, c.Sha256, "archive")
+	return err
 }
 
 // AddContent adds content to the storage
@@ -130,7 +166,8 @@ func AddContent(w http.ResponseWriter, r *http.Request, s Server) {
 	var publication LcpPublication
 	err := decoder.Decode(&publication)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		api.BodyError(w, r, err)
+		return
 	}
 	// get the content ID in the url
 	contentID := vars["content_id"]
@@ -138,31 +175,69 @@ func AddContent(w http.ResponseWriter, r *http.Request, s Server) {
 		problem.Error(w, r, problem.Problem{Detail: "The content id must be set in the url"}, http.StatusBadRequest)
 		return
 	}
-	// open the encrypted file, use its full path
-	file, err := os.Open(publication.Output)
-	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+	if publication.MaxConcurrentLoans != nil && *publication.MaxConcurrentLoans < 0 {
+		problem.Error(w, r, problem.Problem{Detail: "The number of concurrent loans must not be negative"}, http.StatusBadRequest)
 		return
 	}
-	// the input file will be deleted when the function returns
-	defer cleanupTempFile(file)
-
-	// add the file to the storage, named by contentID, without file extension
-	_, err = s.Store().Add(contentID, file)
+	// open the encrypted file: a local path, a file of the staging store or an http url
+	file, err := staging.Open(publication.Output)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
+	// the input file will be deleted when the function returns
+	defer func() {
+		staging.Close(publication.Output, file)
+		staging.Remove(publication.Output)
+	}()
 
-	// insert a row in the database if the content id does not already exist
-	// udpate the database with a new content key and file location if the content id already exists
+	// the content is inserted in the database if the content id does not already exist,
+	// updated with a new content key and file location if the content id already exists
 	var c index.Content
 	c, err = s.Index().Get(contentID)
-	if err != nil && err != index.NotFound {
+	if err != nil && !errors.Is(err, index.ErrNotFound) {
 		// unable to query db
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		return
 	}
+	// optimistic concurrency: the content must not have been modified since the caller read it;
+	// this is checked before the file is stored
+	ifMatch := r.Header.Get("If-Match")
+	etag := index.ETag(c)
+	if ifMatch != "" && (errors.Is(err, index.ErrNotFound) || !api.MatchETag(ifMatch, etag)) {
+		problem.Error(w, r, problem.Problem{Detail: index.ErrModified.Error()}, http.StatusPreconditionFailed)
+		return
+	}
+	notFound := errors.Is(err, index.ErrNotFound)
+	prev := c
+
+	// the content id is an alias of a content encrypted before from the same source
+	if !notFound && c.Id != contentID {
+		aliasContent(w, c)
+		return
+	}
+	// the source publication may have been encrypted before as another content
+	if notFound && publication.SourceSha256 != "" {
+		if dup, found, err := findDuplicate(publication.SourceSha256, contentID, s); err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+			return
+		} else if found {
+			switch config.Config.Packaging.Duplicates {
+			case "reject":
+				problem.Error(w, r, problem.Problem{Type: problem.DUPLICATE_CONTENT, Instance: dup.Id,
+					Detail: "The publication has already been encrypted as the content " + dup.Id}, http.StatusConflict)
+				return
+			case "alias":
+				if err = s.Index().AddAlias(contentID, dup.Id); err != nil {
+					api.StoreError(w, r, err)
+					return
+				}
+				log.Println("Content", contentID, "is an alias of the content", dup.Id)
+				aliasContent(w, dup)
+				return
+			}
+		}
+	}
 
 	// set the encryption key (c.EncryptionKey)
 	c.EncryptionKey = publication.ContentKey
@@ -177,45 +252,127 @@ func AddContent(w http.ResponseWriter, r *http.Request, s Server) {
 		return
 	}
 
+	// a new file makes a new version of the content: the file of the previous version
+	// is kept for the licenses issued for it
+	if !notFound && index.IsNewVersion(prev, c) {
+		err = archiveContentFile(prev, s)
+		if err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// the file is first stored under a pending key: the file of the content is only replaced
+	// once the content is updated; the file must have the checksum given by the caller
+	uid, err := uuid.NewV4()
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	pending := contentID + ".pending-" + uid.String()
+	_, err = storage.AddVerified(s.Store(), pending, file, c.Sha256, "upload")
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	defer s.Store().Remove(pending)
+
+	if publication.MaxConcurrentLoans != nil {
+		c.MaxConcurrentLoans = *publication.MaxConcurrentLoans
+	}
+	setContentMetadata(&c, publication)
+	if publication.SourceSha256 != "" {
+		c.SourceSha256 = publication.SourceSha256
+	}
+
 	//todo check hash & length?
 
-	code := http.StatusCreated
-	if err == index.NotFound { //insert into database
-		c.Id = contentID
-		err = s.Index().Add(c)
-	} else { //update the encryption key for c.Id = publication.ContentId
-		err = s.Index().Update(c)
-		code = http.StatusOK
+	code := http.StatusOK
+	c.Id = contentID
+	if ifMatch != "" { //update the content if it was not modified meanwhile
+		err = s.Index().UpdateIfMatch(c, etag)
+	} else { //insert or update the content, a repeated notification does not fail
+		var created bool
+		created, err = s.Index().Upsert(c)
+		if created {
+			code = http.StatusCreated
+		}
+	}
+	if errors.Is(err, index.ErrModified) {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusPreconditionFailed)
+		return
+	} else if err != nil { //if db not updated
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	// add the file to the storage, named by contentID, without file extension
+	if _, err = file.Seek(0, io.SeekStart); err == nil {
+		_, err = storage.AddVerified(s.Store(), contentID, file, c.Sha256, "upload")
 	}
-	if err != nil { //if db not updated
+	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		return
 	}
 
-	// set the response http code
+	// set the response http code, with the new entity tag of the content
+	w.Header().Set("ETag", index.ETag(c))
 	w.WriteHeader(code)
 	return
 
 }
 
+// findDuplicate returns a content, other than the given one, encrypted from the same source
+func findDuplicate(sourceSha256 string, contentID string, s Server) (index.Content, bool, error) {
+	contents, err := s.Index().ListBySourceHash(sourceSha256)
+	if err != nil {
+		return index.Content{}, false, err
+	}
+	for _, c := range contents {
+		if c.Id != contentID {
+			return c, true, nil
+		}
+	}
+	return index.Content{}, false, nil
+}
+
+// aliasContent answers the notification of a duplicate content: the encrypted file is not stored,
+// and the content it stands for is given in the Content-Location header
+func aliasContent(w http.ResponseWriter, c index.Content) {
+	w.Header().Set("Content-Location", "/contents/"+c.Id)
+	w.Header().Set("ETag", index.ETag(c))
+	w.WriteHeader(http.StatusOK)
+}
+
 // ListContents lists the content in the storage index
+// parameters (all the contents are listed by default):
+// 	page: page number
+//	per_page: number of items par page
+//	sort: id, title, author, language, publication_date, length or version,
+//	prefixed by "-" for a descending order (default id)
+//	fields: comma separated fields of the contents to return
 //
 func ListContents(w http.ResponseWriter, r *http.Request, s Server) {
-	fn := s.Index().List()
+	params, err := api.ParseListParams(r, 0)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	if params.After != "" {
+		problem.Error(w, r, problem.Problem{Detail: "The contents are listed by page"}, http.StatusBadRequest)
+		return
+	}
+	fn := s.Index().ListContents("", params.Listing())
 	contents := make([]index.Content, 0)
 
-	for it, err := fn(); err == nil; it, err = fn() {
+	it, err := fn()
+	for ; err == nil; it, err = fn() {
 		contents = append(contents, it)
 	}
-
-	w.Header().Set("Content-Type", api.ContentType_JSON)
-	enc := json.NewEncoder(w)
-	err := enc.Encode(contents)
-	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+	if !errors.Is(err, index.ErrNotFound) {
+		api.StoreError(w, r, err)
 		return
 	}
-
+	api.WriteList(w, r, contents, params.PageLinks(r, len(contents)), params.Fields)
 }
 
 // GetContent fetches and returns an encrypted content file
@@ -225,39 +382,108 @@ func GetContent(w http.ResponseWriter, r *http.Request, s Server) {
 	// get the content id from the calling url
 	vars := mux.Vars(r)
 	contentID := vars["content_id"]
-	content, err := s.Index().Get(contentID)
-	if err != nil { //item probably not found
-		if err == index.NotFound {
-			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
-		} else {
-			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+	serveContent(w, r, s, contentID)
+}
+
+// getStoredContent returns the content whose file is stored under a key:
+// a content id, or the key of a previous version of a content
+//
+func getStoredContent(key string, s Server) (index.Content, error) {
+	content, err := s.Index().Get(key)
+	if !errors.Is(err, index.ErrNotFound) {
+		return content, err
+	}
+	if id, version, ok := index.ParseVersionKey(key); ok {
+		content, err = s.Index().GetVersion(id, version)
+		if err == nil && !content.Archived {
+			return index.Content{}, index.ErrNotFound
 		}
+	}
+	return content, err
+}
+
+// ListContentVersions lists the versions of a content, the previous ones first
+//
+func ListContentVersions(w http.ResponseWriter, r *http.Request, s Server) {
+	vars := mux.Vars(r)
+	versions, err := s.Index().ListVersions(vars["content_id"])
+	if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(versions)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+}
+
+// serveContent returns an encrypted content file, or a range of it
+//
+func serveContent(w http.ResponseWriter, r *http.Request, s Server, contentID string) {
+	content, err := getStoredContent(contentID, s)
+	if err != nil { //item probably not found
+		api.StoreError(w, r, err)
 		return
 	}
 	// check the existence of the file
 	item, err := s.Store().Get(contentID)
 	if err != nil { //item probably not found
-		if err == storage.ErrNotFound {
-			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
-		} else {
-			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
-		}
+		api.StoreError(w, r, err)
+		return
+	}
+	etag := index.ETag(content)
+
+	// a single byte range may be requested, e.g. to resume a download;
+	// with If-Range, the range is ignored if the content has changed
+	start, length, partial, err := api.ParseRange(r.Header.Get("Range"), content.Length)
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != etag {
+		partial, err = false, nil
+	}
+	if err == api.ErrRangeNotSatisfiable {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", content.Length))
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusRequestedRangeNotSatisfiable)
 		return
 	}
+
 	// opens the file
-	contentReadCloser, err := item.Contents()
-	defer contentReadCloser.Close()
+	var contentReadCloser io.ReadCloser
+	if partial {
+		contentReadCloser, err = item.ContentsRange(start, length)
+	} else {
+		contentReadCloser, err = item.Contents()
+	}
 	if err != nil { //file probably not found
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
+	defer contentReadCloser.Close()
 	// set headers
 	w.Header().Set("Content-Disposition", "attachment; filename="+content.Location)
 	w.Header().Set("Content-Type", content.Type)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", content.Length))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", etag)
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, content.Length))
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", content.Length))
+	}
 
-	// returns the content of the file to the caller
-	io.Copy(w, contentReadCloser)
+	// returns the content of the file to the caller; the checksum of a complete file is verified
+	// while it is sent, and the last byte of a corrupted file is not sent, so that the transfer fails
+	var reader io.Reader = contentReadCloser
+	if !partial {
+		reader = storage.NewVerifyingReader(contentReadCloser, content.Sha256)
+	}
+	_, err = io.Copy(w, reader)
+	if err == storage.ErrChecksumMismatch {
+		storage.Corrupted.Add("download", 1)
+		log.Println("Integrity error: the stored file of the content", contentID, "is corrupted")
+	}
 
 	return
 
@@ -0,0 +1,283 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/storage"
+)
+
+func TestContentMetadata(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+
+	c := index.Content{Id: "c1", EncryptionKey: []byte("key"), Location: "c1.epub"}
+	setContentMetadata(&c, LcpPublication{Title: "Moby Dick", Author: "Herman Melville", Language: "en",
+		PublicationDate: "1851-10-18", CoverUrl: "https://example.com/c1.jpg"})
+	if err := s.idx.Add(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// the fields omitted by an update are unchanged
+	c, err := s.idx.Get("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setContentMetadata(&c, LcpPublication{Title: "Moby-Dick; or, The Whale"})
+	if err = s.idx.Update(c); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = s.idx.Get("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Title != "Moby-Dick; or, The Whale" || c.Author != "Herman Melville" || c.Language != "en" ||
+		c.PublicationDate != "1851-10-18" || c.CoverUrl != "https://example.com/c1.jpg" {
+		t.Errorf("Unexpected content metadata %+v", c)
+	}
+
+	// the title of the content is the title of the publication link
+	l := license.License{Id: "l1", ContentId: "c1"}
+	license.SetLicenseLinks(&l, c)
+	for _, link := range l.Links {
+		if link.Rel == "publication" && link.Title != c.Title {
+			t.Errorf("Expected the publication link to have the title of the content, got %s", link.Title)
+		}
+	}
+}
+
+func TestContentVersions(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+
+	if err := s.idx.Add(index.Content{Id: "c1", EncryptionKey: []byte("key1"), Location: "c1.epub", Sha256: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.idx.Get("c1")
+	if err != nil || c.Version != 1 {
+		t.Fatalf("Expected the first version of the content, got %d (%v)", c.Version, err)
+	}
+	// an update which does not replace the file keeps the version
+	c.MaxConcurrentLoans = 3
+	if err = s.idx.Update(c); err != nil {
+		t.Fatal(err)
+	}
+	c.EncryptionKey, c.Sha256 = []byte("key2"), "2"
+	if err = s.idx.Update(c); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := s.idx.ListVersions("c1")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Expected 2 versions, got %d (%v)", len(versions), err)
+	}
+	if !versions[0].Archived || versions[0].Version != 1 || string(versions[0].EncryptionKey) != "key1" ||
+		versions[1].Archived || versions[1].Version != 2 || string(versions[1].EncryptionKey) != "key2" {
+		t.Errorf("Unexpected versions %+v", versions)
+	}
+
+	// a license issued for the first version keeps its key and file
+	old, err := s.idx.GetVersion("c1", 1)
+	if err != nil || string(old.EncryptionKey) != "key1" || old.MaxConcurrentLoans != 3 {
+		t.Errorf("Unexpected first version %+v (%v)", old, err)
+	}
+	if key := index.StorageKey(old); key != "c1.v1" {
+		t.Errorf("Unexpected storage key %s", key)
+	}
+	if c, err = getStoredContent("c1.v1", s); err != nil || c.Version != 1 {
+		t.Errorf("Expected the first version to be served, got %+v (%v)", c, err)
+	}
+	if _, err = getStoredContent("c1.v2", s); !errors.Is(err, index.ErrNotFound) {
+		t.Errorf("Expected the current version not to be served as a previous one, got %v", err)
+	}
+	if _, err = s.idx.GetVersion("c1", 3); !errors.Is(err, index.ErrNotFound) {
+		t.Errorf("Expected an unknown version not to be found, got %v", err)
+	}
+}
+
+func TestContentUpsert(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+
+	c := index.Content{Id: "c1", EncryptionKey: []byte("key1"), Location: "c1.epub", Sha256: "1"}
+	if created, err := s.idx.Upsert(c); err != nil || !created {
+		t.Fatalf("Expected the content to be created, got %v (%v)", created, err)
+	}
+	// a repeated notification updates the content, without a new version
+	if created, err := s.idx.Upsert(c); err != nil || created {
+		t.Fatalf("Expected the content to be updated, got %v (%v)", created, err)
+	}
+	if c, err := s.idx.Get("c1"); err != nil || c.Version != 1 {
+		t.Errorf("Expected the first version, got %+v (%v)", c, err)
+	}
+	// a new file makes a new version
+	c.EncryptionKey, c.Sha256 = []byte("key2"), "2"
+	if created, err := s.idx.Upsert(c); err != nil || created {
+		t.Fatalf("Expected the content to be updated, got %v (%v)", created, err)
+	}
+	if c, err := s.idx.Get("c1"); err != nil || c.Version != 2 {
+		t.Errorf("Expected the second version, got %+v (%v)", c, err)
+	}
+
+	// a tenant does not update the content of another tenant
+	if _, err := index.ForTenant(s.idx, "t1").Upsert(c); !errors.Is(err, index.ErrConflict) {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+}
+
+// notifyContent notifies the encryption of a publication as a content
+func notifyContent(t *testing.T, s Server, contentID string, sourceSha256 string) *httptest.ResponseRecorder {
+	f, err := ioutil.TempFile("", "lcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	name, size, checksum := contentID+".epub", int64(0), ""
+	body, _ := json.Marshal(LcpPublication{ContentKey: []byte("key"), Output: f.Name(), Size: &size, Checksum: &checksum,
+		ContentDisposition: &name, SourceSha256: sourceSha256})
+	r := httptest.NewRequest("PUT", "/contents/"+contentID, bytes.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"content_id": contentID})
+	w := httptest.NewRecorder()
+	AddContent(w, r, s)
+	return w
+}
+
+func TestContentDuplicates(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+	defer func() { config.Config.Packaging.Duplicates = "" }()
+	if err := s.idx.Add(index.Content{Id: "c1", EncryptionKey: []byte("key"), Location: "c1.epub", SourceSha256: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Config.Packaging.Duplicates = "reject"
+	w := notifyContent(t, s, "c2", "abc")
+	var p problem.Problem
+	json.NewDecoder(w.Body).Decode(&p)
+	if w.Code != http.StatusConflict || p.Type != problem.DUPLICATE_CONTENT || p.Instance != "c1" {
+		t.Errorf("Expected the duplicate to be rejected, got %d %+v", w.Code, p)
+	}
+
+	config.Config.Packaging.Duplicates = "alias"
+	if w = notifyContent(t, s, "c2", "abc"); w.Code != http.StatusOK || w.Header().Get("Content-Location") != "/contents/c1" {
+		t.Errorf("Expected the duplicate to be an alias, got %d %s", w.Code, w.Header().Get("Content-Location"))
+	}
+	// the alias stands for the content, also when notified again
+	if c, err := s.idx.Get("c2"); err != nil || c.Id != "c1" {
+		t.Errorf("Expected the alias to return the content, got %+v (%v)", c, err)
+	}
+	if w = notifyContent(t, s, "c2", "def"); w.Code != http.StatusOK || w.Header().Get("Content-Location") != "/contents/c1" {
+		t.Errorf("Expected the alias to be kept, got %d", w.Code)
+	}
+	if versions, err := s.idx.ListVersions("c2"); err != nil || len(versions) != 1 || versions[0].Id != "c1" {
+		t.Errorf("Unexpected versions of the alias %+v (%v)", versions, err)
+	}
+
+	// a tenant does not see the contents of another tenant
+	if dups, err := index.ForTenant(s.idx, "t1").ListBySourceHash("abc"); err != nil || len(dups) != 0 {
+		t.Errorf("Expected no duplicate for another tenant, got %+v (%v)", dups, err)
+	}
+}
+
+// racingStore modifies a content while its new file is stored
+type racingStore struct {
+	storage.Store
+	modify func()
+}
+
+func (s racingStore) Add(key string, r io.ReadSeeker) (storage.Item, error) {
+	if strings.Contains(key, ".pending-") {
+		s.modify()
+	}
+	return s.Store.Add(key, r)
+}
+
+func TestContentIfMatch(t *testing.T) {
+	s, closeDB := newLoanServer(t)
+	defer closeDB()
+	dir, err := ioutil.TempDir("", "lcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := storage.NewFileSystem(dir, "")
+	if _, err = fs.Add("c1", strings.NewReader("v1")); err != nil {
+		t.Fatal(err)
+	}
+	c := index.Content{Id: "c1", EncryptionKey: []byte("key1"), Location: "c1.epub"}
+	if err = s.idx.Add(c); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = s.idx.Get("c1"); err != nil {
+		t.Fatal(err)
+	}
+	etag := index.ETag(c)
+	// the content is modified by another request after the If-Match header is checked
+	s.st = racingStore{Store: fs, modify: func() {
+		m := c
+		m.Title = "Moby Dick"
+		m.Location = "moby-dick.epub"
+		if err := s.idx.Update(m); err != nil {
+			t.Fatal(err)
+		}
+	}}
+
+	f, err := ioutil.TempFile("", "lcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("v2")
+	f.Close()
+	name, size, checksum := "c1.epub", int64(2), ""
+	body, _ := json.Marshal(LcpPublication{ContentKey: []byte("key2"), Output: f.Name(), Size: &size, Checksum: &checksum,
+		ContentDisposition: &name})
+	r := httptest.NewRequest("PUT", "/contents/c1", bytes.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"content_id": "c1"})
+	r.Header.Set("If-Match", etag)
+	w := httptest.NewRecorder()
+	AddContent(w, r, s)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected the update to fail, got %d %s", w.Code, w.Body.String())
+	}
+
+	// the file of the content is unchanged, and the new file is not kept
+	item, err := fs.Get("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := item.Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(data) != "v1" {
+		t.Errorf("Expected the stored file to be unchanged, got %s", data)
+	}
+	items, err := fs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if strings.Contains(item.Key(), ".pending-") {
+			t.Errorf("Expected the new file to be removed, got %s", item.Key())
+		}
+	}
+}
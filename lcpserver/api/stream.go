@@ -0,0 +1,61 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/streamer"
+)
+
+// StreamResource returns a resource of a protected publication, decrypted on the fly.
+// This route is only accessible to trusted internal services: the clear content
+// must never be exposed to the public.
+//
+func StreamResource(w http.ResponseWriter, r *http.Request, s Server) {
+	vars := mux.Vars(r)
+	contentID := vars["content_id"]
+	resourcePath := vars["path"]
+
+	content, err := s.Index().Get(contentID)
+	if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	// the stored file is read as the zip file is read, not in memory
+	zr, err := openStoredPublication(content, s, "stream")
+	if err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+
+	publication, err := streamer.Open(zr, content.EncryptionKey)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	resource, rc, err := publication.Open(resourcePath)
+	if err != nil {
+		if err == streamer.ErrResourceNotFound {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+	defer rc.Close()
+
+	if resource.ContentType != "" {
+		w.Header().Set("Content-Type", resource.ContentType)
+	}
+	// the clear content must not be stored by intermediate caches
+	w.Header().Set("Cache-Control", "private, no-store")
+	io.Copy(w, rc)
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"log"
+	"time"
+
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/pack"
+)
+
+// findLicenseTemplate returns the first license template which applies to a content, nil if none does;
+// the metadata of the content are only read if a template selects collections
+//
+func findLicenseTemplate(content index.Content, s Server) *config.LicenseTemplate {
+	templates := config.Config.License.Templates
+	var collection string
+	metadataRead := false
+	for i := range templates {
+		if len(templates[i].Collections) > 0 && !metadataRead {
+			if m, err := s.Index().GetMetadata(content.Id); err == nil {
+				collection = m.Collection
+			}
+			metadataRead = true
+		}
+		if templateMatches(templates[i], content.Type, collection) {
+			return &templates[i]
+		}
+	}
+	return nil
+}
+
+// templateMatches checks a content against a template; a template which sets content types
+// and collections selects the contents matching both
+//
+func templateMatches(t config.LicenseTemplate, contentType string, collection string) bool {
+	if len(t.ContentTypes) > 0 {
+		matched := false
+		for _, mediaRange := range t.ContentTypes {
+			if pack.MediaTypeMatches(mediaRange, contentType) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(t.Collections) > 0 {
+		for _, c := range t.Collections {
+			if c == collection && collection != "" {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// applyLicenseTemplate sets the fields omitted by a partial license from the template of its content
+//
+func applyLicenseTemplate(lic *license.License, contentID string, s Server) {
+	content, err := s.Index().Get(contentID)
+	if err != nil {
+		// a missing content is reported when the license is built
+		return
+	}
+	if t := findLicenseTemplate(content, s); t != nil {
+		log.Println("Apply the license template", t.Name, "to the content", contentID)
+		applyTemplateDefaults(lic, *t, clock.Now())
+	}
+}
+
+// applyTemplateDefaults sets the user hint and the rights omitted by a partial license;
+// the end of the rights is computed from their start, or from now
+//
+func applyTemplateDefaults(lic *license.License, t config.LicenseTemplate, now time.Time) {
+	if lic.Encryption.UserKey.Hint == "" {
+		lic.Encryption.UserKey.Hint = t.Hint
+	}
+	if t.Print == nil && t.Copy == nil && t.Days == 0 {
+		return
+	}
+	if lic.Rights == nil {
+		lic.Rights = new(license.UserRights)
+	}
+	if lic.Rights.Print == nil && t.Print != nil {
+		p := *t.Print
+		lic.Rights.Print = &p
+	}
+	if lic.Rights.Copy == nil && t.Copy != nil {
+		c := *t.Copy
+		lic.Rights.Copy = &c
+	}
+	if lic.Rights.End == nil && t.Days > 0 {
+		start := now
+		if lic.Rights.Start != nil {
+			start = *lic.Rights.Start
+		}
+		end := start.Add(24 * time.Hour * time.Duration(t.Days))
+		lic.Rights.End = &end
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license"
+)
+
+func TestTemplateMatches(t *testing.T) {
+	audio := config.LicenseTemplate{Name: "audiobooks", ContentTypes: []string{"audio/*", "application/audiobook+lcp"}}
+	series := config.LicenseTemplate{Name: "series", ContentTypes: []string{"application/epub+zip"}, Collections: []string{"Discworld"}}
+	tests := []struct {
+		template    config.LicenseTemplate
+		contentType string
+		collection  string
+		expected    bool
+	}{
+		{audio, "application/audiobook+lcp", "", true},
+		{audio, "audio/mpeg", "", true},
+		{audio, "application/epub+zip", "", false},
+		{series, "application/epub+zip", "Discworld", true},
+		{series, "application/epub+zip", "", false},
+		{series, "application/pdf+lcp", "Discworld", false},
+		{config.LicenseTemplate{Name: "default"}, "application/pdf+lcp", "", true},
+	}
+	for _, test := range tests {
+		if m := templateMatches(test.template, test.contentType, test.collection); m != test.expected {
+			t.Errorf("Template %s, %s %q: expected %v", test.template.Name, test.contentType, test.collection, test.expected)
+		}
+	}
+}
+
+func TestApplyTemplateDefaults(t *testing.T) {
+	printRight, copyRight := int32(0), int32(100)
+	tpl := config.LicenseTemplate{Name: "audiobooks", Print: &printRight, Copy: &copyRight, Days: 21, Hint: "Your library card number"}
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var lic license.License
+	applyTemplateDefaults(&lic, tpl, now)
+	if lic.Encryption.UserKey.Hint != tpl.Hint || lic.Rights == nil || *lic.Rights.Print != 0 || *lic.Rights.Copy != 100 {
+		t.Fatalf("Unexpected defaults %+v %+v", lic.Encryption.UserKey, lic.Rights)
+	}
+	if !lic.Rights.End.Equal(now.Add(21 * 24 * time.Hour)) {
+		t.Errorf("Unexpected end %s", lic.Rights.End)
+	}
+
+	// the fields of the partial license are kept
+	start := now.Add(24 * time.Hour)
+	ownCopy := int32(5)
+	lic = license.License{Rights: &license.UserRights{Start: &start, Copy: &ownCopy}}
+	lic.Encryption.UserKey.Hint = "Your password"
+	applyTemplateDefaults(&lic, tpl, now)
+	if lic.Encryption.UserKey.Hint != "Your password" || *lic.Rights.Copy != 5 || *lic.Rights.Print != 0 {
+		t.Errorf("Unexpected license %+v %+v", lic.Encryption.UserKey, lic.Rights)
+	}
+	if !lic.Rights.End.Equal(start.Add(21 * 24 * time.Hour)) {
+		t.Errorf("Expected the end to follow the start, got %s", lic.Rights.End)
+	}
+}
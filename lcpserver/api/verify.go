@@ -0,0 +1,192 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/lcpverify/verify"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/sign"
+)
+
+// the steps of the verdict on a license, after the steps of the verification of its signature
+const (
+	StepIssuer = "issuer"
+	StepStored = "stored record"
+	StepRights = "rights"
+)
+
+// LicenseVerdict is the verdict on a license document, e.g. sent by a reader whose book does not open:
+// its signature, its certificate, its match with the stored license and the drift of its rights
+type LicenseVerdict struct {
+	LicenseId string        `json:"license_id,omitempty"`
+	OK        bool          `json:"ok"`
+	Steps     []verify.Step `json:"steps"`
+	Drift     []RightsDrift `json:"rights_drift,omitempty"`
+}
+
+// RightsDrift is a right, or the update date, of a license document which differs from the stored license
+type RightsDrift struct {
+	Field   string `json:"field"`
+	License string `json:"license"`
+	Stored  string `json:"stored"`
+}
+
+func (v *LicenseVerdict) pass(name, detail string) {
+	v.Steps = append(v.Steps, verify.Step{Name: name, OK: true, Detail: detail})
+}
+
+func (v *LicenseVerdict) fail(name, detail string) {
+	v.Steps = append(v.Steps, verify.Step{Name: name, Detail: detail})
+}
+
+// VerifyLicense checks a license document and returns a verdict: the signature is valid,
+// the certificate is issued by the root of the chain of the certificate of the provider and is a certificate
+// of this server, the license matches the stored one and its rights are up to date.
+//
+func VerifyLicense(w http.ResponseWriter, r *http.Request, s Server) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		api.BodyError(w, r, err)
+		return
+	}
+	verdict := verifyLicense(data, s)
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(verdict)
+}
+
+// verifyLicense returns the verdict on a license document
+func verifyLicense(data []byte, s Server) *LicenseVerdict {
+	// the provider of the document selects the certificate, and the root of its chain
+	var head struct {
+		Provider string `json:"provider"`
+	}
+	json.Unmarshal(data, &head)
+	cert := s.CertificateFor(head.Provider)
+
+	report, l := verify.CheckSignature(data, rootOf(cert))
+	verdict := &LicenseVerdict{LicenseId: report.LicenseId, Steps: report.Steps}
+	if l != nil {
+		checkIssuer(verdict, l, cert)
+		if stored, ok := checkStored(verdict, l, s); ok {
+			checkRightsDrift(verdict, l, stored)
+		}
+	}
+	verdict.OK = true
+	for _, step := range verdict.Steps {
+		verdict.OK = verdict.OK && step.OK
+	}
+	return verdict
+}
+
+// rootOf returns the root certificate of the chain of a certificate, if the chain includes it
+func rootOf(cert *tls.Certificate) *x509.CertPool {
+	if cert == nil || len(cert.Certificate) < 2 {
+		return nil
+	}
+	root, err := x509.ParseCertificate(cert.Certificate[len(cert.Certificate)-1])
+	if err != nil || root.CheckSignatureFrom(root) != nil {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(root)
+	return pool
+}
+
+// checkIssuer checks that a license is signed by the certificate of its provider, or by the next certificate
+// of its key rotation
+func checkIssuer(verdict *LicenseVerdict, l *license.License, cert *tls.Certificate) {
+	fingerprint := sign.FingerprintOf(l.Signature.Certificate)
+	rotation := sign.RotationOf(cert)
+	switch fingerprint {
+	case sign.Fingerprint(rotation.Current):
+		verdict.pass(StepIssuer, "signed with the certificate "+fingerprint)
+	case sign.Fingerprint(rotation.Next):
+		verdict.pass(StepIssuer, "signed with the next certificate "+fingerprint)
+	default:
+		verdict.fail(StepIssuer, "the certificate "+fingerprint+" does not sign the licenses of "+l.Provider+" on this server")
+	}
+}
+
+// checkStored checks that a license matches the license stored by the server, which is returned
+func checkStored(verdict *LicenseVerdict, l *license.License, s Server) (license.License, bool) {
+	stored, err := s.Licenses().Get(l.Id)
+	if err != nil {
+		verdict.fail(StepStored, err.Error())
+		return stored, false
+	}
+	var mismatch []string
+	if l.Provider != stored.Provider {
+		mismatch = append(mismatch, "provider")
+	}
+	if l.User.Id != stored.User.Id {
+		mismatch = append(mismatch, "user id")
+	}
+	if !l.Issued.Equal(stored.Issued) {
+		mismatch = append(mismatch, "issue date")
+	}
+	if len(mismatch) > 0 {
+		detail := "the license differs from the stored license:"
+		for _, m := range mismatch {
+			detail += " " + m
+		}
+		verdict.fail(StepStored, detail)
+		return stored, false
+	}
+	verdict.pass(StepStored, "content "+stored.ContentId)
+	return stored, true
+}
+
+// checkRightsDrift compares the rights and the update date of a license with the stored license:
+// a reading system with an outdated license gets a fresh one through the status document
+func checkRightsDrift(verdict *LicenseVerdict, l *license.License, stored license.License) {
+	var rights, storedRights license.UserRights
+	if l.Rights != nil {
+		rights = *l.Rights
+	}
+	if stored.Rights != nil {
+		storedRights = *stored.Rights
+	}
+	drift := func(field, value, storedValue string) {
+		if value != storedValue {
+			verdict.Drift = append(verdict.Drift, RightsDrift{Field: field, License: value, Stored: storedValue})
+		}
+	}
+	drift("print", formatCount(rights.Print), formatCount(storedRights.Print))
+	drift("copy", formatCount(rights.Copy), formatCount(storedRights.Copy))
+	drift("start", formatDate(rights.Start), formatDate(storedRights.Start))
+	drift("end", formatDate(rights.End), formatDate(storedRights.End))
+	drift("updated", formatDate(l.Updated), formatDate(stored.Updated))
+	if len(verdict.Drift) > 0 {
+		verdict.fail(StepRights, "the license is outdated, the reading system should fetch a fresh license through its status document")
+		return
+	}
+	verdict.pass(StepRights, "up to date")
+}
+
+func formatCount(n *int32) string {
+	if n == nil {
+		return "unlimited"
+	}
+	return strconv.Itoa(int(*n))
+}
+
+func formatDate(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/lcpverify/verify"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/testsupport"
+)
+
+// certServer signs the licenses with a certificate
+type certServer struct {
+	loanServer
+	cert *tls.Certificate
+}
+
+func (s certServer) CertificateFor(provider string) *tls.Certificate { return s.cert }
+
+func TestVerifyLicense(t *testing.T) {
+	ls, closeDB := newLoanServer(t)
+	defer closeDB()
+	ca, err := testsupport.NewCA(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.ProviderCertificate("http://example.com", testsupport.ECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := certServer{ls, cert}
+	end := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	if err = borrow(s, "l1", "u1", &end); err != nil {
+		t.Fatal(err)
+	}
+	signed := func(cert *tls.Certificate) []byte {
+		l, err := s.lst.Get("l1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = license.SignLicense(&l, cert); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(l)
+		return data
+	}
+	post := func(data []byte) LicenseVerdict {
+		w := httptest.NewRecorder()
+		VerifyLicense(w, httptest.NewRequest("POST", "/licenses/verify", bytes.NewReader(data)), s)
+		var v LicenseVerdict
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d", w.Code)
+		}
+		json.NewDecoder(w.Body).Decode(&v)
+		return v
+	}
+	failed := func(v LicenseVerdict) string {
+		for _, step := range v.Steps {
+			if !step.OK {
+				return step.Name
+			}
+		}
+		return ""
+	}
+
+	data := signed(cert)
+	if v := post(data); !v.OK || v.LicenseId != "l1" || len(v.Steps) != 6 {
+		t.Errorf("Expected a valid license, got %+v", v)
+	}
+	// a license modified after its signature
+	tampered := bytes.Replace(data, []byte(`"u1"`), []byte(`"u2"`), 1)
+	if v := post(tampered); v.OK || failed(v) != verify.StepSignature {
+		t.Errorf("Expected an invalid signature, got %+v", v)
+	}
+	// a license signed by another provider
+	other, err := ca.ProviderCertificate("http://other.example.com", testsupport.ECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := post(signed(other)); v.OK || failed(v) != StepIssuer {
+		t.Errorf("Expected an unknown certificate, got %+v", v)
+	}
+	// a license whose rights were extended since it was delivered
+	l, _ := s.lst.Get("l1")
+	extended := end.Add(24 * time.Hour)
+	updated := time.Now().UTC().Truncate(time.Second)
+	l.Rights.End, l.Updated = &extended, &updated
+	if err = s.lst.Update(l); err != nil {
+		t.Fatal(err)
+	}
+	v := post(data)
+	if v.OK || failed(v) != StepRights || len(v.Drift) != 2 || v.Drift[0].Field != "end" || v.Drift[1].Field != "updated" {
+		t.Errorf("Expected the rights to drift, got %+v", v)
+	}
+	// a license unknown to the server
+	unknown := license.License{Id: "l2", Provider: "http://example.com", Issued: time.Now().UTC().Truncate(time.Second)}
+	if err = license.SignLicense(&unknown, cert); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = json.Marshal(unknown)
+	if v = post(data); v.OK || failed(v) != StepStored {
+		t.Errorf("Expected no stored license, got %+v", v)
+	}
+	if v = post([]byte("not a license")); v.OK || failed(v) != verify.StepParse {
+		t.Errorf("Expected a parse error, got %+v", v)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/sign"
+)
+
+// a certificate expiring within this delay is reported as a warning
+const certificateExpiryWarning = 30 * 24 * time.Hour
+
+// configReport collects the results of the configuration check
+type configReport struct {
+	lines    []string
+	failures int
+}
+
+func (r *configReport) ok(check string) {
+	r.lines = append(r.lines, "OK    "+check)
+}
+
+func (r *configReport) warn(check, msg string) {
+	r.lines = append(r.lines, "WARN  "+check+": "+msg)
+}
+
+func (r *configReport) fail(check, msg string) {
+	r.lines = append(r.lines, "FAIL  "+check+": "+msg)
+	r.failures++
+}
+
+// checkConfig validates the configuration, the connection to the databases and the certificates,
+// prints a report and returns the exit code of the process: 0 if no check failed.
+//
+func checkConfig(configFile string) int {
+	report := &configReport{}
+	report.ok("config file " + configFile + " read")
+
+	if err := config.Validate(config.LcpServerName); err != nil {
+		if problems, ok := err.(config.ValidationError); ok {
+			for _, p := range problems {
+				report.fail("config", p)
+			}
+		} else {
+			report.fail("config", err.Error())
+		}
+	} else {
+		report.ok("config valid")
+	}
+
+	dbURI := config.Config.LcpServer.Database
+	if dbURI == "" {
+		dbURI = "sqlite3://file:lcp.sqlite?cache=shared&mode=rwc"
+	}
+	checkDatabase(report, "database", dbURI)
+	if replica := config.Config.LcpServer.ReplicaDatabase; replica != "" {
+		checkDatabase(report, "replica database", replica)
+	}
+
+	checkCertificate(report, "certificate", config.Config.Certificate)
+	checkNextCertificate(report, "next certificate", config.Config.Certificate.Next)
+	for _, t := range config.Config.Tenants {
+		if t.Certificate.Cert != "" {
+			checkCertificate(report, "certificate of tenant "+t.Id, t.Certificate)
+			checkNextCertificate(report, "next certificate of tenant "+t.Id, t.Certificate.Next)
+		}
+	}
+	for _, pc := range config.Config.ProviderCerts {
+		checkCertificate(report, "certificate of provider "+pc.Provider, config.Certificate{Cert: pc.Cert, PrivateKey: pc.PrivateKey, Chain: pc.Chain})
+		checkNextCertificate(report, "next certificate of provider "+pc.Provider, pc.Next)
+	}
+
+	for _, line := range report.lines {
+		fmt.Println(line)
+	}
+	if report.failures > 0 {
+		fmt.Println(strconv.Itoa(report.failures) + " check(s) failed")
+		return 1
+	}
+	fmt.Println("Configuration OK")
+	return 0
+}
+
+// checkDatabase opens a database and pings it
+func checkDatabase(report *configReport, check, uri string) {
+	if !strings.Contains(uri, "://") {
+		report.fail(check, "invalid uri")
+		return
+	}
+	driver, cnxn := dbFromURI(uri)
+	db, err := sql.Open(driver, cnxn)
+	if err != nil {
+		report.fail(check, err.Error())
+		return
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = db.PingContext(ctx); err != nil {
+		report.fail(check, "cannot connect to the "+driver+" database: "+err.Error())
+		return
+	}
+	report.ok(check + " (" + driver + ") reachable")
+}
+
+// checkNextCertificate checks the next certificate of a key rotation, if set
+func checkNextCertificate(report *configReport, check string, next config.NextCertificate) {
+	if next.Cert != "" {
+		checkCertificate(report, check, config.Certificate{Cert: next.Cert, PrivateKey: next.PrivateKey, Chain: next.Chain})
+	}
+}
+
+// checkCertificate checks that a certificate and its private key match, its chain, and the validity period of the certificate
+func checkCertificate(report *configReport, check string, c config.Certificate) {
+	if c.Cert == "" || c.PrivateKey == "" {
+		report.fail(check, "missing certificate or private key")
+		return
+	}
+	pair, err := sign.LoadCertificate(c.Cert, c.PrivateKey, c.Chain)
+	if err != nil {
+		// also returned when the private key does not match the certificate, or a certificate is not part of its chain
+		report.fail(check, err.Error())
+		return
+	}
+	cert := pair.Leaf
+	if len(pair.Certificate) > 1 {
+		report.ok(check + " chain of " + strconv.Itoa(len(pair.Certificate)) + " certificates")
+	}
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		report.fail(check, "not valid before "+cert.NotBefore.UTC().Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		report.fail(check, "expired on "+cert.NotAfter.UTC().Format(time.RFC3339))
+	case now.Add(certificateExpiryWarning).After(cert.NotAfter):
+		report.warn(check, "expires on "+cert.NotAfter.UTC().Format(time.RFC3339))
+	default:
+		report.ok(check + " " + cert.Subject.CommonName + " matches its private key, valid until " + cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+}
@@ -27,7 +27,7 @@ package main
 
 import (
 	"crypto/tls"
-	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -37,18 +37,38 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/abbot/go-http-auth"
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/audit"
+	"github.com/readium/readium-lcp-server/cache"
+	"github.com/readium/readium-lcp-server/clock"
 	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/crl"
+	"github.com/readium/readium-lcp-server/dbutils"
+	"github.com/readium/readium-lcp-server/errorreport"
+	"github.com/readium/readium-lcp-server/feature"
 	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/jobs"
+	"github.com/readium/readium-lcp-server/lcpserver/api"
 	"github.com/readium/readium-lcp-server/lcpserver/server"
 	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/maintenance"
+	"github.com/readium/readium-lcp-server/outbox"
 	"github.com/readium/readium-lcp-server/pack"
+	"github.com/readium/readium-lcp-server/retention"
+	"github.com/readium/readium-lcp-server/servicetoken"
+	"github.com/readium/readium-lcp-server/shared"
+	"github.com/readium/readium-lcp-server/sign"
+	"github.com/readium/readium-lcp-server/staging"
 	"github.com/readium/readium-lcp-server/storage"
+	"github.com/readium/readium-lcp-server/storagegc"
+	"github.com/readium/readium-lcp-server/transport"
 )
 
 func dbFromURI(uri string) (string, string) {
@@ -61,11 +81,39 @@ func main() {
 	var readonly bool = false
 	var err error
 
+	checkOnly := flag.Bool("check-config", false, "check the configuration, the database and the certificates, then exit")
+	config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
 	if config_file = os.Getenv("READIUM_LCPSERVER_CONFIG"); config_file == "" {
 		config_file = "config.yaml"
 	}
 	config.ReadConfig(config_file)
 	log.Println("Reading config " + config_file)
+	if err = config.ApplyFlags(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	if *checkOnly {
+		os.Exit(checkConfig(config_file))
+	}
+	if err = config.Validate(config.LcpServerName); err != nil {
+		log.Fatal(err)
+	}
+	servicetoken.Issuer = config.LcpServerName
+	if err = errorreport.Init(config.LcpServerName, config.Config.ErrorReporting); err != nil {
+		log.Fatal(err)
+	}
+	if err = clock.Init(config.Config.Clock); err != nil {
+		log.Fatal(err)
+	}
+	// store of the rate limits, idempotency keys and locks, shared by the instances of the server
+	if err = shared.Open(config.Config.Shared); err != nil {
+		log.Fatal(err)
+	}
+	// a maintenance enabled by the configuration, read-only until it is ended
+	if err = maintenance.Init(config.LcpServerName, config.Config.LcpServer.Maintenance); err != nil {
+		log.Fatal(err)
+	}
 
 	readonly = config.Config.LcpServer.ReadOnly
 
@@ -79,29 +127,18 @@ func main() {
 		here := filepath.Dir(file)
 		static = filepath.Join(here, "../lcpserver/manage")
 	}
-	filepathConfigJs := filepath.Join(static, "/config.js")
-	fileConfigJs, err := os.Create(filepathConfigJs)
-	if err != nil {
-		panic(err)
-	}
-
-	defer func() {
-		if err := fileConfigJs.Close(); err != nil {
-			panic(err)
-		}
-	}()
-	static = config.Config.LcpServer.Directory
-	if static == "" {
-		_, file, _, _ := runtime.Caller(0)
-		here := filepath.Dir(file)
-		static = filepath.Join(here, "../lcpserver/manage")
-	}
 	configJs := "// This file is automatically generated, and git-ignored.\n// To ignore your local changes, use:\n// git update-index --assume-unchanged lcpserver/manage/config.js\n\nvar Config = {\n    lcp: {url: '" + config.Config.LcpServer.PublicBaseUrl + "', user:'" + config.Config.LcpUpdateAuth.Username + "', password: '" + config.Config.LcpUpdateAuth.Password + "'},\n    lsd: {url: '" + config.Config.LsdServer.PublicBaseUrl + "', user:'" + config.Config.LcpUpdateAuth.Username + "', password: '" + config.Config.LcpUpdateAuth.Password + "'}\n}\n"
 
 	log.Println("manage/index.html config.js:")
 	log.Println(configJs)
 
-	fileConfigJs.WriteString(configJs)
+	// served from memory, the static directory may be read-only
+	api.ConfigJs = configJs
+
+	// files in transit between the instances of the server, e.g. the uploads waiting for their encryption
+	if err = staging.Init(config.Config.Staging); err != nil {
+		panic(err)
+	}
 
 	// use a sqlite db by default
 	if dbURI = config.Config.LcpServer.Database; dbURI == "" {
@@ -116,32 +153,74 @@ func main() {
 	if privKeyFile = config.Config.Certificate.PrivateKey; privKeyFile == "" {
 		panic("Must specify a private key")
 	}
-	cert, err := tls.LoadX509KeyPair(certFile, privKeyFile)
+	cert, err := sign.LoadCertificate(certFile, privKeyFile, config.Config.Certificate.Chain)
 	if err != nil {
 		panic(err)
 	}
+	sign.SetWorkers(config.Config.Certificate.SignerWorkers)
 
 	driver, cnxn := dbFromURI(dbURI)
-	db, err := sql.Open(driver, cnxn)
+	db, err := dbutils.Open(driver, cnxn, config.Config.LcpServer)
 	if err != nil {
 		panic(err)
 	}
-	if driver == "sqlite3" {
-		_, err = db.Exec("PRAGMA journal_mode = WAL")
-		if err != nil {
-			panic(err)
-		}
+	replica, err := dbutils.OpenReplica(config.Config.LcpServer, db)
+	if err != nil {
+		panic(err)
+	}
+	idx, err := index.OpenWithReplica(db, replica)
+	if err != nil {
+		panic(err)
+	}
+
+	lst, err := license.NewSqlStoreWithReplica(db, replica)
+
+	if err != nil {
+		panic(err)
 	}
-	idx, err := index.Open(db)
+
+	ob, err := outbox.Open(db)
+	if err != nil {
+		panic(err)
+	}
+
+	al, err := audit.Open(db)
 	if err != nil {
 		panic(err)
 	}
 
-	lst, err := license.NewSqlStore(db)
+	// rollouts of the features stored in the database, which override the configuration
+	fst, err := feature.Open(db)
+	if err != nil {
+		panic(err)
+	}
+	if err = feature.Use(fst); err != nil {
+		panic(err)
+	}
 
+	jst, err := jobs.Open(db)
 	if err != nil {
 		panic(err)
 	}
+	packWorkers, packAttempts := config.Config.Packaging.Workers, config.Config.Packaging.MaxAttempts
+	if packWorkers == 0 {
+		packWorkers = apilcp.DefaultPackWorkers
+	}
+	if packAttempts == 0 {
+		packAttempts = apilcp.DefaultPackMaxAttempts
+	}
+	queue := jobs.NewQueue(jst, packAttempts)
+
+	// optional cache of the content index and licenses
+	if config.Config.Cache.Type != "" {
+		c, err := cache.New(config.Config.Cache)
+		if err != nil {
+			panic(err)
+		}
+		idx = index.NewCachedIndex(idx, c)
+		lst = license.NewCachedStore(lst, c)
+		log.Println("Cache of the content index and licenses: " + config.Config.Cache.Type)
+	}
 
 	// move config
 	license.CreateDefaultLinks()
@@ -154,8 +233,13 @@ func main() {
 		os.MkdirAll(storagePath, os.ModePerm) //ignore the error, the folder can already exist
 		store = storage.NewFileSystem(storagePath, config.Config.LcpServer.PublicBaseUrl+"/files")
 	}
+	// the large encrypted files are stored in parts, e.g. the files of audiobooks, for the tenants
+	// the storage_parts feature is rolled out to
+	store = storage.WithPartsWhen(store, config.Config.Storage.PartSize, func(key string) bool {
+		return feature.Enabled(feature.StorageParts, storageTenant(key))
+	})
 
-	packager := pack.NewPackager(store, idx, 4)
+	packager := pack.NewPackager(store, idx, packWorkers)
 
 	authFile := config.Config.LcpServer.AuthFile
 	if authFile == "" {
@@ -168,13 +252,87 @@ func main() {
 	htpasswd := auth.HtpasswdFileProvider(authFile)
 	authenticator := auth.NewBasicAuthenticator("Readium License Content Protection Server", htpasswd)
 
-	HandleSignals()
-	parsedPort := strconv.Itoa(config.Config.LcpServer.Port)
-	s := lcpserver.New(":"+parsedPort, static, readonly, &idx, &store, &lst, &cert, packager, authenticator)
+	// publishers sharing the server, each with its own credentials
+	var tenants []lcpserver.Tenant
+	for _, t := range config.Config.Tenants {
+		if t.Id == "" || t.AuthFile == "" {
+			panic("A tenant must have an id and a passwords file")
+		}
+		if _, err = os.Stat(t.AuthFile); err != nil {
+			panic(err)
+		}
+		tenant := lcpserver.Tenant{
+			Id:            t.Id,
+			Authenticator: auth.NewBasicAuthenticator("Readium License Content Protection Server", auth.HtpasswdFileProvider(t.AuthFile)),
+			StoragePrefix: t.StoragePrefix,
+		}
+		if t.Certificate.Cert != "" {
+			tenantCert, err := sign.LoadCertificate(t.Certificate.Cert, t.Certificate.PrivateKey, t.Certificate.Chain)
+			if err != nil {
+				panic(err)
+			}
+			tenant.Certificate = tenantCert
+		}
+		tenants = append(tenants, tenant)
+		log.Println("Tenant " + t.Id)
+	}
+
+	// certificates of the providers the server signs licenses for
+	providerCerts := make(map[string]*tls.Certificate)
+	for _, pc := range config.Config.ProviderCerts {
+		if pc.Provider == "" {
+			panic("A provider certificate must have a provider uri")
+		}
+		if _, ok := providerCerts[pc.Provider]; ok {
+			panic("Duplicate certificate for provider " + pc.Provider)
+		}
+		providerCert, err := sign.LoadCertificate(pc.Cert, pc.PrivateKey, pc.Chain)
+		if err != nil {
+			panic(err)
+		}
+		providerCerts[pc.Provider] = providerCert
+		log.Println("Certificate for provider " + pc.Provider)
+	}
+
+	// expiry and revocation of the certificates of the licenses
+	certs := map[string]*tls.Certificate{"default": cert}
+	for _, t := range tenants {
+		if t.Certificate != nil {
+			certs["tenant "+t.Id] = t.Certificate
+		}
+	}
+	for provider, providerCert := range providerCerts {
+		certs[provider] = providerCert
+	}
+	// key rotations of the certificates, whose next certificates are checked too
+	nexts := map[string]config.NextCertificate{"default": config.Config.Certificate.Next}
+	for _, t := range config.Config.Tenants {
+		if t.Certificate.Cert != "" {
+			nexts["tenant "+t.Id] = t.Certificate.Next
+		}
+	}
+	for _, pc := range config.Config.ProviderCerts {
+		nexts[pc.Provider] = pc.Next
+	}
+	for name, next := range nexts {
+		if nextCert := registerRotation(name, certs[name], next); nextCert != nil {
+			certs[name+" (next)"] = nextCert
+		}
+	}
+	if err = crl.CheckCertificates(certs); err != nil {
+		log.Fatal(err)
+	}
+	go crl.Run(certs, certificateCheckInterval)
+	go feature.Run(featureRefreshInterval)
+
+	HandleSignals(config_file)
+	// the listen address is independent of the public base url, e.g. behind a load balancer
+	listenAddr := config.Config.LcpServer.Listen(":" + strconv.Itoa(config.Config.LcpServer.Port))
+	s := lcpserver.New(listenAddr, static, readonly, &idx, &store, &lst, &ob, &al, cert, packager, queue, authenticator, tenants, providerCerts)
 	if readonly {
-		log.Println("License server running in readonly mode on port " + parsedPort)
+		log.Println("License server running in readonly mode on " + listenAddr)
 	} else {
-		log.Println("License server running on port " + parsedPort)
+		log.Println("License server running on " + listenAddr)
 	}
 	log.Println("Using database " + dbURI)
 	log.Println("Public base URL=" + config.Config.LcpServer.PublicBaseUrl)
@@ -183,13 +341,69 @@ func main() {
 		log.Println("  " + nameOfLink + " => " + link)
 	}
 
-	if err := s.ListenAndServe(); err != nil {
+	// the calls of the License Status Server, received in process or from a queue
+	if err = transport.Serve(config.LcpServerName, s.Handler); err != nil {
+		log.Fatal(err)
+	}
+
+	// deliver the lsd notifications stored with the licenses
+	if config.Config.LsdServer.PublicBaseUrl != "" {
+		go apilcp.RunOutbox(s, outboxInterval)
+	}
+
+	// encryption of the uploaded files
+	if !readonly {
+		queue.Handle(apilcp.JobEncrypt, apilcp.EncryptUpload(s))
+		queue.Start(packWorkers)
+	}
+
+	// purge of the expired licenses
+	retentionConf := config.Config.Retention
+	rules := []retention.Rule{
+		{Name: "licenses", Days: retentionConf.LicenseDays, Purge: func(before time.Time, dryRun bool) (int64, error) {
+			return lst.PurgeExpired(before, retentionConf.LicenseAction != "delete", dryRun)
+		}},
+	}
+	if !readonly && retention.Enabled(rules) {
+		go retention.Run(rules, retention.Interval(retentionConf), retentionConf.DryRun)
+	}
+
+	// deletion of the encrypted files without content record
+	if gcConf := config.Config.Storage.GC; !readonly && gcConf.Enabled {
+		collector := storagegc.New(s, func(tenant string) storagegc.Source { return s.ForTenant(tenant) })
+		go collector.Run(storagegc.Interval(gcConf), gcConf.DryRun)
+	}
+
+	if err := api.ListenAndServe(&s.Server, config.Config.LcpServer.TLS); err != nil {
 		log.Println("Error " + err.Error())
 	}
 
 }
 
-func HandleSignals() {
+// interval between two runs of the re-driver of the lsd notifications outbox,
+// which also runs each time a license is created
+const outboxInterval = 10 * time.Second
+
+// interval between two checks of the expiry and the revocation of the certificates
+const certificateCheckInterval = time.Hour
+
+// interval between two loads of the rollouts of the features stored in the database,
+// which may be changed by another instance of the server
+const featureRefreshInterval = time.Minute
+
+// storageTenant returns the id of the tenant whose storage prefix starts a key, empty for the other keys
+func storageTenant(key string) string {
+	for _, t := range config.Config.Tenants {
+		if t.StoragePrefix != "" && strings.HasPrefix(key, t.StoragePrefix) {
+			return t.Id
+		}
+	}
+	return ""
+}
+
+// HandleSignals dumps the goroutines on SIGQUIT, reloads the configuration on SIGHUP
+// and exits on SIGINT or SIGTERM
+func HandleSignals(configFile string) {
 	sigChan := make(chan os.Signal)
 	go func() {
 		stacktrace := make([]byte, 1<<20)
@@ -198,6 +412,8 @@ func HandleSignals() {
 			case syscall.SIGQUIT:
 				length := runtime.Stack(stacktrace, true)
 				fmt.Println(string(stacktrace[:length]))
+			case syscall.SIGHUP:
+				reloadConfig(configFile)
 			case syscall.SIGINT:
 				fallthrough
 			case syscall.SIGTERM:
@@ -206,7 +422,26 @@ func HandleSignals() {
 			}
 		}
 	}()
-	signal.Notify(sigChan, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+}
+
+// reloadConfig applies the changes of the reloadable settings and logs them
+func reloadConfig(configFile string) {
+	changes, ignored, err := config.Reload(configFile, config.LcpServerName, flag.CommandLine)
+	if err != nil {
+		log.Println("Config reload failed, the configuration is unchanged: " + err.Error())
+		return
+	}
+	license.CreateDefaultLinks()
+	if len(changes) == 0 {
+		log.Println("Config reloaded, no change")
+	}
+	for _, change := range changes {
+		log.Println("Config reloaded: " + change)
+	}
+	for _, key := range ignored {
+		log.Println("Config reload: " + key + " changed, a restart is needed to apply it")
+	}
 }
 
 func s3ConfigFromYAML() storage.S3Config {
@@ -225,3 +460,22 @@ func s3ConfigFromYAML() storage.S3Config {
 
 	return s3config
 }
+
+// registerRotation registers a certificate signing licenses and, if set, loads the next certificate
+// of its key rotation, which is returned
+func registerRotation(name string, cert *tls.Certificate, next config.NextCertificate) *tls.Certificate {
+	r := sign.Rotation{Name: name, Current: cert, Policy: next.Policy}
+	if next.Cert != "" {
+		nextCert, err := sign.LoadCertificate(next.Cert, next.PrivateKey, next.Chain)
+		if err != nil {
+			panic(err)
+		}
+		r.Next = nextCert
+	}
+	sign.SetRotation(r)
+	if r.Next != nil {
+		r = sign.RotationOf(cert)
+		log.Println("Key rotation of the certificate " + name + ": next certificate " + sign.Fingerprint(r.Next) + ", policy " + r.Policy)
+	}
+	return r.Next
+}
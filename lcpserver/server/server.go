@@ -26,18 +26,27 @@
 package lcpserver
 
 import (
+	"crypto/subtle"
 	"crypto/tls"
+	"expvar"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/abbot/go-http-auth"
 	"github.com/gorilla/mux"
 
 	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/audit"
+	"github.com/readium/readium-lcp-server/config"
 	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/jobs"
 	"github.com/readium/readium-lcp-server/lcpserver/api"
 	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/outbox"
 	"github.com/readium/readium-lcp-server/pack"
+	"github.com/readium/readium-lcp-server/problem"
 	"github.com/readium/readium-lcp-server/storage"
 )
 
@@ -47,8 +56,23 @@ type Server struct {
 	idx      *index.Index
 	st       *storage.Store
 	lst      *license.Store
+	ob       *outbox.Store
+	audit    *audit.Store
 	cert     *tls.Certificate
 	source   pack.ManualSource
+	jobs     *jobs.Queue
+	tenants  []Tenant
+	// certificates of the providers, by provider uri
+	providerCerts map[string]*tls.Certificate
+}
+
+// Tenant is a publisher served by the License Server, identified by its credentials.
+// The certificate and the storage prefix are optional.
+type Tenant struct {
+	Id            string
+	Authenticator *auth.BasicAuth
+	Certificate   *tls.Certificate
+	StoragePrefix string
 }
 
 func (s *Server) Store() storage.Store {
@@ -63,17 +87,38 @@ func (s *Server) Licenses() license.Store {
 	return *s.lst
 }
 
+func (s *Server) Outbox() outbox.Store {
+	return *s.ob
+}
+
+func (s *Server) Audit() audit.Store {
+	return *s.audit
+}
+
+// Jobs returns the queue of the background jobs, e.g. the encryption of the uploaded files
+func (s *Server) Jobs() *jobs.Queue {
+	return s.jobs
+}
+
 func (s *Server) Certificate() *tls.Certificate {
 	return s.cert
 }
 
+// CertificateFor returns the certificate used to sign the licenses of a provider
+func (s *Server) CertificateFor(provider string) *tls.Certificate {
+	if cert, ok := s.providerCerts[provider]; ok {
+		return cert
+	}
+	return s.Certificate()
+}
+
 func (s *Server) Source() *pack.ManualSource {
 	return &s.source
 }
 
-func New(bindAddr string, static string, readonly bool, idx *index.Index, st *storage.Store, lst *license.Store, cert *tls.Certificate, packager *pack.Packager, basicAuth *auth.BasicAuth) *Server {
+func New(bindAddr string, static string, readonly bool, idx *index.Index, st *storage.Store, lst *license.Store, ob *outbox.Store, al *audit.Store, cert *tls.Certificate, packager *pack.Packager, queue *jobs.Queue, basicAuth *auth.BasicAuth, tenants []Tenant, providerCerts map[string]*tls.Certificate) *Server {
 
-	sr := api.CreateServerRouter(static)
+	sr := api.CreateServerRouter(static, config.Config.LcpServer)
 
 	s := &Server{
 		Server: http.Server{
@@ -87,8 +132,23 @@ func New(bindAddr string, static string, readonly bool, idx *index.Index, st *st
 		idx:      idx,
 		st:       st,
 		lst:      lst,
+		ob:       ob,
+		audit:    al,
 		cert:     cert,
 		source:   pack.ManualSource{},
+		jobs:     queue,
+		tenants:  tenants,
+
+		providerCerts: providerCerts,
+	}
+	api.SetTimeouts(&s.Server, config.Config.LcpServer.Timeouts)
+
+	// the logins of the rate limits and of the idempotent requests, once their credentials are verified
+	sr.Logins.Verify = func(r *http.Request) string {
+		if t := s.tenantOf(r); t != nil {
+			return "tenant:" + t.Id
+		}
+		return api.ServiceLogin(basicAuth, config.LcpServerName, r)
 	}
 
 	// Route.PathPrefix: http://www.gorillatoolkit.org/pkg/mux#Route.PathPrefix
@@ -106,18 +166,40 @@ func New(bindAddr string, static string, readonly bool, idx *index.Index, st *st
 	s.handleFunc(contentRoutes, "/{content_id}", apilcp.GetContent).Methods("GET")
 	// get all licenses associated with a given content
 	s.handlePrivateFunc(contentRoutes, "/{content_id}/licenses", apilcp.ListLicensesForContent, basicAuth).Methods("GET")
+	// stream the decrypted resources of a publication to trusted internal services
+	if config.Config.Streamer.Enabled {
+		s.handleStreamFunc(contentRoutes, "/{content_id}/stream/{path:.+}", apilcp.StreamResource).Methods("GET")
+	}
+	// time-limited download urls of the encrypted publications
+	if config.Config.SignedURLs.Secret != "" {
+		s.handleFunc(contentRoutes, "/{content_id}/download", apilcp.DownloadContent).Methods("GET")
+		s.handlePrivateFunc(contentRoutes, "/{content_id}/download_url", apilcp.MintDownloadURL, basicAuth).Methods("POST")
+	}
+	// get the metadata associated with a given content
+	s.handlePrivateFunc(contentRoutes, "/{content_id}/metadata", apilcp.GetContentMetadata, basicAuth).Methods("GET")
+	// list the versions of a content, whose files are kept for the licenses issued for them
+	s.handlePrivateFunc(contentRoutes, "/{content_id}/versions", apilcp.ListContentVersions, basicAuth).Methods("GET")
+	// list the users waiting for a copy of a content
+	s.handlePrivateFunc(contentRoutes, "/{content_id}/holds", apilcp.ListHolds, basicAuth).Methods("GET")
 
 	if !readonly {
+		// encrypt an EPUB file in the background, declared before the routes of a content
+		s.handlePrivateFunc(contentRoutes, "/pack", writing(apilcp.StoreContent), basicAuth).Methods("POST")
+		// ingest an ONIX message, associate its metadata with the contents it describes
+		s.handlePrivateFunc(contentRoutes, "/onix", writing(apilcp.IngestOnix), basicAuth).Methods("POST")
 		// put content to the storage
-		s.handlePrivateFunc(contentRoutes, "/{content_id}", apilcp.AddContent, basicAuth).Methods("PUT")
+		s.handlePrivateFunc(contentRoutes, "/{content_id}", writing(apilcp.AddContent), basicAuth).Methods("PUT")
+		// limit of the simultaneous loans of a content, users waiting for a copy
+		s.handlePrivateFunc(contentRoutes, "/{content_id}/max_concurrent_loans", writing(apilcp.SetMaxConcurrentLoans), basicAuth).Methods("PUT")
+		s.handlePrivateFunc(contentRoutes, "/{content_id}/holds/{user_id}", writing(apilcp.CancelHold), basicAuth).Methods("DELETE")
 		// generate a license for given content
-		s.handlePrivateFunc(contentRoutes, "/{content_id}/license", apilcp.GenerateLicense, basicAuth).Methods("POST")
+		s.handlePrivateFunc(contentRoutes, "/{content_id}/license", writing(apilcp.GenerateLicense), basicAuth).Methods("POST")
 		// deprecated, from a typo in the lcp server spec
-		s.handlePrivateFunc(contentRoutes, "/{content_id}/licenses", apilcp.GenerateLicense, basicAuth).Methods("POST")
+		s.handlePrivateFunc(contentRoutes, "/{content_id}/licenses", writing(apilcp.GenerateLicense), basicAuth).Methods("POST")
 		// generate a licensed publication
-		s.handlePrivateFunc(contentRoutes, "/{content_id}/publication", apilcp.GenerateLicensedPublication, basicAuth).Methods("POST")
+		s.handlePrivateFunc(contentRoutes, "/{content_id}/publication", writing(apilcp.GenerateLicensedPublication), basicAuth).Methods("POST")
 		// deprecated, from a typo in the lcp server spec
-		s.handlePrivateFunc(contentRoutes, "/{content_id}/publications", apilcp.GenerateLicensedPublication, basicAuth).Methods("POST")
+		s.handlePrivateFunc(contentRoutes, "/{content_id}/publications", writing(apilcp.GenerateLicensedPublication), basicAuth).Methods("POST")
 	}
 
 	// methods related to licenses
@@ -126,25 +208,105 @@ func New(bindAddr string, static string, readonly bool, idx *index.Index, st *st
 	licenseRoutes := sr.R.PathPrefix(licenseRoutesPathPrefix).Subrouter().StrictSlash(false)
 
 	s.handlePrivateFunc(sr.R, licenseRoutesPathPrefix, apilcp.ListLicenses, basicAuth).Methods("GET")
+	// export the licenses as ndjson or csv, declared before the routes of a license
+	s.handlePrivateFunc(licenseRoutes, "/export", apilcp.ExportLicenses, basicAuth).Methods("GET")
+	if !readonly {
+		// import the licenses issued by another License Server, declared before the routes of a license
+		s.handlePrivateFunc(licenseRoutes, "/import", writing(apilcp.ImportLicenses), basicAuth).Methods("POST")
+	}
+	// verify a license document sent by a support team, declared before the routes of a license
+	s.handlePrivateFunc(licenseRoutes, "/verify", apilcp.VerifyLicense, basicAuth).Methods("POST")
+	// build and validate the key check of a license, declared before the routes of a license
+	s.handlePrivateFunc(licenseRoutes, "/key_check", apilcp.CheckKeyCheck, basicAuth).Methods("POST")
 	// get a license
-	s.handlePrivateFunc(licenseRoutes, "/{license_id}", apilcp.GetLicense, basicAuth).Methods("GET")
-	s.handlePrivateFunc(licenseRoutes, "/{license_id}", apilcp.GetLicense, basicAuth).Methods("POST")
+	s.handlePrivateFunc(licenseRoutes, "/{license_id}", apilcp.Shadowed(apilcp.GetLicense), basicAuth).Methods("GET")
+	s.handlePrivateFunc(licenseRoutes, "/{license_id}", apilcp.Shadowed(apilcp.GetLicense), basicAuth).Methods("POST")
 	// get a licensed publication via a license id
 	s.handlePrivateFunc(licenseRoutes, "/{license_id}/publication", apilcp.GetLicensedPublication, basicAuth).Methods("POST")
+	// get the consumption of the print and copy rights of a license
+	s.handlePrivateFunc(licenseRoutes, "/{license_id}/rights", apilcp.GetLicenseRights, basicAuth).Methods("GET")
 	if !readonly {
 		// update a license
-		s.handlePrivateFunc(licenseRoutes, "/{license_id}", apilcp.UpdateLicense, basicAuth).Methods("PATCH")
+		s.handlePrivateFunc(licenseRoutes, "/{license_id}", writing(apilcp.UpdateLicense), basicAuth).Methods("PATCH")
+		// report the consumption of the print and copy rights of a license
+		s.handlePrivateFunc(licenseRoutes, "/{license_id}/rights", writing(apilcp.ConsumeLicenseRights), basicAuth).Methods("POST")
+		// return or revoke the license of a refunded purchase, called by the storefront
+		s.handlePrivateFunc(licenseRoutes, "/{license_id}/refund", writing(apilcp.RefundLicense), basicAuth).Methods("POST")
+		// encrypt the keys of a license with a new user key
+		s.handlePrivateFunc(licenseRoutes, "/{license_id}/user_key", writing(apilcp.RotateUserKey), basicAuth).Methods("POST")
+	}
+
+	// erasure of the personal data of a user
+	if !readonly {
+		s.handlePrivateFunc(sr.R, "/users/{user_id}/erasure", writing(apilcp.EraseUser), basicAuth).Methods("POST")
+	}
+
+	// background jobs, e.g. the encryption of an uploaded file: state of a job, list of the jobs
+	// and new attempts of a failed job
+	s.handlePrivateFunc(sr.R, "/jobs", apilcp.ListJobs, basicAuth).Methods("GET")
+	s.handlePrivateFunc(sr.R, "/jobs/{job_id}", apilcp.GetJob, basicAuth).Methods("GET")
+	if !readonly {
+		s.handlePrivateFunc(sr.R, "/jobs/{job_id}/requeue", writing(apilcp.RequeueJob), basicAuth).Methods("POST")
+	}
+
+	// revocation list of the certificate of the licenses, public as the certificate
+	if config.Config.Certificate.CRL.Enabled {
+		s.handleFunc(sr.R, "/crl", apilcp.GetCRL).Methods("GET")
+	}
+
+	// verification of the stored licenses and contents
+	s.handlePrivateFunc(sr.R, "/integrity", apilcp.CheckIntegrity, basicAuth).Methods("GET")
+	// certificates signing the licenses, their key rotations and the licenses they signed
+	s.handlePrivateFunc(sr.R, "/certificates", apilcp.ListCertificates, basicAuth).Methods("GET")
+
+	// maintenance mode: the routes which write to the database are refused, the reads are served
+	maintenanceHandler := api.MaintenanceHandler(config.LcpServerName, config.Config.LcpServer.Maintenance)
+	sr.R.HandleFunc("/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		if api.CheckAuth(basicAuth, w, r) {
+			maintenanceHandler(w, r)
+		}
+	}).Methods("GET", "PUT", "DELETE")
+
+	// rollouts of the features stored in the database, which override the configuration
+	featuresHandler := api.FeaturesHandler()
+	sr.R.HandleFunc("/features", func(w http.ResponseWriter, r *http.Request) {
+		if api.CheckAuth(basicAuth, w, r) {
+			featuresHandler(w, r)
+		}
+	}).Methods("GET")
+	if !readonly {
+		sr.R.HandleFunc("/features/{name}", func(w http.ResponseWriter, r *http.Request) {
+			if api.CheckAuth(basicAuth, w, r) && api.CheckMaintenance(w, r, config.LcpServerName) {
+				featuresHandler(w, r)
+			}
+		}).Methods("PUT", "DELETE")
 	}
 
+	// metrics, including the depth of the outbox of lsd notifications
+	sr.R.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		if api.CheckAuth(basicAuth, w, r) {
+			expvar.Handler().ServeHTTP(w, r)
+		}
+	}).Methods("GET")
+
 	s.source.Feed(packager.Incoming)
 	return s
 }
 
 type HandlerFunc func(w http.ResponseWriter, r *http.Request, s apilcp.Server)
 
+// writing refuses the requests of a route which writes to the database while the server is in maintenance
+func writing(fn HandlerFunc) func(w http.ResponseWriter, r *http.Request, s apilcp.Server) {
+	return func(w http.ResponseWriter, r *http.Request, s apilcp.Server) {
+		if api.CheckMaintenance(w, r, config.LcpServerName) {
+			fn(w, r, s)
+		}
+	}
+}
+
 func (s *Server) handleFunc(router *mux.Router, route string, fn HandlerFunc) *mux.Route {
 	return router.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
-		fn(w, r, s)
+		fn(w, r, s.publicServerFor(r))
 	})
 }
 
@@ -152,8 +314,64 @@ type HandlerPrivateFunc func(w http.ResponseWriter, r *auth.AuthenticatedRequest
 
 func (s *Server) handlePrivateFunc(router *mux.Router, route string, fn HandlerFunc, authenticator *auth.BasicAuth) *mux.Route {
 	return router.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
-		if api.CheckAuth(authenticator, w, r) {
-			fn(w, r, s)
+		// the credentials of a tenant give access to its contents and licenses only
+		if t := s.tenantOf(r); t != nil {
+			fn(w, r, tenantServer{s, t})
+			return
+		}
+		if api.CheckServiceAuth(authenticator, config.LcpServerName, w, r) {
+			fn(w, r, s.serverFor(r))
 		}
 	})
 }
+
+// handleStreamFunc protects the streaming routes: the credentials are specific to the streamer,
+// and the caller must connect from an allowed address if a list of addresses is configured.
+func (s *Server) handleStreamFunc(router *mux.Router, route string, fn HandlerFunc) *mux.Route {
+	return router.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
+		if !checkStreamerAccess(r, config.StreamerConfig()) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Readium LCP streamer"`)
+			problem.Error(w, r, problem.Problem{Detail: "Access to the streamer denied"}, http.StatusUnauthorized)
+			return
+		}
+		fn(w, r, s.serverFor(r))
+	})
+}
+
+// checkStreamerAccess checks the credentials and the address of a streaming request
+func checkStreamerAccess(r *http.Request, conf config.Streamer) bool {
+	if conf.Auth.Username == "" || conf.Auth.Password == "" {
+		// the streamer cannot be opened without credentials
+		return false
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOk := subtle.ConstantTimeCompare([]byte(username), []byte(conf.Auth.Username)) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(password), []byte(conf.Auth.Password)) == 1
+	if !userOk || !passOk {
+		return false
+	}
+	if len(conf.AllowedIPs) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range conf.AllowedIPs {
+		if strings.Contains(allowed, "/") {
+			if _, network, err := net.ParseCIDR(allowed); err == nil && network.Contains(ip) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -26,8 +26,31 @@
 package lcpserver
 
 import (
+	"crypto/tls"
 	"testing"
 )
 
 func TestSetup(t *testing.T) {
 }
+
+func TestCertificateFor(t *testing.T) {
+	var serverCert, tenantCert, imprintCert tls.Certificate
+	s := &Server{
+		cert:          &serverCert,
+		providerCerts: map[string]*tls.Certificate{"http://imprint.example.com": &imprintCert},
+	}
+	if s.CertificateFor("http://imprint.example.com") != &imprintCert {
+		t.Error("Expected the certificate of the provider")
+	}
+	if s.CertificateFor("http://other.example.com") != &serverCert {
+		t.Error("Expected the certificate of the server")
+	}
+
+	ts := tenantServer{Server: s, tenant: &Tenant{Id: "t1", Certificate: &tenantCert}}
+	if ts.CertificateFor("http://imprint.example.com") != &imprintCert {
+		t.Error("Expected the certificate of the provider for a tenant")
+	}
+	if ts.CertificateFor("http://other.example.com") != &tenantCert {
+		t.Error("Expected the certificate of the tenant")
+	}
+}
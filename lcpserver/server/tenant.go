@@ -0,0 +1,127 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package lcpserver
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/lcpserver/api"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/storage"
+)
+
+// tenantServer is the view of the server given to the handlers of a tenant:
+// the contents and licenses of other tenants are not visible,
+// the files are stored under the prefix of the tenant and the licenses are signed with its certificate.
+type tenantServer struct {
+	*Server
+	tenant *Tenant
+}
+
+func (t tenantServer) Index() index.Index {
+	return index.ForTenant(t.Server.Index(), t.tenant.Id)
+}
+
+func (t tenantServer) Licenses() license.Store {
+	return license.ForTenant(t.Server.Licenses(), t.tenant.Id)
+}
+
+func (t tenantServer) Store() storage.Store {
+	return storage.WithPrefix(t.Server.Store(), t.tenant.StoragePrefix)
+}
+
+func (t tenantServer) Certificate() *tls.Certificate {
+	if t.tenant.Certificate != nil {
+		return t.tenant.Certificate
+	}
+	return t.Server.Certificate()
+}
+
+// CertificateFor returns the certificate of the provider if there is one,
+// the certificate of the tenant otherwise
+func (t tenantServer) CertificateFor(provider string) *tls.Certificate {
+	if cert, ok := t.providerCerts[provider]; ok {
+		return cert
+	}
+	return t.Certificate()
+}
+
+// tenantOf returns the tenant whose credentials are used by a request, if any
+func (s *Server) tenantOf(r *http.Request) *Tenant {
+	if _, _, ok := r.BasicAuth(); !ok {
+		return nil
+	}
+	for i := range s.tenants {
+		if s.tenants[i].Authenticator.CheckAuth(r) != "" {
+			return &s.tenants[i]
+		}
+	}
+	return nil
+}
+
+// ForTenant returns the view of the server given to a tenant, or the server itself
+// if there is no such tenant
+func (s *Server) ForTenant(id string) apilcp.Server {
+	if t := s.tenantByID(id); t != nil {
+		return tenantServer{Server: s, tenant: t}
+	}
+	return s
+}
+
+// tenantByID returns a tenant from its identifier
+func (s *Server) tenantByID(id string) *Tenant {
+	if id == "" {
+		return nil
+	}
+	for i := range s.tenants {
+		if s.tenants[i].Id == id {
+			return &s.tenants[i]
+		}
+	}
+	return nil
+}
+
+// serverFor returns the view of the server used by a public request, or by a request
+// authenticated with the credentials of the server: if the request targets a content or a license,
+// the view of its tenant is used, so that its files and certificate are found.
+func (s *Server) serverFor(r *http.Request) apilcp.Server {
+	if len(s.tenants) == 0 {
+		return s
+	}
+	if t := s.tenantOf(r); t != nil {
+		return tenantServer{s, t}
+	}
+	vars := mux.Vars(r)
+	if contentID, ok := vars["content_id"]; ok {
+		if c, err := s.Index().Get(contentID); err == nil {
+			if t := s.tenantByID(c.Tenant); t != nil {
+				return tenantServer{s, t}
+			}
+		}
+	}
+	if licenseID, ok := vars["license_id"]; ok {
+		if l, err := s.Licenses().Get(licenseID); err == nil {
+			if t := s.tenantByID(l.Tenant); t != nil {
+				return tenantServer{s, t}
+			}
+		}
+	}
+	return s
+}
+
+// publicServerFor returns the view of the server used by a public request:
+// if tenants are configured, anonymous requests only see the contents without tenant,
+// or the content they target.
+func (s *Server) publicServerFor(r *http.Request) apilcp.Server {
+	srv := s.serverFor(r)
+	if srv == apilcp.Server(s) && len(s.tenants) > 0 {
+		return tenantServer{s, &Tenant{}}
+	}
+	return srv
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// lcptest is an end-to-end test of the License Server and the License Status Server: it starts both servers
+// with sqlite databases and a storage in a temporary folder, protects a sample EPUB, issues a license,
+// registers a device, renews, returns and revokes the licenses, and checks every step.
+// The configuration of an integrator may be given: its databases, storage, ports and credentials are replaced,
+// its other settings (license links, rights policy, packaging, status documents...) are tested.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/sign"
+	"github.com/readium/readium-lcp-server/testsupport"
+)
+
+// username of the services when the configuration has no credentials
+const defaultUsername = "lcptest"
+
+// provider of the licenses, when the configuration has no certificate
+const defaultProvider = "http://localhost"
+
+// readConfig reads the configuration of an integrator; config.ReadConfig panics on an error
+func readConfig(configFile string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	config.ReadConfig(configFile)
+	return nil
+}
+
+// configure replaces the databases, storage, urls and credentials of the configuration by the ones of the test,
+// in a temporary folder; the services are authenticated with basic authentication.
+// It returns the certificate of the licenses, and its root certificates if it has been generated for the test.
+//
+func configure(dir, lcpURL, lsdURL, provider string, verbose bool) (*tls.Certificate, *x509.CertPool, error) {
+	c := &config.Config
+
+	for _, info := range []*config.ServerInfo{&c.LcpServer, &c.LsdServer.ServerInfo} {
+		info.ReadOnly = false
+		info.ReplicaDatabase = ""
+		info.TLS = config.TLS{}
+		info.AuthFile = ""
+		if !verbose {
+			info.AccessLog.Format = "off"
+		}
+	}
+	c.LcpServer.PublicBaseUrl = lcpURL
+	c.LcpServer.Database = "sqlite3://file:" + filepath.Join(dir, "lcp.sqlite") + "?cache=shared&mode=rwc"
+	c.LsdServer.PublicBaseUrl = lsdURL
+	c.LsdServer.Database = "sqlite3://file:" + filepath.Join(dir, "lsd.sqlite") + "?cache=shared&mode=rwc"
+	if c.LsdServer.LicenseLinkUrl == "" {
+		c.LsdServer.LicenseLinkUrl = lcpURL + "/licenses/{license_id}"
+	}
+	c.Storage.Mode = ""
+	c.Storage.FileSystem.Directory = filepath.Join(dir, "files")
+	c.Storage.GC.Enabled = false
+	c.Cache = config.Cache{}
+	c.Tenants = nil
+	c.ServiceTokens = config.ServiceTokens{}
+	c.ErrorReporting = config.ErrorReporting{}
+	c.Shadow = config.Shadow{}
+	c.ComplianceMode = false
+	c.GoofyMode = false
+	c.Refunds = config.Refunds{}
+
+	// the steps of the test need the register, renew and return interactions
+	c.LicenseStatus.Register = true
+	c.LicenseStatus.Renew = true
+	c.LicenseStatus.Return = true
+	if c.LicenseStatus.RentingDays == 0 {
+		c.LicenseStatus.RentingDays = 60
+	}
+
+	links := make(map[string]string)
+	for rel, href := range c.License.Links {
+		links[rel] = href
+	}
+	links["status"] = lsdURL + "/licenses/{license_id}/status"
+	if links["hint"] == "" {
+		links["hint"] = lcpURL + "/hint"
+	}
+	c.License.Links = links
+
+	// the base url placeholders of the links are replaced by the urls of the test servers
+	err := config.SetPublicUrls()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, auth := range []*config.Auth{&c.LcpUpdateAuth, &c.LsdNotifyAuth} {
+		if auth.Username == "" || auth.Password == "" {
+			auth.Username = defaultUsername
+			if auth.Password, err = randomPassword(); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	c.LcpServer.AuthFile = filepath.Join(dir, "lcp.htpasswd")
+	if err = writeHtpasswd(c.LcpServer.AuthFile, c.LcpUpdateAuth); err != nil {
+		return nil, nil, err
+	}
+	c.LsdServer.AuthFile = filepath.Join(dir, "lsd.htpasswd")
+	if err = writeHtpasswd(c.LsdServer.AuthFile, c.LsdNotifyAuth); err != nil {
+		return nil, nil, err
+	}
+
+	// the certificate of the configuration, else a throw-away certificate issued by a test CA
+	if c.Certificate.Cert != "" {
+		cert, err := sign.LoadCertificate(c.Certificate.Cert, c.Certificate.PrivateKey, c.Certificate.Chain)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert, nil, nil
+	}
+	ca, err := testsupport.NewCA(24 * time.Hour)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := ca.ProviderCertificate(provider, testsupport.RSA)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.Certificate.Cert, c.Certificate.PrivateKey, err = testsupport.WriteCertificate(cert, dir); err != nil {
+		return nil, nil, err
+	}
+	return cert, ca.Pool(), nil
+}
+
+// randomPassword returns a password for the services of the test
+func randomPassword() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// writeHtpasswd writes a passwords file with the credentials of a service, hashed with SHA-1
+func writeHtpasswd(file string, auth config.Auth) error {
+	hash := sha1.Sum([]byte(auth.Password))
+	line := auth.Username + ":{SHA}" + base64.StdEncoding.EncodeToString(hash[:]) + "\n"
+	return ioutil.WriteFile(file, []byte(line), 0600)
+}
+
+func run() error {
+	configFile := flag.String("config", "", "optional configuration of the servers; its databases, storage, urls and credentials are replaced")
+	provider := flag.String("provider", defaultProvider, "provider of the licenses, and of the test certificate if the configuration has none")
+	keep := flag.Bool("keep", false, "keeps the temporary folder, with the databases, the files and the logs of the servers")
+	verbose := flag.Bool("v", false, "prints the logs of the servers")
+	flag.Parse()
+
+	if *configFile != "" {
+		if err := readConfig(*configFile); err != nil {
+			return err
+		}
+	}
+	dir, err := ioutil.TempDir("", "lcptest")
+	if err != nil {
+		return err
+	}
+	if *keep {
+		fmt.Println("Temporary folder: " + dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	if !*verbose {
+		logFile, err := os.Create(filepath.Join(dir, "servers.log"))
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+	}
+
+	t := &harness{provider: *provider}
+	if !t.run(dir, *verbose) {
+		return errors.New("the end-to-end test failed")
+	}
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,415 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/lcpencrypt/encrypt"
+	"github.com/readium/readium-lcp-server/lcpserver/api"
+	"github.com/readium/readium-lcp-server/lcpverify/verify"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/localization"
+	"github.com/readium/readium-lcp-server/status"
+	"github.com/readium/readium-lcp-server/testsupport"
+)
+
+// duration of the loans of the test, in days, within the rights policy of the provider
+const testLoanDays = 7
+
+// delay for the status document of a new license, created by a notification of the License Server
+const statusTimeout = 10 * time.Second
+
+// passphrase of the users of the test
+const testPassphrase = "lcptest passphrase"
+
+// device of the test, registered to the licenses
+const (
+	testDeviceID   = "lcptest-device"
+	testDeviceName = "lcptest device"
+)
+
+// harness runs the steps of the end-to-end test and prints their results
+type harness struct {
+	provider string
+	dir      string
+	lcpURL   string
+	lsdURL   string
+	roots    *x509.CertPool
+	client   *http.Client
+	failed   bool
+
+	// the protected publication, shared by the steps
+	contentID string
+	protected []byte
+}
+
+// statusDocument is the part of a status document checked by the test
+type statusDocument struct {
+	Id      string `json:"id"`
+	Status  string `json:"status"`
+	Updated struct {
+		License time.Time `json:"license"`
+		Status  time.Time `json:"status"`
+	} `json:"updated"`
+}
+
+// step runs a step of the test and prints its result; the steps are skipped after a failure
+func (t *harness) step(name string, fn func() (string, error)) {
+	if t.failed {
+		fmt.Println("skip " + name)
+		return
+	}
+	detail, err := fn()
+	if err != nil {
+		t.failed = true
+		fmt.Println("FAIL " + name + ": " + err.Error())
+		return
+	}
+	if detail != "" {
+		name += " (" + detail + ")"
+	}
+	fmt.Println("ok   " + name)
+}
+
+// run starts the servers and runs all the steps of the test; it returns false if a step failed
+func (t *harness) run(dir string, verbose bool) bool {
+	t.dir = dir
+	t.client = &http.Client{Timeout: 30 * time.Second}
+	lcpLn, lsdLn, err := listen()
+	if err != nil {
+		fmt.Println("FAIL listen: " + err.Error())
+		return false
+	}
+	t.lcpURL = "http://" + lcpLn.Addr().String()
+	t.lsdURL = "http://" + lsdLn.Addr().String()
+
+	var cert *tls.Certificate
+	t.step("configuration", func() (string, error) {
+		if cert, t.roots, err = configure(dir, t.lcpURL, t.lsdURL, t.provider, verbose); err != nil {
+			return "", err
+		}
+		for _, server := range []string{config.LcpServerName, config.LsdServerName} {
+			if err = config.Validate(server); err != nil {
+				return "", err
+			}
+		}
+		if err = localization.InitTranslations(); err != nil {
+			return "", err
+		}
+		if t.roots == nil {
+			return "certificate " + config.Config.Certificate.Cert, nil
+		}
+		return "test certificate of " + t.provider, nil
+	})
+	if t.failed {
+		lcpLn.Close()
+		lsdLn.Close()
+		return false
+	}
+	var srv *servers
+	t.step("start the servers", func() (string, error) {
+		srv, err = startServers(lcpLn, lsdLn, cert)
+		return "License Server " + t.lcpURL + ", License Status Server " + t.lsdURL, err
+	})
+	defer srv.close()
+
+	t.step("protect the sample EPUB", t.protect)
+
+	// a loan: registered, renewed then returned
+	var loan license.License
+	t.step("issue a license", func() (string, error) {
+		loan, err = t.issue("lcptest-user-1")
+		return loan.Id, err
+	})
+	t.step("create the status document", func() (string, error) {
+		return t.expectStatus(loan.Id, status.STATUS_READY)
+	})
+	t.step("register a device", func() (string, error) {
+		return t.interact("POST", loan.Id, "register", nil, status.STATUS_ACTIVE)
+	})
+	t.step("renew the loan", func() (string, error) {
+		return t.renew(loan)
+	})
+	t.step("return the loan", func() (string, error) {
+		if _, err := t.interact("PUT", loan.Id, "return", nil, status.STATUS_RETURNED); err != nil {
+			return "", err
+		}
+		return t.expectEnded(loan.Id)
+	})
+
+	// a second loan, revoked by the provider
+	var revoked license.License
+	t.step("issue a second license", func() (string, error) {
+		revoked, err = t.issue("lcptest-user-2")
+		return revoked.Id, err
+	})
+	t.step("register a device to the second license", func() (string, error) {
+		if _, err := t.expectStatus(revoked.Id, status.STATUS_READY); err != nil {
+			return "", err
+		}
+		return t.interact("POST", revoked.Id, "register", nil, status.STATUS_ACTIVE)
+	})
+	t.step("revoke the second license", func() (string, error) {
+		body := map[string]string{"status": status.STATUS_REVOKED}
+		if _, err := t.call("PATCH", t.lsdURL+"/licenses/"+revoked.Id+"/status", body, &config.Config.LsdNotifyAuth, http.StatusOK); err != nil {
+			return "", err
+		}
+		if _, err := t.expectStatus(revoked.Id, status.STATUS_REVOKED); err != nil {
+			return "", err
+		}
+		return t.expectEnded(revoked.Id)
+	})
+
+	if t.failed {
+		fmt.Println("The end-to-end test failed, the logs of the servers are in " + filepath.Join(dir, "servers.log") + " with -keep, or shown with -v")
+	} else {
+		fmt.Println("The end-to-end test succeeded")
+	}
+	return !t.failed
+}
+
+// call sends a request, with the credentials of a service if given, and returns the body of the response
+// if its status is one of the expected ones
+//
+func (t *harness) call(method, u string, body interface{}, auth *config.Auth, expected ...int) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", api.ContentType_JSON)
+	}
+	if auth != nil {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return data, nil
+		}
+	}
+	return nil, errors.New(method + " " + req.URL.Path + " returned " + strconv.Itoa(resp.StatusCode) + ": " + strings.TrimSpace(string(data)))
+}
+
+// protect encrypts the sample EPUB and adds it to the License Server, as lcpencrypt does
+func (t *harness) protect() (string, error) {
+	sample, err := testsupport.SampleEPUB()
+	if err != nil {
+		return "", err
+	}
+	input := filepath.Join(t.dir, "sample.epub")
+	if err = ioutil.WriteFile(input, sample, 0644); err != nil {
+		return "", err
+	}
+	output := filepath.Join(t.dir, "sample-protected.epub")
+	artifact, err := encrypt.EncryptEpub(input, output)
+	if err != nil {
+		return "", err
+	}
+	if t.protected, err = ioutil.ReadFile(output); err != nil {
+		return "", err
+	}
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	t.contentID = uid.String()
+	disposition := "sample.epub"
+	publication := apilcp.LcpPublication{
+		ContentId:          t.contentID,
+		ContentKey:         artifact.EncryptionKey,
+		Output:             output,
+		Size:               &artifact.Size,
+		Checksum:           &artifact.Checksum,
+		ContentDisposition: &disposition,
+		ContentType:        epub.ContentType_EPUB,
+	}
+	_, err = t.call("PUT", t.lcpURL+"/contents/"+t.contentID, publication, &config.Config.LcpUpdateAuth, http.StatusCreated, http.StatusOK)
+	return t.contentID + ", " + strconv.FormatInt(artifact.Size, 10) + " bytes", err
+}
+
+// loanDays returns the duration of the loans of the test, within the range of the rules of the provider;
+// the loan can be renewed for a day
+func loanDays(rules config.RightsRules) int {
+	days := testLoanDays
+	if rules.MaxLoanDays > 0 && days >= rules.MaxLoanDays {
+		days = rules.MaxLoanDays - 1
+	}
+	if days < rules.MinLoanDays {
+		days = rules.MinLoanDays
+	}
+	return days
+}
+
+// issue generates a license of the sample publication for a user and checks it as a reading system does:
+// its signature and certificate, the user key, and the decryption of the publication
+//
+func (t *harness) issue(userID string) (license.License, error) {
+	// the loan started an hour ago, as the return or the revocation ending it now must end it after its start
+	start := clock.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	end := start.AddDate(0, 0, loanDays(license.RightsRulesOf(t.provider)))
+	print, copy := int32(10), int32(1000)
+	partial := license.License{
+		Provider: t.provider,
+		User:     license.UserInfo{Id: userID, Email: userID + "@example.com", Encrypted: []string{"email"}},
+		Rights:   &license.UserRights{Print: &print, Copy: &copy, Start: &start, End: &end},
+	}
+	partial.Encryption.UserKey = license.UserKey{
+		Key:   license.Key{Algorithm: "http://www.w3.org/2001/04/xmlenc#sha256"},
+		Hint:  "The passphrase of the end-to-end test",
+		Value: verify.UserKey(testPassphrase),
+	}
+	data, err := t.call("POST", t.lcpURL+"/contents/"+t.contentID+"/license", partial, &config.Config.LcpUpdateAuth, http.StatusCreated)
+	if err != nil {
+		return license.License{}, err
+	}
+	var lic license.License
+	if err = json.Unmarshal(data, &lic); err != nil {
+		return license.License{}, err
+	}
+	if lic.Encryption.Profile != license.BASIC_PROFILE {
+		// the user key of the production profiles is not derived from the passphrase by the test
+		return lic, nil
+	}
+	report := verify.Verify(data, verify.Options{Passphrase: testPassphrase, Roots: t.roots, Publication: t.protected})
+	for _, s := range report.Steps {
+		if !s.OK {
+			return lic, errors.New("the license fails the check of its " + s.Name + ": " + s.Detail)
+		}
+	}
+	return lic, nil
+}
+
+// getStatus returns the status document of a license
+func (t *harness) getStatus(licenseID string) (statusDocument, error) {
+	var doc statusDocument
+	data, err := t.call("GET", t.lsdURL+"/licenses/"+licenseID+"/status", nil, nil, http.StatusOK)
+	if err == nil {
+		err = json.Unmarshal(data, &doc)
+	}
+	return doc, err
+}
+
+// expectStatus waits for the status document of a license, created by a notification of the License Server,
+// and checks its status
+//
+func (t *harness) expectStatus(licenseID, expected string) (string, error) {
+	deadline := time.Now().Add(statusTimeout)
+	for {
+		doc, err := t.getStatus(licenseID)
+		if err == nil {
+			if doc.Status != expected {
+				return "", errors.New("the status is " + doc.Status + ", " + expected + " expected")
+			}
+			return "status " + doc.Status, nil
+		}
+		if time.Now().After(deadline) {
+			return "", err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// interact sends an interaction of the test device to the License Status Server and checks the new status
+func (t *harness) interact(method, licenseID, interaction string, params url.Values, expected string) (string, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("id", testDeviceID)
+	params.Set("name", testDeviceName)
+	data, err := t.call(method, t.lsdURL+"/licenses/"+licenseID+"/"+interaction+"?"+params.Encode(), nil, nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	var doc statusDocument
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return "", err
+	}
+	if doc.Status != expected {
+		return "", errors.New("the status is " + doc.Status + " after the " + interaction + ", " + expected + " expected")
+	}
+	return "status " + doc.Status, nil
+}
+
+// getRights returns the rights of a license, as stored by the License Server
+func (t *harness) getRights(licenseID string) (license.UserRights, error) {
+	var lic license.License
+	data, err := t.call("GET", t.lcpURL+"/licenses/"+licenseID, nil, &config.Config.LcpUpdateAuth, http.StatusOK, http.StatusPartialContent)
+	if err == nil {
+		err = json.Unmarshal(data, &lic)
+	}
+	if err == nil && (lic.Rights == nil || lic.Rights.End == nil) {
+		err = errors.New("the license " + licenseID + " has no end")
+	}
+	if err != nil {
+		return license.UserRights{}, err
+	}
+	return *lic.Rights, nil
+}
+
+// renew extends a loan by a day and checks that the License Server has postponed its end
+func (t *harness) renew(loan license.License) (string, error) {
+	requested := loan.Rights.End.AddDate(0, 0, 1)
+	params := url.Values{"end": {requested.Format(time.RFC3339)}}
+	if _, err := t.interact("PUT", loan.Id, "renew", params, status.STATUS_ACTIVE); err != nil {
+		return "", err
+	}
+	rights, err := t.getRights(loan.Id)
+	if err != nil {
+		return "", err
+	}
+	if !rights.End.After(*loan.Rights.End) {
+		return "", errors.New("the end of the license is " + rights.End.Format(time.RFC3339) + ", not postponed")
+	}
+	return "until " + rights.End.UTC().Format(time.RFC3339), nil
+}
+
+// expectEnded checks that the License Server has ended the rights of a license
+func (t *harness) expectEnded(licenseID string) (string, error) {
+	rights, err := t.getRights(licenseID)
+	if err != nil {
+		return "", err
+	}
+	if rights.End.After(clock.Now()) {
+		return "", errors.New("the license still ends on " + rights.End.UTC().Format(time.RFC3339))
+	}
+	return "ended on " + rights.End.UTC().Format(time.RFC3339), nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/audit"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
+	"github.com/readium/readium-lcp-server/feature"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/jobs"
+	"github.com/readium/readium-lcp-server/lcpserver/api"
+	"github.com/readium/readium-lcp-server/lcpserver/server"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/license_statuses"
+	"github.com/readium/readium-lcp-server/lsdserver/server"
+	"github.com/readium/readium-lcp-server/outbox"
+	"github.com/readium/readium-lcp-server/pack"
+	"github.com/readium/readium-lcp-server/storage"
+	"github.com/readium/readium-lcp-server/transactions"
+	"github.com/readium/readium-lcp-server/transport"
+)
+
+// interval between two runs of the re-driver of the lsd notifications, which also runs
+// each time a license is created
+const outboxInterval = time.Second
+
+// servers are the License Server and the License Status Server under test, in this process
+type servers struct {
+	lcp *lcpserver.Server
+	lsd *lsdserver.Server
+	dbs []*sql.DB
+}
+
+// listen opens the listeners of the servers on free local ports
+func listen() (lcpLn net.Listener, lsdLn net.Listener, err error) {
+	if lcpLn, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, nil, err
+	}
+	if lsdLn, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		lcpLn.Close()
+		return nil, nil, err
+	}
+	return lcpLn, lsdLn, nil
+}
+
+// openDB opens the sqlite database of a server
+func openDB(uri string, info config.ServerInfo) (*sql.DB, error) {
+	parts := strings.SplitN(uri, "://", 2)
+	return dbutils.Open(parts[0], parts[1], info)
+}
+
+// startServers starts the License Server and the License Status Server on their listeners,
+// as the lcpserver and lsdserver commands do with the configuration
+//
+func startServers(lcpLn, lsdLn net.Listener, cert *tls.Certificate) (*servers, error) {
+	s := &servers{}
+	lcpDB, err := openDB(config.Config.LcpServer.Database, config.Config.LcpServer)
+	if err != nil {
+		return s, err
+	}
+	s.dbs = append(s.dbs, lcpDB)
+	idx, err := index.Open(lcpDB)
+	if err != nil {
+		return s, err
+	}
+	lst, err := license.NewSqlStore(lcpDB)
+	if err != nil {
+		return s, err
+	}
+	ob, err := outbox.Open(lcpDB)
+	if err != nil {
+		return s, err
+	}
+	al, err := audit.Open(lcpDB)
+	if err != nil {
+		return s, err
+	}
+	fst, err := feature.Open(lcpDB)
+	if err != nil {
+		return s, err
+	}
+	if err = feature.Use(fst); err != nil {
+		return s, err
+	}
+	jst, err := jobs.Open(lcpDB)
+	if err != nil {
+		return s, err
+	}
+	queue := jobs.NewQueue(jst, apilcp.DefaultPackMaxAttempts)
+	license.CreateDefaultLinks()
+	store := storage.WithParts(storage.NewFileSystem(config.Config.Storage.FileSystem.Directory, config.Config.LcpServer.PublicBaseUrl+"/files"),
+		config.Config.Storage.PartSize)
+	packager := pack.NewPackager(store, idx, apilcp.DefaultPackWorkers)
+	lcpAuth := auth.NewBasicAuthenticator("Readium License Content Protection Server", auth.HtpasswdFileProvider(config.Config.LcpServer.AuthFile))
+	s.lcp = lcpserver.New(lcpLn.Addr().String(), "", false, &idx, &store, &lst, &ob, &al, cert, packager, queue, lcpAuth, nil, nil)
+
+	lsdDB, err := openDB(config.Config.LsdServer.Database, config.Config.LsdServer.ServerInfo)
+	if err != nil {
+		return s, err
+	}
+	s.dbs = append(s.dbs, lsdDB)
+	hist, err := licensestatuses.Open(lsdDB)
+	if err != nil {
+		return s, err
+	}
+	trns, err := transactions.Open(lsdDB)
+	if err != nil {
+		return s, err
+	}
+	lsdAuth := auth.NewBasicAuthenticator("Basic Realm", auth.HtpasswdFileProvider(config.Config.LsdServer.AuthFile))
+	s.lsd = lsdserver.New(lsdLn.Addr().String(), false, false, false, &hist, &trns, lsdAuth)
+
+	// the transport of the configuration carries the calls between the servers
+	if err = transport.Serve(config.LcpServerName, s.lcp.Handler); err != nil {
+		return s, err
+	}
+	if err = transport.Serve(config.LsdServerName, s.lsd.Handler); err != nil {
+		return s, err
+	}
+
+	go apilcp.RunOutbox(s.lcp, outboxInterval)
+	go s.lcp.Serve(lcpLn)
+	go s.lsd.Serve(lsdLn)
+	return s, nil
+}
+
+// close stops the servers and closes their databases
+func (s *servers) close() {
+	if s.lcp != nil {
+		s.lcp.Close()
+	}
+	if s.lsd != nil {
+		s.lsd.Close()
+	}
+	for _, db := range s.dbs {
+		db.Close()
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/readium/readium-lcp-server/lcpverify/verify"
+)
+
+func showHelpAndExit() {
+	fmt.Println("lcpverify checks a license as an LCP client does, and decrypts its publication")
+	fmt.Println("usage: lcpverify [options] <license file>")
+	flag.PrintDefaults()
+	os.Exit(0)
+}
+
+// readRoots reads the root certificates from a PEM file
+func readRoots(name string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate in " + name)
+	}
+	return roots, nil
+}
+
+func run() (bool, error) {
+	passphrase := flag.String("passphrase", "", "passphrase of the user")
+	userKey := flag.String("userkey", "", "hex encoded user key, used instead of the passphrase")
+	publication := flag.String("publication", "", "optional protected publication, whose resources are decrypted")
+	root := flag.String("root", "", "optional PEM file of the root certificates of the provider certificate")
+	jsonOutput := flag.Bool("json", false, "prints the report in JSON")
+	help := flag.Bool("help", false, "shows information")
+	flag.Parse()
+	if *help {
+		showHelpAndExit()
+	}
+	if flag.NArg() != 1 {
+		return false, errors.New("the license file is missing, type 'lcpverify -help'")
+	}
+
+	data, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		return false, err
+	}
+	var opts verify.Options
+	opts.Passphrase = *passphrase
+	if *userKey != "" {
+		if opts.UserKey, err = hex.DecodeString(*userKey); err != nil {
+			return false, errors.New("invalid user key: " + err.Error())
+		}
+	}
+	if *root != "" {
+		if opts.Roots, err = readRoots(*root); err != nil {
+			return false, err
+		}
+	}
+	if *publication != "" {
+		if opts.Publication, err = ioutil.ReadFile(*publication); err != nil {
+			return false, err
+		}
+	}
+
+	report := verify.Verify(data, opts)
+	if *jsonOutput {
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		fmt.Println(string(out))
+		return report.OK(), nil
+	}
+	fmt.Println("License: " + report.LicenseId)
+	for _, step := range report.Steps {
+		result := "OK"
+		if !step.OK {
+			result = "FAILED"
+		}
+		line := step.Name + ": " + result
+		if step.Detail != "" {
+			line += " (" + step.Detail + ")"
+		}
+		fmt.Println(line)
+	}
+	return report.OK(), nil
+}
+
+func main() {
+	ok, err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		os.Exit(2)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
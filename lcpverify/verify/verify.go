@@ -0,0 +1,305 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package verify checks a license and its protected publication the way an LCP client does:
+// the signature and the certificate of the provider, the user key derived from the passphrase,
+// the key check, the content key and the decryption of the resources of the publication.
+// It is a reference for the integrators who debug the interoperability of their licenses.
+package verify
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/sign"
+	"github.com/readium/readium-lcp-server/streamer"
+)
+
+// the names of the steps of a verification
+const (
+	StepParse       = "parse"
+	StepSignature   = "signature"
+	StepCertificate = "certificate"
+	StepUserKey     = "user key"
+	StepKeyCheck    = "key check"
+	StepContentKey  = "content key"
+	StepUserInfo    = "user info"
+	StepChecksum    = "checksum"
+	StepResource    = "resource"
+)
+
+// Step is the result of a check
+type Step struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report lists the checks of a license, in the order they were done.
+// The checks stop at the first failure which prevents the next ones.
+type Report struct {
+	LicenseId string `json:"license_id,omitempty"`
+	Steps     []Step `json:"steps"`
+}
+
+// OK checks that all the steps succeeded
+func (r *Report) OK() bool {
+	for _, s := range r.Steps {
+		if !s.OK {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Report) pass(name, detail string) {
+	r.Steps = append(r.Steps, Step{Name: name, OK: true, Detail: detail})
+}
+
+func (r *Report) fail(name, detail string) {
+	r.Steps = append(r.Steps, Step{Name: name, Detail: detail})
+}
+
+// Options are the inputs of a verification, besides the license
+type Options struct {
+	// Passphrase is the passphrase of the user, hashed into the user key
+	Passphrase string
+	// UserKey is the user key, used instead of the passphrase if set
+	UserKey []byte
+	// Roots are the root certificates of the provider certificate; the chain is not checked if nil
+	Roots *x509.CertPool
+	// Publication is the protected publication; only the license is checked if nil
+	Publication []byte
+}
+
+// UserKey derives the user key from a passphrase, as the basic profile defines it
+func UserKey(passphrase string) []byte {
+	hash := sha256.Sum256([]byte(passphrase))
+	return hash[:]
+}
+
+// Verify checks a license, and its publication if one is given
+func Verify(data []byte, opts Options) *Report {
+	report, l := CheckSignature(data, opts.Roots)
+	if l == nil {
+		return report
+	}
+
+	userKey := opts.UserKey
+	switch {
+	case userKey != nil:
+		report.pass(StepUserKey, "given")
+	case l.Encryption.Profile == license.BASIC_PROFILE:
+		userKey = UserKey(opts.Passphrase)
+		report.pass(StepUserKey, "SHA-256 of the passphrase")
+	default:
+		// the transformation of the passphrase is confidential in the production profiles
+		report.fail(StepUserKey, "the user key of profile "+l.Encryption.Profile+" cannot be derived from the passphrase, give the user key")
+		return report
+	}
+
+	decrypter, ok := crypto.NewAESEncrypter_CONTENT_KEY().(crypto.Decrypter)
+	if !ok {
+		report.fail(StepKeyCheck, "the encryption algorithm does not support decryption")
+		return report
+	}
+	var check bytes.Buffer
+	if err := decrypter.Decrypt(userKey, bytes.NewReader(l.Encryption.UserKey.Check), &check); err != nil || check.String() != l.Id {
+		report.fail(StepKeyCheck, "the user key does not decrypt the license id, wrong passphrase or key")
+		return report
+	}
+	report.pass(StepKeyCheck, "")
+
+	var contentKey bytes.Buffer
+	if err := decrypter.Decrypt(userKey, bytes.NewReader(l.Encryption.ContentKey.Value), &contentKey); err != nil {
+		report.fail(StepContentKey, err.Error())
+		return report
+	}
+	if contentKey.Len() != 32 {
+		report.fail(StepContentKey, "the content key is "+strconv.Itoa(contentKey.Len())+" bytes long, 32 expected")
+		return report
+	}
+	report.pass(StepContentKey, l.Encryption.ContentKey.Algorithm)
+
+	checkUserInfo(report, l, userKey)
+
+	if opts.Publication != nil {
+		checkPublication(report, l, opts.Publication, contentKey.Bytes())
+	}
+	return report
+}
+
+// CheckSignature checks the signature of a license and its provider certificate, without its keys:
+// the license is returned if it is signed, nil otherwise
+func CheckSignature(data []byte, roots *x509.CertPool) (*Report, *license.License) {
+	report := &Report{}
+
+	// the license is decoded as a generic document for the signature,
+	// so that the fields unknown to this server are signed too
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		report.fail(StepParse, err.Error())
+		return report, nil
+	}
+	var l license.License
+	if err := json.Unmarshal(data, &l); err != nil {
+		report.fail(StepParse, err.Error())
+		return report, nil
+	}
+	report.LicenseId = l.Id
+	report.pass(StepParse, "profile "+l.Encryption.Profile)
+
+	if l.Signature == nil {
+		report.fail(StepSignature, "the license is not signed")
+		return report, nil
+	}
+	delete(doc, "signature")
+	if err := sign.Verify(doc, *l.Signature); err != nil {
+		report.fail(StepSignature, err.Error())
+		return report, nil
+	}
+	report.pass(StepSignature, l.Signature.Algorithm)
+
+	checkCertificate(report, &l, roots)
+	return report, &l
+}
+
+// checkCertificate checks that the provider certificate was valid when the license was issued or updated,
+// and that it is issued by one of the root certificates
+func checkCertificate(report *Report, l *license.License, roots *x509.CertPool) {
+	cert, err := x509.ParseCertificate(l.Signature.Certificate)
+	if err != nil {
+		report.fail(StepCertificate, err.Error())
+		return
+	}
+	date := l.Issued
+	if l.Updated != nil {
+		date = *l.Updated
+	}
+	if date.Before(cert.NotBefore) || date.After(cert.NotAfter) {
+		report.fail(StepCertificate, cert.Subject.String()+" was not valid on "+date.UTC().Format(time.RFC3339))
+		return
+	}
+	if roots == nil {
+		report.pass(StepCertificate, cert.Subject.String()+", chain not checked")
+		return
+	}
+	// the intermediate certificates of the chain are embedded in the signature
+	intermediates := x509.NewCertPool()
+	for _, der := range l.Signature.Chain {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			report.fail(StepCertificate, "certificate chain: "+err.Error())
+			return
+		}
+		intermediates.AddCert(c)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   date,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		report.fail(StepCertificate, err.Error())
+		return
+	}
+	report.pass(StepCertificate, cert.Subject.String())
+}
+
+// checkUserInfo decrypts the encrypted fields of the user info
+func checkUserInfo(report *Report, l *license.License, userKey []byte) {
+	if len(l.User.Encrypted) == 0 {
+		return
+	}
+	fields := map[string]string{"email": l.User.Email, "name": l.User.Name}
+	for _, name := range l.User.Encrypted {
+		value, ok := fields[name]
+		if !ok {
+			report.fail(StepUserInfo, "unknown encrypted field "+name)
+			continue
+		}
+		clear, err := license.DecryptUserField(userKey, value)
+		if err != nil {
+			report.fail(StepUserInfo, name+": "+err.Error())
+			continue
+		}
+		report.pass(StepUserInfo, name+": "+clear)
+	}
+}
+
+// checkPublication checks the publication against its link in the license,
+// then decrypts all its encrypted resources
+func checkPublication(report *Report, l *license.License, data []byte, contentKey []byte) {
+	for _, link := range l.Links {
+		if link.Rel != "publication" {
+			continue
+		}
+		if link.Size != 0 && link.Size != int64(len(data)) {
+			report.fail(StepChecksum, "the publication is "+strconv.Itoa(len(data))+" bytes long, "+strconv.FormatInt(link.Size, 10)+" in the license")
+		}
+		if link.Checksum != "" {
+			hash := sha256.Sum256(data)
+			if hex.EncodeToString(hash[:]) != link.Checksum {
+				report.fail(StepChecksum, "the SHA-256 of the publication differs from the hash in the license")
+			} else {
+				report.pass(StepChecksum, link.Checksum)
+			}
+		}
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		report.fail(StepResource, err.Error())
+		return
+	}
+	pub, err := streamer.Open(zr, contentKey)
+	if err != nil {
+		report.fail(StepResource, err.Error())
+		return
+	}
+	decrypted := 0
+	for _, res := range pub.Resources() {
+		if !res.Encrypted {
+			continue
+		}
+		if err = readResource(pub, res.Path); err != nil {
+			report.fail(StepResource, res.Path+": "+err.Error())
+			continue
+		}
+		decrypted++
+	}
+	if decrypted == 0 {
+		report.fail(StepResource, "no encrypted resource in the publication")
+		return
+	}
+	report.pass(StepResource, strconv.Itoa(decrypted)+" encrypted resources decrypted")
+}
+
+// readResource decrypts and inflates a resource of the publication
+func readResource(pub *streamer.Publication, path string) error {
+	_, rc, err := pub.Open(path)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(ioutil.Discard, rc)
+	if err != nil {
+		return errors.New("the resource does not decrypt or inflate: " + err.Error())
+	}
+	return nil
+}
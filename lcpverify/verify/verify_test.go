@@ -0,0 +1,165 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package verify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/testsupport"
+)
+
+// protect generates a protected publication and a license for it, signed by a provider certificate of a CA
+func protect(t *testing.T, passphrase string) ([]byte, []byte, *testsupport.CA) {
+	ca, err := testsupport.NewCA(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.ProviderCertificate("provider", testsupport.RSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, pub := protectWith(t, passphrase, cert)
+	return data, pub, ca
+}
+
+// protectWith generates a protected publication and a license for it, signed by a certificate
+func protectWith(t *testing.T, passphrase string, cert *tls.Certificate) ([]byte, []byte) {
+	pub, err := testsupport.ProtectedEPUB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := index.Content{Id: "content", EncryptionKey: pub.ContentKey, Sha256: pub.Sha256, Length: int64(len(pub.Data))}
+
+	l := license.License{
+		Provider: "provider",
+		Id:       "license",
+		Issued:   time.Now().UTC().Truncate(time.Second),
+		User:     license.UserInfo{Id: "user", Email: "user@example.com", Encrypted: []string{"email"}},
+		Links: []license.Link{{Rel: "publication", Href: "http://example.com/content",
+			Checksum: content.Sha256, Size: content.Length}},
+	}
+	l.Encryption.Profile = license.BASIC_PROFILE
+	l.Encryption.UserKey.Value = UserKey(passphrase)
+	if err = license.EncryptLicenseFields(&l, content); err != nil {
+		t.Fatal(err)
+	}
+	if err = license.SignLicense(&l, cert); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, pub.Data
+}
+
+func failedStep(r *Report) string {
+	for _, s := range r.Steps {
+		if !s.OK {
+			return s.Name
+		}
+	}
+	return ""
+}
+
+func TestVerify(t *testing.T) {
+	data, pub, ca := protect(t, "secret")
+
+	report := Verify(data, Options{Passphrase: "secret", Publication: pub, Roots: ca.Pool()})
+	if !report.OK() {
+		t.Fatalf("Expected the license to be valid, got %+v", report.Steps)
+	}
+	last := report.Steps[len(report.Steps)-1]
+	if last.Name != StepResource {
+		t.Errorf("Expected the resources to be decrypted, got %+v", report.Steps)
+	}
+
+	other, err := testsupport.NewCA(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = Verify(data, Options{Passphrase: "secret", Roots: other.Pool()})
+	if step := failedStep(report); step != StepCertificate {
+		t.Errorf("Expected the certificate chain to fail with another CA, got %+v", report.Steps)
+	}
+
+	report = Verify(data, Options{Passphrase: "wrong"})
+	if step := failedStep(report); step != StepKeyCheck {
+		t.Errorf("Expected the key check to fail with a wrong passphrase, got %+v", report.Steps)
+	}
+
+	tampered := bytes.Replace(data, []byte(`"provider":"provider"`), []byte(`"provider":"other"`), 1)
+	report = Verify(tampered, Options{Passphrase: "secret"})
+	if step := failedStep(report); step != StepSignature {
+		t.Errorf("Expected the signature to fail on a modified license, got %+v", report.Steps)
+	}
+
+	pub[len(pub)/2] ^= 0xFF
+	report = Verify(data, Options{Passphrase: "secret", Publication: pub})
+	if step := failedStep(report); step != StepChecksum {
+		t.Errorf("Expected the checksum to fail on a modified publication, got %+v", report.Steps)
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	root, err := testsupport.NewCA(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, err := root.Intermediate("LCP Test Intermediate CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := intermediate.ProviderCertificate("provider", testsupport.ECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := protectWith(t, "secret", cert)
+
+	// the intermediate certificate embedded in the signature links the certificate to the root
+	report := Verify(data, Options{Passphrase: "secret", Roots: root.Pool()})
+	if !report.OK() {
+		t.Errorf("Expected the certificate to be verified through the embedded chain, got %+v", report.Steps)
+	}
+	unchained := bytes.Replace(data, []byte(`"certificate_chain"`), []byte(`"other_chain"`), 1)
+	report = Verify(unchained, Options{Passphrase: "secret", Roots: root.Pool()})
+	if step := failedStep(report); step != StepCertificate {
+		t.Errorf("Expected the certificate to fail without its chain, got %+v", report.Steps)
+	}
+}
+
+func TestUserInfo(t *testing.T) {
+	l := license.License{Id: "license", User: license.UserInfo{Id: "user", Email: "user@example.com", Name: "User",
+		Encrypted: []string{"email"}}}
+	// the server encrypts the name in addition to the email listed by the caller
+	license.AddEncryptedFields(&l.User, []string{"email", "name"})
+	l.Encryption.UserKey.Value = UserKey("secret")
+	if err := license.EncryptLicenseFields(&l, index.Content{EncryptionKey: make([]byte, 32)}); err != nil {
+		t.Fatal(err)
+	}
+	if l.User.Email == "user@example.com" || l.User.Name == "User" {
+		t.Fatalf("Expected the user fields to be encrypted, got %+v", l.User)
+	}
+
+	report := &Report{}
+	checkUserInfo(report, &l, UserKey("secret"))
+	if !report.OK() || len(report.Steps) != 2 {
+		t.Errorf("Expected the email and name to be decrypted, got %+v", report.Steps)
+	}
+	if err := license.DecryptUserInfo(&l.User, UserKey("secret")); err != nil || l.User.Name != "User" || l.User.Encrypted != nil {
+		t.Errorf("Unexpected user info %+v %v", l.User, err)
+	}
+
+	l.User.Encrypted = []string{"id"}
+	if err := license.CheckEncryptedFields(l.User); err != license.ErrUnknownUserField {
+		t.Errorf("Expected the user id not to be encrypted, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"errors"
+)
+
+// ErrRightsExceeded is returned when a reported consumption exceeds the rights granted by a license
+var ErrRightsExceeded = errors.New("The consumption exceeds the rights granted by the license")
+
+// RightAllowance is the consumption of a print or copy right; a right without granted amount is not limited
+type RightAllowance struct {
+	Granted   *int32 `json:"granted,omitempty"`
+	Used      int32  `json:"used"`
+	Remaining *int32 `json:"remaining,omitempty"`
+}
+
+// Allowance is the consumption of the print and copy rights of a license, reported by the reading systems
+type Allowance struct {
+	LicenseId string         `json:"id"`
+	Print     RightAllowance `json:"print"`
+	Copy      RightAllowance `json:"copy"`
+}
+
+func newRightAllowance(granted *int32, used int32) RightAllowance {
+	a := RightAllowance{Granted: granted, Used: used}
+	if granted != nil {
+		remaining := *granted - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		a.Remaining = &remaining
+	}
+	return a
+}
+
+// GetAllowance returns the consumption of the print and copy rights of a license
+//
+func (s *sqlStore) GetAllowance(id string) (Allowance, error) {
+	var a Allowance
+	var print, copy *int32
+	var printUsed, copyUsed int32
+	err := s.getallowance.QueryRow(id).Scan(&a.LicenseId, &print, &copy, &printUsed, &copyUsed)
+	if err != nil {
+		return a, wrap("get allowance", err)
+	}
+	a.Print = newRightAllowance(print, printUsed)
+	a.Copy = newRightAllowance(copy, copyUsed)
+	return a, nil
+}
+
+// Consume adds an amount of pages printed and characters copied to the consumption of a license,
+// if it stays within the granted rights; the consumption is updated in a single conditional statement,
+// which is safe when several devices report at the same time.
+//
+func (s *sqlStore) Consume(id string, print int32, copy int32) (Allowance, error) {
+	res, err := s.consume.Exec(print, copy, id, print, copy)
+	if err != nil {
+		return Allowance{}, wrap("consume rights", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// the license does not exist, or the rights would be exceeded
+		a, err := s.GetAllowance(id)
+		if err != nil {
+			return a, err
+		}
+		return a, ErrRightsExceeded
+	}
+	return s.GetAllowance(id)
+}
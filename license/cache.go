@@ -0,0 +1,116 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"time"
+
+	"github.com/readium/readium-lcp-server/cache"
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// cachedStore reads the licenses through a cache; updates invalidate the cached entries.
+// Lists are not cached. The signed licenses are cached if the configuration enables it.
+type cachedStore struct {
+	Store
+	cache  cache.Cache
+	signed bool
+}
+
+// NewCachedStore returns a store which caches the reads of the store given as a parameter
+func NewCachedStore(s Store, c cache.Cache) Store {
+	return cachedStore{Store: s, cache: c, signed: config.Config.Cache.SignedLicenses}
+}
+
+// invalidate removes the cached entries of a license
+func (s cachedStore) invalidate(id string) {
+	s.cache.Delete(licenseKey(id))
+	s.cache.Delete(signedKey(id))
+}
+
+func licenseKey(id string) string {
+	return "lcp:license:" + id
+}
+
+func keysKey(id string) string {
+	return "lcp:license-keys:" + id
+}
+
+func (s cachedStore) Get(id string) (License, error) {
+	var l License
+	if cache.GetObject(s.cache, licenseKey(id), &l) {
+		// an empty set of rights is not kept by the encoding
+		if l.Rights == nil {
+			l.Rights = new(UserRights)
+		}
+		return l, nil
+	}
+	l, err := s.Store.Get(id)
+	if err == nil {
+		cache.SetObject(s.cache, licenseKey(id), l)
+	}
+	return l, err
+}
+
+func (s cachedStore) Update(l License) error {
+	err := s.Store.Update(l)
+	s.invalidate(l.Id)
+	return err
+}
+
+func (s cachedStore) UpdateIfMatch(l License, etag string) error {
+	err := s.Store.UpdateIfMatch(l, etag)
+	s.invalidate(l.Id)
+	return err
+}
+
+func (s cachedStore) UpdateRights(l License) error {
+	err := s.Store.UpdateRights(l)
+	s.invalidate(l.Id)
+	return err
+}
+
+func (s cachedStore) UpdateLsdStatus(id string, status int32) error {
+	err := s.Store.UpdateLsdStatus(id, status)
+	s.invalidate(id)
+	return err
+}
+
+func (s cachedStore) EraseUser(userID string, pseudonym string) ([]string, error) {
+	ids, err := s.Store.EraseUser(userID, pseudonym)
+	for _, id := range ids {
+		s.invalidate(id)
+		s.cache.Delete(keysKey(id))
+	}
+	return ids, err
+}
+
+// PurgeExpired removes all the licenses from the cache after a purge, as the purged licenses are not listed
+func (s cachedStore) PurgeExpired(before time.Time, archive bool, dryRun bool) (int64, error) {
+	n, err := s.Store.PurgeExpired(before, archive, dryRun)
+	if err == nil && !dryRun && n > 0 {
+		s.cache.DeletePrefix("lcp:license")
+	}
+	return n, err
+}
+
+func (s cachedStore) GetKeys(id string) (Keys, error) {
+	var k Keys
+	if cache.GetObject(s.cache, keysKey(id), &k) {
+		return k, nil
+	}
+	k, err := s.Store.GetKeys(id)
+	if err == nil {
+		cache.SetObject(s.cache, keysKey(id), k)
+	}
+	return k, err
+}
+
+func (s cachedStore) SaveKeys(id string, k Keys) error {
+	err := s.Store.SaveKeys(id, k)
+	s.cache.Delete(keysKey(id))
+	s.cache.Delete(signedKey(id))
+	return err
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/cache"
+)
+
+func TestCachedPurge(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	st, err := NewSqlStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := NewCachedStore(st, cache.NewLRU(10, time.Minute))
+
+	end := time.Now().Add(-48 * time.Hour).UTC().Truncate(time.Second)
+	l := License{Provider: "http://example.com", Rights: &UserRights{End: &end}}
+	Initialize("c1", &l)
+	if err = cached.Add(l); err != nil {
+		t.Fatal(err)
+	}
+	// the license is cached
+	if _, err = cached.Get(l.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// a dry run keeps the license
+	if n, err := cached.PurgeExpired(time.Now(), false, true); err != nil || n != 1 {
+		t.Fatalf("Expected 1 license to purge, got %d (%v)", n, err)
+	}
+	if _, err = cached.Get(l.Id); err != nil {
+		t.Errorf("Expected the license to be kept, got %v", err)
+	}
+	if n, err := cached.PurgeExpired(time.Now(), false, false); err != nil || n != 1 {
+		t.Fatalf("Expected 1 license to be purged, got %d (%v)", n, err)
+	}
+	if _, err = cached.Get(l.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the purged license not to be found, got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned when a pagination cursor cannot be decoded
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// Cursor is the position of a license in the ante-chronological list of licenses.
+// The licenses are sorted by issue date then by id, so that the position is unique;
+// the zero cursor is the start of the list.
+type Cursor struct {
+	Issued time.Time
+	Id     string
+}
+
+// CursorOf returns the position of a license in the list
+func CursorOf(l LicenseReport) Cursor {
+	return Cursor{Issued: l.Issued, Id: l.Id}
+}
+
+// IsZero checks if the cursor is the start of the list
+func (c Cursor) IsZero() bool {
+	return c.Issued.IsZero() && c.Id == ""
+}
+
+// String encodes the cursor as an opaque value, usable in a url
+func (c Cursor) String() string {
+	if c.IsZero() {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Issued.UTC().Format(time.RFC3339Nano) + " " + c.Id))
+}
+
+// ParseCursor decodes a cursor; an empty value is the start of the list
+func ParseCursor(value string) (Cursor, error) {
+	if value == "" {
+		return Cursor{}, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(decoded), " ", 2)
+	if len(parts) != 2 {
+		return Cursor{}, ErrInvalidCursor
+	}
+	issued, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return Cursor{Issued: issued, Id: parts[1]}, nil
+}
+
+// firstPageBound is a position before all the licenses, the bound of the first page
+var firstPageBound = Cursor{Issued: time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)}
@@ -0,0 +1,52 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ETag returns the entity tag of a license as stored in the database.
+// It changes each time the user, the provider, the content or the rights of the license are updated,
+// and lets concurrent admin tools detect that a license was modified since they read it.
+//
+func ETag(l License) string {
+	var rights UserRights
+	if l.Rights != nil {
+		rights = *l.Rights
+	}
+	fields := []string{
+		l.Id, l.User.Id, l.Provider, l.ContentId,
+		formatTime(&l.Issued), formatTime(l.Updated),
+		formatInt(rights.Print), formatInt(rights.Copy),
+		formatTime(rights.Start), formatTime(rights.End),
+	}
+	// the links set by the provider, if any, so that the tag of the licenses without links is unchanged
+	if len(l.Links) > 0 {
+		links, _ := json.Marshal(l.Links)
+		fields = append(fields, string(links))
+	}
+	hash := sha256.Sum256([]byte(strings.Join(fields, "\n")))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func formatInt(i *int32) string {
+	if i == nil {
+		return ""
+	}
+	return strconv.FormatInt(int64(*i), 10)
+}
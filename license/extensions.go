@@ -0,0 +1,90 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/url"
+
+	"github.com/readium/readium-lcp-server/sign"
+)
+
+// MaxExtensionsSize is the max size of the extensions of a license, in their JSON form
+const MaxExtensionsSize = 8192
+
+// ErrInvalidExtensions is returned when the extensions of a license cannot be signed
+var ErrInvalidExtensions = errors.New("The extensions of the license must be named by URIs, be valid JSON and fit in 8 KiB")
+
+// Extensions are the members added to a license by its provider, e.g. an order id or a subscription
+// reference. As allowed by the LCP specification, they are named by URIs, so that they never clash
+// with the members of the specification, and they are signed with the license.
+type Extensions map[string]json.RawMessage
+
+// IsExtensionName checks if the name of a member of a license is a URI, i.e. the name of an extension
+func IsExtensionName(name string) bool {
+	u, err := url.Parse(name)
+	return err == nil && u.IsAbs()
+}
+
+// CheckExtensions checks that the extensions of a license are named by URIs,
+// and that their values can be canonicalized for the signature
+func CheckExtensions(e Extensions) error {
+	size := 0
+	for name, value := range e {
+		if !IsExtensionName(name) {
+			return ErrInvalidExtensions
+		}
+		if _, err := sign.CanonJSON(value); err != nil {
+			return ErrInvalidExtensions
+		}
+		size += len(name) + len(value)
+	}
+	if size > MaxExtensionsSize {
+		return ErrInvalidExtensions
+	}
+	return nil
+}
+
+// MarshalJSON encodes a license with its extensions, which are then part of its canonical form
+func (l License) MarshalJSON() ([]byte, error) {
+	// the alias type has the fields of License, without its methods
+	type license License
+	data, err := json.Marshal(license(l))
+	if err != nil || len(l.Extensions) == 0 {
+		return data, err
+	}
+	members := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(data, &members); err != nil {
+		return nil, err
+	}
+	for name, value := range l.Extensions {
+		// the members of the specification are kept
+		if _, ok := members[name]; !ok {
+			members[name] = value
+		}
+	}
+	return json.Marshal(members)
+}
+
+// extensionsValue returns the extensions of a license as stored in the database, nil if there are none
+func extensionsValue(e Extensions) (interface{}, error) {
+	if len(e) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(e)
+	return string(data), err
+}
+
+// scanExtensions returns the extensions of a license stored in the database
+func scanExtensions(value sql.NullString) (Extensions, error) {
+	if !value.Valid || value.String == "" {
+		return nil, nil
+	}
+	var e Extensions
+	err := json.Unmarshal([]byte(value.String), &e)
+	return e, err
+}
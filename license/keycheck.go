@@ -0,0 +1,97 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/readium/readium-lcp-server/crypto"
+)
+
+// ErrKeyCheckMismatch is returned when a user key does not decrypt the key check of a license into its id
+var ErrKeyCheckMismatch = errors.New("The user key does not match the key check of the license")
+
+// BuildKeyCheck returns the key check of a license: its id encrypted with the user key,
+// derived from the passphrase hash as defined by the profile
+func BuildKeyCheck(licenseID string, profile string, key UserKey) ([]byte, error) {
+	userKey, err := GenerateUserKey(profile, key)
+	if err != nil {
+		return nil, err
+	}
+	return buildKeyCheck(licenseID, crypto.NewAESEncrypter_USER_KEY_CHECK(), userKey)
+}
+
+// CheckKeyCheck checks that the user key, derived from the passphrase hash as defined by the profile,
+// decrypts the key check of a license into its id
+func CheckKeyCheck(licenseID string, profile string, key UserKey, check []byte) error {
+	userKey, err := GenerateUserKey(profile, key)
+	if err != nil {
+		return err
+	}
+	return checkKeyCheck(licenseID, userKey, check)
+}
+
+func checkKeyCheck(licenseID string, userKey []byte, check []byte) error {
+	decrypter, ok := crypto.NewAESEncrypter_USER_KEY_CHECK().(crypto.Decrypter)
+	if !ok {
+		return errors.New("The key check algorithm does not support decryption")
+	}
+	var out bytes.Buffer
+	if err := decrypter.Decrypt(userKey, bytes.NewReader(check), &out); err != nil || out.String() != licenseID {
+		return ErrKeyCheckMismatch
+	}
+	return nil
+}
+
+// RotateUserKey returns the keys of a license encrypted with a new user key, e.g. after a change of the passphrase of the user:
+// the previous passphrase hash must match the key check; the content key, the encrypted user fields and the key check
+// are encrypted again with the new user key, which gets the new hint. The passphrase hashes are not kept.
+func (k Keys) RotateUserKey(licenseID string, previous UserKey, next UserKey) (Keys, error) {
+	profile := k.Encryption.Profile
+	previous.Algorithm = k.Encryption.UserKey.Algorithm
+	previousKey, err := GenerateUserKey(profile, previous)
+	if err != nil {
+		return Keys{}, err
+	}
+	if err = checkKeyCheck(licenseID, previousKey, k.Encryption.UserKey.Check); err != nil {
+		return Keys{}, err
+	}
+	// the hash algorithm of the new passphrase is the algorithm of the license, known to the reading systems
+	next.Algorithm = k.Encryption.UserKey.Algorithm
+	nextKey, err := GenerateUserKey(profile, next)
+	if err != nil {
+		return Keys{}, err
+	}
+
+	decrypter, ok := crypto.NewAESEncrypter_CONTENT_KEY().(crypto.Decrypter)
+	if !ok {
+		return Keys{}, errors.New("The content key algorithm does not support decryption")
+	}
+	var contentKey bytes.Buffer
+	if err = decrypter.Decrypt(previousKey, bytes.NewReader(k.Encryption.ContentKey.Value), &contentKey); err != nil {
+		return Keys{}, err
+	}
+	rotated := k
+	rotated.Encryption.ContentKey.Value = encryptKey(crypto.NewAESEncrypter_CONTENT_KEY(), contentKey.Bytes(), nextKey)
+	for _, name := range k.User.Encrypted {
+		field := userField(&rotated.User, name)
+		value, err := DecryptUserField(previousKey, *field)
+		if err != nil {
+			return Keys{}, err
+		}
+		if *field, err = EncryptUserField(nextKey, value); err != nil {
+			return Keys{}, err
+		}
+	}
+	rotated.Encryption.UserKey.Check, err = buildKeyCheck(licenseID, crypto.NewAESEncrypter_USER_KEY_CHECK(), nextKey)
+	if err != nil {
+		return Keys{}, err
+	}
+	if next.Hint != "" {
+		rotated.Encryption.UserKey.Hint = next.Hint
+	}
+	return rotated, nil
+}
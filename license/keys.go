@@ -0,0 +1,68 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"encoding/json"
+
+	"github.com/readium/readium-lcp-server/dbutils"
+)
+
+// ErrKeysNotFound is returned when no license was delivered yet with a user key
+var ErrKeysNotFound = dbutils.NewError(ErrNotFound, "The license has not been delivered yet")
+
+// Keys are the fields of the last license delivered to a user which depend on its user key:
+// the content key encrypted with the user key, the key check and the encrypted user fields.
+// They let the server deliver the license again, e.g. with updated rights, without the passphrase
+// of the user. The passphrase hash itself is never kept.
+type Keys struct {
+	Encryption Encryption `json:"encryption"`
+	User       UserInfo   `json:"user"`
+}
+
+// KeysOf returns the keys of a license delivered to a user
+func KeysOf(l License) Keys {
+	k := Keys{Encryption: l.Encryption, User: l.User}
+	k.Encryption.UserKey.Value = nil
+	k.Encryption.UserKey.HexValue = ""
+	return k
+}
+
+// Apply sets the keys of a license
+func (k Keys) Apply(l *License) {
+	l.Encryption = k.Encryption
+	l.User = k.User
+}
+
+// SaveKeys keeps the keys of the last license delivered to the user
+func (s *sqlStore) SaveKeys(id string, k Keys) error {
+	doc, err := json.Marshal(k)
+	if err != nil {
+		return wrap("save license keys", err)
+	}
+	_, err = s.savekeys.Exec(id, string(doc))
+	return wrap("save license keys", err)
+}
+
+// GetKeys returns the keys of the last license delivered to the user
+func (s *sqlStore) GetKeys(id string) (Keys, error) {
+	var doc string
+	err := s.getkeys.QueryRow(id).Scan(&doc)
+	if err != nil {
+		return Keys{}, dbutils.Wrap("get license keys", err, ErrKeysNotFound, ErrConflict, ErrStorage)
+	}
+	var k Keys
+	if err = json.Unmarshal([]byte(doc), &k); err != nil {
+		return Keys{}, wrap("get license keys", err)
+	}
+	return k, nil
+}
+
+const keysTableDef = "CREATE TABLE IF NOT EXISTS license_keys (" +
+	"license_id varchar(255) PRIMARY KEY," +
+	"document text NOT NULL)"
+
+var keysTableDefMySQL = dbutils.MySQLTable{Name: "license_keys", Definition: "`license_id` varchar(255) NOT NULL PRIMARY KEY," +
+	"`document` text NOT NULL"}
@@ -9,16 +9,17 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/tls"
-	"encoding/base64"
 	"fmt"
 	"io"
-	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/clock"
 	"github.com/readium/readium-lcp-server/config"
 	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/feature"
 	"github.com/readium/readium-lcp-server/index"
 	"github.com/readium/readium-lcp-server/sign"
 )
@@ -77,6 +78,9 @@ const V1_PROFILE = "http://readium.org/lcp/profile-1.0"
 
 var DefaultLinks map[string]string
 
+// linksMutex protects DefaultLinks, which are replaced on a configuration reload
+var linksMutex sync.RWMutex
+
 type License struct {
 	Provider   string          `json:"provider"`
 	Id         string          `json:"id"`
@@ -88,6 +92,13 @@ type License struct {
 	Rights     *UserRights     `json:"rights,omitempty"`
 	Signature  *sign.Signature `json:"signature,omitempty"`
 	ContentId  string          `json:"-"`
+	Tenant     string          `json:"-"`
+	// the version of the content the license is issued for, 0 for the current version
+	ContentVersion int `json:"-"`
+	// the members added by the provider, named by URIs
+	Extensions Extensions `json:"-"`
+	// the external reference of the license, e.g. the number of the order it was issued for
+	Reference string `json:"-"`
 }
 
 type LicenseReport struct {
@@ -98,6 +109,8 @@ type LicenseReport struct {
 	User      UserInfo    `json:"user,omitempty"`
 	Rights    *UserRights `json:"rights"`
 	ContentId string      `json:"-"`
+	Tenant    string      `json:"-"`
+	Reference string      `json:"reference,omitempty"`
 }
 
 // source: http://play.golang.org/p/4FkNSiUDMg
@@ -122,28 +135,41 @@ func Initialize(contentID string, l *License) {
 	uuid, _ := newUUID()
 	l.Id = uuid
 	// issued datetime is now
-	l.Issued = time.Now().UTC().Truncate(time.Second)
+	l.Issued = clock.Now().UTC().Truncate(time.Second)
 	// set the content id
 	l.ContentId = contentID
 }
 
-// SetLicenseProfile sets the license profile from config
+// SetLicenseProfile sets the license profile from config,
+// or the 1.0 profile if it is rolled out to the provider of the license
 //
 func SetLicenseProfile(l *License) {
+	profile := config.Config.Profile
+	if feature.Enabled(feature.Profile10, l.Provider) {
+		profile = "1.0"
+	}
+	l.Encryption.Profile = ProfileURI(profile)
+}
+
+// ProfileURI returns the URI of a profile of the configuration
+//
+func ProfileURI(profile string) string {
 	// possible profiles are basic and 1.0
-	if config.Config.Profile == "1.0" {
-		l.Encryption.Profile = V1_PROFILE
-	} else {
-		l.Encryption.Profile = BASIC_PROFILE
+	if profile == "1.0" {
+		return V1_PROFILE
 	}
+	return BASIC_PROFILE
 }
 
 // CreateDefaultLinks inits the global var DefaultLinks from config data
 // ... DefaultLinks used in several places.
+// It is called again when the configuration is reloaded.
 //
 func CreateDefaultLinks() {
-	configLinks := config.Config.License.Links
+	configLinks := config.LicenseLinks()
 
+	linksMutex.Lock()
+	defer linksMutex.Unlock()
 	DefaultLinks = make(map[string]string)
 
 	for key := range configLinks {
@@ -154,6 +180,8 @@ func CreateDefaultLinks() {
 // SetDefaultLinks sets a Link array from config links
 //
 func SetDefaultLinks() []Link {
+	linksMutex.RLock()
+	defer linksMutex.RUnlock()
 	links := new([]Link)
 	for key := range DefaultLinks {
 		link := Link{Href: DefaultLinks[key], Rel: key}
@@ -166,16 +194,44 @@ func SetDefaultLinks() []Link {
 // l.ContentId must have been set before the call
 //
 func SetLicenseLinks(l *License, c index.Content) error {
+	return SetLicenseLinksWith(l, c, nil)
+}
+
+// SetLicenseLinksWith sets the links like SetLicenseLinks; the links given replace
+// the default links of the same relation, or are added to them
+//
+func SetLicenseLinksWith(l *License, c index.Content, links map[string]string) error {
 	// set the links
 	l.Links = SetDefaultLinks()
+	for rel, href := range links {
+		replaced := false
+		for i := range l.Links {
+			if l.Links[i].Rel == rel {
+				l.Links[i].Href = href
+				replaced = true
+			}
+		}
+		if !replaced {
+			l.Links = append(l.Links, Link{Rel: rel, Href: href})
+		}
+	}
 
 	for i := 0; i < len(l.Links); i++ {
 		// publication link
 		if l.Links[i].Rel == "publication" {
-			l.Links[i].Href = strings.Replace(l.Links[i].Href, "{publication_id}", l.ContentId, 1)
+			// the file of a previous version of the content is kept under its own key
+			publicationID := l.ContentId
+			if c.Archived {
+				publicationID = index.StorageKey(c)
+			}
+			l.Links[i].Href = strings.Replace(l.Links[i].Href, "{publication_id}", publicationID, 1)
 			l.Links[i].Type = c.Type
 			l.Links[i].Size = c.Length
+			// the title of the content if known, else its file name
 			l.Links[i].Title = c.Location
+			if c.Title != "" {
+				l.Links[i].Title = c.Title
+			}
 			l.Links[i].Checksum = c.Sha256
 		}
 		// status link
@@ -193,7 +249,10 @@ func SetLicenseLinks(l *License, c index.Content) error {
 func EncryptLicenseFields(l *License, c index.Content) error {
 
 	// generate the user key
-	encryptionKey := GenerateUserKey(l.Encryption.UserKey)
+	encryptionKey, err := GenerateUserKey(l.Encryption.Profile, l.Encryption.UserKey)
+	if err != nil {
+		return err
+	}
 
 	// empty the passphrase hash to avoid sending it back to the user
 	l.Encryption.UserKey.Value = nil
@@ -205,8 +264,7 @@ func EncryptLicenseFields(l *License, c index.Content) error {
 	l.Encryption.ContentKey.Value = encryptKey(encrypterContentKey, c.EncryptionKey, encryptionKey[:])
 
 	// encrypt the user info fields
-	encrypterFields := crypto.NewAESEncrypter_FIELDS()
-	err := encryptFields(encrypterFields, l, encryptionKey[:])
+	err = encryptFields(l, encryptionKey[:])
 	if err != nil {
 		return err
 	}
@@ -227,24 +285,21 @@ func encryptKey(encrypter crypto.Encrypter, key []byte, kek []byte) []byte {
 	return out.Bytes()
 }
 
-func encryptFields(encrypter crypto.Encrypter, l *License, key []byte) error {
-	for _, toEncrypt := range l.User.Encrypted {
-		var out bytes.Buffer
-		field := getField(&l.User, toEncrypt)
-		err := encrypter.Encrypt(key[:], bytes.NewBufferString(field.String()), &out)
+func encryptFields(l *License, key []byte) error {
+	if err := CheckEncryptedFields(l.User); err != nil {
+		return err
+	}
+	for _, name := range l.User.Encrypted {
+		field := userField(&l.User, name)
+		encrypted, err := EncryptUserField(key, *field)
 		if err != nil {
 			return err
 		}
-		field.Set(reflect.ValueOf(base64.StdEncoding.EncodeToString(out.Bytes())))
+		*field = encrypted
 	}
 	return nil
 }
 
-func getField(u *UserInfo, field string) reflect.Value {
-	v := reflect.ValueOf(u).Elem()
-	return v.FieldByName(strings.Title(field))
-}
-
 // buildKeyCheck
 // encrypt the license id with the key used for encrypting content
 //
@@ -257,14 +312,11 @@ func buildKeyCheck(licenseID string, encrypter crypto.Encrypter, key []byte) ([]
 	return out.Bytes(), nil
 }
 
-// SignLicense signs a license using the server certificate
+// SignLicense signs a license using the server certificate,
+// through the pool of signers of the server
 //
 func SignLicense(l *License, cert *tls.Certificate) error {
-	sig, err := sign.NewSigner(cert)
-	if err != nil {
-		return err
-	}
-	res, err := sig.Sign(l)
+	res, err := sign.Sign(cert, l)
 	if err != nil {
 		return err
 	}
@@ -26,8 +26,11 @@
 package license
 
 import (
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/readium/readium-lcp-server/clock"
 	"github.com/readium/readium-lcp-server/config"
 )
 
@@ -48,3 +51,91 @@ func TestLicense(t *testing.T) {
 		t.Error("Expected %s, got %s", profile, l.Encryption.Profile)
 	}
 }
+
+func TestIssued(t *testing.T) {
+	// the issue date is the time of the clock, in UTC whatever the timezone of the server
+	montreal := time.FixedZone("EST", -5*3600)
+	defer clock.Set(clock.NewFake(time.Date(2021, 12, 31, 21, 30, 15, 500, montreal)))()
+
+	l := License{}
+	Initialize("1234-1234-1234-1234", &l)
+	if expected := time.Date(2022, 1, 1, 2, 30, 15, 0, time.UTC); l.Issued != expected {
+		t.Errorf("Expected the license to be issued at %v, got %v", expected, l.Issued)
+	}
+}
+
+func TestValidateRights(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	day := func(n int) *time.Time {
+		t := now.AddDate(0, 0, n)
+		return &t
+	}
+	negative := int32(-1)
+	rules := config.RightsRules{MaxLoanDays: 30}
+
+	for _, valid := range []UserRights{{}, {End: day(30)}, {Start: day(-10), End: day(20)}} {
+		if err := ValidateRights(&valid, rules, now); err != nil {
+			t.Errorf("Expected the rights %+v to be valid, got %v", valid, err)
+		}
+	}
+
+	// all the broken rules are listed
+	err := ValidateRights(&UserRights{Print: &negative, Start: day(-40), End: day(-45)}, rules, now)
+	var rightsErr *RightsError
+	if !errors.As(err, &rightsErr) || !errors.Is(err, ErrBadRights) || len(rightsErr.Violations) != 3 {
+		t.Fatalf("Expected 3 broken rules, got %v", err)
+	}
+	if err = ValidateRights(&UserRights{End: day(31)}, rules, now); err == nil {
+		t.Error("Expected a loan longer than the maximum to be rejected")
+	}
+	if err = ValidateRights(&UserRights{End: day(-1)}, config.RightsRules{AllowPastEnd: true}, now); err != nil {
+		t.Errorf("Expected an allowed end in the past, got %v", err)
+	}
+}
+
+func TestRightsRulesOf(t *testing.T) {
+	config.Config.RightsPolicy = config.RightsPolicy{RightsRules: config.RightsRules{MaxLoanDays: 30},
+		Providers: map[string]config.RightsRules{"https://publisher.example.com": {MaxLoanDays: 90}}}
+	defer func() { config.Config.RightsPolicy = config.RightsPolicy{} }()
+
+	if rules := RightsRulesOf("https://publisher.example.com"); rules.MaxLoanDays != 90 {
+		t.Errorf("Expected the rules of the provider, got %+v", rules)
+	}
+	if rules := RightsRulesOf("https://other.example.com"); rules.MaxLoanDays != 30 {
+		t.Errorf("Expected the default rules, got %+v", rules)
+	}
+}
+
+func TestEnforceLoan(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	day := func(n int) *time.Time {
+		t := now.AddDate(0, 0, n)
+		return &t
+	}
+	rules := config.RightsRules{MinLoanDays: 7, MaxLoanDays: 30}
+
+	rights := UserRights{End: day(14)}
+	if d := EnforceLoan(&rights, rules, now); d != nil {
+		t.Errorf("Expected a loan in range, got %+v", d)
+	}
+	rights = UserRights{End: day(60)}
+	if d := EnforceLoan(&rights, rules, now); d == nil || d.Decision != LoanRejected || !rights.End.Equal(*day(60)) {
+		t.Errorf("Expected a too long loan to be rejected, got %+v", d)
+	}
+	if err := ValidateRights(&rights, rules, now); err == nil {
+		t.Error("Expected the rejected loan to be invalid")
+	}
+
+	// the loans out of range are clamped into it
+	rules.LoanEnforcement = "clamp"
+	for requested, expected := range map[int]int{60: 30, 2: 7} {
+		rights = UserRights{Start: day(0), End: day(requested)}
+		d := EnforceLoan(&rights, rules, now.Add(time.Hour))
+		if d == nil || d.Decision != LoanClamped || !d.RequestedEnd.Equal(*day(requested)) || !rights.End.Equal(*day(expected)) {
+			t.Errorf("Expected a loan of %d days to be clamped to %d days, got %+v", requested, expected, d)
+		}
+		if err := ValidateRights(&rights, rules, now.Add(time.Hour)); err != nil {
+			t.Errorf("Expected the clamped loan to be valid, got %v", err)
+		}
+	}
+}
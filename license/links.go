@@ -0,0 +1,74 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+// ServerLinks are the relations of the links set by the server, which a provider cannot update
+var ServerLinks = []string{"publication", "status", "self"}
+
+// IsServerLink tells if a relation is set by the server
+func IsServerLink(rel string) bool {
+	for _, r := range ServerLinks {
+		if r == rel {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeLinks returns the links with the updates applied: a link replaces the link of the same relation,
+// or is added; a link without href removes the link of its relation
+func MergeLinks(links []Link, updates []Link) []Link {
+	merged := append([]Link{}, links...)
+	for _, u := range updates {
+		replaced := false
+		for i := 0; i < len(merged); i++ {
+			if merged[i].Rel != u.Rel {
+				continue
+			}
+			if u.Href == "" {
+				merged = append(merged[:i], merged[i+1:]...)
+				i--
+			} else {
+				merged[i] = u
+			}
+			replaced = true
+		}
+		if !replaced && u.Href != "" {
+			merged = append(merged, u)
+		}
+	}
+	return merged
+}
+
+// linksValue returns the value of the links of a license stored in the database:
+// only the links set by the provider are stored
+func linksValue(links []Link) (interface{}, error) {
+	var own []Link
+	for _, l := range links {
+		if !IsServerLink(l.Rel) {
+			own = append(own, l)
+		}
+	}
+	if len(own) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(own)
+	return string(data), err
+}
+
+// scanLinks returns the links of a license stored in the database
+func scanLinks(value sql.NullString) ([]Link, error) {
+	if !value.Valid || value.String == "" {
+		return nil, nil
+	}
+	var links []Link
+	err := json.Unmarshal([]byte(value.String), &links)
+	return links, err
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/readium/readium-lcp-server/dbutils"
+)
+
+// ErrHoldNotFound is returned when a user is not waiting for a copy of a content
+var ErrHoldNotFound = dbutils.NewError(ErrNotFound, "Hold not found")
+
+// Loans are the active loans of a content: licenses with an end of the rights in the future.
+// A returned or revoked license ends when it is returned or revoked.
+type Loans struct {
+	Active int
+	// the earliest end of the active loans, when a copy will be available again
+	NextEnd *time.Time
+}
+
+// Hold is a user waiting for a copy of a content; the first users placed on hold borrow the copies first
+type Hold struct {
+	ContentId string    `json:"content_id"`
+	UserId    string    `json:"user_id"`
+	Created   time.Time `json:"created"`
+	Position  int       `json:"position"`
+}
+
+// CountLoansTx counts the active loans of a content at a given time
+//
+func (s *sqlStore) CountLoansTx(tx *sql.Tx, contentID string, now time.Time) (Loans, error) {
+	var loans Loans
+	err := s.countloans.QueryRowTx(tx, contentID, now.UTC()).Scan(&loans.Active)
+	if err != nil || loans.Active == 0 {
+		return loans, wrap("count loans", err)
+	}
+	var end time.Time
+	err = s.nextloanend.QueryRowTx(tx, contentID, now.UTC()).Scan(&end)
+	if err == nil {
+		loans.NextEnd = &end
+	} else if err == sql.ErrNoRows {
+		err = nil
+	}
+	return loans, wrap("count loans", err)
+}
+
+// HoldsTx returns the holds of a content, the oldest first
+//
+func (s *sqlStore) HoldsTx(tx *sql.Tx, contentID string) ([]Hold, error) {
+	rows, err := s.listholds.QueryTx(tx, contentID)
+	return scanHolds(rows, err)
+}
+
+// ListHolds returns the holds of a content, the oldest first
+//
+func (s *sqlStore) ListHolds(contentID string) ([]Hold, error) {
+	rows, err := s.listholds.Query(contentID)
+	return scanHolds(rows, err)
+}
+
+func scanHolds(rows *sql.Rows, err error) ([]Hold, error) {
+	if err != nil {
+		return nil, wrap("list holds", err)
+	}
+	defer rows.Close()
+	holds := make([]Hold, 0)
+	for rows.Next() {
+		var h Hold
+		if err = rows.Scan(&h.ContentId, &h.UserId, &h.Created); err != nil {
+			return nil, wrap("list holds", err)
+		}
+		h.Position = len(holds) + 1
+		holds = append(holds, h)
+	}
+	return holds, wrap("list holds", rows.Err())
+}
+
+// AddHoldTx places a user on hold for a content
+//
+func (s *sqlStore) AddHoldTx(tx *sql.Tx, contentID string, userID string, created time.Time) error {
+	_, err := s.addhold.ExecTx(tx, contentID, userID, created.UTC())
+	return wrap("add hold", err)
+}
+
+// RemoveHoldTx removes a user from the holds of a content, once the user borrowed a copy
+//
+func (s *sqlStore) RemoveHoldTx(tx *sql.Tx, contentID string, userID string) error {
+	_, err := s.removehold.ExecTx(tx, contentID, userID)
+	return wrap("remove hold", err)
+}
+
+// RemoveHold cancels the hold of a user on a content
+//
+func (s *sqlStore) RemoveHold(contentID string, userID string) error {
+	res, err := s.removehold.Exec(contentID, userID)
+	if err != nil {
+		return wrap("remove hold", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrHoldNotFound
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// ErrBadRights is the error of the rights which break the rules, detailed by a RightsError
+var ErrBadRights = errors.New("Erroneous rights: counts must be positive and start must be before end")
+
+// RightsViolation is a rule broken by a field of the rights of a license
+type RightsViolation struct {
+	Field  string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// RightsError lists the rules broken by the rights of a license; it is an ErrBadRights
+type RightsError struct {
+	Violations []RightsViolation
+}
+
+func (e *RightsError) Error() string {
+	reasons := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		reasons[i] = v.Field + ": " + v.Reason
+	}
+	return "Erroneous rights: " + strings.Join(reasons, "; ")
+}
+
+// Is makes a RightsError an ErrBadRights
+func (e *RightsError) Is(target error) bool {
+	return target == ErrBadRights
+}
+
+// RightsRulesOf returns the rules of the rights of the licenses of a provider
+func RightsRulesOf(provider string) config.RightsRules {
+	policy := config.Config.RightsPolicy
+	if rules, ok := policy.Providers[provider]; ok {
+		return rules
+	}
+	return policy.RightsRules
+}
+
+// ValidateRights checks the rights of a license against rules, at a time: the counts must not be negative,
+// the start must be before the end, the end must not be in the past unless allowed,
+// and the loan must last between its minimum and maximum durations; the start of the loan is the time if not set.
+// It returns a RightsError listing all the broken rules, or nil.
+//
+func ValidateRights(rights *UserRights, rules config.RightsRules, now time.Time) error {
+	if rights == nil {
+		return nil
+	}
+	var violations []RightsViolation
+	if rights.Print != nil && *rights.Print < 0 {
+		violations = append(violations, RightsViolation{"rights.print", "must not be negative"})
+	}
+	if rights.Copy != nil && *rights.Copy < 0 {
+		violations = append(violations, RightsViolation{"rights.copy", "must not be negative"})
+	}
+	if rights.Start != nil && rights.End != nil && !rights.Start.Before(*rights.End) {
+		violations = append(violations, RightsViolation{"rights.end", "must be after the start"})
+	}
+	if rights.End != nil {
+		if !rules.AllowPastEnd && rights.End.Before(now) {
+			violations = append(violations, RightsViolation{"rights.end", "must not be in the past"})
+		}
+		min, max := loanRange(rules)
+		if length := loanLength(rights, now); max > 0 && length > max {
+			violations = append(violations, RightsViolation{"rights.end", "the loan must not last more than " + strconv.Itoa(rules.MaxLoanDays) + " days"})
+		} else if min > 0 && length < min {
+			violations = append(violations, RightsViolation{"rights.end", "the loan must last at least " + strconv.Itoa(rules.MinLoanDays) + " days"})
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return &RightsError{Violations: violations}
+}
+
+// the decisions taken on a loan out of the duration range of its provider
+const (
+	LoanClamped  = "clamped"
+	LoanRejected = "rejected"
+)
+
+// LoanDecision records a loan out of the duration range of its provider, and the end of its rights once clamped
+type LoanDecision struct {
+	Decision     string     `json:"decision"`
+	RequestedEnd time.Time  `json:"requested_end"`
+	End          *time.Time `json:"end,omitempty"`
+	MinLoanDays  int        `json:"min_loan_days,omitempty"`
+	MaxLoanDays  int        `json:"max_loan_days,omitempty"`
+}
+
+// EnforceLoan checks the duration of a loan against the range of the rules, at a time: a loan out of range
+// is clamped into it if the rules clamp, else it is rejected by ValidateRights.
+// It returns the decision, or nil if the loan is in range.
+//
+func EnforceLoan(rights *UserRights, rules config.RightsRules, now time.Time) *LoanDecision {
+	if rights == nil || rights.End == nil {
+		return nil
+	}
+	start := loanStart(rights, now)
+	if !start.Before(*rights.End) {
+		// not a loan, rejected by ValidateRights
+		return nil
+	}
+	min, max := loanRange(rules)
+	end := *rights.End
+	switch length := loanLength(rights, now); {
+	case max > 0 && length > max:
+		end = start.Add(max)
+	case min > 0 && length < min:
+		end = start.Add(min)
+	default:
+		return nil
+	}
+	d := &LoanDecision{Decision: LoanRejected, RequestedEnd: *rights.End, MinLoanDays: rules.MinLoanDays, MaxLoanDays: rules.MaxLoanDays}
+	if rules.LoanEnforcement == "clamp" {
+		d.Decision, d.End = LoanClamped, &end
+		rights.End = &end
+	}
+	return d
+}
+
+// loanStart returns the start of a loan: the start of its rights, else the time
+func loanStart(rights *UserRights, now time.Time) time.Time {
+	if rights.Start != nil {
+		return *rights.Start
+	}
+	return now
+}
+
+// loanLength returns the duration of a loan, to the second as the stored dates
+func loanLength(rights *UserRights, now time.Time) time.Duration {
+	return rights.End.Sub(loanStart(rights, now)).Round(time.Second)
+}
+
+// loanRange returns the minimum and maximum durations of a loan, zero if not limited
+func loanRange(rules config.RightsRules) (time.Duration, time.Duration) {
+	return time.Duration(rules.MinLoanDays) * 24 * time.Hour, time.Duration(rules.MaxLoanDays) * 24 * time.Hour
+}
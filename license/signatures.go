@@ -0,0 +1,132 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/readium/readium-lcp-server/dbutils"
+	"github.com/readium/readium-lcp-server/sign"
+)
+
+// ErrSignatureNotFound is returned when no signature of a license was recorded
+var ErrSignatureNotFound = dbutils.NewError(ErrNotFound, "No signature of the license was recorded")
+
+// SignatureCount is the number of licenses whose last signature used a certificate,
+// identified by its fingerprint; the active licenses are the licenses whose rights have not ended
+type SignatureCount struct {
+	Certificate string `json:"certificate"`
+	Licenses    int64  `json:"licenses"`
+	Active      int64  `json:"active_licenses"`
+}
+
+// SaveSignature records the fingerprint of the certificate which signed a license last
+func (s *sqlStore) SaveSignature(id string, certificate string) error {
+	_, err := s.savesignature.Exec(id, certificate)
+	return wrap("save license signature", err)
+}
+
+// GetSignature returns the fingerprint of the certificate which signed a license last
+func (s *sqlStore) GetSignature(id string) (string, error) {
+	var certificate string
+	err := s.getsignature.QueryRow(id).Scan(&certificate)
+	if err != nil {
+		return "", dbutils.Wrap("get license signature", err, ErrSignatureNotFound, ErrConflict, ErrStorage)
+	}
+	return certificate, nil
+}
+
+// CountSignatures returns the number of licenses, and of active licenses, last signed with each certificate
+func (s *sqlStore) CountSignatures(now time.Time) ([]SignatureCount, error) {
+	rows, err := s.countsignatures.Query(now.UTC())
+	if err != nil {
+		return nil, wrap("count license signatures", err)
+	}
+	defer rows.Close()
+	var counts []SignatureCount
+	for rows.Next() {
+		var c SignatureCount
+		if err = rows.Scan(&c.Certificate, &c.Licenses, &c.Active); err != nil {
+			return nil, wrap("count license signatures", err)
+		}
+		counts = append(counts, c)
+	}
+	return counts, wrap("count license signatures", rows.Err())
+}
+
+const signaturesTableDef = "CREATE TABLE IF NOT EXISTS license_signature (" +
+	"license_id varchar(255) PRIMARY KEY," +
+	"certificate varchar(64) NOT NULL)"
+
+var signaturesTableDefMySQL = dbutils.MySQLTable{Name: "license_signature", Definition: "`license_id` varchar(255) NOT NULL PRIMARY KEY," +
+	"`certificate` varchar(64) NOT NULL"}
+
+// the roles of the certificates in a report
+const (
+	RoleCurrent = "current"
+	RoleNext    = "next"
+	// a certificate which signed licenses but is no longer configured
+	RoleRetired = "retired"
+)
+
+// CertificateReport reports a certificate which signs licenses, and the licenses it signed last.
+// A certificate is retirable when no active license was last signed with it and it does not sign
+// licenses any more: its licenses are signed with the next certificate when they are fetched again.
+type CertificateReport struct {
+	Name        string     `json:"name,omitempty"`
+	Role        string     `json:"role"`
+	Policy      string     `json:"policy,omitempty"`
+	Fingerprint string     `json:"fingerprint"`
+	Subject     string     `json:"subject,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+	Signing     bool       `json:"signing"`
+	Licenses    int64      `json:"licenses"`
+	Active      int64      `json:"active_licenses"`
+	Retirable   bool       `json:"retirable"`
+}
+
+// ReportCertificates reports the certificates of the key rotations and the certificates which signed
+// the licenses counted, which are retired if they are not part of a rotation
+func ReportCertificates(rotations []sign.Rotation, counts []SignatureCount) []CertificateReport {
+	byCertificate := make(map[string]SignatureCount)
+	for _, c := range counts {
+		byCertificate[c.Certificate] = c
+	}
+	reported := make(map[string]bool)
+	report := func(name, role string, r sign.Rotation, cert *tls.Certificate, signing bool) CertificateReport {
+		c := CertificateReport{Name: name, Role: role, Fingerprint: sign.Fingerprint(cert), Signing: signing}
+		if r.Next != nil {
+			c.Policy = r.Policy
+		}
+		if cert.Leaf != nil {
+			notAfter := cert.Leaf.NotAfter.UTC()
+			c.Subject, c.NotAfter = cert.Leaf.Subject.String(), &notAfter
+		}
+		count := byCertificate[c.Fingerprint]
+		c.Licenses, c.Active = count.Licenses, count.Active
+		c.Retirable = !signing && c.Active == 0
+		reported[c.Fingerprint] = true
+		return c
+	}
+
+	var certs []CertificateReport
+	for _, r := range rotations {
+		if r.Current == nil {
+			continue
+		}
+		certs = append(certs, report(r.Name, RoleCurrent, r, r.Current, r.Next == nil || r.Policy != sign.PolicyAll))
+		if r.Next != nil {
+			certs = append(certs, report(r.Name, RoleNext, r, r.Next, r.Policy != sign.PolicyStaged))
+		}
+	}
+	for _, c := range counts {
+		if !reported[c.Certificate] {
+			certs = append(certs, CertificateReport{Role: RoleRetired, Fingerprint: c.Certificate,
+				Licenses: c.Licenses, Active: c.Active, Retirable: c.Active == 0})
+		}
+	}
+	return certs
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/readium/readium-lcp-server/cache"
+)
+
+// SignedCacheStats counts the hits and misses of the cache of the signed licenses
+var SignedCacheStats = expvar.NewMap("license_signed_cache")
+
+// signedEntry is a signed license document, valid as long as the license is not updated
+// and is signed with the same certificate
+type signedEntry struct {
+	Updated     time.Time
+	Certificate string
+	Document    []byte
+}
+
+func signedKey(id string) string {
+	return "lcp:license-signed:" + id
+}
+
+// updatedOf returns the update date of a license, zero if it was never updated
+func updatedOf(l License) time.Time {
+	if l.Updated == nil {
+		return time.Time{}
+	}
+	return l.Updated.UTC()
+}
+
+// GetSigned is not supported by the database, which does not keep the signed licenses
+func (s *sqlStore) GetSigned(l License, certificate string) ([]byte, bool) {
+	return nil, false
+}
+
+// SetSigned is not supported by the database, which does not keep the signed licenses
+func (s *sqlStore) SetSigned(l License, certificate string, doc []byte) {
+}
+
+// GetSigned returns the signed document of a license, if it was cached since the last update of the license
+// and signed with a certificate, identified by its fingerprint
+func (s cachedStore) GetSigned(l License, certificate string) ([]byte, bool) {
+	if !s.signed {
+		return nil, false
+	}
+	var e signedEntry
+	if cache.GetObject(s.cache, signedKey(l.Id), &e) && e.Updated.Equal(updatedOf(l)) && e.Certificate == certificate {
+		SignedCacheStats.Add("hits", 1)
+		return e.Document, true
+	}
+	SignedCacheStats.Add("misses", 1)
+	return nil, false
+}
+
+// SetSigned caches the signed document of a license, until the license is updated
+// or signed with another certificate
+func (s cachedStore) SetSigned(l License, certificate string, doc []byte) {
+	if s.signed {
+		cache.SetObject(s.cache, signedKey(l.Id), signedEntry{Updated: updatedOf(l), Certificate: certificate, Document: doc})
+	}
+}
@@ -7,36 +7,156 @@ package license
 
 import (
 	"database/sql"
-	"errors"
 	"log"
-	"strings"
 	"time"
 
+	"github.com/readium/readium-lcp-server/clock"
 	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
 )
 
-var NotFound = errors.New("License not found")
+// the errors of the license store; the errors of the database are wrapped in errors of kind ErrStorage,
+// the violations of a unique constraint in errors of kind ErrConflict
+var (
+	ErrNotFound = dbutils.NewError(dbutils.ErrNotFound, "License not found")
+	ErrConflict = dbutils.NewError(dbutils.ErrConflict, "License conflict")
+	ErrStorage  = dbutils.NewError(dbutils.ErrStorage, "License storage error")
+)
+
+// ErrModified is returned when a license was modified since it was read
+var ErrModified = dbutils.NewError(ErrConflict, "The license has been modified since it was read")
+
+// wrap returns the error of an operation of the store
+func wrap(op string, err error) error {
+	return dbutils.Wrap(op, err, ErrNotFound, ErrConflict, ErrStorage)
+}
 
 type Store interface {
 	//List() func() (License, error)
 	List(ContentId string, page int, pageNum int) func() (LicenseReport, error)
+	ListForTenant(tenant string, contentID string, page int, pageNum int) func() (LicenseReport, error)
 	ListAll(page int, pageNum int) func() (LicenseReport, error)
+	ListAllForTenant(tenant string, page int, pageNum int) func() (LicenseReport, error)
+	ListAllAfter(after Cursor, limit int) func() (LicenseReport, error)
+	ListAllForTenantAfter(tenant string, after Cursor, limit int) func() (LicenseReport, error)
+	ListByReference(reference string) ([]LicenseReport, error)
+	ListReports(filter ReportFilter, listing dbutils.Listing) func() (LicenseReport, error)
+	ExportReports(filter ReportFilter, fn func(LicenseReport) error) error
 	UpdateRights(l License) error
 	Update(l License) error
+	UpdateIfMatch(l License, etag string) error
 	UpdateLsdStatus(id string, status int32) error
 	Add(l License) error
+	AddTx(tx *sql.Tx, l License) error
 	Get(id string) (License, error)
+	EraseUser(userID string, pseudonym string) ([]string, error)
+	PurgeExpired(before time.Time, archive bool, dryRun bool) (int64, error)
+	GetAllowance(id string) (Allowance, error)
+	Consume(id string, print int32, copy int32) (Allowance, error)
+	CountLoansTx(tx *sql.Tx, contentID string, now time.Time) (Loans, error)
+	HoldsTx(tx *sql.Tx, contentID string) ([]Hold, error)
+	AddHoldTx(tx *sql.Tx, contentID string, userID string, created time.Time) error
+	RemoveHoldTx(tx *sql.Tx, contentID string, userID string) error
+	ListHolds(contentID string) ([]Hold, error)
+	RemoveHold(contentID string, userID string) error
+	SaveKeys(id string, k Keys) error
+	GetKeys(id string) (Keys, error)
+	GetSigned(l License, certificate string) ([]byte, bool)
+	SetSigned(l License, certificate string, doc []byte)
+	SaveSignature(id string, certificate string) error
+	GetSignature(id string) (string, error)
+	CountSignatures(now time.Time) ([]SignatureCount, error)
 }
 
 type sqlStore struct {
 	db              *sql.DB
-	listall         *sql.Stmt
-	list            *sql.Stmt
-	updaterights    *sql.Stmt
-	add             *sql.Stmt
-	update          *sql.Stmt
-	updatelsdstatus *sql.Stmt
-	get             *sql.Stmt
+	listall         *dbutils.Stmt
+	listalltenant   *dbutils.Stmt
+	listafter       *dbutils.Stmt
+	listtenantafter *dbutils.Stmt
+	list            *dbutils.Stmt
+	listtenant      *dbutils.Stmt
+	updaterights    *dbutils.Stmt
+	add             *dbutils.Stmt
+	update          *dbutils.Stmt
+	updatelsdstatus *dbutils.Stmt
+	get             *dbutils.Stmt
+	getforupdate    *dbutils.Stmt
+	listbyuser      *dbutils.Stmt
+	eraseuser       *dbutils.Stmt
+	countexpired    *dbutils.Stmt
+	archiveexpired  *dbutils.Stmt
+	deleteexpired   *dbutils.Stmt
+	getallowance    *dbutils.Stmt
+	consume         *dbutils.Stmt
+	countloans      *dbutils.Stmt
+	nextloanend     *dbutils.Stmt
+	listholds       *dbutils.Stmt
+	addhold         *dbutils.Stmt
+	removehold      *dbutils.Stmt
+	getkeys         *dbutils.Stmt
+	savekeys        *dbutils.Stmt
+	erasekeys       *dbutils.Stmt
+	purgekeys       *dbutils.Stmt
+	listbyreference *dbutils.Stmt
+	getsignature    *dbutils.Stmt
+	savesignature   *dbutils.Stmt
+	countsignatures *dbutils.Stmt
+	purgesignatures *dbutils.Stmt
+	replica         *sql.DB
+	dialect         dbutils.Dialect
+}
+
+// ReportFilter selects the licenses of a list; an empty field does not filter the list.
+// Since and Until are the bounds of the issue date of the licenses.
+type ReportFilter struct {
+	ContentId string
+	Tenant    string
+	UserId    string
+	Since     time.Time
+	Until     time.Time
+}
+
+// where returns the conditions of a filter and their arguments
+func (f ReportFilter) where() (string, []interface{}) {
+	where := " WHERE 1=1"
+	var args []interface{}
+	if f.ContentId != "" {
+		where += " AND content_fk = ?"
+		args = append(args, f.ContentId)
+	}
+	if f.Tenant != "" {
+		where += " AND tenant = ?"
+		args = append(args, f.Tenant)
+	}
+	if f.UserId != "" {
+		where += " AND user_id = ?"
+		args = append(args, f.UserId)
+	}
+	if !f.Since.IsZero() {
+		where += " AND issued >= ?"
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		where += " AND issued < ?"
+		args = append(args, f.Until.UTC())
+	}
+	return where, args
+}
+
+// reportQuery selects the license reports
+const reportQuery = `SELECT id, user_id, provider, issued, updated,
+		rights_print, rights_copy, rights_start, rights_end, content_fk, tenant, reference
+		FROM license`
+
+// reportColumns are the columns of the fields the license reports are sorted by
+var reportColumns = map[string]string{
+	"id":       "id",
+	"issued":   "issued",
+	"updated":  "updated",
+	"user":     "user_id",
+	"provider": "provider",
+	"end":      "rights_end",
 }
 
 // ListAll lists all licenses in ante-chronological order
@@ -45,6 +165,7 @@ type sqlStore struct {
 func (s *sqlStore) ListAll(page int, pageNum int) func() (LicenseReport, error) {
 	listLicenses, err := s.listall.Query(page, pageNum*page)
 	if err != nil {
+		err = wrap("list licenses", err)
 		return func() (LicenseReport, error) { return LicenseReport{}, err }
 	}
 	return func() (LicenseReport, error) {
@@ -53,26 +174,166 @@ func (s *sqlStore) ListAll(page int, pageNum int) func() (LicenseReport, error)
 		l.Rights = new(UserRights)
 		if listLicenses.Next() {
 			err := listLicenses.Scan(&l.Id, &l.User.Id, &l.Provider, &l.Issued, &l.Updated,
-				&l.Rights.Print, &l.Rights.Copy, &l.Rights.Start, &l.Rights.End, &l.ContentId)
+				&l.Rights.Print, &l.Rights.Copy, &l.Rights.Start, &l.Rights.End, &l.ContentId, &l.Tenant)
 
 			if err != nil {
-				return l, err
+				return l, wrap("list licenses", err)
 			}
 
 		} else {
 			listLicenses.Close()
-			err = NotFound
+			err = ErrNotFound
 		}
 		return l, err
 	}
 }
 
+// ListAllForTenant lists the licenses of a tenant in ante-chronological order
+// pageNum starts at 0
+//
+func (s *sqlStore) ListAllForTenant(tenant string, page int, pageNum int) func() (LicenseReport, error) {
+	listLicenses, err := s.listalltenant.Query(tenant, page, pageNum*page)
+	if err != nil {
+		err = wrap("list licenses", err)
+		return func() (LicenseReport, error) { return LicenseReport{}, err }
+	}
+	return func() (LicenseReport, error) {
+		var l LicenseReport
+		l.User = UserInfo{}
+		l.Rights = new(UserRights)
+		if listLicenses.Next() {
+			err := listLicenses.Scan(&l.Id, &l.User.Id, &l.Provider, &l.Issued, &l.Updated,
+				&l.Rights.Print, &l.Rights.Copy, &l.Rights.Start, &l.Rights.End, &l.ContentId, &l.Tenant)
+
+			if err != nil {
+				return l, wrap("list licenses", err)
+			}
+
+		} else {
+			listLicenses.Close()
+			err = ErrNotFound
+		}
+		return l, err
+	}
+}
+
+// ListAllAfter lists the licenses which come after a position in ante-chronological order;
+// the position of the last license is the cursor of the next page.
+// Unlike ListAll, the cost of a page does not grow with its position in the list.
+//
+func (s *sqlStore) ListAllAfter(after Cursor, limit int) func() (LicenseReport, error) {
+	if after.IsZero() {
+		after = firstPageBound
+	}
+	rows, err := s.listafter.Query(after.Issued.UTC(), after.Issued.UTC(), after.Id, limit)
+	return listReports(rows, err)
+}
+
+// ListAllForTenantAfter lists the licenses of a tenant which come after a position in ante-chronological order
+//
+func (s *sqlStore) ListAllForTenantAfter(tenant string, after Cursor, limit int) func() (LicenseReport, error) {
+	if after.IsZero() {
+		after = firstPageBound
+	}
+	rows, err := s.listtenantafter.Query(tenant, after.Issued.UTC(), after.Issued.UTC(), after.Id, limit)
+	return listReports(rows, err)
+}
+
+// ListByReference lists the licenses generated with an external reference, e.g. an order number,
+// in ante-chronological order
+//
+func (s *sqlStore) ListByReference(reference string) ([]LicenseReport, error) {
+	fn := listReports(s.listbyreference.Query(reference))
+	var licenses []LicenseReport
+	for {
+		l, err := fn()
+		if err == ErrNotFound {
+			return licenses, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		licenses = append(licenses, l)
+	}
+}
+
+// ListReports lists the licenses selected by a filter, sorted by a field of their reports
+// (id, issued, updated, user, provider or end), in ante-chronological order by default
+//
+func (s *sqlStore) ListReports(filter ReportFilter, listing dbutils.Listing) func() (LicenseReport, error) {
+	clauses, err := listing.Clauses(reportColumns, "-issued", "id")
+	if err != nil {
+		return listReports(nil, err)
+	}
+	where, args := filter.where()
+	// the sort and the page are not parameters of the query: the query is not prepared
+	return listReports(s.replica.Query(s.dialect.Bind(reportQuery+where+clauses), args...))
+}
+
+// ExportReports calls fn on each license selected by a filter, in chronological order, as the rows
+// are read from the database: the licenses are not held in memory, and an error of fn stops the export.
+//
+func (s *sqlStore) ExportReports(filter ReportFilter, fn func(LicenseReport) error) error {
+	where, args := filter.where()
+	rows, err := s.replica.Query(s.dialect.Bind(reportQuery+where+" ORDER BY issued, id"), args...)
+	if err != nil {
+		return wrap("export licenses", err)
+	}
+	defer rows.Close()
+	next := listReports(rows, nil)
+	for {
+		l, err := next()
+		if err == ErrNotFound {
+			return wrap("export licenses", rows.Err())
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(l); err != nil {
+			return err
+		}
+	}
+}
+
+// listReports iterates on the rows of a list of licenses
+func listReports(rows *sql.Rows, err error) func() (LicenseReport, error) {
+	if err != nil {
+		err = wrap("list licenses", err)
+		return func() (LicenseReport, error) { return LicenseReport{}, err }
+	}
+	return func() (LicenseReport, error) {
+		var l LicenseReport
+		l.Rights = new(UserRights)
+		if !rows.Next() {
+			rows.Close()
+			return l, ErrNotFound
+		}
+		err := rows.Scan(&l.Id, &l.User.Id, &l.Provider, &l.Issued, &l.Updated,
+			&l.Rights.Print, &l.Rights.Copy, &l.Rights.Start, &l.Rights.End, &l.ContentId, &l.Tenant, &l.Reference)
+		return l, wrap("list licenses", err)
+	}
+}
+
 // List lists licenses for a given ContentId
 // pageNum starting at 0
 //
 func (s *sqlStore) List(contentID string, page int, pageNum int) func() (LicenseReport, error) {
 	listLicenses, err := s.list.Query(contentID, page, pageNum*page)
+	return listContentLicenses(listLicenses, err)
+}
+
+// ListForTenant lists the licenses of a tenant for a given ContentId
+// pageNum starting at 0
+//
+func (s *sqlStore) ListForTenant(tenant string, contentID string, page int, pageNum int) func() (LicenseReport, error) {
+	listLicenses, err := s.listtenant.Query(tenant, contentID, page, pageNum*page)
+	return listContentLicenses(listLicenses, err)
+}
+
+// listContentLicenses iterates on the rows of a list of the licenses of a content
+func listContentLicenses(listLicenses *sql.Rows, err error) func() (LicenseReport, error) {
 	if err != nil {
+		err = wrap("list licenses", err)
 		return func() (LicenseReport, error) { return LicenseReport{}, err }
 	}
 	return func() (LicenseReport, error) {
@@ -82,13 +343,13 @@ func (s *sqlStore) List(contentID string, page int, pageNum int) func() (License
 		if listLicenses.Next() {
 
 			err := listLicenses.Scan(&l.Id, &l.User.Id, &l.Provider, &l.Issued, &l.Updated,
-				&l.Rights.Print, &l.Rights.Copy, &l.Rights.Start, &l.Rights.End, &l.ContentId)
+				&l.Rights.Print, &l.Rights.Copy, &l.Rights.Start, &l.Rights.End, &l.ContentId, &l.Tenant)
 			if err != nil {
-				return l, err
+				return l, wrap("list licenses", err)
 			}
 		} else {
 			listLicenses.Close()
-			err = NotFound
+			err = ErrNotFound
 		}
 		return l, err
 	}
@@ -97,37 +358,100 @@ func (s *sqlStore) List(contentID string, page int, pageNum int) func() (License
 // UpdateRights
 //
 func (s *sqlStore) UpdateRights(l License) error {
-	result, err := s.updaterights.Exec(l.Rights.Print, l.Rights.Copy, l.Rights.Start, l.Rights.End, time.Now().UTC().Truncate(time.Second), l.Id)
+	result, err := s.updaterights.Exec(l.Rights.Print, l.Rights.Copy, l.Rights.Start, l.Rights.End, clock.Now().UTC().Truncate(time.Second), l.Id)
 
 	if err == nil {
 		if r, _ := result.RowsAffected(); r == 0 {
-			return NotFound
+			return ErrNotFound
 		}
 	}
-	return err
+	return wrap("update rights", err)
 }
 
 // Add creates a new record in the license table
 //
 func (s *sqlStore) Add(l License) error {
-	_, err := s.add.Exec(
+	extensions, err := extensionsValue(l.Extensions)
+	if err != nil {
+		return err
+	}
+	_, err = s.add.Exec(
 		l.Id, l.User.Id, l.Provider, l.Issued, nil,
 		l.Rights.Print, l.Rights.Copy, l.Rights.Start, l.Rights.End,
-		l.ContentId)
-	return err
+		l.ContentId, l.Tenant, l.Encryption.Profile, l.Encryption.UserKey.Algorithm, l.ContentVersion, extensions, l.Reference)
+	return wrap("add license", err)
+}
+
+// AddTx stores a license in a transaction, e.g. with its notification to the lsd server
+func (s *sqlStore) AddTx(tx *sql.Tx, l License) error {
+	extensions, err := extensionsValue(l.Extensions)
+	if err != nil {
+		return err
+	}
+	_, err = s.add.ExecTx(tx,
+		l.Id, l.User.Id, l.Provider, l.Issued, nil,
+		l.Rights.Print, l.Rights.Copy, l.Rights.Start, l.Rights.End,
+		l.ContentId, l.Tenant, l.Encryption.Profile, l.Encryption.UserKey.Algorithm, l.ContentVersion, extensions, l.Reference)
+	return wrap("add license", err)
 }
 
 // Update updates a record in the license table
 //
 func (s *sqlStore) Update(l License) error {
-	_, err := s.update.Exec(
+	links, err := linksValue(l.Links)
+	if err != nil {
+		return err
+	}
+	_, err = s.update.Exec(
 		l.User.Id, l.Provider,
-		time.Now().UTC().Truncate(time.Second),
+		clock.Now().UTC().Truncate(time.Second),
 		l.Rights.Print, l.Rights.Copy, l.Rights.Start, l.Rights.End,
-		l.ContentId,
+		l.ContentId, links,
 		l.Id)
 
-	return err
+	return wrap("update license", err)
+}
+
+// UpdateIfMatch updates a record in the license table if the stored license
+// still has the given entity tag, i.e. if it was not modified since it was read.
+// The stored license is locked during the check (except in sqlite, where the write
+// transaction fails if another one modified the license meanwhile).
+//
+func (s *sqlStore) UpdateIfMatch(l License, etag string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return wrap("update license", err)
+	}
+	links, err := linksValue(l.Links)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var cur License
+	var extensions, curLinks sql.NullString
+	cur.Rights = new(UserRights)
+	err = s.getforupdate.QueryRowTx(tx, l.Id).Scan(&cur.Id, &cur.User.Id, &cur.Provider, &cur.Issued, &cur.Updated,
+		&cur.Rights.Print, &cur.Rights.Copy, &cur.Rights.Start, &cur.Rights.End,
+		&cur.ContentId, &cur.Tenant, &cur.Encryption.Profile, &cur.Encryption.UserKey.Algorithm, &cur.ContentVersion, &extensions, &cur.Reference, &curLinks)
+	if err == nil {
+		cur.Links, err = scanLinks(curLinks)
+	}
+	if err == nil && ETag(cur) != etag {
+		err = ErrModified
+	}
+	if err == nil {
+		_, err = s.update.ExecTx(tx,
+			l.User.Id, l.Provider,
+			clock.Now().UTC().Truncate(time.Second),
+			l.Rights.Print, l.Rights.Copy, l.Rights.Start, l.Rights.End,
+			l.ContentId, links,
+			l.Id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return wrap("update license", err)
+	}
+	return wrap("update license", tx.Commit())
 }
 
 // UpdateLsdStatus
@@ -137,7 +461,7 @@ func (s *sqlStore) UpdateLsdStatus(id string, status int32) error {
 		status,
 		id)
 
-	return err
+	return wrap("update license status", err)
 }
 
 // Get a license from the db
@@ -149,118 +473,340 @@ func (s *sqlStore) Get(id string) (License, error) {
 
 	row := s.get.QueryRow(id)
 
+	var extensions, links sql.NullString
 	err := row.Scan(&l.Id, &l.User.Id, &l.Provider, &l.Issued, &l.Updated,
 		&l.Rights.Print, &l.Rights.Copy, &l.Rights.Start, &l.Rights.End,
-		&l.ContentId)
+		&l.ContentId, &l.Tenant, &l.Encryption.Profile, &l.Encryption.UserKey.Algorithm, &l.ContentVersion, &extensions, &l.Reference, &links)
 
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return l, NotFound
-		} else {
-			return l, err
+		return l, wrap("get license", err)
+	}
+	if l.Extensions, err = scanExtensions(extensions); err == nil {
+		// the links set by the provider, the other links are set when the license is built
+		l.Links, err = scanLinks(links)
+	}
+
+	return l, wrap("get license", err)
+}
+
+// EraseUser replaces the identifier of a user by a pseudonym in all its licenses,
+// and returns the identifiers of these licenses. The licenses stay valid, and the statistics
+// are preserved as all the licenses of the user get the same pseudonym.
+//
+func (s *sqlStore) EraseUser(userID string, pseudonym string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, wrap("erase user", err)
+	}
+	rows, err := s.listbyuser.QueryTx(tx, userID)
+	if err != nil {
+		tx.Rollback()
+		return nil, wrap("erase user", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, wrap("erase user", err)
 		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		tx.Rollback()
+		return ids, nil
+	}
+	// the encrypted user fields of the licenses delivered are erased too
+	if _, err = s.erasekeys.ExecTx(tx, userID); err != nil {
+		tx.Rollback()
+		return nil, wrap("erase user", err)
+	}
+	if _, err = s.eraseuser.ExecTx(tx, pseudonym, userID); err != nil {
+		tx.Rollback()
+		return nil, wrap("erase user", err)
 	}
+	return ids, wrap("erase user", tx.Commit())
+}
 
-	return l, nil
+// PurgeExpired deletes the licenses whose rights ended before a date, and returns their number;
+// if archive is true, they are moved to the license_archive table. In dry-run mode,
+// the licenses are only counted.
+//
+func (s *sqlStore) PurgeExpired(before time.Time, archive bool, dryRun bool) (int64, error) {
+	before = before.UTC()
+	if dryRun {
+		var count int64
+		err := s.countexpired.QueryRow(before).Scan(&count)
+		return count, wrap("purge licenses", err)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, wrap("purge licenses", err)
+	}
+	if archive {
+		if _, err = s.archiveexpired.ExecTx(tx, before); err != nil {
+			tx.Rollback()
+			return 0, wrap("purge licenses", err)
+		}
+	}
+	if _, err = s.purgekeys.ExecTx(tx, before); err != nil {
+		tx.Rollback()
+		return 0, wrap("purge licenses", err)
+	}
+	if _, err = s.purgesignatures.ExecTx(tx, before); err != nil {
+		tx.Rollback()
+		return 0, wrap("purge licenses", err)
+	}
+	res, err := s.deleteexpired.ExecTx(tx, before)
+	if err != nil {
+		tx.Rollback()
+		return 0, wrap("purge licenses", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, wrap("purge licenses", err)
+	}
+	n, err := res.RowsAffected()
+	return n, wrap("purge licenses", err)
 }
 
 // NewSqlStore
 //
 func NewSqlStore(db *sql.DB) (Store, error) {
+	return NewSqlStoreWithReplica(db, db)
+}
+
+// NewSqlStoreWithReplica returns a license store; listings are read from the replica database.
+//
+func NewSqlStoreWithReplica(db *sql.DB, replica *sql.DB) (Store, error) {
 	
 	var tabledefquery, listallquery, listquery, updaterightsquery, addquery, updatequery, updatelsdstatusquery, getquery string
-
-	if strings.HasPrefix(config.Config.LcpServer.Database, "postgres") {
-		// postgres
+	var getforupdatequery, listalltenantquery, listtenantquery, listbyuserquery, eraseuserquery string
+	var archivetabledefquery, countexpiredquery, archiveexpiredquery, deleteexpiredquery string
+	var listafterquery, listtenantafterquery string
+	var getallowancequery, consumequery string
+	var holdtabledefquery, countloansquery, nextloanendquery, listholdsquery, addholdquery, removeholdquery string
+	var getkeysquery, erasekeysquery, purgekeysquery string
+	var listbyreferencequery string
+	var getsignaturequery, countsignaturesquery, purgesignaturesquery string
+
+	// the queries are written with '?' placeholders, bound to the dialect of the database
+	d := dbutils.DialectOf(config.Config.LcpServer.Database)
+	tabledefquery = tableDef
+	archivetabledefquery = archiveTableDef
+	holdtabledefquery = holdTableDef
+	if d == dbutils.Postgres {
 		tabledefquery = tableDefPostgers
-		listallquery = `SELECT id, user_id, provider, issued, updated,
-			rights_print, rights_copy, rights_start, rights_end, content_fk
-			FROM license
-			ORDER BY issued desc LIMIT $1 OFFSET $2`
-		listquery = `SELECT id, user_id, provider, issued, updated,
-			rights_print, rights_copy, rights_start, rights_end, content_fk
-			FROM license
-			WHERE content_fk=$1 LIMIT $2 OFFSET $3`
-		updaterightsquery = "UPDATE license SET rights_print=$1, rights_copy=$2, rights_start=$3, rights_end=$4, updated=$5 WHERE id=$6"
-		addquery = `INSERT INTO license (id, user_id, provider, issued, updated,
-			rights_print, rights_copy, rights_start, rights_end, content_fk) 
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
-		updatequery = `UPDATE license SET user_id=$1, provider=$2, updated=$3,
-			rights_print=$4, rights_copy=$5, rights_start=$6, rights_end=$7, content_fk =$8
-			WHERE id=$9`
-		updatelsdstatusquery = `UPDATE license SET lsd_status =$1 WHERE id=$2`
-		getquery = `SELECT id, user_id, provider, issued, updated, rights_print, rights_copy,
-			rights_start, rights_end, content_fk FROM license
-			where id = $1`
-	}else{
-		// mysql/sqlite
-		tabledefquery = tableDef
-		listallquery = `SELECT id, user_id, provider, issued, updated,
-			rights_print, rights_copy, rights_start, rights_end, content_fk
-			FROM license
-			ORDER BY issued desc LIMIT ? OFFSET ?`
-		listquery = `SELECT id, user_id, provider, issued, updated,
-			rights_print, rights_copy, rights_start, rights_end, content_fk
-			FROM license
-			WHERE content_fk=? LIMIT ? OFFSET ?`
-		updaterightsquery = "UPDATE license SET rights_print=?, rights_copy=?, rights_start=?, rights_end=?,u pdated=? WHERE id=?"
-		addquery = `INSERT INTO license (id, user_id, provider, issued, updated,
-			rights_print, rights_copy, rights_start, rights_end, content_fk) 
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
-		updatequery = `UPDATE license SET user_id=?, provider=?, updated=?,
-			rights_print=?, rights_copy=?, rights_start=?, rights_end=?, content_fk =?
-			WHERE id=?`
-		updatelsdstatusquery = `UPDATE license SET lsd_status =? WHERE id=?`
-		getquery = `SELECT id, user_id, provider, issued, updated, rights_print, rights_copy,
-			rights_start, rights_end, content_fk FROM license
-			where id = ?`
+		archivetabledefquery = archiveTableDefPostgres
+		holdtabledefquery = holdTableDefPostgres
 	}
+	listallquery = `SELECT id, user_id, provider, issued, updated,
+		rights_print, rights_copy, rights_start, rights_end, content_fk, tenant
+		FROM license
+		ORDER BY issued desc LIMIT ? OFFSET ?`
+	listalltenantquery = `SELECT id, user_id, provider, issued, updated,
+		rights_print, rights_copy, rights_start, rights_end, content_fk, tenant
+		FROM license
+		WHERE tenant=? ORDER BY issued desc LIMIT ? OFFSET ?`
+	listquery = `SELECT id, user_id, provider, issued, updated,
+		rights_print, rights_copy, rights_start, rights_end, content_fk, tenant
+		FROM license
+		WHERE content_fk=? LIMIT ? OFFSET ?`
+	listtenantquery = `SELECT id, user_id, provider, issued, updated,
+		rights_print, rights_copy, rights_start, rights_end, content_fk, tenant
+		FROM license
+		WHERE tenant=? AND content_fk=? LIMIT ? OFFSET ?`
+	updaterightsquery = "UPDATE license SET rights_print=?, rights_copy=?, rights_start=?, rights_end=?, updated=? WHERE id=?"
+	addquery = `INSERT INTO license (id, user_id, provider, issued, updated,
+		rights_print, rights_copy, rights_start, rights_end, content_fk, tenant, profile, user_key_algorithm, content_version, extensions, reference)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	updatequery = `UPDATE license SET user_id=?, provider=?, updated=?,
+		rights_print=?, rights_copy=?, rights_start=?, rights_end=?, content_fk =?, links=?
+		WHERE id=?`
+	updatelsdstatusquery = `UPDATE license SET lsd_status =? WHERE id=?`
+	getquery = `SELECT id, user_id, provider, issued, updated, rights_print, rights_copy,
+		rights_start, rights_end, content_fk, tenant, profile, user_key_algorithm, content_version, extensions, reference, links FROM license
+		where id = ?`
+	listbyuserquery = "SELECT id FROM license WHERE user_id=?"
+	eraseuserquery = "UPDATE license SET user_id=? WHERE user_id=?"
+	countexpiredquery = "SELECT COUNT(*) FROM license WHERE rights_end < ?"
+	archiveexpiredquery = "INSERT INTO license_archive (" + archivedColumns + ") SELECT " + archivedColumns +
+		" FROM license WHERE rights_end < ?"
+	deleteexpiredquery = "DELETE FROM license WHERE rights_end < ?"
+	listafterquery = `SELECT id, user_id, provider, issued, updated,
+		rights_print, rights_copy, rights_start, rights_end, content_fk, tenant, reference
+		FROM license
+		WHERE issued <= ? AND (issued < ? OR id < ?) ORDER BY issued DESC, id DESC LIMIT ?`
+	listtenantafterquery = `SELECT id, user_id, provider, issued, updated,
+		rights_print, rights_copy, rights_start, rights_end, content_fk, tenant, reference
+		FROM license
+		WHERE tenant=? AND issued <= ? AND (issued < ? OR id < ?) ORDER BY issued DESC, id DESC LIMIT ?`
+	getallowancequery = "SELECT id, rights_print, rights_copy, print_used, copy_used FROM license WHERE id = ?"
+	consumequery = `UPDATE license SET print_used = print_used + ?, copy_used = copy_used + ?
+		WHERE id = ? AND (rights_print IS NULL OR print_used + ? <= rights_print)
+		AND (rights_copy IS NULL OR copy_used + ? <= rights_copy)`
+	countloansquery = "SELECT COUNT(*) FROM license WHERE content_fk = ? AND rights_end > ?"
+	nextloanendquery = "SELECT rights_end FROM license WHERE content_fk = ? AND rights_end > ? ORDER BY rights_end LIMIT 1"
+	listholdsquery = "SELECT content_fk, user_id, created FROM license_hold WHERE content_fk = ? ORDER BY created, user_id"
+	addholdquery = "INSERT INTO license_hold (content_fk, user_id, created) VALUES (?, ?, ?)"
+	removeholdquery = "DELETE FROM license_hold WHERE content_fk = ? AND user_id = ?"
+	getkeysquery = "SELECT document FROM license_keys WHERE license_id = ?"
+	erasekeysquery = "DELETE FROM license_keys WHERE license_id IN (SELECT id FROM license WHERE user_id = ?)"
+	purgekeysquery = "DELETE FROM license_keys WHERE license_id IN (SELECT id FROM license WHERE rights_end < ?)"
+	listbyreferencequery = `SELECT id, user_id, provider, issued, updated,
+		rights_print, rights_copy, rights_start, rights_end, content_fk, tenant, reference
+		FROM license
+		WHERE reference = ? ORDER BY issued DESC, id DESC`
+	getsignaturequery = "SELECT certificate FROM license_signature WHERE license_id = ?"
+	countsignaturesquery = `SELECT s.certificate, COUNT(*),
+		SUM(CASE WHEN l.rights_end IS NULL OR l.rights_end > ? THEN 1 ELSE 0 END)
+		FROM license_signature s JOIN license l ON l.id = s.license_id
+		GROUP BY s.certificate ORDER BY s.certificate`
+	purgesignaturesquery = "DELETE FROM license_signature WHERE license_id IN (SELECT id FROM license WHERE rights_end < ?)"
+
+	// lock the row read before a conditional update
+	getforupdatequery = getquery + d.ForUpdate()
+
+	// the columns are added to the databases created before them, so that their indexes can be created;
+	// on a new database, the errors are ignored and the tables are created with all their columns
+	// add the "tenant" column to the databases created before multi-tenancy, ignore an error
+	db.Exec("ALTER TABLE license ADD COLUMN tenant varchar(255) NOT NULL DEFAULT ''")
+	// add the consumption of the rights to the databases created before its accounting, ignore an error
+	db.Exec("ALTER TABLE license ADD COLUMN print_used int NOT NULL DEFAULT 0")
+	db.Exec("ALTER TABLE license ADD COLUMN copy_used int NOT NULL DEFAULT 0")
+	// add the profile and passphrase hash algorithm the licenses are issued with, ignore an error
+	db.Exec("ALTER TABLE license ADD COLUMN profile varchar(255) NOT NULL DEFAULT ''")
+	db.Exec("ALTER TABLE license ADD COLUMN user_key_algorithm varchar(255) NOT NULL DEFAULT ''")
+	// add the version of the content the licenses are issued for, ignore an error;
+	// the licenses issued before the versioning of the contents refer to the first version
+	db.Exec("ALTER TABLE license ADD COLUMN content_version int NOT NULL DEFAULT 1")
+	// add the extensions of the licenses, ignore an error
+	db.Exec("ALTER TABLE license ADD COLUMN extensions text DEFAULT NULL")
+	// add the external reference of the licenses, e.g. an order number, ignore an error
+	db.Exec("ALTER TABLE license ADD COLUMN reference varchar(255) NOT NULL DEFAULT ''")
+	// add the links set by the providers, ignore an error
+	db.Exec("ALTER TABLE license ADD COLUMN links text DEFAULT NULL")
 
 	// if sqlite/postgres, create the license table if it does not exist
-	if strings.HasPrefix(config.Config.LcpServer.Database, "sqlite") || strings.HasPrefix(config.Config.LcpServer.Database, "postgres") {
+	if d != dbutils.MySQL {
 		_, err := db.Exec(tabledefquery)
 		if err != nil {
 			log.Println("Error creating license table")
 			return nil, err
 		}
+		_, err = db.Exec(archivetabledefquery)
+		if err != nil {
+			log.Println("Error creating license_archive table")
+			return nil, err
+		}
+		_, err = db.Exec(holdtabledefquery)
+		if err != nil {
+			log.Println("Error creating license_hold table")
+			return nil, err
+		}
+		_, err = db.Exec(keysTableDef)
+		if err != nil {
+			log.Println("Error creating license_keys table")
+			return nil, err
+		}
+		_, err = db.Exec(signaturesTableDef)
+		if err != nil {
+			log.Println("Error creating license_signature table")
+			return nil, err
+		}
+		// add the indexes of the lists and searches, also to the existing databases
+		_, err = db.Exec(indexDef)
+		if err != nil {
+			log.Println("Error creating the indexes of the license table")
+			return nil, err
+		}
 	}
-
-	listall, err := db.Prepare(listallquery)
-	if err != nil {
-		return nil, err
+	// if mysql, create the license tables if they do not exist
+	if d == dbutils.MySQL {
+		err := dbutils.CreateMySQLTables(db, tableDefMySQL, archiveTableDefMySQL, holdTableDefMySQL, keysTableDefMySQL, signaturesTableDefMySQL)
+		if err != nil {
+			log.Println("Error creating the license tables")
+			return nil, err
+		}
 	}
 
-	list, err := db.Prepare(listquery)
-	if err != nil {
-		return nil, err
-	}
+	listall := dbutils.NewStmt(replica, d.Bind(listallquery))
 
-	updaterights, err := db.Prepare(updaterightsquery)
-	if err != nil {
-		return nil, err
-	}
+	listalltenant := dbutils.NewStmt(replica, d.Bind(listalltenantquery))
 
-	add, err := db.Prepare(addquery)
-	if err != nil {
-		return nil, err
-	}
+	listafter := dbutils.NewStmt(replica, d.Bind(listafterquery))
 
-	update, err := db.Prepare(updatequery)
-	if err != nil {
-		return nil, err
-	}
+	listtenantafter := dbutils.NewStmt(replica, d.Bind(listtenantafterquery))
 
-	updatelsdstatus, err := db.Prepare(updatelsdstatusquery)
-	if err != nil {
-		return nil, err
-	}
+	list := dbutils.NewStmt(replica, d.Bind(listquery))
 
-	get, err := db.Prepare(getquery)
-	if err != nil {
-		return nil, err
-	}
+	listtenant := dbutils.NewStmt(replica, d.Bind(listtenantquery))
+
+	updaterights := dbutils.NewStmt(db, d.Bind(updaterightsquery))
 
-	return &sqlStore{db, listall, list, updaterights, add, update, updatelsdstatus, get}, nil
+	add := dbutils.NewStmt(db, d.Bind(addquery))
+
+	update := dbutils.NewStmt(db, d.Bind(updatequery))
+
+	updatelsdstatus := dbutils.NewStmt(db, d.Bind(updatelsdstatusquery))
+
+	get := dbutils.NewStmt(db, d.Bind(getquery))
+
+	getforupdate := dbutils.NewStmt(db, d.Bind(getforupdatequery))
+
+	// erasure of the personal data of a user
+	listbyuser := dbutils.NewStmt(db, d.Bind(listbyuserquery))
+
+	eraseuser := dbutils.NewStmt(db, d.Bind(eraseuserquery))
+
+	// retention of the expired licenses
+	countexpired := dbutils.NewStmt(db, d.Bind(countexpiredquery))
+
+	archiveexpired := dbutils.NewStmt(db, d.Bind(archiveexpiredquery))
+
+	deleteexpired := dbutils.NewStmt(db, d.Bind(deleteexpiredquery))
+
+	// accounting of the print and copy rights
+	getallowance := dbutils.NewStmt(db, d.Bind(getallowancequery))
+
+	consume := dbutils.NewStmt(db, d.Bind(consumequery))
+
+	// limit of the concurrent loans and holds
+	countloans := dbutils.NewStmt(db, d.Bind(countloansquery))
+
+	nextloanend := dbutils.NewStmt(db, d.Bind(nextloanendquery))
+
+	listholds := dbutils.NewStmt(db, d.Bind(listholdsquery))
+
+	addhold := dbutils.NewStmt(db, d.Bind(addholdquery))
+
+	removehold := dbutils.NewStmt(db, d.Bind(removeholdquery))
+
+	// keys of the licenses delivered, which let them be delivered again
+	getkeys := dbutils.NewStmt(db, d.Bind(getkeysquery))
+
+	savekeys := dbutils.NewStmt(db, d.Upsert("license_keys", []string{"license_id", "document"}, []string{"license_id"}))
+
+	erasekeys := dbutils.NewStmt(db, d.Bind(erasekeysquery))
+
+	purgekeys := dbutils.NewStmt(db, d.Bind(purgekeysquery))
+
+	listbyreference := dbutils.NewStmt(replica, d.Bind(listbyreferencequery))
+
+	// certificates which signed the licenses, during a key rotation
+	getsignature := dbutils.NewStmt(db, d.Bind(getsignaturequery))
+
+	savesignature := dbutils.NewStmt(db, d.Upsert("license_signature", []string{"license_id", "certificate"}, []string{"license_id"}))
+
+	countsignatures := dbutils.NewStmt(replica, d.Bind(countsignaturesquery))
+
+	purgesignatures := dbutils.NewStmt(db, d.Bind(purgesignaturesquery))
+
+	return &sqlStore{db, listall, listalltenant, listafter, listtenantafter, list, listtenant, updaterights, add, update, updatelsdstatus, get, getforupdate,
+		listbyuser, eraseuser, countexpired, archiveexpired, deleteexpired, getallowance, consume,
+		countloans, nextloanend, listholds, addhold, removehold, getkeys, savekeys, erasekeys, purgekeys, listbyreference,
+		getsignature, savesignature, countsignatures, purgesignatures, replica, d}, nil
 }
 
 const tableDef = "CREATE TABLE IF NOT EXISTS license (" +
@@ -275,6 +821,15 @@ const tableDef = "CREATE TABLE IF NOT EXISTS license (" +
 	"rights_end datetime DEFAULT NULL," +
 	"content_fk varchar(255) NOT NULL," +
 	"lsd_status integer default 0," +
+	"tenant varchar(255) NOT NULL default ''," +
+	"print_used integer NOT NULL default 0," +
+	"copy_used integer NOT NULL default 0," +
+	"profile varchar(255) NOT NULL default ''," +
+	"user_key_algorithm varchar(255) NOT NULL default ''," +
+	"content_version integer NOT NULL default 1," +
+	"extensions text DEFAULT NULL," +
+	"reference varchar(255) NOT NULL default ''," +
+	"links text DEFAULT NULL," +
 	"FOREIGN KEY(content_fk) REFERENCES content(id))"
 
 const tableDefPostgers = "CREATE TABLE IF NOT EXISTS license (" +
@@ -289,4 +844,111 @@ const tableDefPostgers = "CREATE TABLE IF NOT EXISTS license (" +
 	"rights_end TIMESTAMPTZ DEFAULT NULL," +
 	"content_fk VARCHAR(255) NOT NULL," +
 	"lsd_status INT default 0," +
-	"FOREIGN KEY(content_fk) REFERENCES content(id))"
\ No newline at end of file
+	"tenant VARCHAR(255) NOT NULL default ''," +
+	"print_used INT NOT NULL default 0," +
+	"copy_used INT NOT NULL default 0," +
+	"profile VARCHAR(255) NOT NULL default ''," +
+	"user_key_algorithm VARCHAR(255) NOT NULL default ''," +
+	"content_version INT NOT NULL default 1," +
+	"extensions TEXT DEFAULT NULL," +
+	"reference VARCHAR(255) NOT NULL default ''," +
+	"links TEXT DEFAULT NULL," +
+	"FOREIGN KEY(content_fk) REFERENCES content(id))"
+// archivedColumns are the columns copied to the license_archive table
+const archivedColumns = "id, user_id, provider, issued, updated, rights_print, rights_copy, rights_start, rights_end, content_fk, lsd_status, tenant"
+
+const archiveTableDef = "CREATE TABLE IF NOT EXISTS license_archive (" +
+	"id varchar(255) PRIMARY KEY," +
+	"user_id varchar(255) NOT NULL," +
+	"provider varchar(255) NOT NULL," +
+	"issued datetime NOT NULL," +
+	"updated datetime DEFAULT NULL," +
+	"rights_print int(11) DEFAULT NULL," +
+	"rights_copy int(11) DEFAULT NULL," +
+	"rights_start datetime DEFAULT NULL," +
+	"rights_end datetime DEFAULT NULL," +
+	"content_fk varchar(255) NOT NULL," +
+	"lsd_status integer default 0," +
+	"tenant varchar(255) NOT NULL default '')"
+
+const archiveTableDefPostgres = "CREATE TABLE IF NOT EXISTS license_archive (" +
+	"id VARCHAR(255) PRIMARY KEY," +
+	"user_id VARCHAR(255) NOT NULL," +
+	"provider VARCHAR(255) NOT NULL," +
+	"issued TIMESTAMPTZ NOT NULL," +
+	"updated TIMESTAMPTZ DEFAULT NULL," +
+	"rights_print INT DEFAULT NULL," +
+	"rights_copy INT DEFAULT NULL," +
+	"rights_start TIMESTAMPTZ DEFAULT NULL," +
+	"rights_end TIMESTAMPTZ DEFAULT NULL," +
+	"content_fk VARCHAR(255) NOT NULL," +
+	"lsd_status INT default 0," +
+	"tenant VARCHAR(255) NOT NULL default '')"
+
+// users waiting for a copy of a content limited to concurrent loans
+const holdTableDef = "CREATE TABLE IF NOT EXISTS license_hold (" +
+	"content_fk varchar(255) NOT NULL," +
+	"user_id varchar(255) NOT NULL," +
+	"created datetime NOT NULL," +
+	"PRIMARY KEY (content_fk, user_id))"
+
+const holdTableDefPostgres = "CREATE TABLE IF NOT EXISTS license_hold (" +
+	"content_fk VARCHAR(255) NOT NULL," +
+	"user_id VARCHAR(255) NOT NULL," +
+	"created TIMESTAMPTZ NOT NULL," +
+	"PRIMARY KEY (content_fk, user_id))"
+
+// indexes of the license table: lists by content, searches by user, lists by date
+// (the keyset pagination sorts on issued then id) and searches by status
+const indexDef = "CREATE INDEX IF NOT EXISTS license_content_fk_index ON license (content_fk);" +
+	"CREATE INDEX IF NOT EXISTS license_user_id_index ON license (user_id);" +
+	"CREATE INDEX IF NOT EXISTS license_issued_index ON license (issued, id);" +
+	"CREATE INDEX IF NOT EXISTS license_lsd_status_index ON license (lsd_status);" +
+	"CREATE INDEX IF NOT EXISTS license_reference_index ON license (reference);"
+
+var tableDefMySQL = dbutils.MySQLTable{Name: "license", Definition: "`id` varchar(255) NOT NULL PRIMARY KEY," +
+	"`user_id` varchar(255) NOT NULL," +
+	"`provider` varchar(255) NOT NULL," +
+	"`issued` datetime NOT NULL," +
+	"`updated` datetime NULL DEFAULT NULL," +
+	"`rights_print` int DEFAULT NULL," +
+	"`rights_copy` int DEFAULT NULL," +
+	"`rights_start` datetime NULL DEFAULT NULL," +
+	"`rights_end` datetime NULL DEFAULT NULL," +
+	"`content_fk` varchar(255) NOT NULL," +
+	"`lsd_status` int DEFAULT 0," +
+	"`tenant` varchar(255) NOT NULL DEFAULT ''," +
+	"`print_used` int NOT NULL DEFAULT 0," +
+	"`copy_used` int NOT NULL DEFAULT 0," +
+	"`profile` varchar(255) NOT NULL DEFAULT ''," +
+	"`user_key_algorithm` varchar(255) NOT NULL DEFAULT ''," +
+	"`content_version` int NOT NULL DEFAULT 1," +
+	"`extensions` text NULL DEFAULT NULL," +
+	"`reference` varchar(255) NOT NULL DEFAULT ''," +
+	"`links` text NULL DEFAULT NULL," +
+	"FOREIGN KEY(`content_fk`) REFERENCES `content`(`id`)",
+	// the foreign key already indexes content_fk
+	Indexes: []dbutils.MySQLIndex{
+		{Name: "license_user_id_index", Columns: "`user_id`"},
+		{Name: "license_issued_index", Columns: "`issued`, `id`"},
+		{Name: "license_lsd_status_index", Columns: "`lsd_status`"},
+		{Name: "license_reference_index", Columns: "`reference`"},
+	}}
+
+var archiveTableDefMySQL = dbutils.MySQLTable{Name: "license_archive", Definition: "`id` varchar(255) NOT NULL PRIMARY KEY," +
+	"`user_id` varchar(255) NOT NULL," +
+	"`provider` varchar(255) NOT NULL," +
+	"`issued` datetime NOT NULL," +
+	"`updated` datetime NULL DEFAULT NULL," +
+	"`rights_print` int DEFAULT NULL," +
+	"`rights_copy` int DEFAULT NULL," +
+	"`rights_start` datetime NULL DEFAULT NULL," +
+	"`rights_end` datetime NULL DEFAULT NULL," +
+	"`content_fk` varchar(255) NOT NULL," +
+	"`lsd_status` int DEFAULT 0," +
+	"`tenant` varchar(255) NOT NULL DEFAULT ''"}
+
+var holdTableDefMySQL = dbutils.MySQLTable{Name: "license_hold", Definition: "`content_fk` varchar(255) NOT NULL," +
+	"`user_id` varchar(255) NOT NULL," +
+	"`created` datetime NOT NULL," +
+	"PRIMARY KEY (`content_fk`, `user_id`)"}
@@ -64,8 +64,8 @@ func TestStoreAdd(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	l := License{}
-	Initialize(&l)
+	l := License{Rights: new(UserRights)}
+	Initialize("c1", &l)
 	err = st.Add(l)
 	if err != nil {
 		t.Fatal(err)
@@ -82,3 +82,41 @@ func TestStoreAdd(t *testing.T) {
 		t.Error("Difference between Add and Get")
 	}
 }
+
+func TestStoreLinks(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	st, err := NewSqlStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := License{Rights: new(UserRights)}
+	Initialize("c1", &l)
+	if err = st.Add(l); err != nil {
+		t.Fatal(err)
+	}
+	etag := ETag(l)
+
+	// only the links set by the provider are stored
+	l.Links = []Link{{Rel: "hint", Href: "https://example.com/hint"}, {Rel: "publication", Href: "https://example.com/c1.epub"}}
+	if err = st.UpdateIfMatch(l, etag); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := st.Get(l.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Links) != 1 || stored.Links[0].Rel != "hint" || stored.Links[0].Href != "https://example.com/hint" {
+		t.Errorf("Unexpected stored links %+v", stored.Links)
+	}
+	// the links are part of the entity tag
+	withoutLinks := stored
+	withoutLinks.Links = nil
+	if ETag(stored) == ETag(withoutLinks) {
+		t.Error("Expected the links to change the entity tag")
+	}
+}
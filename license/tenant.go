@@ -0,0 +1,190 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/readium/readium-lcp-server/dbutils"
+)
+
+// ErrOperatorOnly is returned when a tenant calls an operation reserved to the operator of the server
+var ErrOperatorOnly = errors.New("This operation is reserved to the operator of the License Server")
+
+// tenantStore restricts a license store to the licenses of a tenant:
+// the licenses of other tenants are reported as not found
+type tenantStore struct {
+	Store
+	tenant string
+}
+
+// ForTenant returns a view of the store restricted to the licenses of a tenant;
+// the licenses added through this view belong to the tenant.
+func ForTenant(s Store, tenant string) Store {
+	return tenantStore{Store: s, tenant: tenant}
+}
+
+// owned checks that a license belongs to the tenant
+func (s tenantStore) owned(id string) error {
+	_, err := s.Get(id)
+	return err
+}
+
+func (s tenantStore) Get(id string) (License, error) {
+	l, err := s.Store.Get(id)
+	if err == nil && l.Tenant != s.tenant {
+		return License{}, ErrNotFound
+	}
+	return l, err
+}
+
+func (s tenantStore) Add(l License) error {
+	l.Tenant = s.tenant
+	return s.Store.Add(l)
+}
+
+func (s tenantStore) AddTx(tx *sql.Tx, l License) error {
+	l.Tenant = s.tenant
+	return s.Store.AddTx(tx, l)
+}
+
+func (s tenantStore) Update(l License) error {
+	if err := s.owned(l.Id); err != nil {
+		return err
+	}
+	return s.Store.Update(l)
+}
+
+func (s tenantStore) UpdateIfMatch(l License, etag string) error {
+	if err := s.owned(l.Id); err != nil {
+		return err
+	}
+	return s.Store.UpdateIfMatch(l, etag)
+}
+
+func (s tenantStore) UpdateRights(l License) error {
+	if err := s.owned(l.Id); err != nil {
+		return err
+	}
+	return s.Store.UpdateRights(l)
+}
+
+func (s tenantStore) UpdateLsdStatus(id string, status int32) error {
+	if err := s.owned(id); err != nil {
+		return err
+	}
+	return s.Store.UpdateLsdStatus(id, status)
+}
+
+func (s tenantStore) GetAllowance(id string) (Allowance, error) {
+	if err := s.owned(id); err != nil {
+		return Allowance{}, err
+	}
+	return s.Store.GetAllowance(id)
+}
+
+func (s tenantStore) Consume(id string, print int32, copy int32) (Allowance, error) {
+	if err := s.owned(id); err != nil {
+		return Allowance{}, err
+	}
+	return s.Store.Consume(id, print, copy)
+}
+
+func (s tenantStore) SaveKeys(id string, k Keys) error {
+	if err := s.owned(id); err != nil {
+		return err
+	}
+	return s.Store.SaveKeys(id, k)
+}
+
+func (s tenantStore) GetKeys(id string) (Keys, error) {
+	if err := s.owned(id); err != nil {
+		return Keys{}, err
+	}
+	return s.Store.GetKeys(id)
+}
+
+func (s tenantStore) SaveSignature(id string, certificate string) error {
+	if err := s.owned(id); err != nil {
+		return err
+	}
+	return s.Store.SaveSignature(id, certificate)
+}
+
+func (s tenantStore) GetSignature(id string) (string, error) {
+	if err := s.owned(id); err != nil {
+		return "", err
+	}
+	return s.Store.GetSignature(id)
+}
+
+// CountSignatures is reserved to the operator, the certificates may be shared by the tenants
+func (s tenantStore) CountSignatures(now time.Time) ([]SignatureCount, error) {
+	return nil, ErrOperatorOnly
+}
+
+// EraseUser is reserved to the operator: the identifiers of users are not scoped by tenant
+func (s tenantStore) EraseUser(userID string, pseudonym string) ([]string, error) {
+	return nil, ErrOperatorOnly
+}
+
+// PurgeExpired is reserved to the operator, the retention rules apply to all the tenants
+func (s tenantStore) PurgeExpired(before time.Time, archive bool, dryRun bool) (int64, error) {
+	return 0, ErrOperatorOnly
+}
+
+// List lists the licenses of the tenant for a content
+func (s tenantStore) List(contentID string, page int, pageNum int) func() (LicenseReport, error) {
+	return s.Store.ListForTenant(s.tenant, contentID, page, pageNum)
+}
+
+// ListForTenant lists the licenses of the tenant, whatever the tenant given
+func (s tenantStore) ListForTenant(tenant string, contentID string, page int, pageNum int) func() (LicenseReport, error) {
+	return s.Store.ListForTenant(s.tenant, contentID, page, pageNum)
+}
+
+func (s tenantStore) ListAll(page int, pageNum int) func() (LicenseReport, error) {
+	return s.Store.ListAllForTenant(s.tenant, page, pageNum)
+}
+
+func (s tenantStore) ListAllAfter(after Cursor, limit int) func() (LicenseReport, error) {
+	return s.Store.ListAllForTenantAfter(s.tenant, after, limit)
+}
+
+// ListAllForTenant lists the licenses of the tenant, whatever the tenant given
+func (s tenantStore) ListAllForTenant(tenant string, page int, pageNum int) func() (LicenseReport, error) {
+	return s.Store.ListAllForTenant(s.tenant, page, pageNum)
+}
+
+// ListAllForTenantAfter lists the licenses of the tenant, whatever the tenant given
+func (s tenantStore) ListAllForTenantAfter(tenant string, after Cursor, limit int) func() (LicenseReport, error) {
+	return s.Store.ListAllForTenantAfter(s.tenant, after, limit)
+}
+
+// ListReports lists the licenses of the tenant
+func (s tenantStore) ListReports(filter ReportFilter, listing dbutils.Listing) func() (LicenseReport, error) {
+	filter.Tenant = s.tenant
+	return s.Store.ListReports(filter, listing)
+}
+
+// ExportReports exports the licenses of the tenant
+func (s tenantStore) ExportReports(filter ReportFilter, fn func(LicenseReport) error) error {
+	filter.Tenant = s.tenant
+	return s.Store.ExportReports(filter, fn)
+}
+
+// ListByReference lists the licenses of the tenant generated with an external reference
+func (s tenantStore) ListByReference(reference string) ([]LicenseReport, error) {
+	all, err := s.Store.ListByReference(reference)
+	var licenses []LicenseReport
+	for _, l := range all {
+		if l.Tenant == s.tenant {
+			licenses = append(licenses, l)
+		}
+	}
+	return licenses, err
+}
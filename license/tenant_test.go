@@ -0,0 +1,111 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestTenantStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	st, err := NewSqlStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1, t2 := ForTenant(st, "t1"), ForTenant(st, "t2")
+
+	// the licenses of the other tenant come first in the table
+	var own []string
+	for i, tenant := range []Store{t2, t2, t1, t1, t1} {
+		l := License{Provider: "http://example.com", Rights: new(UserRights)}
+		Initialize("c1", &l)
+		l.User.Id = "u" + string(rune('1'+i))
+		if err = tenant.Add(l); err != nil {
+			t.Fatal(err)
+		}
+		if tenant == t1 {
+			own = append(own, l.Id)
+		}
+	}
+	var foreign string
+	fn := st.ListAll(10, 0)
+	for l, err := fn(); err == nil; l, err = fn() {
+		if l.Tenant == "t2" {
+			foreign = l.Id
+		}
+	}
+	if foreign == "" {
+		t.Fatal("Expected the licenses of another tenant")
+	}
+
+	// a page of the licenses of a content is full
+	count := func(fn func() (LicenseReport, error)) int {
+		n := 0
+		for l, err := fn(); err == nil; l, err = fn() {
+			if l.Tenant != "t1" {
+				t.Errorf("Expected the licenses of the tenant, got %s", l.Tenant)
+			}
+			n++
+		}
+		return n
+	}
+	if n := count(t1.List("c1", 2, 0)); n != 2 {
+		t.Errorf("Expected a page of 2 licenses, got %d", n)
+	}
+	if n := count(t1.List("c1", 2, 1)); n != 1 {
+		t.Errorf("Expected a page of 1 license, got %d", n)
+	}
+	if n := count(t1.ListAll(10, 0)); n != 3 {
+		t.Errorf("Expected the 3 licenses of the tenant, got %d", n)
+	}
+	// another tenant cannot be listed through the view of a tenant
+	if n := count(t1.ListAllForTenant("t2", 10, 0)); n != 3 {
+		t.Errorf("Expected the 3 licenses of the tenant, got %d", n)
+	}
+	if n := count(t1.ListForTenant("t2", "c1", 10, 0)); n != 3 {
+		t.Errorf("Expected the 3 licenses of the tenant, got %d", n)
+	}
+
+	// the licenses of another tenant are not found
+	if _, err = t1.Get(own[0]); err != nil {
+		t.Errorf("Expected the license of the tenant, got %v", err)
+	}
+	if _, err = t1.Get(foreign); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the license of another tenant not to be found, got %v", err)
+	}
+	l, err := st.Get(foreign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.User.Id = "intruder"
+	if err = t1.Update(l); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the update to be refused, got %v", err)
+	}
+	if err = t1.UpdateRights(l); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the update of the rights to be refused, got %v", err)
+	}
+	if err = t1.UpdateLsdStatus(foreign, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the update of the status to be refused, got %v", err)
+	}
+	if _, err = t1.GetAllowance(foreign); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the allowance not to be found, got %v", err)
+	}
+	if l, err = st.Get(foreign); err != nil || l.User.Id == "intruder" {
+		t.Errorf("Expected the license to be unchanged, got %+v (%v)", l, err)
+	}
+	// the operations on all the licenses are reserved to the operator
+	if _, err = t1.EraseUser("u1", "anonymous"); err != ErrOperatorOnly {
+		t.Errorf("Expected the erasure to be refused, got %v", err)
+	}
+}
@@ -5,9 +5,133 @@
 
 package license
 
-// GenerateUserKey function prepares the user key
-func GenerateUserKey(key UserKey) []byte {
-	var userKey []byte
-	userKey = key.Value
-	return userKey
+import (
+	"errors"
+	"sync"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// SHA256_URI is the passphrase hash algorithm of the LCP profiles
+const SHA256_URI = "http://www.w3.org/2001/04/xmlenc#sha256"
+
+// ErrUnsupportedHashAlgorithm is returned when the passphrase hash algorithm is not accepted by the profile of a license
+var ErrUnsupportedHashAlgorithm = errors.New("The passphrase hash algorithm is not supported by the profile of the license")
+
+// ErrBadHashSize is returned when the passphrase hash does not have the size of its algorithm
+var ErrBadHashSize = errors.New("The size of the passphrase hash does not match its algorithm")
+
+// UserKeyDerivation derives the user key (32 bytes) from the passphrase hash
+type UserKeyDerivation func(hash []byte) ([]byte, error)
+
+type derivation struct {
+	size   int
+	derive UserKeyDerivation
+}
+
+var (
+	derivationsMutex sync.RWMutex
+	derivations      = map[string]derivation{}
+)
+
+func derivationKey(profile string, algorithm string) string {
+	return profile + " " + algorithm
+}
+
+// RegisterUserKeyDerivation registers the derivation of the user key for a profile and a passphrase hash algorithm,
+// whose hashes have the given size. It replaces the derivation registered for the same profile and algorithm,
+// e.g. the transformation of the production profiles.
+//
+func RegisterUserKeyDerivation(profile string, algorithm string, size int, derive UserKeyDerivation) {
+	derivationsMutex.Lock()
+	defer derivationsMutex.Unlock()
+	derivations[derivationKey(profile, algorithm)] = derivation{size: size, derive: derive}
+}
+
+func init() {
+	// the passphrase hash is the user key
+	identity := func(hash []byte) ([]byte, error) { return hash, nil }
+	RegisterUserKeyDerivation(BASIC_PROFILE, SHA256_URI, 32, identity)
+	RegisterUserKeyDerivation(V1_PROFILE, SHA256_URI, 32, identity)
+}
+
+func getDerivation(profile string, algorithm string) (derivation, bool) {
+	derivationsMutex.RLock()
+	defer derivationsMutex.RUnlock()
+	d, ok := derivations[derivationKey(profile, algorithm)]
+	return d, ok
+}
+
+// HashSize returns the size of the passphrase hashes of an algorithm, 0 if no profile supports it
+//
+func HashSize(algorithm string) int {
+	derivationsMutex.RLock()
+	defer derivationsMutex.RUnlock()
+	for _, profile := range []string{BASIC_PROFILE, V1_PROFILE} {
+		if d, ok := derivations[derivationKey(profile, algorithm)]; ok {
+			return d.size
+		}
+	}
+	return 0
+}
+
+// HashAlgorithms returns the passphrase hash algorithms accepted for a profile, from the configuration;
+// sha256 by default
+//
+func HashAlgorithms(profile string) []string {
+	name := "basic"
+	if profile == V1_PROFILE {
+		name = "1.0"
+	}
+	if algorithms := config.Config.License.HashAlgorithms[name]; len(algorithms) > 0 {
+		return algorithms
+	}
+	return []string{SHA256_URI}
+}
+
+// NegotiateHashAlgorithm checks that the passphrase hash algorithm given for a license is accepted by its profile;
+// if none is given, the preferred algorithm of the profile is used
+//
+func NegotiateHashAlgorithm(l *License) error {
+	accepted := HashAlgorithms(l.Encryption.Profile)
+	algorithm := l.Encryption.UserKey.Algorithm
+	if algorithm == "" {
+		algorithm = accepted[0]
+	}
+	for _, a := range accepted {
+		if a != algorithm {
+			continue
+		}
+		if _, ok := getDerivation(l.Encryption.Profile, algorithm); !ok {
+			break
+		}
+		l.Encryption.UserKey.Algorithm = algorithm
+		return nil
+	}
+	return ErrUnsupportedHashAlgorithm
+}
+
+// GenerateUserKey derives the user key from the passphrase hash, as defined by the profile
+// and the passphrase hash algorithm (sha256 if not set)
+//
+func GenerateUserKey(profile string, key UserKey) ([]byte, error) {
+	algorithm := key.Algorithm
+	if algorithm == "" {
+		algorithm = SHA256_URI
+	}
+	d, ok := getDerivation(profile, algorithm)
+	if !ok {
+		// the licenses of an unknown profile are built like the licenses of the basic profile
+		if d, ok = getDerivation(BASIC_PROFILE, algorithm); !ok {
+			return nil, ErrUnsupportedHashAlgorithm
+		}
+	}
+	if len(key.Value) != d.size {
+		return nil, ErrBadHashSize
+	}
+	userKey, err := d.derive(key.Value)
+	if err == nil && len(userKey) != 32 {
+		err = errors.New("The user key derived from the passphrase hash must be 32 bytes long")
+	}
+	return userKey, err
 }
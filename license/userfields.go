@@ -0,0 +1,111 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package license
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+
+	"github.com/readium/readium-lcp-server/crypto"
+)
+
+// EncryptableUserFields are the fields of the user info which may be encrypted with the user key
+var EncryptableUserFields = []string{"email", "name"}
+
+// ErrUnknownUserField is returned when a field of the user info cannot be encrypted
+var ErrUnknownUserField = errors.New("Only the email and name of the user can be encrypted")
+
+// userField returns the value of a field of the user info, nil if the field cannot be encrypted
+func userField(u *UserInfo, name string) *string {
+	switch name {
+	case "email":
+		return &u.Email
+	case "name":
+		return &u.Name
+	}
+	return nil
+}
+
+// CheckEncryptedFields checks that the encrypted fields of a user info are known and listed once
+//
+func CheckEncryptedFields(u UserInfo) error {
+	seen := make(map[string]bool)
+	for _, name := range u.Encrypted {
+		if userField(&u, name) == nil || seen[name] {
+			return ErrUnknownUserField
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// AddEncryptedFields adds fields to the encrypted fields of a user info, when they are set
+// and not already listed; the fields are encrypted with the user key when the license is built
+//
+func AddEncryptedFields(u *UserInfo, fields []string) {
+	for _, name := range fields {
+		value := userField(u, name)
+		if value == nil || *value == "" {
+			continue
+		}
+		listed := false
+		for _, encrypted := range u.Encrypted {
+			if encrypted == name {
+				listed = true
+				break
+			}
+		}
+		if !listed {
+			u.Encrypted = append(u.Encrypted, name)
+		}
+	}
+}
+
+// EncryptUserField encrypts the value of a user field with the user key, as required by the LCP specification;
+// the result is base64 encoded
+//
+func EncryptUserField(userKey []byte, value string) (string, error) {
+	var out bytes.Buffer
+	err := crypto.NewAESEncrypter_FIELDS().Encrypt(userKey, bytes.NewBufferString(value), &out)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(out.Bytes()), nil
+}
+
+// DecryptUserField decrypts the base64 encoded value of a user field with the user key
+//
+func DecryptUserField(userKey []byte, value string) (string, error) {
+	encrypted, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	var clear bytes.Buffer
+	decrypter := crypto.NewAESEncrypter_FIELDS().(crypto.Decrypter)
+	if err = decrypter.Decrypt(userKey, bytes.NewReader(encrypted), &clear); err != nil {
+		return "", err
+	}
+	return clear.String(), nil
+}
+
+// DecryptUserInfo decrypts the encrypted fields of a user info in place, e.g. for a support tool
+// which knows the user passphrase
+//
+func DecryptUserInfo(u *UserInfo, userKey []byte) error {
+	if err := CheckEncryptedFields(*u); err != nil {
+		return err
+	}
+	for _, name := range u.Encrypted {
+		field := userField(u, name)
+		clear, err := DecryptUserField(userKey, *field)
+		if err != nil {
+			return err
+		}
+		*field = clear
+	}
+	u.Encrypted = nil
+	return nil
+}
@@ -26,6 +26,7 @@
 package licensestatuses
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/readium/readium-lcp-server/transactions"
@@ -60,4 +61,37 @@ type LicenseStatus struct {
 	PotentialRights   *PotentialRights     `json:"potential_rights,omitempty"`
 	Events            []transactions.Event `json:"events,omitempty"`
 	CurrentEndLicense *time.Time           `json:"-"`
+	Tenant            string               `json:"-"`
+	// the policy which computed the potential end of the loan
+	PotentialRightsPolicy string `json:"-"`
+	// the provider of the license, which selects the extensions of the status document
+	Provider string `json:"-"`
+	// the content of the license, which groups the statistics per publication
+	ContentId string `json:"-"`
+	// the vendor fields of the status document, named by URIs
+	Extensions map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON encodes a license status, with the vendor fields of its extensions
+func (ls LicenseStatus) MarshalJSON() ([]byte, error) {
+	// the alias type has the fields of LicenseStatus, without its methods
+	type licenseStatus LicenseStatus
+	data, err := json.Marshal(licenseStatus(ls))
+	if err != nil || len(ls.Extensions) == 0 {
+		return data, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range ls.Extensions {
+		// the fields of the specification are kept
+		if _, ok := fields[name]; ok {
+			continue
+		}
+		if fields[name], err = json.Marshal(value); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(fields)
 }
@@ -27,32 +27,65 @@ package licensestatuses
 
 import (
 	"database/sql"
-	"errors"
 	"log"
-	"strings"
 	"time"
 
 	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
 	"github.com/readium/readium-lcp-server/status"
 )
 
-var NotFound = errors.New("License Status not found")
+// the errors of the license status store; the errors of the database are wrapped in errors of kind ErrStorage,
+// the violations of a unique constraint in errors of kind ErrConflict
+var (
+	ErrNotFound = dbutils.NewError(dbutils.ErrNotFound, "License Status not found")
+	ErrConflict = dbutils.NewError(dbutils.ErrConflict, "License Status conflict")
+	ErrStorage  = dbutils.NewError(dbutils.ErrStorage, "License Status storage error")
+)
+
+// wrap returns the error of an operation of the store
+func wrap(op string, err error) error {
+	return dbutils.Wrap(op, err, ErrNotFound, ErrConflict, ErrStorage)
+}
 
 type LicenseStatuses interface {
 	//Get(id int) (LicenseStatus, error)
 	Add(ls LicenseStatus) error
 	List(deviceLimit int64, limit int64, offset int64) func() (LicenseStatus, error)
+	ListSorted(deviceLimit int64, listing dbutils.Listing) func() (LicenseStatus, error)
 	GetByLicenseId(id string) (*LicenseStatus, error)
 	Update(ls LicenseStatus) error
+	UpdateTx(tx *sql.Tx, ls LicenseStatus) error
+	Begin() (*sql.Tx, error)
+	CountByStatus() (map[string]int64, error)
+	PurgeReturned(before time.Time, dryRun bool) (int64, error)
 }
 
 type dbLicenseStatuses struct {
 	db             *sql.DB
-	get            *sql.Stmt
-	add            *sql.Stmt
-	list           *sql.Stmt
-	getbylicenseid *sql.Stmt
-	update         *sql.Stmt
+	get            *dbutils.Stmt
+	add            *dbutils.Stmt
+	list           *dbutils.Stmt
+	getbylicenseid *dbutils.Stmt
+	update         *dbutils.Stmt
+	countbystatus  *dbutils.Stmt
+	countreturned  *dbutils.Stmt
+	purgeevents    *dbutils.Stmt
+	purgearchived  *dbutils.Stmt
+	purgereturned  *dbutils.Stmt
+	replica        *sql.DB
+	dialect        dbutils.Dialect
+}
+
+// statusSortColumns are the columns of the fields the license statuses are sorted by;
+// "created" is the order in which the statuses were created
+var statusSortColumns = map[string]string{
+	"created":         "id",
+	"id":              "license_ref",
+	"status":          "status",
+	"device_count":    "device_count",
+	"license_updated": "license_updated",
+	"status_updated":  "status_updated",
 }
 
 // //Get gets license status by id
@@ -79,21 +112,39 @@ type dbLicenseStatuses struct {
 //Add adds license status to database
 func (i dbLicenseStatuses) Add(ls LicenseStatus) error {
 	statusDB, err := status.SetStatus(ls.Status)
-	if err == nil {
-		var end time.Time
-		if ls.PotentialRights != nil && ls.PotentialRights.End != nil && !(*ls.PotentialRights.End).IsZero() {
-			end = *ls.PotentialRights.End
-		}
-		_, err = i.add.Exec(statusDB, ls.Updated.License, ls.Updated.Status, ls.DeviceCount, &end, ls.LicenseRef, ls.CurrentEndLicense)
+	if err != nil {
+		return err
 	}
-	return err
+	var end time.Time
+	if ls.PotentialRights != nil && ls.PotentialRights.End != nil && !(*ls.PotentialRights.End).IsZero() {
+		end = *ls.PotentialRights.End
+	}
+	_, err = i.add.Exec(statusDB, ls.Updated.License, ls.Updated.Status, ls.DeviceCount, &end, ls.LicenseRef, ls.CurrentEndLicense, ls.Tenant, ls.PotentialRightsPolicy, ls.Provider, ls.ContentId)
+	return wrap("add license status", err)
 }
 
 //List gets license statuses which have devices count more than devices limit
 //input parameters: limit - how much license statuses need to get, offset - from what position need to start
 func (i dbLicenseStatuses) List(deviceLimit int64, limit int64, offset int64) func() (LicenseStatus, error) {
-	rows, err := i.list.Query(deviceLimit, limit, offset)
+	return listStatuses(i.list.Query(deviceLimit, limit, offset))
+}
+
+// ListSorted gets the license statuses which have at least deviceLimit devices, sorted by created, id,
+// status, device_count, license_updated or status_updated; the last created first by default
+func (i dbLicenseStatuses) ListSorted(deviceLimit int64, listing dbutils.Listing) func() (LicenseStatus, error) {
+	clauses, err := listing.Clauses(statusSortColumns, "-created", "id")
 	if err != nil {
+		return listStatuses(nil, err)
+	}
+	query := "SELECT status, license_updated, status_updated, device_count, license_ref FROM license_status WHERE device_count >= ?"
+	// the sort and the page are not parameters of the query: the query is not prepared
+	return listStatuses(i.replica.Query(i.dialect.Bind(query+clauses), deviceLimit))
+}
+
+// listStatuses iterates on the rows of a list of license statuses
+func listStatuses(rows *sql.Rows, err error) func() (LicenseStatus, error) {
+	if err != nil {
+		err = wrap("list license statuses", err)
 		return func() (LicenseStatus, error) { return LicenseStatus{}, err }
 	}
 	return func() (LicenseStatus, error) {
@@ -110,9 +161,9 @@ func (i dbLicenseStatuses) List(deviceLimit int64, limit int64, offset int64) fu
 			}
 		} else {
 			rows.Close()
-			err = NotFound
+			err = ErrNotFound
 		}
-		return ls, err
+		return ls, wrap("list license statuses", err)
 	}
 }
 
@@ -126,7 +177,7 @@ func (i dbLicenseStatuses) GetByLicenseId(licenseFk string) (*LicenseStatus, err
 	var statusUpdate *time.Time
 
 	row := i.getbylicenseid.QueryRow(licenseFk)
-	err := row.Scan(&ls.Id, &statusDB, &licenseUpdate, &statusUpdate, &ls.DeviceCount, &potentialRightsEnd, &ls.LicenseRef, &ls.CurrentEndLicense)
+	err := row.Scan(&ls.Id, &statusDB, &licenseUpdate, &statusUpdate, &ls.DeviceCount, &potentialRightsEnd, &ls.LicenseRef, &ls.CurrentEndLicense, &ls.Tenant, &ls.PotentialRightsPolicy, &ls.Provider)
 
 	if err == nil {
 		status.GetStatus(statusDB, &ls.Status)
@@ -142,17 +193,30 @@ func (i dbLicenseStatuses) GetByLicenseId(licenseFk string) (*LicenseStatus, err
 			ls.Updated.Status = statusUpdate
 			ls.Updated.License = licenseUpdate
 		}
-	} else {
-		if err == sql.ErrNoRows {
-			return nil, err
-		}
+	} else if err == sql.ErrNoRows {
+		return nil, ErrNotFound
 	}
 
-	return &ls, err
+	return &ls, wrap("get license status", err)
 }
 
 //Update updates license status
 func (i dbLicenseStatuses) Update(ls LicenseStatus) error {
+	return i.updateIn(nil, ls)
+}
+
+// UpdateTx updates a license status in a transaction, e.g. with the event which changes it
+func (i dbLicenseStatuses) UpdateTx(tx *sql.Tx, ls LicenseStatus) error {
+	return i.updateIn(tx, ls)
+}
+
+// Begin starts a transaction on the database of the license statuses, which is also the database of the events
+func (i dbLicenseStatuses) Begin() (*sql.Tx, error) {
+	return i.db.Begin()
+}
+
+// updateIn updates a license status, in a transaction if tx is not nil
+func (i dbLicenseStatuses) updateIn(tx *sql.Tx, ls LicenseStatus) error {
 
 	statusInt, err := status.SetStatus(ls.Status)
 	if err != nil {
@@ -165,74 +229,160 @@ func (i dbLicenseStatuses) Update(ls LicenseStatus) error {
 		potentialRightsEnd = ls.PotentialRights.End
 	}
 
+	args := []interface{}{statusInt, ls.Updated.License, ls.Updated.Status, ls.DeviceCount, potentialRightsEnd, ls.CurrentEndLicense, ls.PotentialRightsPolicy, ls.Id}
 	var result sql.Result
-	result, err = i.update.Exec(statusInt, ls.Updated.License, ls.Updated.Status, ls.DeviceCount, potentialRightsEnd, ls.CurrentEndLicense, ls.Id)
+	if tx != nil {
+		result, err = i.update.ExecTx(tx, args...)
+	} else {
+		result, err = i.update.Exec(args...)
+	}
 
 	if err == nil {
 		if r, _ := result.RowsAffected(); r == 0 {
-			return NotFound
+			return ErrNotFound
+		}
+	}
+	return wrap("update license status", err)
+}
+
+//CountByStatus returns the number of license statuses per status
+func (i dbLicenseStatuses) CountByStatus() (map[string]int64, error) {
+	counts := make(map[string]int64)
+	// every status is returned, even if no license status is in this state
+	for _, st := range status.StatusValues {
+		counts[st] = 0
+	}
+
+	rows, err := i.countbystatus.Query()
+	if err != nil {
+		return nil, wrap("count license statuses", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var statusDB, count int64
+		var st string
+		err = rows.Scan(&statusDB, &count)
+		if err != nil {
+			return nil, wrap("count license statuses", err)
+		}
+		status.GetStatus(statusDB, &st)
+		if st != "" {
+			counts[st] += count
 		}
 	}
-	return err
+	return counts, wrap("count license statuses", rows.Err())
+}
+
+// PurgeReturned deletes the license statuses of the loans returned before a date, with their events,
+// and returns their number. In dry-run mode, the license statuses are only counted.
+func (i dbLicenseStatuses) PurgeReturned(before time.Time, dryRun bool) (int64, error) {
+	before = before.UTC()
+	if dryRun {
+		var count int64
+		err := i.countreturned.QueryRow(status.STATUS_RETURNED_INT, before).Scan(&count)
+		return count, wrap("purge license statuses", err)
+	}
+	tx, err := i.db.Begin()
+	if err != nil {
+		return 0, wrap("purge license statuses", err)
+	}
+	// the events reference the license statuses
+	_, err = i.purgeevents.ExecTx(tx, status.STATUS_RETURNED_INT, before)
+	if err == nil {
+		_, err = i.purgearchived.ExecTx(tx, status.STATUS_RETURNED_INT, before)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, wrap("purge license statuses", err)
+	}
+	res, err := i.purgereturned.ExecTx(tx, status.STATUS_RETURNED_INT, before)
+	if err != nil {
+		tx.Rollback()
+		return 0, wrap("purge license statuses", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, wrap("purge license statuses", err)
+	}
+	n, err := res.RowsAffected()
+	return n, wrap("purge license statuses", err)
 }
 
 //Open defines scripts for queries & create table license_status if it does not exist
 func Open(db *sql.DB) (l LicenseStatuses, err error) {
+	return OpenWithReplica(db, db)
+}
+
+// OpenWithReplica opens the license statuses; listings and statistics are read from the replica database.
+func OpenWithReplica(db *sql.DB, replica *sql.DB) (l LicenseStatuses, err error) {
 
 	var createTableQuery, getQuery, getByLicenseIdQuery, addQuery, updateQuery, listQuery string
-	if strings.HasPrefix(config.Config.LcpServer.Database, "postgres") {
-		// postgres
+	var countReturnedQuery, purgeEventsQuery, purgeArchivedQuery, purgeReturnedQuery string
+	countByStatusQuery := "SELECT status, COUNT(*) FROM license_status GROUP BY status"
+	// the queries are written with '?' placeholders, bound to the dialect of the database
+	d := dbutils.DialectOf(config.Config.LsdServer.Database)
+	createTableQuery = tableDef
+	if d == dbutils.Postgres {
 		createTableQuery = tableDefPostgres
-		getQuery = "SELECT * FROM license_status WHERE id = $1 LIMIT 1"
-		getByLicenseIdQuery = "SELECT * FROM license_status where license_ref = $1"
-		listQuery = "SELECT status, license_updated, status_updated, device_count, license_ref FROM license_status WHERE device_count >= $1 ORDER BY id DESC LIMIT $2 OFFSET $3"
-		addQuery = "INSERT INTO license_status (status, license_updated, status_updated, device_count, potential_rights_end, license_ref, rights_end) VALUES ($1, $2, $3, $4, $5, $6, $7)"
-		updateQuery = "UPDATE license_status SET status=$1, license_updated=$2, status_updated=$3, device_count=$4, potential_rights_end=$5, rights_end=$6 WHERE id=$7"
-	} else {
-		// mysql/sqlite
-		createTableQuery = tableDef
-		getQuery = "SELECT * FROM license_status WHERE id = ? LIMIT 1"
-		getByLicenseIdQuery = "SELECT * FROM license_status where license_ref = ?"
-		listQuery = "SELECT status, license_updated, status_updated, device_count, license_ref FROM license_status WHERE device_count >= ? ORDER BY id DESC LIMIT ? OFFSET ?"
-		addQuery = "INSERT INTO license_status (status, license_updated, status_updated, device_count, potential_rights_end, license_ref, rights_end) VALUES (?, ?, ?, ?, ?, ?, ?)"
-		updateQuery = "UPDATE license_status SET status=?, license_updated=?, status_updated=?, device_count=?,potential_rights_end=?,  rights_end=?  WHERE id=?"
 	}
+	getQuery = "SELECT id, status, license_updated, status_updated, device_count, potential_rights_end, license_ref, rights_end, tenant, potential_rights_policy, provider FROM license_status WHERE id = ? LIMIT 1"
+	getByLicenseIdQuery = "SELECT id, status, license_updated, status_updated, device_count, potential_rights_end, license_ref, rights_end, tenant, potential_rights_policy, provider FROM license_status where license_ref = ?"
+	listQuery = "SELECT status, license_updated, status_updated, device_count, license_ref FROM license_status WHERE device_count >= ? ORDER BY id DESC LIMIT ? OFFSET ?"
+	addQuery = "INSERT INTO license_status (status, license_updated, status_updated, device_count, potential_rights_end, license_ref, rights_end, tenant, potential_rights_policy, provider, content_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	updateQuery = "UPDATE license_status SET status=?, license_updated=?, status_updated=?, device_count=?, potential_rights_end=?, rights_end=?, potential_rights_policy=? WHERE id=?"
+	countReturnedQuery = "SELECT COUNT(*) FROM license_status WHERE status = ? AND status_updated < ?"
+	purgeEventsQuery = "DELETE FROM event WHERE license_status_fk IN (SELECT id FROM license_status WHERE status = ? AND status_updated < ?)"
+	purgeArchivedQuery = "DELETE FROM event_archive WHERE license_status_fk IN (SELECT id FROM license_status WHERE status = ? AND status_updated < ?)"
+	purgeReturnedQuery = "DELETE FROM license_status WHERE status = ? AND status_updated < ?"
 
 	// if sqlite/postgres, create the license_status table in the lsd db if it does not exist
-	if strings.HasPrefix(config.Config.LsdServer.Database, "sqlite") || strings.HasPrefix(config.Config.LcpServer.Database, "postgres") {
+	if d != dbutils.MySQL {
 		_, err = db.Exec(createTableQuery)
 		if err != nil {
 			log.Println("Error creating license_status table")
 			return
 		}
 	}
-
-	get, err := db.Prepare(getQuery)
-	if err != nil {
-		return
+	// if mysql, create the license_status table if it does not exist
+	if d == dbutils.MySQL {
+		err = dbutils.CreateMySQLTables(db, tableDefMySQL)
+		if err != nil {
+			log.Println("Error creating license_status table")
+			return
+		}
 	}
+	// add the "tenant" column to the databases created before multi-tenancy, ignore an error
+	db.Exec("ALTER TABLE license_status ADD COLUMN tenant varchar(255) NOT NULL DEFAULT ''")
+	// add the "potential_rights_policy" column to the databases created before the policies, ignore an error
+	db.Exec("ALTER TABLE license_status ADD COLUMN potential_rights_policy varchar(64) NOT NULL DEFAULT ''")
+	// add the "provider" column to the databases created before the status extensions, ignore an error
+	db.Exec("ALTER TABLE license_status ADD COLUMN provider varchar(255) NOT NULL DEFAULT ''")
+	// add the "content_id" column to the databases created before the statistics per publication, ignore an error
+	db.Exec("ALTER TABLE license_status ADD COLUMN content_id varchar(255) NOT NULL DEFAULT ''")
 
-	list, err := db.Prepare(listQuery)
-	if err != nil {
-		return
-	}
+	get := dbutils.NewStmt(db, d.Bind(getQuery))
 
-	getbylicenseid, err := db.Prepare(getByLicenseIdQuery)
-	if err != nil {
-		return
-	}
+	list := dbutils.NewStmt(replica, d.Bind(listQuery))
 
-	add, err := db.Prepare(addQuery)
-	if err != nil {
-		return
-	}
+	getbylicenseid := dbutils.NewStmt(db, d.Bind(getByLicenseIdQuery))
 
-	update, err := db.Prepare(updateQuery)
-	if err != nil {
-		return
-	}
+	add := dbutils.NewStmt(db, d.Bind(addQuery))
+
+	update := dbutils.NewStmt(db, d.Bind(updateQuery))
+
+	countbystatus := dbutils.NewStmt(replica, d.Bind(countByStatusQuery))
+
+	// retention of the returned loans
+	countreturned := dbutils.NewStmt(db, d.Bind(countReturnedQuery))
+
+	purgeevents := dbutils.NewStmt(db, d.Bind(purgeEventsQuery))
 
-	l = dbLicenseStatuses{db, get, add, list, getbylicenseid, update}
+	purgearchived := dbutils.NewStmt(db, d.Bind(purgeArchivedQuery))
+
+	purgereturned := dbutils.NewStmt(db, d.Bind(purgeReturnedQuery))
+
+	l = dbLicenseStatuses{db, get, add, list, getbylicenseid, update, countbystatus,
+		countreturned, purgeevents, purgearchived, purgereturned, replica, d}
 	return
 }
 
@@ -244,7 +394,11 @@ const tableDef = "CREATE TABLE IF NOT EXISTS license_status (" +
 	"device_count int(11) DEFAULT NULL," +
 	"potential_rights_end datetime DEFAULT NULL," +
 	"license_ref varchar(255) NOT NULL," +
-	"rights_end datetime DEFAULT NULL  " +
+	"rights_end datetime DEFAULT NULL," +
+	"tenant varchar(255) NOT NULL DEFAULT ''," +
+	"potential_rights_policy varchar(64) NOT NULL DEFAULT ''," +
+	"provider varchar(255) NOT NULL DEFAULT ''," +
+	"content_id varchar(255) NOT NULL DEFAULT ''" +
 	");" +
 	"CREATE INDEX IF NOT EXISTS license_ref_index on license_status (license_ref);"
 
@@ -256,6 +410,24 @@ const tableDefPostgres = "CREATE TABLE IF NOT EXISTS license_status (" +
 	"device_count INT DEFAULT NULL," +
 	"potential_rights_end TIMESTAMPTZ DEFAULT NULL," +
 	"license_ref VARCHAR(255) NOT NULL," +
-	"rights_end TIMESTAMPTZ DEFAULT NULL  " +
+	"rights_end TIMESTAMPTZ DEFAULT NULL," +
+	"tenant VARCHAR(255) NOT NULL DEFAULT ''," +
+	"potential_rights_policy VARCHAR(64) NOT NULL DEFAULT ''," +
+	"provider VARCHAR(255) NOT NULL DEFAULT ''," +
+	"content_id VARCHAR(255) NOT NULL DEFAULT ''" +
 	");" +
-	"CREATE INDEX IF NOT EXISTS license_ref_index on license_status (license_ref);"
\ No newline at end of file
+	"CREATE INDEX IF NOT EXISTS license_ref_index on license_status (license_ref);"
+
+var tableDefMySQL = dbutils.MySQLTable{Name: "license_status", Definition: "`id` int NOT NULL PRIMARY KEY AUTO_INCREMENT," +
+	"`status` int NOT NULL," +
+	"`license_updated` datetime NOT NULL," +
+	"`status_updated` datetime NOT NULL," +
+	"`device_count` int DEFAULT NULL," +
+	"`potential_rights_end` datetime NULL DEFAULT NULL," +
+	"`license_ref` varchar(255) NOT NULL," +
+	"`rights_end` datetime NULL DEFAULT NULL," +
+	"`tenant` varchar(255) NOT NULL DEFAULT ''," +
+	"`potential_rights_policy` varchar(64) NOT NULL DEFAULT ''," +
+	"`provider` varchar(255) NOT NULL DEFAULT ''," +
+	"`content_id` varchar(255) NOT NULL DEFAULT ''",
+	Indexes: []dbutils.MySQLIndex{{Name: "license_ref_index", Columns: "`license_ref`"}}}
@@ -0,0 +1,61 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilsd
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/license_statuses"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// Erasure lists the licenses of a user whose personal data must be erased
+type Erasure struct {
+	Licenses []string `json:"licenses"`
+}
+
+// ErasureResult is the number of license statuses whose events were anonymized
+type ErasureResult struct {
+	Anonymized int `json:"anonymized"`
+}
+
+// EraseUserData anonymizes the events of the licenses of a user: the device names are erased
+// and the device ids are replaced by random ones. The status documents stay valid.
+// It is triggered by the License Server, when the data of a user is erased.
+//
+func EraseUserData(w http.ResponseWriter, r *http.Request, s Server) {
+	var erasure Erasure
+	if err := json.NewDecoder(r.Body).Decode(&erasure); err != nil {
+		api.BodyError(w, r, err)
+		return
+	}
+
+	result := ErasureResult{}
+	for _, licenseID := range erasure.Licenses {
+		ls, err := s.LicenseStatuses().GetByLicenseId(licenseID)
+		if errors.Is(err, licensestatuses.ErrNotFound) {
+			// the status document may not have been created yet
+			continue
+		}
+		if err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		if err = s.Transactions().AnonymizeEvents(ls.Id); err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		result.Anonymized++
+	}
+	log.Println("Erasure: events of " + strconv.Itoa(result.Anonymized) + " licenses anonymized")
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilsd
+
+import (
+	"log"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license_statuses"
+)
+
+// resolveExtensions returns the extensions of the status documents of a provider:
+// the default extension, then the extension of the provider
+func resolveExtensions(cfg config.StatusExtensions, provider string) []config.StatusExtension {
+	extensions := []config.StatusExtension{cfg.Default}
+	if e, ok := cfg.Providers[provider]; ok && provider != "" {
+		extensions = append(extensions, e)
+	}
+	return extensions
+}
+
+// addExtensions adds the vendor fields and links of its provider to a status document;
+// a field of the provider replaces the default field of the same name.
+func addExtensions(ls *licensestatuses.LicenseStatus) {
+	for _, e := range resolveExtensions(config.Config.LicenseStatus.Extensions, ls.Provider) {
+		// the fields are checked when the configuration is validated
+		fields, err := e.JSONFields()
+		if err != nil {
+			log.Println("Invalid status document extension:", err)
+			continue
+		}
+		for name, value := range fields {
+			if ls.Extensions == nil {
+				ls.Extensions = make(map[string]interface{})
+			}
+			ls.Extensions[name] = value
+		}
+		for _, l := range e.Links {
+			ls.Links = append(ls.Links, licensestatuses.Link{Rel: l.Rel, Href: strings.Replace(l.Href, "{license_id}", ls.LicenseRef, -1),
+				Type: l.Type, Title: l.Title, Profile: l.Profile, Templated: l.Templated})
+		}
+	}
+}
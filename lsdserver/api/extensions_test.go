@@ -0,0 +1,72 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilsd
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license_statuses"
+)
+
+const extensionsConfig = `
+default:
+  fields:
+    https://vendor.example.com/support: https://vendor.example.com/help
+    https://vendor.example.com/tier: basic
+providers:
+  https://publisher.example.com:
+    fields:
+      https://vendor.example.com/tier: premium
+      https://vendor.example.com/events:
+        - type: highlight
+          max: 10
+    links:
+      - rel: https://vendor.example.com/rels/review
+        href: https://vendor.example.com/review/{license_id}
+        type: text/html
+`
+
+func TestStatusExtensions(t *testing.T) {
+	var cfg config.StatusExtensions
+	if err := yaml.Unmarshal([]byte(extensionsConfig), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	config.Config.LicenseStatus.Extensions = cfg
+	defer func() { config.Config.LicenseStatus = config.LicenseStatus{} }()
+
+	// the licenses of other providers get the default extension
+	ls := licensestatuses.LicenseStatus{LicenseRef: "l1", Status: "ready", Provider: "https://other.example.com"}
+	addExtensions(&ls)
+	if len(ls.Links) != 0 || ls.Extensions["https://vendor.example.com/tier"] != "basic" {
+		t.Errorf("Unexpected default extension %+v %+v", ls.Extensions, ls.Links)
+	}
+
+	ls = licensestatuses.LicenseStatus{LicenseRef: "l1", Status: "ready", Provider: "https://publisher.example.com"}
+	addExtensions(&ls)
+	if len(ls.Links) != 1 || ls.Links[0].Href != "https://vendor.example.com/review/l1" {
+		t.Errorf("Unexpected links %+v", ls.Links)
+	}
+
+	// the vendor fields are encoded with the fields of the status document
+	data, err := json.Marshal(ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["id"] != "l1" || doc["status"] != "ready" || doc["https://vendor.example.com/tier"] != "premium" ||
+		doc["https://vendor.example.com/support"] != "https://vendor.example.com/help" {
+		t.Errorf("Unexpected status document %s", data)
+	}
+	if events, ok := doc["https://vendor.example.com/events"].([]interface{}); !ok || len(events) != 1 {
+		t.Errorf("Unexpected vendor events %s", data)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilsd
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/servicetoken"
+	"github.com/readium/readium-lcp-server/transport"
+)
+
+// default number of attempts of a request of a fresh license to the License Server
+const defaultFreshLicenseAttempts = 3
+
+// default timeout of an attempt, in seconds
+const defaultFreshLicenseTimeout = 10
+
+// freshLicenseDelay is the delay before the second attempt, doubled at each new attempt
+var freshLicenseDelay = 500 * time.Millisecond
+
+// errLicenseNotDelivered is returned when the License Server has not delivered the license to the user yet
+var errLicenseNotDelivered = errors.New("The license has not been delivered yet")
+
+// GetFreshLicense returns the license of a license status, signed again by the License Server
+// with its current rights and links, e.g. after a renewal or a return.
+// It is the license link of the status documents when fresh licenses are enabled.
+//
+func GetFreshLicense(w http.ResponseWriter, r *http.Request, s Server) {
+	licenseID := mux.Vars(r)["key"]
+	if _, err := s.LicenseStatuses().GetByLicenseId(licenseID); err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	resp, err := fetchFreshLicense(licenseID)
+	if err != nil {
+		if err == errLicenseNotDelivered {
+			problem.Error(w, r, problem.Problem{Type: problem.LICENSE_NOT_FOUND, Detail: err.Error()}, http.StatusNotFound)
+			return
+		}
+		log.Println("Error getting a fresh license " + licenseID + " from the License Server: " + err.Error())
+		problem.Error(w, r, problem.Problem{Detail: "The License Server is not available"}, http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, header := range []string{"Content-Type", "Content-Disposition", "ETag"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	// the license changes with its rights and status
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// fetchFreshLicense requests a fresh license from the License Server; the request is attempted again
+// after a network error or a server error. The response is returned as is for the other statuses.
+func fetchFreshLicense(licenseID string) (*http.Response, error) {
+	conf := config.Config.LicenseStatus.FreshLicense
+	attempts := conf.Attempts
+	if attempts <= 0 {
+		attempts = defaultFreshLicenseAttempts
+	}
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultFreshLicenseTimeout
+	}
+	lcpURL := config.Config.LcpServer.PublicBaseUrl + "/licenses/" + licenseID + "?fresh=true"
+
+	var err error
+	delay := freshLicenseDelay
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var req *http.Request
+		req, err = http.NewRequest("GET", lcpURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		// a new token for each attempt, as a token is short-lived
+		if err = servicetoken.Authorize(req, config.LcpServerName, config.Config.LcpUpdateAuth); err != nil {
+			return nil, err
+		}
+		var resp *http.Response
+		resp, err = transport.To(config.LcpServerName).Do(req, time.Duration(timeout)*time.Second)
+		if err != nil {
+			continue
+		}
+		switch {
+		case resp.StatusCode == http.StatusPartialContent:
+			// a partial license: the license was never fetched by the user
+			resp.Body.Close()
+			return nil, errLicenseNotDelivered
+		case resp.StatusCode >= http.StatusInternalServerError:
+			resp.Body.Close()
+			err = errors.New("status " + strconv.Itoa(resp.StatusCode))
+			continue
+		}
+		return resp, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilsd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license_statuses"
+)
+
+func TestFetchFreshLicense(t *testing.T) {
+	calls := 0
+	status := http.StatusServiceUnavailable
+	lcp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/licenses/l1" || r.FormValue("fresh") != "true" {
+			t.Errorf("Unexpected request %s", r.URL)
+		}
+		// the License Server is available at the second attempt
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"id":"l1"}`))
+	}))
+	defer lcp.Close()
+	config.Config.LcpServer.PublicBaseUrl = lcp.URL
+	defer func() { config.Config.LcpServer.PublicBaseUrl = "" }()
+	freshLicenseDelay = time.Millisecond
+
+	status = http.StatusOK
+	resp, err := fetchFreshLicense("l1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if calls != 2 || string(body) != `{"id":"l1"}` {
+		t.Errorf("Expected the license after a retry, got %s after %d calls", body, calls)
+	}
+
+	// a partial license is returned for a license never delivered
+	calls, status = 0, http.StatusPartialContent
+	if _, err = fetchFreshLicense("l1"); err != errLicenseNotDelivered {
+		t.Errorf("Expected the license not to be delivered, got %v", err)
+	}
+
+	// the License Server stays unavailable
+	calls, status = 0, http.StatusServiceUnavailable
+	if _, err = fetchFreshLicense("l1"); err == nil || calls != defaultFreshLicenseAttempts {
+		t.Errorf("Expected %d attempts and an error, got %d attempts and %v", defaultFreshLicenseAttempts, calls, err)
+	}
+
+	// the status documents link to the fresh license
+	config.Config.LicenseStatus.FreshLicense.Enabled = true
+	defer func() { config.Config.LicenseStatus = config.LicenseStatus{} }()
+	ls := licensestatuses.LicenseStatus{LicenseRef: "l1"}
+	makeLinks(&ls, nil)
+	if ls.Links[0].Rel != "license" || ls.Links[0].Href != config.Config.LsdServer.PublicBaseUrl+"/licenses/l1/license" {
+		t.Errorf("Unexpected license link %+v", ls.Links[0])
+	}
+}
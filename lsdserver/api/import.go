@@ -0,0 +1,117 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilsd
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/lcpserver/api"
+	"github.com/readium/readium-lcp-server/license_statuses"
+	"github.com/readium/readium-lcp-server/status"
+	"github.com/readium/readium-lcp-server/transactions"
+)
+
+// the errors of the imported status documents
+var (
+	ErrImportStatus = errors.New("The status of the status document is unknown")
+	ErrImportEvent  = errors.New("The status document has an event of an unknown type")
+	ErrImportRef    = errors.New("The status document is not the status document of the license")
+)
+
+// ImportLicenseStatuses imports the status documents of the licenses issued by another License Server,
+// from the records imported by the License Server (POST /licenses/import on both servers).
+// A record without a status document gets a new status document, as a license notified by the License Server.
+// The events of the status documents are imported, so that the devices already registered are known.
+//
+func ImportLicenseStatuses(w http.ResponseWriter, r *http.Request, s Server) {
+	tenant := r.Header.Get(api.HeaderTenant)
+	report, err := apilcp.ReadImport(r.Body, func(rec apilcp.ImportRecord) (bool, error) {
+		return importLicenseStatus(rec, tenant, s)
+	})
+	apilcp.WriteImportReport(w, r, report, err)
+}
+
+// importLicenseStatus adds the status document of an imported license, with its events;
+// a status document already present is skipped
+func importLicenseStatus(rec apilcp.ImportRecord, tenant string, s Server) (bool, error) {
+	l := rec.License
+	if l.Id == "" || len(l.Id) > 255 || l.Provider == "" || l.Issued.IsZero() {
+		return false, apilcp.ErrImportLicense
+	}
+	_, err := s.LicenseStatuses().GetByLicenseId(l.Id)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, licensestatuses.ErrNotFound) {
+		return false, err
+	}
+
+	var ls licensestatuses.LicenseStatus
+	ls.Tenant = tenant
+	makeLicenseStatus(l, &ls)
+	var events []transactions.Event
+	if doc := rec.Status; doc != nil {
+		if doc.LicenseRef != "" && doc.LicenseRef != l.Id {
+			return false, ErrImportRef
+		}
+		if !isStatus(doc.Status) {
+			return false, ErrImportStatus
+		}
+		ls.Status = doc.Status
+		if doc.Updated != nil && doc.Updated.License != nil {
+			ls.Updated.License = doc.Updated.License
+		}
+		if doc.Updated != nil && doc.Updated.Status != nil {
+			ls.Updated.Status = doc.Updated.Status
+		}
+		if doc.PotentialRights != nil && doc.PotentialRights.End != nil {
+			ls.PotentialRights = doc.PotentialRights
+		}
+		// the devices registered with the other server count in the limits of this server
+		devices := make(map[string]bool)
+		for _, e := range doc.Events {
+			if getEventType(e.Type) == 0 {
+				return false, ErrImportEvent
+			}
+			if e.Type == status.EventTypes[status.STATUS_ACTIVE_INT] {
+				devices[e.DeviceId] = true
+			}
+		}
+		count := len(devices)
+		ls.DeviceCount = &count
+		events = doc.Events
+	}
+
+	if err = s.LicenseStatuses().Add(ls); err != nil {
+		return false, err
+	}
+	if len(events) == 0 {
+		return false, nil
+	}
+	stored, err := s.LicenseStatuses().GetByLicenseId(l.Id)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range events {
+		e.LicenseStatusFk = stored.Id
+		e.Timestamp = e.Timestamp.UTC()
+		if err = s.Transactions().Add(e, getEventType(e.Type)); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// isStatus checks if a status is one of the statuses of the specification
+func isStatus(st string) bool {
+	for _, value := range status.StatusValues {
+		if value == st {
+			return true
+		}
+	}
+	return false
+}
@@ -7,10 +7,13 @@ package apilsd
 
 import (
 	"bytes"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
@@ -19,15 +22,19 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/clock"
 	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
 	"github.com/readium/readium-lcp-server/lcpserver/api"
 	"github.com/readium/readium-lcp-server/license"
 	"github.com/readium/readium-lcp-server/license_statuses"
 	"github.com/readium/readium-lcp-server/localization"
 	"github.com/readium/readium-lcp-server/logging"
 	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/servicetoken"
 	"github.com/readium/readium-lcp-server/status"
 	"github.com/readium/readium-lcp-server/transactions"
+	"github.com/readium/readium-lcp-server/transport"
 )
 
 // Server interface
@@ -45,11 +52,15 @@ func CreateLicenseStatusDocument(w http.ResponseWriter, r *http.Request, s Serve
 	err := apilcp.DecodeJSONLicense(r, &lic)
 
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		api.BodyError(w, r, err)
 		return
 	}
 
 	var ls licensestatuses.LicenseStatus
+	// the tenant of the license, on a License Server shared by several publishers
+	ls.Tenant = r.Header.Get(api.HeaderTenant)
+	// the content of the license, which the license document does not hold
+	ls.ContentId = r.Header.Get(api.HeaderContentId)
 	makeLicenseStatus(lic, &ls)
 
 	err = s.LicenseStatuses().Add(ls)
@@ -72,7 +83,7 @@ func GetLicenseStatusDocument(w http.ResponseWriter, r *http.Request, s Server)
 
 	licenseStatus, err := s.LicenseStatuses().GetByLicenseId(licenseID)
 	if err != nil {
-		if licenseStatus == nil {
+		if errors.Is(err, licensestatuses.ErrNotFound) {
 			problem.NotFoundHandler(w, r)
 			logging.WriteToFile(complianceTestNumber, LICENSE_STATUS, strconv.Itoa(http.StatusNotFound), "License id not found")
 			return
@@ -83,7 +94,7 @@ func GetLicenseStatusDocument(w http.ResponseWriter, r *http.Request, s Server)
 		return
 	}
 
-	currentDateTime := time.Now().UTC().Truncate(time.Second)
+	currentDateTime := clock.Now().UTC().Truncate(time.Second)
 
 	// if a rights end date is set, check if the license has expired
 	if licenseStatus.CurrentEndLicense != nil {
@@ -103,6 +114,9 @@ func GetLicenseStatusDocument(w http.ResponseWriter, r *http.Request, s Server)
 		}
 	}
 
+	// a rolling potential end moves with time
+	refreshPotentialRights(licenseStatus, currentDateTime)
+
 	err = fillLicenseStatus(licenseStatus, r, s)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
@@ -144,15 +158,15 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 	// check the existence of the license in the lsd server
 	licenseStatus, err := s.LicenseStatuses().GetByLicenseId(licenseID)
 	if err != nil {
-		if licenseStatus == nil {
+		if errors.Is(err, licensestatuses.ErrNotFound) {
 			// the license is not stored in the lsd server
 			msg = "The license id " + licenseID + " was not found in the database"
-			problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusNotFound)
+			problem.Error(w, r, problem.Problem{Type: problem.LICENSE_STATUS_NOT_FOUND, Detail: msg}, http.StatusNotFound)
 			logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusNotFound), msg)
 			return
 		}
 		// unknown error
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusInternalServerError), "")
 		return
 	}
@@ -166,7 +180,7 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 	// check the mandatory request parameters
 	if (dILen == 0) || (dILen > 255) || (dNLen == 0) || (dNLen > 255) {
 		msg = "device id and device name are mandatory and their maximum length is 255 bytes"
-		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusBadRequest)
+		problem.Error(w, r, problem.Problem{Type: problem.REGISTRATION_BAD_REQUEST, Detail: msg}, http.StatusBadRequest)
 		logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusBadRequest), msg)
 		return
 	}
@@ -174,7 +188,7 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 	// in case we want to test the resilience of an app to registering failures
 	if s.GoofyMode() {
 		msg = "**goofy mode** registering error"
-		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusBadRequest)
+		problem.Error(w, r, problem.Problem{Type: problem.REGISTRATION_BAD_REQUEST, Detail: msg}, http.StatusBadRequest)
 		logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusBadRequest), msg)
 		return
 	}
@@ -183,7 +197,7 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 	// the device cannot be registered if the license has been revoked, returned, cancelled or expired
 	if (licenseStatus.Status != status.STATUS_ACTIVE) && (licenseStatus.Status != status.STATUS_READY) {
 		msg = "License is neither ready or active"
-		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusForbidden)
+		problem.Error(w, r, problem.Problem{Type: problem.REGISTRATION_BAD_REQUEST, Detail: msg}, http.StatusForbidden)
 		logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusForbidden), msg)
 		return
 	}
@@ -191,7 +205,7 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 	// check if the device has already been registered for this license
 	deviceStatus, err := s.Transactions().CheckDeviceStatus(licenseStatus.Id, deviceID)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 		return
 	}
@@ -203,12 +217,6 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 
 		// create a registered event
 		event := makeEvent(status.STATUS_ACTIVE, deviceName, deviceID, licenseStatus.Id)
-		err = s.Transactions().Add(*event, status.STATUS_ACTIVE_INT)
-		if err != nil {
-			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
-			logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusInternalServerError), err.Error())
-			return
-		}
 
 		// the license has been updated, the corresponding field is set
 		licenseStatus.Updated.Status = &event.Timestamp
@@ -220,10 +228,10 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 		// one more device attached to this license
 		*licenseStatus.DeviceCount++
 
-		// update the license status in db
-		err = s.LicenseStatuses().Update(*licenseStatus)
+		// store the event and update the license status in db
+		err = saveEvent(r, *event, status.STATUS_ACTIVE_INT, *licenseStatus, s)
 		if err != nil {
-			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+			problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 			logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 			return
 		}
@@ -237,7 +245,7 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 	// fill the updated license status
 	err = fillLicenseStatus(licenseStatus, r, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 		return
 	}
@@ -247,7 +255,7 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 	enc := json.NewEncoder(w)
 	err = enc.Encode(licenseStatus)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 		return
 	}
@@ -265,14 +273,14 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 
 	licenseStatus, err := s.LicenseStatuses().GetByLicenseId(licenseID)
 	if err != nil {
-		if licenseStatus == nil {
+		if errors.Is(err, licensestatuses.ErrNotFound) {
 			msg = "The license id " + licenseID + " was not found in the database"
-			problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusNotFound)
+			problem.Error(w, r, problem.Problem{Type: problem.LICENSE_STATUS_NOT_FOUND, Detail: msg}, http.StatusNotFound)
 			logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusNotFound), msg)
 			return
 		}
 
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusInternalServerError), "")
 		return
 	}
@@ -282,7 +290,7 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 
 	// check request parameters
 	if (len(deviceName) > 255) || (len(deviceID) > 255) {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		problem.Error(w, r, problem.Problem{Type: problem.RETURN_BAD_REQUEST, Detail: err.Error()}, http.StatusBadRequest)
 		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusBadRequest), err.Error())
 		return
 	}
@@ -297,33 +305,27 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 		break
 	default:
 		msg = "The current license status is " + licenseStatus.Status + "; return forbidden"
-		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusForbidden)
+		problem.Error(w, r, problem.Problem{Type: problem.RETURN_BAD_REQUEST, Detail: msg}, http.StatusForbidden)
 		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusForbidden), msg)
 		return
 	}
 
-	// create a return event
+	// create a return event, stored with the license status once the license is updated
 	event := makeEvent(status.STATUS_RETURNED, deviceName, deviceID, licenseStatus.Id)
-	err = s.Transactions().Add(*event, status.STATUS_RETURNED_INT)
-	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
-		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
-		return
-	}
 
 	// update a license via a call to the lcp Server
 	// the event date is sent to the lcp server, covers the case where the lsd server clock is badly sync'd with the lcp server clock
 	httpStatusCode, errorr := updateLicense(event.Timestamp, licenseID)
 	if errorr != nil {
-		problem.Error(w, r, problem.Problem{Detail: errorr.Error()}, http.StatusInternalServerError)
-		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: errorr.Error()}, http.StatusInternalServerError)
+		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusInternalServerError), errorr.Error())
 		return
 	}
 	if httpStatusCode != http.StatusOK && httpStatusCode != http.StatusPartialContent { // 200, 206
 		errorr = errors.New("LCP license PATCH returned HTTP error code " + strconv.Itoa(httpStatusCode))
 
-		problem.Error(w, r, problem.Problem{Detail: errorr.Error()}, httpStatusCode)
-		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(httpStatusCode), err.Error())
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: errorr.Error()}, httpStatusCode)
+		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(httpStatusCode), errorr.Error())
 		return
 	}
 	licenseStatus.CurrentEndLicense = &event.Timestamp
@@ -333,9 +335,9 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 	// update the license updated timestamp with the event date
 	licenseStatus.Updated.License = &event.Timestamp
 
-	err = s.LicenseStatuses().Update(*licenseStatus)
+	err = saveEvent(r, *event, status.STATUS_RETURNED_INT, *licenseStatus, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 		return
 	}
@@ -346,7 +348,7 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 	// fill the license status
 	err = fillLicenseStatus(licenseStatus, r, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 		return
 	}
@@ -357,7 +359,7 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 	err = enc.Encode(licenseStatus)
 
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 		return
 	}
@@ -381,13 +383,13 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	licenseStatus, err := s.LicenseStatuses().GetByLicenseId(licenseID)
 
 	if err != nil {
-		if licenseStatus == nil {
+		if errors.Is(err, licensestatuses.ErrNotFound) {
 			msg = "The license id " + licenseID + " was not found in the database"
-			problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusNotFound)
+			problem.Error(w, r, problem.Problem{Type: problem.LICENSE_STATUS_NOT_FOUND, Detail: msg}, http.StatusNotFound)
 			logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusNotFound), msg)
 			return
 		}
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 		return
 	}
@@ -397,7 +399,7 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 
 	// check the request parameters
 	if (len(deviceName) > 255) || (len(deviceID) > 255) {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		problem.Error(w, r, problem.Problem{Type: problem.RENEW_BAD_REQUEST, Detail: err.Error()}, http.StatusBadRequest)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusBadRequest), err.Error())
 		return
 	}
@@ -405,7 +407,7 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	// note: renewing an unactive (ready) license is forbidden
 	if licenseStatus.Status != status.STATUS_ACTIVE {
 		msg = "The current license status is " + licenseStatus.Status + "; renew forbidden"
-		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusForbidden)
+		problem.Error(w, r, problem.Problem{Type: problem.RENEW_BAD_REQUEST, Detail: msg}, http.StatusForbidden)
 		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusForbidden), msg)
 		return
 	}
@@ -414,7 +416,7 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	var currentEnd time.Time
 	if licenseStatus.CurrentEndLicense == nil || (*licenseStatus.CurrentEndLicense).IsZero() {
 		msg = "This license has no current end date; it cannot be renewed"
-		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusForbidden)
+		problem.Error(w, r, problem.Problem{Type: problem.RENEW_BAD_REQUEST, Detail: msg}, http.StatusForbidden)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusForbidden), msg)
 		return
 	}
@@ -429,7 +431,7 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 		renewDays := config.Config.LicenseStatus.RenewDays
 		if renewDays == 0 {
 			msg = "No explicit end value and no configured value"
-			problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusInternalServerError)
+			problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: msg}, http.StatusInternalServerError)
 			logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusInternalServerError), msg)
 			return
 		}
@@ -446,7 +448,7 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 		var err error
 		suggestedEnd, err = time.Parse(time.RFC3339, timeEndString)
 		if err != nil {
-			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+			problem.Error(w, r, problem.Problem{Type: problem.RENEW_BAD_REQUEST, Detail: err.Error()}, http.StatusBadRequest)
 			logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusBadRequest), err.Error())
 			return
 		}
@@ -454,41 +456,49 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	}
 
 	// check the suggested end date vs the upper end date (which is already set in our implementation)
+	refreshPotentialRights(licenseStatus, clock.Now())
+	if licenseStatus.PotentialRights == nil || licenseStatus.PotentialRights.End == nil {
+		msg = "This license has no potential rights end; it cannot be renewed"
+		problem.Error(w, r, problem.Problem{Type: problem.RENEW_BAD_REQUEST, Detail: msg}, http.StatusForbidden)
+		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusForbidden), msg)
+		return
+	}
 	log.Print("Potential rights end = ", licenseStatus.PotentialRights.End.UTC().Format(time.RFC3339))
 	if suggestedEnd.After(*licenseStatus.PotentialRights.End) {
 		msg := "Attempt to renew with a date greater than potential rights end = " + licenseStatus.PotentialRights.End.UTC().Format(time.RFC3339)
-		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusForbidden)
+		problem.Error(w, r, problem.Problem{Type: problem.RENEW_REJECT, Detail: msg}, http.StatusForbidden)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusForbidden), msg)
 		return
 	}
 	// check the suggested end date vs the current end date
 	if suggestedEnd.Before(currentEnd) {
 		msg := "Attempt to renew with a date before the current end date"
-		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusForbidden)
+		problem.Error(w, r, problem.Problem{Type: problem.RENEW_REJECT, Detail: msg}, http.StatusForbidden)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusForbidden), msg)
 		return
 	}
 
-	// create a renew event
+	// create a renew event, stored with the license status once the license is updated
 	event := makeEvent(status.EVENT_RENEWED, deviceName, deviceID, licenseStatus.Id)
-	err = s.Transactions().Add(*event, status.EVENT_RENEWED_INT)
-	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
-		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
-		return
-	}
 
-	// update a license via a call to the lcp Server
-	httpStatusCode, errorr := updateLicense(suggestedEnd, licenseID)
+	// update a license via a call to the lcp Server, which may clamp the end into the duration range of the loans
+	suggestedEnd, httpStatusCode, errorr := patchLicenseEnd(suggestedEnd, licenseID)
 	if errorr != nil {
-		problem.Error(w, r, problem.Problem{Detail: errorr.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: errorr.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusInternalServerError), errorr.Error())
 		return
 	}
+	if httpStatusCode == http.StatusBadRequest {
+		// the new end breaks the rules of the rights of the provider, e.g. the maximum duration of its loans
+		msg = "The renewal is refused by the rights policy of the provider"
+		problem.Error(w, r, problem.Problem{Type: problem.RENEW_REJECT, Detail: msg}, http.StatusForbidden)
+		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusForbidden), msg)
+		return
+	}
 	if httpStatusCode != http.StatusOK && httpStatusCode != http.StatusPartialContent { // 200, 206
 		errorr = errors.New("LCP license PATCH returned HTTP error code " + strconv.Itoa(httpStatusCode))
 
-		problem.Error(w, r, problem.Problem{Detail: errorr.Error()}, httpStatusCode)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: errorr.Error()}, httpStatusCode)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(httpStatusCode), errorr.Error())
 		return
 	}
@@ -498,10 +508,10 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	licenseStatus.Updated.Status = &event.Timestamp
 	licenseStatus.Updated.License = &event.Timestamp
 
-	// update the license status in db
-	err = s.LicenseStatuses().Update(*licenseStatus)
+	// store the event and update the license status in db
+	err = saveEvent(r, *event, status.EVENT_RENEWED_INT, *licenseStatus, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 		return
 	}
@@ -513,7 +523,7 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	// fill the localized 'message', the 'links' and 'event' objects in the license status
 	err = fillLicenseStatus(licenseStatus, r, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 		return
 	}
@@ -523,93 +533,65 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	enc := json.NewEncoder(w)
 	err = enc.Encode(licenseStatus)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 		return
 	}
 }
 
-// FilterLicenseStatuses returns a sequence of license statuses, in their id order
+// FilterLicenseStatuses returns a sequence of license statuses, the last created first by default
 // function for detecting licenses which used a lot of devices
+// parameters:
+//	devices: min number of devices (default 1)
+// 	page: page number (default 1)
+//	per_page: number of items par page (default 10)
+//	sort: created, id, status, device_count, license_updated or status_updated,
+//	prefixed by "-" for a descending order
+//	fields: comma separated fields of the statuses to return
 //
 func FilterLicenseStatuses(w http.ResponseWriter, r *http.Request, s Server) {
-	w.Header().Set("Content-Type", api.ContentType_JSON)
-
 	// Get request parameters. If not defined, set default values
 	rDevices := r.FormValue("devices")
 	if rDevices == "" {
 		rDevices = "1"
 	}
 
-	rPage := r.FormValue("page")
-	if rPage == "" {
-		rPage = "1"
-	}
-
-	rPerPage := r.FormValue("per_page")
-	if rPerPage == "" {
-		rPerPage = "10"
-	}
-
 	devicesLimit, err := strconv.ParseInt(rDevices, 10, 32)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		problem.Error(w, r, problem.Problem{Type: problem.FILTER_BAD_REQUEST, Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
-
-	page, err := strconv.ParseInt(rPage, 10, 32)
-	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
-		return
+	params, err := api.ParseListParams(r, 10)
+	if err == nil && params.After != "" {
+		err = errors.New("The license statuses are listed by page")
 	}
-
-	perPage, err := strconv.ParseInt(rPerPage, 10, 32)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		problem.Error(w, r, problem.Problem{Type: problem.FILTER_BAD_REQUEST, Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
 
-	if (page < 1) || (perPage < 1) || (devicesLimit < 1) {
-		problem.Error(w, r, problem.Problem{Detail: "Devices, page, per_page must be positive number"}, http.StatusBadRequest)
+	if devicesLimit < 1 {
+		problem.Error(w, r, problem.Problem{Type: problem.FILTER_BAD_REQUEST, Detail: "Devices, page, per_page must be positive number"}, http.StatusBadRequest)
 		return
 	}
 
-	page--
-
 	licenseStatuses := make([]licensestatuses.LicenseStatus, 0)
 
-	fn := s.LicenseStatuses().List(devicesLimit, perPage, page*perPage)
-	for it, err := fn(); err == nil; it, err = fn() {
+	fn := s.LicenseStatuses().ListSorted(devicesLimit, params.Listing())
+	it, err := fn()
+	for ; err == nil; it, err = fn() {
 		licenseStatuses = append(licenseStatuses, it)
 	}
-
-	devices := strconv.Itoa(int(devicesLimit))
-	lsperpage := strconv.Itoa(int(perPage) + 1)
-	var resultLink string
-
-	if len(licenseStatuses) > 0 {
-		nextPage := strconv.Itoa(int(page) + 1)
-		resultLink += "</licenses/?devices=" + devices + "&page=" + nextPage + "&per_page=" + lsperpage + ">; rel=\"next\"; title=\"next\""
-	}
-
-	if page > 0 {
-		previousPage := strconv.Itoa(int(page) - 1)
-		if len(resultLink) > 0 {
-			resultLink += ", "
+	if !errors.Is(err, licensestatuses.ErrNotFound) {
+		if api.StoreStatus(err) == http.StatusBadRequest {
+			problem.Error(w, r, problem.Problem{Type: problem.FILTER_BAD_REQUEST, Detail: err.Error()}, http.StatusBadRequest)
+			return
 		}
-		resultLink += "</licenses/?devices=" + devices + "&page=" + previousPage + "&per_page=" + lsperpage + ">; rel=\"previous\"; title=\"previous\""
-	}
-
-	if len(resultLink) > 0 {
-		w.Header().Set("Link", resultLink)
-	}
-
-	enc := json.NewEncoder(w)
-	err = enc.Encode(licenseStatuses)
-	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		return
 	}
+
+	api.WriteList(w, r, licenseStatuses, params.PageLinks(r, len(licenseStatuses)), params.Fields)
 }
 
 // ListRegisteredDevices returns data about the use of a given license
@@ -622,7 +604,7 @@ func ListRegisteredDevices(w http.ResponseWriter, r *http.Request, s Server) {
 
 	licenseStatus, err := s.LicenseStatuses().GetByLicenseId(licenseID)
 	if err != nil {
-		if licenseStatus == nil {
+		if errors.Is(err, licensestatuses.ErrNotFound) {
 			problem.NotFoundHandler(w, r)
 			//logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusNotFound))
 			return
@@ -647,6 +629,184 @@ func ListRegisteredDevices(w http.ResponseWriter, r *http.Request, s Server) {
 	}
 }
 
+// ListLicenseEvents returns the events recorded for a given license
+// parameters:
+//	key: license id
+//	type: optional event type (register, return, renew, revoke, cancel)
+//	device: optional device id
+//	from, to: optional date range, RFC 3339 timestamps
+//	format: json (default, paginated), csv or ndjson (all matching events)
+//	page, per_page: pagination of the json output, default to page 1 and 10 events per page
+//
+func ListLicenseEvents(w http.ResponseWriter, r *http.Request, s Server) {
+	vars := mux.Vars(r)
+	licenseID := vars["key"]
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" && format != "ndjson" {
+		problem.Error(w, r, problem.Problem{Detail: "Unknown format " + format}, http.StatusBadRequest)
+		return
+	}
+
+	rPage := r.FormValue("page")
+	if rPage == "" {
+		rPage = "1"
+	}
+
+	rPerPage := r.FormValue("per_page")
+	if rPerPage == "" {
+		rPerPage = "10"
+	}
+
+	page, err := strconv.ParseInt(rPage, 10, 32)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	perPage, err := strconv.ParseInt(rPerPage, 10, 32)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	if (page < 1) || (perPage < 1) {
+		problem.Error(w, r, problem.Problem{Detail: "page, per_page must be positive number"}, http.StatusBadRequest)
+		return
+	}
+
+	var filter transactions.EventFilter
+	rType := r.FormValue("type")
+	if rType != "" {
+		filter.Type = getEventType(rType)
+		if filter.Type == 0 {
+			problem.Error(w, r, problem.Problem{Detail: "Unknown event type " + rType}, http.StatusBadRequest)
+			return
+		}
+	}
+	filter.DeviceId = r.FormValue("device")
+	if rFrom := r.FormValue("from"); rFrom != "" {
+		filter.From, err = time.Parse(time.RFC3339, rFrom)
+		if err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+			return
+		}
+	}
+	if rTo := r.FormValue("to"); rTo != "" {
+		filter.To, err = time.Parse(time.RFC3339, rTo)
+		if err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	page--
+
+	licenseStatus, err := s.LicenseStatuses().GetByLicenseId(licenseID)
+	if err != nil {
+		if errors.Is(err, licensestatuses.ErrNotFound) {
+			problem.NotFoundHandler(w, r)
+			return
+		}
+
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	// exports are not paginated
+	limit, offset := perPage, page*perPage
+	if format != "json" {
+		limit, offset = math.MaxInt32, 0
+	}
+
+	events := make([]transactions.Event, 0)
+
+	fn := s.Transactions().ListByLicenseStatusId(licenseStatus.Id, filter, limit, offset)
+	var event transactions.Event
+	for event, err = fn(); err == nil; event, err = fn() {
+		events = append(events, event)
+	}
+	if !errors.Is(err, transactions.ErrNotFound) {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", api.ContentType_CSV)
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+licenseID+"-events.csv\"")
+		err = writeEventsCSV(w, licenseID, events)
+	case "ndjson":
+		w.Header().Set("Content-Type", api.ContentType_NDJSON)
+		err = writeEventsNDJSON(w, events)
+	default:
+		w.Header().Set("Content-Type", api.ContentType_JSON)
+		// pagination links, keeping the filters
+		query := r.URL.Query()
+		query.Del("page")
+		query.Set("per_page", strconv.Itoa(int(perPage)))
+		eventsURL := "/licenses/" + licenseID + "/events?" + query.Encode() + "&page="
+		var resultLink string
+
+		if int64(len(events)) == perPage {
+			nextPage := strconv.Itoa(int(page) + 2)
+			resultLink += "<" + eventsURL + nextPage + ">; rel=\"next\"; title=\"next\""
+		}
+
+		if page > 0 {
+			previousPage := strconv.Itoa(int(page))
+			if len(resultLink) > 0 {
+				resultLink += ", "
+			}
+			resultLink += "<" + eventsURL + previousPage + ">; rel=\"previous\"; title=\"previous\""
+		}
+
+		if len(resultLink) > 0 {
+			w.Header().Set("Link", resultLink)
+		}
+
+		enc := json.NewEncoder(w)
+		err = enc.Encode(events)
+	}
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+}
+
+// writeEventsCSV writes events as csv records, with a header line
+//
+func writeEventsCSV(w io.Writer, licenseID string, events []transactions.Event) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"license_id", "timestamp", "type", "device_id", "device_name"})
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		err = cw.Write([]string{licenseID, e.Timestamp.UTC().Format(time.RFC3339), e.Type, e.DeviceId, e.DeviceName})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeEventsNDJSON writes events as newline delimited json objects
+//
+func writeEventsNDJSON(w io.Writer, events []transactions.Event) error {
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // LendingCancellation cancels (before use) or revokes (after use)  a license.
 // parameters:
 //	key: license id
@@ -664,13 +824,13 @@ func LendingCancellation(w http.ResponseWriter, r *http.Request, s Server) {
 	licenseStatus, err := s.LicenseStatuses().GetByLicenseId(licenseID)
 	if err != nil {
 		// erroneous license id
-		if licenseStatus == nil {
+		if errors.Is(err, licensestatuses.ErrNotFound) {
 			problem.NotFoundHandler(w, r)
 			logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusNotFound), "License id not found")
 			return
 		}
 		// other error
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 		return
 	}
@@ -678,14 +838,14 @@ func LendingCancellation(w http.ResponseWriter, r *http.Request, s Server) {
 	var newStatus licensestatuses.LicenseStatus
 	err = decodeJsonLicenseStatus(r, &newStatus)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 		return
 	}
 	// the new status must be either cancelled or revoked
 	if newStatus.Status != status.STATUS_REVOKED && newStatus.Status != status.STATUS_CANCELLED {
 		msg := "The new status must be either cancelled or revoked"
-		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusBadRequest)
+		problem.Error(w, r, problem.Problem{Type: problem.CANCEL_BAD_REQUEST, Detail: msg}, http.StatusBadRequest)
 		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusBadRequest), msg)
 		return
 	}
@@ -693,14 +853,14 @@ func LendingCancellation(w http.ResponseWriter, r *http.Request, s Server) {
 	// cancelling is only possible when the status is ready
 	if newStatus.Status == status.STATUS_CANCELLED && licenseStatus.Status != status.STATUS_READY {
 		msg := "The license is not on ready state, it can't be cancelled"
-		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusBadRequest)
+		problem.Error(w, r, problem.Problem{Type: problem.CANCEL_BAD_REQUEST, Detail: msg}, http.StatusBadRequest)
 		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusBadRequest), msg)
 		return
 	}
 	// revocation is only possible when the status is ready or active
 	if newStatus.Status == status.STATUS_REVOKED && licenseStatus.Status != status.STATUS_READY && licenseStatus.Status != status.STATUS_ACTIVE {
 		msg := "The license is not on ready or active state, it can't be revoked"
-		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusBadRequest)
+		problem.Error(w, r, problem.Problem{Type: problem.CANCEL_BAD_REQUEST, Detail: msg}, http.StatusBadRequest)
 		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusBadRequest), msg)
 		return
 	}
@@ -712,18 +872,18 @@ func LendingCancellation(w http.ResponseWriter, r *http.Request, s Server) {
 	log.Println("New Status: " + newStatus.Status)
 
 	// the new expiration time is now
-	currentTime := time.Now().UTC().Truncate(time.Second)
+	currentTime := clock.Now().UTC().Truncate(time.Second)
 
 	// update the license with the new expiration time, via a call to the lcp Server
 	httpStatusCode, erru := updateLicense(currentTime, licenseID)
 	if erru != nil {
-		problem.Error(w, r, problem.Problem{Detail: erru.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: erru.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusInternalServerError), erru.Error())
 		return
 	}
 	if httpStatusCode != http.StatusOK && httpStatusCode != http.StatusPartialContent { // 200, 206
 		err = errors.New("License update notif to lcp server failed with http code " + strconv.Itoa(httpStatusCode))
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, httpStatusCode)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, httpStatusCode)
 		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(httpStatusCode), err.Error())
 		return
 	}
@@ -741,22 +901,16 @@ func LendingCancellation(w http.ResponseWriter, r *http.Request, s Server) {
 	deviceName := "system"
 	deviceID := "system"
 	event := makeEvent(st, deviceName, deviceID, licenseStatus.Id)
-	err = s.Transactions().Add(*event, ty)
-	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
-		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
-		return
-	}
 	// update the license status properties with the new status & expiration item (now)
 	licenseStatus.Status = newStatus.Status
 	licenseStatus.CurrentEndLicense = &currentTime
 	licenseStatus.Updated.Status = &currentTime
 	licenseStatus.Updated.License = &currentTime
 
-	// update the license status in db
-	err = s.LicenseStatuses().Update(*licenseStatus)
+	// store the event and update the license status in db
+	err = saveEvent(r, *event, ty, *licenseStatus, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Type: problem.SERVER_INTERNAL_ERROR, Detail: err.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 		return
 	}
@@ -769,6 +923,7 @@ func LendingCancellation(w http.ResponseWriter, r *http.Request, s Server) {
 //
 func makeLicenseStatus(license license.License, ls *licensestatuses.LicenseStatus) {
 	ls.LicenseRef = license.Id
+	ls.Provider = license.Provider
 
 	registerAvailable := config.Config.LicenseStatus.Register
 
@@ -781,18 +936,10 @@ func makeLicenseStatus(license license.License, ls *licensestatuses.LicenseStatu
 		ls.CurrentEndLicense = &endFromLicense
 		ls.PotentialRights = new(licensestatuses.PotentialRights)
 
-		rentingDays := config.Config.LicenseStatus.RentingDays
-		if rentingDays > 0 {
-			endFromConfig := license.Issued.Add(time.Hour * 24 * time.Duration(rentingDays))
-
-			if endFromLicense.After(endFromConfig) {
-				ls.PotentialRights.End = &endFromLicense
-			} else {
-				ls.PotentialRights.End = &endFromConfig
-			}
-		} else {
-			ls.PotentialRights.End = &endFromLicense
-		}
+		// the policy of the potential end is resolved per license and kept with the license status
+		ls.PotentialRightsPolicy = resolvePotentialRightsPolicy(config.Config.LicenseStatus, license.Provider, ls.Tenant)
+		potential := potentialEnd(config.Config.LicenseStatus, ls.PotentialRightsPolicy, endFromLicense, license.Issued, clock.Now())
+		ls.PotentialRights.End = &potential
 	}
 
 	if registerAvailable {
@@ -804,7 +951,7 @@ func makeLicenseStatus(license license.License, ls *licensestatuses.LicenseStatu
 	ls.Updated = new(licensestatuses.Updated)
 	ls.Updated.License = &license.Issued
 
-	currentTime := time.Now().UTC().Truncate(time.Second)
+	currentTime := clock.Now().UTC().Truncate(time.Second)
 	ls.Updated.Status = &currentTime
 
 	count := 0
@@ -823,7 +970,7 @@ func getEvents(ls *licensestatuses.LicenseStatus, s Server) error {
 		events = append(events, event)
 	}
 
-	if err == transactions.NotFound {
+	if errors.Is(err, transactions.ErrNotFound) {
 		ls.Events = events
 		err = nil
 	}
@@ -831,10 +978,10 @@ func getEvents(ls *licensestatuses.LicenseStatus, s Server) error {
 	return err
 }
 
-// makeLinks creates and adds links to the license status
+// makeLinks creates and adds links to the license status, on the base url forwarded by a trusted proxy if any
 //
-func makeLinks(ls *licensestatuses.LicenseStatus) {
-	lsdBaseURL := config.Config.LsdServer.PublicBaseUrl
+func makeLinks(ls *licensestatuses.LicenseStatus, r *http.Request) {
+	lsdBaseURL := api.BaseURL(r, config.Config.LsdServer.PublicBaseUrl)
 	licenseLinkURL := config.Config.LsdServer.LicenseLinkUrl
 	lcpBaseURL := config.Config.LcpServer.PublicBaseUrl
 	registerAvailable := config.Config.LicenseStatus.Register
@@ -846,8 +993,12 @@ func makeLinks(ls *licensestatuses.LicenseStatus) {
 
 	links := new([]licensestatuses.Link)
 
-	// if the link template to the license is set
-	if licenseLinkURL != "" {
+	// the license is signed again with its current rights, through the License Status Server
+	if config.Config.LicenseStatus.FreshLicense.Enabled {
+		link := licensestatuses.Link{Href: lsdBaseURL + "/licenses/" + ls.LicenseRef + "/license", Rel: "license", Type: api.ContentType_LCP_JSON, Templated: false}
+		*links = append(*links, link)
+		// if the link template to the license is set
+	} else if licenseLinkURL != "" {
 		licenseLinkURLReal := strings.Replace(licenseLinkURL, "{license_id}", ls.LicenseRef, -1)
 		link := licensestatuses.Link{Href: licenseLinkURLReal, Rel: "license", Type: api.ContentType_LCP_JSON, Templated: false}
 		*links = append(*links, link)
@@ -876,23 +1027,56 @@ func makeLinks(ls *licensestatuses.LicenseStatus) {
 		link := licensestatuses.Link{Href: lsdBaseURL + "/licenses/" + ls.LicenseRef + "/renew{?end,id,name}", Rel: "renew", Type: api.ContentType_LSD_JSON, Templated: true}
 		*links = append(*links, link)
 	}
+	// if the rights accounting is set
+	if config.Config.LicenseStatus.RightsAccounting {
+		link := licensestatuses.Link{Href: lsdBaseURL + "/licenses/" + ls.LicenseRef + "/rights", Rel: "rights", Type: api.ContentType_JSON}
+		*links = append(*links, link)
+	}
 
 	ls.Links = *links
 }
 
+// saveEvent stores an event and the license status it changes in a single transaction,
+// and logs the event with the address of the client
+//
+func saveEvent(r *http.Request, event transactions.Event, eventType int, ls licensestatuses.LicenseStatus, s Server) error {
+	err := dbutils.Transact(s.LicenseStatuses(), func(tx *sql.Tx) error {
+		if err := s.Transactions().AddTx(tx, event, eventType); err != nil {
+			return err
+		}
+		return s.LicenseStatuses().UpdateTx(tx, ls)
+	})
+	if err == nil {
+		log.Println("Event " + event.Type + " of the license " + ls.LicenseRef + " by the device " + event.DeviceId + " from " + api.ClientIP(r))
+	}
+	return err
+}
+
 // makeEvent creates an event and fill it
 //
 func makeEvent(status string, deviceName string, deviceID string, licenseStatusFk int) *transactions.Event {
 	event := transactions.Event{}
 	event.DeviceId = deviceID
 	event.DeviceName = deviceName
-	event.Timestamp = time.Now().UTC().Truncate(time.Second)
+	event.Timestamp = clock.Now().UTC().Truncate(time.Second)
 	event.Type = status
 	event.LicenseStatusFk = licenseStatusFk
 
 	return &event
 }
 
+// getEventType returns the int value of an event type, as stored in the db
+// 0 is returned if the event type is unknown
+//
+func getEventType(eventType string) int {
+	for key, value := range status.EventTypes {
+		if value == eventType {
+			return key
+		}
+	}
+	return 0
+}
+
 // decodeJsonLicenseStatus decodes license status json to the object
 //
 func decodeJsonLicenseStatus(r *http.Request, ls *licensestatuses.LicenseStatus) error {
@@ -914,10 +1098,18 @@ func decodeJsonLicenseStatus(r *http.Request, ls *licensestatuses.LicenseStatus)
 // called from return, renew and cancel/revoke actions
 //
 func updateLicense(timeEnd time.Time, licenseID string) (int, error) {
+	_, code, err := patchLicenseEnd(timeEnd, licenseID)
+	return code, err
+}
+
+// patchLicenseEnd sets the end of the rights of a license by calling the License Server,
+// and returns the end it has stored, e.g. clamped into the duration range of the loans of the provider
+//
+func patchLicenseEnd(timeEnd time.Time, licenseID string) (time.Time, int, error) {
 	// get the lcp server url
 	lcpBaseURL := config.Config.LcpServer.PublicBaseUrl
 	if len(lcpBaseURL) <= 0 {
-		return 0, errors.New("Undefined Config.LcpServer.PublicBaseUrl")
+		return timeEnd, 0, errors.New("Undefined Config.LcpServer.PublicBaseUrl")
 	}
 	// create a minimum license object, limited to the license id plus rights
 	// FIXME: remove the id (here and in the lcpserver license.go)
@@ -925,9 +1117,6 @@ func updateLicense(timeEnd time.Time, licenseID string) (int, error) {
 	// set the new end date
 	minLicense.Rights.End = &timeEnd
 
-	var lcpClient = &http.Client{
-		Timeout: time.Second * 10,
-	}
 	// FIXME: this Pipe thing should be replaced by a json.Marshal
 	pr, pw := io.Pipe()
 	go func() {
@@ -941,26 +1130,35 @@ func updateLicense(timeEnd time.Time, licenseID string) (int, error) {
 	// send the content to the LCP server
 	req, err := http.NewRequest("PATCH", lcpURL, pr)
 	if err != nil {
-		return 0, err
+		return timeEnd, 0, err
 	}
 	// set the credentials
-	updateAuth := config.Config.LcpUpdateAuth
-	if updateAuth.Username != "" {
-		req.SetBasicAuth(updateAuth.Username, updateAuth.Password)
+	if err = servicetoken.Authorize(req, config.LcpServerName, config.Config.LcpUpdateAuth); err != nil {
+		return timeEnd, 0, err
 	}
 	// set the content type
 	req.Header.Add("Content-Type", api.ContentType_LCP_JSON)
 	// send the request to the lcp server
-	response, err := lcpClient.Do(req)
+	response, err := transport.To(config.LcpServerName).Do(req, 10*time.Second)
 	if err == nil {
+		defer response.Body.Close()
 		if response.StatusCode != http.StatusOK {
 			log.Println("Notify Lcp Server of License (" + licenseID + ") = " + strconv.Itoa(response.StatusCode))
+			return timeEnd, response.StatusCode, nil
+		}
+		// the License Server returns the rights it has stored
+		var stored license.License
+		if json.NewDecoder(response.Body).Decode(&stored) == nil && stored.Rights != nil && stored.Rights.End != nil {
+			if !stored.Rights.End.Equal(timeEnd) {
+				log.Println("The License Server has set the end of the license " + licenseID + " to " + stored.Rights.End.UTC().Format(time.RFC3339))
+			}
+			timeEnd = *stored.Rights.End
 		}
-		return response.StatusCode, nil
+		return timeEnd, response.StatusCode, nil
 	}
 
 	log.Println("Error Notify Lcp Server of License (" + licenseID + "):" + err.Error())
-	return 0, err
+	return timeEnd, 0, err
 }
 
 // fillLicenseStatus fills the localized 'message' field, the 'links' and 'event' objects in the license status
@@ -970,7 +1168,9 @@ func fillLicenseStatus(ls *licensestatuses.LicenseStatus, r *http.Request, s Ser
 	acceptLanguages := r.Header.Get("Accept-Language")
 	localization.LocalizeMessage(acceptLanguages, &ls.Message, ls.Status)
 	// add the links
-	makeLinks(ls)
+	makeLinks(ls, r)
+	// add the vendor fields and links
+	addExtensions(ls)
 	// add the events
 	err := getEvents(ls, s)
 
@@ -0,0 +1,178 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilsd
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license_statuses"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// The built-in policies of the potential end of the loans
+const (
+	PolicyRentingDays = "renting_days" // renting_days after the issue of the license
+	PolicyFixed       = "fixed"        // a fixed max end date
+	PolicyRolling     = "rolling"      // rolling_days from now, computed again at each use
+	PolicyPublisher   = "publisher"    // the date supplied by the publisher, else the end of the license
+)
+
+// PotentialRightsPolicy computes the potential end of a loan, i.e. the date until which it can be renewed
+type PotentialRightsPolicy interface {
+	// PotentialEnd returns the potential end of a loan ending at end and issued at issued, at the time now
+	PotentialEnd(cfg config.LicenseStatus, end time.Time, issued time.Time, now time.Time) time.Time
+	// Rolling tells if the potential end moves with time, in which case it is computed again at each use
+	Rolling() bool
+}
+
+type rentingDaysPolicy struct{}
+
+func (rentingDaysPolicy) PotentialEnd(cfg config.LicenseStatus, end time.Time, issued time.Time, now time.Time) time.Time {
+	if cfg.RentingDays <= 0 {
+		return end
+	}
+	return issued.Add(24 * time.Hour * time.Duration(cfg.RentingDays))
+}
+
+func (rentingDaysPolicy) Rolling() bool { return false }
+
+type fixedPolicy struct{}
+
+func (fixedPolicy) PotentialEnd(cfg config.LicenseStatus, end time.Time, issued time.Time, now time.Time) time.Time {
+	fixed, err := time.Parse(time.RFC3339, cfg.PotentialRights.FixedEnd)
+	if err != nil {
+		return end
+	}
+	return fixed
+}
+
+func (fixedPolicy) Rolling() bool { return false }
+
+type rollingPolicy struct{}
+
+func (rollingPolicy) PotentialEnd(cfg config.LicenseStatus, end time.Time, issued time.Time, now time.Time) time.Time {
+	return now.Add(24 * time.Hour * time.Duration(cfg.PotentialRights.RollingDays))
+}
+
+func (rollingPolicy) Rolling() bool { return true }
+
+// publisherPolicy keeps the end of the license until the publisher supplies a potential end
+type publisherPolicy struct{}
+
+func (publisherPolicy) PotentialEnd(cfg config.LicenseStatus, end time.Time, issued time.Time, now time.Time) time.Time {
+	return end
+}
+
+func (publisherPolicy) Rolling() bool { return false }
+
+var potentialRightsPolicies = map[string]PotentialRightsPolicy{
+	PolicyRentingDays: rentingDaysPolicy{},
+	PolicyFixed:       fixedPolicy{},
+	PolicyRolling:     rollingPolicy{},
+	PolicyPublisher:   publisherPolicy{},
+}
+
+// RegisterPotentialRightsPolicy adds a policy of the potential end of the loans, or replaces a built-in one.
+// It must be called before the server starts.
+func RegisterPotentialRightsPolicy(id string, policy PotentialRightsPolicy) {
+	potentialRightsPolicies[id] = policy
+}
+
+// resolvePotentialRightsPolicy returns the policy of a license, from its tenant, else its provider, else the default policy
+func resolvePotentialRightsPolicy(cfg config.LicenseStatus, provider string, tenant string) string {
+	id := cfg.PotentialRights.Policy
+	if p, ok := cfg.PotentialRights.Providers[provider]; ok && provider != "" {
+		id = p
+	}
+	if p, ok := cfg.PotentialRights.Tenants[tenant]; ok && tenant != "" {
+		id = p
+	}
+	if id == "" {
+		return PolicyRentingDays
+	}
+	if _, ok := potentialRightsPolicies[id]; !ok {
+		log.Println("Unknown potential rights policy " + id + ", " + PolicyRentingDays + " is used")
+		return PolicyRentingDays
+	}
+	return id
+}
+
+// potentialEnd computes the potential end of a loan with a policy; it is never before the end of the loan
+func potentialEnd(cfg config.LicenseStatus, id string, end time.Time, issued time.Time, now time.Time) time.Time {
+	policy, ok := potentialRightsPolicies[id]
+	if !ok {
+		policy = rentingDaysPolicy{}
+	}
+	potential := policy.PotentialEnd(cfg, end, issued, now).UTC().Truncate(time.Second)
+	if potential.Before(end) {
+		return end
+	}
+	return potential
+}
+
+// refreshPotentialRights computes again the potential end of a loan under a rolling policy
+func refreshPotentialRights(ls *licensestatuses.LicenseStatus, now time.Time) {
+	if ls.PotentialRights == nil || ls.CurrentEndLicense == nil {
+		return
+	}
+	if policy, ok := potentialRightsPolicies[ls.PotentialRightsPolicy]; !ok || !policy.Rolling() {
+		return
+	}
+	end := potentialEnd(config.Config.LicenseStatus, ls.PotentialRightsPolicy, *ls.CurrentEndLicense, time.Time{}, now)
+	ls.PotentialRights.End = &end
+}
+
+// SetPotentialRights sets the potential end of a loan supplied by its publisher;
+// the license status then follows the publisher policy
+//
+func SetPotentialRights(w http.ResponseWriter, r *http.Request, s Server) {
+	licenseID := mux.Vars(r)["key"]
+
+	var potentialRights licensestatuses.PotentialRights
+	if err := json.NewDecoder(r.Body).Decode(&potentialRights); err != nil {
+		api.BodyError(w, r, err)
+		return
+	}
+	if potentialRights.End == nil || potentialRights.End.IsZero() {
+		problem.Error(w, r, problem.Problem{Detail: "Missing potential rights end"}, http.StatusBadRequest)
+		return
+	}
+
+	licenseStatus, err := s.LicenseStatuses().GetByLicenseId(licenseID)
+	if err != nil {
+		if errors.Is(err, licensestatuses.ErrNotFound) {
+			problem.NotFoundHandler(w, r)
+			return
+		}
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if licenseStatus.CurrentEndLicense == nil || licenseStatus.CurrentEndLicense.IsZero() {
+		problem.Error(w, r, problem.Problem{Detail: "The license " + licenseID + " is not a loan"}, http.StatusBadRequest)
+		return
+	}
+	end := potentialRights.End.UTC().Truncate(time.Second)
+	if end.Before(*licenseStatus.CurrentEndLicense) {
+		problem.Error(w, r, problem.Problem{Detail: "The potential rights end is before the end of the license"}, http.StatusBadRequest)
+		return
+	}
+
+	licenseStatus.PotentialRights = &licensestatuses.PotentialRights{End: &end}
+	licenseStatus.PotentialRightsPolicy = PolicyPublisher
+	err = s.LicenseStatuses().Update(*licenseStatus)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
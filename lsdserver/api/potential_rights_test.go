@@ -0,0 +1,78 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license_statuses"
+)
+
+func TestResolvePotentialRightsPolicy(t *testing.T) {
+	cfg := config.LicenseStatus{PotentialRights: config.PotentialRights{
+		Policy:    PolicyRolling,
+		Providers: map[string]string{"https://publisher.example.com": PolicyFixed},
+		Tenants:   map[string]string{"tenant-a": PolicyPublisher, "tenant-b": "unknown"},
+	}}
+	tests := []struct{ provider, tenant, expected string }{
+		{"", "", PolicyRolling},
+		{"https://publisher.example.com", "", PolicyFixed},
+		{"https://publisher.example.com", "tenant-a", PolicyPublisher},
+		{"", "tenant-b", PolicyRentingDays},
+	}
+	for _, test := range tests {
+		if id := resolvePotentialRightsPolicy(cfg, test.provider, test.tenant); id != test.expected {
+			t.Errorf("Expected the policy %s for %q/%q, got %s", test.expected, test.provider, test.tenant, id)
+		}
+	}
+	if id := resolvePotentialRightsPolicy(config.LicenseStatus{}, "", ""); id != PolicyRentingDays {
+		t.Errorf("Expected the default policy, got %s", id)
+	}
+}
+
+func TestPotentialEnd(t *testing.T) {
+	issued := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	end := issued.Add(7 * 24 * time.Hour)
+	now := issued.Add(time.Hour)
+	cfg := config.LicenseStatus{RentingDays: 30, PotentialRights: config.PotentialRights{
+		FixedEnd:    "2020-06-30T00:00:00Z",
+		RollingDays: 10,
+	}}
+
+	if e := potentialEnd(cfg, PolicyRentingDays, end, issued, now); !e.Equal(issued.Add(30 * 24 * time.Hour)) {
+		t.Errorf("Unexpected renting days end %s", e)
+	}
+	if e := potentialEnd(cfg, PolicyFixed, end, issued, now); !e.Equal(time.Date(2020, 6, 30, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected fixed end %s", e)
+	}
+	if e := potentialEnd(cfg, PolicyRolling, end, issued, now); !e.Equal(now.Add(10 * 24 * time.Hour)) {
+		t.Errorf("Unexpected rolling end %s", e)
+	}
+	if e := potentialEnd(cfg, PolicyPublisher, end, issued, now); !e.Equal(end) {
+		t.Errorf("Unexpected publisher end %s", e)
+	}
+	// the potential end is never before the end of the license
+	cfg.RentingDays = 2
+	if e := potentialEnd(cfg, PolicyRentingDays, end, issued, now); !e.Equal(end) {
+		t.Errorf("Expected the end of the license, got %s", e)
+	}
+
+	// a rolling potential end moves with time
+	config.Config.LicenseStatus = cfg
+	defer func() { config.Config.LicenseStatus = config.LicenseStatus{} }()
+	ls := licensestatuses.LicenseStatus{CurrentEndLicense: &end, PotentialRights: &licensestatuses.PotentialRights{End: &end}, PotentialRightsPolicy: PolicyRolling}
+	later := now.Add(5 * 24 * time.Hour)
+	refreshPotentialRights(&ls, later)
+	if !ls.PotentialRights.End.Equal(later.Add(10 * 24 * time.Hour)) {
+		t.Errorf("Unexpected rolling end %s", ls.PotentialRights.End)
+	}
+	ls.PotentialRightsPolicy = PolicyFixed
+	refreshPotentialRights(&ls, later.Add(24*time.Hour))
+	if !ls.PotentialRights.End.Equal(later.Add(10 * 24 * time.Hour)) {
+		t.Errorf("Expected a fixed end to stay, got %s", ls.PotentialRights.End)
+	}
+}
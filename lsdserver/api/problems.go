@@ -0,0 +1,18 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilsd
+
+import (
+	"github.com/readium/readium-lcp-server/license_statuses"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/transactions"
+)
+
+// the types of the problems reporting the errors of the License Status Server;
+// the interactions with a license status document use the types of the specification
+func init() {
+	problem.RegisterType(licensestatuses.ErrNotFound, problem.LICENSE_STATUS_NOT_FOUND)
+	problem.RegisterType(transactions.ErrNotFound, problem.EVENT_NOT_FOUND)
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilsd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license_statuses"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/servicetoken"
+	"github.com/readium/readium-lcp-server/status"
+	"github.com/readium/readium-lcp-server/transport"
+)
+
+// maxConsumptionSize limits the body of a consumption report
+const maxConsumptionSize = 4096
+
+// timeout of the calls to the rights accounting of the License Server
+const rightsTimeout = 10 * time.Second
+
+// GetRightsAllowance returns the print and copy rights of a license, their consumption and the remaining allowances,
+// as recorded by the License Server
+//
+func GetRightsAllowance(w http.ResponseWriter, r *http.Request, s Server) {
+	licenseID := mux.Vars(r)["key"]
+	if _, err := s.LicenseStatuses().GetByLicenseId(licenseID); err != nil {
+		api.StoreError(w, r, err)
+		return
+	}
+	forwardRights(w, r, "GET", licenseID, nil)
+}
+
+// ReportRightsConsumption forwards the print and copy amounts consumed by a reading system to the License Server,
+// which rejects a consumption exceeding the granted rights. The license must be ready or active.
+//
+func ReportRightsConsumption(w http.ResponseWriter, r *http.Request, s Server) {
+	licenseID := mux.Vars(r)["key"]
+	licenseStatus, err := s.LicenseStatuses().GetByLicenseId(licenseID)
+	if err != nil {
+		if errors.Is(err, licensestatuses.ErrNotFound) {
+			problem.NotFoundHandler(w, r)
+			return
+		}
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if licenseStatus.Status != status.STATUS_ACTIVE && licenseStatus.Status != status.STATUS_READY {
+		msg := "The current license status is " + licenseStatus.Status + "; the rights cannot be consumed"
+		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusForbidden)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxConsumptionSize))
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	forwardRights(w, r, "POST", licenseID, body)
+}
+
+// forwardRights calls the rights accounting of the License Server and copies its response
+func forwardRights(w http.ResponseWriter, r *http.Request, method string, licenseID string, body []byte) {
+	lcpURL := config.Config.LcpServer.PublicBaseUrl + "/licenses/" + licenseID + "/rights"
+	req, err := http.NewRequest(method, lcpURL, bytes.NewReader(body))
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if err = servicetoken.Authorize(req, config.LcpServerName, config.Config.LcpUpdateAuth); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", api.ContentType_JSON)
+	}
+	resp, err := transport.To(config.LcpServerName).Do(req, rightsTimeout)
+	if err != nil {
+		log.Println("Error calling the rights accounting of the License Server for the license " + licenseID + ": " + err.Error())
+		problem.Error(w, r, problem.Problem{Detail: "The License Server is not available"}, http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 European Digital Reading Lab. All rights reserved.
+// Licensed to the Readium Foundation under one or more contributor license agreements.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilsd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/status"
+	"github.com/readium/readium-lcp-server/transactions"
+)
+
+// default time window of the statistics, in days
+const statisticsDefaultDays = 30
+
+// GetLicenseStatistics returns the number of licenses per status
+// (ready, active, expired, revoked, returned, cancelled)
+//
+func GetLicenseStatistics(w http.ResponseWriter, r *http.Request, s Server) {
+	counts, err := s.LicenseStatuses().CountByStatus()
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(counts)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetRegistrationStatistics returns the number of device registrations per day
+// parameters:
+//	from, to: optional time window, RFC 3339 timestamps; defaults to the last 30 days
+//
+func GetRegistrationStatistics(w http.ResponseWriter, r *http.Request, s Server) {
+	from, to, err := getStatisticsWindow(r)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	counts := make([]transactions.DailyCount, 0)
+
+	fn := s.Transactions().CountByDay(status.STATUS_ACTIVE_INT, from, to)
+	var count transactions.DailyCount
+	for count, err = fn(); err == nil; count, err = fn() {
+		counts = append(counts, count)
+	}
+	if !errors.Is(err, transactions.ErrNotFound) {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(counts)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetRenewalStatistics returns the number of renewals per publication, the most renewed first
+// the publications are given by their content id, which the license server resolves to titles;
+// the renewals of the licenses created before the content was recorded are counted with an empty id.
+// parameters:
+//	from, to: optional time window, RFC 3339 timestamps; defaults to the last 30 days
+//
+func GetRenewalStatistics(w http.ResponseWriter, r *http.Request, s Server) {
+	from, to, err := getStatisticsWindow(r)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	counts := make([]transactions.ContentCount, 0)
+
+	fn := s.Transactions().CountByContent(status.EVENT_RENEWED_INT, from, to)
+	var count transactions.ContentCount
+	for count, err = fn(); err == nil; count, err = fn() {
+		counts = append(counts, count)
+	}
+	if !errors.Is(err, transactions.ErrNotFound) {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(counts)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+}
+
+// getStatisticsWindow gets the time window of a statistics request
+//
+func getStatisticsWindow(r *http.Request) (from time.Time, to time.Time, err error) {
+	to = clock.Now().UTC()
+	if rTo := r.FormValue("to"); rTo != "" {
+		to, err = time.Parse(time.RFC3339, rTo)
+		if err != nil {
+			return
+		}
+	}
+	from = to.AddDate(0, 0, -statisticsDefaultDays)
+	if rFrom := r.FormValue("from"); rFrom != "" {
+		from, err = time.Parse(time.RFC3339, rFrom)
+	}
+	return
+}
@@ -6,7 +6,7 @@
 package main
 
 import (
-	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -21,12 +21,21 @@ import (
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/clock"
 	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
+	"github.com/readium/readium-lcp-server/errorreport"
 	"github.com/readium/readium-lcp-server/license_statuses"
 	"github.com/readium/readium-lcp-server/localization"
 	"github.com/readium/readium-lcp-server/logging"
 	"github.com/readium/readium-lcp-server/lsdserver/server"
+	"github.com/readium/readium-lcp-server/maintenance"
+	"github.com/readium/readium-lcp-server/retention"
+	"github.com/readium/readium-lcp-server/servicetoken"
+	"github.com/readium/readium-lcp-server/shared"
 	"github.com/readium/readium-lcp-server/transactions"
+	"github.com/readium/readium-lcp-server/transport"
 )
 
 func dbFromURI(uri string) (string, string) {
@@ -39,11 +48,35 @@ func main() {
 	var readonly bool = false
 	var err error
 
+	config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
 	if config_file = os.Getenv("READIUM_LSDSERVER_CONFIG"); config_file == "" {
 		config_file = "config.yaml"
 	}
 
 	config.ReadConfig(config_file)
+	if err = config.ApplyFlags(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	if err = config.Validate(config.LsdServerName); err != nil {
+		log.Fatal(err)
+	}
+	servicetoken.Issuer = config.LsdServerName
+	if err = errorreport.Init(config.LsdServerName, config.Config.ErrorReporting); err != nil {
+		log.Fatal(err)
+	}
+	if err = clock.Init(config.Config.Clock); err != nil {
+		log.Fatal(err)
+	}
+	// store of the rate limits, idempotency keys and locks, shared by the instances of the server
+	if err = shared.Open(config.Config.Shared); err != nil {
+		log.Fatal(err)
+	}
+	// a maintenance enabled by the configuration, read-only until it is ended
+	if err = maintenance.Init(config.LsdServerName, config.Config.LsdServer.Maintenance); err != nil {
+		log.Fatal(err)
+	}
 
 	err = localization.InitTranslations()
 	if err != nil {
@@ -63,23 +96,21 @@ func main() {
 	}
 
 	driver, cnxn := dbFromURI(dbURI)
-	db, err := sql.Open(driver, cnxn)
+	db, err := dbutils.Open(driver, cnxn, config.Config.LsdServer.ServerInfo)
 	if err != nil {
 		panic(err)
 	}
-	if driver == "sqlite3" {
-		_, err = db.Exec("PRAGMA journal_mode = WAL")
-		if err != nil {
-			panic(err)
-		}
-	}
 
-	hist, err := licensestatuses.Open(db)
+	replica, err := dbutils.OpenReplica(config.Config.LsdServer.ServerInfo, db)
+	if err != nil {
+		panic(err)
+	}
+	hist, err := licensestatuses.OpenWithReplica(db, replica)
 	if err != nil {
 		panic(err)
 	}
 
-	trns, err := transactions.Open(db)
+	trns, err := transactions.OpenWithReplica(db, replica)
 	if err != nil {
 		panic(err)
 	}
@@ -110,17 +141,33 @@ func main() {
 
 	HandleSignals()
 
-	parsedPort := strconv.Itoa(config.Config.LsdServer.Port)
-	s := lsdserver.New(":"+parsedPort, readonly, complianceMode, goofyMode, &hist, &trns, authenticator)
+	// the listen address is independent of the public base url, e.g. behind a load balancer
+	listenAddr := config.Config.LsdServer.Listen(":" + strconv.Itoa(config.Config.LsdServer.Port))
+	s := lsdserver.New(listenAddr, readonly, complianceMode, goofyMode, &hist, &trns, authenticator)
 	if readonly {
-		log.Println("License status server running in readonly mode on port " + parsedPort)
+		log.Println("License status server running in readonly mode on " + listenAddr)
 	} else {
-		log.Println("License status server running on port " + parsedPort)
+		log.Println("License status server running on " + listenAddr)
 	}
 	log.Println("Using database " + dbURI)
 	log.Println("Public base URL=" + config.Config.LsdServer.PublicBaseUrl)
 
-	if err := s.ListenAndServe(); err != nil {
+	// the calls of the License Server, received in process or from a queue
+	if err = transport.Serve(config.LsdServerName, s.Handler); err != nil {
+		log.Fatal(err)
+	}
+
+	// purge of the old events and returned loans
+	retentionConf := config.Config.Retention
+	rules := []retention.Rule{
+		{Name: "events", Days: retentionConf.EventDays, Purge: trns.PurgeEvents},
+		{Name: "returned_loans", Days: retentionConf.ReturnedDays, Purge: hist.PurgeReturned},
+	}
+	if !readonly && retention.Enabled(rules) {
+		go retention.Run(rules, retention.Interval(retentionConf), retentionConf.DryRun)
+	}
+
+	if err := api.ListenAndServe(&s.Server, config.Config.LsdServer.TLS); err != nil {
 		log.Println("Error " + err.Error())
 	}
 
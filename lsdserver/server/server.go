@@ -6,6 +6,7 @@
 package lsdserver
 
 import (
+	"expvar"
 	"net/http"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
 	"github.com/readium/readium-lcp-server/license_statuses"
 	"github.com/readium/readium-lcp-server/lsdserver/api"
 	"github.com/readium/readium-lcp-server/transactions"
@@ -40,7 +42,7 @@ func (s *Server) GoofyMode() bool {
 
 func New(bindAddr string, readonly bool, complianceMode bool, goofyMode bool, lst *licensestatuses.LicenseStatuses, trns *transactions.Transactions, basicAuth *auth.BasicAuth) *Server {
 
-	sr := api.CreateServerRouter("")
+	sr := api.CreateServerRouter("", config.Config.LsdServer.ServerInfo)
 
 	s := &Server{
 		Server: http.Server{
@@ -55,6 +57,12 @@ func New(bindAddr string, readonly bool, complianceMode bool, goofyMode bool, ls
 		trns:      *trns,
 		goofyMode: goofyMode,
 	}
+	api.SetTimeouts(&s.Server, config.Config.LsdServer.Timeouts)
+
+	// the logins of the rate limits and of the idempotent requests, once their credentials are verified
+	sr.Logins.Verify = func(r *http.Request) string {
+		return api.ServiceLogin(basicAuth, config.LsdServerName, r)
+	}
 
 	// Route.PathPrefix: http://www.gorillatoolkit.org/pkg/mux#Route.PathPrefix
 	// Route.Subrouter: http://www.gorillatoolkit.org/pkg/mux#Route.Subrouter
@@ -66,27 +74,73 @@ func New(bindAddr string, readonly bool, complianceMode bool, goofyMode bool, ls
 	s.handlePrivateFunc(sr.R, licenseRoutesPathPrefix, apilsd.FilterLicenseStatuses, basicAuth).Methods("GET")
 
 	s.handleFunc(licenseRoutes, "/{key}/status", apilsd.GetLicenseStatusDocument).Methods("GET")
+	// the license link of the status documents, when fresh licenses are enabled
+	if config.Config.LicenseStatus.FreshLicense.Enabled {
+		s.handleFunc(licenseRoutes, "/{key}/license", apilsd.GetFreshLicense).Methods("GET")
+	}
+
+	// statistics
+	statisticsRoutes := sr.R.PathPrefix("/statistics").Subrouter().StrictSlash(false)
+	s.handlePrivateFunc(statisticsRoutes, "/licenses", apilsd.GetLicenseStatistics, basicAuth).Methods("GET")
+	s.handlePrivateFunc(statisticsRoutes, "/registrations", apilsd.GetRegistrationStatistics, basicAuth).Methods("GET")
+	s.handlePrivateFunc(statisticsRoutes, "/renewals", apilsd.GetRenewalStatistics, basicAuth).Methods("GET")
 
 	if complianceMode {
 		s.handleFunc(sr.R, "/compliancetest", apilsd.AddLogToFile).Methods("POST")
 	}
 
 	s.handlePrivateFunc(licenseRoutes, "/{key}/registered", apilsd.ListRegisteredDevices, basicAuth).Methods("GET")
+	s.handlePrivateFunc(licenseRoutes, "/{key}/events", apilsd.ListLicenseEvents, basicAuth).Methods("GET")
 	if !readonly {
-		s.handleFunc(licenseRoutes, "/{key}/register", apilsd.RegisterDevice).Methods("POST")
-		s.handleFunc(licenseRoutes, "/{key}/return", apilsd.LendingReturn).Methods("PUT")
-		s.handleFunc(licenseRoutes, "/{key}/renew", apilsd.LendingRenewal).Methods("PUT")
-		s.handlePrivateFunc(licenseRoutes, "/{key}/status", apilsd.LendingCancellation, basicAuth).Methods("PATCH")
+		s.handleFunc(licenseRoutes, "/{key}/register", writing(apilsd.RegisterDevice)).Methods("POST")
+		s.handleFunc(licenseRoutes, "/{key}/return", writing(apilsd.LendingReturn)).Methods("PUT")
+		s.handleFunc(licenseRoutes, "/{key}/renew", writing(apilsd.LendingRenewal)).Methods("PUT")
+		// the reading systems report the consumption of the print and copy rights
+		if config.Config.LicenseStatus.RightsAccounting {
+			s.handleFunc(licenseRoutes, "/{key}/rights", apilsd.GetRightsAllowance).Methods("GET")
+			s.handleFunc(licenseRoutes, "/{key}/rights", writing(apilsd.ReportRightsConsumption)).Methods("POST")
+		}
+		s.handlePrivateFunc(licenseRoutes, "/{key}/status", writing(apilsd.LendingCancellation), basicAuth).Methods("PATCH")
+		s.handlePrivateFunc(licenseRoutes, "/{key}/potential_rights", writing(apilsd.SetPotentialRights), basicAuth).Methods("PUT")
+
+		s.handlePrivateFunc(sr.R, "/licenses", writing(apilsd.CreateLicenseStatusDocument), basicAuth).Methods("PUT")
+		// import the status documents of the licenses issued by another License Server
+		s.handlePrivateFunc(licenseRoutes, "/import", writing(apilsd.ImportLicenseStatuses), basicAuth).Methods("POST")
+		s.handlePrivateFunc(licenseRoutes, "/", writing(apilsd.CreateLicenseStatusDocument), basicAuth).Methods("PUT")
 
-		s.handlePrivateFunc(sr.R, "/licenses", apilsd.CreateLicenseStatusDocument, basicAuth).Methods("PUT")
-		s.handlePrivateFunc(licenseRoutes, "/", apilsd.CreateLicenseStatusDocument, basicAuth).Methods("PUT")
+		// erasure of the personal data of a user, triggered by the License Server
+		s.handlePrivateFunc(sr.R, "/erasures", writing(apilsd.EraseUserData), basicAuth).Methods("POST")
 	}
 
+	// maintenance mode: the routes which write to the database are refused, the reads are served
+	maintenanceHandler := api.MaintenanceHandler(config.LsdServerName, config.Config.LsdServer.Maintenance)
+	sr.R.HandleFunc("/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		if api.CheckAuth(basicAuth, w, r) {
+			maintenanceHandler(w, r)
+		}
+	}).Methods("GET", "PUT", "DELETE")
+
+	// metrics, including the number of records purged by the retention rules
+	sr.R.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		if api.CheckAuth(basicAuth, w, r) {
+			expvar.Handler().ServeHTTP(w, r)
+		}
+	}).Methods("GET")
+
 	return s
 }
 
 type HandlerFunc func(w http.ResponseWriter, r *http.Request, s apilsd.Server)
 
+// writing refuses the requests of a route which writes to the database while the server is in maintenance
+func writing(fn HandlerFunc) func(w http.ResponseWriter, r *http.Request, s apilsd.Server) {
+	return func(w http.ResponseWriter, r *http.Request, s apilsd.Server) {
+		if api.CheckMaintenance(w, r, config.LsdServerName) {
+			fn(w, r, s)
+		}
+	}
+}
+
 func (s *Server) handleFunc(router *mux.Router, route string, fn HandlerFunc) *mux.Route {
 	return router.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
 		fn(w, r, s)
@@ -97,7 +151,7 @@ type HandlerPrivateFunc func(w http.ResponseWriter, r *http.Request, s apilsd.Se
 
 func (s *Server) handlePrivateFunc(router *mux.Router, route string, fn HandlerPrivateFunc, authenticator *auth.BasicAuth) *mux.Route {
 	return router.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
-		if api.CheckAuth(authenticator, w, r) {
+		if api.CheckServiceAuth(authenticator, config.LsdServerName, w, r) {
 			fn(w, r, s)
 		}
 	})
@@ -0,0 +1,126 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package maintenance keeps the maintenance state of the servers, e.g. during a maintenance window of the database:
+// the requests which write are refused while the reads are served. The state is kept in the shared store,
+// so that a maintenance started on an instance of a server applies to all the instances if the store is Redis.
+package maintenance
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/shared"
+)
+
+// DefaultRetryAfter is the delay after which the clients are told to retry, if not configured
+const DefaultRetryAfter = 300 * time.Second
+
+// MaxDuration bounds a maintenance started without an end, so that a forgotten maintenance
+// does not keep a server read-only
+const MaxDuration = 24 * time.Hour
+
+// ErrEnded is returned when the end of a new maintenance is already past
+var ErrEnded = errors.New("The end of the maintenance is past")
+
+// State is the maintenance of a server
+type State struct {
+	Enabled    bool       `json:"enabled"`
+	Message    string     `json:"message,omitempty"`
+	RetryAfter int        `json:"retry_after,omitempty"` // in seconds
+	Until      *time.Time `json:"until,omitempty"`
+}
+
+// RetryIn returns the delay after which the clients should retry, not beyond the end of the maintenance
+func (st State) RetryIn(now time.Time) time.Duration {
+	retry := time.Duration(st.RetryAfter) * time.Second
+	if retry <= 0 {
+		retry = DefaultRetryAfter
+	}
+	if st.Until != nil && st.Until.Sub(now) < retry {
+		retry = st.Until.Sub(now)
+	}
+	if retry < time.Second {
+		retry = time.Second
+	}
+	return retry
+}
+
+func key(server string) string {
+	return "maintenance:" + server
+}
+
+// Get returns the maintenance state of a server
+func Get(server string) (State, error) {
+	var st State
+	b, err := shared.Default().Get(key(server))
+	if err != nil || b == nil {
+		return st, err
+	}
+	err = json.Unmarshal(b, &st)
+	return st, err
+}
+
+// Active returns the maintenance state of a server and whether it is in maintenance;
+// a server whose state cannot be read is not in maintenance, the error is logged
+func Active(server string) (State, bool) {
+	st, err := Get(server)
+	if err != nil {
+		log.Println("Maintenance: " + err.Error())
+		return State{}, false
+	}
+	return st, st.Enabled
+}
+
+// Start puts a server in maintenance until the end of the state, MaxDuration at most,
+// and returns the new state
+func Start(server string, st State) (State, error) {
+	now := clock.Now().UTC().Truncate(time.Second)
+	duration := MaxDuration
+	if st.Until != nil {
+		if duration = st.Until.Sub(now); duration <= 0 {
+			return st, ErrEnded
+		}
+		if duration > MaxDuration {
+			duration = MaxDuration
+		}
+	}
+	until := now.Add(duration)
+	st.Enabled, st.Until = true, &until
+	b, err := json.Marshal(st)
+	if err != nil {
+		return st, err
+	}
+	if err = shared.Default().Set(key(server), b, duration); err != nil {
+		return st, err
+	}
+	log.Println("Maintenance of the " + server + " server started, until " + until.Format(time.RFC3339))
+	return st, nil
+}
+
+// Stop ends the maintenance of a server
+func Stop(server string) error {
+	s := shared.Default()
+	b, err := s.Get(key(server))
+	if err != nil || b == nil {
+		return err
+	}
+	if err = s.DeleteIf(key(server), b); err == nil {
+		log.Println("Maintenance of the " + server + " server ended")
+	}
+	return err
+}
+
+// Init starts the maintenance of a server if it is enabled by its configuration
+func Init(server string, conf config.Maintenance) error {
+	if !conf.Enabled {
+		return nil
+	}
+	_, err := Start(server, State{Message: conf.Message, RetryAfter: conf.RetryAfter})
+	return err
+}
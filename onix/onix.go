@@ -0,0 +1,234 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package onix parses the subset of ONIX for Books 3.0 messages (reference tags)
+// used to describe publications: identifiers, title, contributors and cover.
+package onix
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+// ONIX code list values used by the parser
+const (
+	productIDTypeISBN13    = "15" // list 5: ISBN-13
+	titleTypeDistinctive   = "01" // list 15: distinctive title
+	resourceTypeFrontCover = "01" // list 158: front cover
+	resourceModeImage      = "03" // list 159: still image
+)
+
+// ErrNoProduct is returned when a message does not contain any product
+var ErrNoProduct = errors.New("The ONIX message does not contain any product")
+
+// Product is the metadata extracted from an ONIX product record
+type Product struct {
+	RecordReference string   `json:"record_reference"`
+	Identifiers     []string `json:"identifiers,omitempty"`
+	ISBN            string   `json:"isbn,omitempty"`
+	Title           string   `json:"title,omitempty"`
+	Authors         []string `json:"authors,omitempty"`
+	CoverURL        string   `json:"cover_url,omitempty"`
+	Collection      string   `json:"collection,omitempty"`
+}
+
+// Author returns the contributors as a single display string
+func (p Product) Author() string {
+	return strings.Join(p.Authors, ", ")
+}
+
+type message struct {
+	XMLName  xml.Name  `xml:"ONIXMessage"`
+	Products []product `xml:"Product"`
+}
+
+type product struct {
+	RecordReference    string               `xml:"RecordReference"`
+	ProductIdentifiers []productIdentifier  `xml:"ProductIdentifier"`
+	TitleDetails       []titleDetail        `xml:"DescriptiveDetail>TitleDetail"`
+	Contributors       []contributor        `xml:"DescriptiveDetail>Contributor"`
+	Collections        []collection         `xml:"DescriptiveDetail>Collection"`
+	SupportingResource []supportingResource `xml:"CollateralDetail>SupportingResource"`
+}
+
+type productIdentifier struct {
+	ProductIDType string `xml:"ProductIDType"`
+	IDValue       string `xml:"IDValue"`
+}
+
+type titleDetail struct {
+	TitleType     string         `xml:"TitleType"`
+	TitleElements []titleElement `xml:"TitleElement"`
+}
+
+type titleElement struct {
+	TitleText          string `xml:"TitleText"`
+	TitlePrefix        string `xml:"TitlePrefix"`
+	TitleWithoutPrefix string `xml:"TitleWithoutPrefix"`
+	Subtitle           string `xml:"Subtitle"`
+}
+
+type collection struct {
+	TitleDetails []titleDetail `xml:"TitleDetail"`
+}
+
+type contributor struct {
+	ContributorRole []string `xml:"ContributorRole"`
+	PersonName      string   `xml:"PersonName"`
+	NamesBeforeKey  string   `xml:"NamesBeforeKey"`
+	KeyNames        string   `xml:"KeyNames"`
+	CorporateName   string   `xml:"CorporateName"`
+}
+
+type supportingResource struct {
+	ResourceContentType string            `xml:"ResourceContentType"`
+	ResourceMode        string            `xml:"ResourceMode"`
+	ResourceVersions    []resourceVersion `xml:"ResourceVersion"`
+}
+
+type resourceVersion struct {
+	ResourceLink string `xml:"ResourceLink"`
+}
+
+// Parse reads an ONIX 3.0 message and returns its products
+// only reference tags are supported, short tags are not.
+func Parse(r io.Reader) ([]Product, error) {
+	var msg message
+
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = charset.NewReaderLabel
+	if err := dec.Decode(&msg); err != nil {
+		return nil, err
+	}
+	if len(msg.Products) == 0 {
+		return nil, ErrNoProduct
+	}
+
+	products := make([]Product, 0, len(msg.Products))
+	for _, p := range msg.Products {
+		products = append(products, p.toProduct())
+	}
+	return products, nil
+}
+
+func (p product) toProduct() Product {
+	res := Product{RecordReference: strings.TrimSpace(p.RecordReference)}
+
+	for _, id := range p.ProductIdentifiers {
+		value := strings.TrimSpace(id.IDValue)
+		if value == "" {
+			continue
+		}
+		res.Identifiers = append(res.Identifiers, value)
+		if id.ProductIDType == productIDTypeISBN13 && res.ISBN == "" {
+			res.ISBN = value
+		}
+	}
+
+	res.Title = p.title()
+
+	for _, c := range p.Contributors {
+		if !c.isAuthor() {
+			continue
+		}
+		if name := c.name(); name != "" {
+			res.Authors = append(res.Authors, name)
+		}
+	}
+
+	res.CoverURL = p.coverURL()
+	res.Collection = p.collection()
+	return res
+}
+
+// title returns the distinctive title of the product, or the first one found
+func (p product) title() string {
+	var fallback string
+	for _, td := range p.TitleDetails {
+		for _, te := range td.TitleElements {
+			t := te.text()
+			if t == "" {
+				continue
+			}
+			if td.TitleType == titleTypeDistinctive {
+				return t
+			}
+			if fallback == "" {
+				fallback = t
+			}
+		}
+	}
+	return fallback
+}
+
+// collection returns the title of the first collection of the product, e.g. a series
+func (p product) collection() string {
+	for _, c := range p.Collections {
+		for _, td := range c.TitleDetails {
+			for _, te := range td.TitleElements {
+				if t := te.text(); t != "" {
+					return t
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func (te titleElement) text() string {
+	t := strings.TrimSpace(te.TitleText)
+	if t == "" {
+		t = strings.TrimSpace(strings.TrimSpace(te.TitlePrefix) + " " + strings.TrimSpace(te.TitleWithoutPrefix))
+	}
+	if t != "" && strings.TrimSpace(te.Subtitle) != "" {
+		t += ": " + strings.TrimSpace(te.Subtitle)
+	}
+	return t
+}
+
+// coverURL returns the link to the front cover image, if any
+func (p product) coverURL() string {
+	for _, sr := range p.SupportingResource {
+		if sr.ResourceContentType != resourceTypeFrontCover {
+			continue
+		}
+		if sr.ResourceMode != "" && sr.ResourceMode != resourceModeImage {
+			continue
+		}
+		for _, rv := range sr.ResourceVersions {
+			if link := strings.TrimSpace(rv.ResourceLink); link != "" {
+				return link
+			}
+		}
+	}
+	return ""
+}
+
+// isAuthor checks the contributor role; A01 is "by (author)",
+// any role is accepted when none is given
+func (c contributor) isAuthor() bool {
+	if len(c.ContributorRole) == 0 {
+		return true
+	}
+	for _, role := range c.ContributorRole {
+		if role == "A01" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c contributor) name() string {
+	if n := strings.TrimSpace(c.PersonName); n != "" {
+		return n
+	}
+	if n := strings.TrimSpace(strings.TrimSpace(c.NamesBeforeKey) + " " + strings.TrimSpace(c.KeyNames)); n != "" {
+		return n
+	}
+	return strings.TrimSpace(c.CorporateName)
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package onix
+
+import (
+	"strings"
+	"testing"
+)
+
+const sampleMessage = `<?xml version="1.0" encoding="UTF-8"?>
+<ONIXMessage release="3.0" xmlns="http://ns.editeur.org/onix/3.0/reference">
+  <Header>
+    <Sender><SenderName>Publisher</SenderName></Sender>
+  </Header>
+  <Product>
+    <RecordReference>com.example.9780000000002</RecordReference>
+    <ProductIdentifier>
+      <ProductIDType>01</ProductIDType>
+      <IDValue>e0c7a0f6-3c64-4a1b-b5a4-0f3a8e4e5a01</IDValue>
+    </ProductIdentifier>
+    <ProductIdentifier>
+      <ProductIDType>15</ProductIDType>
+      <IDValue>9780000000002</IDValue>
+    </ProductIdentifier>
+    <DescriptiveDetail>
+      <TitleDetail>
+        <TitleType>01</TitleType>
+        <TitleElement>
+          <TitleElementLevel>01</TitleElementLevel>
+          <TitlePrefix>The</TitlePrefix>
+          <TitleWithoutPrefix>Time Machine</TitleWithoutPrefix>
+          <Subtitle>An Invention</Subtitle>
+        </TitleElement>
+      </TitleDetail>
+      <Contributor>
+        <SequenceNumber>1</SequenceNumber>
+        <ContributorRole>A01</ContributorRole>
+        <PersonName>H. G. Wells</PersonName>
+      </Contributor>
+      <Contributor>
+        <SequenceNumber>2</SequenceNumber>
+        <ContributorRole>B06</ContributorRole>
+        <PersonName>A Translator</PersonName>
+      </Contributor>
+    </DescriptiveDetail>
+    <CollateralDetail>
+      <SupportingResource>
+        <ResourceContentType>01</ResourceContentType>
+        <ContentAudience>00</ContentAudience>
+        <ResourceMode>03</ResourceMode>
+        <ResourceVersion>
+          <ResourceForm>02</ResourceForm>
+          <ResourceLink>https://example.com/covers/9780000000002.jpg</ResourceLink>
+        </ResourceVersion>
+      </SupportingResource>
+    </CollateralDetail>
+  </Product>
+  <Product>
+    <RecordReference>com.example.other</RecordReference>
+    <DescriptiveDetail>
+      <TitleDetail>
+        <TitleType>01</TitleType>
+        <TitleElement><TitleText>Other</TitleText></TitleElement>
+      </TitleDetail>
+      <Contributor>
+        <NamesBeforeKey>Jules</NamesBeforeKey>
+        <KeyNames>Verne</KeyNames>
+      </Contributor>
+    </DescriptiveDetail>
+  </Product>
+</ONIXMessage>`
+
+func TestParse(t *testing.T) {
+	products, err := Parse(strings.NewReader(sampleMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 {
+		t.Fatalf("expected 2 products, got %d", len(products))
+	}
+
+	p := products[0]
+	if p.RecordReference != "com.example.9780000000002" {
+		t.Errorf("unexpected record reference %q", p.RecordReference)
+	}
+	if p.ISBN != "9780000000002" {
+		t.Errorf("unexpected isbn %q", p.ISBN)
+	}
+	if len(p.Identifiers) != 2 || p.Identifiers[0] != "e0c7a0f6-3c64-4a1b-b5a4-0f3a8e4e5a01" {
+		t.Errorf("unexpected identifiers %v", p.Identifiers)
+	}
+	if p.Title != "The Time Machine: An Invention" {
+		t.Errorf("unexpected title %q", p.Title)
+	}
+	if p.Author() != "H. G. Wells" {
+		t.Errorf("unexpected author %q", p.Author())
+	}
+	if p.CoverURL != "https://example.com/covers/9780000000002.jpg" {
+		t.Errorf("unexpected cover %q", p.CoverURL)
+	}
+
+	p = products[1]
+	if p.Title != "Other" || p.Author() != "Jules Verne" || p.ISBN != "" || p.CoverURL != "" {
+		t.Errorf("unexpected product %+v", p)
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	_, err := Parse(strings.NewReader(`<ONIXMessage release="3.0"></ONIXMessage>`))
+	if err != ErrNoProduct {
+		t.Errorf("expected ErrNoProduct, got %v", err)
+	}
+
+	_, err = Parse(strings.NewReader(`<ONIXmessage release="3.0"><product/></ONIXmessage>`))
+	if err == nil {
+		t.Error("expected an error on a short tag message")
+	}
+}
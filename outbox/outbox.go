@@ -0,0 +1,193 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package outbox stores the notifications of the License Server to the License Status Server
+// which could not be delivered yet; they are sent again by a background task.
+package outbox
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
+)
+
+// NotFound is returned at the end of a list of notifications
+var NotFound = errors.New("Notification not found")
+
+// Notification is a pending notification of a new license
+type Notification struct {
+	Id          int64
+	LicenseId   string
+	Payload     []byte
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	Created     time.Time
+}
+
+// Store is the outbox of pending notifications
+type Store interface {
+	Begin() (*sql.Tx, error)
+	Add(n Notification) error
+	AddTx(tx *sql.Tx, n Notification) error
+	ListDue(now time.Time, limit int) func() (Notification, error)
+	Retry(id int64, attempts int, next time.Time, lastError string) error
+	Delete(id int64) error
+	Count() (int64, error)
+}
+
+type dbStore struct {
+	db      *sql.DB
+	add     *dbutils.Stmt
+	listdue *dbutils.Stmt
+	retry   *dbutils.Stmt
+	delete  *dbutils.Stmt
+	count   *dbutils.Stmt
+}
+
+// Begin starts a transaction on the database of the outbox, which is also the database of the licenses
+func (s dbStore) Begin() (*sql.Tx, error) {
+	return s.db.Begin()
+}
+
+// Add stores a notification in the outbox
+func (s dbStore) Add(n Notification) error {
+	setDefaults(&n)
+	_, err := s.add.Exec(n.LicenseId, string(n.Payload), n.Attempts, n.NextAttempt.UTC(), n.LastError, n.Created.UTC())
+	return err
+}
+
+// AddTx stores a notification in the outbox, in a transaction
+func (s dbStore) AddTx(tx *sql.Tx, n Notification) error {
+	setDefaults(&n)
+	_, err := s.add.ExecTx(tx, n.LicenseId, string(n.Payload), n.Attempts, n.NextAttempt.UTC(), n.LastError, n.Created.UTC())
+	return err
+}
+
+// setDefaults sets the creation date to now; by default, a new notification is due immediately
+func setDefaults(n *Notification) {
+	if n.Created.IsZero() {
+		n.Created = time.Now().UTC()
+	}
+	if n.NextAttempt.IsZero() {
+		n.NextAttempt = n.Created
+	}
+}
+
+// ListDue lists the notifications which must be sent again, oldest first
+func (s dbStore) ListDue(now time.Time, limit int) func() (Notification, error) {
+	rows, err := s.listdue.Query(now.UTC(), limit)
+	if err != nil {
+		return func() (Notification, error) { return Notification{}, err }
+	}
+	return func() (Notification, error) {
+		var n Notification
+		var payload string
+		var err error
+		if rows.Next() {
+			err = rows.Scan(&n.Id, &n.LicenseId, &payload, &n.Attempts, &n.NextAttempt, &n.LastError, &n.Created)
+			n.Payload = []byte(payload)
+		} else {
+			rows.Close()
+			err = NotFound
+		}
+		return n, err
+	}
+}
+
+// Retry records a failed attempt and schedules the next one
+func (s dbStore) Retry(id int64, attempts int, next time.Time, lastError string) error {
+	_, err := s.retry.Exec(attempts, next.UTC(), lastError, id)
+	return err
+}
+
+// Delete removes a delivered notification
+func (s dbStore) Delete(id int64) error {
+	_, err := s.delete.Exec(id)
+	return err
+}
+
+// Count returns the number of pending notifications
+func (s dbStore) Count() (int64, error) {
+	var count int64
+	err := s.count.QueryRow().Scan(&count)
+	return count, err
+}
+
+// Open opens the outbox and creates the lsd_outbox table if it does not exist
+func Open(db *sql.DB) (s Store, err error) {
+	// the queries are written with '?' placeholders, bound to the dialect of the database
+	d := dbutils.DialectOf(config.Config.LcpServer.Database)
+	createTableQuery := tableDef
+	if d == dbutils.Postgres {
+		createTableQuery = tableDefPostgres
+	}
+	addQuery := "INSERT INTO lsd_outbox (license_id, payload, attempts, next_attempt, last_error, created) VALUES (?, ?, ?, ?, ?, ?)"
+	listDueQuery := "SELECT id, license_id, payload, attempts, next_attempt, last_error, created FROM lsd_outbox WHERE next_attempt <= ? ORDER BY id LIMIT ?"
+	retryQuery := "UPDATE lsd_outbox SET attempts = ?, next_attempt = ?, last_error = ? WHERE id = ?"
+	deleteQuery := "DELETE FROM lsd_outbox WHERE id = ?"
+	countQuery := "SELECT COUNT(*) FROM lsd_outbox"
+
+	// if sqlite/postgres, create the outbox table if it does not exist
+	if d != dbutils.MySQL {
+		_, err = db.Exec(createTableQuery)
+		if err != nil {
+			log.Println("Error creating the lsd_outbox table")
+			return
+		}
+	}
+	// if mysql, create the outbox table if it does not exist
+	if d == dbutils.MySQL {
+		err = dbutils.CreateMySQLTables(db, tableDefMySQL)
+		if err != nil {
+			log.Println("Error creating the lsd_outbox table")
+			return
+		}
+	}
+
+	s = dbStore{
+		db,
+		dbutils.NewStmt(db, d.Bind(addQuery)),
+		dbutils.NewStmt(db, d.Bind(listDueQuery)),
+		dbutils.NewStmt(db, d.Bind(retryQuery)),
+		dbutils.NewStmt(db, d.Bind(deleteQuery)),
+		dbutils.NewStmt(db, d.Bind(countQuery)),
+	}
+	return
+}
+
+const tableDef = "CREATE TABLE IF NOT EXISTS lsd_outbox (" +
+	"id integer PRIMARY KEY AUTOINCREMENT," +
+	"license_id varchar(255) NOT NULL," +
+	"payload text NOT NULL," +
+	"attempts int NOT NULL DEFAULT 0," +
+	"next_attempt datetime NOT NULL," +
+	"last_error varchar(1024) NOT NULL DEFAULT ''," +
+	"created datetime NOT NULL" +
+	");" +
+	"CREATE INDEX IF NOT EXISTS lsd_outbox_next_attempt_index on lsd_outbox (next_attempt);"
+
+const tableDefPostgres = "CREATE TABLE IF NOT EXISTS lsd_outbox (" +
+	"id SERIAL PRIMARY KEY," +
+	"license_id VARCHAR(255) NOT NULL," +
+	"payload TEXT NOT NULL," +
+	"attempts INT NOT NULL DEFAULT 0," +
+	"next_attempt TIMESTAMPTZ NOT NULL," +
+	"last_error VARCHAR(1024) NOT NULL DEFAULT ''," +
+	"created TIMESTAMPTZ NOT NULL" +
+	");" +
+	"CREATE INDEX IF NOT EXISTS lsd_outbox_next_attempt_index on lsd_outbox (next_attempt);"
+
+var tableDefMySQL = dbutils.MySQLTable{Name: "lsd_outbox", Definition: "`id` int NOT NULL PRIMARY KEY AUTO_INCREMENT," +
+	"`license_id` varchar(255) NOT NULL," +
+	"`payload` text NOT NULL," +
+	"`attempts` int NOT NULL DEFAULT 0," +
+	"`next_attempt` datetime NOT NULL," +
+	"`last_error` varchar(1024) NOT NULL DEFAULT ''," +
+	"`created` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP",
+	Indexes: []dbutils.MySQLIndex{{Name: "lsd_outbox_next_attempt_index", Columns: "`next_attempt`"}}}
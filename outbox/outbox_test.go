@@ -0,0 +1,113 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package outbox
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestOutbox(t *testing.T) {
+	config.Config.LcpServer.Database = "sqlite3://:memory:"
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	ob, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	err = ob.Add(Notification{LicenseId: "lic-1", Payload: []byte(`{"id":"lic-1"}`), Attempts: 3, NextAttempt: now.Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ob.Add(Notification{LicenseId: "lic-2", Payload: []byte(`{"id":"lic-2"}`), Attempts: 3, NextAttempt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := ob.Count(); err != nil || count != 2 {
+		t.Fatalf("Expected 2 notifications, got %d, %v", count, err)
+	}
+
+	// only the first notification is due
+	var due []Notification
+	fn := ob.ListDue(now, 10)
+	for n, err := fn(); err == nil; n, err = fn() {
+		due = append(due, n)
+	}
+	if len(due) != 1 || due[0].LicenseId != "lic-1" || string(due[0].Payload) != `{"id":"lic-1"}` {
+		t.Fatalf("Expected the notification of lic-1, got %v", due)
+	}
+
+	// postpone it
+	err = ob.Retry(due[0].Id, 4, now.Add(time.Hour), "connection refused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn = ob.ListDue(now, 10)
+	if _, err = fn(); err != NotFound {
+		t.Errorf("Expected no due notification, got %v", err)
+	}
+
+	// deliver it
+	if err = ob.Delete(due[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := ob.Count(); err != nil || count != 1 {
+		t.Errorf("Expected 1 notification, got %d, %v", count, err)
+	}
+}
+
+func TestOutboxTransaction(t *testing.T) {
+	config.Config.LcpServer.Database = "sqlite3://:memory:"
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	ob, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a rolled back notification is not stored
+	tx, err := ob.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ob.AddTx(tx, Notification{LicenseId: "lic-1", Payload: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	if count, err := ob.Count(); err != nil || count != 0 {
+		t.Fatalf("Expected no notification, got %d, %v", count, err)
+	}
+
+	// a committed notification is due immediately
+	tx, err = ob.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ob.AddTx(tx, Notification{LicenseId: "lic-2", Payload: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := ob.ListDue(time.Now().UTC().Add(time.Second), 10)()
+	if err != nil || n.LicenseId != "lic-2" || n.Attempts != 0 {
+		t.Errorf("Expected the notification of lic-2, got %v, %v", n, err)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"path"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// Options customizes the packaging of a publication
+type Options struct {
+	// resources matching one of these rules are left in clear
+	Exemptions ExemptionRules
+	// media types of resources deflated before encryption
+	CompressTypes []string
+	// media types of resources never deflated before encryption; they take precedence over CompressTypes
+	NoCompressTypes []string
+}
+
+// NewOptions returns the packaging options defined in the configuration
+func NewOptions(packaging config.Packaging) Options {
+	return Options{
+		Exemptions:      packaging.Exemptions,
+		CompressTypes:   packaging.CompressTypes,
+		NoCompressTypes: packaging.NoCompressTypes,
+	}
+}
+
+// compressBeforeEncryption tells if a resource must be deflated before encryption;
+// defaultValue is returned if the media type of the resource is not configured
+func (options Options) compressBeforeEncryption(contentType string, defaultValue bool) bool {
+	for _, mediaRange := range options.NoCompressTypes {
+		if MediaTypeMatches(mediaRange, contentType) {
+			return false
+		}
+	}
+	for _, mediaRange := range options.CompressTypes {
+		if MediaTypeMatches(mediaRange, contentType) {
+			return true
+		}
+	}
+	return defaultValue
+}
+
+// ExemptionRules is a set of rules selecting resources which must not be encrypted,
+// in addition to the resources which are never encrypted (e.g. the package document)
+type ExemptionRules []config.ExemptionRule
+
+// Exempts returns true if a resource matches one of the rules
+func (rules ExemptionRules) Exempts(resourcePath string, contentType string, size int64) bool {
+	for _, rule := range rules {
+		if ruleMatches(rule, resourcePath, contentType, size) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleMatches checks a resource against a rule;
+// a rule without pattern and media type doesn't match any resource
+func ruleMatches(rule config.ExemptionRule, resourcePath string, contentType string, size int64) bool {
+	if rule.Pattern == "" && rule.MediaType == "" {
+		return false
+	}
+	if rule.MaxSize > 0 && size > rule.MaxSize {
+		return false
+	}
+	if rule.Pattern != "" {
+		if matched, err := path.Match(rule.Pattern, resourcePath); err != nil || !matched {
+			return false
+		}
+	}
+	if rule.MediaType != "" && !MediaTypeMatches(rule.MediaType, contentType) {
+		return false
+	}
+	return true
+}
+
+// MediaTypeMatches compares a media type with a media range, e.g. "image/*";
+// parameters of the media type are ignored
+func MediaTypeMatches(mediaRange string, mediaType string) bool {
+	if i := strings.Index(mediaType, ";"); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	mediaRange = strings.ToLower(mediaRange)
+	if strings.HasSuffix(mediaRange, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*"))
+	}
+	return mediaType == mediaRange
+}
+
+// ParseMediaTypes splits a comma separated list of media types, as given on the command line
+func ParseMediaTypes(mediaTypes string) []string {
+	var list []string
+	for _, mediaType := range strings.Split(mediaTypes, ",") {
+		if mediaType = strings.TrimSpace(mediaType); mediaType != "" {
+			list = append(list, mediaType)
+		}
+	}
+	return list
+}
+
+// ParseExemptionRules builds rules from comma separated lists of glob patterns and media types,
+// as given on the command line; maxSize applies to every rule
+func ParseExemptionRules(patterns string, mediaTypes string, maxSize int64) ExemptionRules {
+	var rules ExemptionRules
+	for _, pattern := range strings.Split(patterns, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			rules = append(rules, config.ExemptionRule{Pattern: pattern, MaxSize: maxSize})
+		}
+	}
+	for _, mediaType := range ParseMediaTypes(mediaTypes) {
+		rules = append(rules, config.ExemptionRule{MediaType: mediaType, MaxSize: maxSize})
+	}
+	return rules
+}
@@ -28,6 +28,7 @@ type EncryptionProfile string
 type PackageWriter interface {
 	NewFile(path string, contentType string, storageMethod uint16) (io.WriteCloser, error)
 	MarkAsEncrypted(path string, originalSize int64, profile EncryptionProfile, algorithm string)
+	MarkAsCompressed(path string, originalSize int64)
 	Close() error
 }
 
@@ -45,6 +46,12 @@ type Resource interface {
 // Process encrypts when necessary the resources of a package.
 // It generates an output package and closes it.
 func Process(profile EncryptionProfile, encrypter crypto.Encrypter, reader PackageReader, writer PackageWriter) (key crypto.ContentKey, err error) {
+	return ProcessWithOptions(profile, encrypter, reader, writer, Options{})
+}
+
+// ProcessWithOptions encrypts when necessary the resources of a package, applying packaging options.
+// It generates an output package and closes it.
+func ProcessWithOptions(profile EncryptionProfile, encrypter crypto.Encrypter, reader PackageReader, writer PackageWriter, options Options) (key crypto.ContentKey, err error) {
 	key, err = encrypter.GenerateKey()
 	if err != nil {
 		log.Println("Error generating a key")
@@ -52,9 +59,11 @@ func Process(profile EncryptionProfile, encrypter crypto.Encrypter, reader Packa
 	}
 
 	for _, resource := range reader.Resources() {
-		if !resource.Encrypted() && resource.CanBeEncrypted() {
+		if !resource.Encrypted() && resource.CanBeEncrypted() &&
+			!options.Exemptions.Exempts(resource.Path(), resource.ContentType(), resource.Size()) {
 			log.Printf("Encrypting %s", resource.Path())
-			err = encryptResource(profile, encrypter, key, resource, writer)
+			compress := options.compressBeforeEncryption(resource.ContentType(), resource.CompressBeforeEncryption())
+			err = encryptResource(profile, encrypter, key, resource, compress, writer)
 			if err != nil {
 				log.Println("Error encrypting " + resource.Path() + ": " + err.Error())
 				return
@@ -75,6 +84,11 @@ func Process(profile EncryptionProfile, encrypter crypto.Encrypter, reader Packa
 
 // Do encrypts when necessary the resources of an EPUB package.
 func Do(encrypter crypto.Encrypter, ep epub.Epub, w io.Writer) (enc *xmlenc.Manifest, key crypto.ContentKey, err error) {
+	return DoWithOptions(encrypter, ep, w, Options{})
+}
+
+// DoWithOptions encrypts when necessary the resources of an EPUB package, applying packaging options.
+func DoWithOptions(encrypter crypto.Encrypter, ep epub.Epub, w io.Writer, options Options) (enc *xmlenc.Manifest, key crypto.ContentKey, err error) {
 	key, err = encrypter.GenerateKey()
 	if err != nil {
 		log.Println("Error generating a key")
@@ -88,8 +102,18 @@ func Do(encrypter crypto.Encrypter, ep epub.Epub, w io.Writer) (enc *xmlenc.Mani
 	}
 
 	for _, res := range ep.Resource {
-		if _, alreadyEncrypted := ep.Encryption.DataForFile(res.Path); !alreadyEncrypted && canEncrypt(res, ep) {
-			toCompress := mustCompressBeforeEncryption(*res, ep)
+		data, alreadyEncrypted := ep.Encryption.DataForFile(res.Path)
+		if alreadyEncrypted {
+			// obfuscated fonts and their encryption.xml entries are kept as is
+			if data.IsObfuscation() {
+				log.Println("Preserving obfuscated font " + res.Path)
+			} else {
+				log.Println("Preserving resource already encrypted " + res.Path)
+			}
+		}
+		if !alreadyEncrypted && canEncrypt(res, ep) &&
+			!options.Exemptions.Exempts(res.Path, res.ContentType, int64(res.OriginalSize)) {
+			toCompress := options.compressBeforeEncryption(res.ContentType, mustCompressBeforeEncryption(*res, ep))
 			err = encryptFile(encrypter, key, ep.Encryption, res, toCompress, ew)
 			if err != nil {
 				log.Println("Error encrypting " + res.Path + ": " + err.Error())
@@ -130,11 +154,10 @@ func canEncrypt(file *epub.Resource, ep epub.Epub) bool {
 	return ep.CanEncrypt(file.Path)
 }
 
-func encryptResource(profile EncryptionProfile, encrypter crypto.Encrypter, key crypto.ContentKey, resource Resource, packageWriter PackageWriter) error {
+func encryptResource(profile EncryptionProfile, encrypter crypto.Encrypter, key crypto.ContentKey, resource Resource, compress bool, packageWriter PackageWriter) error {
 	storageMethod := uint16(Deflate)
-	mustBeCompressedBeforeEncryption := resource.CompressBeforeEncryption()
 
-	if mustBeCompressedBeforeEncryption {
+	if compress {
 		storageMethod = NoCompression
 	}
 
@@ -148,7 +171,7 @@ func encryptResource(profile EncryptionProfile, encrypter crypto.Encrypter, key
 	}
 	var reader io.Reader = resourceReader
 
-	if resource.CompressBeforeEncryption() {
+	if compress {
 		var buffer bytes.Buffer
 		w, err := flate.NewWriter(&buffer, 9)
 		if err != nil {
@@ -167,6 +190,9 @@ func encryptResource(profile EncryptionProfile, encrypter crypto.Encrypter, key
 	file.Close()
 
 	packageWriter.MarkAsEncrypted(resource.Path(), resource.Size(), profile, encrypter.Signature())
+	if compress {
+		packageWriter.MarkAsCompressed(resource.Path(), resource.Size())
+	}
 
 	return err
 }
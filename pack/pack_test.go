@@ -32,6 +32,7 @@ import (
 	"io/ioutil"
 	"testing"
 
+	"github.com/readium/readium-lcp-server/config"
 	"github.com/readium/readium-lcp-server/crypto"
 	"github.com/readium/readium-lcp-server/epub"
 	"github.com/readium/readium-lcp-server/xmlenc"
@@ -181,3 +182,151 @@ func TestPackingWithSpace(t *testing.T) {
 	}
 
 }
+
+func TestExemptionRules(t *testing.T) {
+	rules := ParseExemptionRules("OPS/images/*title*", "audio/*", 0)
+	rules = append(rules, config.ExemptionRule{MediaType: "image/png", MaxSize: 1000})
+
+	var tests = []struct {
+		path        string
+		contentType string
+		size        int64
+		exempted    bool
+	}{
+		{"OPS/images/Moby-Dick_FE_title_page.jpg", "image/jpeg", 200000, true},
+		{"OPS/images/other.jpg", "image/jpeg", 100, false},
+		{"OPS/audio/track.mp3", "audio/mpeg", 5000000, true},
+		{"OPS/images/thumb.png", "image/png", 500, true},
+		{"OPS/images/large.png", "image/png; charset=binary", 5000, false},
+		{"OPS/chapter_001.xhtml", "application/xhtml+xml", 100, false},
+	}
+	for _, test := range tests {
+		if exempted := rules.Exempts(test.path, test.contentType, test.size); exempted != test.exempted {
+			t.Errorf("Exempts(%s, %s, %d) = %t, expected %t", test.path, test.contentType, test.size, exempted, test.exempted)
+		}
+	}
+}
+
+func TestPackingWithExemptions(t *testing.T) {
+	z, err := zip.OpenReader("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input, _ := epub.Read(&z.Reader)
+
+	imagePath := "OPS/images/Moby-Dick_FE_title_page.jpg"
+	options := Options{Exemptions: ParseExemptionRules("OPS/images/*", "", 0)}
+
+	buf := new(bytes.Buffer)
+	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
+	encryption, _, err := DoWithOptions(encrypter, input, buf, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, encrypted := encryption.DataForFile(imagePath); encrypted {
+		t.Errorf("Did not expect %s to be encrypted", imagePath)
+	}
+	if len(encryption.Data) == 0 {
+		t.Error("Expected some encrypted data")
+	}
+}
+
+func TestPackingWithCompressionOptions(t *testing.T) {
+	z, err := zip.OpenReader("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input, _ := epub.Read(&z.Reader)
+
+	htmlFilePath := "OPS/chapter_001.xhtml"
+	imagePath := "OPS/images/Moby-Dick_FE_title_page.jpg"
+	options := Options{CompressTypes: []string{"image/*"}, NoCompressTypes: []string{"application/xhtml+xml"}}
+
+	buf := new(bytes.Buffer)
+	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
+	encryption, _, err := DoWithOptions(encrypter, input, buf, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected = map[string]int{htmlFilePath: NoCompression, imagePath: Deflate}
+	for path, method := range expected {
+		data, ok := encryption.DataForFile(path)
+		if !ok {
+			t.Errorf("Expected %s to be encrypted", path)
+			continue
+		}
+		if m := data.Properties.Properties[0].Compression.Method; m != method {
+			t.Errorf("Expected %s to have a compression method %d, got %d", path, method, m)
+		}
+	}
+}
+
+func TestPackingWithObfuscatedFont(t *testing.T) {
+	z, err := zip.OpenReader("../test/samples/sample-with-space.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input, _ := epub.Read(&z.Reader)
+
+	fontFilePath := "OPS/fonts/MinionPro Regular.otf"
+	inputRes, ok := findFile(fontFilePath, input)
+	if !ok {
+		t.Fatalf("Could not find %s in input", fontFilePath)
+	}
+	inputBytes, err := ioutil.ReadAll(inputRes.Contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputRes.Contents = bytes.NewReader(inputBytes)
+
+	buf := new(bytes.Buffer)
+	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
+	encryption, _, err := Do(encrypter, input, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a single entry, describing the obfuscation
+	count := 0
+	for _, data := range encryption.Data {
+		if data.CipherData.CipherReference.URI == xmlenc.URI("OPS/fonts/MinionPro%20Regular.otf") {
+			count++
+			if !data.IsObfuscation() {
+				t.Errorf("Expected the obfuscation algorithm, got %s", data.Method.Algorithm)
+			}
+		}
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 encryption entry for %s, got %d", fontFilePath, count)
+	}
+
+	// the obfuscated font is copied as is
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, _ := epub.Read(zr)
+	outputRes, ok := findFile(fontFilePath, output)
+	if !ok {
+		t.Fatalf("Could not find %s in output", fontFilePath)
+	}
+	outputBytes, err := ioutil.ReadAll(outputRes.Contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(inputBytes, outputBytes) {
+		t.Errorf("Expected the obfuscated font to be unchanged")
+	}
+
+	// unescaped cipher references are found as well
+	m := xmlenc.Manifest{Data: []xmlenc.Data{{}}}
+	m.Data[0].CipherData.CipherReference.URI = xmlenc.URI(fontFilePath)
+	if _, ok := m.DataForFile(fontFilePath); !ok {
+		t.Errorf("Expected to find an unescaped cipher reference")
+	}
+}
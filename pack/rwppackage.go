@@ -149,6 +149,25 @@ func (writer *RWPPackageWriter) MarkAsEncrypted(path string, originalSize int64,
 	}
 }
 
+// MarkAsCompressed records in the manifest that a resource was deflated before encryption
+func (writer *RWPPackageWriter) MarkAsCompressed(path string, originalSize int64) {
+	for i, resource := range writer.manifest.ReadingOrder {
+		if path == resource.Href {
+			if resource.Properties == nil {
+				writer.manifest.ReadingOrder[i].Properties = new(rwpm.Properties)
+			}
+			if writer.manifest.ReadingOrder[i].Properties.Encrypted == nil {
+				writer.manifest.ReadingOrder[i].Properties.Encrypted = new(rwpm.Encrypted)
+			}
+
+			writer.manifest.ReadingOrder[i].Properties.Encrypted.Compression = "deflate"
+			writer.manifest.ReadingOrder[i].Properties.Encrypted.OriginalLength = int(originalSize)
+
+			break
+		}
+	}
+}
+
 const MANIFEST_LOCATION = "manifest.json"
 
 func (writer *RWPPackageWriter) writeManifest() error {
@@ -36,6 +36,8 @@ import (
 	"net/http"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/technoweenie/grohl"
 
@@ -54,8 +56,25 @@ type Problem struct {
 	Detail   string `json:"detail,omitempty"`
 	Instance string `json:"instance,omitempty"`
 	//Additional members
+	Availability  *Availability  `json:"availability,omitempty"`
+	InvalidParams []InvalidParam `json:"invalid-params,omitempty"`
 }
 
+// InvalidParam is a field of a request which breaks a rule, as in the example of RFC 7807
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// Availability describes the copies of a content when none is available for a new loan
+type Availability struct {
+	MaxConcurrentLoans int        `json:"max_concurrent_loans"`
+	ActiveLoans        int        `json:"active_loans"`
+	NextAvailable      *time.Time `json:"next_available,omitempty"`
+	HoldPosition       int        `json:"hold_position,omitempty"`
+}
+
+// the types of the problems defined by the License Status Document specification
 const ERROR_BASE_URL = "http://readium.org/license-status-document/error/"
 const SERVER_INTERNAL_ERROR = ERROR_BASE_URL + "server"
 const REGISTRATION_BAD_REQUEST = ERROR_BASE_URL + "registration"
@@ -65,6 +84,117 @@ const RENEW_REJECT = ERROR_BASE_URL + "renew/date"
 const CANCEL_BAD_REQUEST = ERROR_BASE_URL + "cancel"
 const FILTER_BAD_REQUEST = ERROR_BASE_URL + "filter"
 
+// SERVER_ERROR_BASE_URL is the base of the types of the other problems reported by the servers.
+// These types are stable: the clients may rely on them rather than on the detail of the problems.
+const SERVER_ERROR_BASE_URL = "http://readium.org/lcp-server/error/"
+
+// the types of the problems which have no more specific type, by http status
+const (
+	BAD_REQUEST           = SERVER_ERROR_BASE_URL + "bad-request"
+	UNAUTHORIZED          = SERVER_ERROR_BASE_URL + "unauthorized"
+	FORBIDDEN             = SERVER_ERROR_BASE_URL + "forbidden"
+	NOT_FOUND             = SERVER_ERROR_BASE_URL + "not-found"
+	METHOD_NOT_ALLOWED    = SERVER_ERROR_BASE_URL + "method-not-allowed"
+	CONFLICT              = SERVER_ERROR_BASE_URL + "conflict"
+	GONE                  = SERVER_ERROR_BASE_URL + "gone"
+	PRECONDITION_FAILED   = SERVER_ERROR_BASE_URL + "precondition-failed"
+	BODY_TOO_LARGE        = SERVER_ERROR_BASE_URL + "body-too-large"
+	UNSUPPORTED_MEDIA     = SERVER_ERROR_BASE_URL + "unsupported-media-type"
+	RANGE_NOT_SATISFIABLE = SERVER_ERROR_BASE_URL + "range-not-satisfiable"
+	TOO_MANY_REQUESTS     = SERVER_ERROR_BASE_URL + "too-many-requests"
+	INTERNAL_ERROR        = SERVER_ERROR_BASE_URL + "internal"
+	BAD_GATEWAY           = SERVER_ERROR_BASE_URL + "bad-gateway"
+	SERVICE_UNAVAILABLE   = SERVER_ERROR_BASE_URL + "unavailable"
+)
+
+// the types of the problems reporting known errors of the servers
+const (
+	INVALID_BODY             = SERVER_ERROR_BASE_URL + "invalid-body"
+	LICENSE_NOT_FOUND        = SERVER_ERROR_BASE_URL + "license-not-found"
+	CONTENT_NOT_FOUND        = SERVER_ERROR_BASE_URL + "content-not-found"
+	FILE_NOT_FOUND           = SERVER_ERROR_BASE_URL + "file-not-found"
+	CHECKSUM_MISMATCH        = SERVER_ERROR_BASE_URL + "checksum-mismatch"
+	DUPLICATE_CONTENT        = SERVER_ERROR_BASE_URL + "duplicate-content"
+	LICENSE_STATUS_NOT_FOUND = SERVER_ERROR_BASE_URL + "license-status-not-found"
+	EVENT_NOT_FOUND          = SERVER_ERROR_BASE_URL + "event-not-found"
+	HOLD_NOT_FOUND           = SERVER_ERROR_BASE_URL + "hold-not-found"
+	LICENSE_MODIFIED         = SERVER_ERROR_BASE_URL + "license-modified"
+	CONTENT_MODIFIED         = SERVER_ERROR_BASE_URL + "content-modified"
+	MANDATORY_INFO_MISSING   = SERVER_ERROR_BASE_URL + "mandatory-info-missing"
+	BAD_PASSPHRASE_HASH      = SERVER_ERROR_BASE_URL + "bad-passphrase-hash"
+	UNSUPPORTED_HASH         = SERVER_ERROR_BASE_URL + "unsupported-hash-algorithm"
+	HASH_ALGORITHM_CHANGED   = SERVER_ERROR_BASE_URL + "hash-algorithm-changed"
+	KEY_CHECK_MISMATCH       = SERVER_ERROR_BASE_URL + "key-check-mismatch"
+	UNKNOWN_USER_FIELD       = SERVER_ERROR_BASE_URL + "unknown-user-field"
+	NOT_UPDATABLE            = SERVER_ERROR_BASE_URL + "not-updatable"
+	LICENSE_ID_MISMATCH      = SERVER_ERROR_BASE_URL + "license-id-mismatch"
+	BAD_RIGHTS               = SERVER_ERROR_BASE_URL + "bad-rights"
+	BAD_CONSUMPTION          = SERVER_ERROR_BASE_URL + "bad-consumption"
+	RIGHTS_EXCEEDED          = SERVER_ERROR_BASE_URL + "rights-exceeded"
+	INVALID_CURSOR           = SERVER_ERROR_BASE_URL + "invalid-cursor"
+	OPERATOR_ONLY            = SERVER_ERROR_BASE_URL + "operator-only"
+	INVALID_SERVICE_TOKEN    = SERVER_ERROR_BASE_URL + "invalid-service-token"
+	EXPIRED_SERVICE_TOKEN    = SERVER_ERROR_BASE_URL + "expired-service-token"
+	SERVICE_TOKEN_AUDIENCE   = SERVER_ERROR_BASE_URL + "service-token-audience"
+	USER_NOT_FOUND           = SERVER_ERROR_BASE_URL + "user-not-found"
+	PUBLICATION_NOT_FOUND    = SERVER_ERROR_BASE_URL + "publication-not-found"
+	PURCHASE_NOT_FOUND       = SERVER_ERROR_BASE_URL + "purchase-not-found"
+	INVALID_SESSION          = SERVER_ERROR_BASE_URL + "invalid-session"
+	EXPIRED_SESSION          = SERVER_ERROR_BASE_URL + "expired-session"
+	INVALID_PURCHASE_STATE   = SERVER_ERROR_BASE_URL + "invalid-purchase-state"
+	RENEWAL_REFUSED          = SERVER_ERROR_BASE_URL + "renewal-refused"
+	UNSUPPORTED_UPLOAD       = SERVER_ERROR_BASE_URL + "unsupported-upload"
+	IDEMPOTENCY_MISMATCH     = SERVER_ERROR_BASE_URL + "idempotency-key-mismatch"
+)
+
+var statusTypes = map[int]string{
+	http.StatusBadRequest:                   BAD_REQUEST,
+	http.StatusUnauthorized:                 UNAUTHORIZED,
+	http.StatusForbidden:                    FORBIDDEN,
+	http.StatusNotFound:                     NOT_FOUND,
+	http.StatusMethodNotAllowed:             METHOD_NOT_ALLOWED,
+	http.StatusConflict:                     CONFLICT,
+	http.StatusGone:                         GONE,
+	http.StatusPreconditionFailed:           PRECONDITION_FAILED,
+	http.StatusRequestEntityTooLarge:        BODY_TOO_LARGE,
+	http.StatusUnsupportedMediaType:         UNSUPPORTED_MEDIA,
+	http.StatusRequestedRangeNotSatisfiable: RANGE_NOT_SATISFIABLE,
+	http.StatusTooManyRequests:              TOO_MANY_REQUESTS,
+	http.StatusInternalServerError:          INTERNAL_ERROR,
+	http.StatusBadGateway:                   BAD_GATEWAY,
+	http.StatusServiceUnavailable:           SERVICE_UNAVAILABLE,
+}
+
+var (
+	typesMutex sync.RWMutex
+	errorTypes = map[string]string{}
+)
+
+// RegisterType gives a type to the problems which report an error: the problems without type
+// whose detail is the message of the error get this type
+//
+func RegisterType(err error, typeURI string) {
+	typesMutex.Lock()
+	defer typesMutex.Unlock()
+	errorTypes[err.Error()] = typeURI
+}
+
+// TypeOf returns the type of a problem without type: the type registered for its detail,
+// else the type of its http status, else about:blank
+//
+func TypeOf(detail string, status int) string {
+	typesMutex.RLock()
+	typeURI, ok := errorTypes[detail]
+	typesMutex.RUnlock()
+	if ok {
+		return typeURI
+	}
+	if typeURI, ok = statusTypes[status]; ok {
+		return typeURI
+	}
+	return "about:blank"
+}
+
 func Error(w http.ResponseWriter, r *http.Request, problem Problem, status int) {
 	acceptLanguages := r.Header.Get("Accept-Language")
 
@@ -75,11 +205,16 @@ func Error(w http.ResponseWriter, r *http.Request, problem Problem, status int)
 	w.WriteHeader(status)
 
 	problem.Status = status
+	if problem.Type == "" {
+		problem.Type = TypeOf(problem.Detail, status)
+	}
 
-	if problem.Type == "about:blank" || problem.Type == "" { // lookup Title  statusText should match http status
+	if problem.Type == "about:blank" || problem.Title == "" { // lookup Title  statusText should match http status
 		localization.LocalizeMessage(acceptLanguages, &problem.Title, http.StatusText(status))
 	} else {
 		localization.LocalizeMessage(acceptLanguages, &problem.Title, problem.Title)
+	}
+	if problem.Detail != "" {
 		localization.LocalizeMessage(acceptLanguages, &problem.Detail, problem.Detail)
 	}
 	jsonError, e := json.Marshal(problem)
@@ -0,0 +1,47 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func report(p Problem, status int) (Problem, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	Error(w, httptest.NewRequest("GET", "/licenses/1", nil), p, status)
+	var res Problem
+	json.NewDecoder(w.Body).Decode(&res)
+	return res, w
+}
+
+func TestTypes(t *testing.T) {
+	RegisterType(errors.New("Thing not found"), SERVER_ERROR_BASE_URL+"thing-not-found")
+
+	p, w := report(Problem{Detail: "Thing not found"}, http.StatusNotFound)
+	if w.Header().Get("Content-Type") != ContentType_PROBLEM_JSON {
+		t.Errorf("Unexpected content type %s", w.Header().Get("Content-Type"))
+	}
+	if p.Type != SERVER_ERROR_BASE_URL+"thing-not-found" || p.Status != http.StatusNotFound || p.Title != "Not Found" {
+		t.Errorf("Unexpected problem for a registered error %+v", p)
+	}
+
+	// the problems without a registered error get the type of their status
+	if p, _ = report(Problem{Detail: "Something else"}, http.StatusNotFound); p.Type != NOT_FOUND {
+		t.Errorf("Expected the type %s, got %s", NOT_FOUND, p.Type)
+	}
+	if p, _ = report(Problem{Detail: "Teapot"}, http.StatusTeapot); p.Type != "about:blank" || p.Title != http.StatusText(http.StatusTeapot) {
+		t.Errorf("Expected a blank problem, got %+v", p)
+	}
+
+	// the explicit types and titles are kept
+	p, _ = report(Problem{Type: RENEW_REJECT, Title: "Renewal refused", Detail: "Thing not found"}, http.StatusForbidden)
+	if p.Type != RENEW_REJECT || p.Title != "Renewal refused" || p.Detail != "Thing not found" {
+		t.Errorf("Unexpected problem with an explicit type %+v", p)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package retention runs the periodic purge of the old records of a server,
+// e.g. expired licenses or old events, and exposes the number of purged rows on /debug/vars.
+package retention
+
+import (
+	"expvar"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/readium/readium-lcp-server/clock"
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// DefaultInterval is the delay between two runs of the rules, if none is configured
+const DefaultInterval = 24 * time.Hour
+
+// Purged is the number of rows purged by each rule since the start of the server
+var Purged = expvar.NewMap("retention_purged")
+
+// Purgeable is the number of rows each rule would have purged at its last run, in dry-run mode
+var Purgeable = expvar.NewMap("retention_purgeable")
+
+// PurgeFunc purges the records older than a date and returns their number;
+// in dry-run mode, the records are only counted.
+type PurgeFunc func(before time.Time, dryRun bool) (int64, error)
+
+// Rule purges the records older than a number of days; it is disabled if the number of days is 0
+type Rule struct {
+	Name  string
+	Days  int
+	Purge PurgeFunc
+}
+
+// RunOnce applies each enabled rule and returns the number of rows purged, or purgeable, per rule
+//
+func RunOnce(rules []Rule, now time.Time, dryRun bool) map[string]int64 {
+	counts := make(map[string]int64)
+	for _, rule := range rules {
+		if rule.Days <= 0 {
+			continue
+		}
+		before := now.UTC().AddDate(0, 0, -rule.Days)
+		count, err := rule.Purge(before, dryRun)
+		if err != nil {
+			log.Println("Retention: error purging " + rule.Name + ": " + err.Error())
+			continue
+		}
+		counts[rule.Name] = count
+		if dryRun {
+			v := new(expvar.Int)
+			v.Set(count)
+			Purgeable.Set(rule.Name, v)
+			log.Println("Retention (dry run): " + strconv.FormatInt(count, 10) + " " + rule.Name + " would be purged")
+		} else {
+			Purged.Add(rule.Name, count)
+			if count > 0 {
+				log.Println("Retention: " + strconv.FormatInt(count, 10) + " " + rule.Name + " purged")
+			}
+		}
+	}
+	return counts
+}
+
+// Run applies the rules at startup, then periodically; it never returns
+//
+func Run(rules []Rule, interval time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	for {
+		RunOnce(rules, clock.Now(), dryRun)
+		<-ticker.C
+	}
+}
+
+// Enabled checks if at least one rule is enabled
+func Enabled(rules []Rule) bool {
+	for _, rule := range rules {
+		if rule.Days > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Interval returns the configured interval between two runs
+func Interval(c config.Retention) time.Duration {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval) * time.Hour
+	}
+	return DefaultInterval
+}
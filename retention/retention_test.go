@@ -0,0 +1,57 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package retention
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunOnce(t *testing.T) {
+	now := time.Date(2020, time.March, 10, 12, 0, 0, 0, time.UTC)
+	var cutoff time.Time
+	var dryRuns []bool
+	rules := []Rule{
+		{Name: "events", Days: 30, Purge: func(before time.Time, dryRun bool) (int64, error) {
+			cutoff = before
+			dryRuns = append(dryRuns, dryRun)
+			return 12, nil
+		}},
+		{Name: "disabled", Days: 0, Purge: func(before time.Time, dryRun bool) (int64, error) {
+			t.Error("A disabled rule must not run")
+			return 0, nil
+		}},
+		{Name: "failing", Days: 1, Purge: func(before time.Time, dryRun bool) (int64, error) {
+			return 0, errors.New("db error")
+		}},
+	}
+
+	counts := RunOnce(rules, now, true)
+	if !cutoff.Equal(now.AddDate(0, 0, -30)) {
+		t.Errorf("Unexpected cutoff %v", cutoff)
+	}
+	if counts["events"] != 12 || len(counts) != 1 {
+		t.Errorf("Expected 12 events, got %v", counts)
+	}
+	if v := Purgeable.Get("events"); v == nil || v.String() != "12" {
+		t.Errorf("Expected 12 purgeable events, got %v", v)
+	}
+	if v := Purged.Get("events"); v != nil {
+		t.Errorf("Nothing must be purged in dry-run mode, got %v", v)
+	}
+
+	RunOnce(rules, now, false)
+	RunOnce(rules, now, false)
+	if v := Purged.Get("events"); v == nil || v.String() != "24" {
+		t.Errorf("Expected 24 purged events, got %v", v)
+	}
+	if len(dryRuns) != 3 || !dryRuns[0] || dryRuns[1] || dryRuns[2] {
+		t.Errorf("Unexpected dry-run flags %v", dryRuns)
+	}
+	if !Enabled(rules) || Enabled(rules[1:2]) {
+		t.Error("Unexpected result of Enabled")
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package servicetoken authenticates the requests between the License Server, the License Status Server
+// and the frontend with short-lived signed tokens (JWT), instead of a shared login and password.
+// A token is bound to the server it is sent to (audience) and expires after a short delay.
+// It is signed with a HMAC secret (HS256) or a private key (RS256 or ES256); the key id is given
+// in the header of the token, so that several keys are accepted while a key is rotated.
+package servicetoken
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// ErrInvalidToken is returned when a service token is malformed, badly signed or signed with an unknown key
+var ErrInvalidToken = errors.New("Invalid service token")
+
+// ErrExpiredToken is returned when a service token has expired
+var ErrExpiredToken = errors.New("The service token has expired")
+
+// ErrWrongAudience is returned when a service token was issued for another server
+var ErrWrongAudience = errors.New("The service token was issued for another server")
+
+// DefaultTTL is the default lifetime of a service token
+const DefaultTTL = 60 * time.Second
+
+// leeway tolerates the clock differences between the servers
+const leeway = 30 * time.Second
+
+// Issuer is the name of the server which issues the tokens (config.LcpServerName, LsdServerName
+// or FrontendServerName), set when the server starts
+var Issuer string
+
+// Claims are the claims of a service token
+type Claims struct {
+	Issuer   string `json:"iss"`
+	Audience string `json:"aud"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Enabled checks if the tokens are configured, with a key which signs the tokens of this server
+func Enabled() bool {
+	return config.ServiceTokensConfig().SigningKey != ""
+}
+
+// New returns a token for a server, signed with the signing key of the configuration
+func New(audience string, now time.Time) (string, error) {
+	conf := config.ServiceTokensConfig()
+	ttl := DefaultTTL
+	if conf.TTL > 0 {
+		ttl = time.Duration(conf.TTL) * time.Second
+	}
+	claims := Claims{Issuer: Issuer, Audience: audience, IssuedAt: now.Unix(), Expires: now.Add(ttl).Unix()}
+	return Sign(claims, conf.SigningKey, conf)
+}
+
+// Sign returns a token carrying some claims, signed with a key of the configuration
+func Sign(claims Claims, kid string, conf config.ServiceTokens) (string, error) {
+	var alg string
+	var signer func(unsigned string) ([]byte, error)
+	if secret, ok := conf.Secrets[kid]; ok {
+		alg = "HS256"
+		signer = func(unsigned string) ([]byte, error) { return hmacSignature(unsigned, secret), nil }
+	} else if file, ok := conf.PrivateKeys[kid]; ok {
+		key, err := loadKey(file, true)
+		if err != nil {
+			return "", err
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			alg = "RS256"
+			signer = func(unsigned string) ([]byte, error) {
+				digest := sha256.Sum256([]byte(unsigned))
+				return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+			}
+		case *ecdsa.PrivateKey:
+			if key.Curve != elliptic.P256() {
+				return "", errKeyType(kid)
+			}
+			alg = "ES256"
+			signer = func(unsigned string) ([]byte, error) {
+				digest := sha256.Sum256([]byte(unsigned))
+				r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+				if err != nil {
+					return nil, err
+				}
+				// the signature is the concatenation of r and s, 32 bytes each
+				sig := make([]byte, 64)
+				rb, sb := r.Bytes(), s.Bytes()
+				copy(sig[32-len(rb):32], rb)
+				copy(sig[64-len(sb):], sb)
+				return sig, nil
+			}
+		default:
+			return "", errKeyType(kid)
+		}
+	} else {
+		return "", errors.New("No key " + kid + " to sign the service tokens")
+	}
+
+	h, _ := json.Marshal(header{Algorithm: alg, Type: "JWT", KeyID: kid})
+	payload, _ := json.Marshal(claims)
+	unsigned := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := signer(unsigned)
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Verify checks the signature, the audience and the expiration time of a token and returns its claims
+func Verify(token string, audience string, now time.Time, conf config.ServiceTokens) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	unsigned := parts[0] + "." + parts[1]
+	if !checkSignature(h, unsigned, sig, conf) {
+		return Claims{}, ErrInvalidToken
+	}
+	var claims Claims
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	if claims.Audience != audience {
+		return Claims{}, ErrWrongAudience
+	}
+	if now.Add(-leeway).Unix() >= claims.Expires || now.Add(leeway).Unix() < claims.IssuedAt {
+		return Claims{}, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+// checkSignature checks the signature of a token with the key given in its header;
+// the algorithm must match the type of the key
+func checkSignature(h header, unsigned string, sig []byte, conf config.ServiceTokens) bool {
+	if h.Algorithm == "HS256" {
+		secret, ok := conf.Secrets[h.KeyID]
+		return ok && hmac.Equal(sig, hmacSignature(unsigned, secret))
+	}
+	file, ok := conf.PublicKeys[h.KeyID]
+	if !ok {
+		return false
+	}
+	key, err := loadKey(file, false)
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256([]byte(unsigned))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return h.Algorithm == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if h.Algorithm != "ES256" || key.Curve != elliptic.P256() || len(sig) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	}
+	return false
+}
+
+// errKeyType is returned for a private key which cannot sign the tokens: ES256 requires a P-256 key
+func errKeyType(kid string) error {
+	return errors.New("The private key " + kid + " of the service tokens must be a RSA or P-256 key")
+}
+
+func hmacSignature(unsigned string, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+var (
+	keysMutex sync.Mutex
+	keys      = map[string]interface{}{}
+)
+
+// loadKey reads a PEM file of a private or public key once; the files of the keys are not expected
+// to change, a rotated key gets a new file
+func loadKey(file string, private bool) (interface{}, error) {
+	parse, cacheKey := parsePublicKey, "public "+file
+	if private {
+		parse, cacheKey = parsePrivateKey, "private "+file
+	}
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	if key, ok := keys[cacheKey]; ok {
+		return key, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM key in " + file)
+	}
+	key, err := parse(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keys[cacheKey] = key
+	return key, nil
+}
+
+func parsePrivateKey(der []byte) (interface{}, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return x509.ParsePKCS8PrivateKey(der)
+}
+
+// parsePublicKey accepts a public key or a certificate
+func parsePublicKey(der []byte) (interface{}, error) {
+	if key, err := x509.ParsePKIXPublicKey(der); err == nil {
+		return key, nil
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return cert.PublicKey, nil
+}
+
+// Authorize sets the credentials of a request sent to another server: a service token
+// if the tokens are enabled, the basic authentication otherwise (if a login is configured)
+func Authorize(req *http.Request, audience string, fallback config.Auth) error {
+	if !Enabled() {
+		if fallback.Username != "" {
+			req.SetBasicAuth(fallback.Username, fallback.Password)
+		}
+		return nil
+	}
+	token, err := New(audience, time.Now())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// FromRequest returns the service token of a request, given as a bearer token
+func FromRequest(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package servicetoken
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestRotation(t *testing.T) {
+	now := time.Now()
+	old := config.ServiceTokens{Secrets: map[string]string{"k1": "secret one"}}
+	token, err := Sign(Claims{Issuer: "lcp", Audience: "lsd", IssuedAt: now.Unix(), Expires: now.Add(time.Minute).Unix()}, "k1", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := Verify(token, "lsd", now, old)
+	if err != nil || claims.Issuer != "lcp" {
+		t.Fatalf("Expected a valid token, got %+v %v", claims, err)
+	}
+	if _, err = Verify(token, "lcp", now, old); err != ErrWrongAudience {
+		t.Errorf("Expected a wrong audience, got %v", err)
+	}
+	if _, err = Verify(token, "lsd", now.Add(2*time.Minute), old); err != ErrExpiredToken {
+		t.Errorf("Expected an expired token, got %v", err)
+	}
+
+	// while the key is rotated, the tokens signed with both keys are accepted
+	rotating := config.ServiceTokens{Secrets: map[string]string{"k1": "secret one", "k2": "secret two"}}
+	if _, err = Verify(token, "lsd", now, rotating); err != nil {
+		t.Errorf("Expected the old key to be accepted, got %v", err)
+	}
+	// once the old key is removed, its tokens are rejected
+	rotated := config.ServiceTokens{Secrets: map[string]string{"k2": "secret two"}}
+	if _, err = Verify(token, "lsd", now, rotated); err != ErrInvalidToken {
+		t.Errorf("Expected the old key to be rejected, got %v", err)
+	}
+	// a secret does not verify another key
+	forged := config.ServiceTokens{Secrets: map[string]string{"k1": "secret two"}}
+	if _, err = Verify(token, "lsd", now, forged); err != ErrInvalidToken {
+		t.Errorf("Expected a bad signature, got %v", err)
+	}
+}
+
+func writePEM(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestPrivateKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicetoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	rsaPub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	ecPub, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	conf := config.ServiceTokens{
+		PrivateKeys: map[string]string{
+			"rsa": writePEM(t, dir, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)),
+			"ec":  writePEM(t, dir, "ec.pem", "EC PRIVATE KEY", ecDER),
+		},
+		PublicKeys: map[string]string{
+			"rsa": writePEM(t, dir, "rsa.pub", "PUBLIC KEY", rsaPub),
+			"ec":  writePEM(t, dir, "ec.pub", "PUBLIC KEY", ecPub),
+		},
+	}
+
+	now := time.Now()
+	claims := Claims{Issuer: "frontend", Audience: "lcp", IssuedAt: now.Unix(), Expires: now.Add(time.Minute).Unix()}
+	for _, kid := range []string{"rsa", "ec"} {
+		token, err := Sign(claims, kid, conf)
+		if err != nil {
+			t.Fatalf("Expected a token signed with %s, got %v", kid, err)
+		}
+		if _, err = Verify(token, "lcp", now, conf); err != nil {
+			t.Errorf("Expected a valid %s token, got %v", kid, err)
+		}
+	}
+	// the public key of another key does not verify a token
+	token, _ := Sign(claims, "ec", conf)
+	swapped := conf
+	swapped.PublicKeys = map[string]string{"ec": conf.PublicKeys["rsa"]}
+	if _, err = Verify(token, "lcp", now, swapped); err != ErrInvalidToken {
+		t.Errorf("Expected a bad signature, got %v", err)
+	}
+
+	// ES256 is signed with a P-256 key only
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384DER, _ := x509.MarshalECPrivateKey(p384Key)
+	conf.PrivateKeys["p384"] = writePEM(t, dir, "p384.pem", "EC PRIVATE KEY", p384DER)
+	if _, err = Sign(claims, "p384", conf); err == nil || !strings.Contains(err.Error(), "must be a RSA or P-256 key") {
+		t.Errorf("Expected the P-384 key to be refused, got %v", err)
+	}
+	// and the key is refused with the configuration
+	previous := config.Config.ServiceTokens
+	defer func() { config.Config.ServiceTokens = previous }()
+	config.Config.ServiceTokens = conf
+	err = config.Validate(config.LsdServerName)
+	if err == nil || !strings.Contains(err.Error(), "service_tokens.private_keys.p384: must be a RSA or P-256 key") {
+		t.Errorf("Expected the configuration to be refused, got %v", err)
+	}
+	if strings.Contains(err.Error(), "service_tokens.private_keys.ec:") || strings.Contains(err.Error(), "service_tokens.public_keys.") {
+		t.Errorf("Expected the other keys to be accepted, got %v", err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	defer func() { config.Config.ServiceTokens = config.ServiceTokens{} }()
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	if err := Authorize(req, "lcp", config.Auth{Username: "user", Password: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := req.BasicAuth(); !ok {
+		t.Error("Expected the basic authentication when the tokens are disabled")
+	}
+
+	config.Config.ServiceTokens = config.ServiceTokens{SigningKey: "k1", Secrets: map[string]string{"k1": "secret"}}
+	req, _ = http.NewRequest("GET", "http://example.com", nil)
+	if err := Authorize(req, "lcp", config.Auth{Username: "user", Password: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(FromRequest(req), "lcp", time.Now(), config.Config.ServiceTokens); err != nil {
+		t.Errorf("Expected a valid service token, got %v", err)
+	}
+}
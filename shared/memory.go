@@ -0,0 +1,109 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package shared
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the expired entries are purged when the store has grown by this number of entries
+const purgeEvery = 1024
+
+type entry struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryStore keeps the counters and values in the memory of the process:
+// the limits hold for each instance of the server
+type memoryStore struct {
+	mutex   sync.Mutex
+	entries map[string]entry
+	purgeAt int
+}
+
+// NewMemory returns a store in the memory of the process
+func NewMemory() Store {
+	return &memoryStore{entries: make(map[string]entry), purgeAt: purgeEvery}
+}
+
+// get returns an entry which has not expired; the lock must be held
+func (m *memoryStore) get(key string, now time.Time) (entry, bool) {
+	e, ok := m.entries[key]
+	if ok && !now.Before(e.expires) {
+		delete(m.entries, key)
+		return entry{}, false
+	}
+	return e, ok
+}
+
+// set stores an entry, and purges the expired entries from time to time; the lock must be held
+func (m *memoryStore) set(key string, e entry, now time.Time) {
+	m.entries[key] = e
+	if len(m.entries) < m.purgeAt {
+		return
+	}
+	for k, e := range m.entries {
+		if !now.Before(e.expires) {
+			delete(m.entries, k)
+		}
+	}
+	m.purgeAt = len(m.entries) + purgeEvery
+}
+
+func (m *memoryStore) Incr(key string, ttl time.Duration) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	e, ok := m.get(key, now)
+	var n int64
+	if ok {
+		n, _ = strconv.ParseInt(string(e.value), 10, 64)
+	} else {
+		e.expires = now.Add(ttl)
+	}
+	n++
+	e.value = []byte(strconv.FormatInt(n, 10))
+	m.set(key, e, now)
+	return n, nil
+}
+
+func (m *memoryStore) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	if _, ok := m.get(key, now); ok {
+		return false, nil
+	}
+	m.set(key, entry{value: value, expires: now.Add(ttl)}, now)
+	return true, nil
+}
+
+func (m *memoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	m.set(key, entry{value: value, expires: now.Add(ttl)}, now)
+	return nil
+}
+
+func (m *memoryStore) Get(key string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e, _ := m.get(key, time.Now())
+	return e.value, nil
+}
+
+func (m *memoryStore) DeleteIf(key string, value []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if e, ok := m.get(key, time.Now()); ok && bytes.Equal(e.value, value) {
+		delete(m.entries, key)
+	}
+	return nil
+}
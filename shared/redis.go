@@ -0,0 +1,99 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package shared
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// prefix of the Redis keys of the store
+const keyPrefix = "lcp:shared:"
+
+// the counter gets its time to live when it is created, so that a window of a rate limit is not extended
+var incrScript = redis.NewScript(1, `
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then redis.call("PEXPIRE", KEYS[1], ARGV[1]) end
+return n`)
+
+// the key is deleted only if it still holds the value, e.g. the token of the request holding a lock
+var deleteIfScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end
+return 0`)
+
+// redisStore keeps the counters and values in a Redis server, shared by all the instances of the server
+type redisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedis returns a store in the Redis server at the given url (redis://host:port/db)
+func NewRedis(url string) (Store, error) {
+	if url == "" {
+		return nil, errors.New("The url of the Redis server is missing")
+	}
+	pool := &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url,
+				redis.DialConnectTimeout(time.Second),
+				redis.DialReadTimeout(time.Second),
+				redis.DialWriteTimeout(time.Second))
+		},
+	}
+	// check the connection at startup
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		return nil, err
+	}
+	return &redisStore{pool: pool}, nil
+}
+
+func milliseconds(ttl time.Duration) int64 {
+	return int64(ttl / time.Millisecond)
+}
+
+func (s *redisStore) Incr(key string, ttl time.Duration) (int64, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return redis.Int64(incrScript.Do(conn, keyPrefix+key, milliseconds(ttl)))
+}
+
+func (s *redisStore) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := redis.String(conn.Do("SET", keyPrefix+key, value, "PX", milliseconds(ttl), "NX"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *redisStore) Set(key string, value []byte, ttl time.Duration) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SET", keyPrefix+key, value, "PX", milliseconds(ttl))
+	return err
+}
+
+func (s *redisStore) Get(key string) ([]byte, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	b, err := redis.Bytes(conn.Do("GET", keyPrefix+key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (s *redisStore) DeleteIf(key string, value []byte) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := deleteIfScript.Do(conn, keyPrefix+key, value)
+	return err
+}
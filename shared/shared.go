@@ -0,0 +1,118 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package shared keeps the counters, values and locks shared by the instances of a server: the rate limits,
+// the idempotency keys and the locks of the concurrent loan checks. They are kept in the memory of the process,
+// or in a Redis server so that the limits hold across the instances behind a load balancer.
+package shared
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// store types
+const (
+	TypeMemory = "memory"
+	TypeRedis  = "redis"
+)
+
+// ErrUnknownType is returned when the store type of the configuration is not supported
+var ErrUnknownType = errors.New("Unknown shared store type")
+
+// ErrLocked is returned when a lock is still held by another request after the wait
+var ErrLocked = errors.New("The resource is locked by another request")
+
+// Store keeps counters and values which expire
+type Store interface {
+	// Incr increments a counter, created with the given time to live, and returns its new value
+	Incr(key string, ttl time.Duration) (int64, error)
+	// SetNX stores a value if the key is not set, and returns true if it was stored
+	SetNX(key string, value []byte, ttl time.Duration) (bool, error)
+	// Set stores a value
+	Set(key string, value []byte, ttl time.Duration) error
+	// Get returns a value, nil if the key is not set
+	Get(key string) ([]byte, error)
+	// DeleteIf deletes a key if its value is the given value
+	DeleteIf(key string, value []byte) error
+}
+
+var (
+	storeMutex sync.RWMutex
+	store      Store
+)
+
+// Open opens the store of the configuration, used by the servers; the memory store is used by default
+func Open(conf config.Shared) error {
+	var s Store
+	switch conf.Type {
+	case "", TypeMemory:
+		s = NewMemory()
+	case TypeRedis:
+		var err error
+		if s, err = NewRedis(conf.RedisURL); err != nil {
+			return err
+		}
+	default:
+		return ErrUnknownType
+	}
+	Use(s)
+	return nil
+}
+
+// Use sets the store of the servers
+func Use(s Store) {
+	storeMutex.Lock()
+	store = s
+	storeMutex.Unlock()
+}
+
+// Default returns the store of the servers, a memory store if none was opened
+func Default() Store {
+	storeMutex.RLock()
+	s := store
+	storeMutex.RUnlock()
+	if s != nil {
+		return s
+	}
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	if store == nil {
+		store = NewMemory()
+	}
+	return store
+}
+
+// how often a lock is tried again while it is held
+const lockRetry = 20 * time.Millisecond
+
+// Lock acquires the lock of a resource, held at most for ttl, and waits at most wait for it;
+// the returned function releases the lock, if it is still held by this request
+func Lock(s Store, name string, ttl time.Duration, wait time.Duration) (func(), error) {
+	key := "lock:" + name
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	token := []byte(uid.String())
+	deadline := time.Now().Add(wait)
+	for {
+		ok, err := s.SetNX(key, token, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return func() { s.DeleteIf(key, token) }, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLocked
+		}
+		time.Sleep(lockRetry)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemory()
+	for i := int64(1); i <= 3; i++ {
+		if n, err := s.Incr("counter", 50*time.Millisecond); err != nil || n != i {
+			t.Fatalf("Expected %d, got %d, %v", i, n, err)
+		}
+	}
+	if ok, _ := s.SetNX("key", []byte("a"), time.Minute); !ok {
+		t.Error("Expected the value to be stored")
+	}
+	if ok, _ := s.SetNX("key", []byte("b"), time.Minute); ok {
+		t.Error("Expected the value to be kept")
+	}
+	s.DeleteIf("key", []byte("b"))
+	if v, _ := s.Get("key"); string(v) != "a" {
+		t.Errorf("Expected the value to be kept, got %s", v)
+	}
+	s.DeleteIf("key", []byte("a"))
+	if v, _ := s.Get("key"); v != nil {
+		t.Errorf("Expected the value to be deleted, got %s", v)
+	}
+	// the counter expires with the ttl given at its creation
+	time.Sleep(60 * time.Millisecond)
+	if n, _ := s.Incr("counter", time.Minute); n != 1 {
+		t.Errorf("Expected a new counter, got %d", n)
+	}
+}
+
+func TestLock(t *testing.T) {
+	s := NewMemory()
+	unlock, err := Lock(s, "content", time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Lock(s, "content", time.Minute, 50*time.Millisecond); err != ErrLocked {
+		t.Errorf("Expected the lock to be held, got %v", err)
+	}
+	// the lock is acquired once released
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		unlock()
+	}()
+	unlock2, err := Lock(s, "content", time.Minute, time.Second)
+	if err != nil {
+		t.Fatalf("Expected the lock to be released, got %v", err)
+	}
+	// a lock released after its ttl does not release the lock of another request
+	unlock()
+	if _, err = Lock(s, "content", time.Minute, 0); err != ErrLocked {
+		t.Errorf("Expected the lock to be held, got %v", err)
+	}
+	unlock2()
+	// a lock expires after its ttl
+	if _, err = Lock(s, "other", 20*time.Millisecond, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Lock(s, "other", time.Minute, time.Second); err != nil {
+		t.Errorf("Expected the lock to expire, got %v", err)
+	}
+}
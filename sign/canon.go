@@ -7,39 +7,160 @@ package sign
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
-	"io"
-	"strings"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
 )
 
+// The canonical form of a document is the form which is signed, as defined by the LCP specification:
+// - no whitespace outside of the strings,
+// - the members of each object sorted by name, in the order of the Unicode code points,
+// - the strings in UTF-8, where only the quotation mark, the reverse solidus and the control characters
+//   are escaped, as JSON.stringify does: \b, \t, \n, \f, \r in short form, the others as \u00xx,
+// - the numbers kept as they are serialized.
+// The serialization does not depend on the version of the encoding/json package:
+// for instance, U+2028 and U+2029 are not escaped, unlike what encoding/json does.
+
+// canonBuffers are reused by the canonicalizations, as one is done for each license
+var canonBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// Canon returns the canonical JSON form of a document
 func Canon(in interface{}) ([]byte, error) {
-	// the easiest way to canonicalize is to marshal it and reify it as a map
-	// which will sort stuff correctly
-	b, err1 := json.Marshal(in)
-	if err1 != nil {
-		return b, err1
+	buf := canonBuffers.Get().(*bytes.Buffer)
+	defer canonBuffers.Put(buf)
+	if err := canonInto(buf, in); err != nil {
+		return nil, err
 	}
+	out := make([]byte, buf.Len())
+	copy(out, buf.Bytes())
+	return out, nil
+}
 
-	var jsonObj interface{} // map[string]interface{} ==> auto sorting
+// CanonJSON returns the canonical form of a JSON document
+func CanonJSON(doc []byte) ([]byte, error) {
+	return Canon(json.RawMessage(doc))
+}
 
-	dec := json.NewDecoder(strings.NewReader(string(b)))
+// canonHash returns the SHA-256 hash of the canonical form of a document, without copying it
+func canonHash(in interface{}) ([sha256.Size]byte, error) {
+	buf := canonBuffers.Get().(*bytes.Buffer)
+	defer canonBuffers.Put(buf)
+	if err := canonInto(buf, in); err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(buf.Bytes()), nil
+}
+
+// canonInto writes the canonical form of a document in a buffer.
+// The document is serialized by encoding/json, so that the field tags apply,
+// then parsed as generic values, which are serialized in canonical form.
+func canonInto(buf *bytes.Buffer, in interface{}) error {
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(in); err != nil {
+		return err
+	}
+
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
 	dec.UseNumber()
-	for {
-		if err2 := dec.Decode(&jsonObj); err2 == io.EOF {
-			break
-		} else if err2 != nil {
-			return nil, err2
-		}
+	if err := dec.Decode(&doc); err != nil {
+		return err
 	}
-	var buf bytes.Buffer
-	enc := json.NewEncoder(&buf)
-	// do not escape characters
-	enc.SetEscapeHTML(false)
-	err := enc.Encode(jsonObj)
-	if err != nil {
-		return nil, err
+	buf.Reset()
+	return writeCanon(buf, doc)
+}
+
+// writeCanon writes a generic JSON value in canonical form
+func writeCanon(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		buf.WriteString(v.String())
+	case string:
+		writeCanonString(buf, v)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanon(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		// the byte order of UTF-8 strings is the order of their code points
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonString(buf, k)
+			buf.WriteByte(':')
+			if err := writeCanon(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return errors.New("Unexpected JSON value")
 	}
-	// remove the trailing newline, added by encode
-	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+	return nil
+}
+
+const hexDigits = "0123456789abcdef"
 
+// writeCanonString writes a string with the escapes of the canonical form;
+// invalid UTF-8 sequences are replaced by U+FFFD, as encoding/json does
+func writeCanonString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+			case c == '\b':
+				buf.WriteString(`\b`)
+			case c == '\t':
+				buf.WriteString(`\t`)
+			case c == '\n':
+				buf.WriteString(`\n`)
+			case c == '\f':
+				buf.WriteString(`\f`)
+			case c == '\r':
+				buf.WriteString(`\r`)
+			case c < 0x20:
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hexDigits[c>>4])
+				buf.WriteByte(hexDigits[c&0xF])
+			default:
+				buf.WriteByte(c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf.WriteRune(utf8.RuneError)
+		} else {
+			buf.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	buf.WriteByte('"')
 }
@@ -27,7 +27,10 @@ package sign
 
 import (
 	"bytes"
+	"encoding/json"
+	"reflect"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestCanonSimple(t *testing.T) {
@@ -77,3 +80,114 @@ func TestCanonInnerStruct(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expected, out)
 	}
 }
+
+// canonVectors are reference inputs and their canonical forms
+var canonVectors = []struct {
+	name, in, out string
+}{
+	{"scalars", `[true, false, null, 0, -1, 1.50, 1e+21, ""]`, `[true,false,null,0,-1,1.50,1e+21,""]`},
+	{"nested objects", `{"b": 1, "a": [ {"d": 2, "c": 3} ], "c": {"z": "x", "y": {}}}`,
+		`{"a":[{"c":3,"d":2}],"b":1,"c":{"y":{},"z":"x"}}`},
+	{"short escapes", `"\"\\\b\f\n\r\t"`, `"\"\\\b\f\n\r\t"`},
+	{"control characters", `"\u0000\u0001\u001F\u007f"`, "\"\\u0000\\u0001\\u001f\u007f\""},
+	{"no other escapes", `"\/ < > & \u00e9 \u2028 \u2029 \ud83d\ude00"`, "\"/ < > & \u00e9 \u2028 \u2029 \U0001F600\""},
+	// code point order: U+FFFF sorts before U+1F600, unlike the UTF-16 order
+	{"key order", `{"\u00e9": 1, "z": 2, "Z": 3, "a": 4, "_": 5, "\uffff": 6, "\ud83d\ude00": 7, "": 8}`,
+		"{\"\":8,\"Z\":3,\"_\":5,\"a\":4,\"z\":2,\"\u00e9\":1,\"\uffff\":6,\"\U0001F600\":7}"},
+	{"license", `{
+		"provider": "https://www.imaginaryebookretailer.com",
+		"id": "ef15e740-697f-11e3-949a-0800200c9a66",
+		"issued": "2013-11-04T01:08:15+01:00",
+		"encryption": {
+			"profile": "http://readium.org/lcp/basic-profile",
+			"content_key": {"algorithm": "http://www.w3.org/2001/04/xmlenc#aes256-cbc", "encrypted_value": "/k8RpXqf4E2WEunCp76E8PjhS051NXwAXeTD1ioazYxCRGvHLAck/KQ3cCh5JxDmCK0nRLyAxs1X0aA3z55boQ=="},
+			"user_key": {"text_hint": "Enter your email address", "algorithm": "http://www.w3.org/2001/04/xmlenc#sha256", "key_check": "jJEjUDipHK3OjGt6kFq7dcOLZuicQFUYwQ+TYkAIWKm6Xv6kpHFhF7LOkUK/Owww"}
+		},
+		"links": [{"rel": "hint", "href": "https://www.imaginaryebookretailer.com/lcp/hint", "type": "text/html"}],
+		"user": {"id": "d9f298a7-7f34-49e7-8aae-4378ecb1d597", "email": "EnCt2b8c6d2afd94ae4ed201b27049d8ce1afe31a90ceb6d6a6e6a3b0d1efb6"},
+		"rights": {"print": 10, "copy": 2048, "start": "2013-11-04T01:08:15+01:00", "end": "2013-11-25T01:08:15+01:00"}
+	}`, `{"encryption":{"content_key":{"algorithm":"http://www.w3.org/2001/04/xmlenc#aes256-cbc","encrypted_value":"/k8RpXqf4E2WEunCp76E8PjhS051NXwAXeTD1ioazYxCRGvHLAck/KQ3cCh5JxDmCK0nRLyAxs1X0aA3z55boQ=="},` +
+		`"profile":"http://readium.org/lcp/basic-profile","user_key":{"algorithm":"http://www.w3.org/2001/04/xmlenc#sha256","key_check":"jJEjUDipHK3OjGt6kFq7dcOLZuicQFUYwQ+TYkAIWKm6Xv6kpHFhF7LOkUK/Owww","text_hint":"Enter your email address"}},` +
+		`"id":"ef15e740-697f-11e3-949a-0800200c9a66","issued":"2013-11-04T01:08:15+01:00",` +
+		`"links":[{"href":"https://www.imaginaryebookretailer.com/lcp/hint","rel":"hint","type":"text/html"}],` +
+		`"provider":"https://www.imaginaryebookretailer.com",` +
+		`"rights":{"copy":2048,"end":"2013-11-25T01:08:15+01:00","print":10,"start":"2013-11-04T01:08:15+01:00"},` +
+		`"user":{"email":"EnCt2b8c6d2afd94ae4ed201b27049d8ce1afe31a90ceb6d6a6e6a3b0d1efb6","id":"d9f298a7-7f34-49e7-8aae-4378ecb1d597"}}`},
+}
+
+func TestCanonVectors(t *testing.T) {
+	for _, v := range canonVectors {
+		out, err := CanonJSON([]byte(v.in))
+		if err != nil {
+			t.Errorf("%s: %v", v.name, err)
+			continue
+		}
+		if string(out) != v.out {
+			t.Errorf("%s: expected %s, got %s", v.name, v.out, out)
+		}
+	}
+}
+
+func TestCanonInvalidUTF8(t *testing.T) {
+	out, err := Canon(map[string]string{"a": "x\xffy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{\"a\":\"x\uFFFDy\"}"; string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+}
+
+// checkCanonProperties checks the properties of the canonical form of a valid JSON document:
+// it is valid UTF-8 and JSON, compact, has the same value as the document and is its own canonical form
+func checkCanonProperties(t *testing.T, in []byte) {
+	out, err := CanonJSON(in)
+	if err != nil {
+		t.Fatalf("Canonicalization of %q failed: %v", in, err)
+	}
+	if !utf8.Valid(out) || !json.Valid(out) {
+		t.Fatalf("Invalid canonical form %q of %q", out, in)
+	}
+	var compact bytes.Buffer
+	if err = json.Compact(&compact, out); err != nil || !bytes.Equal(compact.Bytes(), out) {
+		t.Errorf("The canonical form %q is not compact", out)
+	}
+	if !reflect.DeepEqual(decodeGeneric(t, in), decodeGeneric(t, out)) {
+		t.Errorf("The canonical form %q does not have the value of %q", out, in)
+	}
+	again, err := CanonJSON(out)
+	if err != nil || !bytes.Equal(again, out) {
+		t.Errorf("The canonical form %q is not stable, got %q", out, again)
+	}
+}
+
+func decodeGeneric(t *testing.T, doc []byte) interface{} {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestCanonProperties(t *testing.T) {
+	for _, v := range canonVectors {
+		checkCanonProperties(t, []byte(v.in))
+	}
+}
+
+func FuzzCanonJSON(f *testing.F) {
+	for _, v := range canonVectors {
+		f.Add([]byte(v.in))
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		if !json.Valid(in) {
+			if _, err := CanonJSON(in); err == nil {
+				t.Errorf("Expected an error on the invalid document %q", in)
+			}
+			return
+		}
+		checkCanonProperties(t, in)
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+)
+
+// LoadCertificate loads a certificate, its private key and, if chainFile is set, the intermediate certificates
+// of its chain. The intermediate certificates may also follow the certificate in certFile.
+// The chain of the returned certificate is ordered from the certificate up to the root, if given:
+// the intermediate certificates are embedded in the signatures.
+//
+func LoadCertificate(certFile, keyFile, chainFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	candidates := cert.Certificate[1:]
+	if chainFile != "" {
+		data, err := ioutil.ReadFile(chainFile)
+		if err != nil {
+			return nil, err
+		}
+		chain, err := decodeCertificates(data)
+		if err != nil {
+			return nil, errors.New(chainFile + ": " + err.Error())
+		}
+		candidates = append(candidates, chain...)
+	}
+	if err = orderChain(&cert, candidates); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// decodeCertificates returns the certificates of a PEM file, in DER
+func decodeCertificates(data []byte) ([][]byte, error) {
+	var certs [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certs = append(certs, block.Bytes)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return certs, nil
+}
+
+// orderChain sets the chain of a certificate from a set of candidates: each certificate is followed by its issuer,
+// until a root certificate or a certificate whose issuer is not a candidate. A candidate which is not part
+// of the chain is an error.
+//
+func orderChain(cert *tls.Certificate, candidates [][]byte) error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	parsed := make([]*x509.Certificate, 0, len(candidates))
+	for _, der := range candidates {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, c)
+	}
+
+	chain := [][]byte{leaf.Raw}
+	used := make([]bool, len(parsed))
+	for current := leaf; ; {
+		next := -1
+		for i, c := range parsed {
+			if !used[i] && bytes.Equal(current.RawIssuer, c.RawSubject) && current.CheckSignatureFrom(c) == nil {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		used[next] = true
+		current = parsed[next]
+		chain = append(chain, current.Raw)
+		if isRoot(current) {
+			break
+		}
+	}
+	for i, c := range parsed {
+		// a duplicate of a certificate of the chain may be left in the files
+		if !used[i] && !inChain(chain, c.Raw) {
+			return errors.New("The certificate " + c.Subject.String() + " is not part of the chain of " + leaf.Subject.String())
+		}
+	}
+	cert.Certificate = chain
+	cert.Leaf = leaf
+	return nil
+}
+
+// isRoot returns true if a certificate is self-signed
+func isRoot(c *x509.Certificate) bool {
+	return bytes.Equal(c.RawIssuer, c.RawSubject) && c.CheckSignatureFrom(c) == nil
+}
+
+// intermediates returns the intermediate certificates of the chain of a certificate, embedded in its signatures:
+// the root certificates are left out, as the reading systems know them
+func intermediates(cert *tls.Certificate) [][]byte {
+	var chain [][]byte
+	for _, der := range cert.Certificate[1:] {
+		if c, err := x509.ParseCertificate(der); err == nil && !isRoot(c) {
+			chain = append(chain, der)
+		}
+	}
+	return chain
+}
+
+func inChain(chain [][]byte, der []byte) bool {
+	for _, c := range chain {
+		if bytes.Equal(c, der) {
+			return true
+		}
+	}
+	return false
+}
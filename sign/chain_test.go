@@ -0,0 +1,102 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/readium/readium-lcp-server/testsupport"
+)
+
+func writePEM(t *testing.T, file string, certs ...*x509.Certificate) {
+	var data bytes.Buffer
+	for _, c := range certs {
+		pem.Encode(&data, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	if err := ioutil.WriteFile(file, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadCertificateChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root, err := testsupport.NewCA(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, err := root.Intermediate("LCP Test Intermediate CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := intermediate.ProviderCertificate("https://provider.example.com", testsupport.ECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the certificate alone, its chain in another file, in any order
+	certFile, keyFile, err := testsupport.WriteCertificate(&tls.Certificate{Certificate: issued.Certificate[:1], PrivateKey: issued.PrivateKey}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainFile := filepath.Join(dir, "chain.pem")
+	writePEM(t, chainFile, root.Certificate, intermediate.Certificate)
+
+	cert, err := LoadCertificate(certFile, keyFile, chainFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 3 || !bytes.Equal(cert.Certificate[1], intermediate.Certificate.Raw) || !bytes.Equal(cert.Certificate[2], root.Certificate.Raw) {
+		t.Fatalf("Expected the certificate, the intermediate and the root, got %d certificates", len(cert.Certificate))
+	}
+
+	// the intermediate certificate is embedded in the signature, not the root
+	signer, err := NewSigner(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.Sign(map[string]string{"test": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig.Chain) != 1 || !bytes.Equal(sig.Chain[0], intermediate.Certificate.Raw) {
+		t.Fatalf("Expected the intermediate certificate in the signature, got %d certificates", len(sig.Chain))
+	}
+	pool := x509.NewCertPool()
+	for _, der := range sig.Chain {
+		c, _ := x509.ParseCertificate(der)
+		pool.AddCert(c)
+	}
+	leaf, _ := x509.ParseCertificate(sig.Certificate)
+	if _, err = leaf.Verify(x509.VerifyOptions{Roots: root.Pool(), Intermediates: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		t.Error("Expected the certificate to be verified with the embedded chain, got", err)
+	}
+
+	// without its chain, the certificate is still loaded, and signs without intermediate certificates
+	cert, err = LoadCertificate(certFile, keyFile, "")
+	if err != nil || len(cert.Certificate) != 1 || len(intermediates(cert)) != 0 {
+		t.Errorf("Expected the certificate alone, got %v", err)
+	}
+
+	// a certificate which is not part of the chain is refused
+	other, err := testsupport.NewCA(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, chainFile, intermediate.Certificate, other.Certificate)
+	if _, err = LoadCertificate(certFile, keyFile, chainFile); err == nil {
+		t.Error("Expected a certificate outside of the chain to be refused")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package sign
+
+import (
+	"crypto/tls"
+	"expvar"
+	"runtime"
+	"sync"
+)
+
+// waitingSignatures is the number of signatures waiting for a worker
+var waitingSignatures = expvar.NewInt("sign_waiting")
+
+// Pool signs documents with a bounded number of workers. Signing is CPU bound: more concurrent
+// signatures than processors only slow down each of them and let the requests pile up.
+// The signer of a certificate is created on its first use, then reused.
+type Pool struct {
+	workers chan struct{}
+	signers sync.Map // *tls.Certificate -> Signer
+}
+
+// NewPool returns a pool of signers; there is one worker per processor if workers is not positive
+func NewPool(workers int) *Pool {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &Pool{workers: make(chan struct{}, workers)}
+}
+
+// signer returns the signer of a certificate
+func (p *Pool) signer(cert *tls.Certificate) (Signer, error) {
+	if s, ok := p.signers.Load(cert); ok {
+		return s.(Signer), nil
+	}
+	s, err := NewSigner(cert)
+	if err != nil {
+		return nil, err
+	}
+	p.signers.Store(cert, s)
+	return s, nil
+}
+
+// Sign signs a document with a certificate, waiting for a free worker
+func (p *Pool) Sign(cert *tls.Certificate, in interface{}) (Signature, error) {
+	s, err := p.signer(cert)
+	if err != nil {
+		return Signature{}, err
+	}
+	waitingSignatures.Add(1)
+	p.workers <- struct{}{}
+	waitingSignatures.Add(-1)
+	defer func() { <-p.workers }()
+	return s.Sign(in)
+}
+
+// defaultPool is the pool used by the License Server
+var defaultPool = NewPool(0)
+
+// SetWorkers sets the number of workers of the default pool; it must be called before the first signature
+func SetWorkers(workers int) {
+	defaultPool = NewPool(workers)
+}
+
+// Sign signs a document with a certificate, through the default pool
+func Sign(cert *tls.Certificate, in interface{}) (Signature, error) {
+	return defaultPool.Sign(cert, in)
+}
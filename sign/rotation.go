@@ -0,0 +1,98 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package sign
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"sort"
+	"sync"
+)
+
+// the policies of a key rotation
+const (
+	// PolicyStaged keeps signing with the current certificate; the next one is only loaded and checked
+	PolicyStaged = "staged"
+	// PolicyNew signs the new licenses, and the licenses already signed with it, with the next certificate
+	PolicyNew = "new"
+	// PolicyAll signs all the licenses with the next certificate
+	PolicyAll = "all"
+)
+
+// Rotation is the key rotation of a certificate signing licenses: during a rotation, Next replaces Current
+// according to the policy. Name identifies the certificate in the reports, e.g. "default" or a provider uri.
+type Rotation struct {
+	Name    string
+	Current *tls.Certificate
+	Next    *tls.Certificate
+	Policy  string
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate, in hex, which identifies it in the records
+func Fingerprint(cert *tls.Certificate) string {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return ""
+	}
+	return FingerprintOf(cert.Certificate[0])
+}
+
+// FingerprintOf returns the SHA-256 fingerprint of a certificate in DER, e.g. the certificate of a signature
+func FingerprintOf(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// Select returns the certificate signing a license, from the fingerprint of the certificate
+// which signed it last, empty if it was never signed
+func (r Rotation) Select(previous string) *tls.Certificate {
+	if r.Next == nil {
+		return r.Current
+	}
+	switch r.Policy {
+	case PolicyAll:
+		return r.Next
+	case PolicyNew:
+		if previous == "" || previous == Fingerprint(r.Next) {
+			return r.Next
+		}
+	}
+	return r.Current
+}
+
+// Rotating returns true if the certificate signing a license depends on the certificate which signed it last
+func (r Rotation) Rotating() bool {
+	return r.Next != nil && r.Policy == PolicyNew
+}
+
+// the rotations of the certificates of the server, by current certificate
+var rotations sync.Map // *tls.Certificate -> Rotation
+
+// SetRotation registers a certificate signing licenses and its key rotation, if Next is set
+func SetRotation(r Rotation) {
+	if r.Policy == "" {
+		r.Policy = PolicyStaged
+	}
+	rotations.Store(r.Current, r)
+}
+
+// RotationOf returns the key rotation of a certificate; a certificate which was not registered is not rotated
+func RotationOf(cert *tls.Certificate) Rotation {
+	if r, ok := rotations.Load(cert); ok {
+		return r.(Rotation)
+	}
+	return Rotation{Current: cert, Policy: PolicyStaged}
+}
+
+// Rotations returns the certificates registered, and their rotations, sorted by name
+func Rotations() []Rotation {
+	var list []Rotation
+	rotations.Range(func(_, r interface{}) bool {
+		list = append(list, r.(Rotation))
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
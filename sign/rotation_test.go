@@ -0,0 +1,57 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package sign
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/readium/readium-lcp-server/testsupport"
+)
+
+func TestRotation(t *testing.T) {
+	ca, err := testsupport.NewCA(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := ca.ProviderCertificate("https://provider.example.com", testsupport.ECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := ca.ProviderCertificate("https://provider.example.com", testsupport.RSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(current) == Fingerprint(next) || len(Fingerprint(current)) != 64 {
+		t.Fatalf("Unexpected fingerprints %s, %s", Fingerprint(current), Fingerprint(next))
+	}
+
+	// a certificate which is not registered is not rotated
+	if r := RotationOf(current); r.Select("") != current || r.Rotating() {
+		t.Error("Expected the certificate to sign without rotation")
+	}
+
+	cases := []struct {
+		policy   string
+		previous string
+		expected *tls.Certificate
+	}{
+		{"", "", current},
+		{PolicyStaged, Fingerprint(next), current},
+		{PolicyNew, "", next},
+		{PolicyNew, Fingerprint(current), current},
+		{PolicyNew, Fingerprint(next), next},
+		{PolicyAll, Fingerprint(current), next},
+	}
+	for _, c := range cases {
+		SetRotation(Rotation{Name: "default", Current: current, Next: next, Policy: c.policy})
+		if RotationOf(current).Select(c.previous) != c.expected {
+			t.Errorf("Policy %q, previous %.8s: unexpected certificate", c.policy, c.previous)
+		}
+	}
+	if list := Rotations(); len(list) != 1 || list[0].Name != "default" || list[0].Next != next {
+		t.Errorf("Expected the registered rotation, got %+v", list)
+	}
+}
@@ -30,7 +30,6 @@ import (
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
 	"crypto/tls"
 	"errors"
 	"math"
@@ -42,14 +41,17 @@ type Signer interface {
 
 type Signature struct {
 	Certificate []byte `json:"certificate"`
-	Value       []byte `json:"value"`
-	Algorithm   string `json:"algorithm"`
+	// intermediate certificates between the certificate and its root, if any
+	Chain     [][]byte `json:"certificate_chain,omitempty"`
+	Value     []byte   `json:"value"`
+	Algorithm string   `json:"algorithm"`
 }
 
 // ECDSA
 type ecdsaSigner struct {
-	key  *ecdsa.PrivateKey
-	cert *tls.Certificate
+	key   *ecdsa.PrivateKey
+	cert  *tls.Certificate
+	chain [][]byte
 }
 
 // Used to fill the resulting output according to the XMLDSIG spec
@@ -62,12 +64,10 @@ func copyWithLeftPad(dest, src []byte) {
 }
 
 func (signer *ecdsaSigner) Sign(in interface{}) (sig Signature, err error) {
-	plain, err := Canon(in)
+	hashed, err := canonHash(in)
 	if err != nil {
 		return
 	}
-
-	hashed := sha256.Sum256(plain)
 	r, s, err := ecdsa.Sign(rand.Reader, signer.key, hashed[:])
 	if err != nil {
 		return
@@ -83,22 +83,22 @@ func (signer *ecdsaSigner) Sign(in interface{}) (sig Signature, err error) {
 
 	sig.Algorithm = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
 	sig.Certificate = signer.cert.Certificate[0]
+	sig.Chain = signer.chain
 	return
 }
 
 // RSA
 type rsaSigner struct {
-	key  *rsa.PrivateKey
-	cert *tls.Certificate
+	key   *rsa.PrivateKey
+	cert  *tls.Certificate
+	chain [][]byte
 }
 
 func (signer *rsaSigner) Sign(in interface{}) (sig Signature, err error) {
-	plain, err := Canon(in)
+	hashed, err := canonHash(in)
 	if err != nil {
 		return
 	}
-
-	hashed := sha256.Sum256(plain)
 	sig.Value, err = rsa.SignPKCS1v15(rand.Reader, signer.key, crypto.SHA256, hashed[:])
 	if err != nil {
 		return
@@ -106,18 +106,20 @@ func (signer *rsaSigner) Sign(in interface{}) (sig Signature, err error) {
 
 	sig.Algorithm = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
 	sig.Certificate = signer.cert.Certificate[0]
+	sig.Chain = signer.chain
 
 	return
 }
 
 // Creates a new signer given the certificate type. Currently supports
-// RSA (PKCS1v15) and ECDSA (SHA256 is used in both cases)
+// RSA (PKCS1v15) and ECDSA (SHA256 is used in both cases).
+// The intermediate certificates of the chain of the certificate are embedded in the signatures.
 func NewSigner(certificate *tls.Certificate) (Signer, error) {
 	switch k := certificate.PrivateKey.(type) {
 	case *ecdsa.PrivateKey:
-		return &ecdsaSigner{k, certificate}, nil
+		return &ecdsaSigner{k, certificate, intermediates(certificate)}, nil
 	case *rsa.PrivateKey:
-		return &rsaSigner{k, certificate}, nil
+		return &rsaSigner{k, certificate, intermediates(certificate)}, nil
 	}
 
 	return nil, errors.New("Unsupported certificate type")
@@ -32,6 +32,7 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"math/big"
+	"sync"
 	"testing"
 )
 
@@ -112,3 +113,124 @@ func getParamsFromECDSASignature(b []byte) (*big.Int, *big.Int) {
 
 	return r, s
 }
+
+func TestVerify(t *testing.T) {
+	for _, name := range []string{"sample_rsa", "sample_ecdsa"} {
+		cert, err := tls.LoadX509KeyPair("cert/"+name+".crt", "cert/"+name+".pem")
+		if err != nil {
+			t.Fatal("Couldn't load sample certificate ", err)
+		}
+		signer, err := NewSigner(&cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input := map[string]string{"test": "test"}
+		sig, err := signer.Sign(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = Verify(input, sig); err != nil {
+			t.Errorf("%s: expected the signature to be valid, got %v", name, err)
+		}
+		if err = Verify(map[string]string{"test": "modified"}, sig); err != ErrInvalidSignature {
+			t.Errorf("%s: expected an invalid signature, got %v", name, err)
+		}
+	}
+}
+
+func TestPool(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("cert/sample_rsa.crt", "cert/sample_rsa.pem")
+	if err != nil {
+		t.Fatal("Couldn't load sample certificate ", err)
+	}
+	pool := NewPool(2)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			input := map[string]int{"test": i}
+			sig, err := pool.Sign(&cert, input)
+			if err == nil {
+				err = Verify(input, sig)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err = pool.Sign(&tls.Certificate{}, "test"); err == nil {
+		t.Error("Expected an error with an unsupported certificate")
+	}
+}
+
+// benchLicense looks like a license, for the benchmarks of the signature
+type benchLicense struct {
+	Provider string            `json:"provider"`
+	Id       string            `json:"id"`
+	Issued   string            `json:"issued"`
+	Links    []map[string]string `json:"links"`
+	User     map[string]string `json:"user"`
+	Rights   map[string]int    `json:"rights"`
+}
+
+var benchInput = benchLicense{Provider: "http://example.com", Id: "ef15e740-697f-11e3-949a-0800200c9a66",
+	Issued: "2020-06-01T10:00:00Z",
+	Links: []map[string]string{{"rel": "hint", "href": "http://example.com/hint"},
+		{"rel": "publication", "href": "http://example.com/publication.epub", "type": "application/epub+zip"}},
+	User:   map[string]string{"id": "user", "email": "dHVcR1LFRYQkyQhR1XPKnw==", "name": "C2Vjp2wGtQqHuAXrvR4oXw=="},
+	Rights: map[string]int{"print": 10, "copy": 2048}}
+
+// BenchmarkSignNewSigner creates a signer for each license, as before the pool
+func BenchmarkSignNewSigner(b *testing.B) {
+	for _, name := range []string{"sample_rsa", "sample_ecdsa"} {
+		cert, err := tls.LoadX509KeyPair("cert/"+name+".crt", "cert/"+name+".pem")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					signer, _ := NewSigner(&cert)
+					if _, err := signer.Sign(benchInput); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkSignPool(b *testing.B) {
+	for _, name := range []string{"sample_rsa", "sample_ecdsa"} {
+		cert, err := tls.LoadX509KeyPair("cert/"+name+".crt", "cert/"+name+".pem")
+		if err != nil {
+			b.Fatal(err)
+		}
+		pool := NewPool(0)
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := pool.Sign(&cert, benchInput); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCanon(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := canonHash(benchInput); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"math/big"
+)
+
+// ErrInvalidSignature is returned when a signature does not match the signed data
+var ErrInvalidSignature = errors.New("Invalid signature")
+
+// Verify checks a signature against the canonical form of the signed data,
+// with the public key of the certificate embedded in the signature.
+// The signed data must not contain the signature itself.
+func Verify(in interface{}, sig Signature) error {
+	cert, err := x509.ParseCertificate(sig.Certificate)
+	if err != nil {
+		return err
+	}
+	plain, err := Canon(in)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256(plain)
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], sig.Value) != nil {
+			return ErrInvalidSignature
+		}
+	case *ecdsa.PublicKey:
+		// r and s are concatenated, each padded to the byte size of the curve order
+		size := len(sig.Value) / 2
+		if size == 0 || len(sig.Value) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(sig.Value[:size])
+		s := new(big.Int).SetBytes(sig.Value[size:])
+		if !ecdsa.Verify(pub, hashed[:], r, s) {
+			return ErrInvalidSignature
+		}
+	default:
+		return errors.New("Unsupported certificate type")
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package signedurl mints and checks time-limited download urls,
+// signed with a secret shared by the instances of the License Server (HMAC-SHA256).
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrExpired is returned when a signed url has expired
+var ErrExpired = errors.New("The download url has expired")
+
+// ErrInvalidSignature is returned when the signature of a url is missing or invalid
+var ErrInvalidSignature = errors.New("The signature of the download url is invalid")
+
+// Sign returns the url of a resource, signed until the expiration time.
+// The resource identifier is part of the signed data, so that a signature
+// cannot be reused for another resource.
+//
+func Sign(href string, resource string, expires time.Time, secret string) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	q := url.Values{}
+	q.Set("expires", exp)
+	q.Set("signature", signature(resource, exp, secret))
+	return href + "?" + q.Encode()
+}
+
+// Verify checks the expiration time and signature of a url, given its query parameters
+//
+func Verify(query url.Values, resource string, secret string, now time.Time) error {
+	exp := query.Get("expires")
+	sig, err := hex.DecodeString(query.Get("signature"))
+	if exp == "" || err != nil || len(sig) == 0 {
+		return ErrInvalidSignature
+	}
+	expected, _ := hex.DecodeString(signature(resource, exp, secret))
+	if !hmac.Equal(sig, expected) {
+		return ErrInvalidSignature
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if now.Unix() > expires {
+		return ErrExpired
+	}
+	return nil
+}
+
+func signature(resource string, expires string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(resource + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
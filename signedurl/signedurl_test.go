@@ -0,0 +1,43 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package signedurl
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignedURL(t *testing.T) {
+	now := time.Now()
+	href := Sign("https://lcp.example.com/contents/abc/download", "abc", now.Add(time.Hour), "secret")
+
+	u, err := url.Parse(href)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if err = Verify(query, "abc", "secret", now); err != nil {
+		t.Errorf("Expected a valid url, got %v", err)
+	}
+	if err = Verify(query, "abc", "secret", now.Add(2*time.Hour)); err != ErrExpired {
+		t.Errorf("Expected an expired url, got %v", err)
+	}
+	if err = Verify(query, "def", "secret", now); err != ErrInvalidSignature {
+		t.Errorf("Expected an invalid signature for another resource, got %v", err)
+	}
+	if err = Verify(query, "abc", "other", now); err != ErrInvalidSignature {
+		t.Errorf("Expected an invalid signature with another secret, got %v", err)
+	}
+
+	// the expiration time cannot be changed
+	query.Set("expires", "99999999999")
+	if err = Verify(query, "abc", "secret", now); err != ErrInvalidSignature {
+		t.Errorf("Expected an invalid signature, got %v", err)
+	}
+	if err = Verify(url.Values{}, "abc", "secret", now); err != ErrInvalidSignature {
+		t.Errorf("Expected an invalid signature without parameters, got %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package staging keeps the files in transit between the instances of the servers: the publications uploaded
+// to the License Server or to the frontend, waiting for their encryption by a worker, and the encrypted publications
+// waiting for their import by the License Server. In a staging store shared by the instances, an S3 bucket
+// or a directory mounted by all of them, a file written by an instance is read by another one, so that the servers
+// run as stateless replicas. Without a staging store, the files are kept in local directories, as before.
+package staging
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/storage"
+)
+
+// Scheme prefixes the locations of the files kept in the staging store, e.g. "staging:3f2a….epub"
+const Scheme = "staging:"
+
+// ErrDisabled is returned when a file is staged without a staging store
+var ErrDisabled = errors.New("No staging store is configured")
+
+// DefaultMaxDownloadSize is the maximum size of a file given by an http location, if the configuration does not set it
+const DefaultMaxDownloadSize = 1 << 30
+
+// ErrTooLarge is returned when a file given by an http location exceeds the maximum size
+var ErrTooLarge = errors.New("The downloaded file exceeds the maximum size")
+
+// fetchClient downloads the files given by an http location; a redirection must stay on the allowed hosts
+var fetchClient = &http.Client{
+	Timeout: 2 * time.Minute,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("Too many redirects")
+		}
+		return checkHost(req.URL)
+	},
+}
+
+var (
+	mu      sync.RWMutex
+	store   storage.Store
+	hosts   []string
+	maxSize int64 = DefaultMaxDownloadSize
+)
+
+// Init opens the staging store of the configuration; there is no staging store if it is not configured
+func Init(conf config.Storage) error {
+	var s storage.Store
+	switch {
+	case conf.Mode == "s3":
+		var err error
+		if s, err = storage.S3(storage.S3Config{
+			Bucket: conf.Bucket, Endpoint: conf.Endpoint, Region: conf.Region,
+			ID: conf.AccessId, Secret: conf.Secret, Token: conf.Token,
+			DisableSSL: conf.DisableSSL, ForcePathStyle: conf.PathStyle,
+		}); err != nil {
+			return err
+		}
+	case conf.FileSystem.Directory != "":
+		if err := os.MkdirAll(conf.FileSystem.Directory, os.ModePerm); err != nil {
+			return err
+		}
+		s = storage.NewFileSystem(conf.FileSystem.Directory, "")
+	}
+	Use(s)
+	mu.Lock()
+	hosts = conf.DownloadHosts
+	maxSize = conf.MaxDownloadSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxDownloadSize
+	}
+	mu.Unlock()
+	return nil
+}
+
+// Use sets the staging store, e.g. in the tests; nil disables it
+func Use(s storage.Store) {
+	mu.Lock()
+	store = s
+	mu.Unlock()
+}
+
+func current() storage.Store {
+	mu.RLock()
+	defer mu.RUnlock()
+	return store
+}
+
+// Enabled tells if a staging store is configured
+func Enabled() bool {
+	return current() != nil
+}
+
+// Put stores a file in the staging store and returns its location; the extension (e.g. ".epub") is kept
+// in the location, as it selects the format of a publication
+func Put(r io.ReadSeeker, ext string) (string, error) {
+	s := current()
+	if s == nil {
+		return "", ErrDisabled
+	}
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	key := uid.String() + ext
+	if _, err = s.Add(key, r); err != nil {
+		return "", err
+	}
+	return Scheme + key, nil
+}
+
+// PutFile stores a local file in the staging store, removes it and returns its location
+func PutFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	location, err := Put(f, path.Ext(name))
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	os.Remove(name)
+	return location, nil
+}
+
+// checkHost refuses the download of a url whose host is not allowed by the configuration
+func checkHost(u *url.URL) error {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, host := range hosts {
+		if strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname()) {
+			return nil
+		}
+	}
+	return errors.New("The download from " + u.Host + " is not allowed")
+}
+
+// isLocal tells if a location is a local path
+func isLocal(location string) bool {
+	return !strings.HasPrefix(location, Scheme) && !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://")
+}
+
+// Open returns a local file for a location: the file itself for a local path, or a temporary copy
+// of a staged file or of a file given by an http(s) url of an allowed host. The file is released by Close.
+//
+func Open(location string) (*os.File, error) {
+	if isLocal(location) {
+		return os.Open(location)
+	}
+	var r io.ReadCloser
+	limit := int64(-1)
+	if strings.HasPrefix(location, Scheme) {
+		s := current()
+		if s == nil {
+			return nil, ErrDisabled
+		}
+		item, err := s.Get(strings.TrimPrefix(location, Scheme))
+		if err != nil {
+			return nil, err
+		}
+		if r, err = item.Contents(); err != nil {
+			return nil, err
+		}
+	} else {
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, err
+		}
+		if err = checkHost(u); err != nil {
+			return nil, err
+		}
+		resp, err := fetchClient.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.New("The download of " + location + " failed, status " + strconv.Itoa(resp.StatusCode))
+		}
+		r = resp.Body
+		mu.RLock()
+		limit = maxSize
+		mu.RUnlock()
+	}
+	defer r.Close()
+	// the extension of the copy is the extension of the location, without the query of an url
+	ext := path.Ext(strings.SplitN(location, "?", 2)[0])
+	f, err := ioutil.TempFile("", "staging.*"+ext)
+	if err != nil {
+		return nil, err
+	}
+	var n int64
+	if limit < 0 {
+		_, err = io.Copy(f, r)
+	} else if n, err = io.Copy(f, io.LimitReader(r, limit+1)); err == nil && n > limit {
+		err = ErrTooLarge
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// Close closes the local file of a location, and removes it if it is a temporary copy
+func Close(location string, f *os.File) {
+	if f == nil {
+		return
+	}
+	f.Close()
+	if !isLocal(location) {
+		os.Remove(f.Name())
+	}
+}
+
+// Remove removes the file of a location, local or staged, once it is no longer needed;
+// a file given by an url is not removed from its server
+func Remove(location string) error {
+	if isLocal(location) {
+		return os.Remove(location)
+	}
+	if strings.HasPrefix(location, Scheme) {
+		if s := current(); s != nil {
+			return s.Remove(strings.TrimPrefix(location, Scheme))
+		}
+	}
+	return nil
+}
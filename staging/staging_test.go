@@ -0,0 +1,105 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package staging
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestStaging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer Use(nil)
+
+	if err = Init(config.Storage{}); err != nil || Enabled() {
+		t.Fatalf("Expected no staging store, got %v", err)
+	}
+	if _, err = Put(strings.NewReader("epub"), ".epub"); err != ErrDisabled {
+		t.Errorf("Expected the staging store to be disabled, got %v", err)
+	}
+	if err = Init(config.Storage{FileSystem: config.FileSystem{Directory: dir}}); err != nil || !Enabled() {
+		t.Fatalf("Expected a staging store, got %v", err)
+	}
+
+	// a local file moved to the staging store, read through a temporary copy
+	local := filepath.Join(dir, "upload.epub")
+	if err = ioutil.WriteFile(local, []byte("epub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	location, err := PutFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location, Scheme) || !strings.HasSuffix(location, ".epub") {
+		t.Errorf("Expected a staged epub file, got %s", location)
+	}
+	if _, err = os.Stat(local); !os.IsNotExist(err) {
+		t.Error("Expected the local file to be removed")
+	}
+	f, err := Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(f); string(b) != "epub" || !strings.HasSuffix(f.Name(), ".epub") {
+		t.Errorf("Expected a copy of the epub file, got %s in %s", b, f.Name())
+	}
+	Close(location, f)
+	if _, err = os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Error("Expected the copy to be removed")
+	}
+	if err = Remove(location); err != nil {
+		t.Error(err)
+	}
+	if _, err = Open(location); err == nil {
+		t.Error("Expected the staged file to be removed")
+	}
+
+	// a file given by an url
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/files/book.epub" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("encrypted"))
+	}))
+	defer ts.Close()
+	// only the configured hosts are allowed
+	if _, err = Open(ts.URL + "/files/book.epub"); err == nil {
+		t.Fatal("Expected the download to be refused")
+	}
+	if err = Init(config.Storage{DownloadHosts: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer Init(config.Storage{})
+	f, err = Open(ts.URL + "/files/book.epub?sig=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(f); string(b) != "encrypted" || !strings.HasSuffix(f.Name(), ".epub") {
+		t.Errorf("Expected a copy of the downloaded file, got %s in %s", b, f.Name())
+	}
+	Close(ts.URL+"/files/book.epub", f)
+	if _, err = Open(ts.URL + "/files/missing.epub"); err == nil {
+		t.Error("Expected the download to fail")
+	}
+	// a file larger than the maximum size is refused
+	if err = Init(config.Storage{DownloadHosts: []string{"127.0.0.1"}, MaxDownloadSize: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(ts.URL + "/files/book.epub"); err != ErrTooLarge {
+		t.Errorf("Expected the download to be too large, got %v", err)
+	}
+}
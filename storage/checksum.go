@@ -0,0 +1,135 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// ErrChecksumMismatch is returned when the SHA-256 of a file is not the expected one
+var ErrChecksumMismatch = errors.New("The checksum of the file does not match its expected value")
+
+// Corrupted counts the files whose checksum did not match, per operation (upload, download, archive)
+var Corrupted = expvar.NewMap("storage_checksum_mismatches")
+
+// Checksum returns the hex encoded SHA-256 of a file, then rewinds it
+func Checksum(r io.ReadSeeker) (string, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// AddVerified adds a file to a store if its SHA-256 is the expected one (not checked if empty);
+// op names the operation counted by Corrupted on a mismatch
+//
+func AddVerified(s Store, key string, r io.ReadSeeker, expected string, op string) (Item, error) {
+	if expected != "" {
+		sum, err := Checksum(r)
+		if err != nil {
+			return nil, wrap("add", key, err)
+		}
+		if !strings.EqualFold(sum, expected) {
+			Corrupted.Add(op, 1)
+			return nil, ErrChecksumMismatch
+		}
+	}
+	return s.Add(key, r)
+}
+
+// Verify reads a stored item and checks that its SHA-256 is the expected one (not checked if empty),
+// e.g. before the item is read at random positions; op names the operation counted by Corrupted on a mismatch
+//
+func Verify(item Item, expected string, op string) error {
+	if expected == "" {
+		return nil
+	}
+	contents, err := item.Contents()
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+	_, err = io.Copy(ioutil.Discard, NewVerifyingReader(contents, expected))
+	if err == ErrChecksumMismatch {
+		Corrupted.Add(op, 1)
+	}
+	return err
+}
+
+// verifyingReader computes the SHA-256 of the data read; the last byte is held back
+// until the end of the data is reached and the checksum verified, so that a corrupted
+// file is never read completely
+type verifyingReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected string
+	last     byte
+	held     bool
+	err      error
+}
+
+// NewVerifyingReader returns a reader which fails with ErrChecksumMismatch at the end
+// of the data if its SHA-256 is not the expected one (not checked if empty)
+//
+func NewVerifyingReader(r io.Reader, expected string) io.Reader {
+	if expected == "" {
+		return r
+	}
+	return &verifyingReader{r: r, hash: sha256.New(), expected: expected}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if v.err != nil {
+		// the byte held back is returned once the checksum is verified
+		if v.err == io.EOF && v.held {
+			p[0], v.held = v.last, false
+			return 1, io.EOF
+		}
+		return 0, v.err
+	}
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	read := 0
+	if n > 0 {
+		last := p[n-1]
+		if v.held {
+			copy(p[1:n], p[:n-1])
+			p[0] = v.last
+			read = n
+		} else {
+			read = n - 1
+		}
+		v.last, v.held = last, true
+	}
+	switch {
+	case err == io.EOF && !strings.EqualFold(hex.EncodeToString(v.hash.Sum(nil)), v.expected):
+		v.err = ErrChecksumMismatch
+		return read, v.err
+	case err != nil:
+		v.err = err
+		if err == io.EOF {
+			return read, nil
+		}
+		return read, err
+	}
+	return read, nil
+}
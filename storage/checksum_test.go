@@ -0,0 +1,85 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+	"testing/iotest"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	data := []byte("the encrypted publication")
+	sum := sha256.Sum256(data)
+	expected := hex.EncodeToString(sum[:])
+
+	// the data is returned unchanged, whatever the size of the reads
+	res, err := ioutil.ReadAll(NewVerifyingReader(iotest.OneByteReader(bytes.NewReader(data)), expected))
+	if err != nil || !bytes.Equal(res, data) {
+		t.Errorf("Expected the data to be read, got %q (%v)", res, err)
+	}
+	res, err = ioutil.ReadAll(NewVerifyingReader(iotest.DataErrReader(bytes.NewReader(data)), expected))
+	if err != nil || !bytes.Equal(res, data) {
+		t.Errorf("Expected the data to be read, got %q (%v)", res, err)
+	}
+
+	// a corrupted file is never read completely
+	corrupted := append([]byte{}, data...)
+	corrupted[3] = 'X'
+	res, err = ioutil.ReadAll(NewVerifyingReader(bytes.NewReader(corrupted), expected))
+	if err != ErrChecksumMismatch || len(res) >= len(data) {
+		t.Errorf("Expected a checksum mismatch, got %d bytes (%v)", len(res), err)
+	}
+}
+
+func TestAddVerified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcp_checksum_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileSystem(dir, "http://localhost/assets")
+	data := []byte("the encrypted publication")
+	sum := sha256.Sum256(data)
+
+	if _, err := AddVerified(store, "good", bytes.NewReader(data), hex.EncodeToString(sum[:]), "upload"); err != nil {
+		t.Error(err)
+	}
+	if _, err := AddVerified(store, "bad", bytes.NewReader(data), "0123", "upload"); err != ErrChecksumMismatch {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+	if _, err := store.Get("bad"); err != ErrNotFound {
+		t.Errorf("Expected the corrupted file not to be stored, got %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcp_checksum_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileSystem(dir, "http://localhost/assets")
+	data := []byte("the encrypted publication")
+	sum := sha256.Sum256(data)
+	item, err := store.Add("c1", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Verify(item, hex.EncodeToString(sum[:]), "download"); err != nil {
+		t.Error(err)
+	}
+	if err = Verify(item, "", "download"); err != nil {
+		t.Error(err)
+	}
+	if err = Verify(item, "0123", "download"); err != ErrChecksumMismatch {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+}
@@ -27,7 +27,6 @@ package storage
 
 import (
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 )
@@ -52,20 +51,47 @@ func (i fsItem) PublicURL() string {
 }
 
 func (i fsItem) Contents() (io.ReadCloser, error) {
-	return os.Open(filepath.Join(i.storageDir, i.name))
-	// FIXME: process errors
+	file, err := os.Open(filepath.Join(i.storageDir, i.name))
+	if err != nil {
+		return nil, wrap("read", i.name, err)
+	}
+	return file, nil
+}
+
+// ContentsRange returns length bytes of the item, from start
+func (i fsItem) ContentsRange(start int64, length int64) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(i.storageDir, i.name))
+	if err != nil {
+		return nil, wrap("read", i.name, err)
+	}
+	if _, err = file.Seek(start, io.SeekStart); err != nil {
+		file.Close()
+		return nil, wrap("read", i.name, err)
+	}
+	return rangeReadCloser{io.LimitReader(file, length), file}, nil
+}
+
+// rangeReadCloser reads a part of a file and closes the file
+type rangeReadCloser struct {
+	io.Reader
+	io.Closer
 }
 
 func (s fsStorage) Add(key string, r io.ReadSeeker) (Item, error) {
+	// the key may hold a folder, e.g. a tenant prefix
+	err := os.MkdirAll(filepath.Dir(filepath.Join(s.fspath, key)), os.ModePerm)
+	if err != nil {
+		return nil, wrap("add", key, err)
+	}
 	file, err := os.Create(filepath.Join(s.fspath, key))
 	if err != nil {
-		return nil, err
+		return nil, wrap("add", key, err)
 	}
 	defer file.Close()
-	io.Copy(file, r)
+	_, err = io.Copy(file, r)
 
 	if err != nil {
-		return nil, err
+		return nil, wrap("add", key, err)
 	}
 	return &fsItem{name: key, storageDir: s.fspath, baseURL: s.url}, nil
 }
@@ -76,29 +102,33 @@ func (s fsStorage) Add(key string, r io.ReadSeeker) (Item, error) {
 func (s fsStorage) Get(key string) (Item, error) {
 	_, err := os.Stat(filepath.Join(s.fspath, key))
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, ErrNotFound
-		}
-		return nil, err
+		return nil, wrap("get", key, err)
 	}
 	return &fsItem{name: key, storageDir: s.fspath, baseURL: s.url}, nil
 }
 
 
 func (s fsStorage) Remove(key string) error {
-	return os.Remove(filepath.Join(s.fspath, key))
+	return wrap("remove", key, os.Remove(filepath.Join(s.fspath, key)))
 }
 
 func (s fsStorage) List() ([]Item, error) {
 	var items []Item
 
-	files, err := ioutil.ReadDir(s.fspath)
+	// the files of the folders are listed too, e.g. the files of the tenants
+	err := filepath.Walk(s.fspath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(s.fspath, p)
+		if err != nil {
+			return err
+		}
+		items = append(items, &fsItem{name: filepath.ToSlash(name), storageDir: s.fspath, baseURL: s.url})
+		return nil
+	})
 	if err != nil {
-		return nil, err
-	}
-
-	for _, fi := range files {
-		items = append(items, &fsItem{name: fi.Name(), storageDir: s.fspath, baseURL: s.url})
+		return nil, wrap("list", "", err)
 	}
 
 	return items, nil
@@ -28,16 +28,62 @@ package storage
 import (
 	"errors"
 	"io"
+	"os"
+	"time"
 )
 
 // ErrNotFound is not found
 var ErrNotFound = errors.New("Item could not be found")
 
+// ErrStorage is the kind of the errors of the storage backend, which are wrapped in an Error
+var ErrStorage = errors.New("Storage error")
+
+// Error is an error of the storage backend on an item
+type Error struct {
+	Op  string
+	Key string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Op + " " + e.Key + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error of the storage backend
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is checks if the error is of kind ErrStorage
+func (e *Error) Is(target error) bool {
+	return target == ErrStorage
+}
+
+// wrap returns the error of an operation on an item: ErrNotFound if the item does not exist,
+// else an Error
+func wrap(op string, key string, err error) error {
+	var storageErr *Error
+	switch {
+	case err == nil || err == ErrNotFound || errors.As(err, &storageErr):
+		return err
+	case os.IsNotExist(err) || isS3NotFound(err):
+		return ErrNotFound
+	}
+	return &Error{Op: op, Key: key, Err: err}
+}
+
 // Item interface
 type Item interface {
 	Key() string
 	PublicURL() string
 	Contents() (io.ReadCloser, error)
+	ContentsRange(start int64, length int64) (io.ReadCloser, error)
+}
+
+// Presigner is implemented by the items of cloud storages
+// which can be downloaded directly with a time-limited url
+type Presigner interface {
+	PresignedURL(ttl time.Duration) (string, error)
 }
 
 // Store interface
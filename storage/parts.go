@@ -0,0 +1,339 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// partsSuffix is the suffix of the key of the manifest of an item stored in parts
+const partsSuffix = ".parts"
+
+// partedStore splits the large items in parts, stored as separate objects of the store,
+// e.g. to stay under the maximum size of an object in some storage backends.
+// The parts of an item are listed in a manifest, stored under the key of the item followed by ".parts";
+// the item is read as a single object, reassembled from its parts.
+type partedStore struct {
+	Store
+	partSize int64
+	// split checks if the items of a key may be stored in parts, all the items if nil
+	split func(key string) bool
+}
+
+// manifest lists the parts of an item, in order
+type manifest struct {
+	Length int64  `json:"length"`
+	Parts  []part `json:"parts"`
+}
+
+type part struct {
+	Key    string `json:"key"`
+	Length int64  `json:"length"`
+}
+
+// WithParts returns a view of a store where the items larger than partSize bytes are stored in parts.
+// The items already stored in parts are read whatever the part size, even 0 (no item is split).
+func WithParts(s Store, partSize int64) Store {
+	return partedStore{Store: s, partSize: partSize}
+}
+
+// WithPartsWhen is WithParts for the keys accepted by split only, e.g. to roll out the storage in parts;
+// the other items are stored as single objects, and the items already stored in parts are still read.
+func WithPartsWhen(s Store, partSize int64, split func(key string) bool) Store {
+	return partedStore{Store: s, partSize: partSize, split: split}
+}
+
+// PartKey returns the key of a part of an item, numbered from 1
+func PartKey(key string, n int) string {
+	return key + ".part" + strconv.Itoa(n)
+}
+
+// isPartKey checks if a key is the key of a part of an item
+func isPartKey(key string) bool {
+	pos := strings.LastIndex(key, ".part")
+	if pos <= 0 {
+		return false
+	}
+	n, err := strconv.Atoi(key[pos+5:])
+	return err == nil && n > 0
+}
+
+func (s partedStore) Add(key string, r io.ReadSeeker) (Item, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = r.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return nil, wrap("add", key, err)
+	}
+	prev, _ := s.manifest(key)
+	if s.partSize <= 0 || size <= s.partSize || s.split != nil && !s.split(key) {
+		item, err := s.Store.Add(key, r)
+		if err == nil && prev != nil {
+			// the item replaces an item stored in parts
+			s.removeParts(key, prev, 0)
+		}
+		return item, err
+	}
+
+	m := &manifest{Length: size}
+	for offset, n := int64(0), 1; offset < size; offset, n = offset+s.partSize, n+1 {
+		length := s.partSize
+		if offset+length > size {
+			length = size - offset
+		}
+		p := part{Key: PartKey(key, n), Length: length}
+		if _, err = s.Store.Add(p.Key, &sectionSeeker{r: r, base: offset, size: length}); err != nil {
+			return nil, err
+		}
+		m.Parts = append(m.Parts, p)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, wrap("add", key, err)
+	}
+	if _, err = s.Store.Add(key+partsSuffix, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	// the item replaces an item stored as a single object, or in more parts
+	if err = s.Store.Remove(key); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if prev != nil {
+		s.removeParts(key, prev, len(m.Parts))
+	}
+	return &partedItem{store: s, key: key, m: m}, nil
+}
+
+// Get returns an item stored as a single object, or in parts
+func (s partedStore) Get(key string) (Item, error) {
+	item, err := s.Store.Get(key)
+	if !errors.Is(err, ErrNotFound) {
+		return item, err
+	}
+	m, err := s.manifest(key)
+	if err != nil {
+		return nil, err
+	}
+	return &partedItem{store: s, key: key, m: m}, nil
+}
+
+// Remove removes an item and its parts
+func (s partedStore) Remove(key string) error {
+	m, merr := s.manifest(key)
+	err := s.Store.Remove(key)
+	switch {
+	case merr == nil && (err == nil || errors.Is(err, ErrNotFound)):
+		return s.removeParts(key, m, 0)
+	case errors.Is(err, ErrNotFound) && !errors.Is(merr, ErrNotFound):
+		return merr
+	}
+	return err
+}
+
+// List lists the items, an item stored in parts once
+func (s partedStore) List() ([]Item, error) {
+	items, err := s.Store.List()
+	if err != nil {
+		return nil, err
+	}
+	var listed []Item
+	for _, item := range items {
+		key := item.Key()
+		switch {
+		case strings.HasSuffix(key, partsSuffix):
+			listed = append(listed, &partedItem{store: s, key: strings.TrimSuffix(key, partsSuffix)})
+		case !isPartKey(key):
+			listed = append(listed, item)
+		}
+	}
+	return listed, nil
+}
+
+// manifest reads the manifest of an item stored in parts
+func (s partedStore) manifest(key string) (*manifest, error) {
+	item, err := s.Store.Get(key + partsSuffix)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := item.Contents()
+	if err != nil {
+		return nil, err
+	}
+	defer contents.Close()
+	var m manifest
+	if err = json.NewDecoder(contents).Decode(&m); err != nil {
+		return nil, wrap("read", key+partsSuffix, err)
+	}
+	return &m, nil
+}
+
+// removeParts removes the parts of an item which follow the first ones,
+// and its manifest if all the parts are removed
+func (s partedStore) removeParts(key string, m *manifest, first int) error {
+	var err error
+	for _, p := range m.Parts[first:] {
+		if rerr := s.Store.Remove(p.Key); rerr != nil && !errors.Is(rerr, ErrNotFound) && err == nil {
+			err = rerr
+		}
+	}
+	if first == 0 {
+		if rerr := s.Store.Remove(key + partsSuffix); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// partedItem is an item stored in parts; the manifest of the items listed is read on demand
+type partedItem struct {
+	store partedStore
+	key   string
+	m     *manifest
+}
+
+func (i *partedItem) Key() string {
+	return i.key
+}
+
+// PublicURL is empty, as the item is not stored as a single object
+func (i *partedItem) PublicURL() string {
+	return ""
+}
+
+func (i *partedItem) Contents() (io.ReadCloser, error) {
+	if err := i.load(); err != nil {
+		return nil, err
+	}
+	return i.ContentsRange(0, i.m.Length)
+}
+
+// ContentsRange returns length bytes of the item, from start, read from the parts which hold them
+func (i *partedItem) ContentsRange(start int64, length int64) (io.ReadCloser, error) {
+	if err := i.load(); err != nil {
+		return nil, err
+	}
+	var sections []section
+	offset := int64(0)
+	for _, p := range i.m.Parts {
+		if length > 0 && start < offset+p.Length {
+			n := offset + p.Length - start
+			if n > length {
+				n = length
+			}
+			sections = append(sections, section{key: p.Key, start: start - offset, length: n})
+			start, length = start+n, length-n
+		}
+		offset += p.Length
+	}
+	return &partsReader{store: i.store.Store, sections: sections}, nil
+}
+
+func (i *partedItem) load() error {
+	if i.m != nil {
+		return nil
+	}
+	m, err := i.store.manifest(i.key)
+	if err != nil {
+		return err
+	}
+	i.m = m
+	return nil
+}
+
+// section is a range of bytes of a part
+type section struct {
+	key    string
+	start  int64
+	length int64
+}
+
+// partsReader reads sections of parts in sequence, opening each part when it is reached
+type partsReader struct {
+	store    Store
+	sections []section
+	cur      io.ReadCloser
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.sections) == 0 {
+				return 0, io.EOF
+			}
+			sec := r.sections[0]
+			r.sections = r.sections[1:]
+			item, err := r.store.Get(sec.key)
+			if err != nil {
+				return 0, err
+			}
+			if r.cur, err = item.ContentsRange(sec.start, sec.length); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	return r.cur.Close()
+}
+
+// sectionSeeker reads size bytes of a reader from base, as a ReadSeeker
+type sectionSeeker struct {
+	r    io.ReadSeeker
+	base int64
+	size int64
+	pos  int64
+}
+
+func (s *sectionSeeker) Read(p []byte) (int, error) {
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+	if _, err := s.r.Seek(s.base+s.pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if rest := s.size - s.pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	if err == io.EOF && s.pos < s.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (s *sectionSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("Seek before the start of the section")
+	}
+	s.pos = offset
+	return offset, nil
+}
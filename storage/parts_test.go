@@ -0,0 +1,128 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcp_parts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := NewFileSystem(dir, "http://localhost/files")
+	s := WithParts(fs, 10)
+
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	if _, err = s.Add("c1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	// 4 parts and the manifest, listed as a single item
+	if items, _ := fs.List(); len(items) != 5 {
+		t.Errorf("Expected 5 objects, got %d", len(items))
+	}
+	if items, _ := s.List(); len(items) != 1 || items[0].Key() != "c1" {
+		t.Errorf("Expected the item to be listed once, got %v", items)
+	}
+
+	item, err := s.Get("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := item.Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, _ := ioutil.ReadAll(contents)
+	contents.Close()
+	if !bytes.Equal(read, data) {
+		t.Errorf("Expected the item to be reassembled, got %s", read)
+	}
+	// a range over several parts
+	if contents, err = item.ContentsRange(8, 15); err != nil {
+		t.Fatal(err)
+	}
+	read, _ = ioutil.ReadAll(contents)
+	contents.Close()
+	if string(read) != "89abcdefghijklm" {
+		t.Errorf("Unexpected range %s", read)
+	}
+
+	// a smaller file replaces the parts
+	if _, err = s.Add("c1", bytes.NewReader([]byte("small"))); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := fs.List(); len(items) != 1 {
+		t.Errorf("Expected the parts to be removed, got %d objects", len(items))
+	}
+	if _, err = s.Add("c1", bytes.NewReader(data[:25])); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Remove("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := fs.List(); len(items) != 0 {
+		t.Errorf("Expected all the objects to be removed, got %d", len(items))
+	}
+	if _, err = s.Get("c1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the item not to be found, got %v", err)
+	}
+}
+
+func TestPartsWhen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcp_parts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := NewFileSystem(dir, "http://localhost/files")
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	if _, err = WithParts(fs, 10).Add("a/c1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys which are not accepted are stored as single objects
+	s := WithPartsWhen(fs, 10, func(key string) bool { return key[:2] == "a/" })
+	if _, err = s.Add("b/c2", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Get("b/c2"); err != nil {
+		t.Errorf("Expected a single object, got %v", err)
+	}
+	if _, err = s.Add("a/c3", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Get("a/c3" + partsSuffix); err != nil {
+		t.Errorf("Expected the item to be stored in parts, got %v", err)
+	}
+
+	// the items already stored in parts are read, and replaced by a single object
+	s = WithPartsWhen(fs, 10, func(key string) bool { return false })
+	item, err := s.Get("a/c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := item.Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, _ := ioutil.ReadAll(contents)
+	contents.Close()
+	if !bytes.Equal(read, data) {
+		t.Errorf("Expected the item to be reassembled, got %s", read)
+	}
+	if _, err = s.Add("a/c1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Get("a/c1" + partsSuffix); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the parts to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"io"
+	"strings"
+)
+
+// prefixStore stores the items under a key prefix, e.g. a folder per tenant
+type prefixStore struct {
+	Store
+	prefix string
+}
+
+// WithPrefix returns a view of a store where the keys of the items are prefixed;
+// only the items with this prefix are listed.
+func WithPrefix(s Store, prefix string) Store {
+	if prefix == "" {
+		return s
+	}
+	return prefixStore{Store: s, prefix: prefix}
+}
+
+func (s prefixStore) Add(key string, r io.ReadSeeker) (Item, error) {
+	return s.Store.Add(s.prefix+key, r)
+}
+
+func (s prefixStore) Get(key string) (Item, error) {
+	return s.Store.Get(s.prefix + key)
+}
+
+func (s prefixStore) Remove(key string) error {
+	return s.Store.Remove(s.prefix + key)
+}
+
+func (s prefixStore) List() ([]Item, error) {
+	items, err := s.Store.List()
+	if err != nil {
+		return nil, err
+	}
+	var filtered []Item
+	for _, item := range items {
+		if strings.HasPrefix(item.Key(), s.prefix) {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered, nil
+}
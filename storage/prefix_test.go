@@ -0,0 +1,76 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPrefixStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcp_prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := NewFileSystem(dir, "")
+	t1, t2 := WithPrefix(fs, "t1/"), WithPrefix(fs, "t2/")
+
+	// the same key is another file for each tenant
+	if _, err = t1.Add("c1", strings.NewReader("t1 file")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = t2.Add("c1", strings.NewReader("t2 file")); err != nil {
+		t.Fatal(err)
+	}
+	read := func(s Store, key string) string {
+		item, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := item.Contents()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		b, _ := ioutil.ReadAll(rc)
+		return string(b)
+	}
+	if b := read(t1, "c1"); b != "t1 file" {
+		t.Errorf("Expected the file of the tenant, got %s", b)
+	}
+
+	// a tenant only lists its files
+	if _, err = t2.Add("c2", strings.NewReader("t2 file")); err != nil {
+		t.Fatal(err)
+	}
+	items, err := t1.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Key() != "t1/c1" {
+		t.Errorf("Expected the file of the tenant only, got %d files", len(items))
+	}
+	if _, err = t1.Get("c2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the file of another tenant not to be found, got %v", err)
+	}
+
+	// a tenant does not remove the files of another tenant
+	if err = t2.Remove("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if b := read(t1, "c1"); b != "t1 file" {
+		t.Errorf("Expected the file of the tenant to be kept, got %s", b)
+	}
+	if err = t1.Remove("c2"); err == nil {
+		t.Error("Expected the file of another tenant not to be removed")
+	}
+	if b := read(t2, "c2"); b != "t2 file" {
+		t.Errorf("Expected the file of the other tenant to be kept, got %s", b)
+	}
+}
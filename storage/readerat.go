@@ -0,0 +1,63 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"io"
+)
+
+// readAheadSize is the size of the blocks read from the storage by a ReaderAt
+const readAheadSize = 1 << 20
+
+// itemReaderAt reads an item by blocks of its contents, so that the small sequential reads
+// of a zip reader do not each make a request to the storage
+type itemReaderAt struct {
+	item  Item
+	size  int64
+	start int64
+	block []byte
+}
+
+// NewReaderAt returns a ReaderAt of an item of the given size, e.g. to read a stored zip file
+// without loading it in memory. It must not be used concurrently.
+func NewReaderAt(item Item, size int64) io.ReaderAt {
+	return &itemReaderAt{item: item, size: size}
+}
+
+func (r *itemReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+		if pos < r.start || pos >= r.start+int64(len(r.block)) {
+			if err := r.fill(pos); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], r.block[pos-r.start:])
+	}
+	return n, nil
+}
+
+// fill reads the block which starts at pos
+func (r *itemReaderAt) fill(pos int64) error {
+	length := int64(readAheadSize)
+	if pos+length > r.size {
+		length = r.size - pos
+	}
+	contents, err := r.item.ContentsRange(pos, length)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+	block := make([]byte, length)
+	if _, err = io.ReadFull(contents, block); err != nil {
+		return wrap("read", r.item.Key(), err)
+	}
+	r.start, r.block = pos, block
+	return nil
+}
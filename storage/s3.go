@@ -28,8 +28,10 @@ package storage
 import (
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -59,8 +61,32 @@ func (i s3item) Contents() (io.ReadCloser, error) {
 		Bucket: aws.String(i.store.bucket),
 		Key:    aws.String(i.key),
 	})
+	if err != nil {
+		return nil, wrap("read", i.key, err)
+	}
+	return resp.Body, nil
+}
 
-	return resp.Body, err
+// ContentsRange returns length bytes of the item, from start
+func (i s3item) ContentsRange(start int64, length int64) (io.ReadCloser, error) {
+	resp, err := i.store.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(i.store.bucket),
+		Key:    aws.String(i.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, start+length-1)),
+	})
+	if err != nil {
+		return nil, wrap("read", i.key, err)
+	}
+	return resp.Body, nil
+}
+
+// PresignedURL returns a url of the item, valid for the given duration
+func (i s3item) PresignedURL(ttl time.Duration) (string, error) {
+	req, _ := i.store.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(i.store.bucket),
+		Key:    aws.String(i.key),
+	})
+	return req.Presign(ttl)
 }
 
 func (s *s3store) Add(key string, r io.ReadSeeker) (Item, error) {
@@ -72,7 +98,7 @@ func (s *s3store) Add(key string, r io.ReadSeeker) (Item, error) {
 
 	item := s3item{bucket: s.bucket, key: key, store: s}
 
-	return item, err
+	return item, wrap("add", key, err)
 }
 
 func (s *s3store) Get(key string) (Item, error) {
@@ -80,7 +106,10 @@ func (s *s3store) Get(key string) (Item, error) {
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	})
-	return s3item{bucket: s.bucket, key: key, store: s}, err
+	if err != nil {
+		return nil, wrap("get", key, err)
+	}
+	return s3item{bucket: s.bucket, key: key, store: s}, nil
 }
 
 func (s *s3store) Remove(key string) error {
@@ -89,7 +118,7 @@ func (s *s3store) Remove(key string) error {
 		Key:    aws.String(key),
 	})
 
-	return err
+	return wrap("remove", key, err)
 }
 
 func (s *s3store) List() ([]Item, error) {
@@ -98,7 +127,7 @@ func (s *s3store) List() ([]Item, error) {
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, wrap("list", "", err)
 	}
 
 	var items []Item
@@ -110,6 +139,15 @@ func (s *s3store) List() ([]Item, error) {
 	return items, nil
 }
 
+// isS3NotFound checks if an error of S3 means that an object does not exist;
+// HeadObject returns a NotFound error without body
+func isS3NotFound(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound"
+	}
+	return false
+}
+
 // S3Config structure
 type S3Config struct {
 	Bucket   string
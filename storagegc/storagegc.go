@@ -0,0 +1,159 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package storagegc compares the files of the storage with the content index:
+// it reports the contents whose file is missing, and deletes the encrypted files
+// which have no content record. The counts are exposed on /debug/vars.
+package storagegc
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/storage"
+)
+
+// DefaultInterval is the delay between two runs of the collector, if none is configured
+const DefaultInterval = 24 * time.Hour
+
+// Metrics are the results of the last run (orphaned_files, missing_files)
+// and the number of files deleted since the start of the server (deleted_files)
+var Metrics = expvar.NewMap("storage_gc")
+
+// Source gives access to the contents and files of a License Server, or of one of its tenants
+type Source interface {
+	Index() index.Index
+	Store() storage.Store
+}
+
+// Report is the result of a run of the collector
+type Report struct {
+	Files    int `json:"files"`
+	Contents int `json:"contents"`
+	// the files without content record
+	OrphanedFiles []string `json:"orphaned_files"`
+	// the contents without file
+	MissingFiles []string `json:"missing_files"`
+	// the orphaned files deleted by this run
+	Deleted []string `json:"deleted"`
+}
+
+// Collector deletes the orphaned files. A file is only deleted if it was already orphaned
+// at the previous run, so that a file stored just before its content record is never deleted.
+type Collector struct {
+	src       Source
+	forTenant func(tenant string) Source
+	// the orphaned files found by the previous run
+	candidates map[string]bool
+}
+
+// New returns a collector of the files of a source; forTenant returns the view of a tenant,
+// whose files are stored under its own prefix
+//
+func New(src Source, forTenant func(tenant string) Source) *Collector {
+	return &Collector{src: src, forTenant: forTenant, candidates: make(map[string]bool)}
+}
+
+// RunOnce compares the storage with the index and deletes the files found orphaned by this run
+// and the previous one; in dry-run mode, the files are only reported.
+//
+func (c *Collector) RunOnce(dryRun bool) (Report, error) {
+	report := Report{OrphanedFiles: []string{}, MissingFiles: []string{}, Deleted: []string{}}
+
+	// the files are listed first: a file stored after the listing of the contents
+	// is not reported as orphaned
+	items, err := c.src.Store().List()
+	if err != nil {
+		return report, err
+	}
+	report.Files = len(items)
+
+	contents := make(map[string]bool)
+	fn := c.src.Index().List()
+	content, err := fn()
+	for ; err == nil; content, err = fn() {
+		contents[content.Id] = true
+		report.Contents++
+		if _, err := c.forTenant(content.Tenant).Store().Get(content.Id); errors.Is(err, storage.ErrNotFound) {
+			report.MissingFiles = append(report.MissingFiles, content.Id)
+		}
+	}
+	if !errors.Is(err, index.ErrNotFound) {
+		return report, err
+	}
+
+	candidates := make(map[string]bool)
+	for _, item := range items {
+		key := item.Key()
+		if c.known(path.Base(key), contents) {
+			continue
+		}
+		report.OrphanedFiles = append(report.OrphanedFiles, key)
+		if dryRun || !c.candidates[key] {
+			candidates[key] = true
+			continue
+		}
+		if err := c.src.Store().Remove(key); err != nil {
+			log.Println("Storage GC: error deleting " + key + ": " + err.Error())
+			candidates[key] = true
+			continue
+		}
+		report.Deleted = append(report.Deleted, key)
+	}
+	c.candidates = candidates
+
+	setMetric("orphaned_files", len(report.OrphanedFiles))
+	setMetric("missing_files", len(report.MissingFiles))
+	Metrics.Add("deleted_files", int64(len(report.Deleted)))
+	return report, nil
+}
+
+// known checks if a file is the file of a content, or of a previous version of a content
+func (c *Collector) known(key string, contents map[string]bool) bool {
+	if contents[key] {
+		return true
+	}
+	id, version, ok := index.ParseVersionKey(key)
+	if !ok || !contents[id] {
+		return false
+	}
+	content, err := c.src.Index().GetVersion(id, version)
+	return err == nil && content.Archived
+}
+
+func setMetric(name string, value int) {
+	v := new(expvar.Int)
+	v.Set(int64(value))
+	Metrics.Set(name, v)
+}
+
+// Run runs the collector at startup, then periodically; it never returns
+//
+func (c *Collector) Run(interval time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	for {
+		report, err := c.RunOnce(dryRun)
+		if err != nil {
+			log.Println("Storage GC: " + err.Error())
+		} else {
+			log.Println("Storage GC: " + strconv.Itoa(len(report.OrphanedFiles)) + " orphaned files, " +
+				strconv.Itoa(len(report.Deleted)) + " deleted, " + strconv.Itoa(len(report.MissingFiles)) + " contents without file")
+		}
+		<-ticker.C
+	}
+}
+
+// Interval returns the configured interval between two runs
+func Interval(c config.StorageGC) time.Duration {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval) * time.Hour
+	}
+	return DefaultInterval
+}
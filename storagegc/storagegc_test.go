@@ -0,0 +1,87 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storagegc
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/storage"
+)
+
+type source struct {
+	idx   index.Index
+	store storage.Store
+}
+
+func (s source) Index() index.Index   { return s.idx }
+func (s source) Store() storage.Store { return s.store }
+func (s source) forTenant(tenant string) Source {
+	return source{index.ForTenant(s.idx, tenant), storage.WithPrefix(s.store, tenant+"/")}
+}
+
+func TestCollector(t *testing.T) {
+	config.Config.LcpServer.Database = "sqlite3://:memory:"
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	dir, err := ioutil.TempDir("", "lcp_storagegc_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var src source
+	if src.idx, err = index.Open(db); err != nil {
+		t.Fatal(err)
+	}
+	src.store = storage.NewFileSystem(dir, "http://localhost/assets")
+	// a content of a tenant, a previous version, a content without file and an orphaned file
+	src.idx.Add(index.Content{Id: "c1", EncryptionKey: []byte("key1"), Location: "c1.epub", Tenant: "t1"})
+	c, _ := src.idx.Get("c1")
+	c.EncryptionKey = []byte("key2")
+	src.idx.Update(c)
+	src.idx.Add(index.Content{Id: "c2", EncryptionKey: []byte("key"), Location: "c2.epub"})
+	for _, key := range []string{"t1/c1", "t1/c1.v1", "orphan", "c2.v1"} {
+		if _, err = src.store.Add(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	collector := New(src, src.forTenant)
+	report, err := collector.RunOnce(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 4 || report.Contents != 2 || !reflect.DeepEqual(report.MissingFiles, []string{"c2"}) ||
+		!reflect.DeepEqual(report.OrphanedFiles, []string{"c2.v1", "orphan"}) || len(report.Deleted) != 0 {
+		t.Errorf("Unexpected first report %+v", report)
+	}
+
+	// the files orphaned at the previous run are deleted, except in dry-run mode
+	if report, err = collector.RunOnce(true); err != nil || len(report.Deleted) != 0 {
+		t.Errorf("Expected no file to be deleted in dry-run mode, got %+v (%v)", report, err)
+	}
+	if report, err = collector.RunOnce(false); err != nil || !reflect.DeepEqual(report.Deleted, []string{"c2.v1", "orphan"}) {
+		t.Errorf("Expected the orphaned files to be deleted, got %+v (%v)", report, err)
+	}
+	if _, err = src.store.Get("orphan"); err != storage.ErrNotFound {
+		t.Errorf("Expected the orphaned file to be deleted, got %v", err)
+	}
+	if _, err = src.store.Get("t1/c1.v1"); err != nil {
+		t.Errorf("Expected the file of the previous version to be kept, got %v", err)
+	}
+}
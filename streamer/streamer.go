@@ -0,0 +1,174 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package streamer gives access to the resources of a protected publication
+// (EPUB or Readium Web Publication package), decrypted on the fly with its content key.
+// It is meant to be used by trusted services only: the content key never leaves the server.
+package streamer
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"path"
+	"sort"
+
+	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/pack"
+	"github.com/readium/readium-lcp-server/rwpm"
+)
+
+// ErrResourceNotFound is returned when a resource is not in the publication
+var ErrResourceNotFound = errors.New("Resource not found in the publication")
+
+// ErrUnknownFormat is returned when a package is neither an EPUB nor a Web Publication
+var ErrUnknownFormat = errors.New("Unknown publication format")
+
+// Resource describes a resource of a protected publication
+type Resource struct {
+	Path        string
+	ContentType string
+	Encrypted   bool
+	Compressed  bool
+	file        *zip.File
+}
+
+// Publication is a protected publication opened for streaming
+type Publication struct {
+	key       crypto.ContentKey
+	resources map[string]*Resource
+}
+
+// Open opens a protected publication, which must be an EPUB
+// or a packaged Readium Web Publication
+func Open(zr *zip.Reader, key crypto.ContentKey) (*Publication, error) {
+	p := &Publication{key: key, resources: make(map[string]*Resource)}
+	for _, file := range zr.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		p.resources[file.Name] = &Resource{
+			Path:        file.Name,
+			ContentType: mime.TypeByExtension(path.Ext(file.Name)),
+			file:        file,
+		}
+	}
+
+	if _, ok := p.resources[epub.ContainerFile]; ok {
+		return p, p.readEpub(zr)
+	}
+	if _, ok := p.resources[pack.MANIFEST_LOCATION]; ok {
+		return p, p.readWebPub()
+	}
+	return nil, ErrUnknownFormat
+}
+
+// readEpub gets the encryption and compression of the resources
+// from the encryption file of an EPUB, and their media type from the package
+func (p *Publication) readEpub(zr *zip.Reader) error {
+	ep, err := epub.Read(zr)
+	if err != nil {
+		return err
+	}
+	for _, r := range ep.Resource {
+		res, ok := p.resources[r.Path]
+		if !ok {
+			continue
+		}
+		if r.ContentType != "" {
+			res.ContentType = r.ContentType
+		}
+		if ep.Encryption == nil {
+			continue
+		}
+		if data, ok := ep.Encryption.DataForFile(r.Path); ok && !data.IsObfuscation() {
+			res.Encrypted = true
+			res.Compressed = r.Compressed
+		}
+	}
+	return nil
+}
+
+// readWebPub gets the encryption and compression of the resources
+// from the manifest of a Web Publication
+func (p *Publication) readWebPub() error {
+	rc, err := p.resources[pack.MANIFEST_LOCATION].file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var manifest rwpm.Publication
+	err = json.NewDecoder(rc).Decode(&manifest)
+	if err != nil {
+		return err
+	}
+	links := append(append([]rwpm.Link{}, manifest.ReadingOrder...), manifest.Resources...)
+	for _, link := range links {
+		res, ok := p.resources[link.Href]
+		if !ok {
+			continue
+		}
+		if link.TypeLink != "" {
+			res.ContentType = link.TypeLink
+		}
+		if link.Properties != nil && link.Properties.Encrypted != nil {
+			res.Encrypted = true
+			res.Compressed = link.Properties.Encrypted.Compression == "deflate"
+		}
+	}
+	return nil
+}
+
+// Resource returns the description of a resource of the publication
+func (p *Publication) Resource(path string) (*Resource, bool) {
+	res, ok := p.resources[path]
+	return res, ok
+}
+
+// Resources returns the resources of the publication, sorted by path
+func (p *Publication) Resources() []*Resource {
+	list := make([]*Resource, 0, len(p.resources))
+	for _, res := range p.resources {
+		list = append(list, res)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+// Open returns the clear content of a resource of the publication
+func (p *Publication) Open(path string) (*Resource, io.ReadCloser, error) {
+	res, ok := p.resources[path]
+	if !ok {
+		return nil, nil, ErrResourceNotFound
+	}
+	rc, err := res.file.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !res.Encrypted {
+		return res, rc, nil
+	}
+	defer rc.Close()
+
+	decrypter, ok := crypto.NewAESEncrypter_PUBLICATION_RESOURCES().(crypto.Decrypter)
+	if !ok {
+		return nil, nil, errors.New("The encryption algorithm does not support decryption")
+	}
+	var buf bytes.Buffer
+	err = decrypter.Decrypt(p.key, rc, &buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.Compressed {
+		return res, flate.NewReader(&buf), nil
+	}
+	return res, ioutil.NopCloser(&buf), nil
+}
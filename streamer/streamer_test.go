@@ -0,0 +1,107 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package streamer
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/pack"
+)
+
+func readClearResource(t *testing.T, path string) []byte {
+	z, err := zip.OpenReader("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	for _, f := range z.File {
+		if f.Name == path {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+			b, err := ioutil.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+	}
+	t.Fatalf("Could not find %s in the sample", path)
+	return nil
+}
+
+func TestStreamEpub(t *testing.T) {
+	z, err := zip.OpenReader("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	input, err := epub.Read(&z.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	_, key, err := pack.Do(crypto.NewAESEncrypter_PUBLICATION_RESOURCES(), input, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publication, err := Open(zr, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an encrypted and compressed resource
+	htmlPath := "OPS/chapter_001.xhtml"
+	res, rc, err := publication.Open(htmlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Encrypted || !res.Compressed {
+		t.Errorf("Expected %s to be encrypted and compressed", htmlPath)
+	}
+	if res.ContentType != "application/xhtml+xml" {
+		t.Errorf("Unexpected content type %s", res.ContentType)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, readClearResource(t, htmlPath)) {
+		t.Errorf("Expected %s to be decrypted", htmlPath)
+	}
+
+	// a resource in clear
+	opfPath := "OPS/package.opf"
+	res, rc, err = publication.Open(opfPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Encrypted {
+		t.Errorf("Did not expect %s to be encrypted", opfPath)
+	}
+	b, _ = ioutil.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(b, readClearResource(t, opfPath)) {
+		t.Errorf("Expected %s to be unchanged", opfPath)
+	}
+
+	if _, _, err = publication.Open("OPS/missing.xhtml"); err != ErrResourceNotFound {
+		t.Errorf("Expected ErrResourceNotFound, got %v", err)
+	}
+}
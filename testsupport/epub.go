@@ -0,0 +1,139 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package testsupport
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/pack"
+)
+
+// Chapters is the number of chapters of the sample EPUB
+const Chapters = 3
+
+const containerXML = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OPS/package.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`
+
+const packageOPF = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">urn:uuid:4d4e5bb4-9c5e-4a29-9d6f-0a8d9b3b1f7e</dc:identifier>
+    <dc:title>LCP Test Publication</dc:title>
+    <dc:language>en</dc:language>
+    <meta property="dcterms:modified">2020-01-01T00:00:00Z</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+{{items}}  </manifest>
+  <spine>
+{{itemrefs}}  </spine>
+</package>`
+
+const chapterXHTML = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>Chapter {{n}}</title></head>
+<body>
+<h1>Chapter {{n}}</h1>
+{{paragraphs}}</body>
+</html>`
+
+const paragraph = "<p>Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua.</p>\n"
+
+// ChapterPath returns the path in the sample EPUB of a chapter, numbered from 1
+func ChapterPath(n int) string {
+	return "OPS/chapter" + strconv.Itoa(n) + ".xhtml"
+}
+
+// SampleEPUB generates a small clear EPUB 3: a navigation document and a few chapters
+func SampleEPUB() ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	// the mimetype comes first and is stored
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, err
+	}
+	w.Write([]byte(epub.ContentType_EPUB))
+
+	var items, itemrefs, navItems strings.Builder
+	files := map[string]string{epub.ContainerFile: containerXML}
+	for n := 1; n <= Chapters; n++ {
+		id := "chapter" + strconv.Itoa(n)
+		items.WriteString(`    <item id="` + id + `" href="` + id + `.xhtml" media-type="application/xhtml+xml"/>` + "\n")
+		itemrefs.WriteString(`    <itemref idref="` + id + `"/>` + "\n")
+		navItems.WriteString(`<li><a href="` + id + `.xhtml">Chapter ` + strconv.Itoa(n) + "</a></li>\n")
+		chapter := strings.Replace(chapterXHTML, "{{n}}", strconv.Itoa(n), -1)
+		files[ChapterPath(n)] = strings.Replace(chapter, "{{paragraphs}}", strings.Repeat(paragraph, 20*n), 1)
+	}
+	opf := strings.Replace(packageOPF, "{{items}}", items.String(), 1)
+	files["OPS/package.opf"] = strings.Replace(opf, "{{itemrefs}}", itemrefs.String(), 1)
+	files["OPS/nav.xhtml"] = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>Contents</title></head>
+<body><nav epub:type="toc"><ol>
+` + navItems.String() + `</ol></nav></body>
+</html>`
+
+	// a stable order, so that the same EPUB is generated at each run
+	names := []string{epub.ContainerFile, "OPS/package.opf", "OPS/nav.xhtml"}
+	for n := 1; n <= Chapters; n++ {
+		names = append(names, ChapterPath(n))
+	}
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write([]byte(files[name])); err != nil {
+			return nil, err
+		}
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Publication is a protected publication
+type Publication struct {
+	Data       []byte
+	ContentKey crypto.ContentKey
+	Sha256     string // hex encoded hash of Data
+}
+
+// ProtectedEPUB generates the sample EPUB and protects it with a random content key
+func ProtectedEPUB() (Publication, error) {
+	clear, err := SampleEPUB()
+	if err != nil {
+		return Publication{}, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(clear), int64(len(clear)))
+	if err != nil {
+		return Publication{}, err
+	}
+	ep, err := epub.Read(zr)
+	if err != nil {
+		return Publication{}, err
+	}
+	var buf bytes.Buffer
+	_, key, err := pack.Do(crypto.NewAESEncrypter_PUBLICATION_RESOURCES(), ep, &buf)
+	if err != nil {
+		return Publication{}, err
+	}
+	hash := sha256.Sum256(buf.Bytes())
+	return Publication{Data: buf.Bytes(), ContentKey: key, Sha256: hex.EncodeToString(hash[:])}, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// lcpfixtures writes throw-away fixtures for a local development setup:
+// a test CA, a provider certificate issued by it and a sample clear EPUB.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/readium/readium-lcp-server/testsupport"
+)
+
+func run() error {
+	dir := flag.String("dir", ".", "directory where the fixtures are written")
+	provider := flag.String("provider", "http://localhost", "provider of the certificate")
+	days := flag.Int("days", 30, "validity of the certificates, in days")
+	ecdsa := flag.Bool("ecdsa", false, "generates an ECDSA provider certificate instead of an RSA one")
+	flag.Parse()
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+	ca, err := testsupport.NewCA(time.Duration(*days) * 24 * time.Hour)
+	if err != nil {
+		return err
+	}
+	keyType := testsupport.RSA
+	if *ecdsa {
+		keyType = testsupport.ECDSA
+	}
+	cert, err := ca.ProviderCertificate(*provider, keyType)
+	if err != nil {
+		return err
+	}
+	certFile, keyFile, err := testsupport.WriteCertificate(cert, *dir)
+	if err != nil {
+		return err
+	}
+	caFile := filepath.Join(*dir, "ca.pem")
+	if err = ioutil.WriteFile(caFile, ca.PEM(), 0644); err != nil {
+		return err
+	}
+	sample, err := testsupport.SampleEPUB()
+	if err != nil {
+		return err
+	}
+	sampleFile := filepath.Join(*dir, "sample.epub")
+	if err = ioutil.WriteFile(sampleFile, sample, 0644); err != nil {
+		return err
+	}
+
+	fmt.Println("Provider certificate: " + certFile)
+	fmt.Println("Private key: " + keyFile)
+	fmt.Println("Root certificate: " + caFile)
+	fmt.Println("Sample EPUB: " + sampleFile)
+	fmt.Println("Valid until: " + ca.Certificate.NotAfter.UTC().Format(time.RFC3339))
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		os.Exit(1)
+	}
+}
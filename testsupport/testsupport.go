@@ -0,0 +1,213 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package testsupport generates throw-away fixtures at test time: a certificate authority,
+// provider certificates issued by it and protected publications, so that the tests
+// and the local development servers do not depend on certificate files which expire.
+// It must not be used in production: the keys are generated for a single run.
+package testsupport
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"time"
+)
+
+// KeyType is the type of key of a certificate
+type KeyType int
+
+// the types of key of the generated certificates
+const (
+	ECDSA KeyType = iota
+	RSA
+)
+
+// DefaultValidity is the default validity period of the generated certificates, starting one hour ago
+const DefaultValidity = 24 * time.Hour
+
+// CA is a certificate authority, which issues provider certificates
+type CA struct {
+	Certificate *x509.Certificate
+	// CRLDistributionPoint is the url of the revocation list of the authority, set in the certificates it issues
+	CRLDistributionPoint string
+	key                  *ecdsa.PrivateKey
+	serial               int64
+	// certificates of the authorities above an intermediate authority, up to the root
+	issuers [][]byte
+}
+
+// NewCA generates a self-signed certificate authority; the certificates it issues have the same validity.
+// The validity is DefaultValidity if it is not positive.
+func NewCA(validity time.Duration) (*CA, error) {
+	if validity <= 0 {
+		validity = DefaultValidity
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	notBefore := time.Now().Add(-time.Hour).Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "LCP Test Root CA", Organization: []string{"Readium"}},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Certificate: cert, key: key, serial: 1}, nil
+}
+
+// Pool returns a pool made of the certificate of the authority, for the verification of a chain
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// Intermediate generates an intermediate certificate authority, issued by the authority with the same validity.
+// The chains of the certificates it issues include its certificate and the certificates of the authorities above it.
+func (ca *CA) Intermediate(name string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(ca.serial),
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"Readium"}},
+		NotBefore:             ca.Certificate.NotBefore,
+		NotAfter:              ca.Certificate.NotAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	issuers := append([][]byte{ca.Certificate.Raw}, ca.issuers...)
+	return &CA{Certificate: cert, key: key, serial: 1, issuers: issuers}, nil
+}
+
+// PEM returns the certificate of the authority in PEM
+func (ca *CA) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate.Raw})
+}
+
+// ProviderCertificate generates the certificate of a provider, issued by the authority.
+// The chain of the returned certificate is the provider certificate, the certificate of the authority
+// then, for an intermediate authority, the certificates of the authorities above it.
+func (ca *CA) ProviderCertificate(provider string, keyType KeyType) (*tls.Certificate, error) {
+	var key interface{}
+	var public interface{}
+	switch keyType {
+	case ECDSA:
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key, public = k, &k.PublicKey
+	case RSA:
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		key, public = k, &k.PublicKey
+	default:
+		return nil, errors.New("Unknown key type")
+	}
+
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: provider, Organization: []string{"LCP Tests"}},
+		NotBefore:    ca.Certificate.NotBefore,
+		NotAfter:     ca.Certificate.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if ca.CRLDistributionPoint != "" {
+		template.CRLDistributionPoints = []string{ca.CRLDistributionPoint}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, public, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: append([][]byte{der, ca.Certificate.Raw}, ca.issuers...),
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// RevocationList returns a certificate revocation list of the authority in DER, which revokes the given certificates
+// and is updated again after the given delay
+func (ca *CA) RevocationList(nextUpdate time.Duration, revoked ...*tls.Certificate) ([]byte, error) {
+	now := time.Now().Truncate(time.Second)
+	template := &x509.RevocationList{
+		Number:     big.NewInt(now.Unix()),
+		ThisUpdate: now,
+		NextUpdate: now.Add(nextUpdate),
+	}
+	for _, cert := range revoked {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		template.RevokedCertificates = append(template.RevokedCertificates, pkix.RevokedCertificate{SerialNumber: leaf.SerialNumber, RevocationTime: now})
+	}
+	return x509.CreateRevocationList(rand.Reader, template, ca.Certificate, ca.key)
+}
+
+// WriteCertificate writes a certificate chain and its private key in PEM files of a directory,
+// e.g. for the configuration of a License Server; it returns the paths of the files
+func WriteCertificate(cert *tls.Certificate, dir string) (certFile, keyFile string, err error) {
+	var certPEM bytes.Buffer
+	for _, der := range cert.Certificate {
+		pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return "", "", err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "privkey.pem")
+	if err = ioutil.WriteFile(certFile, certPEM.Bytes(), 0644); err != nil {
+		return "", "", err
+	}
+	if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
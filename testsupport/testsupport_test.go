@@ -0,0 +1,95 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package testsupport
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/readium/readium-lcp-server/sign"
+	"github.com/readium/readium-lcp-server/streamer"
+)
+
+func TestProviderCertificate(t *testing.T) {
+	ca, err := NewCA(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keyType := range []KeyType{ECDSA, RSA} {
+		cert, err := ca.ProviderCertificate("provider", keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = cert.Leaf.Verify(x509.VerifyOptions{Roots: ca.Pool()}); err != nil {
+			t.Errorf("Expected the provider certificate to be issued by the CA: %s", err)
+		}
+		sig, err := sign.Sign(cert, map[string]string{"test": "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = sign.Verify(map[string]string{"test": "test"}, sig); err != nil {
+			t.Errorf("Expected a valid signature: %s", err)
+		}
+	}
+
+	// the files are read as the License Server reads its certificate
+	dir, err := ioutil.TempDir("", "testsupport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, err := ca.ProviderCertificate("provider", RSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile, err := WriteCertificate(cert, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Errorf("Could not load the written certificate: %s", err)
+	}
+}
+
+func TestProtectedEPUB(t *testing.T) {
+	pub, err := ProtectedEPUB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(pub.Data), int64(len(pub.Data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := streamer.Open(zr, pub.ContentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n <= Chapters; n++ {
+		res, rc, err := p.Open(ChapterPath(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Encrypted {
+			t.Errorf("Expected %s to be encrypted", res.Path)
+		}
+		if !strings.Contains(string(b), "Lorem ipsum") {
+			t.Errorf("Unexpected content of %s", res.Path)
+		}
+	}
+	if res, _ := p.Resource("OPS/nav.xhtml"); res == nil || res.Encrypted {
+		t.Error("Expected the navigation document to be in clear")
+	}
+}
@@ -7,23 +7,42 @@ package transactions
 
 import (
 	"database/sql"
-	"errors"
 	"log"
-	"strings"
 	"time"
 
 	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/dbutils"
 	"github.com/readium/readium-lcp-server/status"
+	uuid "github.com/satori/go.uuid"
 )
 
-var NotFound = errors.New("Event not found")
+// the errors of the events store; the errors of the database are wrapped in errors of kind ErrStorage,
+// the violations of a unique constraint in errors of kind ErrConflict
+var (
+	ErrNotFound = dbutils.NewError(dbutils.ErrNotFound, "Event not found")
+	ErrConflict = dbutils.NewError(dbutils.ErrConflict, "Event conflict")
+	ErrStorage  = dbutils.NewError(dbutils.ErrStorage, "Event storage error")
+)
+
+// wrap returns the error of an operation of the events store
+func wrap(op string, err error) error {
+	return dbutils.Wrap(op, err, ErrNotFound, ErrConflict, ErrStorage)
+}
 
 type Transactions interface {
 	Get(id int) (Event, error)
 	Add(e Event, eventType int) error
+	AddTx(tx *sql.Tx, e Event, eventType int) error
 	GetByLicenseStatusId(licenseStatusFk int) func() (Event, error)
+	GetArchivedByLicenseStatusId(licenseStatusFk int) func() (Event, error)
 	CheckDeviceStatus(licenseStatusFk int, deviceId string) (string, error)
 	ListRegisteredDevices(licenseStatusFk int) func() (Device, error)
+	ListByLicenseStatusId(licenseStatusFk int, filter EventFilter, limit int64, offset int64) func() (Event, error)
+	Archive(licenseStatusFk int, keep int) error
+	CountByDay(eventType int, from time.Time, to time.Time) func() (DailyCount, error)
+	CountByContent(eventType int, from time.Time, to time.Time) func() (ContentCount, error)
+	AnonymizeEvents(licenseStatusFk int) error
+	PurgeEvents(before time.Time, dryRun bool) (int64, error)
 }
 
 type RegisteredDevicesList struct {
@@ -46,19 +65,66 @@ type Event struct {
 	LicenseStatusFk int       `json:"-"`
 }
 
+// DailyCount is the number of events of a given day
+type DailyCount struct {
+	Day   string `json:"day"`
+	Count int64  `json:"count"`
+}
+
+// ContentCount is the number of events of the licenses of a given content;
+// the content of the licenses created before the statistics per publication is unknown, i.e. empty
+type ContentCount struct {
+	ContentId string `json:"content_id"`
+	Count     int64  `json:"count"`
+}
+
+// EventFilter selects events on their type, device and timestamp
+// zero values are ignored
+type EventFilter struct {
+	Type     int
+	DeviceId string
+	From     time.Time
+	To       time.Time
+}
+
+// bounds used when the date range of a filter is open
+var (
+	minTimestamp = time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC)
+	maxTimestamp = time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC)
+)
+
 type dbTransactions struct {
 	db                    *sql.DB
-	get                   *sql.Stmt
-	add                   *sql.Stmt
-	getbylicensestatusid  *sql.Stmt
-	checkdevicestatus     *sql.Stmt
-	listregistereddevices *sql.Stmt
+	get                   *dbutils.Stmt
+	add                   *dbutils.Stmt
+	getbylicensestatusid  *dbutils.Stmt
+	checkdevicestatus     *dbutils.Stmt
+	listregistereddevices *dbutils.Stmt
+	listbylicensestatusid *dbutils.Stmt
+	archiveboundary       *dbutils.Stmt
+	archivecopy           *dbutils.Stmt
+	archivedelete         *dbutils.Stmt
+	checkarchivedstatus   *dbutils.Stmt
+	countbyday            *dbutils.Stmt
+	countbycontent        *dbutils.Stmt
+	listdeviceids         *dbutils.Stmt
+	anonymizenames        *dbutils.Stmt
+	anonymizearchivenames *dbutils.Stmt
+	anonymizedevice       *dbutils.Stmt
+	anonymizearchivedev   *dbutils.Stmt
+	countold              *dbutils.Stmt
+	deleteold             *dbutils.Stmt
+	deleteoldarchived     *dbutils.Stmt
+	getarchived           *dbutils.Stmt
 }
 
 // Get returns an event by its id
 //
 func (i dbTransactions) Get(id int) (Event, error) {
 	records, err := i.get.Query(id)
+	if err != nil {
+		return Event{}, wrap("get event", err)
+	}
 	var typeInt int
 
 	defer records.Close()
@@ -68,18 +134,41 @@ func (i dbTransactions) Get(id int) (Event, error) {
 		if err == nil {
 			e.Type = status.EventTypes[typeInt]
 		}
-		return e, err
+		return e, wrap("get event", err)
 	}
 
-	return Event{}, NotFound
+	return Event{}, ErrNotFound
 }
 
 // Add adds an event in the database,
 // The parameter eventType corresponds to the field 'type' in table 'event'
 //
+// If a cap is set on the number of events kept per license status,
+// older events are moved to the 'event_archive' table.
+//
 func (i dbTransactions) Add(e Event, eventType int) error {
 	_, err := i.add.Exec(e.DeviceName, e.Timestamp, eventType, e.DeviceId, e.LicenseStatusFk)
-	return err
+	if err != nil {
+		return wrap("add event", err)
+	}
+	if eventsCap := config.Config.LicenseStatus.EventsCap; eventsCap > 0 {
+		err = i.Archive(e.LicenseStatusFk, eventsCap)
+	}
+	return wrap("add event", err)
+}
+
+// AddTx adds an event in a transaction, e.g. with the update of its license status;
+// the older events are archived in the same transaction
+//
+func (i dbTransactions) AddTx(tx *sql.Tx, e Event, eventType int) error {
+	_, err := i.add.ExecTx(tx, e.DeviceName, e.Timestamp, eventType, e.DeviceId, e.LicenseStatusFk)
+	if err != nil {
+		return wrap("add event", err)
+	}
+	if eventsCap := config.Config.LicenseStatus.EventsCap; eventsCap > 0 {
+		err = i.archiveTx(tx, e.LicenseStatusFk, eventsCap)
+	}
+	return wrap("add event", err)
 }
 
 // GetByLicenseStatusId returns all events by license status id
@@ -87,6 +176,68 @@ func (i dbTransactions) Add(e Event, eventType int) error {
 func (i dbTransactions) GetByLicenseStatusId(licenseStatusFk int) func() (Event, error) {
 	rows, err := i.getbylicensestatusid.Query(licenseStatusFk)
 	if err != nil {
+		err = wrap("list events", err)
+		return func() (Event, error) { return Event{}, err }
+	}
+	return func() (Event, error) {
+		var e Event
+		var err error
+		var typeInt int
+
+		if rows.Next() {
+			err = rows.Scan(&e.Id, &e.DeviceName, &e.Timestamp, &typeInt, &e.DeviceId, &e.LicenseStatusFk)
+			if err == nil {
+				e.Type = status.EventTypes[typeInt]
+			}
+		} else {
+			rows.Close()
+			err = ErrNotFound
+		}
+		return e, wrap("list events", err)
+	}
+}
+
+// GetArchivedByLicenseStatusId returns the archived events of a license status, in chronological order
+//
+func (i dbTransactions) GetArchivedByLicenseStatusId(licenseStatusFk int) func() (Event, error) {
+	rows, err := i.getarchived.Query(licenseStatusFk)
+	if err != nil {
+		err = wrap("list events", err)
+		return func() (Event, error) { return Event{}, err }
+	}
+	return func() (Event, error) {
+		var e Event
+		var err error
+		var typeInt int
+
+		if rows.Next() {
+			err = rows.Scan(&e.Id, &e.DeviceName, &e.Timestamp, &typeInt, &e.DeviceId, &e.LicenseStatusFk)
+			if err == nil {
+				e.Type = status.EventTypes[typeInt]
+			}
+		} else {
+			rows.Close()
+			err = ErrNotFound
+		}
+		return e, wrap("list events", err)
+	}
+}
+
+// ListByLicenseStatusId returns a page of events by license status id, in chronological order
+// the events are selected by the filter; archived events are returned too
+//
+func (i dbTransactions) ListByLicenseStatusId(licenseStatusFk int, filter EventFilter, limit int64, offset int64) func() (Event, error) {
+	from, to := filter.From, filter.To
+	if from.IsZero() {
+		from = minTimestamp
+	}
+	if to.IsZero() {
+		to = maxTimestamp
+	}
+	rows, err := i.listbylicensestatusid.Query(licenseStatusFk, licenseStatusFk, filter.Type, filter.Type, filter.DeviceId, filter.DeviceId,
+		from.UTC(), to.UTC(), limit, offset)
+	if err != nil {
+		err = wrap("list events", err)
 		return func() (Event, error) { return Event{}, err }
 	}
 	return func() (Event, error) {
@@ -101,17 +252,182 @@ func (i dbTransactions) GetByLicenseStatusId(licenseStatusFk int) func() (Event,
 			}
 		} else {
 			rows.Close()
-			err = NotFound
+			err = ErrNotFound
+		}
+		return e, wrap("list events", err)
+	}
+}
+
+// Archive moves the events of a license status to the 'event_archive' table,
+// keeping only the most recent ones in the 'event' table
+//
+func (i dbTransactions) Archive(licenseStatusFk int, keep int) error {
+	return dbutils.Transact(i.db, func(tx *sql.Tx) error {
+		return i.archiveTx(tx, licenseStatusFk, keep)
+	})
+}
+
+// archiveTx archives the older events of a license status in a transaction
+func (i dbTransactions) archiveTx(tx *sql.Tx, licenseStatusFk int, keep int) error {
+	// the boundary is the id of the most recent event to archive
+	var boundary int
+	err := i.archiveboundary.QueryRowTx(tx, licenseStatusFk, keep).Scan(&boundary)
+	if err == sql.ErrNoRows {
+		// not enough events, nothing to archive
+		return nil
+	} else if err != nil {
+		return wrap("archive events", err)
+	}
+	if _, err = i.archivecopy.ExecTx(tx, licenseStatusFk, boundary); err != nil {
+		return wrap("archive events", err)
+	}
+	_, err = i.archivedelete.ExecTx(tx, licenseStatusFk, boundary)
+	return wrap("archive events", err)
+}
+
+// CountByDay returns the number of events of a given type per day, in the [from, to] interval
+// archived events are counted
+//
+func (i dbTransactions) CountByDay(eventType int, from time.Time, to time.Time) func() (DailyCount, error) {
+	rows, err := i.countbyday.Query(eventType, from.UTC(), to.UTC())
+	if err != nil {
+		err = wrap("count events", err)
+		return func() (DailyCount, error) { return DailyCount{}, err }
+	}
+	return func() (DailyCount, error) {
+		var c DailyCount
+		var err error
+		if rows.Next() {
+			err = rows.Scan(&c.Day, &c.Count)
+			// some drivers return a full timestamp
+			if len(c.Day) > 10 {
+				c.Day = c.Day[:10]
+			}
+		} else {
+			rows.Close()
+			err = ErrNotFound
 		}
-		return e, err
+		return c, wrap("count events", err)
 	}
 }
 
+// CountByContent returns the number of events of a given type per content, in the [from, to] interval
+// the contents with the highest number of events come first; archived events are counted
+//
+func (i dbTransactions) CountByContent(eventType int, from time.Time, to time.Time) func() (ContentCount, error) {
+	rows, err := i.countbycontent.Query(eventType, from.UTC(), to.UTC())
+	if err != nil {
+		err = wrap("count events", err)
+		return func() (ContentCount, error) { return ContentCount{}, err }
+	}
+	return func() (ContentCount, error) {
+		var c ContentCount
+		var err error
+		if rows.Next() {
+			err = rows.Scan(&c.ContentId, &c.Count)
+		} else {
+			rows.Close()
+			err = ErrNotFound
+		}
+		return c, wrap("count events", err)
+	}
+}
+
+// AnonymizeEvents erases the names of the devices in the events of a license status,
+// live and archived, and replaces each device identifier by a random one: the number of devices
+// and the statistics are preserved, but the devices cannot be identified anymore.
+//
+func (i dbTransactions) AnonymizeEvents(licenseStatusFk int) error {
+	// get the device ids first, the result set must be closed before updates
+	var deviceIds []string
+	rows, err := i.listdeviceids.Query(licenseStatusFk, licenseStatusFk)
+	if err != nil {
+		return wrap("anonymize events", err)
+	}
+	for rows.Next() {
+		var id sql.NullString
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return wrap("anonymize events", err)
+		}
+		if id.Valid {
+			deviceIds = append(deviceIds, id.String)
+		}
+	}
+	rows.Close()
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return wrap("anonymize events", err)
+	}
+	_, err = i.anonymizenames.ExecTx(tx, licenseStatusFk)
+	if err == nil {
+		_, err = i.anonymizearchivenames.ExecTx(tx, licenseStatusFk)
+	}
+	for _, id := range deviceIds {
+		if err != nil {
+			break
+		}
+		var uid uuid.UUID
+		if uid, err = uuid.NewV4(); err != nil {
+			break
+		}
+		pseudonym := "anon-" + uid.String()
+		_, err = i.anonymizedevice.ExecTx(tx, pseudonym, licenseStatusFk, id)
+		if err == nil {
+			_, err = i.anonymizearchivedev.ExecTx(tx, pseudonym, licenseStatusFk, id)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return wrap("anonymize events", err)
+	}
+	return wrap("anonymize events", tx.Commit())
+}
+
+// PurgeEvents deletes the events, live and archived, older than a date and returns their number.
+// In dry-run mode, the events are only counted.
+//
+func (i dbTransactions) PurgeEvents(before time.Time, dryRun bool) (int64, error) {
+	before = before.UTC()
+	if dryRun {
+		var count int64
+		err := i.countold.QueryRow(before, before).Scan(&count)
+		return count, wrap("purge events", err)
+	}
+	tx, err := i.db.Begin()
+	if err != nil {
+		return 0, wrap("purge events", err)
+	}
+	res, err := i.deleteold.ExecTx(tx, before)
+	if err != nil {
+		tx.Rollback()
+		return 0, wrap("purge events", err)
+	}
+	live, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, wrap("purge events", err)
+	}
+	res, err = i.deleteoldarchived.ExecTx(tx, before)
+	if err != nil {
+		tx.Rollback()
+		return 0, wrap("purge events", err)
+	}
+	archived, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, wrap("purge events", err)
+	}
+	return live + archived, wrap("purge events", tx.Commit())
+}
+
 // ListRegisteredDevices returns all devices which have an 'active' status by licensestatus id
 //
 func (i dbTransactions) ListRegisteredDevices(licenseStatusFk int) func() (Device, error) {
-	rows, err := i.listregistereddevices.Query(licenseStatusFk)
+	rows, err := i.listregistereddevices.Query(licenseStatusFk, licenseStatusFk)
 	if err != nil {
+		err = wrap("list devices", err)
 		return func() (Device, error) { return Device{}, err }
 	}
 	return func() (Device, error) {
@@ -121,14 +437,15 @@ func (i dbTransactions) ListRegisteredDevices(licenseStatusFk int) func() (Devic
 			err = rows.Scan(&d.DeviceId, &d.DeviceName, &d.Timestamp)
 		} else {
 			rows.Close()
-			err = NotFound
+			err = ErrNotFound
 		}
-		return d, err
+		return d, wrap("list devices", err)
 	}
 }
 
 // CheckDeviceStatus gets the current status of a device
-// if the device has not been recorded in the 'event' table, typeString is empty.
+// if the device has not been recorded in the 'event' table, the 'event_archive' table is checked;
+// if the device has not been recorded in any of them, typeString is empty.
 //
 func (i dbTransactions) CheckDeviceStatus(licenseStatusFk int, deviceId string) (string, error) {
 	var typeString string
@@ -136,6 +453,10 @@ func (i dbTransactions) CheckDeviceStatus(licenseStatusFk int, deviceId string)
 
 	row := i.checkdevicestatus.QueryRow(licenseStatusFk, deviceId)
 	err := row.Scan(&typeInt)
+	if err == sql.ErrNoRows {
+		row = i.checkarchivedstatus.QueryRow(licenseStatusFk, deviceId)
+		err = row.Scan(&typeInt)
+	}
 
 	if err == nil {
 		typeString = status.EventTypes[typeInt]
@@ -145,73 +466,140 @@ func (i dbTransactions) CheckDeviceStatus(licenseStatusFk int, deviceId string)
 		}
 	}
 
-	return typeString, err
+	return typeString, wrap("check device status", err)
 }
 
 // Open defines scripts for queries & create the 'event' table if it does not exist
 //
 func Open(db *sql.DB) (t Transactions, err error) {
+	return OpenWithReplica(db, db)
+}
+
+// OpenWithReplica opens the transactions; the search of events and the statistics
+// are read from the replica database, the device checks stay on the primary.
+func OpenWithReplica(db *sql.DB, replica *sql.DB) (t Transactions, err error) {
 	
 	var createTableQuery, getQuery, getByLicenseStatusIdQuery, checkDeviceStatusQuery, addQuery, listRegisteredDevicesQuery string
-	if strings.HasPrefix(config.Config.LcpServer.Database, "postgres") {
-		// postgres
+	var listByLicenseStatusIdQuery, archiveBoundaryQuery, archiveCopyQuery, archiveDeleteQuery, checkArchivedStatusQuery string
+	var countByDayQuery, countByContentQuery string
+	var listDeviceIdsQuery, anonymizeNamesQuery, anonymizeArchiveNamesQuery, anonymizeDeviceQuery, anonymizeArchiveDeviceQuery string
+	var countOldQuery, deleteOldQuery, deleteOldArchivedQuery, getArchivedQuery string
+	// the queries are written with '?' placeholders, bound to the dialect of the database
+	d := dbutils.DialectOf(config.Config.LsdServer.Database)
+	createTableQuery = tableDef
+	if d == dbutils.Postgres {
 		createTableQuery = tableDefPostgres
-		getQuery = "SELECT * FROM event WHERE id = $1 LIMIT 1"
-		getByLicenseStatusIdQuery = "SELECT * FROM event WHERE license_status_fk = $1"
-		checkDeviceStatusQuery = "SELECT type FROM event WHERE license_status_fk = $1 AND device_id = $2 ORDER BY timestamp DESC LIMIT 1"
-		listRegisteredDevicesQuery = "SELECT device_id, device_name, timestamp FROM event WHERE license_status_fk = $1 AND type = 1"
-		addQuery = "INSERT INTO event (device_name, timestamp, type, device_id, license_status_fk) VALUES ($1, $2, $3, $4, $5)"
-	} else {
-		// mysql/sqlite
-		createTableQuery = tableDef
-		getQuery = "SELECT * FROM event WHERE id = ? LIMIT 1"
-		getByLicenseStatusIdQuery = "SELECT * FROM event WHERE license_status_fk = ?"
-		checkDeviceStatusQuery = "SELECT type FROM event WHERE license_status_fk = ? AND device_id = ? ORDER BY timestamp DESC LIMIT 1"
-		listRegisteredDevicesQuery = "SELECT device_id, device_name, timestamp FROM event WHERE license_status_fk = ? AND type = 1"
-		addQuery = "INSERT INTO event (device_name, timestamp, type, device_id, license_status_fk) VALUES (?, ?, ?, ?, ?)"
 	}
+	getQuery = "SELECT * FROM event WHERE id = ? LIMIT 1"
+	getByLicenseStatusIdQuery = "SELECT * FROM event WHERE license_status_fk = ?"
+	checkDeviceStatusQuery = "SELECT type FROM event WHERE license_status_fk = ? AND device_id = ? ORDER BY timestamp DESC LIMIT 1"
+	listRegisteredDevicesQuery = "SELECT device_id, device_name, timestamp FROM event WHERE license_status_fk = ? AND type = 1" +
+		" UNION ALL SELECT device_id, device_name, timestamp FROM event_archive WHERE license_status_fk = ? AND type = 1"
+	addQuery = "INSERT INTO event (device_name, timestamp, type, device_id, license_status_fk) VALUES (?, ?, ?, ?, ?)"
+	// the archived events keep their id, which orders them before the recent ones
+	listByLicenseStatusIdQuery = "SELECT id, device_name, timestamp, type, device_id, license_status_fk FROM" +
+		" (SELECT id, device_name, timestamp, type, device_id, license_status_fk FROM event WHERE license_status_fk = ?" +
+		" UNION ALL SELECT id, device_name, timestamp, type, device_id, license_status_fk FROM event_archive WHERE license_status_fk = ?) e" +
+		" WHERE (? = 0 OR type = ?) AND (? = '' OR device_id = ?) AND timestamp >= ? AND timestamp <= ? ORDER BY id ASC LIMIT ? OFFSET ?"
+	archiveBoundaryQuery = "SELECT id FROM event WHERE license_status_fk = ? ORDER BY id DESC LIMIT 1 OFFSET ?"
+	archiveCopyQuery = "INSERT INTO event_archive (id, device_name, timestamp, type, device_id, license_status_fk)" +
+		" SELECT id, device_name, timestamp, type, device_id, license_status_fk FROM event WHERE license_status_fk = ? AND id <= ?"
+	archiveDeleteQuery = "DELETE FROM event WHERE license_status_fk = ? AND id <= ?"
+	checkArchivedStatusQuery = "SELECT type FROM event_archive WHERE license_status_fk = ? AND device_id = ? ORDER BY timestamp DESC LIMIT 1"
+	countByDayQuery = "SELECT DATE(timestamp) AS day, COUNT(*) FROM " + allEvents +
+		" WHERE type = ? AND timestamp >= ? AND timestamp <= ? GROUP BY day ORDER BY day"
+	countByContentQuery = "SELECT ls.content_id, COUNT(*) AS total FROM " + allEvents + " JOIN license_status ls ON e.license_status_fk = ls.id" +
+		" WHERE e.type = ? AND e.timestamp >= ? AND e.timestamp <= ? GROUP BY ls.content_id ORDER BY total DESC"
+	listDeviceIdsQuery = "SELECT device_id FROM event WHERE license_status_fk = ?" +
+		" UNION SELECT device_id FROM event_archive WHERE license_status_fk = ?"
+	anonymizeNamesQuery = "UPDATE event SET device_name = '' WHERE license_status_fk = ?"
+	anonymizeArchiveNamesQuery = "UPDATE event_archive SET device_name = '' WHERE license_status_fk = ?"
+	anonymizeDeviceQuery = "UPDATE event SET device_id = ? WHERE license_status_fk = ? AND device_id = ?"
+	anonymizeArchiveDeviceQuery = "UPDATE event_archive SET device_id = ? WHERE license_status_fk = ? AND device_id = ?"
+	countOldQuery = "SELECT (SELECT COUNT(*) FROM event WHERE timestamp < ?) + (SELECT COUNT(*) FROM event_archive WHERE timestamp < ?)"
+	deleteOldQuery = "DELETE FROM event WHERE timestamp < ?"
+	deleteOldArchivedQuery = "DELETE FROM event_archive WHERE timestamp < ?"
+	getArchivedQuery = "SELECT id, device_name, timestamp, type, device_id, license_status_fk FROM event_archive WHERE license_status_fk = ? ORDER BY id"
 
 	// if sqlite/postgres, create the event table in the lsd db if it does not exist
-	if strings.HasPrefix(config.Config.LsdServer.Database, "sqlite") || strings.HasPrefix(config.Config.LcpServer.Database, "postgres") {
+	if d != dbutils.MySQL {
 		_, err = db.Exec(createTableQuery)
 		if err != nil {
 			log.Println("Error creating sqlite event table")
 			return
 		}
 	}
+	// if mysql, create the event tables if it does not exist
+	if d == dbutils.MySQL {
+		err = dbutils.CreateMySQLTables(db, tableDefMySQL, archiveTableDefMySQL)
+		if err != nil {
+			log.Println("Error creating the event tables")
+			return
+		}
+	}
 
 	// select an event by its id
-	get, err := db.Prepare(getQuery)
-	if err != nil {
-		return
-	}
+	get := dbutils.NewStmt(db, d.Bind(getQuery))
 
 	// add an event
-	add, err := db.Prepare(addQuery)
-	if err != nil {
-		return
-	}
+	add := dbutils.NewStmt(db, d.Bind(addQuery))
 
-	getbylicensestatusid, err := db.Prepare(getByLicenseStatusIdQuery)
-	if err != nil {
-		return
-	}
+	getbylicensestatusid := dbutils.NewStmt(db, d.Bind(getByLicenseStatusIdQuery))
 
 	// the status of a device corresponds to the latest event stored in the db.
-	checkdevicestatus, err := db.Prepare(checkDeviceStatusQuery)
-	if err != nil {
-		return
-	}
+	checkdevicestatus := dbutils.NewStmt(db, d.Bind(checkDeviceStatusQuery))
 
-	listregistereddevices, err := db.Prepare(listRegisteredDevicesQuery)
-	if err != nil {
-		return
-	}
+	listregistereddevices := dbutils.NewStmt(db, d.Bind(listRegisteredDevicesQuery))
+
+	// paginated and filtered list of events
+	listbylicensestatusid := dbutils.NewStmt(replica, d.Bind(listByLicenseStatusIdQuery))
+
+	// archival of older events
+	archiveboundary := dbutils.NewStmt(db, d.Bind(archiveBoundaryQuery))
+
+	archivecopy := dbutils.NewStmt(db, d.Bind(archiveCopyQuery))
+
+	archivedelete := dbutils.NewStmt(db, d.Bind(archiveDeleteQuery))
+
+	checkarchivedstatus := dbutils.NewStmt(db, d.Bind(checkArchivedStatusQuery))
+
+	// statistics
+	countbyday := dbutils.NewStmt(replica, d.Bind(countByDayQuery))
+
+	countbycontent := dbutils.NewStmt(replica, d.Bind(countByContentQuery))
+
+	// erasure of the personal data of the users
+	listdeviceids := dbutils.NewStmt(db, d.Bind(listDeviceIdsQuery))
+
+	anonymizenames := dbutils.NewStmt(db, d.Bind(anonymizeNamesQuery))
+
+	anonymizearchivenames := dbutils.NewStmt(db, d.Bind(anonymizeArchiveNamesQuery))
+
+	anonymizedevice := dbutils.NewStmt(db, d.Bind(anonymizeDeviceQuery))
+
+	anonymizearchivedev := dbutils.NewStmt(db, d.Bind(anonymizeArchiveDeviceQuery))
 
-	t = dbTransactions{db, get, add, getbylicensestatusid, checkdevicestatus, listregistereddevices}
+	// retention of the old events
+	countold := dbutils.NewStmt(db, d.Bind(countOldQuery))
+
+	deleteold := dbutils.NewStmt(db, d.Bind(deleteOldQuery))
+
+	deleteoldarchived := dbutils.NewStmt(db, d.Bind(deleteOldArchivedQuery))
+
+	// export of the archived events
+	getarchived := dbutils.NewStmt(replica, d.Bind(getArchivedQuery))
+
+	t = dbTransactions{db, get, add, getbylicensestatusid, checkdevicestatus, listregistereddevices,
+		listbylicensestatusid, archiveboundary, archivecopy, archivedelete, checkarchivedstatus,
+		countbyday, countbycontent, listdeviceids, anonymizenames, anonymizearchivenames,
+		anonymizedevice, anonymizearchivedev, countold, deleteold, deleteoldarchived, getarchived}
 	return
 }
 
+// allEvents is used by statistics queries, which count live and archived events
+const allEvents = "(SELECT timestamp, type, license_status_fk FROM event" +
+	" UNION ALL SELECT timestamp, type, license_status_fk FROM event_archive) e"
+
 const tableDef = "CREATE TABLE IF NOT EXISTS event (" +
 	"id integer PRIMARY KEY," +
 	"device_name varchar(255) DEFAULT NULL," +
@@ -221,7 +609,17 @@ const tableDef = "CREATE TABLE IF NOT EXISTS event (" +
 	"license_status_fk int NOT NULL," +
 	"FOREIGN KEY(license_status_fk) REFERENCES license_status(id)" +
 	");" +
-	"CREATE INDEX IF NOT EXISTS license_status_fk_index on event (license_status_fk);"
+	"CREATE INDEX IF NOT EXISTS license_status_fk_index on event (license_status_fk);" +
+	"CREATE TABLE IF NOT EXISTS event_archive (" +
+	"id integer PRIMARY KEY," +
+	"device_name varchar(255) DEFAULT NULL," +
+	"timestamp datetime NOT NULL," +
+	"type int NOT NULL," +
+	"device_id varchar(255) DEFAULT NULL," +
+	"license_status_fk int NOT NULL," +
+	"FOREIGN KEY(license_status_fk) REFERENCES license_status(id)" +
+	");" +
+	"CREATE INDEX IF NOT EXISTS event_archive_license_status_fk_index on event_archive (license_status_fk);"
 
 const tableDefPostgres = "CREATE TABLE IF NOT EXISTS event (" +
 	"id SERIAL PRIMARY KEY," +
@@ -232,4 +630,33 @@ const tableDefPostgres = "CREATE TABLE IF NOT EXISTS event (" +
 	"license_status_fk INT NOT NULL," +
 	"FOREIGN KEY(license_status_fk) REFERENCES license_status(id)" +
 	");" +
-	"CREATE INDEX IF NOT EXISTS license_status_fk_index on event (license_status_fk);"
\ No newline at end of file
+	"CREATE INDEX IF NOT EXISTS license_status_fk_index on event (license_status_fk);" +
+	"CREATE TABLE IF NOT EXISTS event_archive (" +
+	"id INT PRIMARY KEY," +
+	"device_name VARCHAR(255) DEFAULT NULL," +
+	"timestamp TIMESTAMPTZ NOT NULL," +
+	"type INT NOT NULL," +
+	"device_id VARCHAR(255) DEFAULT NULL," +
+	"license_status_fk INT NOT NULL," +
+	"FOREIGN KEY(license_status_fk) REFERENCES license_status(id)" +
+	");" +
+	"CREATE INDEX IF NOT EXISTS event_archive_license_status_fk_index on event_archive (license_status_fk);"
+
+var tableDefMySQL = dbutils.MySQLTable{Name: "event", Definition: "`id` int NOT NULL PRIMARY KEY AUTO_INCREMENT," +
+	"`device_name` varchar(255) DEFAULT NULL," +
+	"`timestamp` datetime NOT NULL," +
+	"`type` int NOT NULL," +
+	"`device_id` varchar(255) DEFAULT NULL," +
+	"`license_status_fk` int NOT NULL," +
+	"FOREIGN KEY(`license_status_fk`) REFERENCES `license_status`(`id`)",
+	Indexes: []dbutils.MySQLIndex{{Name: "license_status_fk_index", Columns: "`license_status_fk`"}}}
+
+// archived events keep their id
+var archiveTableDefMySQL = dbutils.MySQLTable{Name: "event_archive", Definition: "`id` int NOT NULL PRIMARY KEY," +
+	"`device_name` varchar(255) DEFAULT NULL," +
+	"`timestamp` datetime NOT NULL," +
+	"`type` int NOT NULL," +
+	"`device_id` varchar(255) DEFAULT NULL," +
+	"`license_status_fk` int NOT NULL," +
+	"FOREIGN KEY(`license_status_fk`) REFERENCES `license_status`(`id`)",
+	Indexes: []dbutils.MySQLIndex{{Name: "event_archive_license_status_fk_index", Columns: "`license_status_fk`"}}}
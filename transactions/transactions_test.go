@@ -12,6 +12,7 @@ import (
 
 	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/readium/readium-lcp-server/config"
 	"github.com/readium/readium-lcp-server/status"
 )
 
@@ -37,3 +38,262 @@ func TestTransactionCreation(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// TestTransactionArchive adds events beyond the cap and checks that older events are archived
+func TestTransactionArchive(t *testing.T) {
+	config.Config.LsdServer.Database = "sqlite3://:memory:"
+	config.Config.LicenseStatus.EventsCap = 2
+	defer func() { config.Config.LicenseStatus.EventsCap = 0 }()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	// a single connection, as each connection to :memory: opens a new database
+	db.SetMaxOpenConns(1)
+	// statistics queries join the license_status table
+	_, err = db.Exec("CREATE TABLE license_status (id integer PRIMARY KEY, license_ref varchar(255) NOT NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trns, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := time.Now().UTC().Truncate(time.Second)
+	for _, typeInt := range []int{status.STATUS_ACTIVE_INT, status.EVENT_RENEWED_INT, status.EVENT_RENEWED_INT, status.STATUS_RETURNED_INT} {
+		e := Event{DeviceName: "testdevice", Timestamp: timestamp, Type: status.EventTypes[typeInt], DeviceId: "deviceid", LicenseStatusFk: 1}
+		err = trns.Add(e, typeInt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := 0
+	fn := trns.GetByLicenseStatusId(1)
+	for _, err = fn(); err == nil; _, err = fn() {
+		count++
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 events, got %d", count)
+	}
+
+	archived := 0
+	fn = trns.GetArchivedByLicenseStatusId(1)
+	for _, err = fn(); err == nil; _, err = fn() {
+		archived++
+	}
+	if archived != 2 {
+		t.Errorf("Expected 2 archived events, got %d", archived)
+	}
+
+	// the register event has been archived but the device is still registered
+	devices := 0
+	dfn := trns.ListRegisteredDevices(1)
+	for _, err = dfn(); err == nil; _, err = dfn() {
+		devices++
+	}
+	if devices != 1 {
+		t.Errorf("Expected 1 registered device, got %d", devices)
+	}
+
+	// the archived events are listed first
+	var listed []Event
+	fn = trns.ListByLicenseStatusId(1, EventFilter{}, 10, 0)
+	for e, err := fn(); err == nil; e, err = fn() {
+		listed = append(listed, e)
+	}
+	if len(listed) != 4 || listed[0].Type != status.EventTypes[status.STATUS_ACTIVE_INT] || listed[3].Type != status.EventTypes[status.STATUS_RETURNED_INT] {
+		t.Errorf("Expected the 4 events in chronological order, got %+v", listed)
+	}
+	var page []Event
+	fn = trns.ListByLicenseStatusId(1, EventFilter{}, 2, 2)
+	for e, err := fn(); err == nil; e, err = fn() {
+		page = append(page, e)
+	}
+	if len(page) != 2 || page[0].Id != listed[2].Id {
+		t.Errorf("Expected the second page to hold the recent events, got %+v", page)
+	}
+
+	// filter on the event type
+	renewed := 0
+	fn = trns.ListByLicenseStatusId(1, EventFilter{Type: status.EVENT_RENEWED_INT}, 10, 0)
+	for _, err = fn(); err == nil; _, err = fn() {
+		renewed++
+	}
+	if renewed != 2 {
+		t.Errorf("Expected 2 renew events, got %d", renewed)
+	}
+
+	// filter on the device and the date range
+	matching := 0
+	filter := EventFilter{DeviceId: "deviceid", From: timestamp.Add(-time.Hour), To: timestamp.Add(time.Hour)}
+	fn = trns.ListByLicenseStatusId(1, filter, 10, 0)
+	for _, err = fn(); err == nil; _, err = fn() {
+		matching++
+	}
+	if matching != 4 {
+		t.Errorf("Expected 4 events for the device, got %d", matching)
+	}
+	fn = trns.ListByLicenseStatusId(1, EventFilter{From: timestamp.Add(time.Hour)}, 10, 0)
+	if _, err = fn(); err != ErrNotFound {
+		t.Errorf("Expected no event after the date range, got %v", err)
+	}
+
+	// archived events are counted by statistics
+	registrations := 0
+	cfn := trns.CountByDay(status.STATUS_ACTIVE_INT, timestamp.Add(-time.Hour), timestamp.Add(time.Hour))
+	for c, err := cfn(); err == nil; c, err = cfn() {
+		if c.Day != timestamp.Format("2006-01-02") {
+			t.Errorf("Unexpected day %s", c.Day)
+		}
+		registrations += int(c.Count)
+	}
+	if registrations != 1 {
+		t.Errorf("Expected 1 registration, got %d", registrations)
+	}
+}
+
+// TestCountByContent checks that the renewals are counted per publication, live and archived
+func TestCountByContent(t *testing.T) {
+	config.Config.LsdServer.Database = "sqlite3://:memory:"
+	config.Config.LicenseStatus.EventsCap = 1
+	defer func() { config.Config.LicenseStatus.EventsCap = 0 }()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("CREATE TABLE license_status (id integer PRIMARY KEY, license_ref varchar(255) NOT NULL, content_id varchar(255) NOT NULL DEFAULT '');" +
+		"INSERT INTO license_status (id, license_ref, content_id) VALUES (1, 'l1', 'c1'), (2, 'l2', 'c1'), (3, 'l3', 'c2'), (4, 'l4', '')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trns, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := time.Now().UTC().Truncate(time.Second)
+	// two renewals of the first license, one of them archived by the cap
+	for _, fk := range []int{1, 1, 2, 3, 4} {
+		e := Event{DeviceName: "phone", Timestamp: timestamp, DeviceId: "device", LicenseStatusFk: fk}
+		if err = trns.Add(e, status.EVENT_RENEWED_INT); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := Event{DeviceName: "phone", Timestamp: timestamp, DeviceId: "device", LicenseStatusFk: 3}
+	if err = trns.Add(e, status.STATUS_RETURNED_INT); err != nil {
+		t.Fatal(err)
+	}
+
+	var counts []ContentCount
+	fn := trns.CountByContent(status.EVENT_RENEWED_INT, timestamp.Add(-time.Hour), timestamp.Add(time.Hour))
+	for c, err := fn(); err == nil; c, err = fn() {
+		counts = append(counts, c)
+	}
+	if len(counts) != 3 || counts[0] != (ContentCount{ContentId: "c1", Count: 3}) {
+		t.Fatalf("Expected the renewals of 3 contents, c1 first, got %+v", counts)
+	}
+	for _, c := range counts[1:] {
+		if c.Count != 1 || (c.ContentId != "c2" && c.ContentId != "") {
+			t.Errorf("Unexpected count %+v", c)
+		}
+	}
+	fn = trns.CountByContent(status.EVENT_RENEWED_INT, timestamp.Add(time.Hour), timestamp.Add(2*time.Hour))
+	if _, err = fn(); err != ErrNotFound {
+		t.Errorf("Expected no renewal after the time window, got %v", err)
+	}
+}
+
+// TestAnonymizeEvents checks that the devices of a license cannot be identified after an erasure,
+// and that they are still counted
+func TestAnonymizeEvents(t *testing.T) {
+	config.Config.LsdServer.Database = "sqlite3://:memory:"
+	config.Config.LicenseStatus.EventsCap = 1
+	defer func() { config.Config.LicenseStatus.EventsCap = 0 }()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	trns, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := time.Now().UTC().Truncate(time.Second)
+	for _, device := range []string{"device-1", "device-2", "device-1"} {
+		e := Event{DeviceName: "phone of " + device, Timestamp: timestamp, DeviceId: device, LicenseStatusFk: 1}
+		if err = trns.Add(e, status.STATUS_ACTIVE_INT); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := Event{DeviceName: "other phone", Timestamp: timestamp, DeviceId: "device-3", LicenseStatusFk: 2}
+	if err = trns.Add(other, status.STATUS_ACTIVE_INT); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = trns.AnonymizeEvents(1); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]bool)
+	registrations := 0
+	dfn := trns.ListRegisteredDevices(1)
+	for d, err := dfn(); err == nil; d, err = dfn() {
+		if d.DeviceName != "" || d.DeviceId == "device-1" || d.DeviceId == "device-2" {
+			t.Errorf("Device not anonymized: %v", d)
+		}
+		ids[d.DeviceId] = true
+		registrations++
+	}
+	if registrations != 3 || len(ids) != 2 {
+		t.Errorf("Expected 3 registrations of 2 devices, got %d of %d", registrations, len(ids))
+	}
+
+	// other licenses are not modified
+	if typeString, err := trns.CheckDeviceStatus(2, "device-3"); err != nil || typeString == "" {
+		t.Errorf("Expected the device of another license to be kept, got %q, %v", typeString, err)
+	}
+}
+
+// TestPurgeEvents checks that the old events are counted in dry-run mode, then deleted
+func TestPurgeEvents(t *testing.T) {
+	config.Config.LsdServer.Database = "sqlite3://:memory:"
+	config.Config.LicenseStatus.EventsCap = 1
+	defer func() { config.Config.LicenseStatus.EventsCap = 0 }()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	trns, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	// the first old event is archived by the cap
+	for _, timestamp := range []time.Time{now.AddDate(0, 0, -100), now.AddDate(0, 0, -90), now} {
+		e := Event{DeviceName: "phone", Timestamp: timestamp, DeviceId: "device-1", LicenseStatusFk: 1}
+		if err = trns.Add(e, status.STATUS_ACTIVE_INT); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := now.AddDate(0, 0, -30)
+	if count, err := trns.PurgeEvents(before, true); err != nil || count != 2 {
+		t.Fatalf("Expected 2 purgeable events, got %d, %v", count, err)
+	}
+	if count, err := trns.PurgeEvents(before, false); err != nil || count != 2 {
+		t.Fatalf("Expected 2 purged events, got %d, %v", count, err)
+	}
+	if count, err := trns.PurgeEvents(before, true); err != nil || count != 0 {
+		t.Errorf("Expected no purgeable event, got %d, %v", count, err)
+	}
+	if typeString, err := trns.CheckDeviceStatus(1, "device-1"); err != nil || typeString == "" {
+		t.Errorf("Expected the recent event to be kept, got %q, %v", typeString, err)
+	}
+}
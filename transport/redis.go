@@ -0,0 +1,212 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	uuid "github.com/satori/go.uuid"
+)
+
+// prefix of the Redis keys of the queues
+const keyPrefix = "lcp:transport:"
+
+// wait of the consumers for a call, before waiting again
+const consumeWait = 5 * time.Second
+
+// time to live of a response which has not been received, e.g. after the timeout of the caller
+const replyTTL = 60
+
+// message is a call sent through the queue of a server; the call is dropped if it is received
+// after its deadline, as the caller does not wait for the response anymore
+type message struct {
+	Id       string      `json:"id"`
+	Method   string      `json:"method"`
+	URI      string      `json:"uri"`
+	Header   http.Header `json:"header,omitempty"`
+	Body     []byte      `json:"body,omitempty"`
+	Deadline time.Time   `json:"deadline"`
+}
+
+// reply is the response to a call, sent through the queue of the caller
+type reply struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// queues are the Redis queues of the servers: the callers push the calls to the queue of a server,
+// consumed by its instances, and wait for the response in the reply queue of the call
+type queues struct {
+	pool *redis.Pool
+}
+
+var (
+	queuesMutex  sync.Mutex
+	openedQueues = make(map[string]*queues)
+)
+
+// openQueues returns the queues of the Redis server at the given url (redis://host:port/db),
+// connected once by process
+func openQueues(url string) (*queues, error) {
+	queuesMutex.Lock()
+	defer queuesMutex.Unlock()
+	if q, ok := openedQueues[url]; ok {
+		return q, nil
+	}
+	if url == "" {
+		return nil, errors.New("The url of the Redis server is missing")
+	}
+	pool := &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url,
+				redis.DialConnectTimeout(time.Second),
+				redis.DialReadTimeout(time.Second),
+				redis.DialWriteTimeout(time.Second))
+		},
+	}
+	// check the connection
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		return nil, err
+	}
+	q := &queues{pool: pool}
+	openedQueues[url] = q
+	return q, nil
+}
+
+func queueKey(server string) string {
+	return keyPrefix + server
+}
+
+func replyKey(id string) string {
+	return keyPrefix + "reply:" + id
+}
+
+// redisTransport sends the calls to a server through its queue
+type redisTransport struct {
+	queues *queues
+	server string
+}
+
+func (t redisTransport) Do(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	m := message{
+		Id:       uid.String(),
+		Method:   req.Method,
+		URI:      req.URL.RequestURI(),
+		Header:   req.Header,
+		Body:     body,
+		Deadline: time.Now().Add(timeout).UTC(),
+	}
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := t.queues.pool.Get()
+	defer conn.Close()
+	if _, err = conn.Do("LPUSH", queueKey(t.server), payload); err != nil {
+		return nil, err
+	}
+	// BRPOP waits for whole seconds
+	wait := int((timeout + time.Second - 1) / time.Second)
+	values, err := redis.ByteSlices(redis.DoWithTimeout(conn, timeout+time.Second, "BRPOP", replyKey(m.Id), wait))
+	if err == redis.ErrNil {
+		return nil, ErrTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rep reply
+	if err = json.Unmarshal(values[1], &rep); err != nil {
+		return nil, err
+	}
+	return newResponse(req, rep.Status, rep.Header, rep.Body), nil
+}
+
+// consume handles the calls of the queue of a server, concurrently; it never returns
+func (q *queues) consume(server string, handler http.Handler) {
+	for {
+		conn := q.pool.Get()
+		values, err := redis.ByteSlices(redis.DoWithTimeout(conn, consumeWait+time.Second, "BRPOP", queueKey(server), int(consumeWait/time.Second)))
+		conn.Close()
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			log.Println("Transport: Redis error on the queue of the " + server + ": " + err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		go q.handle(handler, values[1])
+	}
+}
+
+// handle handles a call received from a queue, and sends its response to the caller
+func (q *queues) handle(handler http.Handler, payload []byte) {
+	var m message
+	if err := json.Unmarshal(payload, &m); err != nil {
+		log.Println("Transport: invalid call in the queue: " + err.Error())
+		return
+	}
+	timeout := time.Until(m.Deadline)
+	if timeout <= 0 {
+		log.Println("Transport: call " + m.Method + " " + m.URI + " dropped after its deadline")
+		return
+	}
+	req, err := http.NewRequest(m.Method, m.URI, bytes.NewReader(m.Body))
+	if err != nil {
+		log.Println("Transport: invalid call " + m.Method + " " + m.URI + ": " + err.Error())
+		return
+	}
+	if m.Header != nil {
+		req.Header = m.Header
+	}
+	resp, err := serveLocal(handler, req, remoteRedis, timeout)
+	if err != nil {
+		log.Println("Transport: call " + m.Method + " " + m.URI + ": " + err.Error())
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	payload, err = json.Marshal(reply{Status: resp.StatusCode, Header: resp.Header, Body: body})
+	if err != nil {
+		log.Println("Transport: invalid response to " + m.Method + " " + m.URI + ": " + err.Error())
+		return
+	}
+
+	conn := q.pool.Get()
+	defer conn.Close()
+	key := replyKey(m.Id)
+	if _, err = conn.Do("LPUSH", key, payload); err == nil {
+		_, err = conn.Do("EXPIRE", key, replyTTL)
+	}
+	if err != nil {
+		log.Println("Transport: Redis error on the response to " + m.Method + " " + m.URI + ": " + err.Error())
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package transport carries the calls between the License Server and the License Status Server:
+// the notifications of the License Server (new licenses, revocations, erasures) and the calls of the
+// License Status Server (license updates, fresh licenses, rights accounting). A call is an http request,
+// sent to the public base url of the other server, to its handler when both servers run in the same process,
+// or through a Redis queue consumed by the instances of the other server.
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// transport modes
+const (
+	ModeHTTP      = "http"
+	ModeInProcess = "inprocess"
+	ModeRedis     = "redis"
+)
+
+// ErrUnknownMode is returned when the transport mode of the configuration is not supported
+var ErrUnknownMode = errors.New("Unknown transport mode")
+
+// ErrNotRegistered is returned by the in-process transport when the called server does not run in this process
+var ErrNotRegistered = errors.New("The server does not run in this process")
+
+// ErrTimeout is returned when the called server has not answered in time
+var ErrTimeout = errors.New("The server has not answered in time")
+
+// Transport sends the calls to a server
+type Transport interface {
+	// Do sends a request to the server and returns its response, or an error if there is no response
+	// within the timeout; the request url is the public url of the resource
+	Do(req *http.Request, timeout time.Duration) (*http.Response, error)
+}
+
+// the handlers of the servers running in this process
+var (
+	handlersMutex sync.RWMutex
+	handlers      = make(map[string]http.Handler)
+)
+
+// Serve makes a server available to the calls of the other server: its handler is called directly
+// by the in-process transport, and consumes the queue of the server with the Redis transport.
+//
+func Serve(server string, handler http.Handler) error {
+	handlersMutex.Lock()
+	handlers[server] = handler
+	handlersMutex.Unlock()
+
+	if config.Config.Transport.Mode != ModeRedis {
+		return nil
+	}
+	q, err := openQueues(config.Config.Transport.RedisURL)
+	if err != nil {
+		return err
+	}
+	go q.consume(server, handler)
+	log.Println("Transport: consuming the calls to the " + server + " from Redis")
+	return nil
+}
+
+// To returns the transport of the calls to a server, defined in the configuration
+//
+func To(server string) Transport {
+	switch config.Config.Transport.Mode {
+	case "", ModeHTTP:
+		return httpTransport{}
+	case ModeInProcess:
+		return inProcess{server: server}
+	case ModeRedis:
+		q, err := openQueues(config.Config.Transport.RedisURL)
+		if err != nil {
+			return failing{err: err}
+		}
+		return redisTransport{queues: q, server: server}
+	default:
+		return failing{err: ErrUnknownMode}
+	}
+}
+
+// httpTransport sends the calls to the public base url of the server
+type httpTransport struct{}
+
+func (httpTransport) Do(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	client := &http.Client{Timeout: timeout}
+	return client.Do(req)
+}
+
+// inProcess calls the handler of the server, running in the same process
+type inProcess struct {
+	server string
+}
+
+func (t inProcess) Do(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	handlersMutex.RLock()
+	handler := handlers[t.server]
+	handlersMutex.RUnlock()
+	if handler == nil {
+		return nil, ErrNotRegistered
+	}
+	return serveLocal(handler, req, remoteInProcess, timeout)
+}
+
+// failing is the transport of an invalid configuration
+type failing struct {
+	err error
+}
+
+func (t failing) Do(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	return nil, t.err
+}
+
+// remote addresses of the local calls: they are not ip addresses, so that they never match an allowed ip
+const (
+	remoteInProcess = "inprocess"
+	remoteRedis     = "redis"
+)
+
+// serveLocal handles a request with the handler of a server and returns the response; the handler
+// is not interrupted by the timeout, but its response is then ignored
+//
+func serveLocal(handler http.Handler, req *http.Request, remote string, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	in := req.Clone(ctx)
+	in.RequestURI = req.URL.RequestURI()
+	in.RemoteAddr = remote
+	if in.Body == nil {
+		in.Body = http.NoBody
+	}
+
+	rec := &recorder{header: make(http.Header)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Transport: panic in %s %s: %v", in.Method, in.RequestURI, r)
+				rec.WriteHeader(http.StatusInternalServerError)
+			}
+		}()
+		handler.ServeHTTP(rec, in)
+	}()
+	select {
+	case <-done:
+		return rec.response(req), nil
+	case <-ctx.Done():
+		return nil, ErrTimeout
+	}
+}
+
+// recorder records the response of a handler
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(b)
+}
+
+// Flush is a no-op, the response is returned once complete
+func (rec *recorder) Flush() {}
+
+// response returns the recorded response to a request
+func (rec *recorder) response(req *http.Request) *http.Response {
+	return newResponse(req, rec.status, rec.header, rec.body.Bytes())
+}
+
+// newResponse returns an http response, as received from a server
+func newResponse(req *http.Request, status int, header http.Header, body []byte) *http.Response {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package transport
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// echo answers with the method, the uri, the credentials, the remote address and the body of the request
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	username, _, _ := r.BasicAuth()
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(r.Method + " " + r.RequestURI + " " + username + " " + r.RemoteAddr + " " + string(body)))
+})
+
+func call(t *testing.T, tr Transport, url string, timeout time.Duration) (*http.Response, string, error) {
+	req, err := http.NewRequest("PUT", url, strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("lcp", "secret")
+	resp, err := tr.Do(req, timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(body), nil
+}
+
+func TestInProcess(t *testing.T) {
+	config.Config.Transport = config.Transport{Mode: ModeInProcess}
+	defer func() { config.Config.Transport = config.Transport{} }()
+
+	if _, _, err := call(t, To("unknown"), "http://lsd.example.com/licenses", time.Second); err != ErrNotRegistered {
+		t.Errorf("Expected a server out of this process to be reported, got %v", err)
+	}
+
+	if err := Serve("echo", echo); err != nil {
+		t.Fatal(err)
+	}
+	resp, body, err := call(t, To("echo"), "http://lsd.example.com/licenses?tenant=a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected the status and headers of the handler, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if body != "PUT /licenses?tenant=a lcp inprocess payload" {
+		t.Errorf("Expected the request to be handled in process, got %q", body)
+	}
+
+	slow := make(chan struct{})
+	defer close(slow)
+	Serve("slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-slow }))
+	if _, _, err := call(t, To("slow"), "http://lcp.example.com/licenses/1", 50*time.Millisecond); err != ErrTimeout {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+
+	Serve("panic", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { panic("boom") }))
+	if resp, _, err := call(t, To("panic"), "http://lcp.example.com/licenses/1", time.Second); err != nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected a panic to be an internal error, got %v", err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	resp, body, err := call(t, To("echo"), server.URL+"/licenses", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || !strings.HasPrefix(body, "PUT /licenses lcp 127.0.0.1:") {
+		t.Errorf("Expected the request to be sent over http, got %d %q", resp.StatusCode, body)
+	}
+
+	config.Config.Transport = config.Transport{Mode: "pigeon"}
+	defer func() { config.Config.Transport = config.Transport{} }()
+	if _, _, err := call(t, To("echo"), server.URL+"/licenses", time.Second); err != ErrUnknownMode {
+		t.Errorf("Expected an unknown mode to be reported, got %v", err)
+	}
+}
@@ -29,10 +29,17 @@ import (
 	"encoding/xml"
 	"io"
 	"net/url"
+	"strings"
 
 	"golang.org/x/net/html/charset"
 )
 
+// font obfuscation algorithms
+const (
+	ObfuscationIDPF  = "http://www.idpf.org/2008/embedding"
+	ObfuscationAdobe = "http://ns.adobe.com/pdf/enc#RC"
+)
+
 type Manifest struct {
 	//Keys []Key
 	Data    []Data   `xml:"http://www.w3.org/2001/04/xmlenc# EncryptedData"`
@@ -40,6 +47,8 @@ type Manifest struct {
 }
 
 // DataForFile returns the EncryptedData item corresponding to a given path
+// URIs are compared once unescaped, as encryption.xml files found in the wild
+// do not always escape them.
 func (m Manifest) DataForFile(path string) (Data, bool) {
 	fileUri, err := url.Parse(path)
 	if err != nil {
@@ -53,9 +62,30 @@ func (m Manifest) DataForFile(path string) (Data, bool) {
 		}
 	}
 
+	for _, datum := range m.Data {
+		if unescapeURI(datum.CipherData.CipherReference.URI) == path {
+			return datum, true
+		}
+	}
+
 	return Data{}, false
 }
 
+// IsObfuscation returns true if the EncryptedData item describes an obfuscated font
+// (IDPF or Adobe algorithm), which must be kept as is in the publication
+func (d Data) IsObfuscation() bool {
+	return d.Method.Algorithm == ObfuscationIDPF || d.Method.Algorithm == ObfuscationAdobe
+}
+
+// unescapeURI returns the path in the container corresponding to a cipher reference
+func unescapeURI(uri URI) string {
+	path, err := url.PathUnescape(string(uri))
+	if err != nil {
+		path = string(uri)
+	}
+	return strings.TrimPrefix(path, "/")
+}
+
 // Write writes the encryption XML structure
 func (m Manifest) Write(w io.Writer) error {
 	w.Write([]byte(xml.Header))